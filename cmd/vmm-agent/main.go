@@ -0,0 +1,41 @@
+// vmm-agent runs inside VMs and answers the host over the Firecracker vsock
+// device: command execution, file transfer, health reports, clean shutdown
+// and clock sync. It is installed into images by scripts/build-rootfs.sh.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/mdlayher/vsock"
+
+	"github.com/raesene/baremetalvmm/internal/agent"
+)
+
+var (
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
+)
+
+func main() {
+	port := flag.Uint("port", agent.Port, "vsock port to listen on")
+	showVersion := flag.Bool("version", false, "Show version information")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("vmm-agent version %s\ncommit: %s\nbuilt: %s\n", version, commit, date)
+		os.Exit(0)
+	}
+
+	ln, err := vsock.Listen(uint32(*port), nil)
+	if err != nil {
+		log.Fatalf("Failed to listen on vsock port %d: %v", *port, err)
+	}
+	log.Printf("vmm-agent %s listening on vsock port %d", version, *port)
+	if err := agent.NewServer(version).Serve(ln); err != nil {
+		log.Fatalf("Server error: %v", err)
+	}
+}
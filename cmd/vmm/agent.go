@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/raesene/baremetalvmm/internal/agent"
+	"github.com/raesene/baremetalvmm/internal/daemon"
+	"github.com/raesene/baremetalvmm/internal/validate"
+	"github.com/raesene/baremetalvmm/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+// agentClient returns a client for a running VM's guest agent.
+func agentClient(name string) (*agent.Client, error) {
+	if err := validate.VMName(name); err != nil {
+		return nil, err
+	}
+	v, err := daemon.Open(cfg).Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if v.State != vm.StateRunning {
+		return nil, fmt.Errorf("VM '%s' is not running", name)
+	}
+	return agent.NewClient(v.VsockPath()), nil
+}
+
+// interruptContext returns a context cancelled by Ctrl+C.
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+func agentCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "agent",
+		Short: "Talk to the guest agent of a VM",
+		Long: `Talk to vmm-agent, the guest agent in images built by scripts/build-rootfs.sh.
+The agent is reached over the VM's vsock device rather than the network, so it
+works even when guest networking is broken. Talking to it needs root.`,
+	}
+
+	cmd.AddCommand(agentStatusCmd(), agentWaitCmd(), agentSyncTimeCmd())
+	return cmd
+}
+
+func agentStatusCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:               "status <name>",
+		Short:             "Show a VM's health as reported by its guest agent",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := agentClient(args[0])
+			if err != nil {
+				return err
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			h, err := client.Ping(ctx)
+			if err != nil {
+				return err
+			}
+			printHealth(h)
+			return nil
+		},
+	}
+}
+
+func agentWaitCmd() *cobra.Command {
+	var timeout time.Duration
+
+	cmd := &cobra.Command{
+		Use:               "wait <name>",
+		Short:             "Wait until a VM's guest has finished booting",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := agentClient(args[0])
+			if err != nil {
+				return err
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			h, err := client.WaitReady(ctx, time.Second)
+			if err != nil {
+				return fmt.Errorf("VM '%s' did not become ready: %w", args[0], err)
+			}
+			fmt.Printf("VM '%s' is ready (system state: %s)\n", args[0], displayState(h.SystemState))
+			return nil
+		},
+	}
+
+	cmd.Flags().DurationVar(&timeout, "timeout", 2*time.Minute, "How long to wait")
+
+	return cmd
+}
+
+func agentSyncTimeCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:               "sync-time <name>",
+		Short:             "Set a VM's clock to the host's",
+		Long:              "Set a VM's clock to the host's. Restoring a snapshot does this automatically.",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := agentClient(args[0])
+			if err != nil {
+				return err
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := client.SyncTime(ctx); err != nil {
+				return fmt.Errorf("failed to sync clock: %w", err)
+			}
+			fmt.Printf("Clock of VM '%s' set to %s\n", args[0], time.Now().Format(time.RFC3339))
+			return nil
+		},
+	}
+}
+
+func printHealth(h *agent.Health) {
+	fmt.Printf("Agent version:  %s\n", h.Version)
+	fmt.Printf("Hostname:       %s\n", h.Hostname)
+	fmt.Printf("Kernel:         %s\n", h.Kernel)
+	fmt.Printf("Uptime:         %s\n", time.Duration(h.Uptime)*time.Second)
+	fmt.Printf("Load average:   %s\n", strings.Join(h.Load[:], " "))
+	fmt.Printf("System state:   %s\n", displayState(h.SystemState))
+	skew := h.Time.Sub(time.Now()).Round(time.Millisecond)
+	fmt.Printf("Guest clock:    %s (%s from host)\n", h.Time.Format(time.RFC3339), skew)
+}
+
+// displayState shows a missing systemd state as such.
+func displayState(state string) string {
+	if state == "" {
+		return "(no systemd)"
+	}
+	return state
+}
+
+func execCmd() *cobra.Command {
+	var env []string
+	var dir string
+	var stdin bool
+
+	cmd := &cobra.Command{
+		Use:   "exec <name> -- <command> [args...]",
+		Short: "Run a command in a VM through its guest agent",
+		Long: `Run a command in a VM through its guest agent and exit with the command's
+exit code. Unlike 'vmm ssh' this needs no guest networking. The command is not
+run in a shell; use "sh -c" for pipes and redirection.`,
+		Example: `  vmm exec web -- systemctl status nginx
+  vmm exec web --env DEBUG=1 -- /opt/app/check.sh
+  cat script.sh | vmm exec web -i -- sh`,
+		Args:              cobra.MinimumNArgs(2),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := agentClient(args[0])
+			if err != nil {
+				return err
+			}
+			req := agent.ExecRequest{Command: args[1:], Env: env, Dir: dir}
+			if stdin {
+				if req.Stdin, err = io.ReadAll(os.Stdin); err != nil {
+					return fmt.Errorf("failed to read standard input: %w", err)
+				}
+			}
+
+			ctx, cancel := interruptContext()
+			defer cancel()
+			code, err := client.Exec(ctx, req, os.Stdout, os.Stderr)
+			if err != nil {
+				return err
+			}
+			if code != 0 {
+				os.Exit(code)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringArrayVarP(&env, "env", "e", nil, "Set an environment variable (KEY=value, can be repeated)")
+	cmd.Flags().StringVarP(&dir, "workdir", "w", "", "Working directory in the guest")
+	cmd.Flags().BoolVarP(&stdin, "stdin", "i", false, "Pass standard input to the command")
+
+	return cmd
+}
+
+func cpCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cp <src> <dst>",
+		Short: "Copy a file to or from a VM through its guest agent",
+		Long: `Copy a single file between the host and a VM through its guest agent. One of
+the paths names the VM as <name>:<absolute-path>. Copying into a directory
+keeps the file name.`,
+		Example: `  vmm cp ./app.conf web:/etc/app/app.conf
+  vmm cp web:/var/log/syslog ./web-syslog`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			srcVM, srcPath := splitVMPath(args[0])
+			dstVM, dstPath := splitVMPath(args[1])
+			switch {
+			case srcVM == "" && dstVM != "":
+				return pushFile(dstVM, srcPath, dstPath)
+			case srcVM != "" && dstVM == "":
+				return pullFile(srcVM, srcPath, dstPath)
+			default:
+				return fmt.Errorf("exactly one of the paths must be in a VM, written as <name>:<path>")
+			}
+		},
+	}
+	return cmd
+}
+
+// splitVMPath splits "name:/path" into the VM name and guest path. A local
+// path gives an empty name.
+func splitVMPath(arg string) (name, path string) {
+	if i := strings.Index(arg, ":"); i > 0 && !strings.Contains(arg[:i], "/") {
+		return arg[:i], arg[i+1:]
+	}
+	return "", arg
+}
+
+func pushFile(name, src, dst string) error {
+	client, err := agentClient(name)
+	if err != nil {
+		return err
+	}
+	if !filepath.IsAbs(dst) {
+		return fmt.Errorf("guest path '%s' must be absolute", dst)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", src)
+	}
+	if strings.HasSuffix(dst, "/") {
+		dst += filepath.Base(src)
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	if err := client.Push(ctx, f, info.Size(), dst, info.Mode()); err != nil {
+		return fmt.Errorf("failed to copy to VM: %w", err)
+	}
+	fmt.Printf("Copied %s to %s:%s (%s)\n", src, name, dst, formatBytes(info.Size()))
+	return nil
+}
+
+func pullFile(name, src, dst string) error {
+	client, err := agentClient(name)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(dst); err == nil && info.IsDir() {
+		dst = filepath.Join(dst, filepath.Base(src))
+	}
+	// Write next to the destination and rename, so a failed copy leaves any
+	// existing file alone
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".vmm-cp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", dst, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	mode, err := client.Pull(ctx, src, tmp)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to copy from VM: %w", err)
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return fmt.Errorf("failed to write %s: %w", dst, err)
+	}
+	fmt.Printf("Copied %s:%s to %s\n", name, src, dst)
+	return nil
+}
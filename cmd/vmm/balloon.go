@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/raesene/baremetalvmm/internal/daemon"
+	"github.com/raesene/baremetalvmm/internal/validate"
+	"github.com/raesene/baremetalvmm/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+func balloonCmd() *cobra.Command {
+	var target int
+
+	cmd := &cobra.Command{
+		Use:   "balloon <name> --target <MB>",
+		Short: "Set the size of a VM's memory balloon",
+		Long: `Set how much of a VM's memory is held by its balloon device. Inflating the
+balloon takes memory the guest is not using and returns it to the host;
+deflating it gives the memory back. The guest needs the virtio-balloon driver,
+and the balloon deflates by itself if the guest runs out of memory.
+
+The size is kept with the VM: a running VM's balloon is resized straight away,
+and a stopped VM's is inflated to it when the VM boots. Use 'vmm stats' to see
+how far the guest has got.`,
+		Example: `  # Take 512 MB back from an idle VM
+  vmm balloon worker-1 --target 512
+
+  # Give it all back
+  vmm balloon worker-1 --target 0`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validate.VMName(name); err != nil {
+				return err
+			}
+			updated, err := daemon.Open(cfg).SetBalloon(name, target)
+			if err != nil {
+				return fmt.Errorf("failed to set balloon: %w", err)
+			}
+			if updated.State.Active() {
+				fmt.Printf("Balloon of VM '%s' set to %d MB\n", name, updated.BalloonMB)
+			} else {
+				fmt.Printf("Balloon of VM '%s' set to %d MB (applied when the VM starts)\n", name, updated.BalloonMB)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().IntVar(&target, "target", 0, "Memory for the balloon to hold, in MB (0 deflates it)")
+	cmd.MarkFlagRequired("target")
+
+	return cmd
+}
+
+func statsCmd() *cobra.Command {
+	var watch bool
+	var interval time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "stats [name...]",
+		Short: "Show memory balloon statistics of running VMs",
+		Long: `Show the balloon size of running VMs and the memory statistics their guests
+report through the balloon driver, which refreshes them every few seconds.
+Guests without the driver show no statistics.`,
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			for _, name := range args {
+				if err := validate.VMName(name); err != nil {
+					return err
+				}
+			}
+			backend := daemon.Open(cfg)
+			for {
+				if err := printStats(backend, args); err != nil {
+					return err
+				}
+				if !watch {
+					return nil
+				}
+				time.Sleep(interval)
+				fmt.Println()
+			}
+		},
+	}
+
+	cmd.Flags().BoolVarP(&watch, "watch", "w", false, "Keep printing statistics")
+	cmd.Flags().DurationVar(&interval, "interval", 5*time.Second, "Time between updates with --watch")
+
+	return cmd
+}
+
+// printStats prints a table of the balloon statistics of the named VMs, or
+// of every running VM when names is empty.
+func printStats(backend daemon.Backend, names []string) error {
+	var vms []*vm.VM
+	if len(names) == 0 {
+		all, err := backend.List()
+		if err != nil {
+			return fmt.Errorf("failed to list VMs: %w", err)
+		}
+		for _, v := range all {
+			if v.State == vm.StateRunning {
+				vms = append(vms, v)
+			}
+		}
+		if len(vms) == 0 {
+			fmt.Println("No running VMs")
+			return nil
+		}
+	} else {
+		for _, name := range names {
+			v, err := backend.Get(name)
+			if err != nil {
+				return err
+			}
+			vms = append(vms, v)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tMEMORY\tBALLOON\tGUEST TOTAL\tAVAILABLE\tFREE\tMAJOR FAULTS\tSWAP IN/OUT")
+	for _, v := range vms {
+		if v.State != vm.StateRunning {
+			fmt.Fprintf(w, "%s\t%d MB\t%s\t-\t-\t-\t-\t-\n", v.Name, v.MemoryMB, v.State)
+			continue
+		}
+		st, err := backend.BalloonStats(v.Name)
+		if err != nil {
+			fmt.Fprintf(w, "%s\t%d MB\t(unavailable)\t-\t-\t-\t-\t-\n", v.Name, v.MemoryMB)
+			continue
+		}
+		balloon := fmt.Sprintf("%d MB", st.ActualMB)
+		if st.ActualMB != st.TargetMB {
+			balloon = fmt.Sprintf("%d -> %d MB", st.ActualMB, st.TargetMB)
+		}
+		if st.TotalMemory == 0 {
+			fmt.Fprintf(w, "%s\t%d MB\t%s\t-\t-\t-\t-\t-\n", v.Name, v.MemoryMB, balloon)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d MB\t%s\t%s\t%s\t%s\t%d\t%d/%d\n",
+			v.Name, v.MemoryMB, balloon, formatBytes(st.TotalMemory), formatBytes(st.AvailableMemory),
+			formatBytes(st.FreeMemory), st.MajorFaults, st.SwapIn, st.SwapOut)
+	}
+	return w.Flush()
+}
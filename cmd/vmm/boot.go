@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/raesene/baremetalvmm/internal/daemon"
+	"github.com/raesene/baremetalvmm/internal/validate"
+	"github.com/spf13/cobra"
+)
+
+func bootCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "boot",
+		Short: "Manage how a VM boots",
+		Long: `Manage the kernel, extra kernel arguments and initrd a VM boots with.
+
+The extra arguments are appended to the command line vmm builds itself
+("console=ttyS0 reboot=k panic=1 pci=off" and the network configuration), so
+a repeated parameter overrides the default. Boot settings can only be changed
+while the VM is stopped.`,
+	}
+
+	cmd.AddCommand(bootShowCmd(), bootSetCmd())
+	return cmd
+}
+
+func bootShowCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:               "show <name>",
+		Short:             "Show a VM's boot settings",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validate.VMName(name); err != nil {
+				return err
+			}
+			v, err := daemon.Open(cfg).Get(name)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Boot settings for VM '%s':\n", name)
+			fmt.Printf("  Kernel:      %s\n", orNone(v.Kernel, "(default kernel)"))
+			fmt.Printf("  Kernel args: %s\n", orNone(v.KernelArgs, "(none)"))
+			fmt.Printf("  Initrd:      %s\n", orNone(v.Initrd, "(none)"))
+			return nil
+		},
+	}
+}
+
+func bootSetCmd() *cobra.Command {
+	var kernelName, kernelArgs, initrdName string
+
+	cmd := &cobra.Command{
+		Use:   "set <name>",
+		Short: "Change a stopped VM's boot settings",
+		Long:  "Change a stopped VM's boot settings. Only the settings given are changed; pass an empty value to go back to the default.",
+		Example: `  # Boot with a debug initrd and verbose logging
+  vmm boot set web --initrd debug --kernel-args "loglevel=7 rd.debug"
+
+  # Go back to the default kernel and no initrd
+  vmm boot set web --kernel "" --initrd ""`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validate.VMName(name); err != nil {
+				return err
+			}
+			flags := cmd.Flags()
+			if !flags.Changed("kernel") && !flags.Changed("kernel-args") && !flags.Changed("initrd") {
+				return fmt.Errorf("specify at least one of --kernel, --kernel-args and --initrd")
+			}
+
+			backend := daemon.Open(cfg)
+			v, err := backend.Get(name)
+			if err != nil {
+				return err
+			}
+			boot := v.Boot()
+			if flags.Changed("kernel") {
+				boot.Kernel = kernelName
+			}
+			if flags.Changed("kernel-args") {
+				boot.KernelArgs = kernelArgs
+			}
+			if flags.Changed("initrd") {
+				boot.Initrd = initrdName
+			}
+			if err := boot.Validate(); err != nil {
+				return err
+			}
+
+			if _, err := backend.SetBoot(name, boot); err != nil {
+				return fmt.Errorf("failed to update boot settings: %w", err)
+			}
+			fmt.Printf("Boot settings for VM '%s' updated (applied when the VM starts)\n", name)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&kernelName, "kernel", "", "Name of kernel to use (from 'vmm kernel import')")
+	cmd.Flags().StringVar(&kernelArgs, "kernel-args", "", "Extra kernel command line arguments, appended to the defaults")
+	cmd.Flags().StringVar(&initrdName, "initrd", "", "Name of initrd to boot with (from 'vmm initrd import')")
+	cmd.RegisterFlagCompletionFunc("kernel", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return completeKernelNames(cmd, nil, toComplete)
+	})
+	cmd.RegisterFlagCompletionFunc("initrd", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return completeInitrdNames(cmd, nil, toComplete)
+	})
+
+	return cmd
+}
+
+// orNone returns value, or placeholder when it is empty.
+func orNone(value, placeholder string) string {
+	if value == "" {
+		return placeholder
+	}
+	return value
+}
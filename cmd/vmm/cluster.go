@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"os"
 	"strings"
@@ -9,9 +8,9 @@ import (
 	"time"
 
 	"github.com/raesene/baremetalvmm/internal/cluster"
+	"github.com/raesene/baremetalvmm/internal/daemon"
 	"github.com/raesene/baremetalvmm/internal/firecracker"
 	"github.com/raesene/baremetalvmm/internal/image"
-	"github.com/raesene/baremetalvmm/internal/mount"
 	"github.com/raesene/baremetalvmm/internal/network"
 	"github.com/raesene/baremetalvmm/internal/sshkey"
 	"github.com/raesene/baremetalvmm/internal/validate"
@@ -283,7 +282,7 @@ func clusterCreateCmd() *cobra.Command {
 				newVM.SSHPublicKey = sshPubKey
 				newVM.SocketPath = fmt.Sprintf("%s/%s.sock", paths.Sockets, vmName)
 
-				if err := newVM.Save(paths.VMs); err != nil {
+				if _, err := daemon.Open(cfg).Create(newVM); err != nil {
 					return fmt.Errorf("failed to save VM '%s': %w", vmName, err)
 				}
 				fmt.Printf("  Created VM '%s'\n", vmName)
@@ -404,90 +403,13 @@ func clusterCreateCmd() *cobra.Command {
 	return cmd
 }
 
+// startClusterVM boots a cluster node and returns its IP address.
 func startClusterVM(vmName string) (string, error) {
-	paths := cfg.GetPaths()
-
-	existingVM, err := vm.Load(paths.VMs, vmName)
-	if err != nil {
-		return "", fmt.Errorf("VM '%s' not found", vmName)
-	}
-
-	imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
-	if err := imgMgr.EnsureDefaultImages(); err != nil {
-		return "", fmt.Errorf("failed to ensure images: %w", err)
-	}
-
-	vmRootfs, err := imgMgr.CreateVMRootfs(vmName, paths.VMs, existingVM.DiskSizeMB, existingVM.Image)
-	if err != nil {
-		return "", fmt.Errorf("failed to create VM rootfs: %w", err)
-	}
-	existingVM.RootfsPath = vmRootfs
-	existingVM.KernelPath = imgMgr.GetKernelPath(existingVM.Kernel)
-
-	if err := sshkey.EnsureKeyPair(paths.SSH); err != nil {
-		return "", fmt.Errorf("failed to ensure vmm SSH key: %w", err)
-	}
-	authorizedKeys, err := sshkey.BuildAuthorizedKeys(paths.SSH, existingVM.SSHPublicKey)
+	started, err := daemon.Open(cfg).Start(vmName)
 	if err != nil {
-		return "", fmt.Errorf("failed to build authorized keys: %w", err)
+		return "", err
 	}
-	if err := image.InjectSSHKey(existingVM.RootfsPath, authorizedKeys); err != nil {
-		return "", fmt.Errorf("failed to inject SSH key: %w", err)
-	}
-
-	if err := image.InjectDNSConfig(existingVM.RootfsPath, existingVM.DNSServers); err != nil {
-		return "", fmt.Errorf("failed to inject DNS config: %w", err)
-	}
-
-	netMgr := network.NewManager(cfg.BridgeName, cfg.Subnet, cfg.Gateway, cfg.HostInterface)
-	if err := netMgr.EnsureBridge(); err != nil {
-		return "", fmt.Errorf("failed to setup bridge: %w", err)
-	}
-
-	if !netMgr.TapExists(existingVM.TapDevice) {
-		if err := netMgr.CreateTap(existingVM.TapDevice); err != nil {
-			return "", fmt.Errorf("failed to create TAP device: %w", err)
-		}
-	}
-
-	ip, err := netMgr.AllocateIP(usedVMIPs(paths.VMs))
-	if err != nil {
-		return "", fmt.Errorf("failed to allocate IP: %w", err)
-	}
-	existingVM.IPAddress = ip
-
-	existingVM.State = vm.StateStarting
-	existingVM.Save(paths.VMs)
-
-	ctx := context.Background()
-	fcClient := firecracker.NewClient()
-	vmCfg := &firecracker.VMConfig{
-		SocketPath: existingVM.SocketPath,
-		KernelPath: existingVM.KernelPath,
-		RootfsPath: existingVM.RootfsPath,
-		CPUs:       existingVM.CPUs,
-		MemoryMB:   existingVM.MemoryMB,
-		TapDevice:  existingVM.TapDevice,
-		MacAddress: existingVM.MacAddress,
-		LogPath:    fmt.Sprintf("%s/%s.log", paths.Logs, vmName),
-		IPAddress:  existingVM.IPAddress,
-		Gateway:    cfg.Gateway,
-		Subnet:     cfg.Subnet,
-	}
-
-	machine, err := fcClient.StartVM(ctx, vmCfg)
-	if err != nil {
-		existingVM.State = vm.StateError
-		existingVM.Save(paths.VMs)
-		return "", fmt.Errorf("failed to start VM: %w", err)
-	}
-
-	existingVM.State = vm.StateRunning
-	existingVM.PID = fcClient.GetVMPID(machine)
-	existingVM.StartedAt = time.Now()
-	existingVM.Save(paths.VMs)
-
-	return ip, nil
+	return started.IPAddress, nil
 }
 
 func clusterDeleteCmd() *cobra.Command {
@@ -517,47 +439,22 @@ func clusterDeleteCmd() *cobra.Command {
 			fmt.Printf("Deleting cluster '%s'...\n", name)
 
 			// Delete all VMs
-			fcClient := firecracker.NewClient()
-			netMgr := network.NewManager(cfg.BridgeName, cfg.Subnet, cfg.Gateway, cfg.HostInterface)
-			imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
+			backend := daemon.Open(cfg)
 
 			var deleteErrors []string
 			for _, vmName := range cl.AllVMs() {
-				existingVM, err := vm.Load(paths.VMs, vmName)
-				if err != nil {
+				if !vm.Exists(paths.VMs, vmName) {
 					fmt.Printf("  Warning: VM '%s' not found, skipping\n", vmName)
 					continue
 				}
 
-				fcClient.UpdateVMState(existingVM)
-				if existingVM.State == vm.StateRunning {
-					fmt.Printf("  Stopping VM '%s'...\n", vmName)
-					ctx := context.Background()
-					if err := fcClient.Terminate(ctx, existingVM); err != nil {
-						// Keep the VM's state file so the surviving process
-						// stays traceable instead of being orphaned.
-						fmt.Printf("  Warning: %v; keeping VM '%s'\n", err, vmName)
-						existingVM.State = vm.StateError
-						if saveErr := existingVM.Save(paths.VMs); saveErr != nil {
-							fmt.Printf("  Warning: failed to save VM state: %v\n", saveErr)
-						}
-						deleteErrors = append(deleteErrors, vmName)
-						continue
-					}
-				}
-
-				if existingVM.TapDevice != "" && netMgr.TapExists(existingVM.TapDevice) {
-					netMgr.DeleteTap(existingVM.TapDevice)
-				}
-				imgMgr.DeleteVMRootfs(vmName, paths.VMs)
-
-				if len(existingVM.Mounts) > 0 {
-					mountMgr := mount.NewManager(paths.Mounts)
-					mountMgr.DeleteAllMountImages(vmName, existingVM.Mounts)
+				// A VM whose process cannot be stopped keeps its state file
+				// so the surviving process stays traceable.
+				if err := backend.Delete(vmName, true); err != nil {
+					fmt.Printf("  Warning: %v; keeping VM '%s'\n", err, vmName)
+					deleteErrors = append(deleteErrors, vmName)
+					continue
 				}
-
-				os.Remove(existingVM.SocketPath)
-				vm.Delete(paths.VMs, vmName)
 				fmt.Printf("  Deleted VM '%s'\n", vmName)
 			}
 
@@ -6,6 +6,7 @@ import (
 	"github.com/raesene/baremetalvmm/internal/cluster"
 	"github.com/raesene/baremetalvmm/internal/image"
 	"github.com/raesene/baremetalvmm/internal/vm"
+	"github.com/raesene/baremetalvmm/internal/volume"
 	"github.com/spf13/cobra"
 )
 
@@ -54,6 +55,23 @@ func completeKernelNames(cmd *cobra.Command, args []string, toComplete string) (
 	return kernels, cobra.ShellCompDirectiveNoFileComp
 }
 
+func completeInitrdNames(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) != 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	paths := cfg.GetPaths()
+	imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
+	initrds, err := imgMgr.ListInitrds()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	var names []string
+	for _, i := range initrds {
+		names = append(names, i.Name)
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
 func completeImageNames(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 	if len(args) != 0 {
 		return nil, cobra.ShellCompDirectiveNoFileComp
@@ -74,15 +92,42 @@ func completeImageNames(cmd *cobra.Command, args []string, toComplete string) ([
 	return names, cobra.ShellCompDirectiveNoFileComp
 }
 
-func usedVMIPs(vmsDir string) []string {
-	vms, _ := vm.List(vmsDir)
-	var ips []string
-	for _, v := range vms {
-		if v.IPAddress != "" {
-			ips = append(ips, v.IPAddress)
-		}
+func completeNetworkNames(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) != 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	defs, err := cfg.Networks().List()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	var names []string
+	for _, d := range defs {
+		names = append(names, d.Name)
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+func completeVolumeNames(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) != 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	volumes, err := volume.NewManager(cfg.GetPaths().Volumes).List()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	var names []string
+	for _, v := range volumes {
+		names = append(names, v.Name)
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeVolumeAndVMNames completes a volume name followed by a VM name.
+func completeVolumeAndVMNames(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) == 1 {
+		return completeVMNames(cmd, nil, toComplete)
 	}
-	return ips
+	return completeVolumeNames(cmd, args, toComplete)
 }
 
 func expandHomePath(path string) string {
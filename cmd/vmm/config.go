@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/raesene/baremetalvmm/internal/config"
 	"github.com/spf13/cobra"
@@ -21,7 +22,24 @@ func configCmd() *cobra.Command {
 			fmt.Printf("Bridge name:       %s\n", cfg.BridgeName)
 			fmt.Printf("Subnet:            %s\n", cfg.Subnet)
 			fmt.Printf("Gateway:           %s\n", cfg.Gateway)
+			if cfg.Subnet6 != "" {
+				fmt.Printf("IPv6 subnet:       %s\n", cfg.Subnet6)
+			}
+			if len(cfg.IPExclude) > 0 {
+				fmt.Printf("Excluded IPs:      %s\n", strings.Join(cfg.IPExclude, ", "))
+			}
 			fmt.Printf("Host interface:    %s\n", cfg.HostInterface)
+			if cfg.DisableDNS {
+				fmt.Printf("Built-in DNS:      disabled\n")
+			} else {
+				fmt.Printf("Built-in DNS:      enabled (served by vmmd)\n")
+			}
+			if len(cfg.DNSUpstream) > 0 {
+				fmt.Printf("DNS upstream:      %s\n", strings.Join(cfg.DNSUpstream, ", "))
+			}
+			if p := cfg.AutoBalloon; p != nil {
+				fmt.Printf("Auto-balloon:      below %d MB host memory available (served by vmmd)\n", p.HostFreeMB)
+			}
 			fmt.Printf("Config file:       %s\n", config.ConfigPath())
 
 			// Display VM defaults
@@ -63,6 +81,20 @@ func configCmd() *cobra.Command {
 				fmt.Printf("  kernel:          (default kernel)\n")
 			}
 
+			// Kernel arguments
+			if defaults.KernelArgs != "" {
+				fmt.Printf("  kernel_args:     %s (from config)\n", defaults.KernelArgs)
+			} else {
+				fmt.Printf("  kernel_args:     (none)\n")
+			}
+
+			// Initrd
+			if defaults.Initrd != "" {
+				fmt.Printf("  initrd:          %s (from config)\n", defaults.Initrd)
+			} else {
+				fmt.Printf("  initrd:          (none)\n")
+			}
+
 			// SSH key path
 			if defaults.SSHKeyPath != "" {
 				fmt.Printf("  ssh_key_path:    %s (from config)\n", defaults.SSHKeyPath)
@@ -77,6 +109,13 @@ func configCmd() *cobra.Command {
 				fmt.Printf("  dns_servers:     [8.8.8.8, 8.8.4.4, 1.1.1.1] (default)\n")
 			}
 
+			// Rate limits
+			if !defaults.RateLimits.Empty() {
+				fmt.Printf("  rate_limits:     %s (from config)\n", defaults.RateLimits.Summary())
+			} else {
+				fmt.Printf("  rate_limits:     (none)\n")
+			}
+
 			return nil
 		},
 	}
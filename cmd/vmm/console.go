@@ -2,15 +2,20 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"sync/atomic"
 	"time"
 
+	"github.com/raesene/baremetalvmm/internal/console"
 	"github.com/raesene/baremetalvmm/internal/firecracker"
 	"github.com/raesene/baremetalvmm/internal/validate"
 	"github.com/raesene/baremetalvmm/internal/vm"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 )
 
 func consoleCmd() *cobra.Command {
@@ -21,7 +26,7 @@ func consoleCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:               "console <name>",
 		Short:             "View serial console output of a microVM",
-		Long:              "Display captured serial console output from a VM, including kernel boot messages and crash output.",
+		Long:              "Display captured serial console output from a VM, including kernel boot messages and crash output.\nUse 'vmm console attach' to type into the console.",
 		Args:              cobra.ExactArgs(1),
 		ValidArgsFunction: completeVMNames,
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -63,6 +68,110 @@ func consoleCmd() *cobra.Command {
 	cmd.Flags().BoolVarP(&follow, "follow", "f", true, "Follow new output (use --follow=false to just show tail)")
 	cmd.Flags().IntVarP(&lines, "lines", "n", 50, "Number of lines to show from the end")
 
+	cmd.AddCommand(consoleAttachCmd())
+
+	return cmd
+}
+
+func consoleAttachCmd() *cobra.Command {
+	var readOnly bool
+
+	cmd := &cobra.Command{
+		Use:   "attach <name>",
+		Short: "Attach to the serial console of a running microVM",
+		Long: `Attach the terminal to a running VM's serial console (ttyS0), to log in when
+SSH is unavailable. Press Ctrl+] to detach; the VM keeps running.
+
+Any number of sessions can watch a console, but only one can type into it.
+Use --read-only to watch while another session is attached. Output is still
+written to the console log.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validate.VMName(name); err != nil {
+				return err
+			}
+			paths := cfg.GetPaths()
+
+			existingVM, err := vm.Load(paths.VMs, name)
+			if err != nil {
+				return fmt.Errorf("VM '%s' not found", name)
+			}
+			consolePath := existingVM.ConsolePath()
+			logPath := firecracker.ConsoleLogPath(fmt.Sprintf("%s/%s.log", paths.Logs, existingVM.Name))
+
+			var input *os.File
+			if readOnly {
+				if !console.Available(consolePath) {
+					return console.ErrNotRunning
+				}
+			} else {
+				if input, err = console.OpenInput(consolePath); err != nil {
+					return err
+				}
+				defer input.Close()
+			}
+
+			if readOnly {
+				fmt.Printf("Watching console of VM '%s' (read-only). Press Ctrl+C to stop.\n", name)
+			} else {
+				fmt.Printf("Connected to console of VM '%s'. Press Ctrl+] to detach.\n", name)
+				fmt.Printf("Press Enter if no login prompt appears.\n")
+			}
+
+			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer cancel()
+
+			// Stop when the VM goes away
+			var stopped atomic.Bool
+			go func() {
+				if console.WaitStopped(ctx, consolePath) {
+					stopped.Store(true)
+					cancel()
+				}
+			}()
+
+			followDone := make(chan error, 1)
+			go func() { followDone <- console.Follow(ctx, logPath, -1, os.Stdout) }()
+
+			raw := false
+			if input != nil {
+				// Raw mode passes every key, including Ctrl+C, to the guest
+				if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+					state, err := term.MakeRaw(fd)
+					if err != nil {
+						cancel()
+						<-followDone
+						return fmt.Errorf("failed to set terminal to raw mode: %w", err)
+					}
+					raw = true
+					defer term.Restore(fd, state)
+				}
+				go func() {
+					io.Copy(input, console.NewEscapeReader(os.Stdin))
+					cancel()
+				}()
+			}
+
+			<-ctx.Done()
+			err = <-followDone
+			// Move off whatever the guest left on the current line
+			eol := "\n"
+			if raw {
+				eol = "\r\n"
+			}
+			if stopped.Load() {
+				fmt.Printf("%sVM '%s' stopped.%s", eol, name, eol)
+			} else {
+				fmt.Printf("%sDetached from console of VM '%s'.%s", eol, name, eol)
+			}
+			return err
+		},
+	}
+
+	cmd.Flags().BoolVar(&readOnly, "read-only", false, "Watch the console without typing into it")
+
 	return cmd
 }
 
@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 
+	"github.com/raesene/baremetalvmm/internal/daemon"
 	"github.com/raesene/baremetalvmm/internal/image"
 	"github.com/raesene/baremetalvmm/internal/mount"
 	"github.com/raesene/baremetalvmm/internal/network"
@@ -20,7 +22,14 @@ func createCmd() *cobra.Command {
 	var dnsServers []string
 	var imageName string
 	var kernelName string
+	var kernelArgs string
+	var initrdName string
 	var mounts []string
+	var staticIP string
+	var networkName string
+	var nicSpecs []string
+	var limits vm.RateLimits
+	var thin bool
 
 	cmd := &cobra.Command{
 		Use:   "create <name>",
@@ -83,6 +92,12 @@ func createCmd() *cobra.Command {
 			if !cmd.Flags().Changed("kernel") && defaults.Kernel != "" {
 				kernelName = defaults.Kernel
 			}
+			if !cmd.Flags().Changed("kernel-args") && defaults.KernelArgs != "" {
+				kernelArgs = defaults.KernelArgs
+			}
+			if !cmd.Flags().Changed("initrd") && defaults.Initrd != "" {
+				initrdName = defaults.Initrd
+			}
 
 			// SSH key path
 			if !cmd.Flags().Changed("ssh-key") && defaults.SSHKeyPath != "" {
@@ -94,6 +109,22 @@ func createCmd() *cobra.Command {
 				dnsServers = defaults.DNSServers
 			}
 
+			// Rate limits: each flag overrides its config default
+			if configured := defaults.RateLimits; configured != nil {
+				if !cmd.Flags().Changed("net-bandwidth") {
+					limits.Net.BandwidthMiB = configured.Net.BandwidthMiB
+				}
+				if !cmd.Flags().Changed("net-ops") {
+					limits.Net.Ops = configured.Net.Ops
+				}
+				if !cmd.Flags().Changed("disk-bandwidth") {
+					limits.Disk.BandwidthMiB = configured.Disk.BandwidthMiB
+				}
+				if !cmd.Flags().Changed("disk-ops") {
+					limits.Disk.Ops = configured.Disk.Ops
+				}
+			}
+
 			// Validate resource bounds
 			if err := validate.CPUs(cpus); err != nil {
 				return err
@@ -109,6 +140,43 @@ func createCmd() *cobra.Command {
 					return err
 				}
 			}
+			if err := limits.Validate(); err != nil {
+				return err
+			}
+			boot := vm.Boot{Kernel: kernelName, KernelArgs: kernelArgs, Initrd: initrdName}
+			if err := boot.Validate(); err != nil {
+				return err
+			}
+
+			// --network and --ip describe a single interface; --nic
+			// describes each interface in guest order
+			nics := []vm.NIC{{Network: networkName, IPAddress: staticIP}}
+			if len(nicSpecs) > 0 {
+				if cmd.Flags().Changed("network") || cmd.Flags().Changed("ip") {
+					return fmt.Errorf("--nic cannot be combined with --network or --ip; describe the first interface with --nic instead")
+				}
+				nics = nil
+				for _, spec := range nicSpecs {
+					nic, err := parseNICSpec(spec)
+					if err != nil {
+						return err
+					}
+					nics = append(nics, nic)
+				}
+			}
+			netDefs := make([]*network.Definition, len(nics))
+			for i, nic := range nics {
+				netDef, err := cfg.Networks().Get(nic.Network)
+				if err != nil {
+					return err
+				}
+				if nic.IPAddress != "" {
+					if err := netDef.IPAM(paths.State).ValidateAddress(nic.IPAddress); err != nil {
+						return err
+					}
+				}
+				netDefs[i] = netDef
+			}
 
 			// Create image manager for validation
 			imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
@@ -126,6 +194,9 @@ func createCmd() *cobra.Command {
 					return fmt.Errorf("kernel '%s' not found. Use 'vmm kernel list' to see available kernels", kernelName)
 				}
 			}
+			if initrdName != "" && !imgMgr.InitrdExists(initrdName) {
+				return fmt.Errorf("initrd '%s' not found. Use 'vmm initrd list' to see available initrds", initrdName)
+			}
 
 			// Parse mount specifications
 			var vmMounts []vm.Mount
@@ -144,10 +215,24 @@ func createCmd() *cobra.Command {
 			newVM.DiskSizeMB = disk
 			newVM.Image = imageName
 			newVM.Kernel = kernelName
-			newVM.MacAddress = newVM.GenerateMacAddress()
-			newVM.TapDevice = network.GenerateTapName(newVM.ID)
+			newVM.KernelArgs = kernelArgs
+			newVM.Initrd = initrdName
+			if thin {
+				newVM.BaseImage = imgMgr.GetDefaultRootfsPath()
+				if imageName != "" {
+					newVM.BaseImage = imgMgr.GetImagePath(imageName)
+				}
+			}
 			newVM.DNSServers = dnsServers
 			newVM.Mounts = vmMounts
+			if !limits.Empty() {
+				newVM.RateLimits = &limits
+			}
+			for i := range nics {
+				nics[i].TapDevice = network.GenerateNICTapName(newVM.ID, i)
+				nics[i].MacAddress = newVM.GenerateNICMacAddress(i)
+			}
+			newVM.NIC, newVM.NICs = nics[0], nics[1:]
 
 			// Set paths
 			newVM.SocketPath = fmt.Sprintf("%s/%s.sock", paths.Sockets, name)
@@ -163,8 +248,9 @@ func createCmd() *cobra.Command {
 			}
 
 			// Save VM config
-			if err := newVM.Save(paths.VMs); err != nil {
-				return fmt.Errorf("failed to save VM config: %w", err)
+			newVM, err := daemon.Open(cfg).Create(newVM)
+			if err != nil {
+				return err
 			}
 
 			fmt.Printf("Created VM '%s' (ID: %s)\n", name, newVM.ID)
@@ -172,16 +258,42 @@ func createCmd() *cobra.Command {
 			if newVM.Image != "" {
 				fmt.Printf("  Image: %s\n", newVM.Image)
 			}
+			if newVM.BaseImage != "" {
+				fmt.Printf("  Disk: copy-on-write overlay of %s\n", newVM.BaseImage)
+			}
 			if newVM.Kernel != "" {
 				fmt.Printf("  Kernel: %s\n", newVM.Kernel)
 			}
-			fmt.Printf("  TAP device: %s, MAC: %s\n", newVM.TapDevice, newVM.MacAddress)
+			if newVM.KernelArgs != "" {
+				fmt.Printf("  Kernel args: %s\n", newVM.KernelArgs)
+			}
+			if newVM.Initrd != "" {
+				fmt.Printf("  Initrd: %s\n", newVM.Initrd)
+			}
+			if len(newVM.NICs) == 0 {
+				fmt.Printf("  Network: %s (%s), TAP device: %s, MAC: %s\n", netDefs[0].Name, netDefs[0].Subnet, newVM.TapDevice, newVM.MacAddress)
+				if newVM.IPAddress != "" {
+					fmt.Printf("  IP address: %s (reserved)\n", newVM.IPAddress)
+				}
+			} else {
+				fmt.Printf("  Interfaces:\n")
+				for i, nic := range newVM.Interfaces() {
+					fmt.Printf("    - %s: %s (%s), TAP device: %s, MAC: %s", vm.InterfaceName(i), netDefs[i].Name, netDefs[i].Subnet, nic.TapDevice, nic.MacAddress)
+					if nic.IPAddress != "" {
+						fmt.Printf(", IP: %s (reserved)", nic.IPAddress)
+					}
+					fmt.Println()
+				}
+			}
 			if newVM.SSHPublicKey != "" {
 				fmt.Printf("  SSH key: configured\n")
 			}
 			if len(newVM.DNSServers) > 0 {
 				fmt.Printf("  DNS servers: %v\n", newVM.DNSServers)
 			}
+			if !newVM.RateLimits.Empty() {
+				fmt.Printf("  Rate limits: %s\n", newVM.RateLimits.Summary())
+			}
 			if len(newVM.Mounts) > 0 {
 				fmt.Printf("  Mounts:\n")
 				for _, m := range newVM.Mounts {
@@ -200,16 +312,56 @@ func createCmd() *cobra.Command {
 	cmd.Flags().IntVar(&memory, "memory", 0, "Memory in MB")
 	cmd.Flags().IntVar(&disk, "disk", 0, "Disk size in MB")
 	cmd.Flags().StringVar(&sshKeyPath, "ssh-key", "", "Path to SSH public key file for root access")
-	cmd.Flags().StringSliceVar(&dnsServers, "dns", nil, "Custom DNS servers (can be specified multiple times)")
+	cmd.Flags().StringSliceVar(&dnsServers, "dns", nil, "Custom DNS servers instead of the built-in vmm.internal resolver (can be specified multiple times)")
 	cmd.Flags().StringVar(&imageName, "image", "", "Name of rootfs image to use (from 'vmm image import')")
+	cmd.Flags().BoolVar(&thin, "thin", false, "Give the VM a copy-on-write overlay of the image instead of its own copy")
 	cmd.Flags().StringVar(&kernelName, "kernel", "", "Name of kernel to use (from 'vmm kernel import')")
+	cmd.Flags().StringVar(&kernelArgs, "kernel-args", "", "Extra kernel command line arguments, appended to the defaults")
+	cmd.Flags().StringVar(&initrdName, "initrd", "", "Name of initrd to boot with (from 'vmm initrd import')")
+	cmd.Flags().StringVar(&networkName, "network", "", "Name of the network to attach the VM to (default network if omitted)")
+	cmd.Flags().StringVar(&staticIP, "ip", "", "Reserve a static IP address for the VM (must be in the network's subnet)")
+	cmd.Flags().StringArrayVar(&nicSpecs, "nic", nil, "Attach a network interface (format: network=<name>[,ip=<addr>]); repeat for eth0, eth1, ...")
 	cmd.Flags().StringArrayVar(&mounts, "mount", nil, "Mount host directory in VM (format: /host/path:tag[:ro|rw])")
+	cmd.Flags().IntVar(&limits.Net.BandwidthMiB, "net-bandwidth", 0, "Limit each network interface to this many MiB/s in each direction (0 = unlimited)")
+	cmd.Flags().IntVar(&limits.Net.Ops, "net-ops", 0, "Limit each network interface to this many packets/s in each direction (0 = unlimited)")
+	cmd.Flags().IntVar(&limits.Disk.BandwidthMiB, "disk-bandwidth", 0, "Limit the rootfs and each mount drive to this many MiB/s (0 = unlimited)")
+	cmd.Flags().IntVar(&limits.Disk.Ops, "disk-ops", 0, "Limit the rootfs and each mount drive to this many requests/s (0 = unlimited)")
 	cmd.RegisterFlagCompletionFunc("kernel", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 		return completeKernelNames(cmd, nil, toComplete)
 	})
+	cmd.RegisterFlagCompletionFunc("initrd", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return completeInitrdNames(cmd, nil, toComplete)
+	})
+	cmd.RegisterFlagCompletionFunc("network", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return completeNetworkNames(cmd, nil, toComplete)
+	})
 	cmd.RegisterFlagCompletionFunc("image", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 		return completeImageNames(cmd, nil, toComplete)
 	})
 
 	return cmd
 }
+
+// parseNICSpec parses a --nic value of the form network=<name>[,ip=<addr>].
+// An omitted network means the default network.
+func parseNICSpec(spec string) (vm.NIC, error) {
+	var nic vm.NIC
+	for _, field := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok || value == "" {
+			return vm.NIC{}, fmt.Errorf("invalid --nic '%s': expected network=<name>[,ip=<addr>]", spec)
+		}
+		switch key {
+		case "network":
+			if err := validate.NetworkName(value); err != nil {
+				return vm.NIC{}, err
+			}
+			nic.Network = value
+		case "ip":
+			nic.IPAddress = value
+		default:
+			return vm.NIC{}, fmt.Errorf("invalid --nic '%s': unknown key '%s'", spec, key)
+		}
+	}
+	return nic, nil
+}
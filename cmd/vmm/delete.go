@@ -1,17 +1,11 @@
 package main
 
 import (
-	"context"
 	"fmt"
-	"os"
+	"strings"
 
-	"github.com/raesene/baremetalvmm/internal/firecracker"
-	"github.com/raesene/baremetalvmm/internal/image"
-	"github.com/raesene/baremetalvmm/internal/mount"
-	"github.com/raesene/baremetalvmm/internal/network"
-	"github.com/raesene/baremetalvmm/internal/snapshot"
+	"github.com/raesene/baremetalvmm/internal/daemon"
 	"github.com/raesene/baremetalvmm/internal/validate"
-	"github.com/raesene/baremetalvmm/internal/vm"
 	"github.com/spf13/cobra"
 )
 
@@ -28,85 +22,25 @@ func deleteCmd() *cobra.Command {
 			if err := validate.VMName(name); err != nil {
 				return err
 			}
-			paths := cfg.GetPaths()
 
-			// Load VM to check state
-			existingVM, err := vm.Load(paths.VMs, name)
-			if err != nil {
-				return fmt.Errorf("VM '%s' not found", name)
-			}
-
-			// Update state based on actual running status
-			fcClient := firecracker.NewClient()
-			fcClient.UpdateVMState(existingVM)
-
-			// Check if running
-			if existingVM.State == vm.StateRunning {
-				if !force {
-					return fmt.Errorf("VM '%s' is running. Use --force to delete anyway", name)
-				}
-				// Stop VM if force. Never delete the VM's state while its
-				// Firecracker process survives, or the process is orphaned
-				// with no record of how to reach it.
-				fmt.Printf("Stopping VM '%s'...\n", name)
-				ctx := context.Background()
-				if err := fcClient.Terminate(ctx, existingVM); err != nil {
-					existingVM.State = vm.StateError
-					if saveErr := existingVM.Save(paths.VMs); saveErr != nil {
-						fmt.Printf("Warning: failed to save VM state: %v\n", saveErr)
-					}
-					return fmt.Errorf("refusing to delete VM '%s': %w", name, err)
-				}
-			}
-
-			// Cleanup network resources
-			netMgr := network.NewManager(cfg.BridgeName, cfg.Subnet, cfg.Gateway, cfg.HostInterface)
-			if existingVM.TapDevice != "" && netMgr.TapExists(existingVM.TapDevice) {
-				if err := netMgr.DeleteTap(existingVM.TapDevice); err != nil {
-					fmt.Printf("Warning: failed to delete TAP device: %v\n", err)
-				}
-			}
-
-			for _, pf := range existingVM.PortForwards {
-				if existingVM.IPAddress != "" {
-					if err := netMgr.RemovePortForward(pf.HostPort, pf.GuestPort, existingVM.IPAddress, pf.Protocol); err != nil {
-						fmt.Printf("Warning: failed to remove port forward %d:%d: %v\n", pf.HostPort, pf.GuestPort, err)
-					}
-				}
-			}
-
-			// Delete VM rootfs
-			imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
-			if err := imgMgr.DeleteVMRootfs(name, paths.VMs); err != nil {
-				fmt.Printf("Warning: failed to delete VM rootfs: %v\n", err)
-			}
-
-			// Delete mount images
-			if len(existingVM.Mounts) > 0 {
-				mountMgr := mount.NewManager(paths.Mounts)
-				if err := mountMgr.DeleteAllMountImages(name, existingVM.Mounts); err != nil {
-					fmt.Printf("Warning: failed to delete mount images: %v\n", err)
+			// Removes the VM's rootfs, mount images, snapshots and state,
+			// but not its volumes. A running VM is stopped first only when
+			// --force is given.
+			backend := daemon.Open(cfg)
+			var volumes []string
+			if v, err := backend.Get(name); err == nil {
+				for _, att := range v.Volumes {
+					volumes = append(volumes, att.Name)
 				}
 			}
-
-			// Delete any snapshots belonging to this VM
-			snapMgr := snapshot.NewManager(paths.Snapshots)
-			if snaps, _ := snapMgr.List(name); len(snaps) > 0 {
-				fmt.Printf("Deleting %d snapshot(s) for VM '%s'...\n", len(snaps), name)
-			}
-			if err := snapMgr.DeleteAllForVM(name); err != nil {
-				fmt.Printf("Warning: failed to delete snapshots: %v\n", err)
-			}
-
-			// Delete socket file
-			os.Remove(existingVM.SocketPath)
-
-			// Delete VM config
-			if err := vm.Delete(paths.VMs, name); err != nil {
-				return fmt.Errorf("failed to delete VM: %w", err)
+			if err := backend.Delete(name, force); err != nil {
+				return err
 			}
 
 			fmt.Printf("Deleted VM '%s'\n", name)
+			if len(volumes) > 0 {
+				fmt.Printf("Kept its volumes: %s\n", strings.Join(volumes, ", "))
+			}
 			return nil
 		},
 	}
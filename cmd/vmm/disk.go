@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/raesene/baremetalvmm/internal/daemon"
+	"github.com/raesene/baremetalvmm/internal/validate"
+	"github.com/spf13/cobra"
+)
+
+func diskCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "disk",
+		Short: "Manage VM disks",
+		Long: `Manage VM root disks.
+
+A VM created with 'vmm create --thin' boots from a copy-on-write overlay of
+its image rather than its own copy: blocks it has not written are read from
+the shared image, so its disk only takes up the space it has changed. The
+image cannot be deleted while thin VMs use it.`,
+	}
+
+	cmd.AddCommand(diskFlattenCmd())
+
+	return cmd
+}
+
+func diskFlattenCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "flatten <name>",
+		Short: "Give a thin VM its own copy of its rootfs",
+		Long: `Copy a thin VM's rootfs, with the changes it has made, into a disk of its
+own, so it no longer depends on its base image. The VM must be stopped.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validate.VMName(name); err != nil {
+				return err
+			}
+
+			if _, err := daemon.OpenWithProgress(cfg, printProgress).Flatten(name); err != nil {
+				return err
+			}
+
+			fmt.Printf("VM '%s' now has its own rootfs\n", name)
+			return nil
+		},
+	}
+	return cmd
+}
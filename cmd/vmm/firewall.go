@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/raesene/baremetalvmm/internal/daemon"
+	"github.com/raesene/baremetalvmm/internal/validate"
+	"github.com/raesene/baremetalvmm/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+func firewallCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "firewall",
+		Short: "Manage per-VM firewall rules",
+		Long: `Manage a VM's firewall. Rules allow or deny traffic to the VM (ingress) or
+from it (egress) by protocol, port and remote address range. They are checked
+in order and the first match decides; traffic no rule matches gets the
+direction's default, which is allow unless changed with 'vmm firewall default'.
+
+Changes to a running VM take effect immediately; otherwise they are applied
+the next time the VM starts.`,
+	}
+
+	cmd.AddCommand(
+		firewallListCmd(),
+		firewallAddCmd(),
+		firewallRemoveCmd(),
+		firewallDefaultCmd(),
+		firewallClearCmd(),
+	)
+
+	return cmd
+}
+
+// loadFirewall returns the VM's firewall policy, or an empty one.
+func loadFirewall(backend daemon.Backend, name string) (*vm.Firewall, error) {
+	if err := validate.VMName(name); err != nil {
+		return nil, err
+	}
+	v, err := backend.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if v.Firewall == nil {
+		return &vm.Firewall{}, nil
+	}
+	return v.Firewall, nil
+}
+
+func firewallListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "list <name>",
+		Short:             "List a VM's firewall rules",
+		Aliases:           []string{"ls"},
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fw, err := loadFirewall(daemon.Open(cfg), args[0])
+			if err != nil {
+				return err
+			}
+			printFirewall(args[0], fw)
+			return nil
+		},
+	}
+	return cmd
+}
+
+func printFirewall(name string, fw *vm.Firewall) {
+	def := func(d string) string {
+		if d == "" {
+			return vm.FirewallAllow
+		}
+		return d
+	}
+	fmt.Printf("Firewall for VM '%s' (default ingress: %s, egress: %s)\n", name, def(fw.DefaultIngress), def(fw.DefaultEgress))
+	if len(fw.Rules) == 0 {
+		fmt.Println("No rules configured")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tDIRECTION\tACTION\tPROTOCOL\tPORT\tCIDR")
+	for i, r := range fw.Rules {
+		proto, port, cidr := r.Protocol, "-", r.CIDR
+		if proto == "" {
+			proto = "any"
+		}
+		if r.Port != 0 {
+			port = strconv.Itoa(r.Port)
+		}
+		if cidr == "" {
+			cidr = "any"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", i+1, r.Direction, r.Action, proto, port, cidr)
+	}
+	w.Flush()
+}
+
+func firewallAddCmd() *cobra.Command {
+	var rule vm.FirewallRule
+	var position int
+
+	cmd := &cobra.Command{
+		Use:   "add <name>",
+		Short: "Add a firewall rule to a VM",
+		Example: `  # Only allow SSH from the LAN into the VM
+  vmm firewall default web --ingress deny
+  vmm firewall add web --direction ingress --action allow --protocol tcp --port 22 --cidr 192.168.1.0/24
+
+  # Stop the VM from reaching other VMs on the default network
+  vmm firewall add web --direction egress --action deny --cidr 172.16.0.0/16`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validate.VMName(name); err != nil {
+				return err
+			}
+			if err := rule.Validate(); err != nil {
+				return err
+			}
+			if position < 0 {
+				return fmt.Errorf("invalid position %d", position)
+			}
+			if _, err := daemon.Open(cfg).AddFirewallRule(name, rule, position); err != nil {
+				return fmt.Errorf("failed to update firewall: %w", err)
+			}
+			fmt.Printf("Firewall rule added: %s\n", rule)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&rule.Direction, "direction", "", "Traffic to the VM (ingress) or from it (egress)")
+	cmd.Flags().StringVar(&rule.Action, "action", "", "allow or deny")
+	cmd.Flags().StringVar(&rule.Protocol, "protocol", "", "tcp, udp, icmp or icmpv6 (default: any)")
+	cmd.Flags().IntVar(&rule.Port, "port", 0, "Destination port, tcp and udp only (default: any)")
+	cmd.Flags().StringVar(&rule.CIDR, "cidr", "", "Remote IPv4 or IPv6 range: the source for ingress, the destination for egress (default: any)")
+	cmd.Flags().IntVar(&position, "position", 0, "Insert the rule at this position (1 = first) instead of appending it")
+	cmd.MarkFlagRequired("direction")
+	cmd.MarkFlagRequired("action")
+
+	return cmd
+}
+
+func firewallRemoveCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "remove <name> <rule-number>",
+		Short:             "Remove a firewall rule from a VM",
+		Aliases:           []string{"rm"},
+		Args:              cobra.ExactArgs(2),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validate.VMName(name); err != nil {
+				return err
+			}
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				return fmt.Errorf("invalid rule number '%s' (see 'vmm firewall list %s')", args[1], name)
+			}
+			if _, err := daemon.Open(cfg).RemoveFirewallRule(name, n); err != nil {
+				return fmt.Errorf("failed to update firewall: %w", err)
+			}
+			fmt.Printf("Firewall rule %d removed from VM '%s'\n", n, name)
+			return nil
+		},
+	}
+	return cmd
+}
+
+func firewallDefaultCmd() *cobra.Command {
+	var ingress, egress string
+
+	cmd := &cobra.Command{
+		Use:               "default <name>",
+		Short:             "Set what happens to traffic no rule matches",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if !cmd.Flags().Changed("ingress") && !cmd.Flags().Changed("egress") {
+				return fmt.Errorf("specify --ingress and/or --egress")
+			}
+			if err := validate.VMName(name); err != nil {
+				return err
+			}
+			defaults := vm.Firewall{DefaultIngress: ingress, DefaultEgress: egress}
+			if err := defaults.Validate(); err != nil {
+				return err
+			}
+			if _, err := daemon.Open(cfg).SetFirewallDefaults(name, ingress, egress); err != nil {
+				return fmt.Errorf("failed to update firewall: %w", err)
+			}
+			fmt.Printf("Firewall defaults for VM '%s' updated\n", name)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&ingress, "ingress", "", "Default for traffic to the VM (allow or deny)")
+	cmd.Flags().StringVar(&egress, "egress", "", "Default for traffic from the VM (allow or deny)")
+
+	return cmd
+}
+
+func firewallClearCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "clear <name>",
+		Short:             "Remove all firewall rules and defaults from a VM",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validate.VMName(name); err != nil {
+				return err
+			}
+			if _, err := daemon.Open(cfg).SetFirewall(name, nil); err != nil {
+				return fmt.Errorf("failed to clear firewall: %w", err)
+			}
+			fmt.Printf("Firewall cleared for VM '%s'\n", name)
+			return nil
+		},
+	}
+	return cmd
+}
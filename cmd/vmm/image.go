@@ -3,8 +3,9 @@ package main
 import (
 	"fmt"
 
-	"github.com/raesene/baremetalvmm/internal/firecracker"
+	"github.com/raesene/baremetalvmm/internal/daemon"
 	"github.com/raesene/baremetalvmm/internal/image"
+	"github.com/raesene/baremetalvmm/internal/lock"
 	"github.com/raesene/baremetalvmm/internal/validate"
 	"github.com/raesene/baremetalvmm/internal/vm"
 	"github.com/spf13/cobra"
@@ -130,8 +131,13 @@ Examples:
 			}
 
 			force, _ := cmd.Flags().GetBool("force")
-			if imgMgr.ImageExists(name) && !force {
-				return fmt.Errorf("image '%s' already exists locally. Use --force to overwrite", name)
+			if imgMgr.ImageExists(name) {
+				if !force {
+					return fmt.Errorf("image '%s' already exists locally. Use --force to overwrite", name)
+				}
+				if err := checkImageUnused(imgMgr, name); err != nil {
+					return err
+				}
 			}
 
 			fmt.Println("Querying GitHub releases...")
@@ -142,6 +148,13 @@ Examples:
 
 			for _, r := range releases {
 				if r.Type == "rootfs" && r.LocalName == name {
+					// The old image goes first, so no thin VM is created on
+					// it while its replacement is written
+					if force && imgMgr.ImageExists(name) {
+						if err := deleteUnusedImage(imgMgr, name); err != nil {
+							return err
+						}
+					}
 					fmt.Printf("Downloading %s (%s)...\n", r.LocalName, r.Tag)
 					if err := imgMgr.DownloadRootfsFromRelease(r.DownloadURL, r.LocalName); err != nil {
 						return fmt.Errorf("download failed: %w", err)
@@ -211,7 +224,7 @@ Examples:
 			paths := cfg.GetPaths()
 			imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
 
-			if err := imgMgr.DeleteImage(name); err != nil {
+			if err := deleteUnusedImage(imgMgr, name); err != nil {
 				return err
 			}
 
@@ -248,21 +261,12 @@ Examples:
 				return err
 			}
 
-			paths := cfg.GetPaths()
-
-			existingVM, err := vm.Load(paths.VMs, vmName)
-			if err != nil {
-				return fmt.Errorf("VM '%s' not found: %w", vmName, err)
-			}
-
-			fcClient := firecracker.NewClient()
-			fcClient.UpdateVMState(existingVM)
-			if existingVM.State == vm.StateRunning {
-				return fmt.Errorf("VM '%s' is running. Stop it first before taking a snapshot", vmName)
+			if err := daemon.OpenWithProgress(cfg, printProgress).SnapshotImage(vmName, imageName); err != nil {
+				return err
 			}
 
-			imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
-			return imgMgr.SnapshotVMRootfs(vmName, paths.VMs, imageName)
+			fmt.Printf("Created image '%s' from VM '%s'\n", imageName, vmName)
+			return nil
 		},
 	}
 	snapshotCmd.Flags().String("name", "", "Name for the snapshot image (required)")
@@ -271,3 +275,27 @@ Examples:
 	cmd.AddCommand(listCmd, pullCmd, importCmd, deleteCmd, snapshotCmd)
 	return cmd
 }
+
+// checkImageUnused refuses to delete or replace an image that thin VMs are
+// overlays of.
+func checkImageUnused(imgMgr *image.Manager, name string) error {
+	if err := vm.CheckBaseImageUnused(cfg.GetPaths().VMs, imgMgr.GetImagePath(name)); err != nil {
+		return fmt.Errorf("cannot remove image '%s': %w (see 'vmm disk flatten')", name, err)
+	}
+	return nil
+}
+
+// deleteUnusedImage deletes an image that no thin VM is an overlay of. The
+// global lock, which lifecycle takes to create a thin VM, is held from the
+// check until the image is gone.
+func deleteUnusedImage(imgMgr *image.Manager, name string) error {
+	gl, err := lock.Global(cfg.GetPaths().State, globalLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer gl.Unlock()
+	if err := checkImageUnused(imgMgr, name); err != nil {
+		return err
+	}
+	return imgMgr.DeleteImage(name)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/raesene/baremetalvmm/internal/image"
+	"github.com/raesene/baremetalvmm/internal/validate"
+	"github.com/raesene/baremetalvmm/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+func initrdCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "initrd",
+		Short: "Manage initrd images",
+		Long: `Manage initrd images that VMs can boot with, set per VM with
+'vmm create --initrd' or 'vmm boot set --initrd'.`,
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List imported initrds",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			paths := cfg.GetPaths()
+			imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
+
+			initrds, err := imgMgr.ListInitrds()
+			if err != nil {
+				return fmt.Errorf("failed to list initrds: %w", err)
+			}
+
+			if len(initrds) == 0 {
+				fmt.Println("No initrds found. Use 'vmm initrd import' to add one.")
+				return nil
+			}
+
+			fmt.Println("Available initrds:")
+			for _, i := range initrds {
+				sizeMB := float64(i.Size) / (1024 * 1024)
+				fmt.Printf("  - %-20s %6.1f MB  %s\n", i.Name, sizeMB, i.Format)
+			}
+
+			return nil
+		},
+	}
+
+	var forceImport bool
+	importCmd := &cobra.Command{
+		Use:   "import <path>",
+		Short: "Import an initrd image",
+		Long: `Import an initrd image.
+
+The image must be a cpio archive, optionally compressed with a method the
+guest kernel supports (gzip, zstd, xz, lz4, bzip2, lzma or lzo).
+
+Examples:
+  vmm initrd import /boot/initrd.img-6.1.0 --name debian-6.1
+  vmm initrd import ./initramfs.cpio.gz --name debug --force`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			srcPath := args[0]
+			name, _ := cmd.Flags().GetString("name")
+
+			if name == "" {
+				return fmt.Errorf("--name is required")
+			}
+			if err := validate.InitrdName(name); err != nil {
+				return err
+			}
+
+			if err := cfg.EnsureDirectories(); err != nil {
+				return fmt.Errorf("failed to create directories: %w", err)
+			}
+
+			paths := cfg.GetPaths()
+			imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
+
+			return imgMgr.ImportInitrd(srcPath, name, forceImport)
+		},
+	}
+	importCmd.Flags().String("name", "", "Name for the imported initrd (required)")
+	importCmd.Flags().BoolVarP(&forceImport, "force", "f", false, "Overwrite existing initrd with same name")
+	importCmd.MarkFlagRequired("name")
+
+	deleteCmd := &cobra.Command{
+		Use:               "delete <name>",
+		Short:             "Delete an initrd",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeInitrdNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validate.InitrdName(name); err != nil {
+				return err
+			}
+			paths := cfg.GetPaths()
+			imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
+
+			// Check if any VMs are using this initrd
+			vms, _ := vm.List(paths.VMs)
+			var usingVMs []string
+			for _, v := range vms {
+				if v.Initrd == name {
+					usingVMs = append(usingVMs, v.Name)
+				}
+			}
+			if len(usingVMs) > 0 {
+				fmt.Printf("Warning: The following VMs are using initrd '%s': %v\n", name, usingVMs)
+				fmt.Println("These VMs will fail to start if the initrd is deleted.")
+			}
+
+			if err := imgMgr.DeleteInitrd(name); err != nil {
+				return err
+			}
+
+			fmt.Printf("Deleted initrd '%s'\n", name)
+			return nil
+		},
+	}
+
+	cmd.AddCommand(listCmd, importCmd, deleteCmd)
+	return cmd
+}
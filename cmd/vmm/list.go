@@ -3,24 +3,32 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 	"text/tabwriter"
 
-	"github.com/raesene/baremetalvmm/internal/firecracker"
+	"github.com/raesene/baremetalvmm/internal/daemon"
+	"github.com/raesene/baremetalvmm/internal/diskfile"
+	"github.com/raesene/baremetalvmm/internal/image"
 	"github.com/raesene/baremetalvmm/internal/vm"
 	"github.com/spf13/cobra"
 )
 
 func listCmd() *cobra.Command {
 	var all bool
+	var output string
 
 	cmd := &cobra.Command{
 		Use:     "list",
 		Short:   "List all microVMs",
 		Aliases: []string{"ls"},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			paths := cfg.GetPaths()
+			if output != "" && output != "wide" {
+				return fmt.Errorf("invalid output format '%s': must be wide", output)
+			}
+			wide := output == "wide"
 
-			vms, err := vm.List(paths.VMs)
+			// States are refreshed from the running process table
+			vms, err := daemon.Open(cfg).List()
 			if err != nil {
 				return fmt.Errorf("failed to list VMs: %w", err)
 			}
@@ -30,14 +38,12 @@ func listCmd() *cobra.Command {
 				return nil
 			}
 
-			// Update state for each VM
-			fcClient := firecracker.NewClient()
-			for _, v := range vms {
-				fcClient.UpdateVMState(v)
-			}
-
 			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-			fmt.Fprintln(w, "NAME\tID\tSTATE\tCPUs\tMEMORY\tIP ADDRESS")
+			if wide {
+				fmt.Fprintln(w, "NAME\tID\tSTATE\tCPUs\tMEMORY\tDISK\tDISK USAGE\tIP ADDRESS\tIPV6 ADDRESS\tNETWORKS\tFIREWALL")
+			} else {
+				fmt.Fprintln(w, "NAME\tID\tSTATE\tCPUs\tMEMORY\tDISK\tDISK USAGE\tIP ADDRESS")
+			}
 			for _, v := range vms {
 				if !all && v.State == vm.StateStopped {
 					continue
@@ -46,8 +52,18 @@ func listCmd() *cobra.Command {
 				if ip == "" {
 					ip = "-"
 				}
-				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d MB\t%s\n",
-					v.Name, v.ID, v.State, v.CPUs, v.MemoryMB, ip)
+				disk, usage := diskSizes(v)
+				if wide {
+					ip6 := v.IPv6Address
+					if ip6 == "" {
+						ip6 = "-"
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d MB\t%s\t%s\t%s\t%s\t%s\t%s\n",
+						v.Name, v.ID, v.State, v.CPUs, v.MemoryMB, disk, usage, ip, ip6, networkNames(v), v.Firewall.Summary())
+					continue
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d MB\t%s\t%s\t%s\n",
+					v.Name, v.ID, v.State, v.CPUs, v.MemoryMB, disk, usage, ip)
 			}
 			w.Flush()
 
@@ -56,6 +72,49 @@ func listCmd() *cobra.Command {
 	}
 
 	cmd.Flags().BoolVarP(&all, "all", "a", true, "Show all VMs including stopped")
+	cmd.Flags().StringVarP(&output, "output", "o", "", "Output format: wide adds IPv6 addresses, networks and firewall policy")
 
 	return cmd
 }
+
+// networkNames lists the networks a VM's interfaces are attached to, in
+// guest order.
+func networkNames(v *vm.VM) string {
+	var names []string
+	for _, nic := range v.Interfaces() {
+		name := nic.Network
+		if name == "" {
+			name = "default"
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, ",")
+}
+
+// diskSizes returns the apparent size of a VM's rootfs and the disk space it
+// takes up, which is less while the image is sparse, or "-" for a VM whose
+// rootfs has not been created yet. A thin VM only takes up the space of the
+// blocks it has written over its base image.
+func diskSizes(v *vm.VM) (string, string) {
+	if v.BaseImage != "" {
+		base, err := os.Stat(v.BaseImage)
+		if err != nil {
+			return "-", "-"
+		}
+		size := max(base.Size(), int64(v.DiskSizeMB)*1024*1024)
+		usage := "0.0 MB (thin)"
+		if cow, err := os.Stat(image.VMOverlayPath(v.Name, cfg.GetPaths().VMs)); err == nil {
+			usage = fmt.Sprintf("%.1f MB (thin)", float64(diskfile.AllocatedSize(cow))/(1024*1024))
+		}
+		return fmt.Sprintf("%.1f MB", float64(size)/(1024*1024)), usage
+	}
+	if v.RootfsPath == "" {
+		return "-", "-"
+	}
+	info, err := os.Stat(v.RootfsPath)
+	if err != nil {
+		return "-", "-"
+	}
+	return fmt.Sprintf("%.1f MB", float64(info.Size())/(1024*1024)),
+		fmt.Sprintf("%.1f MB", float64(diskfile.AllocatedSize(info))/(1024*1024))
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/raesene/baremetalvmm/internal/firecracker"
+	"github.com/raesene/baremetalvmm/internal/lock"
 	"github.com/raesene/baremetalvmm/internal/mount"
 	"github.com/raesene/baremetalvmm/internal/validate"
 	"github.com/raesene/baremetalvmm/internal/vm"
@@ -39,6 +40,12 @@ Example:
 			}
 			paths := cfg.GetPaths()
 
+			vmLock, err := lock.VM(paths.State, vmName)
+			if err != nil {
+				return err
+			}
+			defer vmLock.Unlock()
+
 			// Load VM
 			existingVM, err := vm.Load(paths.VMs, vmName)
 			if err != nil {
@@ -48,8 +55,8 @@ Example:
 			// Check if VM is running
 			fcClient := firecracker.NewClient()
 			fcClient.UpdateVMState(existingVM)
-			if existingVM.State == vm.StateRunning {
-				return fmt.Errorf("VM '%s' is running. Stop it before syncing mounts", vmName)
+			if existingVM.State.Active() {
+				return fmt.Errorf("VM '%s' is %s. Stop it before syncing mounts", vmName, existingVM.State)
 			}
 
 			// Find the mount with the given tag
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/raesene/baremetalvmm/internal/firecracker"
+	"github.com/raesene/baremetalvmm/internal/lock"
+	"github.com/raesene/baremetalvmm/internal/network"
+	"github.com/raesene/baremetalvmm/internal/validate"
+	"github.com/raesene/baremetalvmm/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+// globalLockTimeout matches the wait used by the lifecycle operations.
+const globalLockTimeout = 30 * time.Second
+
+func networkCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "network",
+		Short: "Manage VM networks and IP leases",
+	}
+
+	cmd.AddCommand(
+		networkCreateCmd(),
+		networkListCmd(),
+		networkDeleteCmd(),
+		networkLeasesCmd(),
+	)
+
+	return cmd
+}
+
+func networkCreateCmd() *cobra.Command {
+	var subnet, subnet6, gateway, bridge string
+	var nat, isolated bool
+	var exclude []string
+
+	cmd := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Create a named network with its own bridge and subnet",
+		Long: `Create a named network. VMs are attached to it with 'vmm create --network <name>'.
+
+By default the network is NATed behind the host interface like the default
+network. --nat=false routes the subnet without address translation, and
+--isolated drops all traffic leaving the bridge so VMs can only reach each
+other and the host.
+
+--subnet6 makes the network dual-stack: each VM also gets the IPv6 address
+that embeds its IPv4 address in the low 32 bits of the IPv6 subnet.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validate.NetworkName(name); err != nil {
+				return err
+			}
+			if isolated && cmd.Flags().Changed("nat") {
+				return fmt.Errorf("--isolated and --nat cannot be combined: isolated networks have no outbound access")
+			}
+			if gateway == "" {
+				gw, err := network.DefaultGateway(subnet)
+				if err != nil {
+					return err
+				}
+				gateway = gw
+			}
+			if bridge == "" {
+				bridge = network.DefaultBridgeName(name)
+			}
+
+			mode := network.ModeNAT
+			switch {
+			case isolated:
+				mode = network.ModeIsolated
+			case !nat:
+				mode = network.ModeRouted
+			}
+
+			paths := cfg.GetPaths()
+			gl, err := lock.Global(paths.State, globalLockTimeout)
+			if err != nil {
+				return err
+			}
+			defer gl.Unlock()
+
+			def := &network.Definition{
+				Name:      name,
+				Bridge:    bridge,
+				Subnet:    subnet,
+				Gateway:   gateway,
+				Subnet6:   subnet6,
+				Mode:      mode,
+				IPExclude: exclude,
+			}
+			if err := cfg.Networks().Create(def); err != nil {
+				return err
+			}
+
+			fmt.Printf("Created network '%s'\n", name)
+			fmt.Printf("  Bridge: %s, Subnet: %s, Gateway: %s, Mode: %s\n", def.Bridge, def.Subnet, def.Gateway, def.Mode)
+			if def.Subnet6 != "" {
+				fmt.Printf("  IPv6 subnet: %s, IPv6 gateway: %s\n", def.Subnet6, def.Gateway6())
+			}
+			fmt.Printf("Attach VMs with: vmm create <vm> --network %s\n", name)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&subnet, "subnet", "", "Subnet in CIDR notation (e.g. 10.66.0.0/24)")
+	cmd.Flags().StringVar(&gateway, "gateway", "", "Gateway address on the bridge (default: first address in the subnet)")
+	cmd.Flags().StringVar(&subnet6, "subnet6", "", "IPv6 subnet in CIDR notation for a dual-stack network (e.g. fd00:66::/64)")
+	cmd.Flags().StringVar(&bridge, "bridge", "", "Bridge device name (default: vmm-<name>)")
+	cmd.Flags().BoolVar(&nat, "nat", true, "Masquerade outbound traffic behind the host interface")
+	cmd.Flags().BoolVar(&isolated, "isolated", false, "Block all traffic between the network and anything outside it")
+	cmd.Flags().StringSliceVar(&exclude, "exclude", nil, "Addresses, ranges or CIDRs never allocated automatically (can be repeated)")
+	cmd.MarkFlagRequired("subnet")
+
+	return cmd
+}
+
+func networkListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "list",
+		Short:   "List networks",
+		Aliases: []string{"ls"},
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			defs, err := cfg.Networks().List()
+			if err != nil {
+				return fmt.Errorf("failed to list networks: %w", err)
+			}
+			vms, _ := vm.List(cfg.GetPaths().VMs)
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tBRIDGE\tSUBNET\tGATEWAY\tIPV6 SUBNET\tMODE\tVMS")
+			for _, d := range defs {
+				subnet6 := d.Subnet6
+				if subnet6 == "" {
+					subnet6 = "-"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\n",
+					d.Name, d.Bridge, d.Subnet, d.Gateway, subnet6, d.Mode, len(vmsOnNetwork(vms, d.Name)))
+			}
+			w.Flush()
+			return nil
+		},
+	}
+	return cmd
+}
+
+func networkDeleteCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "delete <name>",
+		Short:             "Delete a network and its bridge",
+		Aliases:           []string{"rm"},
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeNetworkNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validate.NetworkName(name); err != nil {
+				return err
+			}
+			paths := cfg.GetPaths()
+
+			gl, err := lock.Global(paths.State, globalLockTimeout)
+			if err != nil {
+				return err
+			}
+			defer gl.Unlock()
+
+			registry := cfg.Networks()
+			def, err := registry.Get(name)
+			if err != nil {
+				return err
+			}
+			if def.Name == network.DefaultNetwork {
+				return fmt.Errorf("the default network cannot be deleted")
+			}
+			vms, _ := vm.List(paths.VMs)
+			if attached := vmsOnNetwork(vms, name); len(attached) > 0 {
+				return fmt.Errorf("network '%s' is in use by VMs: %s", name, strings.Join(attached, ", "))
+			}
+
+			if err := def.Manager(cfg.HostInterface).DeleteBridge(); err != nil {
+				return err
+			}
+			if err := registry.Delete(name); err != nil {
+				return err
+			}
+			if err := os.Remove(network.LeasesPath(paths.State, name)); err != nil && !os.IsNotExist(err) {
+				fmt.Printf("Warning: failed to remove IP leases: %v\n", err)
+			}
+
+			fmt.Printf("Deleted network '%s'\n", name)
+			return nil
+		},
+	}
+	return cmd
+}
+
+// nicNetworkName returns the name of the network an interface is attached to.
+func nicNetworkName(nic *vm.NIC) string {
+	if nic.Network == "" {
+		return network.DefaultNetwork
+	}
+	return nic.Network
+}
+
+// vmsOnNetwork returns the names of the VMs with an interface on the named
+// network.
+func vmsOnNetwork(vms []*vm.VM, name string) []string {
+	var names []string
+	for _, v := range vms {
+		for _, nic := range v.Interfaces() {
+			if nicNetworkName(nic) == name {
+				names = append(names, v.Name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+func networkLeasesCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "leases [network]",
+		Short: "List IP address leases",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			paths := cfg.GetPaths()
+			defs, err := cfg.Networks().List()
+			if err != nil {
+				return fmt.Errorf("failed to list networks: %w", err)
+			}
+
+			fcClient := firecracker.NewClient()
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			found := false
+			for _, d := range defs {
+				if len(args) == 1 && d.Name != args[0] {
+					continue
+				}
+				leases, err := d.IPAM(paths.State).Leases()
+				if err != nil {
+					return err
+				}
+				for _, l := range leases {
+					if !found {
+						fmt.Fprintln(w, "NETWORK\tIP\tVM\tINTERFACE\tTYPE\tVM STATE\tCREATED")
+						found = true
+					}
+					kind := "dynamic"
+					if l.Static {
+						kind = "static"
+					}
+					vmName, device := l.Owner()
+					state := "(deleted)"
+					if v, err := vm.Load(paths.VMs, vmName); err == nil {
+						fcClient.UpdateVMState(v)
+						state = string(v.State)
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+						d.Name, l.IP, vmName, device, kind, state, l.CreatedAt.Format("2006-01-02 15:04:05"))
+				}
+			}
+			if !found {
+				fmt.Println("No IP leases. VMs are given a lease the first time they start.")
+				return nil
+			}
+			w.Flush()
+			return nil
+		},
+	}
+
+	cmd.AddCommand(networkLeasesReleaseCmd())
+
+	return cmd
+}
+
+func networkLeasesReleaseCmd() *cobra.Command {
+	var force bool
+
+	cmd := &cobra.Command{
+		Use:               "release <vm>",
+		Short:             "Release a VM's IP leases so the addresses can be reused",
+		Long:              "Release the IP leases of all of a VM's interfaces. A stopped VM is given new addresses the next time it starts. Leases left behind by deleted VMs can also be released.",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validate.VMName(name); err != nil {
+				return err
+			}
+			paths := cfg.GetPaths()
+
+			vmLock, err := lock.VM(paths.State, name)
+			if err != nil {
+				return err
+			}
+			defer vmLock.Unlock()
+
+			v, err := vm.Load(paths.VMs, name)
+			if err == nil {
+				firecracker.NewClient().UpdateVMState(v)
+				if v.State.Active() && !force {
+					return fmt.Errorf("VM '%s' is %s and using its leased address; stop it first or use --force", name, v.State)
+				}
+			} else {
+				v = nil
+			}
+
+			gl, err := lock.Global(paths.State, globalLockTimeout)
+			if err != nil {
+				return err
+			}
+			defer gl.Unlock()
+
+			// A deleted VM's leases can be on any network
+			defs, err := cfg.Networks().List()
+			if err != nil {
+				return fmt.Errorf("failed to list networks: %w", err)
+			}
+			var released []network.Lease
+			for _, d := range defs {
+				leases, err := d.IPAM(paths.State).ReleaseVM(name)
+				if err != nil {
+					return fmt.Errorf("failed to release lease: %w", err)
+				}
+				released = append(released, leases...)
+			}
+			if len(released) == 0 {
+				return fmt.Errorf("VM '%s' has no IP lease", name)
+			}
+
+			// Forget the addresses so the next start does not claim them again
+			if v != nil && !v.State.Active() {
+				for _, nic := range v.Interfaces() {
+					nic.IPAddress = ""
+					nic.IPv6Address = ""
+				}
+				if err := v.Save(paths.VMs); err != nil {
+					fmt.Printf("Warning: failed to save VM state: %v\n", err)
+				}
+			}
+
+			for _, l := range released {
+				_, device := l.Owner()
+				fmt.Printf("Released %s from VM '%s' (%s)\n", l.IP, name, device)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "Release the leases even if the VM is running")
+
+	return cmd
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/raesene/baremetalvmm/internal/daemon"
+	"github.com/raesene/baremetalvmm/internal/validate"
+	"github.com/spf13/cobra"
+)
+
+func pauseCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "pause <name>",
+		Short: "Pause a running microVM",
+		Long: `Pause a running microVM. Its vCPUs stop, so it uses no CPU time, but it keeps
+its memory, TAP devices, IP addresses and port forwards. Resume it with
+'vmm resume'.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validate.VMName(name); err != nil {
+				return err
+			}
+			if _, err := daemon.Open(cfg).Pause(name); err != nil {
+				return err
+			}
+			fmt.Printf("VM '%s' paused\n", name)
+			return nil
+		},
+	}
+}
+
+func resumeCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:               "resume <name>",
+		Short:             "Resume a paused microVM",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validate.VMName(name); err != nil {
+				return err
+			}
+			if _, err := daemon.Open(cfg).Resume(name); err != nil {
+				return err
+			}
+			fmt.Printf("VM '%s' resumed\n", name)
+			return nil
+		},
+	}
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
 
-	"github.com/raesene/baremetalvmm/internal/network"
+	"github.com/raesene/baremetalvmm/internal/daemon"
+	"github.com/raesene/baremetalvmm/internal/portproxy"
 	"github.com/raesene/baremetalvmm/internal/validate"
 	"github.com/raesene/baremetalvmm/internal/vm"
 	"github.com/spf13/cobra"
@@ -13,11 +17,28 @@ func portForwardCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "port-forward",
 		Short: "Manage VM port forwards",
+		Long: `Manage the host ports forwarded to a VM. A forward is written as
+<host-port>:<guest-port>[/tcp|udp], where either port may be a range such as
+8000-8010; the protocol defaults to tcp. Forwards are reachable on every host
+address, including 127.0.0.1, and a host port can only be forwarded to one VM.
+
+By default forwards are DNAT rules in the host's nftables. On hosts where
+another tool such as firewalld or Docker owns the packet filter, add them with
+--mode proxy instead: vmmd then listens on the host port itself and relays
+connections to the VM, counting connections and bytes as it goes.
+
+Changes to a running VM take effect immediately; otherwise they are applied
+the next time the VM starts, at whatever address it has then.`,
 	}
 
+	var mode string
 	addCmd := &cobra.Command{
-		Use:               "add <name> <host-port>:<guest-port>",
-		Short:             "Forward a port from host to VM",
+		Use:   "add <name> <host-port>[-<end>]:<guest-port>[-<end>][/tcp|udp]",
+		Short: "Forward a port or range of ports from host to VM",
+		Example: `  vmm port-forward add web 8080:80
+  vmm port-forward add dns 5353:53/udp
+  vmm port-forward add media 10000-10100:10000-10100/udp
+  vmm port-forward add web 8443:443 --mode proxy`,
 		Args:              cobra.ExactArgs(2),
 		ValidArgsFunction: completeVMNames,
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -25,53 +46,34 @@ func portForwardCmd() *cobra.Command {
 			if err := validate.VMName(name); err != nil {
 				return err
 			}
-			portSpec := args[1]
-			paths := cfg.GetPaths()
-
-			existingVM, err := vm.Load(paths.VMs, name)
+			pf, err := vm.ParsePortForward(args[1])
 			if err != nil {
-				return fmt.Errorf("VM '%s' not found", name)
+				return err
 			}
-
-			if existingVM.IPAddress == "" {
-				return fmt.Errorf("VM '%s' has no IP address (is it running?)", name)
+			if mode != vm.ForwardNAT {
+				pf.Mode = mode
+				if err := pf.Validate(); err != nil {
+					return err
+				}
 			}
 
-			var hostPort, guestPort int
-			if _, err := fmt.Sscanf(portSpec, "%d:%d", &hostPort, &guestPort); err != nil {
-				return fmt.Errorf("invalid port spec '%s', expected format: host-port:guest-port", portSpec)
-			}
-			if hostPort < 1 || hostPort > 65535 {
-				return fmt.Errorf("invalid host port %d: must be 1-65535", hostPort)
-			}
-			if guestPort < 1 || guestPort > 65535 {
-				return fmt.Errorf("invalid guest port %d: must be 1-65535", guestPort)
+			backend := daemon.Open(cfg)
+			updated, err := backend.AddPortForward(name, pf)
+			if err != nil {
+				return err
 			}
-
-			// Check if this port forward is already recorded on the VM
-			for _, pf := range existingVM.PortForwards {
-				if pf.HostPort == hostPort && pf.GuestPort == guestPort && pf.Protocol == "tcp" {
-					fmt.Printf("Port forward already exists: %d -> %s:%d\n", hostPort, existingVM.IPAddress, guestPort)
-					return nil
-				}
+			if updated.State.Active() {
+				fmt.Printf("Port forward added: %s -> %s\n", pf, updated.IPAddress)
+			} else {
+				fmt.Printf("Port forward added: %s (applied when the VM starts)\n", pf)
 			}
-
-			netMgr := network.NewManager(cfg.BridgeName, cfg.Subnet, cfg.Gateway, cfg.HostInterface)
-			if err := netMgr.AddPortForward(hostPort, guestPort, existingVM.IPAddress, "tcp"); err != nil {
-				return fmt.Errorf("failed to add port forward: %w", err)
+			if _, inProcess := backend.(*daemon.Service); inProcess && pf.Proxied() {
+				fmt.Println("Note: proxy forwards are relayed by vmmd, which is not running")
 			}
-
-			existingVM.PortForwards = append(existingVM.PortForwards, vm.PortForward{
-				HostPort:  hostPort,
-				GuestPort: guestPort,
-				Protocol:  "tcp",
-			})
-			existingVM.Save(paths.VMs)
-
-			fmt.Printf("Port forward added: %d -> %s:%d\n", hostPort, existingVM.IPAddress, guestPort)
 			return nil
 		},
 	}
+	addCmd.Flags().StringVar(&mode, "mode", vm.ForwardNAT, "How the port is forwarded: nat (nftables DNAT) or proxy (relayed by vmmd)")
 
 	listCmd := &cobra.Command{
 		Use:               "list <name>",
@@ -83,11 +85,11 @@ func portForwardCmd() *cobra.Command {
 			if err := validate.VMName(name); err != nil {
 				return err
 			}
-			paths := cfg.GetPaths()
 
-			existingVM, err := vm.Load(paths.VMs, name)
+			backend := daemon.Open(cfg)
+			existingVM, err := backend.Get(name)
 			if err != nil {
-				return fmt.Errorf("VM '%s' not found", name)
+				return err
 			}
 
 			if len(existingVM.PortForwards) == 0 {
@@ -95,18 +97,53 @@ func portForwardCmd() *cobra.Command {
 				return nil
 			}
 
+			// Proxy forwards have live counters while vmmd relays them
+			stats, err := backend.PortForwardStats()
+			if err != nil {
+				fmt.Printf("Warning: failed to get proxy statistics: %v\n", err)
+			}
+			byPort := make(map[string]portproxy.Stats)
+			for _, st := range stats {
+				if st.VM == name {
+					byPort[fmt.Sprintf("%d/%s", st.HostPort, st.Protocol)] = st
+				}
+			}
+
 			fmt.Printf("Port forwards for VM '%s':\n", name)
-			fmt.Printf("  %-12s %-12s %s\n", "HOST PORT", "GUEST PORT", "PROTOCOL")
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "  HOST PORTS\tGUEST PORTS\tPROTOCOL\tMODE\tCONNECTIONS\tIN\tOUT")
 			for _, pf := range existingVM.PortForwards {
-				fmt.Printf("  %-12d %-12d %s\n", pf.HostPort, pf.GuestPort, pf.Protocol)
+				mode, conns, in, out := vm.ForwardNAT, "-", "-", "-"
+				if pf.Proxied() {
+					mode = vm.ForwardProxy
+					var total portproxy.Stats
+					found := false
+					for port := pf.HostPort; port <= pf.LastHostPort(); port++ {
+						if st, ok := byPort[fmt.Sprintf("%d/%s", port, pf.Protocol)]; ok {
+							found = true
+							total.Active += st.Active
+							total.Connections += st.Connections
+							total.BytesIn += st.BytesIn
+							total.BytesOut += st.BytesOut
+						}
+					}
+					if found {
+						conns = fmt.Sprintf("%d (%d active)", total.Connections, total.Active)
+						in, out = formatBytes(total.BytesIn), formatBytes(total.BytesOut)
+					}
+				}
+				fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+					portSpan(pf.HostPort, pf.LastHostPort()), portSpan(pf.GuestPort, pf.LastGuestPort()), pf.Protocol, mode, conns, in, out)
 			}
+			w.Flush()
 			return nil
 		},
 	}
 
 	removeCmd := &cobra.Command{
-		Use:               "remove <name> <host-port>:<guest-port>",
+		Use:               "remove <name> <host-port>[-<end>][:<guest-port>][/tcp|udp]",
 		Short:             "Remove a port forward from a VM",
+		Long:              "Remove the forward of a host port or range from a VM. The guest port may be left out, since a host port is only ever forwarded once per protocol.",
 		Args:              cobra.ExactArgs(2),
 		ValidArgsFunction: completeVMNames,
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -114,42 +151,15 @@ func portForwardCmd() *cobra.Command {
 			if err := validate.VMName(name); err != nil {
 				return err
 			}
-			portSpec := args[1]
-			paths := cfg.GetPaths()
-
-			existingVM, err := vm.Load(paths.VMs, name)
+			target, err := parseRemoveSpec(args[1])
 			if err != nil {
-				return fmt.Errorf("VM '%s' not found", name)
-			}
-
-			var hostPort, guestPort int
-			if _, err := fmt.Sscanf(portSpec, "%d:%d", &hostPort, &guestPort); err != nil {
-				return fmt.Errorf("invalid port spec '%s', expected format: host-port:guest-port", portSpec)
-			}
-
-			found := -1
-			for i, pf := range existingVM.PortForwards {
-				if pf.HostPort == hostPort && pf.GuestPort == guestPort {
-					found = i
-					break
-				}
-			}
-			if found == -1 {
-				return fmt.Errorf("port forward %d:%d not found on VM '%s'", hostPort, guestPort, name)
+				return err
 			}
 
-			if existingVM.IPAddress != "" {
-				netMgr := network.NewManager(cfg.BridgeName, cfg.Subnet, cfg.Gateway, cfg.HostInterface)
-				protocol := existingVM.PortForwards[found].Protocol
-				if err := netMgr.RemovePortForward(hostPort, guestPort, existingVM.IPAddress, protocol); err != nil {
-					fmt.Printf("Warning: failed to remove iptables rule: %v\n", err)
-				}
+			if _, err := daemon.Open(cfg).RemovePortForward(name, target); err != nil {
+				return err
 			}
-
-			existingVM.PortForwards = append(existingVM.PortForwards[:found], existingVM.PortForwards[found+1:]...)
-			existingVM.Save(paths.VMs)
-
-			fmt.Printf("Port forward removed: %d:%d\n", hostPort, guestPort)
+			fmt.Printf("Port forward removed: %s\n", target.HostPorts())
 			return nil
 		},
 	}
@@ -157,3 +167,42 @@ func portForwardCmd() *cobra.Command {
 	cmd.AddCommand(addCmd, listCmd, removeCmd)
 	return cmd
 }
+
+// parseRemoveSpec parses the forward to remove. Only its host ports and
+// protocol matter, so the guest port is optional.
+func parseRemoveSpec(spec string) (vm.PortForward, error) {
+	if pf, err := vm.ParsePortForward(spec); err == nil {
+		return pf, nil
+	}
+	host, proto := spec, ""
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		host, proto = spec[:i], spec[i:]
+	}
+	pf, err := vm.ParsePortForward(host + ":1" + proto)
+	if err != nil {
+		return pf, fmt.Errorf("invalid port spec '%s', expected format: host-port[:guest-port][/tcp|udp]", spec)
+	}
+	return pf, nil
+}
+
+// formatBytes renders a byte count with a binary unit, e.g. "1.5 MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// portSpan renders a port or range of ports.
+func portSpan(first, last int) string {
+	if first == last {
+		return fmt.Sprint(first)
+	}
+	return fmt.Sprintf("%d-%d", first, last)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/raesene/baremetalvmm/internal/daemon"
+	"github.com/raesene/baremetalvmm/internal/validate"
+	"github.com/raesene/baremetalvmm/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+func rateLimitCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rate-limit",
+		Short: "Manage per-VM network and disk rate limits",
+		Long: `Manage the bandwidth and operations-per-second limits Firecracker enforces on
+a VM's devices. The network limit applies to each interface in each direction,
+and the disk limit to the rootfs and each mount drive separately. A limit of 0
+is unlimited.
+
+Changes to a running VM take effect immediately; otherwise they are applied
+the next time the VM starts.`,
+	}
+
+	cmd.AddCommand(
+		rateLimitShowCmd(),
+		rateLimitSetCmd(),
+		rateLimitClearCmd(),
+	)
+
+	return cmd
+}
+
+func rateLimitShowCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "show <name>",
+		Short:             "Show a VM's rate limits",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validate.VMName(name); err != nil {
+				return err
+			}
+			v, err := daemon.Open(cfg).Get(name)
+			if err != nil {
+				return err
+			}
+			var limits vm.RateLimits
+			if v.RateLimits != nil {
+				limits = *v.RateLimits
+			}
+			fmt.Printf("Rate limits for VM '%s':\n", name)
+			fmt.Printf("  Network: %s\n", limits.Net)
+			fmt.Printf("  Disk:    %s\n", limits.Disk)
+			return nil
+		},
+	}
+	return cmd
+}
+
+func rateLimitSetCmd() *cobra.Command {
+	var set vm.RateLimits
+
+	cmd := &cobra.Command{
+		Use:   "set <name>",
+		Short: "Change a VM's rate limits",
+		Long:  "Change a VM's rate limits. Only the limits given are changed; pass 0 to lift one.",
+		Example: `  # Cap a worker's image pulls and disk writes
+  vmm rate-limit set worker-1 --net-bandwidth 50 --disk-bandwidth 100
+
+  # Lift the network bandwidth limit again
+  vmm rate-limit set worker-1 --net-bandwidth 0`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validate.VMName(name); err != nil {
+				return err
+			}
+			flags := cmd.Flags()
+			if !flags.Changed("net-bandwidth") && !flags.Changed("net-ops") && !flags.Changed("disk-bandwidth") && !flags.Changed("disk-ops") {
+				return fmt.Errorf("specify at least one of --net-bandwidth, --net-ops, --disk-bandwidth and --disk-ops")
+			}
+
+			backend := daemon.Open(cfg)
+			v, err := backend.Get(name)
+			if err != nil {
+				return err
+			}
+			var limits vm.RateLimits
+			if v.RateLimits != nil {
+				limits = *v.RateLimits
+			}
+			if flags.Changed("net-bandwidth") {
+				limits.Net.BandwidthMiB = set.Net.BandwidthMiB
+			}
+			if flags.Changed("net-ops") {
+				limits.Net.Ops = set.Net.Ops
+			}
+			if flags.Changed("disk-bandwidth") {
+				limits.Disk.BandwidthMiB = set.Disk.BandwidthMiB
+			}
+			if flags.Changed("disk-ops") {
+				limits.Disk.Ops = set.Disk.Ops
+			}
+			if err := limits.Validate(); err != nil {
+				return err
+			}
+
+			updated, err := backend.SetRateLimits(name, &limits)
+			if err != nil {
+				return fmt.Errorf("failed to update rate limits: %w", err)
+			}
+			if updated.State.Active() {
+				fmt.Printf("Rate limits for VM '%s' updated: %s\n", name, updated.RateLimits.Summary())
+			} else {
+				fmt.Printf("Rate limits for VM '%s' updated: %s (applied when the VM starts)\n", name, updated.RateLimits.Summary())
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().IntVar(&set.Net.BandwidthMiB, "net-bandwidth", 0, "MiB/s per network interface and direction")
+	cmd.Flags().IntVar(&set.Net.Ops, "net-ops", 0, "Packets/s per network interface and direction")
+	cmd.Flags().IntVar(&set.Disk.BandwidthMiB, "disk-bandwidth", 0, "MiB/s per drive")
+	cmd.Flags().IntVar(&set.Disk.Ops, "disk-ops", 0, "Requests/s per drive")
+
+	return cmd
+}
+
+func rateLimitClearCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "clear <name>",
+		Short:             "Remove all rate limits from a VM",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validate.VMName(name); err != nil {
+				return err
+			}
+			if _, err := daemon.Open(cfg).SetRateLimits(name, nil); err != nil {
+				return fmt.Errorf("failed to clear rate limits: %w", err)
+			}
+			fmt.Printf("Rate limits cleared for VM '%s'\n", name)
+			return nil
+		},
+	}
+	return cmd
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/raesene/baremetalvmm/internal/daemon"
+	"github.com/raesene/baremetalvmm/internal/validate"
+	"github.com/spf13/cobra"
+)
+
+func restartCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:               "restart <name>",
+		Short:             "Restart a microVM",
+		Long:              "Stop a running microVM and start it again. A stopped VM is simply started.",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validate.VMName(name); err != nil {
+				return err
+			}
+
+			fmt.Printf("Restarting VM '%s'...\n", name)
+
+			restarted, err := daemon.OpenWithProgress(cfg, printProgress).Restart(name)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("VM '%s' restarted\n", name)
+			fmt.Printf("  IP Address: %s\n", restarted.IPAddress)
+			if restarted.IPv6Address != "" {
+				fmt.Printf("  IPv6 Address: %s\n", restarted.IPv6Address)
+			}
+			fmt.Printf("  PID: %d\n", restarted.PID)
+
+			return nil
+		},
+	}
+}
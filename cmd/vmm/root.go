@@ -29,13 +29,28 @@ func newRootCmd() *cobra.Command {
 		listCmd(),
 		startCmd(),
 		stopCmd(),
+		pauseCmd(),
+		resumeCmd(),
+		restartCmd(),
 		sshCmd(),
+		execCmd(),
+		cpCmd(),
 		consoleCmd(),
 		configCmd(),
 		imageCmd(),
 		kernelCmd(),
+		initrdCmd(),
+		bootCmd(),
+		networkCmd(),
 		portForwardCmd(),
+		firewallCmd(),
+		rateLimitCmd(),
+		diskCmd(),
+		balloonCmd(),
+		statsCmd(),
+		agentCmd(),
 		mountCmd(),
+		volumeCmd(),
 		snapshotCmd(),
 		clusterCmd(),
 		versionCmd(),
@@ -2,11 +2,18 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 	"text/tabwriter"
 
+	"github.com/raesene/baremetalvmm/internal/daemon"
 	"github.com/raesene/baremetalvmm/internal/firecracker"
+	"github.com/raesene/baremetalvmm/internal/image"
+	"github.com/raesene/baremetalvmm/internal/lock"
+	"github.com/raesene/baremetalvmm/internal/mount"
 	"github.com/raesene/baremetalvmm/internal/network"
 	"github.com/raesene/baremetalvmm/internal/snapshot"
 	"github.com/raesene/baremetalvmm/internal/validate"
@@ -26,8 +33,12 @@ func snapshotCmd() *cobra.Command {
 		snapshotCreateCmd(),
 		snapshotListCmd(),
 		snapshotRestoreCmd(),
+		snapshotCloneCmd(),
 		snapshotShowCmd(),
 		snapshotDeleteCmd(),
+		snapshotExportCmd(),
+		snapshotImportCmd(),
+		snapshotScheduleCmd(),
 	)
 
 	return cmd
@@ -35,10 +46,20 @@ func snapshotCmd() *cobra.Command {
 
 func snapshotCreateCmd() *cobra.Command {
 	var stop bool
+	var opts snapshot.CreateOptions
 
 	cmd := &cobra.Command{
-		Use:               "create <vm> <snapshot-name>",
-		Short:             "Create a snapshot of a running VM",
+		Use:   "create <vm> <snapshot-name>",
+		Short: "Create a snapshot of a running VM",
+		Long: `Create a snapshot of a running VM's memory and disks.
+
+With --diff, only the memory pages and disk blocks that changed since the VM's
+last snapshot (or the snapshot it was restored from) are stored, and that
+snapshot becomes the new one's parent. Restoring a diff snapshot rebuilds the
+full state from the chain of parents.
+
+With --disk-only, only the disks are copied, so the guest is paused for less
+time; restoring such a snapshot boots the VM from its disks.`,
 		Args:              cobra.ExactArgs(2),
 		ValidArgsFunction: completeVMNames,
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -51,6 +72,12 @@ func snapshotCreateCmd() *cobra.Command {
 			}
 			paths := cfg.GetPaths()
 
+			vmLock, err := lock.VM(paths.State, vmName)
+			if err != nil {
+				return err
+			}
+			defer vmLock.Unlock()
+
 			v, err := vm.Load(paths.VMs, vmName)
 			if err != nil {
 				return fmt.Errorf("VM '%s' not found", vmName)
@@ -67,46 +94,45 @@ func snapshotCreateCmd() *cobra.Command {
 				return fmt.Errorf("snapshot '%s' already exists for VM '%s'", snapName, vmName)
 			}
 
-			fmt.Printf("Creating snapshot '%s' of VM '%s' (this pauses the VM briefly)...\n", snapName, vmName)
+			kind := "snapshot"
+			if opts.Diff {
+				kind = "diff snapshot"
+			} else if opts.DiskOnly {
+				kind = "disk-only snapshot"
+			}
+			fmt.Printf("Creating %s '%s' of VM '%s' (this pauses the VM briefly)...\n", kind, snapName, vmName)
 			ctx := context.Background()
-			meta, err := snapMgr.Create(ctx, fcClient, v, snapName, !stop)
+			opts.LeavePaused = stop
+			meta, err := snapMgr.Create(ctx, fcClient, v, snapName, opts)
 			if err != nil {
 				return fmt.Errorf("failed to create snapshot: %w", err)
 			}
+			if err := v.Save(paths.VMs); err != nil {
+				fmt.Printf("Warning: failed to save VM state: %v\n", err)
+			}
 
 			if stop {
-				// The VM was left paused by Create; fully stop it now.
+				// The VM was left paused by Create. Stop takes the VM's
+				// lock itself
+				vmLock.Unlock()
 				fmt.Printf("Stopping VM '%s'...\n", vmName)
-				v.State = vm.StateStopping
-				v.Save(paths.VMs)
-				if err := fcClient.Terminate(ctx, v); err != nil {
-					v.State = vm.StateError
-					v.Save(paths.VMs)
+				if _, err := daemon.OpenWithProgress(cfg, printProgress).Stop(vmName); err != nil {
 					return fmt.Errorf("snapshot created, but failed to stop VM '%s': %w", vmName, err)
 				}
-				netMgr := network.NewManager(cfg.BridgeName, cfg.Subnet, cfg.Gateway, cfg.HostInterface)
-				if v.TapDevice != "" && netMgr.TapExists(v.TapDevice) {
-					if err := netMgr.DeleteTap(v.TapDevice); err != nil {
-						fmt.Printf("Warning: failed to delete TAP device: %v\n", err)
-					}
-				}
-				for _, pf := range v.PortForwards {
-					if v.IPAddress != "" {
-						if err := netMgr.RemovePortForward(pf.HostPort, pf.GuestPort, v.IPAddress, pf.Protocol); err != nil {
-							fmt.Printf("Warning: failed to remove port forward %d:%d: %v\n", pf.HostPort, pf.GuestPort, err)
-						}
-					}
-				}
-				v.State = vm.StateStopped
-				v.Save(paths.VMs)
 			}
 
+			if meta.Diff() {
+				fmt.Printf("Snapshot '%s' created as a diff against '%s' (%.1f MB)\n", snapName, meta.Parent, float64(meta.SizeBytes)/(1024*1024))
+				return nil
+			}
 			fmt.Printf("Snapshot '%s' created (%.1f MB)\n", snapName, float64(meta.SizeBytes)/(1024*1024))
 			return nil
 		},
 	}
 
 	cmd.Flags().BoolVar(&stop, "stop", false, "Stop the VM after taking the snapshot instead of resuming it")
+	cmd.Flags().BoolVar(&opts.Diff, "diff", false, "Store only the changes since the VM's last snapshot")
+	cmd.Flags().BoolVar(&opts.DiskOnly, "disk-only", false, "Copy the disks without the memory, pausing the guest for less time")
 
 	return cmd
 }
@@ -133,19 +159,54 @@ func snapshotListCmd() *cobra.Command {
 			if err != nil {
 				return fmt.Errorf("failed to list snapshots: %w", err)
 			}
-			if len(snaps) == 0 {
+			var scheduled []*vm.VM
+			if vmName != "" {
+				if v, err := vm.Load(paths.VMs, vmName); err == nil && !v.SnapshotSchedule.Empty() {
+					scheduled = append(scheduled, v)
+				}
+			} else if vms, err := vm.List(paths.VMs); err == nil {
+				for _, v := range vms {
+					if !v.SnapshotSchedule.Empty() {
+						scheduled = append(scheduled, v)
+					}
+				}
+			}
+			if len(snaps) == 0 && len(scheduled) == 0 {
 				fmt.Println("No snapshots found. Create one with: vmm snapshot create <vm> <name>")
 				return nil
 			}
 
+			// Diff snapshots are listed under their parents
+			snaps, depths := snapshot.Tree(snaps)
 			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-			fmt.Fprintln(w, "VM\tSNAPSHOT\tCREATED\tSIZE\tMEMORY")
-			for _, s := range snaps {
-				fmt.Fprintf(w, "%s\t%s\t%s\t%.1f MB\t%d MB\n",
-					s.VMName, s.Name, s.CreatedAt.Format("2006-01-02 15:04:05"),
-					float64(s.SizeBytes)/(1024*1024), s.MemoryMB)
+			if len(snaps) > 0 {
+				fmt.Fprintln(w, "VM\tSNAPSHOT\tTYPE\tCREATED\tSIZE\tDISK USAGE\tMEMORY")
+			}
+			for i, s := range snaps {
+				name, kind := s.Name, s.Kind()
+				if depths[i] > 0 {
+					name = strings.Repeat("  ", depths[i]-1) + "└─ " + s.Name
+				}
+				if s.Scheduled {
+					kind += " (scheduled)"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%.1f MB\t%.1f MB\t%d MB\n",
+					s.VMName, name, kind, s.CreatedAt.Format("2006-01-02 15:04:05"),
+					float64(s.ApparentBytes)/(1024*1024), float64(s.SizeBytes)/(1024*1024), s.MemoryMB)
 			}
 			w.Flush()
+
+			if len(scheduled) > 0 {
+				if len(snaps) > 0 {
+					fmt.Println()
+				}
+				w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "VM\tSCHEDULE\tLAST RUN\tSTATUS")
+				for _, v := range scheduled {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", v.Name, v.SnapshotSchedule.Summary(), scheduleLastRun(v.SnapshotSchedule), scheduleStatus(v.SnapshotSchedule))
+				}
+				w.Flush()
+			}
 			return nil
 		},
 	}
@@ -169,80 +230,102 @@ func snapshotRestoreCmd() *cobra.Command {
 			if err := validate.SnapshotName(snapName); err != nil {
 				return err
 			}
-			paths := cfg.GetPaths()
-
-			v, err := vm.Load(paths.VMs, vmName)
+			meta, err := snapshot.NewManager(cfg.GetPaths().Snapshots).Get(vmName, snapName)
 			if err != nil {
-				return fmt.Errorf("VM '%s' not found", vmName)
+				return err
+			}
+			if fcVer := firecracker.NewClient().Version(); fcVer != "" && meta.FCVersion != "" && fcVer != meta.FCVersion {
+				fmt.Printf("Warning: snapshot was taken with Firecracker %s but %s is installed; restore may fail.\n", meta.FCVersion, fcVer)
 			}
 
-			snapMgr := snapshot.NewManager(paths.Snapshots)
-			meta, err := snapMgr.Get(vmName, snapName)
+			fmt.Printf("Restoring VM '%s' from snapshot '%s'...\n", vmName, snapName)
+			v, err := daemon.OpenWithProgress(cfg, printProgress).Restore(vmName, snapName, force, !noStart)
 			if err != nil {
 				return err
 			}
+			switch {
+			case noStart:
+				fmt.Printf("VM '%s' disks restored from snapshot '%s' (VM left stopped)\n", vmName, snapName)
+				return nil
+			case meta.DiskOnly():
+				// A disk-only snapshot has no memory to resume, so the VM
+				// was booted from the restored disks instead
+				fmt.Printf("VM '%s' disks restored from snapshot '%s' and started\n", vmName, snapName)
+			default:
+				fmt.Printf("VM '%s' restored from snapshot '%s' and resumed\n", vmName, snapName)
+			}
+			fmt.Printf("  IP Address: %s\n", v.IPAddress)
+			fmt.Printf("  PID: %d\n", v.PID)
+			return nil
+		},
+	}
 
-			fcClient := firecracker.NewClient()
-			fcClient.UpdateVMState(v)
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "Stop the VM first if it is running")
+	cmd.Flags().BoolVar(&noStart, "no-start", false, "Restore disks only; do not start the VM from the snapshot")
 
-			ctx := context.Background()
-			netMgr := network.NewManager(cfg.BridgeName, cfg.Subnet, cfg.Gateway, cfg.HostInterface)
+	return cmd
+}
 
-			// The VM must be stopped before its disks are overwritten.
-			if v.State == vm.StateRunning {
-				if !force {
-					return fmt.Errorf("VM '%s' is running; stop it first or use --force to stop and restore", vmName)
-				}
-				fmt.Printf("Stopping VM '%s'...\n", vmName)
-				v.State = vm.StateStopping
-				v.Save(paths.VMs)
-				if err := fcClient.Terminate(ctx, v); err != nil {
-					v.State = vm.StateError
-					v.Save(paths.VMs)
-					return fmt.Errorf("failed to stop VM '%s' before restore: %w", vmName, err)
-				}
-				if v.TapDevice != "" && netMgr.TapExists(v.TapDevice) {
-					if err := netMgr.DeleteTap(v.TapDevice); err != nil {
-						fmt.Printf("Warning: failed to delete TAP device: %v\n", err)
-					}
-				}
-				v.State = vm.StateStopped
-				v.Save(paths.VMs)
-			}
+func snapshotCloneCmd() *cobra.Command {
+	var warm bool
 
-			if fcVer := fcClient.Version(); fcVer != "" && meta.FCVersion != "" && fcVer != meta.FCVersion {
-				fmt.Printf("Warning: snapshot was taken with Firecracker %s but %s is installed; restore may fail.\n", meta.FCVersion, fcVer)
+	cmd := &cobra.Command{
+		Use:   "clone <vm> <snapshot-name> <new-vm>",
+		Short: "Create and start a new VM from a snapshot",
+		Long: `Create and start a new VM from one of another VM's snapshots.
+
+A cold clone (the default) boots a copy of the snapshot's disk with its own
+MAC and IP addresses, like any new VM. A warm clone (--warm) also restores the
+snapshot's memory, so it carries on from the moment the snapshot was taken,
+typically in well under a second; the guest agent then moves it to its new
+addresses. While loading, a warm clone borrows the source VM's TAP devices,
+so the source must be stopped. Port forwards are not cloned.`,
+		Args:              cobra.ExactArgs(3),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			vmName, snapName, newName := args[0], args[1], args[2]
+			if err := validate.VMName(vmName); err != nil {
+				return err
+			}
+			if err := validate.SnapshotName(snapName); err != nil {
+				return err
+			}
+			if err := validate.VMName(newName); err != nil {
+				return err
 			}
 
-			// Restore uses the snapshot's resource configuration.
-			v.CPUs = meta.CPUs
-			v.MemoryMB = meta.MemoryMB
+			if warm {
+				meta, err := snapshot.NewManager(cfg.GetPaths().Snapshots).Get(vmName, snapName)
+				if err != nil {
+					return err
+				}
+				if fcVer := firecracker.NewClient().Version(); fcVer != "" && meta.FCVersion != "" && fcVer != meta.FCVersion {
+					fmt.Printf("Warning: snapshot was taken with Firecracker %s but %s is installed; the clone may fail to start.\n", meta.FCVersion, fcVer)
+				}
+			}
 
-			fmt.Printf("Restoring VM '%s' from snapshot '%s'...\n", vmName, snapName)
-			logPath := fmt.Sprintf("%s/%s.log", paths.Logs, vmName)
-			if _, err := snapMgr.Restore(ctx, fcClient, netMgr, v, snapName, logPath, !noStart); err != nil {
-				v.State = vm.StateError
-				v.Save(paths.VMs)
-				return fmt.Errorf("failed to restore snapshot: %w", err)
+			mode := "cold"
+			if warm {
+				mode = "warm"
 			}
+			fmt.Printf("Creating %s clone '%s' from snapshot '%s' of VM '%s'...\n", mode, newName, snapName, vmName)
 
-			if noStart {
-				v.State = vm.StateStopped
-				v.Save(paths.VMs)
-				fmt.Printf("VM '%s' disks restored from snapshot '%s' (VM left stopped)\n", vmName, snapName)
-				return nil
+			v, err := daemon.OpenWithProgress(cfg, printProgress).Clone(vmName, snapName, newName, warm)
+			if err != nil {
+				return err
 			}
 
-			v.Save(paths.VMs)
-			fmt.Printf("VM '%s' restored from snapshot '%s' and resumed\n", vmName, snapName)
+			fmt.Printf("VM '%s' cloned and started successfully\n", v.Name)
 			fmt.Printf("  IP Address: %s\n", v.IPAddress)
+			if v.IPv6Address != "" {
+				fmt.Printf("  IPv6 Address: %s\n", v.IPv6Address)
+			}
 			fmt.Printf("  PID: %d\n", v.PID)
 			return nil
 		},
 	}
 
-	cmd.Flags().BoolVarP(&force, "force", "f", false, "Stop the VM first if it is running")
-	cmd.Flags().BoolVar(&noStart, "no-start", false, "Restore disks only; do not start the VM from the snapshot")
+	cmd.Flags().BoolVar(&warm, "warm", false, "Restore the snapshot's memory instead of booting its disk")
 
 	return cmd
 }
@@ -274,10 +357,48 @@ func snapshotShowCmd() *cobra.Command {
 			fmt.Fprintf(w, "VM:\t%s (%s)\n", s.VMName, s.VMID)
 			fmt.Fprintf(w, "Created:\t%s\n", s.CreatedAt.Format("2006-01-02 15:04:05"))
 			fmt.Fprintf(w, "Firecracker:\t%s\n", s.FCVersion)
+			if s.CPU != nil {
+				fmt.Fprintf(w, "Host CPU:\t%s %s\n", s.CPU.Vendor, s.CPU.Model)
+			}
 			fmt.Fprintf(w, "CPUs:\t%d\n", s.CPUs)
 			fmt.Fprintf(w, "Memory:\t%d MB\n", s.MemoryMB)
 			fmt.Fprintf(w, "IP Address:\t%s\n", s.IPAddress)
-			fmt.Fprintf(w, "Size:\t%.1f MB\n", float64(s.SizeBytes)/(1024*1024))
+			kind := s.Kind()
+			if s.Scheduled {
+				kind += " (scheduled)"
+			}
+			if s.Diff() {
+				chain, err := snapMgr.Chain(vmName, snapName)
+				if err != nil {
+					return err
+				}
+				var names []string
+				var total int64
+				for _, c := range chain {
+					names = append(names, c.Name)
+					total += c.SizeBytes
+				}
+				fmt.Fprintf(w, "Type:\t%s\n", kind)
+				fmt.Fprintf(w, "Parent:\t%s\n", s.Parent)
+				fmt.Fprintf(w, "Chain:\t%s\n", strings.Join(names, " → "))
+				fmt.Fprintf(w, "Size:\t%.1f MB\n", float64(s.ApparentBytes)/(1024*1024))
+				fmt.Fprintf(w, "Disk Usage:\t%.1f MB (%.1f MB with its chain)\n", float64(s.SizeBytes)/(1024*1024), float64(total)/(1024*1024))
+			} else {
+				fmt.Fprintf(w, "Type:\t%s\n", kind)
+				fmt.Fprintf(w, "Size:\t%.1f MB\n", float64(s.ApparentBytes)/(1024*1024))
+				fmt.Fprintf(w, "Disk Usage:\t%.1f MB\n", float64(s.SizeBytes)/(1024*1024))
+			}
+			children, err := snapMgr.Children(vmName, snapName)
+			if err != nil {
+				return err
+			}
+			if len(children) > 0 {
+				var names []string
+				for _, c := range children {
+					names = append(names, c.Name)
+				}
+				fmt.Fprintf(w, "Diffs:\t%s\n", strings.Join(names, ", "))
+			}
 			if len(s.Mounts) > 0 {
 				fmt.Fprintf(w, "Mounts:\t%d\n", len(s.Mounts))
 			}
@@ -290,8 +411,10 @@ func snapshotShowCmd() *cobra.Command {
 
 func snapshotDeleteCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:               "delete <vm> <snapshot-name>",
-		Short:             "Delete a snapshot",
+		Use:   "delete <vm> <snapshot-name>",
+		Short: "Delete a snapshot",
+		Long: `Delete a snapshot. Diff snapshots built on it are merged with it first, so
+they can still be restored.`,
 		Aliases:           []string{"rm"},
 		Args:              cobra.ExactArgs(2),
 		ValidArgsFunction: completeVMNames,
@@ -305,6 +428,12 @@ func snapshotDeleteCmd() *cobra.Command {
 			}
 			paths := cfg.GetPaths()
 
+			vmLock, err := lock.VM(paths.State, vmName)
+			if err != nil {
+				return err
+			}
+			defer vmLock.Unlock()
+
 			snapMgr := snapshot.NewManager(paths.Snapshots)
 			if err := snapMgr.Delete(vmName, snapName); err != nil {
 				return err
@@ -315,3 +444,381 @@ func snapshotDeleteCmd() *cobra.Command {
 	}
 	return cmd
 }
+
+func snapshotExportCmd() *cobra.Command {
+	var output string
+
+	cmd := &cobra.Command{
+		Use:   "export <vm> <snapshot-name> -o <file>",
+		Short: "Export a snapshot to a portable archive",
+		Long: `Export a snapshot to a compressed, checksummed archive that 'vmm snapshot
+import' can load on another host. The archive holds the snapshot's memory and
+disks, the VM's settings, and the kernel and initrd it boots. A diff snapshot
+is exported with its chain folded in, as a full snapshot.
+
+Use '-o -' to write the archive to standard output.`,
+		Args:              cobra.ExactArgs(2),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			vmName, snapName := args[0], args[1]
+			if err := validate.VMName(vmName); err != nil {
+				return err
+			}
+			if err := validate.SnapshotName(snapName); err != nil {
+				return err
+			}
+			if output == "" {
+				return fmt.Errorf("an output file is required (-o)")
+			}
+			paths := cfg.GetPaths()
+
+			vmLock, err := lock.VM(paths.State, vmName)
+			if err != nil {
+				return err
+			}
+			defer vmLock.Unlock()
+
+			v, err := vm.Load(paths.VMs, vmName)
+			if err != nil {
+				return fmt.Errorf("VM '%s' not found", vmName)
+			}
+			snapMgr := snapshot.NewManager(paths.Snapshots)
+			meta, err := snapMgr.Get(vmName, snapName)
+			if err != nil {
+				return err
+			}
+
+			imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
+			opts := snapshot.ExportOptions{
+				KernelPath: meta.KernelPath,
+				InitrdPath: imgMgr.GetInitrdPath(v.Initrd),
+			}
+			if _, err := os.Stat(opts.KernelPath); err != nil {
+				opts.KernelPath = imgMgr.GetKernelPath(v.Kernel)
+			}
+			if _, err := os.Stat(opts.KernelPath); err != nil {
+				return fmt.Errorf("kernel for VM '%s' not found: %w", vmName, err)
+			}
+
+			if output == "-" {
+				// Progress messages would corrupt the archive
+				if err := snapMgr.Export(v, snapName, os.Stdout, opts); err != nil {
+					return fmt.Errorf("failed to export snapshot: %w", err)
+				}
+				return nil
+			}
+
+			f, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+			if err != nil {
+				return fmt.Errorf("failed to create archive: %w", err)
+			}
+			fmt.Printf("Exporting snapshot '%s' of VM '%s'...\n", snapName, vmName)
+			err = snapMgr.Export(v, snapName, f, opts)
+			if err == nil {
+				err = f.Sync()
+			}
+			f.Close()
+			if err != nil {
+				os.Remove(output)
+				return fmt.Errorf("failed to export snapshot: %w", err)
+			}
+			fmt.Printf("Snapshot exported to %s\n", output)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "", "File to write the archive to ('-' for standard output)")
+
+	return cmd
+}
+
+func snapshotImportCmd() *cobra.Command {
+	var name string
+	var snapName string
+	var force bool
+
+	cmd := &cobra.Command{
+		Use:   "import <file>",
+		Short: "Import a snapshot archive from another host",
+		Long: `Import a snapshot archive written by 'vmm snapshot export'. If the VM does not
+exist it is created from the settings in the archive, stopped, without its
+IP addresses, port forwards or mounts, whose host resources belong to the
+other host. Its networks must exist on this host. Imported under a new name
+(--name), it also gets its own TAP devices and MAC addresses. The kernel and
+initrd in the archive are installed if this host does not have them.
+
+A snapshot can only be restored on a CPU from the same vendor, so an archive
+from another vendor's CPU is refused unless --force is given. Use '-' to read
+the archive from standard input.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			paths := cfg.GetPaths()
+			if err := cfg.EnsureDirectories(); err != nil {
+				return fmt.Errorf("failed to create directories: %w", err)
+			}
+
+			var r io.Reader = os.Stdin
+			if args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				r = f
+			}
+			a, err := snapshot.OpenArchive(r)
+			if err != nil {
+				return err
+			}
+			defer a.Close()
+			man := a.Manifest
+
+			if name == "" {
+				name = man.VM.Name
+			}
+			if snapName == "" {
+				snapName = man.Snapshot.Name
+			}
+			if err := validate.VMName(name); err != nil {
+				return err
+			}
+			if err := validate.SnapshotName(snapName); err != nil {
+				return err
+			}
+
+			if fcVer := firecracker.NewClient().Version(); fcVer != "" && man.Snapshot.FCVersion != "" && fcVer != man.Snapshot.FCVersion {
+				fmt.Printf("Warning: snapshot was taken with Firecracker %s but %s is installed; restoring it may fail.\n", man.Snapshot.FCVersion, fcVer)
+			}
+			if man.Snapshot.CPU != nil {
+				host, err := snapshot.HostCPU()
+				if err != nil {
+					return fmt.Errorf("failed to read this host's CPU: %w", err)
+				}
+				warnings, err := man.Snapshot.CPU.Compare(host)
+				if err != nil {
+					if !force {
+						return fmt.Errorf("%w; use --force to import it anyway", err)
+					}
+					fmt.Printf("Warning: %v\n", err)
+				}
+				for _, w := range warnings {
+					fmt.Printf("Warning: %s\n", w)
+				}
+			}
+
+			// The VM is created through the lifecycle manager, which takes
+			// its lock, so the lock is only held for the import itself
+			v, err := vm.Load(paths.VMs, name)
+			created := false
+			if err == nil {
+				if v.ID != man.VM.ID {
+					return fmt.Errorf("VM '%s' already exists and is not the VM this snapshot was taken of; use --name to import it as a new VM", name)
+				}
+			} else {
+				v = importedVM(man.VM, name, paths.Sockets, paths.VMs)
+				if v.Kernel == "" && man.HasKernel() {
+					// Keep booting the kernel the VM had rather than
+					// this host's default
+					v.Kernel = "imported-" + name
+				}
+				if len(man.VM.PortForwards) > 0 || len(man.VM.Mounts) > 0 {
+					fmt.Println("Warning: port forwards and mounts are not imported; add them again with 'vmm config'")
+				}
+				if len(man.VM.Volumes) > 0 {
+					fmt.Println("Warning: volumes are not exported; create and attach them again with 'vmm volume'")
+				}
+				for _, nic := range v.Interfaces() {
+					_, err := cfg.Networks().Get(nic.Network)
+					if errors.Is(err, network.ErrNetworkNotFound) {
+						return fmt.Errorf("VM '%s' is on network '%s', which does not exist on this host; create it with 'vmm network create' first", name, nic.Network)
+					}
+					if err != nil {
+						return err
+					}
+				}
+				if _, err := daemon.Open(cfg).Create(v); err != nil {
+					return fmt.Errorf("failed to create VM '%s': %w", name, err)
+				}
+				created = true
+			}
+
+			vmLock, err := lock.VM(paths.State, name)
+			if err != nil {
+				return err
+			}
+			defer vmLock.Unlock()
+
+			imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
+			mountMgr := mount.NewManager(paths.Mounts)
+			opts := snapshot.ImportOptions{
+				VMName:     name,
+				SnapName:   snapName,
+				RootfsPath: image.VMRootfsPath(name, paths.VMs),
+				MountPath: func(guestTag string) string {
+					return mountMgr.GetMountImagePath(name, guestTag)
+				},
+			}
+			if man.HasKernel() {
+				opts.KernelPath = imgMgr.GetKernelPath(v.Kernel)
+			}
+			if man.HasInitrd() && v.Initrd != "" {
+				opts.InitrdPath = imgMgr.GetInitrdPath(v.Initrd)
+			}
+
+			fmt.Printf("Importing snapshot '%s' of VM '%s'...\n", snapName, name)
+			meta, err := snapshot.NewManager(paths.Snapshots).Import(a, opts)
+			if err != nil {
+				if created {
+					vmLock.Unlock()
+					if derr := daemon.Open(cfg).Delete(name, true); derr != nil {
+						fmt.Printf("Warning: failed to remove VM '%s': %v\n", name, derr)
+					}
+				}
+				return fmt.Errorf("failed to import snapshot: %w", err)
+			}
+
+			fmt.Printf("Imported snapshot '%s' of VM '%s'\n", meta.Name, name)
+			if man.Snapshot.RootfsPath != opts.RootfsPath {
+				// Firecracker reopens the disks at the paths the snapshot
+				// was taken with, which belong to another name or data
+				// directory
+				fmt.Printf("Note: the snapshot's disks were at %s, not %s, so it cannot be restored in place; boot a cold clone of it instead:\n", man.Snapshot.RootfsPath, opts.RootfsPath)
+				fmt.Printf("  vmm snapshot clone %s %s <new-vm>\n", name, meta.Name)
+			} else {
+				fmt.Printf("Restore it with: vmm snapshot restore %s %s\n", name, meta.Name)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&name, "name", "", "Name for the VM (default: the name in the archive)")
+	cmd.Flags().StringVar(&snapName, "snapshot", "", "Name for the snapshot (default: the name in the archive)")
+	cmd.Flags().BoolVar(&force, "force", false, "Import a snapshot taken on another vendor's CPU")
+
+	return cmd
+}
+
+// importedVM returns the VM to create for an imported snapshot: the exported
+// VM's settings under name, stopped. Its IP addresses and base image belong
+// to the other host and are dropped. Under the exported VM's own name its ID,
+// TAP devices and MAC addresses are kept, so a restored guest finds the ones
+// it was snapshotted with; under another name it gets its own.
+func importedVM(exported *vm.VM, name, socketsDir, vmsDir string) *vm.VM {
+	v := *exported
+	v.Name = name
+	v.State = vm.StateStopped
+	v.PID = 0
+	v.LastSnapshot = ""
+	v.SocketPath = fmt.Sprintf("%s/%s.sock", socketsDir, name)
+	v.RootfsPath = image.VMRootfsPath(name, vmsDir)
+	v.KernelPath = ""
+	v.BaseImage = ""
+	v.PortForwards = nil
+	v.Mounts = nil
+	v.Volumes = nil
+	v.NICs = append([]vm.NIC(nil), exported.NICs...)
+	if name != exported.Name {
+		v.ID = vm.NewVM(name).ID
+	}
+	for _, nic := range v.Interfaces() {
+		nic.IPAddress = ""
+		nic.IPv6Address = ""
+		if name != exported.Name {
+			nic.TapDevice = ""
+			nic.MacAddress = ""
+		}
+	}
+	return &v
+}
+
+func snapshotScheduleCmd() *cobra.Command {
+	var sched vm.SnapshotSchedule
+	var off bool
+
+	cmd := &cobra.Command{
+		Use:   "schedule <vm>",
+		Short: "Show or set a VM's snapshot schedule",
+		Long: `Show or set a VM's snapshot schedule. While the VM is running, vmmd takes a
+snapshot named auto-<time> every interval and prunes the scheduled snapshots
+the retention counts no longer keep: --keep-hourly keeps the newest snapshot
+in each of the last n hours that have one, and --keep-daily and --keep-weekly
+do the same for days and weeks. Snapshots taken by hand are never pruned.
+
+With --disk-only, scheduled snapshots copy the disks without the memory, so
+the guest is paused for less time.`,
+		Example: `  vmm snapshot schedule web --every 6h --keep-hourly 4 --keep-daily 7
+  vmm snapshot schedule web --off`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			vmName := args[0]
+			if err := validate.VMName(vmName); err != nil {
+				return err
+			}
+			backend := daemon.Open(cfg)
+
+			if !off && sched.Every == "" {
+				v, err := backend.Get(vmName)
+				if err != nil {
+					return err
+				}
+				if v.SnapshotSchedule.Empty() {
+					fmt.Printf("VM '%s' has no snapshot schedule. Set one with: vmm snapshot schedule %s --every 6h --keep-daily 7\n", vmName, vmName)
+					return nil
+				}
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintf(w, "Schedule:\t%s\n", v.SnapshotSchedule.Summary())
+				fmt.Fprintf(w, "Last Run:\t%s\n", scheduleLastRun(v.SnapshotSchedule))
+				fmt.Fprintf(w, "Status:\t%s\n", scheduleStatus(v.SnapshotSchedule))
+				w.Flush()
+				return nil
+			}
+
+			var next *vm.SnapshotSchedule
+			if !off {
+				next = &sched
+			}
+			v, err := backend.SetSnapshotSchedule(vmName, next)
+			if err != nil {
+				return err
+			}
+			if v.SnapshotSchedule.Empty() {
+				fmt.Printf("Removed the snapshot schedule of VM '%s'; its scheduled snapshots are kept\n", vmName)
+				return nil
+			}
+			fmt.Printf("Snapshot schedule of VM '%s': %s\n", vmName, v.SnapshotSchedule.Summary())
+			if _, ok := backend.(*daemon.Client); !ok {
+				fmt.Println("Note: schedules are run by vmmd, which is not running")
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&sched.Every, "every", "", "Interval between snapshots, e.g. 30m or 6h")
+	cmd.Flags().IntVar(&sched.KeepHourly, "keep-hourly", 0, "Number of hourly snapshots to keep")
+	cmd.Flags().IntVar(&sched.KeepDaily, "keep-daily", 0, "Number of daily snapshots to keep")
+	cmd.Flags().IntVar(&sched.KeepWeekly, "keep-weekly", 0, "Number of weekly snapshots to keep")
+	cmd.Flags().BoolVar(&sched.DiskOnly, "disk-only", false, "Snapshot the disks without the memory")
+	cmd.Flags().BoolVar(&off, "off", false, "Remove the schedule")
+
+	return cmd
+}
+
+// scheduleLastRun describes when a snapshot schedule last ran.
+func scheduleLastRun(sched *vm.SnapshotSchedule) string {
+	if sched.LastRun.IsZero() {
+		return "never"
+	}
+	return sched.LastRun.Format("2006-01-02 15:04:05")
+}
+
+// scheduleStatus describes the outcome of a snapshot schedule's last run.
+func scheduleStatus(sched *vm.SnapshotSchedule) string {
+	switch {
+	case sched.Failures > 0:
+		return fmt.Sprintf("failed %d time(s) in a row: %s", sched.Failures, sched.LastError)
+	case sched.LastSnapshot != "":
+		return "ok, took " + sched.LastSnapshot
+	}
+	return "waiting"
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/raesene/baremetalvmm/internal/daemon"
+	"github.com/raesene/baremetalvmm/internal/diskfile"
+	"github.com/raesene/baremetalvmm/internal/validate"
+	"github.com/raesene/baremetalvmm/internal/vm"
+	"github.com/raesene/baremetalvmm/internal/volume"
+	"github.com/spf13/cobra"
+)
+
+func volumeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "volume",
+		Short: "Manage persistent data volumes",
+		Long: `Manage persistent data volumes.
+
+A volume is an ext4 disk stored apart from any VM. It is attached to one
+stopped VM at a time, appears in the guest as an extra drive after the
+VM's mounts and is mounted by filesystem UUID, so its mount point does not
+depend on the order of the drives. Deleting the VM leaves the volume and its
+data in place, ready to attach to another VM.
+
+Volumes are not included in snapshots, clones or exports. VMs with volumes
+attached can only take disk-only snapshots.`,
+	}
+
+	cmd.AddCommand(
+		volumeCreateCmd(),
+		volumeListCmd(),
+		volumeDeleteCmd(),
+		volumeResizeCmd(),
+		volumeAttachCmd(),
+		volumeDetachCmd(),
+	)
+
+	return cmd
+}
+
+func volumeCreateCmd() *cobra.Command {
+	var sizeMB int
+
+	cmd := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Create an empty volume",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validate.VolumeName(name); err != nil {
+				return err
+			}
+			if err := validate.VolumeSizeMB(sizeMB); err != nil {
+				return err
+			}
+
+			v, err := volume.NewManager(cfg.GetPaths().Volumes).Create(name, sizeMB)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Created volume '%s' (%d MB)\n", v.Name, v.SizeMB)
+			fmt.Printf("Attach it with: vmm volume attach %s <vm>\n", v.Name)
+			return nil
+		},
+	}
+
+	cmd.Flags().IntVar(&sizeMB, "size", 1024, "Size in MB")
+
+	return cmd
+}
+
+func volumeListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "list",
+		Short:   "List volumes and the VMs they are attached to",
+		Aliases: []string{"ls"},
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			volMgr := volume.NewManager(cfg.GetPaths().Volumes)
+			volumes, err := volMgr.List()
+			if err != nil {
+				return fmt.Errorf("failed to list volumes: %w", err)
+			}
+			vms, _ := vm.List(cfg.GetPaths().VMs)
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tSIZE\tDISK USAGE\tATTACHED TO\tMOUNT PATH")
+			for _, v := range volumes {
+				usage := "-"
+				if info, err := os.Stat(volMgr.ImagePath(v.Name)); err == nil {
+					usage = fmt.Sprintf("%.1f MB", float64(diskfile.AllocatedSize(info))/(1024*1024))
+				}
+				user, mountPath := "-", "-"
+				for _, existing := range vms {
+					if att := existing.Volume(v.Name); att != nil {
+						user, mountPath = existing.Name, att.MountPath
+						if att.ReadOnly {
+							mountPath += " (ro)"
+						}
+						break
+					}
+				}
+				fmt.Fprintf(w, "%s\t%d MB\t%s\t%s\t%s\n", v.Name, v.SizeMB, usage, user, mountPath)
+			}
+			w.Flush()
+			return nil
+		},
+	}
+	return cmd
+}
+
+func volumeDeleteCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "delete <name>",
+		Short:             "Delete a volume and its data",
+		Aliases:           []string{"rm"},
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVolumeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validate.VolumeName(name); err != nil {
+				return err
+			}
+			if err := daemon.Open(cfg).DeleteVolume(name); err != nil {
+				return err
+			}
+
+			fmt.Printf("Deleted volume '%s'\n", name)
+			return nil
+		},
+	}
+	return cmd
+}
+
+func volumeResizeCmd() *cobra.Command {
+	var sizeMB int
+
+	cmd := &cobra.Command{
+		Use:   "resize <name>",
+		Short: "Grow a volume and its filesystem",
+		Long: `Grow a volume and its ext4 filesystem to a new size. Volumes cannot shrink.
+The VM the volume is attached to, if any, must be stopped.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVolumeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validate.VolumeName(name); err != nil {
+				return err
+			}
+			if err := validate.VolumeSizeMB(sizeMB); err != nil {
+				return err
+			}
+
+			v, err := daemon.Open(cfg).ResizeVolume(name, sizeMB)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Volume '%s' is now %d MB\n", v.Name, v.SizeMB)
+			return nil
+		},
+	}
+
+	cmd.Flags().IntVar(&sizeMB, "size", 0, "New size in MB")
+	cmd.MarkFlagRequired("size")
+
+	return cmd
+}
+
+func volumeAttachCmd() *cobra.Command {
+	var mountPath string
+	var readOnly bool
+
+	cmd := &cobra.Command{
+		Use:   "attach <volume> <vm>",
+		Short: "Attach a volume to a stopped VM",
+		Long: `Attach a volume to a stopped VM. It is mounted on --path (default
+/mnt/<volume>) from the VM's next start. A volume is attached to one VM at
+a time.
+
+Example:
+  vmm volume attach pgdata db --path /var/lib/postgresql`,
+		Args:              cobra.ExactArgs(2),
+		ValidArgsFunction: completeVolumeAndVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			volumeName, vmName := args[0], args[1]
+			if err := validate.VolumeName(volumeName); err != nil {
+				return err
+			}
+			if err := validate.VMName(vmName); err != nil {
+				return err
+			}
+			if mountPath != "" {
+				if err := validate.GuestMountPath(mountPath); err != nil {
+					return err
+				}
+			}
+
+			v, err := daemon.Open(cfg).AttachVolume(vmName, vm.VolumeAttachment{
+				Name:      volumeName,
+				MountPath: mountPath,
+				ReadOnly:  readOnly,
+			})
+			if err != nil {
+				return err
+			}
+
+			att := v.Volume(volumeName)
+			fmt.Printf("Attached volume '%s' to VM '%s' on %s\n", volumeName, vmName, att.MountPath)
+			fmt.Printf("It is mounted when the VM next starts: vmm start %s\n", vmName)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&mountPath, "path", "", "Directory to mount the volume on in the guest (default: /mnt/<volume>)")
+	cmd.Flags().BoolVar(&readOnly, "read-only", false, "Mount the volume read-only")
+
+	return cmd
+}
+
+func volumeDetachCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "detach <volume> <vm>",
+		Short:             "Detach a volume from a stopped VM, keeping its data",
+		Args:              cobra.ExactArgs(2),
+		ValidArgsFunction: completeVolumeAndVMNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			volumeName, vmName := args[0], args[1]
+			if err := validate.VolumeName(volumeName); err != nil {
+				return err
+			}
+			if err := validate.VMName(vmName); err != nil {
+				return err
+			}
+
+			if _, err := daemon.Open(cfg).DetachVolume(vmName, volumeName); err != nil {
+				return err
+			}
+
+			fmt.Printf("Detached volume '%s' from VM '%s'\n", volumeName, vmName)
+			return nil
+		},
+	}
+	return cmd
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/raesene/baremetalvmm/internal/config"
+	"github.com/raesene/baremetalvmm/internal/daemon"
+	"github.com/raesene/baremetalvmm/internal/image"
+	"github.com/raesene/baremetalvmm/internal/nameserver"
+	"github.com/raesene/baremetalvmm/internal/portproxy"
+	"github.com/raesene/baremetalvmm/internal/snapshot"
+)
+
+// dnsRefreshInterval is how often the DNS server picks up new networks.
+const dnsRefreshInterval = 30 * time.Second
+
+// autoBalloonInterval is how often the auto-balloon policy checks host and
+// guest memory.
+const autoBalloonInterval = 10 * time.Second
+
+// snapshotScheduleInterval is how often VMs' snapshot schedules are checked.
+// It is the resolution of their intervals.
+const snapshotScheduleInterval = time.Minute
+
+// proxyRefreshInterval is how often the port proxy checks for VMs started or
+// stopped outside the daemon. Changes made through the daemon are picked up
+// straight away.
+const proxyRefreshInterval = 10 * time.Second
+
+// reapInterval is how often VMs whose guest powered itself off are noticed
+// and their TAP devices and port forwards released.
+const reapInterval = 5 * time.Second
+
+var (
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
+)
+
+func main() {
+	socketPath := flag.String("socket", "", "Unix socket to listen on (default <data_dir>/vmmd.sock)")
+	autostart := flag.Bool("autostart", false, "Start all VMs marked for auto-start before serving requests")
+	showVersion := flag.Bool("version", false, "Show version information")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("vmmd version %s\ncommit: %s\nbuilt: %s\n", version, commit, date)
+		os.Exit(0)
+	}
+
+	if os.Geteuid() != 0 {
+		fmt.Fprintln(os.Stderr, "Error: vmmd must run as root to manage TAP devices and Firecracker processes")
+		os.Exit(1)
+	}
+
+	cfg, err := config.Load(config.ConfigPath())
+	if err != nil {
+		log.Printf("Warning: failed to load config: %v", err)
+		cfg = config.DefaultConfig()
+	}
+	if err := cfg.EnsureDirectories(); err != nil {
+		log.Fatalf("Failed to create directories: %v", err)
+	}
+
+	server := daemon.NewServer(cfg, *socketPath)
+	server.Service().SetProgress(func(vmName, step string) {
+		log.Printf("%s: %s", vmName, step)
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Serve DNS before autostarting so the VMs can resolve each other as
+	// soon as they boot
+	if !cfg.DisableDNS {
+		paths := cfg.GetPaths()
+		ns := nameserver.New(
+			nameserver.StateLookup(paths.VMs, paths.Clusters, cfg.Networks()),
+			nameserver.Upstream(cfg.DNSUpstream, image.DefaultDNSServers),
+		)
+		go ns.Serve(ctx, cfg.Networks(), dnsRefreshInterval)
+	}
+
+	// Relay forwards in proxy mode for as long as the daemon runs
+	svc := server.Service()
+	proxy := portproxy.New()
+	svc.SetPortProxy(proxy)
+	go proxy.Serve(ctx, func() ([]portproxy.Forward, error) {
+		vms, err := svc.List()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list VMs: %w", err)
+		}
+		return portproxy.VMForwards(vms), nil
+	}, proxyRefreshInterval)
+
+	// Reclaim memory from idle VMs when the host runs low, if configured
+	if policy := cfg.AutoBalloon; policy != nil {
+		if err := policy.Validate(); err != nil {
+			log.Printf("Warning: auto-balloon disabled: %v", err)
+		} else {
+			go policy.Run(ctx, svc, autoBalloonInterval)
+		}
+	}
+
+	// Take scheduled snapshots for as long as the daemon runs
+	paths := cfg.GetPaths()
+	go snapshot.NewScheduler(paths.Snapshots, paths.VMs, paths.State).Run(ctx, snapshotScheduleInterval)
+
+	// Release what VMs that exited on their own still hold
+	go reapVMs(ctx, svc, reapInterval)
+
+	if *autostart {
+		autostartVMs(server.Service())
+	}
+
+	// VMs keep running when the daemon exits; they are picked up again from
+	// their state files on the next start.
+	if err := server.Run(ctx); err != nil {
+		log.Fatalf("Server error: %v", err)
+	}
+}
+
+// autostartVMs starts every stopped VM that is marked for auto-start.
+func autostartVMs(svc *daemon.Service) {
+	vms, err := svc.List()
+	if err != nil {
+		log.Printf("autostart: failed to list VMs: %v", err)
+		return
+	}
+	for _, v := range vms {
+		if !v.AutoStart || v.State.Active() {
+			continue
+		}
+		started, err := svc.Start(v.Name)
+		if err != nil {
+			log.Printf("autostart: failed to start VM %s: %v", v.Name, err)
+			continue
+		}
+		log.Printf("autostart: started VM %s (IP %s, PID %d)", started.Name, started.IPAddress, started.PID)
+	}
+}
+
+// reapVMs marks VMs whose Firecracker process has exited as stopped every
+// interval until ctx is cancelled.
+func reapVMs(ctx context.Context, svc *daemon.Service, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reaped, err := svc.Reap()
+			if err != nil {
+				log.Printf("reap: %v", err)
+			}
+			for _, name := range reaped {
+				log.Printf("VM %s exited on its own; marked stopped", name)
+			}
+		}
+	}
+}
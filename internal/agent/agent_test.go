@@ -0,0 +1,199 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startAgent runs a Server behind a fake of Firecracker's vsock socket and
+// returns a Client for it.
+func startAgent(t *testing.T, s *Server) *Client {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "vm.vsock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				// Read the handshake a byte at a time so nothing after it
+				// is lost to a buffer
+				var line []byte
+				b := make([]byte, 1)
+				for {
+					if _, err := c.Read(b); err != nil {
+						c.Close()
+						return
+					}
+					if b[0] == '\n' {
+						break
+					}
+					line = append(line, b[0])
+				}
+				if string(line) != fmt.Sprintf("CONNECT %d", Port) {
+					c.Close()
+					return
+				}
+				fmt.Fprintf(c, "OK 1073741824\n")
+				s.handle(c)
+			}()
+		}
+	}()
+	return NewClient(socket)
+}
+
+func TestPing(t *testing.T) {
+	c := startAgent(t, NewServer("test"))
+	h, err := c.Ping(context.Background())
+	if err != nil {
+		t.Fatalf("Ping() error: %v", err)
+	}
+	if h.Version != "test" || h.Kernel == "" || h.Time.IsZero() {
+		t.Errorf("Ping() = %+v, want version, kernel and time", h)
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	c := NewClient(filepath.Join(t.TempDir(), "missing.vsock"))
+	if _, err := c.Ping(context.Background()); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Ping() without a VM error = %v, want ErrUnavailable", err)
+	}
+}
+
+func TestExec(t *testing.T) {
+	c := startAgent(t, NewServer("test"))
+
+	var stdout, stderr bytes.Buffer
+	code, err := c.Exec(context.Background(), ExecRequest{
+		Command: []string{"sh", "-c", `read line; echo "got $line $GREETING"; echo oops >&2; exit 3`},
+		Env:     []string{"GREETING=hello"},
+		Stdin:   []byte("input\n"),
+	}, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("Exec() error: %v", err)
+	}
+	if code != 3 {
+		t.Errorf("Exec() exit code = %d, want 3", code)
+	}
+	if got := stdout.String(); got != "got input hello\n" {
+		t.Errorf("stdout = %q", got)
+	}
+	if got := stderr.String(); got != "oops\n" {
+		t.Errorf("stderr = %q", got)
+	}
+
+	if _, err := c.Exec(context.Background(), ExecRequest{Command: []string{"/nonexistent"}}, nil, nil); err == nil {
+		t.Error("Exec() of a missing program should fail")
+	}
+}
+
+func TestExecCancel(t *testing.T) {
+	c := startAgent(t, NewServer("test"))
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.Exec(ctx, ExecRequest{Command: []string{"sleep", "30"}}, nil, nil); err == nil {
+		t.Error("Exec() past its deadline should fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Exec() returned after %v, want soon after the deadline", elapsed)
+	}
+}
+
+func TestPushPull(t *testing.T) {
+	c := startAgent(t, NewServer("test"))
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.txt")
+	content := strings.Repeat("line of config\n", 1000)
+
+	if err := c.Push(context.Background(), strings.NewReader(content), int64(len(content)), path, 0600); err != nil {
+		t.Fatalf("Push() error: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("pushed file: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("pushed file mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	var got bytes.Buffer
+	mode, err := c.Pull(context.Background(), path, &got)
+	if err != nil {
+		t.Fatalf("Pull() error: %v", err)
+	}
+	if got.String() != content || mode != 0600 {
+		t.Errorf("Pull() = %d bytes, mode %v; want %d bytes, mode 0600", got.Len(), mode, len(content))
+	}
+
+	if err := c.Push(context.Background(), strings.NewReader("x"), 1, "relative.txt", 0644); err == nil {
+		t.Error("Push() to a relative path should fail")
+	}
+	if _, err := c.Pull(context.Background(), dir, &got); err == nil {
+		t.Error("Pull() of a directory should fail")
+	}
+}
+
+func TestShutdownAndSetTime(t *testing.T) {
+	s := NewServer("test")
+	shutdown := make(chan struct{})
+	s.shutdown = func() error {
+		close(shutdown)
+		return nil
+	}
+	var set time.Time
+	s.setTime = func(t time.Time) error {
+		set = t
+		return nil
+	}
+	c := startAgent(t, s)
+
+	if err := c.SyncTime(context.Background()); err != nil {
+		t.Fatalf("SyncTime() error: %v", err)
+	}
+	if d := time.Since(set); d < 0 || d > time.Minute {
+		t.Errorf("guest clock set to %v, want about now", set)
+	}
+
+	if err := c.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error: %v", err)
+	}
+	select {
+	case <-shutdown:
+	case <-time.After(5 * time.Second):
+		t.Error("Shutdown() did not shut the guest down")
+	}
+}
+
+func TestHealthReady(t *testing.T) {
+	tests := []struct {
+		state string
+		want  bool
+	}{
+		{"", true},
+		{"running", true},
+		{"degraded", true},
+		{"starting", false},
+		{"initializing", false},
+	}
+	for _, tt := range tests {
+		h := &Health{SystemState: tt.state}
+		if got := h.Ready(); got != tt.want {
+			t.Errorf("Ready() with state %q = %v, want %v", tt.state, got, tt.want)
+		}
+	}
+}
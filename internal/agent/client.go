@@ -0,0 +1,231 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrUnavailable is returned when the agent cannot be reached: the VM is not
+// running, was booted without a vsock device, or its image has no agent.
+var ErrUnavailable = errors.New("guest agent unavailable")
+
+// Client talks to the agent of one VM through the unix socket backing its
+// Firecracker vsock device.
+type Client struct {
+	socketPath string
+}
+
+// NewClient returns a Client for the VM whose vsock device is backed by
+// socketPath (see vm.VM.VsockPath).
+func NewClient(socketPath string) *Client {
+	return &Client{socketPath: socketPath}
+}
+
+// conn is one request's connection to the agent.
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// dial connects to the agent's port through Firecracker's vsock socket. The
+// connection is closed when ctx is done.
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "unix", c.socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	stop := context.AfterFunc(ctx, func() { nc.Close() })
+	cn := &conn{Conn: closeFunc{nc, stop}, r: bufio.NewReader(nc)}
+
+	// Firecracker answers "OK <host port>" once the guest accepts, and
+	// closes the connection if nothing listens on the port
+	if _, err := fmt.Fprintf(nc, "CONNECT %d\n", Port); err != nil {
+		cn.Close()
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	line, err := cn.r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "OK ") {
+		cn.Close()
+		return nil, fmt.Errorf("%w: no agent listening on vsock port %d", ErrUnavailable, Port)
+	}
+	return cn, nil
+}
+
+// closeFunc stops the context watcher when the connection is closed.
+type closeFunc struct {
+	net.Conn
+	stop func() bool
+}
+
+func (c closeFunc) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
+
+// roundTrip sends req and reads a single response, turning a reported
+// error into a Go error.
+func (c *Client) roundTrip(ctx context.Context, req Request) (*Response, error) {
+	cn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cn.Close()
+	if err := writeMessage(cn, req); err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	var resp Response
+	if err := readMessage(cn.r, &resp); err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+// Ping returns the guest's health.
+func (c *Client) Ping(ctx context.Context) (*Health, error) {
+	resp, err := c.roundTrip(ctx, Request{Op: OpPing})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Health == nil {
+		return nil, fmt.Errorf("agent sent no health report")
+	}
+	return resp.Health, nil
+}
+
+// WaitReady polls the agent until the guest has finished booting or ctx is
+// done, and returns its last health report.
+func (c *Client) WaitReady(ctx context.Context, interval time.Duration) (*Health, error) {
+	for {
+		h, err := c.Ping(ctx)
+		if err == nil && h.Ready() {
+			return h, nil
+		}
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				return h, fmt.Errorf("guest not ready (system state: %s): %w", h.SystemState, ctx.Err())
+			}
+			return nil, err
+		case <-time.After(interval):
+		}
+	}
+}
+
+// ExecRequest describes a command to run in the guest.
+type ExecRequest struct {
+	Command []string
+	Env     []string
+	Dir     string
+	Stdin   []byte
+}
+
+// Exec runs a command in the guest, copying its output to stdout and stderr
+// as it is produced, and returns its exit code. Cancelling ctx kills the
+// command.
+func (c *Client) Exec(ctx context.Context, req ExecRequest, stdout, stderr io.Writer) (int, error) {
+	if len(req.Command) == 0 {
+		return 0, fmt.Errorf("no command given")
+	}
+	cn, err := c.dial(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer cn.Close()
+	if err := writeMessage(cn, Request{Op: OpExec, Command: req.Command, Env: req.Env, Dir: req.Dir, Stdin: req.Stdin}); err != nil {
+		return 0, fmt.Errorf("failed to send request: %w", err)
+	}
+	for {
+		var resp Response
+		if err := readMessage(cn.r, &resp); err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			return 0, fmt.Errorf("failed to read response: %w", err)
+		}
+		if resp.Error != "" {
+			return 0, errors.New(resp.Error)
+		}
+		if len(resp.Stdout) > 0 && stdout != nil {
+			stdout.Write(resp.Stdout)
+		}
+		if len(resp.Stderr) > 0 && stderr != nil {
+			stderr.Write(resp.Stderr)
+		}
+		if resp.ExitCode != nil {
+			return *resp.ExitCode, nil
+		}
+	}
+}
+
+// Push writes size bytes from r to a file in the guest, creating or
+// replacing it with the given permissions.
+func (c *Client) Push(ctx context.Context, r io.Reader, size int64, path string, mode os.FileMode) error {
+	cn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer cn.Close()
+	if err := writeMessage(cn, Request{Op: OpPush, Path: path, Mode: uint32(mode.Perm()), Size: size}); err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	if _, err := io.CopyN(cn, r, size); err != nil {
+		return fmt.Errorf("failed to send file: %w", err)
+	}
+	var resp Response
+	if err := readMessage(cn.r, &resp); err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+// Pull copies a file from the guest to w and returns its permissions.
+func (c *Client) Pull(ctx context.Context, path string, w io.Writer) (os.FileMode, error) {
+	cn, err := c.dial(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer cn.Close()
+	if err := writeMessage(cn, Request{Op: OpPull, Path: path}); err != nil {
+		return 0, fmt.Errorf("failed to send request: %w", err)
+	}
+	var resp Response
+	if err := readMessage(cn.r, &resp); err != nil {
+		return 0, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.Error != "" {
+		return 0, errors.New(resp.Error)
+	}
+	if _, err := io.CopyN(w, cn.r, resp.Size); err != nil {
+		return 0, fmt.Errorf("failed to receive file: %w", err)
+	}
+	return os.FileMode(resp.Mode), nil
+}
+
+// Shutdown asks the guest to stop its services, sync its disks and exit.
+// It returns once the agent has accepted the request; the VM's process
+// exits shortly afterwards.
+func (c *Client) Shutdown(ctx context.Context) error {
+	_, err := c.roundTrip(ctx, Request{Op: OpShutdown})
+	return err
+}
+
+// SyncTime sets the guest clock to the host's, such as after a VM is
+// restored from a snapshot taken long ago.
+func (c *Client) SyncTime(ctx context.Context) error {
+	_, err := c.roundTrip(ctx, Request{Op: OpSetTime, Time: time.Now().UnixNano()})
+	return err
+}
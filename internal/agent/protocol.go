@@ -0,0 +1,101 @@
+// Package agent talks to vmm-agent, the small daemon baked into VM images,
+// over the VM's Firecracker vsock device. Unlike SSH it needs no guest
+// networking, so it keeps working when the guest's network is misconfigured
+// or firewalled.
+//
+// The host side reaches the guest through the unix socket Firecracker
+// creates for the vsock device: a connection starts with "CONNECT <port>",
+// after which it is a stream to the agent's listener. Each connection
+// carries one request. Requests and responses are JSON lines; file contents
+// follow their request or response header as raw bytes.
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Port is the vsock port vmm-agent listens on.
+const Port = 10789
+
+// Operations a Request can ask for.
+const (
+	OpPing     = "ping"
+	OpExec     = "exec"
+	OpPush     = "push"
+	OpPull     = "pull"
+	OpShutdown = "shutdown"
+	OpSetTime  = "settime"
+)
+
+// Request is the header of a request to the agent.
+type Request struct {
+	Op      string   `json:"op"`
+	Command []string `json:"command,omitempty"` // exec: program and arguments
+	Env     []string `json:"env,omitempty"`     // exec: extra KEY=value pairs
+	Dir     string   `json:"dir,omitempty"`     // exec: working directory
+	Stdin   []byte   `json:"stdin,omitempty"`   // exec: standard input
+	Path    string   `json:"path,omitempty"`    // push, pull: guest file
+	Mode    uint32   `json:"mode,omitempty"`    // push: file permissions
+	Size    int64    `json:"size,omitempty"`    // push: bytes following the header
+	Time    int64    `json:"time,omitempty"`    // settime: Unix time in nanoseconds
+}
+
+// Response is a message from the agent. An exec request gets a stream of
+// responses carrying output, ending with one that sets ExitCode.
+type Response struct {
+	Error    string  `json:"error,omitempty"`
+	Stdout   []byte  `json:"stdout,omitempty"`
+	Stderr   []byte  `json:"stderr,omitempty"`
+	ExitCode *int    `json:"exit_code,omitempty"`
+	Size     int64   `json:"size,omitempty"` // pull: bytes following the header
+	Mode     uint32  `json:"mode,omitempty"` // pull: file permissions
+	Health   *Health `json:"health,omitempty"`
+}
+
+// Health is the guest's state as reported by the agent.
+type Health struct {
+	Version     string    `json:"version"`
+	Hostname    string    `json:"hostname"`
+	Kernel      string    `json:"kernel"`
+	Uptime      int64     `json:"uptime"` // seconds
+	Time        time.Time `json:"time"`   // guest clock when the report was made
+	Load        [3]string `json:"load"`
+	SystemState string    `json:"system_state,omitempty"` // systemctl is-system-running, if systemd is present
+}
+
+// Ready reports whether the guest has finished booting. Guests without
+// systemd are ready as soon as the agent answers.
+func (h *Health) Ready() bool {
+	switch h.SystemState {
+	case "initializing", "starting":
+		return false
+	}
+	return true
+}
+
+// writeMessage writes v as one JSON line.
+func writeMessage(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// readMessage reads one JSON line into v. It reads through r so that any
+// raw bytes following the line stay buffered for the caller.
+func readMessage(r *bufio.Reader, v interface{}) error {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(line, v); err != nil {
+		return fmt.Errorf("invalid message: %w", err)
+	}
+	return nil
+}
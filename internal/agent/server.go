@@ -0,0 +1,254 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Server answers requests inside the guest. It is the body of vmm-agent.
+type Server struct {
+	version  string
+	shutdown func() error
+	setTime  func(t time.Time) error
+}
+
+// NewServer returns a Server that reports the given agent version.
+func NewServer(version string) *Server {
+	return &Server{
+		version:  version,
+		shutdown: shutdownGuest,
+		setTime:  setClock,
+	}
+}
+
+// Serve handles connections from ln until it is closed.
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.handle(c)
+	}
+}
+
+// handle answers the single request carried by a connection.
+func (s *Server) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	var req Request
+	if err := readMessage(r, &req); err != nil {
+		log.Printf("failed to read request: %v", err)
+		return
+	}
+
+	var err error
+	switch req.Op {
+	case OpPing:
+		var h *Health
+		if h, err = s.health(); err == nil {
+			err = writeMessage(c, Response{Health: h})
+		}
+	case OpExec:
+		err = s.exec(c, r, req)
+	case OpPush:
+		err = push(c, r, req)
+	case OpPull:
+		err = pull(c, req)
+	case OpShutdown:
+		if err = writeMessage(c, Response{}); err == nil {
+			log.Printf("shutting down at the host's request")
+			go func() {
+				if err := s.shutdown(); err != nil {
+					log.Printf("shutdown failed: %v", err)
+				}
+			}()
+		}
+	case OpSetTime:
+		if err = s.setTime(time.Unix(0, req.Time)); err == nil {
+			err = writeMessage(c, Response{})
+		}
+	default:
+		err = fmt.Errorf("unknown operation %q", req.Op)
+	}
+	if err != nil {
+		writeMessage(c, Response{Error: err.Error()})
+	}
+}
+
+// exec runs a command, streaming its output as it is produced. The command
+// is killed if the host goes away before it finishes.
+func (s *Server) exec(c net.Conn, r *bufio.Reader, req Request) error {
+	if len(req.Command) == 0 {
+		return fmt.Errorf("no command given")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		// Nothing more is sent on an exec connection until it closes
+		io.Copy(io.Discard, r)
+		cancel()
+	}()
+
+	var mu sync.Mutex
+	send := func(resp Response) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return writeMessage(c, resp)
+	}
+	cmd := exec.CommandContext(ctx, req.Command[0], req.Command[1:]...)
+	cmd.Env = append(os.Environ(), req.Env...)
+	cmd.Dir = req.Dir
+	cmd.Stdin = bytes.NewReader(req.Stdin)
+	cmd.Stdout = streamWriter(func(p []byte) error { return send(Response{Stdout: p}) })
+	cmd.Stderr = streamWriter(func(p []byte) error { return send(Response{Stderr: p}) })
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to run %s: %w", req.Command[0], err)
+	}
+
+	err := cmd.Wait()
+	code := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+		// Like a shell, report death by a signal as 128 + the signal
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			code = 128 + int(ws.Signal())
+		}
+	} else if err != nil {
+		return err
+	}
+	return send(Response{ExitCode: &code})
+}
+
+// streamWriter sends each write of a command's output to the host.
+type streamWriter func(p []byte) error
+
+func (w streamWriter) Write(p []byte) (int, error) {
+	// The buffer is reused by the caller once Write returns
+	if err := w(append([]byte(nil), p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// push writes the bytes following the request to a file. They are written
+// to a temporary file first, so an interrupted transfer leaves any existing
+// file untouched.
+func push(c net.Conn, r *bufio.Reader, req Request) error {
+	if !filepath.IsAbs(req.Path) {
+		return fmt.Errorf("path %q is not absolute", req.Path)
+	}
+	mode := os.FileMode(req.Mode).Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(req.Path), ".vmm-agent-*")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", req.Path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.CopyN(tmp, r, req.Size); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", req.Path, err)
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set permissions of %s: %w", req.Path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", req.Path, err)
+	}
+	if err := os.Rename(tmp.Name(), req.Path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", req.Path, err)
+	}
+	return writeMessage(c, Response{})
+}
+
+// pull sends a regular file after a header giving its size and mode.
+func pull(c net.Conn, req Request) error {
+	f, err := os.Open(req.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", req.Path)
+	}
+	if err := writeMessage(c, Response{Size: info.Size(), Mode: uint32(info.Mode().Perm())}); err != nil {
+		return err
+	}
+	// The header has gone, so an error can no longer be reported; the host
+	// sees a short transfer instead
+	if _, err := io.CopyN(c, f, info.Size()); err != nil {
+		log.Printf("failed to send %s: %v", req.Path, err)
+	}
+	return nil
+}
+
+// health gathers the guest's health report.
+func (s *Server) health() (*Health, error) {
+	h := &Health{Version: s.version, Time: time.Now()}
+	h.Hostname, _ = os.Hostname()
+
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err == nil {
+		h.Kernel = unix.ByteSliceToString(uts.Release[:])
+	}
+	var info unix.Sysinfo_t
+	if err := unix.Sysinfo(&info); err == nil {
+		h.Uptime = int64(info.Uptime)
+	}
+	if data, err := os.ReadFile("/proc/loadavg"); err == nil {
+		copy(h.Load[:], strings.Fields(string(data)))
+	}
+	// is-system-running exits non-zero for every state but "running", so
+	// only its output matters
+	if path, err := exec.LookPath("systemctl"); err == nil {
+		out, _ := exec.Command(path, "is-system-running").Output()
+		h.SystemState = strings.TrimSpace(string(out))
+	}
+	return h, nil
+}
+
+// shutdownGuest stops the guest. Firecracker has no power-off device and
+// exits when the guest reboots, so a clean shutdown is a reboot: systemd
+// stops every service and unmounts the filesystems first.
+func shutdownGuest() error {
+	if path, err := exec.LookPath("systemctl"); err == nil {
+		return exec.Command(path, "reboot").Run()
+	}
+	unix.Sync()
+	return unix.Reboot(unix.LINUX_REBOOT_CMD_RESTART)
+}
+
+// setClock sets the guest's realtime clock.
+func setClock(t time.Time) error {
+	ts := unix.NsecToTimespec(t.UnixNano())
+	if err := unix.ClockSettime(unix.CLOCK_REALTIME, &ts); err != nil {
+		return fmt.Errorf("failed to set clock: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+// Package balloon reclaims memory from idle VMs when the host runs low. Every
+// VM boots with a virtio-balloon device; inflating it takes memory the guest
+// is not using and hands it back to the host. vmmd runs the policy when
+// auto_balloon is configured.
+package balloon
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+const (
+	// DefaultGuestReserveMB is the memory left available in each guest when
+	// a policy does not set one.
+	DefaultGuestReserveMB = 256
+	// DefaultStepMB is how far a balloon moves per check when a policy does
+	// not set it.
+	DefaultStepMB = 128
+)
+
+// Policy decides when balloons are inflated and deflated. While the host has
+// less than HostFreeMB available, each VM with more than GuestReserveMB
+// available in the guest gives up some of the excess. Once the host has
+// twice HostFreeMB available again, or a guest drops below its reserve, the
+// balloon is deflated back towards the size the VM was configured with.
+type Policy struct {
+	HostFreeMB     int `json:"host_free_mb"`               // Host memory available below which memory is reclaimed
+	GuestReserveMB int `json:"guest_reserve_mb,omitempty"` // Memory left available in each guest (default 256)
+	StepMB         int `json:"step_mb,omitempty"`          // Most a balloon moves per check (default 128)
+}
+
+// Validate checks that the policy has a threshold and no negative sizes.
+func (p *Policy) Validate() error {
+	if p.HostFreeMB <= 0 {
+		return fmt.Errorf("invalid host_free_mb %d: must be positive", p.HostFreeMB)
+	}
+	if p.GuestReserveMB < 0 {
+		return fmt.Errorf("invalid guest_reserve_mb %d: must not be negative", p.GuestReserveMB)
+	}
+	if p.StepMB < 0 {
+		return fmt.Errorf("invalid step_mb %d: must not be negative", p.StepMB)
+	}
+	return nil
+}
+
+func (p *Policy) reserveMB() int {
+	if p.GuestReserveMB == 0 {
+		return DefaultGuestReserveMB
+	}
+	return p.GuestReserveMB
+}
+
+func (p *Policy) stepMB() int {
+	if p.StepMB == 0 {
+		return DefaultStepMB
+	}
+	return p.StepMB
+}
+
+// Guest is the memory of one running VM as the policy sees it.
+type Guest struct {
+	Name     string
+	MemoryMB int
+	FloorMB  int // The VM's configured balloon size, never deflated below
+	Stats    vm.BalloonStats
+}
+
+// Plan returns the new balloon size of each guest whose balloon should
+// move, by name. Guests that have not reported memory statistics, because
+// they have no balloon driver or have only just booted, are left alone.
+func (p *Policy) Plan(hostAvailableMB int, guests []Guest) map[string]int {
+	reserve, step := p.reserveMB(), p.stepMB()
+	plan := make(map[string]int)
+	for _, g := range guests {
+		if g.Stats.TotalMemory == 0 {
+			continue
+		}
+		current := g.Stats.TargetMB
+		availableMB := int(g.Stats.AvailableMemory >> 20)
+		target := current
+		switch {
+		case availableMB < reserve && current > g.FloorMB:
+			// The guest needs its memory back, whatever the host has
+			target = max(g.FloorMB, current-step)
+		case hostAvailableMB < p.HostFreeMB && availableMB > reserve:
+			target = min(current+min(step, availableMB-reserve), g.MemoryMB-1)
+		case hostAvailableMB >= 2*p.HostFreeMB && current > g.FloorMB:
+			target = max(g.FloorMB, current-step)
+		}
+		if target != current {
+			plan[g.Name] = target
+		}
+	}
+	return plan
+}
+
+// Backend is the VM access the policy needs. It is implemented by
+// daemon.Service.
+type Backend interface {
+	List() ([]*vm.VM, error)
+	BalloonStats(name string) (*vm.BalloonStats, error)
+	ResizeBalloon(name string, targetMB int) error
+}
+
+// Run applies the policy to the running VMs every interval until ctx is
+// cancelled.
+func (p *Policy) Run(ctx context.Context, b Backend, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.apply(b); err != nil {
+				log.Printf("auto-balloon: %v", err)
+			}
+		}
+	}
+}
+
+// apply resizes the balloons of the running VMs once.
+func (p *Policy) apply(b Backend) error {
+	hostAvailableMB, err := HostAvailableMB()
+	if err != nil {
+		return err
+	}
+	vms, err := b.List()
+	if err != nil {
+		return fmt.Errorf("failed to list VMs: %w", err)
+	}
+	var guests []Guest
+	for _, v := range vms {
+		if v.State != vm.StateRunning {
+			continue
+		}
+		st, err := b.BalloonStats(v.Name)
+		if err != nil {
+			// VMs restored from snapshots taken before balloons were added
+			// have none
+			continue
+		}
+		guests = append(guests, Guest{Name: v.Name, MemoryMB: v.MemoryMB, FloorMB: v.BalloonMB, Stats: *st})
+	}
+	for name, targetMB := range p.Plan(hostAvailableMB, guests) {
+		if err := b.ResizeBalloon(name, targetMB); err != nil {
+			log.Printf("auto-balloon: failed to resize balloon of VM %s: %v", name, err)
+			continue
+		}
+		log.Printf("auto-balloon: resized balloon of VM %s to %d MB (host has %d MB available)", name, targetMB, hostAvailableMB)
+	}
+	return nil
+}
+
+// HostAvailableMB returns the memory available on the host for new
+// allocations without swapping, from /proc/meminfo.
+func HostAvailableMB() (int, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read host memory: %w", err)
+	}
+	defer f.Close()
+	return parseMemAvailable(f)
+}
+
+// parseMemAvailable extracts MemAvailable, in MB, from /proc/meminfo.
+func parseMemAvailable(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		kb, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return 0, fmt.Errorf("invalid MemAvailable %q: %w", fields[1], err)
+		}
+		return kb / 1024, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read host memory: %w", err)
+	}
+	return 0, fmt.Errorf("MemAvailable not found in /proc/meminfo")
+}
@@ -0,0 +1,121 @@
+package balloon
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+// guest returns a 1024 MB guest with a balloon of targetMB and availableMB
+// of memory available inside it.
+func guest(name string, floorMB, targetMB, availableMB int) Guest {
+	return Guest{
+		Name:     name,
+		MemoryMB: 1024,
+		FloorMB:  floorMB,
+		Stats: vm.BalloonStats{
+			TargetMB:        targetMB,
+			ActualMB:        targetMB,
+			TotalMemory:     int64(1024-targetMB) << 20,
+			AvailableMemory: int64(availableMB) << 20,
+		},
+	}
+}
+
+func TestPlan(t *testing.T) {
+	p := &Policy{HostFreeMB: 1000}
+	tests := []struct {
+		name            string
+		hostAvailableMB int
+		guests          []Guest
+		want            map[string]int
+	}{
+		{
+			name:            "host has plenty",
+			hostAvailableMB: 1500,
+			guests:          []Guest{guest("idle", 0, 0, 800)},
+			want:            map[string]int{},
+		},
+		{
+			name:            "host low reclaims from idle guests",
+			hostAvailableMB: 500,
+			guests:          []Guest{guest("idle", 0, 0, 800), guest("busy", 0, 0, 200)},
+			want:            map[string]int{"idle": DefaultStepMB},
+		},
+		{
+			name:            "reclaim stops at the guest reserve",
+			hostAvailableMB: 500,
+			guests:          []Guest{guest("idle", 0, 500, 300)},
+			want:            map[string]int{"idle": 500 + 300 - DefaultGuestReserveMB},
+		},
+		{
+			name:            "guest below its reserve gets memory back",
+			hostAvailableMB: 500,
+			guests:          []Guest{guest("busy", 0, 300, 100)},
+			want:            map[string]int{"busy": 300 - DefaultStepMB},
+		},
+		{
+			name:            "host recovered deflates to the configured size",
+			hostAvailableMB: 2500,
+			guests:          []Guest{guest("idle", 200, 256, 800)},
+			want:            map[string]int{"idle": 200},
+		},
+		{
+			name:            "between thresholds nothing moves",
+			hostAvailableMB: 1500,
+			guests:          []Guest{guest("idle", 0, 256, 800)},
+			want:            map[string]int{},
+		},
+		{
+			name:            "guests without statistics are left alone",
+			hostAvailableMB: 500,
+			guests:          []Guest{{Name: "nodriver", MemoryMB: 1024}},
+			want:            map[string]int{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.Plan(tt.hostAvailableMB, tt.guests); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Plan() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		policy  Policy
+		wantErr bool
+	}{
+		{Policy{HostFreeMB: 1024}, false},
+		{Policy{HostFreeMB: 1024, GuestReserveMB: 128, StepMB: 64}, false},
+		{Policy{}, true},
+		{Policy{HostFreeMB: 1024, StepMB: -1}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.policy.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Validate(%+v) error = %v, want error: %v", tt.policy, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseMemAvailable(t *testing.T) {
+	meminfo := `MemTotal:       16318412 kB
+MemFree:          912344 kB
+MemAvailable:    8388608 kB
+Buffers:          123456 kB
+`
+	got, err := parseMemAvailable(strings.NewReader(meminfo))
+	if err != nil {
+		t.Fatalf("parseMemAvailable() error: %v", err)
+	}
+	if got != 8192 {
+		t.Errorf("parseMemAvailable() = %d MB, want 8192", got)
+	}
+
+	if _, err := parseMemAvailable(strings.NewReader("MemTotal: 1 kB\n")); err == nil {
+		t.Error("parseMemAvailable() without MemAvailable should fail")
+	}
+}
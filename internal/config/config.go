@@ -7,6 +7,10 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/raesene/baremetalvmm/internal/balloon"
+	"github.com/raesene/baremetalvmm/internal/network"
+	"github.com/raesene/baremetalvmm/internal/vm"
 )
 
 const (
@@ -23,8 +27,12 @@ type VMDefaults struct {
 	DiskSizeMB int      `json:"disk_size_mb,omitempty"`
 	Image      string   `json:"image,omitempty"`
 	Kernel     string   `json:"kernel,omitempty"`
+	KernelArgs string   `json:"kernel_args,omitempty"` // Appended to the default kernel command line
+	Initrd     string   `json:"initrd,omitempty"`
 	SSHKeyPath string   `json:"ssh_key_path,omitempty"`
 	DNSServers []string `json:"dns_servers,omitempty"`
+	// RateLimits are the network and disk limits of new VMs
+	RateLimits *vm.RateLimits `json:"rate_limits,omitempty"`
 }
 
 // Config holds the global VMM configuration
@@ -33,10 +41,16 @@ type Config struct {
 	BridgeName    string      `json:"bridge_name"`
 	Subnet        string      `json:"subnet"`
 	Gateway       string      `json:"gateway"`
+	Subnet6       string      `json:"subnet6,omitempty"`    // IPv6 subnet; VMs get dual-stack addresses when set
+	IPExclude     []string    `json:"ip_exclude,omitempty"` // Addresses, ranges or CIDRs never allocated dynamically
 	HostInterface string      `json:"host_interface"`
 	KernelPath    string      `json:"kernel_path"`
 	RootfsPath    string      `json:"rootfs_path"`
+	DisableDNS    bool        `json:"disable_dns,omitempty"`  // Don't point VMs at the DNS server vmmd runs on each gateway
+	DNSUpstream   []string    `json:"dns_upstream,omitempty"` // Servers the built-in DNS forwards to (default: the host's resolvers)
 	VMDefaults    *VMDefaults `json:"vm_defaults,omitempty"`
+	// AutoBalloon makes vmmd reclaim memory from idle VMs when the host runs low
+	AutoBalloon *balloon.Policy `json:"auto_balloon,omitempty"`
 }
 
 // GetVMDefaults returns the VM defaults, or an empty struct if none configured
@@ -47,6 +61,29 @@ func (c *Config) GetVMDefaults() VMDefaults {
 	return *c.VMDefaults
 }
 
+// Networks returns the registry of named networks. Its default network is
+// the bridge, subnets and gateway configured here, with NAT.
+func (c *Config) Networks() *network.Registry {
+	return network.NewRegistry(c.GetPaths().Networks, network.Definition{
+		Bridge:    c.BridgeName,
+		Subnet:    c.Subnet,
+		Gateway:   c.Gateway,
+		Subnet6:   c.Subnet6,
+		Mode:      network.ModeNAT,
+		IPExclude: c.IPExclude,
+	})
+}
+
+// NetworkManager returns the host network manager for the named network. An
+// empty name means the default network.
+func (c *Config) NetworkManager(name string) (*network.Manager, error) {
+	d, err := c.Networks().Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return d.Manager(c.HostInterface), nil
+}
+
 // Paths returns commonly used paths derived from the config
 type Paths struct {
 	Config    string
@@ -54,6 +91,7 @@ type Paths struct {
 	Images    string
 	Kernels   string
 	Rootfs    string
+	Initrds   string
 	Sockets   string
 	Logs      string
 	State     string
@@ -61,6 +99,10 @@ type Paths struct {
 	Clusters  string
 	SSH       string
 	Snapshots string
+	Networks  string
+	Volumes   string
+	// DaemonSocket is the unix socket the vmmd daemon listens on
+	DaemonSocket string
 }
 
 // detectDefaultInterface finds the network interface used for the default route
@@ -121,6 +163,7 @@ func (c *Config) GetPaths() *Paths {
 		Images:    filepath.Join(c.DataDir, "images"),
 		Kernels:   filepath.Join(c.DataDir, "images", "kernels"),
 		Rootfs:    filepath.Join(c.DataDir, "images", "rootfs"),
+		Initrds:   filepath.Join(c.DataDir, "images", "initrd"),
 		Sockets:   filepath.Join(c.DataDir, "sockets"),
 		Logs:      filepath.Join(c.DataDir, "logs"),
 		State:     filepath.Join(c.DataDir, "state"),
@@ -128,6 +171,10 @@ func (c *Config) GetPaths() *Paths {
 		Clusters:  filepath.Join(c.DataDir, "clusters"),
 		SSH:       filepath.Join(c.DataDir, "ssh"),
 		Snapshots: filepath.Join(c.DataDir, "snapshots"),
+		Networks:  filepath.Join(c.DataDir, "networks"),
+		Volumes:   filepath.Join(c.DataDir, "volumes"),
+
+		DaemonSocket: filepath.Join(c.DataDir, "vmmd.sock"),
 	}
 }
 
@@ -139,6 +186,7 @@ func (c *Config) EnsureDirectories() error {
 		paths.VMs,
 		paths.Kernels,
 		paths.Rootfs,
+		paths.Initrds,
 		paths.Sockets,
 		paths.Logs,
 		paths.State,
@@ -146,6 +194,8 @@ func (c *Config) EnsureDirectories() error {
 		paths.Clusters,
 		paths.SSH,
 		paths.Snapshots,
+		paths.Networks,
+		paths.Volumes,
 	}
 
 	for _, dir := range dirs {
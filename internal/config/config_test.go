@@ -41,6 +41,7 @@ func TestGetPathsDerivedFromDataDir(t *testing.T) {
 		"Images":    filepath.Join(dataDir, "images"),
 		"Kernels":   filepath.Join(dataDir, "images", "kernels"),
 		"Rootfs":    filepath.Join(dataDir, "images", "rootfs"),
+		"Initrds":   filepath.Join(dataDir, "images", "initrd"),
 		"Sockets":   filepath.Join(dataDir, "sockets"),
 		"Logs":      filepath.Join(dataDir, "logs"),
 		"State":     filepath.Join(dataDir, "state"),
@@ -48,6 +49,10 @@ func TestGetPathsDerivedFromDataDir(t *testing.T) {
 		"Clusters":  filepath.Join(dataDir, "clusters"),
 		"SSH":       filepath.Join(dataDir, "ssh"),
 		"Snapshots": filepath.Join(dataDir, "snapshots"),
+		"Networks":  filepath.Join(dataDir, "networks"),
+		"Volumes":   filepath.Join(dataDir, "volumes"),
+
+		"DaemonSocket": filepath.Join(dataDir, "vmmd.sock"),
 	}
 
 	got := map[string]string{
@@ -56,6 +61,7 @@ func TestGetPathsDerivedFromDataDir(t *testing.T) {
 		"Images":    paths.Images,
 		"Kernels":   paths.Kernels,
 		"Rootfs":    paths.Rootfs,
+		"Initrds":   paths.Initrds,
 		"Sockets":   paths.Sockets,
 		"Logs":      paths.Logs,
 		"State":     paths.State,
@@ -63,6 +69,10 @@ func TestGetPathsDerivedFromDataDir(t *testing.T) {
 		"Clusters":  paths.Clusters,
 		"SSH":       paths.SSH,
 		"Snapshots": paths.Snapshots,
+		"Networks":  paths.Networks,
+		"Volumes":   paths.Volumes,
+
+		"DaemonSocket": paths.DaemonSocket,
 	}
 
 	for k, wantPath := range want {
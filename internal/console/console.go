@@ -0,0 +1,184 @@
+// Package console gives interactive access to a VM's serial console.
+//
+// Firecracker's stdin is a named pipe that vmm creates before starting the
+// process, and its stdout keeps going to the console log. Writing to the pipe
+// types into the guest's ttyS0; the guest's output, including the echo, shows
+// up in the log. Because the log is the output stream, any number of readers
+// can follow it, and since Firecracker holds the pipe open itself, sessions
+// come and go without the VM noticing. A flock on the pipe allows a single
+// writer at a time.
+package console
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// EscapeChar detaches an interactive session: Ctrl+], as in telnet and virsh.
+const EscapeChar = 0x1d
+
+// pollInterval is how often Follow checks the log for new output. It is
+// short enough that typing at the console feels immediate.
+const pollInterval = 20 * time.Millisecond
+
+var (
+	// ErrNotRunning is returned when nothing is reading the console input,
+	// because the VM is not running or was started before consoles could be
+	// attached.
+	ErrNotRunning = errors.New("console is not available (is the VM running? VMs started by older versions need a restart)")
+
+	// ErrBusy is returned when another session is writing to the console.
+	ErrBusy = errors.New("another session is attached to the console (use --read-only to watch)")
+)
+
+// CreateInput makes the named pipe that Firecracker reads the console from
+// and returns it opened for reading and writing, to be passed to the process
+// as stdin. Holding a write end itself means Firecracker never sees EOF when
+// a session detaches. Any stale pipe from an earlier run is replaced.
+func CreateInput(path string) (*os.File, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale console input: %w", err)
+	}
+	if err := unix.Mkfifo(path, 0600); err != nil {
+		return nil, fmt.Errorf("failed to create console input: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to open console input: %w", err)
+	}
+	return f, nil
+}
+
+// OpenInput opens a running VM's console input for writing and takes the
+// writer lock. Closing the file releases the lock.
+func OpenInput(path string) (*os.File, error) {
+	// O_NONBLOCK makes the open fail with ENXIO instead of waiting when
+	// nothing has the pipe open for reading
+	f, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		if os.IsNotExist(err) || errors.Is(err, syscall.ENXIO) {
+			return nil, ErrNotRunning
+		}
+		return nil, fmt.Errorf("failed to open console input: %w", err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, ErrBusy
+		}
+		return nil, fmt.Errorf("failed to lock console input: %w", err)
+	}
+	return f, nil
+}
+
+// Available reports whether a VM's console can be attached to.
+func Available(inputPath string) bool {
+	f, err := os.OpenFile(inputPath, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// WaitStopped returns true once nothing reads the console input any more,
+// because the VM has stopped, or false when ctx is done first.
+func WaitStopped(ctx context.Context, inputPath string) bool {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+			if !Available(inputPath) {
+				return true
+			}
+		}
+	}
+}
+
+// Follow copies output appended to the console log after offset to w until
+// ctx is done. A negative offset starts at the current end of the log. The
+// log is truncated when the VM restarts, in which case Follow starts again
+// from the top.
+func Follow(ctx context.Context, logPath string, offset int64, w io.Writer) error {
+	f, err := os.Open(logPath)
+	if err != nil {
+		return fmt.Errorf("failed to open console log: %w", err)
+	}
+	defer f.Close()
+	if offset < 0 {
+		if offset, err = f.Seek(0, io.SeekEnd); err != nil {
+			return fmt.Errorf("failed to read console log: %w", err)
+		}
+	}
+
+	buf := make([]byte, 32*1024)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		n, err := f.ReadAt(buf, offset)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			offset += int64(n)
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read console log: %w", err)
+		}
+		if info, err := f.Stat(); err == nil && info.Size() < offset {
+			offset = 0
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// EscapeReader passes input through until it reads EscapeChar, then reports
+// io.EOF. The escape character itself is not passed on.
+type EscapeReader struct {
+	r        io.Reader
+	detached bool
+}
+
+// NewEscapeReader wraps r, usually a terminal in raw mode.
+func NewEscapeReader(r io.Reader) *EscapeReader {
+	return &EscapeReader{r: r}
+}
+
+func (e *EscapeReader) Read(p []byte) (int, error) {
+	if e.detached {
+		return 0, io.EOF
+	}
+	n, err := e.r.Read(p)
+	for i := 0; i < n; i++ {
+		if p[i] == EscapeChar {
+			e.detached = true
+			if i == 0 {
+				return 0, io.EOF
+			}
+			return i, nil
+		}
+	}
+	return n, err
+}
+
+// Detached reports whether the escape character has been read.
+func (e *EscapeReader) Detached() bool {
+	return e.detached
+}
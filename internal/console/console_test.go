@@ -0,0 +1,162 @@
+package console
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestInputSingleWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vm.console")
+	// Stands in for Firecracker's stdin
+	stdin, err := CreateInput(path)
+	if err != nil {
+		t.Fatalf("CreateInput() error: %v", err)
+	}
+	defer stdin.Close()
+	if !Available(path) {
+		t.Error("Available() = false for a console being read")
+	}
+
+	w, err := OpenInput(path)
+	if err != nil {
+		t.Fatalf("OpenInput() error: %v", err)
+	}
+	if _, err := OpenInput(path); !errors.Is(err, ErrBusy) {
+		t.Errorf("second OpenInput() error = %v, want ErrBusy", err)
+	}
+	if _, err := w.Write([]byte("root\r")); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(stdin, got); err != nil || string(got) != "root\r" {
+		t.Errorf("console read %q, %v; want %q", got, err, "root\r")
+	}
+
+	w.Close()
+	w, err = OpenInput(path)
+	if err != nil {
+		t.Fatalf("OpenInput() after detach error: %v", err)
+	}
+	w.Close()
+}
+
+func TestOpenInputNotRunning(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := OpenInput(filepath.Join(dir, "missing.console")); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("OpenInput() of a missing pipe error = %v, want ErrNotRunning", err)
+	}
+
+	// A pipe left behind by a VM that has exited
+	stale := filepath.Join(dir, "stale.console")
+	if err := unix.Mkfifo(stale, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenInput(stale); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("OpenInput() of an unread pipe error = %v, want ErrNotRunning", err)
+	}
+	if Available(stale) {
+		t.Error("Available() = true for an unread pipe")
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe to read while Follow writes to it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func waitFor(t *testing.T, b *syncBuffer, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if b.String() == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("followed output = %q, want %q", b.String(), want)
+}
+
+func TestFollow(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "vm-console.log")
+	if err := os.WriteFile(logPath, []byte("old boot output\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var out syncBuffer
+	done := make(chan error, 1)
+	go func() { done <- Follow(ctx, logPath, -1, &out) }()
+	time.Sleep(50 * time.Millisecond)
+
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("login: ")
+	f.Close()
+	waitFor(t, &out, "login: ")
+
+	// A restart truncates the log
+	if err := os.WriteFile(logPath, []byte("boot\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, &out, "login: boot\n")
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Follow() error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Follow() did not return after cancel")
+	}
+}
+
+func TestEscapeReader(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		want     string
+		detached bool
+	}{
+		{"no escape", "ls -l\r", "ls -l\r", false},
+		{"escape ends input", "ls\r\x1dreboot\r", "ls\r", true},
+		{"escape first", "\x1dls", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewEscapeReader(strings.NewReader(tt.input))
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("ReadAll() error: %v", err)
+			}
+			if string(got) != tt.want || r.Detached() != tt.detached {
+				t.Errorf("read %q, detached %v; want %q, %v", got, r.Detached(), tt.want, tt.detached)
+			}
+		})
+	}
+}
@@ -0,0 +1,455 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/raesene/baremetalvmm/internal/portproxy"
+	"github.com/raesene/baremetalvmm/internal/vm"
+	"github.com/raesene/baremetalvmm/internal/volume"
+)
+
+// Client talks to a running vmmd over its unix socket. It implements Backend.
+type Client struct {
+	socketPath string
+	http       *http.Client
+}
+
+// Connect returns a Client for the daemon listening on socketPath, after
+// checking that it answers a health request.
+func Connect(socketPath string) (*Client, error) {
+	c := &Client{
+		socketPath: socketPath,
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := c.do(ctx, http.MethodGet, "/v1/health", nil, nil); err != nil {
+		return nil, fmt.Errorf("vmmd is not reachable on %s: %w", socketPath, err)
+	}
+	return c, nil
+}
+
+// List returns all VMs known to the daemon.
+func (c *Client) List() ([]*vm.VM, error) {
+	var vms []*vm.VM
+	if err := c.do(context.Background(), http.MethodGet, "/v1/vms", nil, &vms); err != nil {
+		return nil, err
+	}
+	return vms, nil
+}
+
+// Get returns a single VM.
+func (c *Client) Get(name string) (*vm.VM, error) {
+	var v vm.VM
+	if err := c.do(context.Background(), http.MethodGet, "/v1/vms/"+url.PathEscape(name), nil, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Create asks the daemon to persist a new VM definition.
+func (c *Client) Create(v *vm.VM) (*vm.VM, error) {
+	var created vm.VM
+	if err := c.do(context.Background(), http.MethodPost, "/v1/vms", v, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// Start asks the daemon to boot a VM and returns its updated record.
+func (c *Client) Start(name string) (*vm.VM, error) {
+	var v vm.VM
+	if err := c.do(context.Background(), http.MethodPost, "/v1/vms/"+url.PathEscape(name)+"/start", nil, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Stop asks the daemon to stop a VM and returns its updated record.
+func (c *Client) Stop(name string) (*vm.VM, error) {
+	var v vm.VM
+	if err := c.do(context.Background(), http.MethodPost, "/v1/vms/"+url.PathEscape(name)+"/stop", nil, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Pause asks the daemon to pause a VM and returns its updated record.
+func (c *Client) Pause(name string) (*vm.VM, error) {
+	var v vm.VM
+	if err := c.do(context.Background(), http.MethodPost, "/v1/vms/"+url.PathEscape(name)+"/pause", nil, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Resume asks the daemon to resume a paused VM and returns its updated
+// record.
+func (c *Client) Resume(name string) (*vm.VM, error) {
+	var v vm.VM
+	if err := c.do(context.Background(), http.MethodPost, "/v1/vms/"+url.PathEscape(name)+"/resume", nil, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Restart asks the daemon to restart a VM and returns its updated record.
+func (c *Client) Restart(name string) (*vm.VM, error) {
+	var v vm.VM
+	if err := c.do(context.Background(), http.MethodPost, "/v1/vms/"+url.PathEscape(name)+"/restart", nil, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Delete asks the daemon to delete a VM.
+func (c *Client) Delete(name string, force bool) error {
+	path := "/v1/vms/" + url.PathEscape(name)
+	if force {
+		path += "?force=true"
+	}
+	return c.do(context.Background(), http.MethodDelete, path, nil, nil)
+}
+
+// SetFirewall asks the daemon to replace a VM's firewall policy and returns
+// its updated record.
+func (c *Client) SetFirewall(name string, fw *vm.Firewall) (*vm.VM, error) {
+	if fw == nil {
+		fw = &vm.Firewall{}
+	}
+	var v vm.VM
+	if err := c.do(context.Background(), http.MethodPut, "/v1/vms/"+url.PathEscape(name)+"/firewall", fw, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// firewallRuleRequest is the body of a request to add a firewall rule.
+type firewallRuleRequest struct {
+	Rule     vm.FirewallRule `json:"rule"`
+	Position int             `json:"position,omitempty"`
+}
+
+// AddFirewallRule asks the daemon to insert a rule into a VM's firewall at
+// position, counting from 1, or append it if position is 0, and returns the
+// VM's updated record.
+func (c *Client) AddFirewallRule(name string, rule vm.FirewallRule, position int) (*vm.VM, error) {
+	req := firewallRuleRequest{Rule: rule, Position: position}
+	var v vm.VM
+	if err := c.do(context.Background(), http.MethodPost, "/v1/vms/"+url.PathEscape(name)+"/firewall/rules", req, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// RemoveFirewallRule asks the daemon to remove the rule at position,
+// counting from 1, from a VM's firewall and returns its updated record.
+func (c *Client) RemoveFirewallRule(name string, position int) (*vm.VM, error) {
+	var v vm.VM
+	path := "/v1/vms/" + url.PathEscape(name) + "/firewall/rules/" + strconv.Itoa(position)
+	if err := c.do(context.Background(), http.MethodDelete, path, nil, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// firewallDefaultsRequest is the body of a request to change a firewall's
+// defaults. An empty direction is left as it is.
+type firewallDefaultsRequest struct {
+	Ingress string `json:"ingress,omitempty"`
+	Egress  string `json:"egress,omitempty"`
+}
+
+// SetFirewallDefaults asks the daemon to change what a VM's firewall does
+// with unmatched traffic and returns its updated record.
+func (c *Client) SetFirewallDefaults(name, ingress, egress string) (*vm.VM, error) {
+	req := firewallDefaultsRequest{Ingress: ingress, Egress: egress}
+	var v vm.VM
+	if err := c.do(context.Background(), http.MethodPut, "/v1/vms/"+url.PathEscape(name)+"/firewall/defaults", req, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// SetPortForwards asks the daemon to replace a VM's port forwards and
+// returns its updated record.
+func (c *Client) SetPortForwards(name string, pfs []vm.PortForward) (*vm.VM, error) {
+	if pfs == nil {
+		pfs = []vm.PortForward{}
+	}
+	var v vm.VM
+	if err := c.do(context.Background(), http.MethodPut, "/v1/vms/"+url.PathEscape(name)+"/port-forwards", pfs, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// AddPortForward asks the daemon to add a port forward to a VM and returns
+// its updated record.
+func (c *Client) AddPortForward(name string, pf vm.PortForward) (*vm.VM, error) {
+	var v vm.VM
+	if err := c.do(context.Background(), http.MethodPost, "/v1/vms/"+url.PathEscape(name)+"/port-forwards", pf, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// RemovePortForward asks the daemon to remove the forward of pf's host ports
+// from a VM and returns its updated record.
+func (c *Client) RemovePortForward(name string, pf vm.PortForward) (*vm.VM, error) {
+	var v vm.VM
+	if err := c.do(context.Background(), http.MethodDelete, "/v1/vms/"+url.PathEscape(name)+"/port-forwards", pf, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// SetRateLimits asks the daemon to replace a VM's rate limits and returns
+// its updated record.
+func (c *Client) SetRateLimits(name string, limits *vm.RateLimits) (*vm.VM, error) {
+	if limits == nil {
+		limits = &vm.RateLimits{}
+	}
+	var v vm.VM
+	if err := c.do(context.Background(), http.MethodPut, "/v1/vms/"+url.PathEscape(name)+"/rate-limits", limits, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// SetSnapshotSchedule asks the daemon to replace a VM's snapshot schedule
+// and returns its updated record. A nil schedule removes it.
+func (c *Client) SetSnapshotSchedule(name string, sched *vm.SnapshotSchedule) (*vm.VM, error) {
+	if sched == nil {
+		sched = &vm.SnapshotSchedule{}
+	}
+	var v vm.VM
+	if err := c.do(context.Background(), http.MethodPut, "/v1/vms/"+url.PathEscape(name)+"/snapshot-schedule", sched, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// balloonRequest is the body of a request to resize a VM's balloon.
+type balloonRequest struct {
+	TargetMB int `json:"target_mb"`
+}
+
+// SetBalloon asks the daemon to set the size of a VM's memory balloon and
+// returns its updated record.
+func (c *Client) SetBalloon(name string, targetMB int) (*vm.VM, error) {
+	var v vm.VM
+	if err := c.do(context.Background(), http.MethodPut, "/v1/vms/"+url.PathEscape(name)+"/balloon", balloonRequest{TargetMB: targetMB}, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// SetBoot asks the daemon to change how a stopped VM boots and returns its
+// updated record.
+func (c *Client) SetBoot(name string, boot vm.Boot) (*vm.VM, error) {
+	var v vm.VM
+	if err := c.do(context.Background(), http.MethodPut, "/v1/vms/"+url.PathEscape(name)+"/boot", boot, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// cloneRequest is the body of a request to clone a VM from a snapshot.
+type cloneRequest struct {
+	Name string `json:"name"`
+	Warm bool   `json:"warm"`
+}
+
+// Clone asks the daemon to create and start a new VM from one of source's
+// snapshots and returns its record.
+func (c *Client) Clone(source, snapName, name string, warm bool) (*vm.VM, error) {
+	req := cloneRequest{Name: name, Warm: warm}
+	path := "/v1/vms/" + url.PathEscape(source) + "/snapshots/" + url.PathEscape(snapName) + "/clone"
+	var v vm.VM
+	if err := c.do(context.Background(), http.MethodPost, path, req, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// restoreRequest is the body of a request to restore a VM from a snapshot.
+type restoreRequest struct {
+	Force bool `json:"force"`
+	Start bool `json:"start"`
+}
+
+// Restore asks the daemon to roll a VM back in place to one of its snapshots
+// and returns its updated record.
+func (c *Client) Restore(name, snapName string, force, start bool) (*vm.VM, error) {
+	req := restoreRequest{Force: force, Start: start}
+	path := "/v1/vms/" + url.PathEscape(name) + "/snapshots/" + url.PathEscape(snapName) + "/restore"
+	var v vm.VM
+	if err := c.do(context.Background(), http.MethodPost, path, req, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Flatten asks the daemon to give a thin VM its own copy of its rootfs and
+// returns its updated record.
+func (c *Client) Flatten(name string) (*vm.VM, error) {
+	var v vm.VM
+	if err := c.do(context.Background(), http.MethodPost, "/v1/vms/"+url.PathEscape(name)+"/flatten", nil, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+type snapshotImageRequest struct {
+	Image string `json:"image"`
+}
+
+// SnapshotImage asks the daemon to save a stopped VM's rootfs as a new base
+// image.
+func (c *Client) SnapshotImage(name, imageName string) error {
+	req := snapshotImageRequest{Image: imageName}
+	return c.do(context.Background(), http.MethodPost, "/v1/vms/"+url.PathEscape(name)+"/image", req, nil)
+}
+
+// AttachVolume asks the daemon to attach a volume to a stopped VM and
+// returns its updated record.
+func (c *Client) AttachVolume(name string, att vm.VolumeAttachment) (*vm.VM, error) {
+	var v vm.VM
+	if err := c.do(context.Background(), http.MethodPost, "/v1/vms/"+url.PathEscape(name)+"/volumes", att, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// DetachVolume asks the daemon to detach a volume from a stopped VM and
+// returns its updated record.
+func (c *Client) DetachVolume(name, volume string) (*vm.VM, error) {
+	var v vm.VM
+	path := "/v1/vms/" + url.PathEscape(name) + "/volumes/" + url.PathEscape(volume)
+	if err := c.do(context.Background(), http.MethodDelete, path, nil, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// resizeVolumeRequest is the body of a request to resize a volume.
+type resizeVolumeRequest struct {
+	SizeMB int `json:"size_mb"`
+}
+
+// ResizeVolume asks the daemon to grow a volume and returns its updated
+// record.
+func (c *Client) ResizeVolume(name string, sizeMB int) (*volume.Volume, error) {
+	var vol volume.Volume
+	if err := c.do(context.Background(), http.MethodPost, "/v1/volumes/"+url.PathEscape(name)+"/resize", resizeVolumeRequest{SizeMB: sizeMB}, &vol); err != nil {
+		return nil, err
+	}
+	return &vol, nil
+}
+
+// DeleteVolume asks the daemon to delete a volume that is not attached to a
+// VM.
+func (c *Client) DeleteVolume(name string) error {
+	return c.do(context.Background(), http.MethodDelete, "/v1/volumes/"+url.PathEscape(name), nil, nil)
+}
+
+// BalloonStats returns a running VM's balloon size and guest memory
+// statistics.
+func (c *Client) BalloonStats(name string) (*vm.BalloonStats, error) {
+	var st vm.BalloonStats
+	if err := c.do(context.Background(), http.MethodGet, "/v1/vms/"+url.PathEscape(name)+"/balloon", nil, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// PortForwardStats returns the counters of the forwards vmmd relays in
+// proxy mode.
+func (c *Client) PortForwardStats() ([]portproxy.Stats, error) {
+	var stats []portproxy.Stats
+	if err := c.do(context.Background(), http.MethodGet, "/v1/port-forwards", nil, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// remoteError is an error reported by the daemon. It matches ErrNotFound or
+// ErrConflict with errors.Is, like the errors returned in-process.
+type remoteError struct {
+	kind error
+	msg  string
+}
+
+func (e *remoteError) Error() string { return e.msg }
+func (e *remoteError) Unwrap() error { return e.kind }
+
+// do performs a request against the daemon. Error responses are converted back
+// into errors that match ErrNotFound and ErrConflict, so callers can handle
+// local and remote backends the same way.
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://vmmd"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		if apiErr.Error == "" {
+			apiErr.Error = resp.Status
+		}
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return &remoteError{kind: ErrNotFound, msg: apiErr.Error}
+		case http.StatusConflict:
+			return &remoteError{kind: ErrConflict, msg: apiErr.Error}
+		default:
+			return fmt.Errorf("%s", apiErr.Error)
+		}
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,765 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+
+	"github.com/raesene/baremetalvmm/internal/config"
+	"github.com/raesene/baremetalvmm/internal/portproxy"
+	"github.com/raesene/baremetalvmm/internal/validate"
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+// Server exposes a Service over HTTP on a unix socket.
+type Server struct {
+	svc        *Service
+	socketPath string
+	router     chi.Router
+}
+
+// NewServer creates a daemon Server for the given configuration. If socketPath
+// is empty the default path under the data directory is used.
+func NewServer(cfg *config.Config, socketPath string) *Server {
+	if socketPath == "" {
+		socketPath = cfg.GetPaths().DaemonSocket
+	}
+	s := &Server{
+		svc:        NewService(cfg),
+		socketPath: socketPath,
+	}
+	s.setupRouter()
+	return s
+}
+
+// Service returns the Service backing the server, for in-process callers such
+// as the autostart pass run when the daemon boots.
+func (s *Server) Service() *Service {
+	return s.svc
+}
+
+func (s *Server) setupRouter() {
+	r := chi.NewRouter()
+	r.Use(middleware.Recoverer)
+
+	r.Route("/v1", func(r chi.Router) {
+		r.Get("/health", s.handleHealth)
+		r.Get("/vms", s.handleList)
+		r.Post("/vms", s.handleCreate)
+		r.Get("/vms/{name}", s.handleGet)
+		r.Post("/vms/{name}/start", s.handleStart)
+		r.Post("/vms/{name}/stop", s.handleStop)
+		r.Post("/vms/{name}/pause", s.handlePause)
+		r.Post("/vms/{name}/resume", s.handleResume)
+		r.Post("/vms/{name}/restart", s.handleRestart)
+		r.Put("/vms/{name}/firewall", s.handleSetFirewall)
+		r.Post("/vms/{name}/firewall/rules", s.handleAddFirewallRule)
+		r.Delete("/vms/{name}/firewall/rules/{position}", s.handleRemoveFirewallRule)
+		r.Put("/vms/{name}/firewall/defaults", s.handleSetFirewallDefaults)
+		r.Put("/vms/{name}/port-forwards", s.handleSetPortForwards)
+		r.Post("/vms/{name}/port-forwards", s.handleAddPortForward)
+		r.Delete("/vms/{name}/port-forwards", s.handleRemovePortForward)
+		r.Put("/vms/{name}/rate-limits", s.handleSetRateLimits)
+		r.Put("/vms/{name}/snapshot-schedule", s.handleSetSnapshotSchedule)
+		r.Get("/vms/{name}/balloon", s.handleBalloonStats)
+		r.Put("/vms/{name}/balloon", s.handleSetBalloon)
+		r.Put("/vms/{name}/boot", s.handleSetBoot)
+		r.Post("/vms/{name}/snapshots/{snapshot}/clone", s.handleClone)
+		r.Post("/vms/{name}/snapshots/{snapshot}/restore", s.handleRestore)
+		r.Post("/vms/{name}/flatten", s.handleFlatten)
+		r.Post("/vms/{name}/image", s.handleSnapshotImage)
+		r.Post("/vms/{name}/volumes", s.handleAttachVolume)
+		r.Delete("/vms/{name}/volumes/{volume}", s.handleDetachVolume)
+		r.Delete("/vms/{name}", s.handleDelete)
+		r.Post("/volumes/{volume}/resize", s.handleResizeVolume)
+		r.Delete("/volumes/{volume}", s.handleDeleteVolume)
+		r.Get("/port-forwards", s.handlePortForwardStats)
+	})
+
+	s.router = r
+}
+
+// Run listens on the unix socket and serves requests until ctx is cancelled.
+// The socket is only accessible to the owner (root), since every operation it
+// exposes is privileged.
+func (s *Server) Run(ctx context.Context) error {
+	if err := os.MkdirAll(filepath.Dir(s.socketPath), 0700); err != nil {
+		return fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	// A stale socket from a previous run would make Listen fail. Refuse to
+	// remove it if another daemon is still answering on it.
+	if _, err := Connect(s.socketPath); err == nil {
+		return fmt.Errorf("vmmd is already running on %s", s.socketPath)
+	}
+	os.Remove(s.socketPath)
+
+	ln, err := net.Listen("unix", s.socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.socketPath, err)
+	}
+	if err := os.Chmod(s.socketPath, 0600); err != nil {
+		ln.Close()
+		return fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+	defer os.Remove(s.socketPath)
+
+	srv := &http.Server{
+		Handler:           s.router,
+		ReadHeaderTimeout: 10 * time.Second,
+		// No WriteTimeout: starting a VM may download images first.
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("vmmd listening on %s", s.socketPath)
+		errCh <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		log.Println("Shutting down...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	}
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	vms, err := s.svc.List()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, vms)
+}
+
+func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
+	var v vm.VM
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	if err := validate.VMName(v.Name); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if v.RateLimits != nil {
+		if err := v.RateLimits.Validate(); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	created, err := s.svc.Create(&v)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	v, err := s.svc.Get(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handleStart(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	v, err := s.svc.Start(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("started VM %s (IP %s, PID %d)", v.Name, v.IPAddress, v.PID)
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handleStop(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	v, err := s.svc.Stop(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("stopped VM %s", v.Name)
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handlePause(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	v, err := s.svc.Pause(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("paused VM %s", v.Name)
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handleResume(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	v, err := s.svc.Resume(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("resumed VM %s", v.Name)
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handleRestart(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	v, err := s.svc.Restart(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("restarted VM %s (IP %s, PID %d)", v.Name, v.IPAddress, v.PID)
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	force := r.URL.Query().Get("force") == "true"
+	if err := s.svc.Delete(name, force); err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("deleted VM %s", name)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+func (s *Server) handleSetFirewall(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	var fw vm.Firewall
+	if err := json.NewDecoder(r.Body).Decode(&fw); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	if err := fw.Validate(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	v, err := s.svc.SetFirewall(name, &fw)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("set firewall for VM %s: %s", v.Name, v.Firewall.Summary())
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handleAddFirewallRule(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	var req firewallRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	if err := req.Rule.Validate(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	v, err := s.svc.AddFirewallRule(name, req.Rule, req.Position)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("added firewall rule to VM %s: %s", v.Name, req.Rule)
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handleRemoveFirewallRule(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	position, err := strconv.Atoi(chi.URLParam(r, "position"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid rule number"})
+		return
+	}
+	v, err := s.svc.RemoveFirewallRule(name, position)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("removed firewall rule %d from VM %s", position, v.Name)
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handleSetFirewallDefaults(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	var req firewallDefaultsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	defaults := vm.Firewall{DefaultIngress: req.Ingress, DefaultEgress: req.Egress}
+	if err := defaults.Validate(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	v, err := s.svc.SetFirewallDefaults(name, req.Ingress, req.Egress)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("set firewall for VM %s: %s", v.Name, v.Firewall.Summary())
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handleSetRateLimits(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	var limits vm.RateLimits
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	if err := limits.Validate(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	v, err := s.svc.SetRateLimits(name, &limits)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("set rate limits for VM %s: %s", v.Name, v.RateLimits.Summary())
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handleSetSnapshotSchedule(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	var sched vm.SnapshotSchedule
+	if err := json.NewDecoder(r.Body).Decode(&sched); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	if !sched.Empty() {
+		if err := sched.Validate(); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	v, err := s.svc.SetSnapshotSchedule(name, &sched)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("set snapshot schedule for VM %s: %s", v.Name, v.SnapshotSchedule.Summary())
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handleSetBalloon(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	var req balloonRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	existing, err := s.svc.Get(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := existing.ValidateBalloon(req.TargetMB); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	v, err := s.svc.SetBalloon(name, req.TargetMB)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("set balloon of VM %s to %d MB", v.Name, v.BalloonMB)
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handleSetBoot(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	var boot vm.Boot
+	if err := json.NewDecoder(r.Body).Decode(&boot); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	if err := boot.Validate(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	v, err := s.svc.SetBoot(name, boot)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("set boot settings for VM %s: kernel %s, initrd %q, args %q", v.Name, v.Kernel, v.Initrd, v.KernelArgs)
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handleClone(w http.ResponseWriter, r *http.Request) {
+	source, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	snapName := chi.URLParam(r, "snapshot")
+	if err := validate.SnapshotName(snapName); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	var req cloneRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	if err := validate.VMName(req.Name); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	v, err := s.svc.Clone(source, snapName, req.Name, req.Warm)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("cloned VM %s from snapshot %s of %s (IP %s, PID %d)", v.Name, snapName, source, v.IPAddress, v.PID)
+	writeJSON(w, http.StatusCreated, v)
+}
+
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	snapName := chi.URLParam(r, "snapshot")
+	if err := validate.SnapshotName(snapName); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	var req restoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	v, err := s.svc.Restore(name, snapName, req.Force, req.Start)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("restored VM %s from snapshot %s (state %s)", v.Name, snapName, v.State)
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handleFlatten(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	v, err := s.svc.Flatten(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("flattened the disk of VM %s", v.Name)
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handleSnapshotImage(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	var req snapshotImageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	if err := validate.ImageName(req.Image); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := s.svc.SnapshotImage(name, req.Image); err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("snapshotted the rootfs of VM %s as image %s", name, req.Image)
+	writeJSON(w, http.StatusCreated, map[string]string{"status": "created"})
+}
+
+func (s *Server) handleAttachVolume(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	var att vm.VolumeAttachment
+	if err := json.NewDecoder(r.Body).Decode(&att); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	if err := validate.VolumeName(att.Name); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if att.MountPath != "" {
+		if err := validate.GuestMountPath(att.MountPath); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	v, err := s.svc.AttachVolume(name, att)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("attached volume %s to VM %s", att.Name, v.Name)
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handleDetachVolume(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	volume := chi.URLParam(r, "volume")
+	if err := validate.VolumeName(volume); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	v, err := s.svc.DetachVolume(name, volume)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("detached volume %s from VM %s", volume, v.Name)
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handleResizeVolume(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "volume")
+	if err := validate.VolumeName(name); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	var req resizeVolumeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	if err := validate.VolumeSizeMB(req.SizeMB); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	vol, err := s.svc.ResizeVolume(name, req.SizeMB)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("resized volume %s to %d MB", vol.Name, vol.SizeMB)
+	writeJSON(w, http.StatusOK, vol)
+}
+
+func (s *Server) handleDeleteVolume(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "volume")
+	if err := validate.VolumeName(name); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := s.svc.DeleteVolume(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("deleted volume %s", name)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+func (s *Server) handleBalloonStats(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	st, err := s.svc.BalloonStats(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+func (s *Server) handleSetPortForwards(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	var pfs []vm.PortForward
+	if err := json.NewDecoder(r.Body).Decode(&pfs); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	for i := range pfs {
+		// An unset protocol means tcp
+		if pfs[i].Protocol == "" {
+			pfs[i].Protocol = "tcp"
+		}
+		if err := pfs[i].Validate(); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	v, err := s.svc.SetPortForwards(name, pfs)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("set %d port forwards for VM %s", len(v.PortForwards), v.Name)
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handleAddPortForward(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	var pf vm.PortForward
+	if err := json.NewDecoder(r.Body).Decode(&pf); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	if pf.Protocol == "" {
+		pf.Protocol = "tcp"
+	}
+	if err := pf.Validate(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	v, err := s.svc.AddPortForward(name, pf)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("added port forward %s to VM %s", pf, v.Name)
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handleRemovePortForward(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmName(w, r)
+	if !ok {
+		return
+	}
+	var pf vm.PortForward
+	if err := json.NewDecoder(r.Body).Decode(&pf); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	if pf.Protocol == "" {
+		pf.Protocol = "tcp"
+	}
+	v, err := s.svc.RemovePortForward(name, pf)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("removed port forward %s from VM %s", pf.HostPorts(), v.Name)
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handlePortForwardStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.svc.PortForwardStats()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if stats == nil {
+		stats = []portproxy.Stats{}
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// vmName extracts and validates the {name} URL parameter, writing a 400
+// response if it is invalid.
+func vmName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := chi.URLParam(r, "name")
+	if err := validate.VMName(name); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return "", false
+	}
+	return name, true
+}
+
+// writeError maps a Service error to an HTTP status code.
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, ErrConflict):
+		code = http.StatusConflict
+	}
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(data)
+}
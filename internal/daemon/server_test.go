@@ -0,0 +1,559 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raesene/baremetalvmm/internal/config"
+	"github.com/raesene/baremetalvmm/internal/portproxy"
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+// startTestServer runs a daemon on a socket in a temporary data directory and
+// returns a connected client.
+func startTestServer(t *testing.T) *Client {
+	t.Helper()
+
+	cfg := config.DefaultConfig()
+	cfg.DataDir = t.TempDir()
+	return runServer(t, NewServer(cfg, ""))
+}
+
+// runServer runs srv until the test ends and returns a connected client.
+func runServer(t *testing.T, srv *Server) *Client {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := Connect(srv.socketPath)
+		if err == nil {
+			return c
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("daemon did not come up: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestClientCreateGetList(t *testing.T) {
+	c := startTestServer(t)
+
+	newVM := vm.NewVM("web1")
+	newVM.CPUs = 2
+	created, err := c.Create(newVM)
+	if err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+	if created.Name != "web1" || created.CPUs != 2 {
+		t.Errorf("Create() = %+v, want name web1 with 2 CPUs", created)
+	}
+
+	got, err := c.Get("web1")
+	if err != nil {
+		t.Fatalf("Get() error: %v", err)
+	}
+	if got.ID != newVM.ID {
+		t.Errorf("Get() ID = %q, want %q", got.ID, newVM.ID)
+	}
+	if got.State != vm.StateCreated {
+		t.Errorf("Get() State = %q, want %q", got.State, vm.StateCreated)
+	}
+
+	vms, err := c.List()
+	if err != nil {
+		t.Fatalf("List() error: %v", err)
+	}
+	if len(vms) != 1 || vms[0].Name != "web1" {
+		t.Errorf("List() = %v, want [web1]", vms)
+	}
+}
+
+func TestClientErrorsMatchSentinels(t *testing.T) {
+	c := startTestServer(t)
+
+	tests := []struct {
+		name string
+		op   func() error
+		want error
+	}{
+		{
+			name: "get missing VM",
+			op:   func() error { _, err := c.Get("missing"); return err },
+			want: ErrNotFound,
+		},
+		{
+			name: "stop missing VM",
+			op:   func() error { _, err := c.Stop("missing"); return err },
+			want: ErrNotFound,
+		},
+		{
+			name: "delete missing VM",
+			op:   func() error { return c.Delete("missing", false) },
+			want: ErrNotFound,
+		},
+		{
+			name: "create duplicate VM",
+			op: func() error {
+				if _, err := c.Create(vm.NewVM("dup")); err != nil {
+					return err
+				}
+				_, err := c.Create(vm.NewVM("dup"))
+				return err
+			},
+			want: ErrConflict,
+		},
+		{
+			name: "stop stopped VM",
+			op: func() error {
+				if _, err := c.Create(vm.NewVM("idle")); err != nil {
+					return err
+				}
+				_, err := c.Stop("idle")
+				return err
+			},
+			want: ErrConflict,
+		},
+		{
+			name: "pause stopped VM",
+			op: func() error {
+				if _, err := c.Create(vm.NewVM("asleep")); err != nil {
+					return err
+				}
+				_, err := c.Pause("asleep")
+				return err
+			},
+			want: ErrConflict,
+		},
+		{
+			name: "resume missing VM",
+			op:   func() error { _, err := c.Resume("missing"); return err },
+			want: ErrNotFound,
+		},
+		{
+			name: "flatten VM with its own rootfs",
+			op: func() error {
+				if _, err := c.Create(vm.NewVM("thick")); err != nil {
+					return err
+				}
+				_, err := c.Flatten("thick")
+				return err
+			},
+			want: ErrConflict,
+		},
+		{
+			name: "snapshot missing VM as image",
+			op:   func() error { return c.SnapshotImage("missing", "template") },
+			want: ErrNotFound,
+		},
+		{
+			name: "attach missing volume",
+			op: func() error {
+				if _, err := c.Create(vm.NewVM("storage")); err != nil {
+					return err
+				}
+				_, err := c.AttachVolume("storage", vm.VolumeAttachment{Name: "missing"})
+				return err
+			},
+			want: ErrNotFound,
+		},
+		{
+			name: "detach volume that is not attached",
+			op:   func() error { _, err := c.DetachVolume("storage", "missing"); return err },
+			want: ErrNotFound,
+		},
+		{
+			name: "clone missing VM",
+			op:   func() error { _, err := c.Clone("missing", "golden", "copy", false); return err },
+			want: ErrNotFound,
+		},
+		{
+			name: "clone missing snapshot",
+			op: func() error {
+				if _, err := c.Create(vm.NewVM("origin")); err != nil {
+					return err
+				}
+				_, err := c.Clone("origin", "golden", "copy", false)
+				return err
+			},
+			want: ErrNotFound,
+		},
+		{
+			name: "restore missing VM",
+			op:   func() error { _, err := c.Restore("missing", "golden", false, true); return err },
+			want: ErrNotFound,
+		},
+		{
+			name: "restore missing snapshot",
+			op:   func() error { _, err := c.Restore("origin", "golden", false, true); return err },
+			want: ErrNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.op()
+			if !errors.Is(err, tt.want) {
+				t.Errorf("error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientDeleteStoppedVM(t *testing.T) {
+	c := startTestServer(t)
+
+	if _, err := c.Create(vm.NewVM("gone")); err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+	if err := c.Delete("gone", false); err != nil {
+		t.Fatalf("Delete() error: %v", err)
+	}
+	if _, err := c.Get("gone"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() after Delete error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestClientRestart(t *testing.T) {
+	c := startTestServer(t)
+
+	// The lifecycle's own error, not the router's 404 for an unknown route
+	_, err := c.Restart("missing")
+	if !errors.Is(err, ErrNotFound) || !strings.Contains(err.Error(), "VM 'missing' not found") {
+		t.Errorf("Restart() of a missing VM error = %v, want the VM reported not found", err)
+	}
+}
+
+func TestClientSetFirewall(t *testing.T) {
+	c := startTestServer(t)
+
+	if _, err := c.Create(vm.NewVM("fw")); err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+	fw := &vm.Firewall{
+		DefaultIngress: vm.FirewallDeny,
+		Rules:          []vm.FirewallRule{{Direction: vm.FirewallIngress, Action: vm.FirewallAllow, Protocol: "tcp", Port: 22}},
+	}
+	if _, err := c.SetFirewall("fw", fw); err != nil {
+		t.Fatalf("SetFirewall() error: %v", err)
+	}
+	got, err := c.Get("fw")
+	if err != nil {
+		t.Fatalf("Get() error: %v", err)
+	}
+	if got.Firewall == nil || got.Firewall.DefaultIngress != vm.FirewallDeny || len(got.Firewall.Rules) != 1 {
+		t.Errorf("Get() firewall = %+v, want the policy just set", got.Firewall)
+	}
+
+	bad := &vm.Firewall{Rules: []vm.FirewallRule{{Direction: "sideways", Action: vm.FirewallAllow}}}
+	if _, err := c.SetFirewall("fw", bad); err == nil || !strings.Contains(err.Error(), "invalid direction") {
+		t.Errorf("SetFirewall() with an invalid rule error = %v, want an invalid direction error", err)
+	}
+
+	if _, err := c.SetFirewall("fw", nil); err != nil {
+		t.Fatalf("SetFirewall(nil) error: %v", err)
+	}
+	if got, _ := c.Get("fw"); got.Firewall != nil {
+		t.Errorf("firewall after clearing = %+v, want none", got.Firewall)
+	}
+	if _, err := c.SetFirewall("missing", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetFirewall() on a missing VM error = %v, want ErrNotFound", err)
+	}
+
+	rule := vm.FirewallRule{Direction: vm.FirewallEgress, Action: vm.FirewallDeny, CIDR: "172.16.0.0/16"}
+	if _, err := c.AddFirewallRule("fw", rule, 0); err != nil {
+		t.Fatalf("AddFirewallRule() error: %v", err)
+	}
+	if _, err := c.SetFirewallDefaults("fw", "", vm.FirewallDeny); err != nil {
+		t.Fatalf("SetFirewallDefaults() error: %v", err)
+	}
+	if _, err := c.SetFirewallDefaults("fw", "maybe", ""); err == nil || !strings.Contains(err.Error(), "invalid default") {
+		t.Errorf("SetFirewallDefaults() with an invalid default error = %v, want an invalid default error", err)
+	}
+	got, err = c.Get("fw")
+	if err != nil {
+		t.Fatalf("Get() error: %v", err)
+	}
+	if got.Firewall == nil || got.Firewall.DefaultEgress != vm.FirewallDeny || len(got.Firewall.Rules) != 1 || got.Firewall.Rules[0] != rule {
+		t.Errorf("Get() firewall = %+v, want the added rule and an egress default of deny", got.Firewall)
+	}
+	if _, err := c.RemoveFirewallRule("fw", 2); !errors.Is(err, ErrNotFound) {
+		t.Errorf("RemoveFirewallRule() of a missing rule error = %v, want ErrNotFound", err)
+	}
+	if _, err := c.RemoveFirewallRule("fw", 1); err != nil {
+		t.Fatalf("RemoveFirewallRule() error: %v", err)
+	}
+}
+
+func TestClientSetRateLimits(t *testing.T) {
+	c := startTestServer(t)
+
+	if _, err := c.Create(vm.NewVM("rl")); err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+	limits := &vm.RateLimits{Net: vm.RateLimit{BandwidthMiB: 20}, Disk: vm.RateLimit{Ops: 500}}
+	if _, err := c.SetRateLimits("rl", limits); err != nil {
+		t.Fatalf("SetRateLimits() error: %v", err)
+	}
+	got, err := c.Get("rl")
+	if err != nil {
+		t.Fatalf("Get() error: %v", err)
+	}
+	if got.RateLimits == nil || *got.RateLimits != *limits {
+		t.Errorf("Get() rate limits = %+v, want %+v", got.RateLimits, limits)
+	}
+
+	bad := &vm.RateLimits{Disk: vm.RateLimit{BandwidthMiB: -5}}
+	if _, err := c.SetRateLimits("rl", bad); err == nil || !strings.Contains(err.Error(), "must not be negative") {
+		t.Errorf("SetRateLimits() with a negative limit error = %v, want a validation error", err)
+	}
+
+	if _, err := c.SetRateLimits("rl", nil); err != nil {
+		t.Fatalf("SetRateLimits(nil) error: %v", err)
+	}
+	if got, _ := c.Get("rl"); got.RateLimits != nil {
+		t.Errorf("rate limits after clearing = %+v, want none", got.RateLimits)
+	}
+}
+
+func TestClientSetSnapshotSchedule(t *testing.T) {
+	c := startTestServer(t)
+
+	if _, err := c.Create(vm.NewVM("sched")); err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+	sched := &vm.SnapshotSchedule{Every: "6h", KeepHourly: 4, KeepDaily: 7}
+	if _, err := c.SetSnapshotSchedule("sched", sched); err != nil {
+		t.Fatalf("SetSnapshotSchedule() error: %v", err)
+	}
+	got, err := c.Get("sched")
+	if err != nil {
+		t.Fatalf("Get() error: %v", err)
+	}
+	if got.SnapshotSchedule == nil || *got.SnapshotSchedule != *sched {
+		t.Errorf("Get() snapshot schedule = %+v, want %+v", got.SnapshotSchedule, sched)
+	}
+
+	bad := &vm.SnapshotSchedule{Every: "10s", KeepDaily: 1}
+	if _, err := c.SetSnapshotSchedule("sched", bad); err == nil || !strings.Contains(err.Error(), "at least") {
+		t.Errorf("SetSnapshotSchedule() with a short interval error = %v, want a validation error", err)
+	}
+
+	if _, err := c.SetSnapshotSchedule("sched", nil); err != nil {
+		t.Fatalf("SetSnapshotSchedule(nil) error: %v", err)
+	}
+	if got, _ := c.Get("sched"); got.SnapshotSchedule != nil {
+		t.Errorf("snapshot schedule after clearing = %+v, want none", got.SnapshotSchedule)
+	}
+	if _, err := c.SetSnapshotSchedule("missing", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetSnapshotSchedule() on a missing VM error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestClientSetBalloon(t *testing.T) {
+	c := startTestServer(t)
+
+	if _, err := c.Create(vm.NewVM("small")); err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+	if _, err := c.SetBalloon("small", 128); err != nil {
+		t.Fatalf("SetBalloon() error: %v", err)
+	}
+	if got, _ := c.Get("small"); got.BalloonMB != 128 {
+		t.Errorf("Get() balloon = %d MB, want 128", got.BalloonMB)
+	}
+
+	if _, err := c.SetBalloon("small", 4096); err == nil || !strings.Contains(err.Error(), "must be less than") {
+		t.Errorf("SetBalloon() larger than the VM error = %v, want a validation error", err)
+	}
+	if _, err := c.BalloonStats("small"); !errors.Is(err, ErrConflict) {
+		t.Errorf("BalloonStats() of a stopped VM error = %v, want ErrConflict", err)
+	}
+}
+
+func TestClientSetBoot(t *testing.T) {
+	c := startTestServer(t)
+
+	if _, err := c.Create(vm.NewVM("boot")); err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+	if _, err := c.SetBoot("boot", vm.Boot{Kernel: "missing"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetBoot() with a missing kernel error = %v, want ErrNotFound", err)
+	}
+	if _, err := c.SetBoot("boot", vm.Boot{Kernel: "default", KernelArgs: "init=/bin/sh\x00"}); err == nil || !strings.Contains(err.Error(), "kernel arguments") {
+		t.Errorf("SetBoot() with a control character error = %v, want a validation error", err)
+	}
+}
+
+func TestClientVolumes(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.DataDir = t.TempDir()
+	c := runServer(t, NewServer(cfg, ""))
+
+	volumes := cfg.GetPaths().Volumes
+	if err := os.MkdirAll(volumes, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(volumes, "db.json"), []byte(`{"name": "db", "size_mb": 1024}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Create(vm.NewVM("web")); err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+
+	if _, err := c.AttachVolume("web", vm.VolumeAttachment{Name: "db", MountPath: "not/absolute"}); err == nil || !strings.Contains(err.Error(), "absolute") {
+		t.Errorf("AttachVolume() with a relative path error = %v, want a validation error", err)
+	}
+	v, err := c.AttachVolume("web", vm.VolumeAttachment{Name: "db", ReadOnly: true})
+	if err != nil {
+		t.Fatalf("AttachVolume() error: %v", err)
+	}
+	if att := v.Volume("db"); att == nil || att.MountPath != "/mnt/db" || !att.ReadOnly {
+		t.Errorf("attached volume = %+v, want db read-only on /mnt/db", att)
+	}
+	if v, err = c.DetachVolume("web", "db"); err != nil {
+		t.Fatalf("DetachVolume() error: %v", err)
+	}
+	if len(v.Volumes) != 0 {
+		t.Errorf("volumes after detach = %+v", v.Volumes)
+	}
+
+	if _, err := c.ResizeVolume("db", 512); !errors.Is(err, ErrConflict) {
+		t.Errorf("ResizeVolume() shrinking error = %v, want ErrConflict", err)
+	}
+	if err := c.DeleteVolume("db"); err != nil {
+		t.Fatalf("DeleteVolume() error: %v", err)
+	}
+	if err := c.DeleteVolume("db"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DeleteVolume() of deleted volume error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestClientSetPortForwards(t *testing.T) {
+	c := startTestServer(t)
+
+	for _, name := range []string{"web", "db"} {
+		if _, err := c.Create(vm.NewVM(name)); err != nil {
+			t.Fatalf("Create(%s) error: %v", name, err)
+		}
+	}
+	pfs := []vm.PortForward{
+		{HostPort: 8080, GuestPort: 80, Protocol: "tcp"},
+		{HostPort: 10000, HostPortEnd: 10010, GuestPort: 10000, Protocol: "udp"},
+	}
+	if _, err := c.SetPortForwards("web", pfs); err != nil {
+		t.Fatalf("SetPortForwards() error: %v", err)
+	}
+	got, err := c.Get("web")
+	if err != nil {
+		t.Fatalf("Get() error: %v", err)
+	}
+	if len(got.PortForwards) != 2 || got.PortForwards[1] != pfs[1] {
+		t.Errorf("Get() port forwards = %v, want %v", got.PortForwards, pfs)
+	}
+
+	// A forward without a protocol is tcp
+	v, err := c.SetPortForwards("db", []vm.PortForward{{HostPort: 2222, GuestPort: 22}})
+	if err != nil {
+		t.Fatalf("SetPortForwards() without a protocol error: %v", err)
+	}
+	if len(v.PortForwards) != 1 || v.PortForwards[0].Protocol != "tcp" {
+		t.Errorf("port forwards without a protocol = %v, want tcp", v.PortForwards)
+	}
+
+	bad := []vm.PortForward{{HostPort: 8080, GuestPort: 80, Protocol: "sctp"}}
+	if _, err := c.SetPortForwards("db", bad); err == nil || !strings.Contains(err.Error(), "invalid protocol") {
+		t.Errorf("SetPortForwards() with an invalid protocol error = %v, want an invalid protocol error", err)
+	}
+	taken := []vm.PortForward{{HostPort: 10005, GuestPort: 5000, Protocol: "udp"}}
+	if _, err := c.SetPortForwards("db", taken); !errors.Is(err, ErrConflict) {
+		t.Errorf("SetPortForwards() with web's port error = %v, want ErrConflict", err)
+	}
+
+	if _, err := c.AddPortForward("db", vm.PortForward{HostPort: 5432, GuestPort: 5432}); err != nil {
+		t.Fatalf("AddPortForward() error: %v", err)
+	}
+	if _, err := c.AddPortForward("db", vm.PortForward{HostPort: 8080, GuestPort: 80}); !errors.Is(err, ErrConflict) {
+		t.Errorf("AddPortForward() with web's port error = %v, want ErrConflict", err)
+	}
+	if _, err := c.RemovePortForward("web", vm.PortForward{HostPort: 8080}); err != nil {
+		t.Fatalf("RemovePortForward() error: %v", err)
+	}
+	if got, _ := c.Get("web"); len(got.PortForwards) != 1 || got.PortForwards[0] != pfs[1] {
+		t.Errorf("port forwards after removal = %v, want [%v]", got.PortForwards, pfs[1])
+	}
+	if _, err := c.RemovePortForward("web", vm.PortForward{HostPort: 8080}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("RemovePortForward() of a removed forward error = %v, want ErrNotFound", err)
+	}
+
+	if _, err := c.SetPortForwards("web", nil); err != nil {
+		t.Fatalf("SetPortForwards(nil) error: %v", err)
+	}
+	if got, _ := c.Get("web"); len(got.PortForwards) != 0 {
+		t.Errorf("port forwards after clearing = %v, want none", got.PortForwards)
+	}
+	if _, err := c.SetPortForwards("missing", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetPortForwards() on a missing VM error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestClientPortForwardStats(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.DataDir = t.TempDir()
+	srv := NewServer(cfg, "")
+	proxy := portproxy.New()
+	defer proxy.Close()
+	srv.Service().SetPortProxy(proxy)
+
+	// Nothing is relayed until there are forwards in proxy mode
+	c := runServer(t, srv)
+	stats, err := c.PortForwardStats()
+	if err != nil {
+		t.Fatalf("PortForwardStats() error: %v", err)
+	}
+	if len(stats) != 0 {
+		t.Errorf("PortForwardStats() with no forwards = %+v, want none", stats)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	if err := proxy.Sync([]portproxy.Forward{{VM: "web", Protocol: "tcp", HostPort: port, GuestIP: "172.16.0.2", GuestPort: 80}}); err != nil {
+		t.Fatalf("Sync() error: %v", err)
+	}
+
+	stats, err = c.PortForwardStats()
+	if err != nil {
+		t.Fatalf("PortForwardStats() error: %v", err)
+	}
+	if len(stats) != 1 || stats[0].VM != "web" || stats[0].HostPort != port || stats[0].Target != "172.16.0.2:80" {
+		t.Errorf("PortForwardStats() = %+v, want the forward to web", stats)
+	}
+}
+
+func TestRunRefusesSecondDaemon(t *testing.T) {
+	c := startTestServer(t)
+
+	cfg := config.DefaultConfig()
+	srv := NewServer(cfg, c.socketPath)
+	if err := srv.Run(context.Background()); err == nil {
+		t.Error("Run() on a socket already served should fail")
+	}
+}
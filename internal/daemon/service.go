@@ -0,0 +1,345 @@
+// Package daemon implements vmmd, the long-running process that owns all VM
+// lifecycle operations on a host.
+//
+// The daemon holds the Firecracker processes, TAP devices and VM state files
+// and exposes them over a local HTTP API on a unix socket. The vmm CLI and the
+// vmm-web UI talk to it through Client, so concurrent requests are serialised
+// in one place instead of racing on IP allocation or half-written state. The
+// operations themselves are implemented by the lifecycle package.
+//
+// When vmmd is not running, Open returns an in-process Service instead, so the
+// CLI keeps working on hosts that have not installed the daemon.
+package daemon
+
+import (
+	"sync"
+
+	"github.com/raesene/baremetalvmm/internal/config"
+	"github.com/raesene/baremetalvmm/internal/lifecycle"
+	"github.com/raesene/baremetalvmm/internal/portproxy"
+	"github.com/raesene/baremetalvmm/internal/vm"
+	"github.com/raesene/baremetalvmm/internal/volume"
+)
+
+var (
+	// ErrNotFound is returned when the named VM does not exist.
+	ErrNotFound = lifecycle.ErrNotFound
+	// ErrConflict is returned when a VM is in the wrong state for an operation.
+	ErrConflict = lifecycle.ErrConflict
+)
+
+// Backend is the set of VM lifecycle operations shared by the in-process
+// Service and the remote Client.
+type Backend interface {
+	List() ([]*vm.VM, error)
+	Get(name string) (*vm.VM, error)
+	Create(v *vm.VM) (*vm.VM, error)
+	Start(name string) (*vm.VM, error)
+	Stop(name string) (*vm.VM, error)
+	Pause(name string) (*vm.VM, error)
+	Resume(name string) (*vm.VM, error)
+	Restart(name string) (*vm.VM, error)
+	Delete(name string, force bool) error
+	SetFirewall(name string, fw *vm.Firewall) (*vm.VM, error)
+	AddFirewallRule(name string, rule vm.FirewallRule, position int) (*vm.VM, error)
+	RemoveFirewallRule(name string, position int) (*vm.VM, error)
+	SetFirewallDefaults(name, ingress, egress string) (*vm.VM, error)
+	SetPortForwards(name string, pfs []vm.PortForward) (*vm.VM, error)
+	AddPortForward(name string, pf vm.PortForward) (*vm.VM, error)
+	RemovePortForward(name string, pf vm.PortForward) (*vm.VM, error)
+	SetRateLimits(name string, limits *vm.RateLimits) (*vm.VM, error)
+	SetBalloon(name string, targetMB int) (*vm.VM, error)
+	SetBoot(name string, boot vm.Boot) (*vm.VM, error)
+	SetSnapshotSchedule(name string, sched *vm.SnapshotSchedule) (*vm.VM, error)
+	Clone(source, snapName, name string, warm bool) (*vm.VM, error)
+	Restore(name, snapName string, force, start bool) (*vm.VM, error)
+	Flatten(name string) (*vm.VM, error)
+	SnapshotImage(name, imageName string) error
+	AttachVolume(name string, att vm.VolumeAttachment) (*vm.VM, error)
+	DetachVolume(name, volume string) (*vm.VM, error)
+	ResizeVolume(name string, sizeMB int) (*volume.Volume, error)
+	DeleteVolume(name string) error
+	BalloonStats(name string) (*vm.BalloonStats, error)
+	PortForwardStats() ([]portproxy.Stats, error)
+}
+
+// Open returns a Client connected to vmmd if it is running, or an in-process
+// Service otherwise.
+func Open(cfg *config.Config) Backend {
+	return OpenWithProgress(cfg, nil)
+}
+
+// OpenWithProgress is like Open, but reports lifecycle progress to fn when
+// the operation runs in-process. When vmmd is running, progress is logged by
+// the daemon instead.
+func OpenWithProgress(cfg *config.Config, fn lifecycle.ProgressFunc) Backend {
+	if c, err := Connect(cfg.GetPaths().DaemonSocket); err == nil {
+		return c
+	}
+	svc := NewService(cfg)
+	svc.lc.SetProgress(fn)
+	return svc
+}
+
+// Service runs lifecycle operations in-process. All mutating operations are
+// serialised by a single lock.
+type Service struct {
+	lc    *lifecycle.Manager
+	mu    sync.Mutex
+	proxy *portproxy.Proxy
+}
+
+// NewService creates a Service using the given configuration.
+func NewService(cfg *config.Config) *Service {
+	return &Service{lc: lifecycle.NewManager(cfg)}
+}
+
+// SetProgress registers a callback for lifecycle progress reports.
+func (s *Service) SetProgress(fn lifecycle.ProgressFunc) {
+	s.lc.SetProgress(fn)
+}
+
+// SetPortProxy registers the proxy relaying forwards in proxy mode. It is
+// asked to pick up changes after every operation that starts or stops a VM
+// or changes its port forwards.
+func (s *Service) SetPortProxy(p *portproxy.Proxy) {
+	s.proxy = p
+}
+
+// refreshProxy tells the proxy that VMs or their forwards changed.
+func (s *Service) refreshProxy() {
+	if s.proxy != nil {
+		s.proxy.Refresh()
+	}
+}
+
+// Reap cleans up after VMs whose Firecracker process exited on its own, such
+// as after the guest powered off, and returns their names.
+func (s *Service) Reap() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lc.Reap()
+}
+
+// List returns all VMs with their live state.
+func (s *Service) List() ([]*vm.VM, error) {
+	return s.lc.List()
+}
+
+// Get returns a single VM with its live state.
+func (s *Service) Get(name string) (*vm.VM, error) {
+	return s.lc.Get(name)
+}
+
+// Create persists a new VM definition.
+func (s *Service) Create(v *vm.VM) (*vm.VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lc.Create(v)
+}
+
+// Start boots a stopped VM.
+func (s *Service) Start(name string) (*vm.VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.refreshProxy()
+	return s.lc.Start(name)
+}
+
+// Stop terminates a running VM.
+func (s *Service) Stop(name string) (*vm.VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.refreshProxy()
+	return s.lc.Stop(name)
+}
+
+// Pause stops a running VM's vCPUs, keeping its network.
+func (s *Service) Pause(name string) (*vm.VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lc.Pause(name)
+}
+
+// Resume starts a paused VM's vCPUs again.
+func (s *Service) Resume(name string) (*vm.VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lc.Resume(name)
+}
+
+// Restart stops a VM if it is running and starts it again.
+func (s *Service) Restart(name string) (*vm.VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.refreshProxy()
+	return s.lc.Restart(name)
+}
+
+// Delete removes a VM and all of its resources.
+func (s *Service) Delete(name string, force bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.refreshProxy()
+	return s.lc.Delete(name, force)
+}
+
+// SetFirewall replaces a VM's firewall policy.
+func (s *Service) SetFirewall(name string, fw *vm.Firewall) (*vm.VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lc.SetFirewall(name, fw)
+}
+
+// AddFirewallRule inserts a rule into a VM's firewall.
+func (s *Service) AddFirewallRule(name string, rule vm.FirewallRule, position int) (*vm.VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lc.AddFirewallRule(name, rule, position)
+}
+
+// RemoveFirewallRule removes a rule from a VM's firewall.
+func (s *Service) RemoveFirewallRule(name string, position int) (*vm.VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lc.RemoveFirewallRule(name, position)
+}
+
+// SetFirewallDefaults changes the defaults of a VM's firewall.
+func (s *Service) SetFirewallDefaults(name, ingress, egress string) (*vm.VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lc.SetFirewallDefaults(name, ingress, egress)
+}
+
+// SetPortForwards replaces a VM's port forwards.
+func (s *Service) SetPortForwards(name string, pfs []vm.PortForward) (*vm.VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.refreshProxy()
+	return s.lc.SetPortForwards(name, pfs)
+}
+
+// AddPortForward adds a port forward to a VM.
+func (s *Service) AddPortForward(name string, pf vm.PortForward) (*vm.VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.refreshProxy()
+	return s.lc.AddPortForward(name, pf)
+}
+
+// RemovePortForward removes the forward of pf's host ports from a VM.
+func (s *Service) RemovePortForward(name string, pf vm.PortForward) (*vm.VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.refreshProxy()
+	return s.lc.RemovePortForward(name, pf)
+}
+
+// SetRateLimits replaces a VM's network and disk rate limits.
+func (s *Service) SetRateLimits(name string, limits *vm.RateLimits) (*vm.VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lc.SetRateLimits(name, limits)
+}
+
+// SetSnapshotSchedule replaces or removes a VM's snapshot schedule.
+func (s *Service) SetSnapshotSchedule(name string, sched *vm.SnapshotSchedule) (*vm.VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lc.SetSnapshotSchedule(name, sched)
+}
+
+// SetBalloon sets the size of a VM's memory balloon.
+func (s *Service) SetBalloon(name string, targetMB int) (*vm.VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lc.SetBalloon(name, targetMB)
+}
+
+// SetBoot changes the kernel, kernel arguments and initrd of a stopped VM.
+func (s *Service) SetBoot(name string, boot vm.Boot) (*vm.VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lc.SetBoot(name, boot)
+}
+
+// Clone creates and starts a new VM from one of source's snapshots.
+func (s *Service) Clone(source, snapName, name string, warm bool) (*vm.VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lc.Clone(source, snapName, name, warm)
+}
+
+// Restore rolls a VM back in place to one of its snapshots.
+func (s *Service) Restore(name, snapName string, force, start bool) (*vm.VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.refreshProxy()
+	return s.lc.Restore(name, snapName, force, start)
+}
+
+// Flatten gives a thin VM its own copy of its rootfs.
+func (s *Service) Flatten(name string) (*vm.VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lc.Flatten(name)
+}
+
+// SnapshotImage saves a stopped VM's rootfs as a new base image.
+func (s *Service) SnapshotImage(name, imageName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lc.SnapshotImage(name, imageName)
+}
+
+// AttachVolume attaches a volume to a stopped VM.
+func (s *Service) AttachVolume(name string, att vm.VolumeAttachment) (*vm.VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lc.AttachVolume(name, att)
+}
+
+// DetachVolume detaches a volume from a stopped VM.
+func (s *Service) DetachVolume(name, volume string) (*vm.VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lc.DetachVolume(name, volume)
+}
+
+// ResizeVolume grows a volume that is not in use by a running VM.
+func (s *Service) ResizeVolume(name string, sizeMB int) (*volume.Volume, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lc.ResizeVolume(name, sizeMB)
+}
+
+// DeleteVolume deletes a volume that is not attached to a VM.
+func (s *Service) DeleteVolume(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lc.DeleteVolume(name)
+}
+
+// ResizeBalloon resizes a running VM's balloon without recording the size.
+// It is used by the auto-balloon policy and is not part of Backend.
+func (s *Service) ResizeBalloon(name string, targetMB int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lc.ResizeBalloon(name, targetMB)
+}
+
+// BalloonStats returns a running VM's balloon size and guest memory
+// statistics.
+func (s *Service) BalloonStats(name string) (*vm.BalloonStats, error) {
+	return s.lc.BalloonStats(name)
+}
+
+// PortForwardStats returns the counters of the forwards relayed by the
+// proxy. It returns nothing when the proxy is not running in this process.
+func (s *Service) PortForwardStats() ([]portproxy.Stats, error) {
+	if s.proxy == nil {
+		return nil, nil
+	}
+	return s.proxy.Stats(), nil
+}
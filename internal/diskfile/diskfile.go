@@ -0,0 +1,255 @@
+// Package diskfile copies and measures disk image files without expanding
+// their holes. An ext4 image is mostly unused space, which a sparse file
+// leaves unallocated, so a plain byte-for-byte copy of a 10GB rootfs writes
+// 10GB where the original takes a few hundred MB.
+//
+// Copy tries the cheapest method the filesystem supports: a reflink on
+// btrfs and XFS, which shares the source's blocks until either file is
+// written; otherwise it copies only the regions that hold data, with
+// copy_file_range so the data stays in the kernel.
+package diskfile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// maxCopyChunk bounds a single copy_file_range call.
+	maxCopyChunk = 1 << 30
+	// zeroBlockSize is the granularity at which a block device is scanned
+	// for zeros, which are left as holes in its copy.
+	zeroBlockSize = 64 << 10
+	// probeHoleSize is the hole ReportsHoles leaves in front of its probe
+	// data, larger than any filesystem's block size.
+	probeHoleSize = 1 << 20
+)
+
+// Copy copies src to dst, creating dst with perm and syncing it to disk.
+// Holes in src stay holes in dst. Any existing dst is overwritten.
+//
+// src may also be a block device, such as a thin VM disk, in which case its
+// zeroed blocks become holes.
+func Copy(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	size, err := Size(in)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	copyData := copyInto
+	if info.Mode()&os.ModeDevice != 0 {
+		copyData = copyDevice
+	}
+	if err := copyData(out, in, size); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// copyInto copies in, which is size bytes long, into the empty file out.
+func copyInto(out, in *os.File, size int64) error {
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err == nil {
+		return nil
+	}
+	// Not a reflink-capable filesystem, or src and dst are on different ones
+	if err := out.Truncate(size); err != nil {
+		return err
+	}
+	return overlay(out, in)
+}
+
+// copyDevice copies the block device in, which is size bytes long, into the
+// empty file out, skipping blocks of zeros.
+func copyDevice(out, in *os.File, size int64) error {
+	if err := out.Truncate(size); err != nil {
+		return err
+	}
+	block := make([]byte, zeroBlockSize)
+	for off := int64(0); off < size; off += zeroBlockSize {
+		n, err := in.ReadAt(block, off)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read %s: %w", in.Name(), err)
+		}
+		if AllZero(block[:n]) {
+			continue
+		}
+		if _, err := out.WriteAt(block[:n], off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AllZero reports whether b holds only zero bytes, which a sparse file need
+// not store.
+func AllZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Overlay copies the regions of src that hold data onto dst at the same
+// offsets, leaving the rest of dst as it is.
+func Overlay(dst *os.File, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return overlay(dst, in)
+}
+
+func overlay(out, in *os.File) error {
+	extents, err := DataExtents(in)
+	if err != nil {
+		return err
+	}
+	for _, e := range extents {
+		if err := copyRange(out, in, e.Start, e.End-e.Start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyRange copies n bytes at off in in to the same offset in out.
+func copyRange(out, in *os.File, off, n int64) error {
+	inOff, outOff := off, off
+	for n > 0 {
+		chunk := n
+		if chunk > maxCopyChunk {
+			chunk = maxCopyChunk
+		}
+		c, err := unix.CopyFileRange(int(in.Fd()), &inOff, int(out.Fd()), &outOff, int(chunk), 0)
+		if err != nil {
+			if errors.Is(err, unix.EXDEV) || errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EOPNOTSUPP) {
+				// Older kernels and some filesystems cannot copy in the
+				// kernel; copy through user space instead
+				_, err := io.Copy(io.NewOffsetWriter(out, outOff), io.NewSectionReader(in, inOff, n))
+				return err
+			}
+			return fmt.Errorf("failed to copy %s: %w", in.Name(), err)
+		}
+		if c == 0 {
+			return fmt.Errorf("failed to copy %s: %w", in.Name(), io.ErrUnexpectedEOF)
+		}
+		n -= int64(c)
+	}
+	return nil
+}
+
+// Extent is a region of a file that holds data, from Start up to End.
+type Extent struct {
+	Start, End int64
+}
+
+// DataExtents returns the regions of f that hold data, in order. The rest of
+// the file, up to its size, is holes. On a filesystem that does not track
+// holes the whole file is one extent.
+func DataExtents(f *os.File) ([]Extent, error) {
+	size, err := Size(f)
+	if err != nil {
+		return nil, err
+	}
+	fd := int(f.Fd())
+	var extents []Extent
+	for off := int64(0); off < size; {
+		start, err := unix.Seek(fd, off, unix.SEEK_DATA)
+		if err != nil {
+			if errors.Is(err, unix.ENXIO) {
+				break // only a hole remains
+			}
+			return nil, fmt.Errorf("failed to find data in %s: %w", f.Name(), err)
+		}
+		end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find hole in %s: %w", f.Name(), err)
+		}
+		extents = append(extents, Extent{start, end})
+		off = end
+	}
+	return extents, nil
+}
+
+// ReportsHoles reports whether the filesystem holding dir tells holes in
+// sparse files apart from data, by writing a probe file that starts with a
+// hole. Where it does not, DataExtents returns the whole file as data, so
+// holes there cannot be told apart from zeros that were written.
+func ReportsHoles(dir string) (bool, error) {
+	f, err := os.CreateTemp(dir, ".holes-probe-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	data := make([]byte, 4096)
+	for i := range data {
+		data[i] = 0xff
+	}
+	if _, err := f.WriteAt(data, probeHoleSize); err != nil {
+		return false, err
+	}
+	// Some filesystems only find out where the data lies once it is written
+	// back
+	if err := f.Sync(); err != nil {
+		return false, err
+	}
+	extents, err := DataExtents(f)
+	if err != nil {
+		return false, err
+	}
+	return len(extents) > 0 && extents[0].Start > 0, nil
+}
+
+// Size returns the size of f, which may be a block device, whose size Stat
+// does not report.
+func Size(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Mode()&os.ModeDevice == 0 {
+		return info.Size(), nil
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find the size of %s: %w", f.Name(), err)
+	}
+	return size, nil
+}
+
+// AllocatedSize returns the disk space a file takes up, which for a sparse
+// file is less than its apparent size, info.Size().
+func AllocatedSize(info os.FileInfo) int64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512
+	}
+	return info.Size()
+}
@@ -0,0 +1,164 @@
+package diskfile
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const blockSize = 1 << 20
+
+// writeSparse creates a file of n blocks where block i holds fill[i], or is
+// a hole where fill[i] is zero.
+func writeSparse(t *testing.T, path string, fill []byte) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(int64(len(fill)) * blockSize); err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range fill {
+		if b == 0 {
+			continue
+		}
+		if _, err := f.WriteAt(bytes.Repeat([]byte{b}, blockSize), int64(i)*blockSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCopy(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	writeSparse(t, src, []byte{1, 0, 0, 2, 0, 0, 0, 0})
+	// An existing dst is replaced
+	if err := os.WriteFile(dst, bytes.Repeat([]byte{9}, 10*blockSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Copy(src, dst, 0600); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	want, _ := os.ReadFile(src)
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("copy does not match the source")
+	}
+
+	srcInfo, _ := os.Stat(src)
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only a filesystem that kept src sparse can be expected to keep dst so
+	if AllocatedSize(srcInfo) < srcInfo.Size() && AllocatedSize(info) >= info.Size() {
+		t.Errorf("copy allocated %d bytes of %d; holes were filled in", AllocatedSize(info), info.Size())
+	}
+}
+
+func TestCopyMissingSource(t *testing.T) {
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "dst")
+	if err := Copy(filepath.Join(dir, "missing"), dst, 0600); err == nil {
+		t.Fatal("Copy should fail for a missing source")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("Copy created dst for a missing source: %v", err)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	layer := filepath.Join(dir, "layer")
+	writeSparse(t, base, []byte{1, 2, 3, 4})
+	writeSparse(t, layer, []byte{0, 7, 0, 8})
+
+	f, err := os.OpenFile(base, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Overlay(f, layer)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Overlay: %v", err)
+	}
+
+	got, err := os.ReadFile(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []byte{1, 7, 3, 8} {
+		if b := got[i*blockSize]; b != want {
+			t.Errorf("block %d = %d, want %d", i, b, want)
+		}
+	}
+}
+
+func TestDataExtents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk")
+	writeSparse(t, path, []byte{0, 1, 1, 0, 0, 2, 0, 0})
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	extents, err := DataExtents(f)
+	if err != nil {
+		t.Fatalf("DataExtents: %v", err)
+	}
+	if len(extents) == 0 {
+		t.Fatal("no data extents")
+	}
+	// A filesystem may report more data than was written, but never less
+	for _, block := range []int64{1, 2, 5} {
+		off, found := block*blockSize, false
+		for _, e := range extents {
+			if e.Start <= off && off+blockSize <= e.End {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("block %d is not in a data extent: %v", block, extents)
+		}
+	}
+}
+
+func TestReportsHoles(t *testing.T) {
+	dir := t.TempDir()
+	holes, err := ReportsHoles(dir)
+	if err != nil {
+		t.Fatalf("ReportsHoles: %v", err)
+	}
+	// The answer must agree with what DataExtents makes of a sparse file
+	path := filepath.Join(dir, "disk")
+	writeSparse(t, path, []byte{0, 0, 0, 1})
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	extents, err := DataExtents(f)
+	if err != nil {
+		t.Fatalf("DataExtents: %v", err)
+	}
+	if got := len(extents) > 0 && extents[0].Start > 0; holes && !got {
+		t.Errorf("ReportsHoles() = true, but a sparse file has no leading hole: %v", extents)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("ReportsHoles left files behind: %v", entries)
+	}
+
+	if _, err := ReportsHoles(filepath.Join(dir, "missing")); err == nil {
+		t.Error("ReportsHoles() of a missing directory should fail")
+	}
+}
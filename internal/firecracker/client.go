@@ -7,19 +7,27 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	sdk "github.com/firecracker-microvm/firecracker-go-sdk"
 	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	ops "github.com/firecracker-microvm/firecracker-go-sdk/client/operations"
 	"github.com/sirupsen/logrus"
 
+	"github.com/raesene/baremetalvmm/internal/agent"
+	"github.com/raesene/baremetalvmm/internal/console"
 	"github.com/raesene/baremetalvmm/internal/vm"
 )
 
 const (
 	DefaultFirecrackerBin = "/usr/local/bin/firecracker"
+
+	// instanceInfoTimeout bounds the query UpdateVMState makes to tell a
+	// running VM from a paused one.
+	instanceInfoTimeout = 2 * time.Second
 )
 
 // consoleLogPath derives the console log path from the VM log path.
@@ -51,28 +59,108 @@ func NewClient() *Client {
 	}
 }
 
-// MountDrive represents an additional block device for host directory mounts
+// MountDrive represents an additional block device: a host directory mount
+// or a volume
 type MountDrive struct {
 	ImagePath string
 	Tag       string
 	ReadOnly  bool
 }
 
-// VMConfig holds the configuration needed to start a Firecracker VM
+// NetworkInterface is a guest network interface backed by a host TAP device.
+// Interfaces appear in the guest as eth0, eth1, ... in the order given.
+type NetworkInterface struct {
+	TapDevice  string
+	MacAddress string
+}
+
+// VMConfig holds the configuration needed to start a Firecracker VM.
+// IPAddress, Gateway and Subnet configure the first network interface (eth0)
+// through the kernel command line; any further interfaces are configured by
+// the guest.
 type VMConfig struct {
+	SocketPath        string
+	KernelPath        string
+	RootfsPath        string
+	CPUs              int
+	MemoryMB          int
+	NetworkInterfaces []NetworkInterface
+	KernelArgs        string // Appended to the default command line
+	InitrdPath        string // Initrd image; empty for none
+	LogPath           string
+	IPAddress         string
+	Gateway           string
+	Subnet            string
+	MountDrives       []MountDrive
+	RateLimits        *vm.RateLimits // Network and disk limits; nil for none
+	BalloonMB         int            // Initial size of the memory balloon
+	VsockPath         string         // Unix socket backing the vsock device; empty for none
+	ConsolePath       string         // Named pipe the serial console reads from; empty for none
+}
+
+// RestoreConfig holds what is needed to start a Firecracker VM from a
+// snapshot. The TAP devices and vsock socket path recorded in the snapshot
+// are used as they are.
+type RestoreConfig struct {
 	SocketPath  string
-	KernelPath  string
-	RootfsPath  string
-	CPUs        int
-	MemoryMB    int
-	TapDevice   string
-	MacAddress  string
-	KernelArgs  string
 	LogPath     string
-	IPAddress   string
-	Gateway     string
-	Subnet      string
-	MountDrives []MountDrive
+	ConsolePath string // Named pipe the serial console reads from; empty for none
+	MemPath     string
+	StatePath   string
+	// RootfsPath and MountPaths, when set, replace the disks recorded in the
+	// snapshot before the guest runs, so a clone uses its own copies.
+	// MountPaths are in drive order.
+	RootfsPath string
+	MountPaths []string
+	Paused     bool // Leave the guest paused once loaded
+}
+
+// guestCID is the vsock context ID of every guest. The host reaches each VM
+// through its own unix socket rather than by CID, so they need not differ.
+const guestCID = 3
+
+// balloonStatsInterval is how often, in seconds, the guest's balloon driver
+// reports memory statistics.
+const balloonStatsInterval = 5
+
+// rootfsDriveID is the Firecracker drive ID of a VM's root filesystem.
+const rootfsDriveID = "rootfs"
+
+// mountDriveID returns the Firecracker drive ID of the index'th mount drive.
+func mountDriveID(index int) string {
+	return fmt.Sprintf("mount%d", index)
+}
+
+// ifaceID returns the Firecracker ID of the index'th network interface. The
+// SDK numbers interfaces from 1.
+func ifaceID(index int) string {
+	return strconv.Itoa(index + 1)
+}
+
+// rateLimiter converts a rate limit into Firecracker's token buckets, each
+// refilled once a second. An unlimited dimension gets a bucket of size zero,
+// which Firecracker treats as no limit; this is also how a limit is lifted
+// from a running VM.
+func rateLimiter(limit vm.RateLimit) *models.RateLimiter {
+	bucket := func(perSecond int64) *models.TokenBucket {
+		return &models.TokenBucket{
+			Size:       sdk.Int64(perSecond),
+			RefillTime: sdk.Int64(1000),
+		}
+	}
+	return &models.RateLimiter{
+		Bandwidth: bucket(int64(limit.BandwidthMiB) << 20),
+		Ops:       bucket(int64(limit.Ops)),
+	}
+}
+
+// bootRateLimiter returns the rate limiter for a device at boot, or nil when
+// it is unlimited.
+func bootRateLimiter(limit vm.RateLimit) *models.RateLimiter {
+	if limit.Empty() {
+		return nil
+	}
+	return rateLimiter(limit)
 }
 
 // netmaskFromCIDR derives a dotted-decimal netmask from a CIDR string (e.g. "172.16.0.0/16" -> "255.255.0.0").
@@ -88,10 +176,33 @@ func netmaskFromCIDR(cidr string) string {
 	return fmt.Sprintf("%d.%d.%d.%d", mask[0], mask[1], mask[2], mask[3])
 }
 
+// defaultKernelArgs is the command line every VM boots with.
+const defaultKernelArgs = "console=ttyS0 reboot=k panic=1 pci=off"
+
+// bootArgs builds a VM's kernel command line: the defaults, the IP
+// configuration if provided, then the VM's own arguments, which come last so
+// they win over earlier ones.
+func bootArgs(cfg *VMConfig) string {
+	kernelArgs := defaultKernelArgs
+
+	// Format: ip=<client-ip>::<gateway-ip>:<netmask>::eth0:off
+	if cfg.IPAddress != "" && cfg.Gateway != "" {
+		kernelArgs += fmt.Sprintf(" ip=%s::%s:%s::eth0:off", cfg.IPAddress, cfg.Gateway, netmaskFromCIDR(cfg.Subnet))
+	}
+
+	if extra := strings.TrimSpace(cfg.KernelArgs); extra != "" {
+		kernelArgs += " " + extra
+	}
+	return kernelArgs
+}
+
 // StartVM starts a Firecracker microVM with the given configuration
 func (c *Client) StartVM(ctx context.Context, cfg *VMConfig) (*sdk.Machine, error) {
-	// Ensure socket doesn't exist
+	// Ensure sockets don't exist
 	os.Remove(cfg.SocketPath)
+	if cfg.VsockPath != "" {
+		os.Remove(cfg.VsockPath)
+	}
 
 	// Validate paths
 	if _, err := os.Stat(cfg.KernelPath); err != nil {
@@ -100,37 +211,38 @@ func (c *Client) StartVM(ctx context.Context, cfg *VMConfig) (*sdk.Machine, erro
 	if _, err := os.Stat(cfg.RootfsPath); err != nil {
 		return nil, fmt.Errorf("rootfs not found at %s: %w", cfg.RootfsPath, err)
 	}
-
-	// Default kernel args for a basic Linux boot
-	kernelArgs := cfg.KernelArgs
-	if kernelArgs == "" {
-		kernelArgs = "console=ttyS0 reboot=k panic=1 pci=off"
+	if cfg.InitrdPath != "" {
+		if _, err := os.Stat(cfg.InitrdPath); err != nil {
+			return nil, fmt.Errorf("initrd not found at %s: %w", cfg.InitrdPath, err)
+		}
 	}
 
-	// Add IP configuration if provided
-	// Format: ip=<client-ip>::<gateway-ip>:<netmask>::eth0:off
-	if cfg.IPAddress != "" && cfg.Gateway != "" {
-		kernelArgs += fmt.Sprintf(" ip=%s::%s:%s::eth0:off", cfg.IPAddress, cfg.Gateway, netmaskFromCIDR(cfg.Subnet))
+	kernelArgs := bootArgs(cfg)
+
+	var limits vm.RateLimits
+	if cfg.RateLimits != nil {
+		limits = *cfg.RateLimits
 	}
 
 	// Build drives list starting with rootfs
 	drives := []models.Drive{
 		{
-			DriveID:      sdk.String("rootfs"),
+			DriveID:      sdk.String(rootfsDriveID),
 			PathOnHost:   sdk.String(cfg.RootfsPath),
 			IsRootDevice: sdk.Bool(true),
 			IsReadOnly:   sdk.Bool(false),
+			RateLimiter:  bootRateLimiter(limits.Disk),
 		},
 	}
 
 	// Add mount drives (vdb, vdc, etc.)
 	for i, mountDrive := range cfg.MountDrives {
-		driveID := fmt.Sprintf("mount%d", i)
 		drives = append(drives, models.Drive{
-			DriveID:      sdk.String(driveID),
+			DriveID:      sdk.String(mountDriveID(i)),
 			PathOnHost:   sdk.String(mountDrive.ImagePath),
 			IsRootDevice: sdk.Bool(false),
 			IsReadOnly:   sdk.Bool(mountDrive.ReadOnly),
+			RateLimiter:  bootRateLimiter(limits.Disk),
 		})
 	}
 
@@ -139,23 +251,34 @@ func (c *Client) StartVM(ctx context.Context, cfg *VMConfig) (*sdk.Machine, erro
 		SocketPath:      cfg.SocketPath,
 		KernelImagePath: cfg.KernelPath,
 		KernelArgs:      kernelArgs,
+		InitrdPath:      cfg.InitrdPath,
 		Drives:          drives,
 		MachineCfg: models.MachineConfiguration{
 			VcpuCount:  sdk.Int64(int64(cfg.CPUs)),
 			MemSizeMib: sdk.Int64(int64(cfg.MemoryMB)),
+			// Lets snapshots of the VM be diffs against the previous one
+			TrackDirtyPages: true,
 		},
+		// Don't forward our signals to Firecracker: VMs outlive the process
+		// that started them, including the vmmd daemon.
+		ForwardSignals: []os.Signal{},
 	}
 
-	// Add network interface if configured
-	if cfg.TapDevice != "" {
-		fcCfg.NetworkInterfaces = []sdk.NetworkInterface{
-			{
-				StaticConfiguration: &sdk.StaticNetworkConfiguration{
-					HostDevName: cfg.TapDevice,
-					MacAddress:  cfg.MacAddress,
-				},
+	// Add network interfaces (eth0, eth1, ...)
+	for _, nic := range cfg.NetworkInterfaces {
+		fcCfg.NetworkInterfaces = append(fcCfg.NetworkInterfaces, sdk.NetworkInterface{
+			StaticConfiguration: &sdk.StaticNetworkConfiguration{
+				HostDevName: nic.TapDevice,
+				MacAddress:  nic.MacAddress,
 			},
-		}
+			InRateLimiter:  bootRateLimiter(limits.Net),
+			OutRateLimiter: bootRateLimiter(limits.Net),
+		})
+	}
+
+	// The vsock device carries the guest agent's connections
+	if cfg.VsockPath != "" {
+		fcCfg.VsockDevices = []sdk.VsockDevice{{Path: cfg.VsockPath, CID: guestCID}}
 	}
 
 	// Find Firecracker binary
@@ -196,6 +319,17 @@ func (c *Client) StartVM(ctx context.Context, cfg *VMConfig) (*sdk.Machine, erro
 		cmdBuilder = cmdBuilder.WithStdout(consoleFile).WithStderr(consoleFile)
 	}
 
+	// Serial console input comes from a named pipe that vmm console attach
+	// writes to. The child keeps its own copy once started.
+	if cfg.ConsolePath != "" {
+		input, err := console.CreateInput(cfg.ConsolePath)
+		if err != nil {
+			return nil, err
+		}
+		defer input.Close()
+		cmdBuilder = cmdBuilder.WithStdin(input)
+	}
+
 	cmd := cmdBuilder.Build(ctx)
 
 	machineOpts = append(machineOpts, sdk.WithProcessRunner(cmd))
@@ -206,6 +340,13 @@ func (c *Client) StartVM(ctx context.Context, cfg *VMConfig) (*sdk.Machine, erro
 		return nil, fmt.Errorf("failed to create Firecracker machine: %w", err)
 	}
 
+	// Every VM gets a balloon device so memory can be reclaimed while it
+	// runs. It deflates when the guest is out of memory, and does nothing in
+	// guests whose kernel has no virtio-balloon driver.
+	machine.Handlers.FcInit = machine.Handlers.FcInit.Append(
+		sdk.NewCreateBalloonHandler(int64(cfg.BalloonMB), true, balloonStatsInterval),
+	)
+
 	// Start the machine
 	if err := machine.Start(ctx); err != nil {
 		return nil, fmt.Errorf("failed to start Firecracker machine: %w", err)
@@ -239,8 +380,8 @@ func (c *Client) Version() string {
 	return fields[len(fields)-1]
 }
 
-// PauseVM pauses a running Firecracker VM over its API socket. The VM must be
-// paused before a snapshot can be created.
+// PauseVM pauses a running Firecracker VM over its API socket. Its vCPUs stop
+// running guest code; the VM must be paused before a snapshot can be created.
 func (c *Client) PauseVM(ctx context.Context, socketPath string) error {
 	machine, err := c.connectToMachine(ctx, socketPath)
 	if err != nil {
@@ -264,34 +405,128 @@ func (c *Client) ResumeVM(ctx context.Context, socketPath string) error {
 	return nil
 }
 
-// CreateSnapshotFiles writes a full snapshot (guest memory + device/vcpu state)
-// of a paused VM to memPath and statePath. The VM must already be paused; the
+// UpdateRateLimits applies a running VM's rate limits to its drives and
+// network interfaces over the API socket. Devices the VM's limits leave
+// unlimited have any earlier limit lifted.
+func (c *Client) UpdateRateLimits(ctx context.Context, v *vm.VM) error {
+	machine, err := c.connectToMachine(ctx, v.SocketPath)
+	if err != nil {
+		return fmt.Errorf("failed to connect to VM: %w", err)
+	}
+	var limits vm.RateLimits
+	if v.RateLimits != nil {
+		limits = *v.RateLimits
+	}
+
+	diskLimit := rateLimiter(limits.Disk)
+	withDiskLimit := func(p *ops.PatchGuestDriveByIDParams) {
+		p.Body.RateLimiter = diskLimit
+	}
+	driveIDs := []string{rootfsDriveID}
+	// Volume drives follow the mount drives
+	for i := 0; i < len(v.Mounts)+len(v.Volumes); i++ {
+		driveIDs = append(driveIDs, mountDriveID(i))
+	}
+	for _, id := range driveIDs {
+		if err := machine.UpdateGuestDrive(ctx, id, "", withDiskLimit); err != nil {
+			return fmt.Errorf("failed to update rate limit of drive %s: %w", id, err)
+		}
+	}
+
+	// The SDK's UpdateGuestNetworkInterfaceRateLimit sends the inbound
+	// limiter in both directions, so both are set on the request instead
+	netLimit := rateLimiter(limits.Net)
+	withNetLimit := func(p *ops.PatchGuestNetworkInterfaceByIDParams) {
+		p.Body.RxRateLimiter = netLimit
+		p.Body.TxRateLimiter = netLimit
+	}
+	for i := range v.Interfaces() {
+		if err := machine.UpdateGuestNetworkInterfaceRateLimit(ctx, ifaceID(i), sdk.RateLimiterSet{}, withNetLimit); err != nil {
+			return fmt.Errorf("failed to update rate limit of %s: %w", vm.InterfaceName(i), err)
+		}
+	}
+	return nil
+}
+
+// SetBalloon changes the size of a running VM's memory balloon. Inflating
+// it takes memory from the guest and returns it to the host; deflating it
+// gives the memory back.
+func (c *Client) SetBalloon(ctx context.Context, socketPath string, targetMB int) error {
+	machine, err := c.connectToMachine(ctx, socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to connect to VM: %w", err)
+	}
+	if err := machine.UpdateBalloon(ctx, int64(targetMB)); err != nil {
+		return fmt.Errorf("failed to resize balloon: %w", err)
+	}
+	return nil
+}
+
+// BalloonStats returns the size of a running VM's memory balloon and the
+// latest memory statistics reported by the guest.
+func (c *Client) BalloonStats(ctx context.Context, socketPath string) (*vm.BalloonStats, error) {
+	machine, err := c.connectToMachine(ctx, socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to VM: %w", err)
+	}
+	st, err := machine.GetBalloonStats(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get balloon statistics: %w", err)
+	}
+	return &vm.BalloonStats{
+		TargetMB:        int(sdk.Int64Value(st.TargetMib)),
+		ActualMB:        int(sdk.Int64Value(st.ActualMib)),
+		TotalMemory:     st.TotalMemory,
+		FreeMemory:      st.FreeMemory,
+		AvailableMemory: st.AvailableMemory,
+		DiskCaches:      st.DiskCaches,
+		MajorFaults:     st.MajorFaults,
+		MinorFaults:     st.MinorFaults,
+		SwapIn:          st.SwapIn,
+		SwapOut:         st.SwapOut,
+	}, nil
+}
+
+// CreateSnapshotFiles writes a snapshot (guest memory + device/vcpu state) of
+// a paused VM to memPath and statePath. The VM must already be paused; the
 // Firecracker process writes both files itself, so their parent directory must
 // exist and be writable by that process.
-func (c *Client) CreateSnapshotFiles(ctx context.Context, socketPath, memPath, statePath string) error {
+//
+// A diff snapshot's memory file is sparse: only the pages the guest wrote
+// since the previous snapshot of this process, or since it was loaded from
+// one, hold data.
+func (c *Client) CreateSnapshotFiles(ctx context.Context, socketPath, memPath, statePath string, diff bool) error {
 	machine, err := c.connectToMachine(ctx, socketPath)
 	if err != nil {
 		return fmt.Errorf("failed to connect to VM: %w", err)
 	}
-	if err := machine.CreateSnapshot(ctx, memPath, statePath); err != nil {
+	snapshotType := models.SnapshotCreateParamsSnapshotTypeFull
+	if diff {
+		snapshotType = models.SnapshotCreateParamsSnapshotTypeDiff
+	}
+	withType := func(p *ops.CreateSnapshotParams) {
+		p.Body.SnapshotType = snapshotType
+	}
+	if err := machine.CreateSnapshot(ctx, memPath, statePath, withType); err != nil {
 		return fmt.Errorf("failed to create snapshot: %w", err)
 	}
 	return nil
 }
 
 // RestoreVM starts a fresh Firecracker process that loads a previously created
-// snapshot (memPath + statePath) and resumes the guest. The block devices and
-// TAP network device referenced by the snapshot state must already exist at the
-// same host paths / names they had when the snapshot was taken.
-func (c *Client) RestoreVM(ctx context.Context, socketPath, logPath, memPath, statePath string) (*sdk.Machine, error) {
+// snapshot and, unless cfg.Paused is set, resumes the guest. The TAP devices
+// referenced by the snapshot state must already exist under the names they
+// had when the snapshot was taken, and so must its disks unless cfg replaces
+// them.
+func (c *Client) RestoreVM(ctx context.Context, cfg *RestoreConfig) (*sdk.Machine, error) {
 	// LoadSnapshot validation requires the socket to be absent and both
 	// snapshot files to exist.
-	os.Remove(socketPath)
-	if _, err := os.Stat(memPath); err != nil {
-		return nil, fmt.Errorf("snapshot memory file not found at %s: %w", memPath, err)
+	os.Remove(cfg.SocketPath)
+	if _, err := os.Stat(cfg.MemPath); err != nil {
+		return nil, fmt.Errorf("snapshot memory file not found at %s: %w", cfg.MemPath, err)
 	}
-	if _, err := os.Stat(statePath); err != nil {
-		return nil, fmt.Errorf("snapshot state file not found at %s: %w", statePath, err)
+	if _, err := os.Stat(cfg.StatePath); err != nil {
+		return nil, fmt.Errorf("snapshot state file not found at %s: %w", cfg.StatePath, err)
 	}
 
 	fcBin := c.FirecrackerBin
@@ -309,13 +544,13 @@ func (c *Client) RestoreVM(ctx context.Context, socketPath, logPath, memPath, st
 
 	cmdBuilder := sdk.VMCommandBuilder{}.
 		WithBin(fcBin).
-		WithSocketPath(socketPath)
+		WithSocketPath(cfg.SocketPath)
 
-	if logPath != "" {
-		if err := os.MkdirAll(filepath.Dir(logPath), 0700); err != nil {
+	if cfg.LogPath != "" {
+		if err := os.MkdirAll(filepath.Dir(cfg.LogPath), 0700); err != nil {
 			return nil, fmt.Errorf("failed to create log directory: %w", err)
 		}
-		consolePath := consoleLogPath(logPath)
+		consolePath := consoleLogPath(cfg.LogPath)
 		consoleFile, err := os.OpenFile(consolePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create console log file: %w", err)
@@ -323,15 +558,27 @@ func (c *Client) RestoreVM(ctx context.Context, socketPath, logPath, memPath, st
 		cmdBuilder = cmdBuilder.WithStdout(consoleFile).WithStderr(consoleFile)
 	}
 
+	if cfg.ConsolePath != "" {
+		input, err := console.CreateInput(cfg.ConsolePath)
+		if err != nil {
+			return nil, err
+		}
+		defer input.Close()
+		cmdBuilder = cmdBuilder.WithStdin(input)
+	}
+
+	// The guest must not run before its disks are swapped
+	swapDisks := cfg.RootfsPath != "" || len(cfg.MountPaths) > 0
 	cmd := cmdBuilder.Build(ctx)
 	machineOpts = append(machineOpts,
 		sdk.WithProcessRunner(cmd),
-		sdk.WithSnapshot(memPath, statePath, func(cfg *sdk.SnapshotConfig) {
-			cfg.ResumeVM = true
+		sdk.WithSnapshot(cfg.MemPath, cfg.StatePath, func(sc *sdk.SnapshotConfig) {
+			sc.ResumeVM = !cfg.Paused && !swapDisks
+			sc.EnableDiffSnapshots = true
 		}),
 	)
 
-	fcCfg := sdk.Config{SocketPath: socketPath}
+	fcCfg := sdk.Config{SocketPath: cfg.SocketPath, ForwardSignals: []os.Signal{}}
 
 	machine, err := sdk.NewMachine(ctx, fcCfg, machineOpts...)
 	if err != nil {
@@ -340,6 +587,30 @@ func (c *Client) RestoreVM(ctx context.Context, socketPath, logPath, memPath, st
 	if err := machine.Start(ctx); err != nil {
 		return nil, fmt.Errorf("failed to restore VM from snapshot: %w", err)
 	}
+	if !swapDisks {
+		return machine, nil
+	}
+
+	// From here on the process is running, so failures must stop it
+	fail := func(err error) (*sdk.Machine, error) {
+		machine.StopVMM()
+		return nil, err
+	}
+	if cfg.RootfsPath != "" {
+		if err := machine.UpdateGuestDrive(ctx, rootfsDriveID, cfg.RootfsPath); err != nil {
+			return fail(fmt.Errorf("failed to replace rootfs: %w", err))
+		}
+	}
+	for i, path := range cfg.MountPaths {
+		if err := machine.UpdateGuestDrive(ctx, mountDriveID(i), path); err != nil {
+			return fail(fmt.Errorf("failed to replace mount drive %d: %w", i, err))
+		}
+	}
+	if !cfg.Paused {
+		if err := machine.ResumeVM(ctx); err != nil {
+			return fail(fmt.Errorf("failed to resume VM: %w", err))
+		}
+	}
 	return machine, nil
 }
 
@@ -368,8 +639,8 @@ func (c *Client) StopVM(ctx context.Context, socketPath string) error {
 
 // Terminate stops the Firecracker process backing a VM and does not return
 // until the process is gone. It escalates from a guest shutdown request
-// (Ctrl+Alt+Del over the API socket) to SIGTERM and finally SIGKILL, then
-// removes the API socket file.
+// (through the guest agent if it answers, else Ctrl+Alt+Del over the API
+// socket) to SIGTERM and finally SIGKILL, then removes the VM's socket files.
 //
 // The VM's PID field is updated to reflect reality: it is set to the PID that
 // was actually terminated while work is in progress, and cleared to 0 once the
@@ -388,8 +659,14 @@ func (c *Client) Terminate(ctx context.Context, v *vm.VM) error {
 	}
 	v.PID = pid
 
-	// Ask the guest to shut down cleanly. This only works when the guest
-	// kernel has the i8042 driver, so don't wait long for it.
+	// Ask the guest agent to shut down cleanly, which works whatever the
+	// guest kernel supports
+	if c.agentShutdown(ctx, v) && waitForExit(pid, v.SocketPath, agentShutdownWait) {
+		return c.finishTerminate(v)
+	}
+
+	// Otherwise send Ctrl+Alt+Del. This only works when the guest kernel has
+	// the i8042 driver, so don't wait long for it.
 	if _, err := os.Stat(v.SocketPath); err == nil {
 		shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 		err := c.StopVM(shutdownCtx, v.SocketPath)
@@ -414,11 +691,29 @@ func (c *Client) Terminate(ctx context.Context, v *vm.VM) error {
 	return fmt.Errorf("firecracker process %d for VM '%s' is still running after SIGKILL", pid, v.Name)
 }
 
-// finishTerminate records that the VM's process is gone and cleans up the socket.
+// agentShutdown asks the VM's guest agent to shut the guest down. It
+// reports whether the agent accepted.
+func (c *Client) agentShutdown(ctx context.Context, v *vm.VM) bool {
+	if _, err := os.Stat(v.VsockPath()); err != nil {
+		return false
+	}
+	reqCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	if err := agent.NewClient(v.VsockPath()).Shutdown(reqCtx); err != nil {
+		c.Logger.Debugf("guest agent shutdown request failed for VM %s: %v", v.Name, err)
+		return false
+	}
+	return true
+}
+
+// finishTerminate records that the VM's process is gone and cleans up its
+// sockets.
 func (c *Client) finishTerminate(v *vm.VM) error {
 	v.PID = 0
-	if err := os.Remove(v.SocketPath); err != nil && !os.IsNotExist(err) {
-		c.Logger.Debugf("failed to remove socket %s: %v", v.SocketPath, err)
+	for _, path := range []string{v.SocketPath, v.VsockPath(), v.ConsolePath()} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			c.Logger.Debugf("failed to remove socket %s: %v", path, err)
+		}
 	}
 	return nil
 }
@@ -466,11 +761,35 @@ func (c *Client) GetVMPID(machine *sdk.Machine) int {
 func (c *Client) UpdateVMState(v *vm.VM) {
 	if pid := ResolvePID(v.SocketPath, v.PID); pid > 0 {
 		v.PID = pid
-		v.State = vm.StateRunning
+		v.State = c.instanceState(v)
 	} else {
 		v.PID = 0
-		if v.State == vm.StateRunning || v.State == vm.StateStarting || v.State == vm.StateStopping {
+		if v.State.Active() || v.State == vm.StateStarting || v.State == vm.StateStopping {
 			v.State = vm.StateStopped
 		}
 	}
 }
+
+// instanceState asks a VM's Firecracker process whether the guest is running
+// or paused. If the API does not answer, a VM recorded as paused is assumed
+// to still be paused and any other VM to be running.
+func (c *Client) instanceState(v *vm.VM) vm.State {
+	fallback := vm.StateRunning
+	if v.State == vm.StatePaused {
+		fallback = vm.StatePaused
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), instanceInfoTimeout)
+	defer cancel()
+	machine, err := c.connectToMachine(ctx, v.SocketPath)
+	if err != nil {
+		return fallback
+	}
+	info, err := machine.DescribeInstanceInfo(ctx)
+	if err != nil || info.State == nil {
+		return fallback
+	}
+	if *info.State == models.InstanceInfoStatePaused {
+		return vm.StatePaused
+	}
+	return vm.StateRunning
+}
@@ -0,0 +1,174 @@
+package firecracker
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := rateLimiter(vm.RateLimit{BandwidthMiB: 50, Ops: 1000})
+	if got := *rl.Bandwidth.Size; got != 50<<20 {
+		t.Errorf("bandwidth bucket size = %d, want %d", got, 50<<20)
+	}
+	if got := *rl.Ops.Size; got != 1000 {
+		t.Errorf("ops bucket size = %d, want 1000", got)
+	}
+	if *rl.Bandwidth.RefillTime != 1000 || *rl.Ops.RefillTime != 1000 {
+		t.Errorf("refill times = %d, %d ms, want 1000", *rl.Bandwidth.RefillTime, *rl.Ops.RefillTime)
+	}
+
+	if bootRateLimiter(vm.RateLimit{}) != nil {
+		t.Error("bootRateLimiter() of an unlimited device should be nil")
+	}
+	// Lifting a limit sends empty buckets rather than nothing
+	if rl := rateLimiter(vm.RateLimit{}); rl.Bandwidth == nil || *rl.Bandwidth.Size != 0 {
+		t.Errorf("rateLimiter() of an unlimited device = %+v, want zero-size buckets", rl)
+	}
+}
+
+// fakeAPI records the PATCH requests sent to a Firecracker API socket and
+// answers GET requests from responses.
+type fakeAPI struct {
+	mu        sync.Mutex
+	patches   map[string]json.RawMessage
+	responses map[string]string
+}
+
+func startFakeAPI(t *testing.T) (string, *fakeAPI) {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "fc.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &fakeAPI{patches: make(map[string]json.RawMessage), responses: make(map[string]string)}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			api.mu.Lock()
+			body, ok := api.responses[r.URL.Path]
+			api.mu.Unlock()
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, body)
+			return
+		}
+		if r.Method == http.MethodPatch {
+			body, _ := io.ReadAll(r.Body)
+			api.mu.Lock()
+			api.patches[r.URL.Path] = body
+			api.mu.Unlock()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return socket, api
+}
+
+func TestUpdateRateLimits(t *testing.T) {
+	socket, api := startFakeAPI(t)
+
+	v := vm.NewVM("web")
+	v.SocketPath = socket
+	v.Mounts = []vm.Mount{{GuestTag: "data"}}
+	v.Volumes = []vm.VolumeAttachment{{Name: "db"}}
+	v.NICs = []vm.NIC{{Network: "backend"}}
+	v.RateLimits = &vm.RateLimits{Net: vm.RateLimit{BandwidthMiB: 10}}
+
+	if err := NewClient().UpdateRateLimits(context.Background(), v); err != nil {
+		t.Fatalf("UpdateRateLimits() error: %v", err)
+	}
+
+	for _, path := range []string{"/drives/rootfs", "/drives/mount0", "/drives/mount1"} {
+		var drive models.PartialDrive
+		if err := json.Unmarshal(api.patches[path], &drive); err != nil {
+			t.Fatalf("PATCH %s body %q: %v", path, api.patches[path], err)
+		}
+		if drive.RateLimiter == nil || *drive.RateLimiter.Bandwidth.Size != 0 {
+			t.Errorf("PATCH %s rate limiter = %+v, want an unlimited one", path, drive.RateLimiter)
+		}
+		if drive.PathOnHost != "" {
+			t.Errorf("PATCH %s changed the path to %q", path, drive.PathOnHost)
+		}
+	}
+	for _, path := range []string{"/network-interfaces/1", "/network-interfaces/2"} {
+		var iface models.PartialNetworkInterface
+		if err := json.Unmarshal(api.patches[path], &iface); err != nil {
+			t.Fatalf("PATCH %s body %q: %v", path, api.patches[path], err)
+		}
+		for dir, rl := range map[string]*models.RateLimiter{"rx": iface.RxRateLimiter, "tx": iface.TxRateLimiter} {
+			if rl == nil || *rl.Bandwidth.Size != 10<<20 {
+				t.Errorf("PATCH %s %s rate limiter = %+v, want 10 MiB/s", path, dir, rl)
+			}
+		}
+	}
+}
+
+func TestBalloon(t *testing.T) {
+	socket, api := startFakeAPI(t)
+	api.responses["/balloon/statistics"] = `{"target_mib": 256, "actual_mib": 200, "target_pages": 65536, "actual_pages": 51200, "available_memory": 104857600, "swap_in": 3}`
+	c := NewClient()
+
+	if err := c.SetBalloon(context.Background(), socket, 256); err != nil {
+		t.Fatalf("SetBalloon() error: %v", err)
+	}
+	var update models.BalloonUpdate
+	if err := json.Unmarshal(api.patches["/balloon"], &update); err != nil {
+		t.Fatalf("PATCH /balloon body %q: %v", api.patches["/balloon"], err)
+	}
+	if update.AmountMib == nil || *update.AmountMib != 256 {
+		t.Errorf("PATCH /balloon amount = %v, want 256", update.AmountMib)
+	}
+
+	st, err := c.BalloonStats(context.Background(), socket)
+	if err != nil {
+		t.Fatalf("BalloonStats() error: %v", err)
+	}
+	want := vm.BalloonStats{TargetMB: 256, ActualMB: 200, AvailableMemory: 100 << 20, SwapIn: 3}
+	if *st != want {
+		t.Errorf("BalloonStats() = %+v, want %+v", *st, want)
+	}
+}
+
+func TestBootArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  VMConfig
+		want string
+	}{
+		{
+			name: "defaults",
+			want: defaultKernelArgs,
+		},
+		{
+			name: "with IP",
+			cfg:  VMConfig{IPAddress: "172.16.0.2", Gateway: "172.16.0.1", Subnet: "172.16.0.0/16"},
+			want: defaultKernelArgs + " ip=172.16.0.2::172.16.0.1:255.255.0.0::eth0:off",
+		},
+		{
+			name: "extra args last",
+			cfg:  VMConfig{IPAddress: "172.16.0.2", Gateway: "172.16.0.1", Subnet: "172.16.0.0/16", KernelArgs: " loglevel=7 panic=0 "},
+			want: defaultKernelArgs + " ip=172.16.0.2::172.16.0.1:255.255.0.0::eth0:off loglevel=7 panic=0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bootArgs(&tt.cfg); got != tt.want {
+				t.Errorf("bootArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
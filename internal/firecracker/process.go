@@ -16,6 +16,10 @@ const (
 	// kernels built without CONFIG_SERIO_I8042/CONFIG_KEYBOARD_ATKBD never
 	// see the request, so this is kept short.
 	gracefulShutdownWait = 3 * time.Second
+	// agentShutdownWait is how long to wait for a guest whose agent accepted
+	// a shutdown request. systemd stops every service first, so this is
+	// longer.
+	agentShutdownWait = 30 * time.Second
 	// sigtermWait is how long to wait for Firecracker to exit after SIGTERM.
 	sigtermWait = 5 * time.Second
 	// sigkillWait is how long to wait for the process to disappear after SIGKILL.
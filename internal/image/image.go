@@ -15,6 +15,8 @@ import (
 	"runtime"
 	"strings"
 	"time"
+
+	"github.com/raesene/baremetalvmm/internal/diskfile"
 )
 
 // ImportDockerImage imports a Docker image as a VMM rootfs
@@ -578,17 +580,20 @@ func (m *Manager) downloadAndDecompressGzipVerified(url, destPath, expectedHash
 	return os.Rename(tmpPath, destPath)
 }
 
-// Manager handles kernel and rootfs image management
+// Manager handles kernel, initrd and rootfs image management
 type Manager struct {
 	KernelDir string
 	RootfsDir string
+	InitrdDir string
 }
 
-// NewManager creates a new image manager
+// NewManager creates a new image manager. Initrd images are kept in an
+// "initrd" directory next to the kernels.
 func NewManager(kernelDir, rootfsDir string) *Manager {
 	return &Manager{
 		KernelDir: kernelDir,
 		RootfsDir: rootfsDir,
+		InitrdDir: filepath.Join(filepath.Dir(kernelDir), "initrd"),
 	}
 }
 
@@ -693,7 +698,7 @@ func (m *Manager) CreateVMRootfs(vmName string, vmDir string, diskSizeMB int, im
 	} else {
 		srcPath = m.GetDefaultRootfsPath()
 	}
-	dstPath := filepath.Join(vmDir, vmName+".ext4")
+	dstPath := VMRootfsPath(vmName, vmDir)
 
 	// Check if VM rootfs already exists
 	if _, err := os.Stat(dstPath); err == nil {
@@ -749,11 +754,22 @@ func (m *Manager) CreateVMRootfs(vmName string, vmDir string, diskSizeMB int, im
 	return dstPath, nil
 }
 
-// DeleteVMRootfs removes a VM's rootfs
+// VMRootfsPath returns the path of a VM's rootfs, which CreateVMRootfs
+// reuses if it already exists.
+func VMRootfsPath(vmName, vmDir string) string {
+	return filepath.Join(vmDir, vmName+".ext4")
+}
+
+// DeleteVMRootfs removes a VM's rootfs, or a thin VM's device and
+// copy-on-write store
 func (m *Manager) DeleteVMRootfs(vmName string, vmDir string) error {
-	path := filepath.Join(vmDir, vmName+".ext4")
-	if _, err := os.Stat(path); err == nil {
-		return os.Remove(path)
+	if err := m.DetachVMDisk(vmName, vmDir); err != nil {
+		return err
+	}
+	for _, path := range []string{VMRootfsPath(vmName, vmDir), VMOverlayPath(vmName, vmDir)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
 	return nil
 }
@@ -761,7 +777,7 @@ func (m *Manager) DeleteVMRootfs(vmName string, vmDir string) error {
 // SnapshotVMRootfs copies a VM's rootfs to the images directory as a reusable base image.
 // The copy is shrunk with resize2fs to minimize disk usage.
 func (m *Manager) SnapshotVMRootfs(vmName, vmDir, imageName string) error {
-	srcPath := filepath.Join(vmDir, vmName+".ext4")
+	srcPath := VMRootfsPath(vmName, vmDir)
 	if _, err := os.Stat(srcPath); os.IsNotExist(err) {
 		return fmt.Errorf("VM '%s' has no rootfs (has it been started?)", vmName)
 	}
@@ -924,22 +940,10 @@ func (m *Manager) downloadFile(url, destPath string) error {
 	return os.Rename(tmpPath, destPath)
 }
 
-// copyFile copies a file from src to dst
+// copyFile copies a file from src to dst. Disk images stay sparse, and
+// share their blocks with src on filesystems that support reflinks.
 func copyFile(src, dst string) error {
-	srcFile, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer srcFile.Close()
-
-	dstFile, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer dstFile.Close()
-
-	_, err = io.Copy(dstFile, srcFile)
-	return err
+	return diskfile.Copy(src, dst, 0666)
 }
 
 // listFiles returns all files in a directory
@@ -1100,7 +1104,8 @@ var DefaultDNSServers = []string{"8.8.8.8", "8.8.4.4", "1.1.1.1"}
 // InjectDNSConfig injects DNS configuration into a rootfs image
 // This mounts the ext4 image and writes /etc/resolv.conf
 // If dnsServers is empty, default public DNS servers are used
-func InjectDNSConfig(rootfsPath string, dnsServers []string) error {
+// searchDomains, if any, are written as the resolver's search list
+func InjectDNSConfig(rootfsPath string, dnsServers, searchDomains []string) error {
 	// Use defaults if no custom servers specified
 	if len(dnsServers) == 0 {
 		dnsServers = DefaultDNSServers
@@ -1125,21 +1130,27 @@ func InjectDNSConfig(rootfsPath string, dnsServers []string) error {
 		umountCmd.Run() // Best effort unmount
 	}()
 
-	// Build resolv.conf content
-	var resolvConf strings.Builder
-	resolvConf.WriteString("# Generated by vmm\n")
-	for _, server := range dnsServers {
-		resolvConf.WriteString(fmt.Sprintf("nameserver %s\n", server))
-	}
-
 	resolvPath := filepath.Join(mountPoint, "etc", "resolv.conf")
-	if err := os.WriteFile(resolvPath, []byte(resolvConf.String()), 0644); err != nil {
+	if err := os.WriteFile(resolvPath, []byte(resolvConf(dnsServers, searchDomains)), 0644); err != nil {
 		return fmt.Errorf("failed to write resolv.conf: %w", err)
 	}
 
 	return nil
 }
 
+// resolvConf renders /etc/resolv.conf for the given servers and search list
+func resolvConf(dnsServers, searchDomains []string) string {
+	var b strings.Builder
+	b.WriteString("# Generated by vmm\n")
+	if len(searchDomains) > 0 {
+		b.WriteString(fmt.Sprintf("search %s\n", strings.Join(searchDomains, " ")))
+	}
+	for _, server := range dnsServers {
+		b.WriteString(fmt.Sprintf("nameserver %s\n", server))
+	}
+	return b.String()
+}
+
 // MountEntry represents a mount point to add to fstab
 type MountEntry struct {
 	Device    string // e.g., /dev/vdb
@@ -1225,6 +1236,102 @@ func InjectMountFstab(rootfsPath string, mounts []MountEntry) error {
 	return nil
 }
 
+// NetworkInterface is a guest network interface to configure statically
+type NetworkInterface struct {
+	Device   string // e.g., eth1
+	Address  string // Address in CIDR notation, e.g., 10.66.0.5/24
+	Gateway  string // Default gateway; empty on interfaces without a default route
+	Address6 string // IPv6 address in CIDR notation; empty on IPv4-only networks
+	Gateway6 string // IPv6 default gateway
+}
+
+// networkdMarker starts every systemd-networkd file written by vmm, so stale
+// files can be told apart from the image's own configuration.
+const networkdMarker = "# Generated by vmm"
+
+// InjectNetworkConfig writes a systemd-networkd configuration for each of the
+// VM's network interfaces into the rootfs image. eth0 is also configured by
+// the kernel ip= parameter; the others are only brought up by networkd.
+func InjectNetworkConfig(rootfsPath string, ifaces []NetworkInterface) error {
+	// Create a temporary mount point
+	mountPoint, err := os.MkdirTemp("", "vmm-rootfs-*")
+	if err != nil {
+		return fmt.Errorf("failed to create mount point: %w", err)
+	}
+	defer os.RemoveAll(mountPoint)
+
+	// Mount the rootfs image
+	mountCmd := exec.Command("mount", "-o", "loop", rootfsPath, mountPoint)
+	if output, err := mountCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to mount rootfs: %w: %s", err, string(output))
+	}
+
+	// Ensure we unmount even if there's an error
+	defer func() {
+		umountCmd := exec.Command("umount", mountPoint)
+		umountCmd.Run()
+	}()
+
+	return writeNetworkConfig(mountPoint, ifaces)
+}
+
+// writeNetworkConfig writes the .network files for ifaces under rootDir,
+// removing any earlier vmm-generated files first so interfaces a VM no longer
+// has are not left configured.
+func writeNetworkConfig(rootDir string, ifaces []NetworkInterface) error {
+	networkDir := filepath.Join(rootDir, "etc", "systemd", "network")
+	if err := os.MkdirAll(networkDir, 0755); err != nil {
+		return fmt.Errorf("failed to create networkd directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(networkDir)
+	if err != nil {
+		return fmt.Errorf("failed to read networkd directory: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".network" {
+			continue
+		}
+		path := filepath.Join(networkDir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err == nil && strings.HasPrefix(string(data), networkdMarker) {
+			os.Remove(path)
+		}
+	}
+
+	for _, iface := range ifaces {
+		guestPath, conf := NetworkdFile(iface)
+		path := filepath.Join(rootDir, guestPath)
+		if err := os.WriteFile(path, []byte(conf), 0644); err != nil {
+			return fmt.Errorf("failed to write network config for %s: %w", iface.Device, err)
+		}
+	}
+
+	return nil
+}
+
+// NetworkdFile returns the guest path and contents of the systemd-networkd
+// configuration for an interface.
+func NetworkdFile(iface NetworkInterface) (path, conf string) {
+	var b strings.Builder
+	b.WriteString(networkdMarker + "\n")
+	b.WriteString(fmt.Sprintf("[Match]\nName=%s\n\n[Network]\nDHCP=no\n", iface.Device))
+	if iface.Address != "" {
+		b.WriteString(fmt.Sprintf("Address=%s\n", iface.Address))
+	}
+	if iface.Gateway != "" {
+		b.WriteString(fmt.Sprintf("Gateway=%s\n", iface.Gateway))
+	}
+	if iface.Address6 != "" {
+		// Addresses are static, so ignore router advertisements
+		b.WriteString(fmt.Sprintf("Address=%s\nIPv6AcceptRA=no\n", iface.Address6))
+	}
+	if iface.Gateway6 != "" {
+		b.WriteString(fmt.Sprintf("Gateway=%s\n", iface.Gateway6))
+	}
+	return fmt.Sprintf("/etc/systemd/network/10-%s.network", iface.Device), b.String()
+}
+
 // InjectSSHKey injects an SSH public key into a rootfs image
 // This mounts the ext4 image and writes the key to /root/.ssh/authorized_keys
 func InjectSSHKey(rootfsPath, sshPublicKey string) error {
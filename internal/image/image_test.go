@@ -1,6 +1,7 @@
 package image
 
 import (
+	"os"
 	"path/filepath"
 	"testing"
 )
@@ -112,3 +113,68 @@ func TestDescribeRootfs(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteNetworkConfig(t *testing.T) {
+	root := t.TempDir()
+	networkDir := filepath.Join(root, "etc", "systemd", "network")
+	if err := os.MkdirAll(networkDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// The image's own config is replaced; a stale vmm config is removed
+	os.WriteFile(filepath.Join(networkDir, "10-eth0.network"), []byte("[Match]\nName=eth0\n"), 0644)
+	os.WriteFile(filepath.Join(networkDir, "10-eth2.network"), []byte(networkdMarker+"\n[Match]\nName=eth2\n"), 0644)
+	os.WriteFile(filepath.Join(networkDir, "99-custom.network"), []byte("[Match]\nName=wg0\n"), 0644)
+
+	err := writeNetworkConfig(root, []NetworkInterface{
+		{Device: "eth0", Address: "172.16.0.2/16", Gateway: "172.16.0.1"},
+		{Device: "eth1", Address: "10.66.0.2/24", Address6: "fd00:66::a42:2/64"},
+	})
+	if err != nil {
+		t.Fatalf("writeNetworkConfig() error: %v", err)
+	}
+
+	eth0, _ := os.ReadFile(filepath.Join(networkDir, "10-eth0.network"))
+	want := networkdMarker + "\n[Match]\nName=eth0\n\n[Network]\nDHCP=no\nAddress=172.16.0.2/16\nGateway=172.16.0.1\n"
+	if string(eth0) != want {
+		t.Errorf("10-eth0.network = %q, want %q", eth0, want)
+	}
+	eth1, _ := os.ReadFile(filepath.Join(networkDir, "10-eth1.network"))
+	want = networkdMarker + "\n[Match]\nName=eth1\n\n[Network]\nDHCP=no\nAddress=10.66.0.2/24\nAddress=fd00:66::a42:2/64\nIPv6AcceptRA=no\n"
+	if string(eth1) != want {
+		t.Errorf("10-eth1.network = %q, want %q", eth1, want)
+	}
+	if _, err := os.Stat(filepath.Join(networkDir, "10-eth2.network")); !os.IsNotExist(err) {
+		t.Error("stale vmm config for eth2 was not removed")
+	}
+	if _, err := os.Stat(filepath.Join(networkDir, "99-custom.network")); err != nil {
+		t.Error("the image's own config for another interface was removed")
+	}
+}
+
+func TestResolvConf(t *testing.T) {
+	tests := []struct {
+		name    string
+		servers []string
+		search  []string
+		want    string
+	}{
+		{
+			name:    "servers only",
+			servers: []string{"8.8.8.8", "1.1.1.1"},
+			want:    "# Generated by vmm\nnameserver 8.8.8.8\nnameserver 1.1.1.1\n",
+		},
+		{
+			name:    "with search domain",
+			servers: []string{"172.16.0.1", "8.8.8.8"},
+			search:  []string{"vmm.internal"},
+			want:    "# Generated by vmm\nsearch vmm.internal\nnameserver 172.16.0.1\nnameserver 8.8.8.8\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolvConf(tt.servers, tt.search); got != tt.want {
+				t.Errorf("resolvConf() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
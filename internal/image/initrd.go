@@ -0,0 +1,154 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// InitrdInfo describes an imported initrd image.
+type InitrdInfo struct {
+	Name    string    // Initrd name (filename without path)
+	Path    string    // Full path to the image
+	Size    int64     // Size in bytes
+	ModTime time.Time // Last modification time
+	Format  string    // Archive or compression format, e.g. "gzip"
+}
+
+// initrdFormats are the leading bytes of the formats the kernel can unpack
+// an initramfs from: a cpio archive, optionally compressed.
+var initrdFormats = []struct {
+	name  string
+	magic []byte
+}{
+	{"cpio", []byte("070701")},
+	{"cpio", []byte("070702")},
+	{"gzip", []byte{0x1f, 0x8b}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{"lz4", []byte{0x02, 0x21, 0x4c, 0x18}},
+	{"bzip2", []byte("BZh")},
+	{"lzma", []byte{0x5d, 0x00, 0x00}},
+	{"lzo", []byte{0x89, 'L', 'Z', 'O'}},
+}
+
+// initrdFormat returns the format of an initrd image, or an error if it is
+// not one the kernel can unpack.
+func initrdFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, 8)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("failed to read initrd: %w", err)
+	}
+	header = header[:n]
+	for _, format := range initrdFormats {
+		if bytes.HasPrefix(header, format.magic) {
+			return format.name, nil
+		}
+	}
+	return "", fmt.Errorf("not a cpio archive or a compressed one (gzip, zstd, xz, lz4, bzip2, lzma, lzo)")
+}
+
+// ImportInitrd copies an initrd image into the initrd directory after
+// checking that the kernel can unpack it.
+func (m *Manager) ImportInitrd(srcPath, name string, force bool) error {
+	destPath := filepath.Join(m.InitrdDir, name)
+
+	if _, err := os.Stat(destPath); err == nil && !force {
+		return fmt.Errorf("initrd '%s' already exists. Use --force to overwrite", name)
+	}
+
+	format, err := initrdFormat(srcPath)
+	if err != nil {
+		return fmt.Errorf("invalid initrd: %w", err)
+	}
+
+	if err := os.MkdirAll(m.InitrdDir, 0755); err != nil {
+		return fmt.Errorf("failed to create initrd directory: %w", err)
+	}
+
+	fmt.Printf("Importing initrd '%s' from %s...\n", name, srcPath)
+	if err := copyFile(srcPath, destPath); err != nil {
+		return fmt.Errorf("failed to copy initrd: %w", err)
+	}
+
+	info, err := os.Stat(destPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat initrd: %w", err)
+	}
+
+	fmt.Printf("Successfully imported initrd '%s'\n", name)
+	fmt.Printf("  Path:   %s\n", destPath)
+	fmt.Printf("  Format: %s\n", format)
+	fmt.Printf("  Size:   %.2f MB\n", float64(info.Size())/(1024*1024))
+	return nil
+}
+
+// DeleteInitrd removes an imported initrd image
+func (m *Manager) DeleteInitrd(name string) error {
+	path := filepath.Join(m.InitrdDir, name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return fmt.Errorf("initrd '%s' not found", name)
+	}
+	return os.Remove(path)
+}
+
+// InitrdExists checks if an initrd with the given name exists
+func (m *Manager) InitrdExists(name string) bool {
+	_, err := os.Stat(filepath.Join(m.InitrdDir, name))
+	return err == nil
+}
+
+// GetInitrdPath returns the full path to an initrd, or an empty string for
+// no initrd.
+func (m *Manager) GetInitrdPath(name string) string {
+	if name == "" {
+		return ""
+	}
+	return filepath.Join(m.InitrdDir, name)
+}
+
+// ListInitrds returns information about all imported initrd images
+func (m *Manager) ListInitrds() ([]InitrdInfo, error) {
+	entries, err := os.ReadDir(m.InitrdDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []InitrdInfo{}, nil
+		}
+		return nil, err
+	}
+
+	var initrds []InitrdInfo
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(m.InitrdDir, entry.Name())
+		format, err := initrdFormat(path)
+		if err != nil {
+			format = "unknown"
+		}
+		initrds = append(initrds, InitrdInfo{
+			Name:    entry.Name(),
+			Path:    path,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Format:  format,
+		})
+	}
+
+	return initrds, nil
+}
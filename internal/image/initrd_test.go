@@ -0,0 +1,92 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInitrdFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+		want    string
+		wantErr bool
+	}{
+		{"cpio newc", []byte("070701000000010000"), "cpio", false},
+		{"cpio crc", []byte("070702000000010000"), "cpio", false},
+		{"gzip", []byte{0x1f, 0x8b, 0x08, 0x00, 0, 0, 0, 0}, "gzip", false},
+		{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x04}, "zstd", false},
+		{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00}, "xz", false},
+		{"kernel image", []byte{0x7f, 'E', 'L', 'F', 2, 1, 1, 0}, "", true},
+		{"text", []byte("hello"), "", true},
+		{"empty", nil, "", true},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "initrd")
+			if err := os.WriteFile(path, tt.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := initrdFormat(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("initrdFormat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("initrdFormat() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImportInitrd(t *testing.T) {
+	dir := t.TempDir()
+	m := NewManager(filepath.Join(dir, "kernels"), filepath.Join(dir, "rootfs"))
+	if m.InitrdDir != filepath.Join(dir, "initrd") {
+		t.Errorf("InitrdDir = %q, want a sibling of the kernel directory", m.InitrdDir)
+	}
+
+	src := filepath.Join(dir, "initramfs.img")
+	if err := os.WriteFile(src, []byte{0x1f, 0x8b, 0x08, 0x00}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ImportInitrd(src, "debug-initrd", false); err != nil {
+		t.Fatalf("ImportInitrd() error: %v", err)
+	}
+	if !m.InitrdExists("debug-initrd") {
+		t.Error("InitrdExists() = false after import")
+	}
+	if err := m.ImportInitrd(src, "debug-initrd", false); err == nil {
+		t.Error("ImportInitrd() over an existing initrd without force should fail")
+	}
+	if err := m.ImportInitrd(src, "debug-initrd", true); err != nil {
+		t.Errorf("ImportInitrd() with force error: %v", err)
+	}
+
+	bad := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(bad, []byte("not an initrd"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ImportInitrd(bad, "bad", false); err == nil {
+		t.Error("ImportInitrd() of a text file should fail")
+	}
+
+	initrds, err := m.ListInitrds()
+	if err != nil {
+		t.Fatalf("ListInitrds() error: %v", err)
+	}
+	if len(initrds) != 1 || initrds[0].Name != "debug-initrd" || initrds[0].Format != "gzip" {
+		t.Errorf("ListInitrds() = %+v, want debug-initrd in gzip format", initrds)
+	}
+	if got := m.GetInitrdPath(""); got != "" {
+		t.Errorf("GetInitrdPath(\"\") = %q, want none", got)
+	}
+
+	if err := m.DeleteInitrd("debug-initrd"); err != nil {
+		t.Fatalf("DeleteInitrd() error: %v", err)
+	}
+	if err := m.DeleteInitrd("debug-initrd"); err == nil {
+		t.Error("DeleteInitrd() of a missing initrd should fail")
+	}
+}
@@ -0,0 +1,247 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// A thin VM's rootfs is a device-mapper snapshot of a read-only base image:
+// reads of blocks the guest has not written fall through to the base, and
+// writes go to a copy-on-write store in the VM's directory, a sparse file
+// that only takes up the space the guest has changed. While the disk is
+// attached the assembled device is /dev/mapper/vmm-<name>, and the VM's usual
+// rootfs path is a symlink to it, so Firecracker, the rootfs injection
+// helpers and snapshots use it like any other image.
+
+const (
+	sectorSize = 512
+	// overlayChunkSectors is the size of the blocks the overlay copies from
+	// the base on a guest's first write, 4K.
+	overlayChunkSectors = 8
+)
+
+// VMOverlayPath returns the path of the copy-on-write store of a thin VM's
+// rootfs.
+func VMOverlayPath(vmName, vmDir string) string {
+	return filepath.Join(vmDir, vmName+".cow")
+}
+
+// overlayDevice returns the device-mapper name of a thin VM's rootfs. When
+// the disk is larger than its base, the base is first extended with zeros by
+// the device named with a ":base" suffix, which no VM name can contain.
+func overlayDevice(vmName string) string {
+	return "vmm-" + vmName
+}
+
+func mapperPath(name string) string {
+	return filepath.Join("/dev/mapper", name)
+}
+
+// overlaySize returns the size of a thin disk over a base image of baseSize
+// bytes: diskSizeMB if that is larger, as CreateVMRootfs resizes copies.
+func overlaySize(baseSize int64, diskSizeMB int) int64 {
+	size := int64(diskSizeMB) * 1024 * 1024
+	if size < baseSize {
+		return baseSize
+	}
+	return size
+}
+
+// cowStoreSize returns how large the copy-on-write store of a disk of size
+// bytes must be to hold every block the guest could write, with the
+// metadata device-mapper keeps for each: one 4K entry table per 256 chunks,
+// and a header. The store is sparse, so the space is only used as written.
+func cowStoreSize(size int64) int64 {
+	return size + size/128 + 1024*1024
+}
+
+// overlayTables returns the device-mapper tables of a thin disk of size
+// bytes over the base at baseDev, baseSize bytes long, with its
+// copy-on-write store at cowDev. origin is the table of the zero-extended
+// base and is empty when the disk is no larger than the base; otherwise the
+// snapshot's origin is the device created from it.
+func overlayTables(baseDev, cowDev, originDev string, baseSize, size int64) (origin, snapshot string) {
+	if size > baseSize {
+		baseSectors := baseSize / sectorSize
+		origin = fmt.Sprintf("0 %d linear %s 0\n%d %d zero",
+			baseSectors, baseDev, baseSectors, size/sectorSize-baseSectors)
+		baseDev = originDev
+	}
+	snapshot = fmt.Sprintf("0 %d snapshot %s %s P %d", size/sectorSize, baseDev, cowDev, overlayChunkSectors)
+	return origin, snapshot
+}
+
+// CreateVMOverlay prepares a thin rootfs for a VM over the image at basePath
+// and attaches it, returning the path to boot from. The copy-on-write store
+// is created on the first start, with the filesystem grown to diskSizeMB if
+// that is larger than the base; later starts reattach it.
+func (m *Manager) CreateVMOverlay(vmName, vmDir string, diskSizeMB int, basePath string) (string, error) {
+	base, err := os.Stat(basePath)
+	if err != nil {
+		return "", fmt.Errorf("base image not found at %s: %w", basePath, err)
+	}
+	size := overlaySize(base.Size(), diskSizeMB)
+
+	cowPath := VMOverlayPath(vmName, vmDir)
+	_, err = os.Stat(cowPath)
+	created := os.IsNotExist(err)
+	if created {
+		fmt.Printf("Creating copy-on-write rootfs for VM '%s' over %s...\n", vmName, basePath)
+		f, err := os.OpenFile(cowPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return "", fmt.Errorf("failed to create copy-on-write store: %w", err)
+		}
+		err = f.Truncate(cowStoreSize(size))
+		f.Close()
+		if err != nil {
+			os.Remove(cowPath)
+			return "", fmt.Errorf("failed to create copy-on-write store: %w", err)
+		}
+	}
+
+	if err := m.AttachVMDisk(vmName, vmDir, diskSizeMB, basePath); err != nil {
+		if created {
+			os.Remove(cowPath)
+		}
+		return "", err
+	}
+	if created && size > base.Size() {
+		fmt.Printf("Resizing rootfs to %d MB...\n", diskSizeMB)
+		dev := mapperPath(overlayDevice(vmName))
+		exec.Command("e2fsck", "-f", "-y", dev).Run() // Best effort, ignore errors
+		if output, err := exec.Command("resize2fs", dev).CombinedOutput(); err != nil {
+			m.DetachVMDisk(vmName, vmDir)
+			os.Remove(cowPath)
+			return "", fmt.Errorf("failed to resize filesystem: %w: %s", err, string(output))
+		}
+	}
+	return VMRootfsPath(vmName, vmDir), nil
+}
+
+// AttachVMDisk assembles a thin VM's rootfs from the image at basePath and
+// its copy-on-write store, and links the VM's rootfs path to it. It does
+// nothing more if the disk is already attached.
+func (m *Manager) AttachVMDisk(vmName, vmDir string, diskSizeMB int, basePath string) error {
+	name := overlayDevice(vmName)
+	dev := mapperPath(name)
+	if _, err := os.Stat(dev); os.IsNotExist(err) {
+		if err := attachOverlay(name, basePath, VMOverlayPath(vmName, vmDir), diskSizeMB); err != nil {
+			return err
+		}
+	}
+
+	rootfsPath := VMRootfsPath(vmName, vmDir)
+	if info, err := os.Lstat(rootfsPath); err == nil {
+		if info.Mode()&os.ModeSymlink == 0 {
+			return fmt.Errorf("VM '%s' has its own rootfs at %s as well as a base image", vmName, rootfsPath)
+		}
+		os.Remove(rootfsPath)
+	}
+	if err := os.Symlink(dev, rootfsPath); err != nil {
+		return fmt.Errorf("failed to link rootfs: %w", err)
+	}
+	return nil
+}
+
+// attachOverlay creates the device-mapper devices of a thin disk. The loop
+// devices backing them are detached straight away, which the kernel defers
+// until device-mapper closes them, so removing the devices frees them.
+func attachOverlay(name, basePath, cowPath string, diskSizeMB int) error {
+	base, err := os.Stat(basePath)
+	if err != nil {
+		return fmt.Errorf("base image not found at %s: %w", basePath, err)
+	}
+	baseDev, err := runCmdOutput("losetup", "--find", "--show", "--read-only", basePath)
+	if err != nil {
+		return fmt.Errorf("failed to attach base image: %w", err)
+	}
+	baseDev = strings.TrimSpace(baseDev)
+	defer exec.Command("losetup", "--detach", baseDev).Run()
+	cowDev, err := runCmdOutput("losetup", "--find", "--show", cowPath)
+	if err != nil {
+		return fmt.Errorf("failed to attach copy-on-write store: %w", err)
+	}
+	cowDev = strings.TrimSpace(cowDev)
+	defer exec.Command("losetup", "--detach", cowDev).Run()
+
+	originName := name + ":base"
+	origin, snapshot := overlayTables(baseDev, cowDev, mapperPath(originName), base.Size(), overlaySize(base.Size(), diskSizeMB))
+	if origin != "" {
+		if err := dmsetupCreate(originName, origin); err != nil {
+			return fmt.Errorf("failed to extend base image: %w", err)
+		}
+	}
+	if err := dmsetupCreate(name, snapshot); err != nil {
+		if origin != "" {
+			exec.Command("dmsetup", "remove", originName).Run()
+		}
+		return fmt.Errorf("failed to create copy-on-write device: %w", err)
+	}
+	return nil
+}
+
+// dmsetupCreate creates a device-mapper device, passing its table on stdin
+// since it may have several lines.
+func dmsetupCreate(name, table string) error {
+	cmd := exec.Command("dmsetup", "create", name)
+	cmd.Stdin = strings.NewReader(table + "\n")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, string(output))
+	}
+	return nil
+}
+
+// DetachVMDisk removes a thin VM's rootfs device and the link to it. Its
+// copy-on-write store is kept for the next start. It does nothing for a VM
+// with its own rootfs, or whose disk is not attached.
+func (m *Manager) DetachVMDisk(vmName, vmDir string) error {
+	rootfsPath := VMRootfsPath(vmName, vmDir)
+	if info, err := os.Lstat(rootfsPath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		os.Remove(rootfsPath)
+	}
+	name := overlayDevice(vmName)
+	for _, dev := range []string{name, name + ":base"} {
+		if _, err := os.Stat(mapperPath(dev)); err != nil {
+			continue
+		}
+		// Firecracker may still be closing the device as it exits
+		if output, err := exec.Command("dmsetup", "remove", "--retry", dev).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to remove device %s: %w: %s", dev, err, string(output))
+		}
+	}
+	return nil
+}
+
+// FlattenVMRootfs gives a thin VM its own copy of its rootfs, so it no longer
+// depends on the image at basePath. The VM must be stopped. A VM that has
+// not been started yet has nothing to copy; its first start copies the image
+// as for any other VM.
+func (m *Manager) FlattenVMRootfs(vmName, vmDir string, diskSizeMB int, basePath string) error {
+	cowPath := VMOverlayPath(vmName, vmDir)
+	if _, err := os.Stat(cowPath); os.IsNotExist(err) {
+		return nil
+	}
+	if err := m.AttachVMDisk(vmName, vmDir, diskSizeMB, basePath); err != nil {
+		return err
+	}
+	rootfsPath := VMRootfsPath(vmName, vmDir)
+	tmpPath := rootfsPath + ".flatten"
+	fmt.Printf("Copying rootfs for VM '%s' from its base image...\n", vmName)
+	if err := copyFile(rootfsPath, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		m.DetachVMDisk(vmName, vmDir)
+		return fmt.Errorf("failed to copy rootfs: %w", err)
+	}
+	if err := m.DetachVMDisk(vmName, vmDir); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, rootfsPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace rootfs: %w", err)
+	}
+	return os.Remove(cowPath)
+}
@@ -0,0 +1,107 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOverlaySize(t *testing.T) {
+	const mb = 1024 * 1024
+	tests := []struct {
+		name       string
+		baseSize   int64
+		diskSizeMB int
+		want       int64
+	}{
+		{"grown", 512 * mb, 2048, 2048 * mb},
+		{"smaller than base", 512 * mb, 256, 512 * mb},
+		{"unset", 512 * mb, 0, 512 * mb},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := overlaySize(tt.baseSize, tt.diskSizeMB); got != tt.want {
+				t.Errorf("overlaySize = %d, want %d", got, tt.want)
+			}
+		})
+	}
+	if got := cowStoreSize(1024 * mb); got <= 1024*mb+1024*mb/256 {
+		t.Errorf("cowStoreSize(1GB) = %d, too small for the data and its metadata", got)
+	}
+}
+
+func TestOverlayTables(t *testing.T) {
+	tests := []struct {
+		name         string
+		baseSize     int64
+		size         int64
+		wantOrigin   string
+		wantSnapshot string
+	}{
+		{
+			name:         "same size",
+			baseSize:     1 << 30,
+			size:         1 << 30,
+			wantSnapshot: "0 2097152 snapshot /dev/loop0 /dev/loop1 P 8",
+		},
+		{
+			name:         "grown",
+			baseSize:     1 << 30,
+			size:         2 << 30,
+			wantOrigin:   "0 2097152 linear /dev/loop0 0\n2097152 2097152 zero",
+			wantSnapshot: "0 4194304 snapshot /dev/mapper/vmm-web:base /dev/loop1 P 8",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			origin, snapshot := overlayTables("/dev/loop0", "/dev/loop1", "/dev/mapper/vmm-web:base", tt.baseSize, tt.size)
+			if origin != tt.wantOrigin {
+				t.Errorf("origin = %q, want %q", origin, tt.wantOrigin)
+			}
+			if snapshot != tt.wantSnapshot {
+				t.Errorf("snapshot = %q, want %q", snapshot, tt.wantSnapshot)
+			}
+		})
+	}
+}
+
+func TestDeleteVMRootfs(t *testing.T) {
+	m := &Manager{}
+	dir := t.TempDir()
+
+	// A VM with its own rootfs
+	rootfs := VMRootfsPath("thick", dir)
+	if err := os.WriteFile(rootfs, []byte("ext4"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DetachVMDisk("thick", dir); err != nil {
+		t.Fatalf("DetachVMDisk: %v", err)
+	}
+	if _, err := os.Stat(rootfs); err != nil {
+		t.Fatalf("DetachVMDisk removed a VM's own rootfs: %v", err)
+	}
+	if err := m.DeleteVMRootfs("thick", dir); err != nil {
+		t.Fatalf("DeleteVMRootfs: %v", err)
+	}
+	if _, err := os.Stat(rootfs); !os.IsNotExist(err) {
+		t.Errorf("rootfs left behind: %v", err)
+	}
+
+	// A thin VM whose device has gone, leaving its link dangling
+	rootfs = VMRootfsPath("thin", dir)
+	cow := VMOverlayPath("thin", dir)
+	if err := os.WriteFile(cow, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "gone"), rootfs); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DeleteVMRootfs("thin", dir); err != nil {
+		t.Fatalf("DeleteVMRootfs: %v", err)
+	}
+	for _, path := range []string{rootfs, cow} {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", filepath.Base(path), err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package lifecycle
+
+import (
+	"fmt"
+
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+// SetBalloon sets the size of a VM's memory balloon, the guest memory handed
+// back to the host. If the VM is running the balloon is resized straight
+// away; otherwise it is inflated to this size when the VM next boots.
+func (m *Manager) SetBalloon(name string, targetMB int) (*vm.VM, error) {
+	l, err := m.lockVM(name)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+
+	v, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.ValidateBalloon(targetMB); err != nil {
+		return nil, err
+	}
+
+	if v.State.Active() {
+		if err := m.hypervisor.SetBalloon(v, targetMB); err != nil {
+			return nil, err
+		}
+	}
+
+	v.BalloonMB = targetMB
+	if err := v.Save(m.cfg.GetPaths().VMs); err != nil {
+		return nil, fmt.Errorf("failed to save VM state: %w", err)
+	}
+	return v, nil
+}
+
+// ResizeBalloon resizes a running VM's balloon without recording the size,
+// so the VM boots with its own balloon size next time. It is how memory is
+// reclaimed temporarily, such as by vmmd's auto-balloon policy.
+func (m *Manager) ResizeBalloon(name string, targetMB int) error {
+	l, err := m.lockVM(name)
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+
+	v, err := m.Get(name)
+	if err != nil {
+		return err
+	}
+	if v.State != vm.StateRunning {
+		return conflictf("VM '%s' is not running (state: %s)", name, v.State)
+	}
+	if err := v.ValidateBalloon(targetMB); err != nil {
+		return err
+	}
+	return m.hypervisor.SetBalloon(v, targetMB)
+}
+
+// BalloonStats returns a running VM's balloon size and the guest's memory
+// statistics.
+func (m *Manager) BalloonStats(name string) (*vm.BalloonStats, error) {
+	v, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if v.State != vm.StateRunning {
+		return nil, conflictf("VM '%s' is not running (state: %s)", name, v.State)
+	}
+	return m.hypervisor.BalloonStats(v)
+}
@@ -0,0 +1,42 @@
+package lifecycle
+
+import (
+	"fmt"
+
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+// SetBoot changes the kernel, extra kernel arguments and initrd a VM boots
+// with. The VM must not be running; the change takes effect when it next
+// starts.
+func (m *Manager) SetBoot(name string, boot vm.Boot) (*vm.VM, error) {
+	if err := boot.Validate(); err != nil {
+		return nil, err
+	}
+	if boot.Kernel != "" && !m.images.KernelExists(boot.Kernel) {
+		return nil, notFoundf("kernel '%s' not found", boot.Kernel)
+	}
+	if boot.Initrd != "" && !m.images.InitrdExists(boot.Initrd) {
+		return nil, notFoundf("initrd '%s' not found", boot.Initrd)
+	}
+
+	l, err := m.lockVM(name)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+
+	v, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if v.State.Active() {
+		return nil, conflictf("VM '%s' must be stopped to change how it boots (state: %s)", name, v.State)
+	}
+
+	v.Kernel, v.KernelArgs, v.Initrd = boot.Kernel, boot.KernelArgs, boot.Initrd
+	if err := v.Save(m.cfg.GetPaths().VMs); err != nil {
+		return nil, fmt.Errorf("failed to save VM state: %w", err)
+	}
+	return v, nil
+}
@@ -0,0 +1,323 @@
+package lifecycle
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/raesene/baremetalvmm/internal/firecracker"
+	"github.com/raesene/baremetalvmm/internal/image"
+	"github.com/raesene/baremetalvmm/internal/lock"
+	"github.com/raesene/baremetalvmm/internal/snapshot"
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+// Clone creates the VM name from one of source's snapshots and starts it.
+// The clone copies source's settings, apart from port forwards, whose host
+// ports belong to source.
+//
+// A cold clone boots a copy of the snapshot's rootfs like any new VM, with
+// its own MAC and IP addresses. A warm clone also restores the snapshot's
+// memory, so it carries on from the instant the snapshot was taken; the guest
+// agent then moves it to the clone's addresses. While the snapshot loads, a
+// warm clone borrows source's TAP devices and vsock socket, which are
+// recorded in the snapshot, so source must be stopped.
+//
+// If any step fails the clone is removed again.
+func (m *Manager) Clone(source, snapName, name string, warm bool) (*vm.VM, error) {
+	if err := m.cfg.EnsureDirectories(); err != nil {
+		return nil, fmt.Errorf("failed to create directories: %w", err)
+	}
+	// Holding source's lock keeps it stopped and the snapshot in place
+	sl, err := m.lockVM(source)
+	if err != nil {
+		return nil, err
+	}
+	defer sl.Unlock()
+	l, err := m.lockVM(name)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+
+	src, err := m.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	if !m.snapshots.Exists(source, snapName) {
+		return nil, notFoundf("snapshot '%s' not found for VM '%s'", snapName, source)
+	}
+	meta, err := m.snapshots.Get(source, snapName)
+	if err != nil {
+		return nil, err
+	}
+	if warm {
+		if meta.DiskOnly() {
+			return nil, conflictf("snapshot '%s' has no memory; make a cold clone instead", snapName)
+		}
+		if src.State.Active() {
+			return nil, conflictf("VM '%s' is %s; a warm clone borrows its TAP devices while loading, so stop it first or make a cold clone", source, src.State)
+		}
+		if meta.StateRootfs != "" && meta.StateRootfs != meta.RootfsPath {
+			return nil, conflictf("snapshot '%s' was imported from a VM whose disks were at %s, which Firecracker reopens while loading; make a cold clone instead", snapName, meta.StateRootfs)
+		}
+		if !sameMounts(src.Mounts, meta.Mounts) {
+			return nil, conflictf("the mounts of VM '%s' have changed since snapshot '%s' was taken; make a cold clone instead", source, snapName)
+		}
+	}
+
+	paths := m.cfg.GetPaths()
+	v := cloneVM(src, meta, name)
+	v.SocketPath = fmt.Sprintf("%s/%s.sock", paths.Sockets, name)
+	if _, err := m.create(v); err != nil {
+		return nil, err
+	}
+	done := false
+	defer func() {
+		if !done {
+			m.discard(v)
+		}
+	}()
+
+	m.report(name, "Copying disks from snapshot")
+	v.RootfsPath = m.images.VMRootfsPath(name, paths.VMs)
+	if !warm {
+		// Mount images are rebuilt from the host directories at boot
+		if err := m.snapshots.CloneDisks(source, snapName, v.RootfsPath, nil); err != nil {
+			return nil, err
+		}
+		if err := m.boot(v); err != nil {
+			return nil, err
+		}
+		done = true
+		return v, nil
+	}
+
+	mountPath := func(guestTag string) string {
+		return m.mounts.GetMountImagePath(name, guestTag)
+	}
+	if err := m.snapshots.CloneDisks(source, snapName, v.RootfsPath, mountPath); err != nil {
+		return nil, err
+	}
+	for i := range v.Mounts {
+		v.Mounts[i].ImagePath = mountPath(v.Mounts[i].GuestTag)
+	}
+	if src.BaseImage != "" {
+		// Firecracker opens source's thin rootfs, recorded in the snapshot,
+		// while loading
+		if err := m.images.AttachVMDisk(source, paths.VMs, src.DiskSizeMB, src.BaseImage); err != nil {
+			return nil, err
+		}
+		defer m.detachDisk(src)
+	}
+	if err := m.restoreClone(v, src, m.snapshots.Dir(source, snapName), meta); err != nil {
+		return nil, err
+	}
+	done = true
+	return v, nil
+}
+
+// cloneVM returns a new VM named name with src's settings and the resources
+// recorded in meta. Its interfaces are on the same networks as src's, with
+// their own TAP devices and MAC addresses assigned when it is created.
+func cloneVM(src *vm.VM, meta *snapshot.Metadata, name string) *vm.VM {
+	v := vm.NewVM(name)
+	v.CPUs = meta.CPUs
+	v.MemoryMB = meta.MemoryMB
+	v.DiskSizeMB = src.DiskSizeMB
+	v.Image = src.Image
+	v.Kernel = src.Kernel
+	v.KernelArgs = src.KernelArgs
+	v.Initrd = src.Initrd
+	v.NIC = vm.NIC{Network: src.Network}
+	for _, nic := range src.NICs {
+		v.NICs = append(v.NICs, vm.NIC{Network: nic.Network})
+	}
+	v.SSHPort = src.SSHPort
+	v.SSHPublicKey = src.SSHPublicKey
+	v.DNSServers = src.DNSServers
+	v.AutoStart = src.AutoStart
+	for _, mnt := range src.Mounts {
+		mnt.ImagePath = ""
+		v.Mounts = append(v.Mounts, mnt)
+	}
+	v.Firewall = src.Firewall
+	v.RateLimits = src.RateLimits
+	v.BalloonMB = src.BalloonMB
+	return v
+}
+
+// sameMounts reports whether a VM's mounts are the drives recorded in a
+// snapshot, in the same order.
+func sameMounts(mounts []vm.Mount, recorded []snapshot.MountSnapshot) bool {
+	if len(mounts) != len(recorded) {
+		return false
+	}
+	for i := range mounts {
+		if mounts[i].GuestTag != recorded[i].GuestTag {
+			return false
+		}
+	}
+	return true
+}
+
+// restoreClone starts a warm clone from the snapshot in dir. Firecracker
+// opens the TAP devices and binds the vsock socket recorded in the snapshot,
+// which are src's, so they are created under src's names and renamed to the
+// clone's once loaded, before the guest runs.
+func (m *Manager) restoreClone(v, src *vm.VM, dir string, meta *snapshot.Metadata) error {
+	paths := m.cfg.GetPaths()
+
+	m.report(v.Name, "Setting up network")
+	nics := v.Interfaces()
+	srcNICs := src.Interfaces()
+	if len(srcNICs) != len(nics) {
+		return fmt.Errorf("VM '%s' has %d interfaces, but its clone has %d", src.Name, len(srcNICs), len(nics))
+	}
+	defs, nets, err := m.hostNetworks(nics)
+	if err != nil {
+		return err
+	}
+
+	rb := &rollback{}
+	defer rb.run()
+
+	taps := make([]string, len(nics))
+	for i := range nics {
+		taps[i] = srcNICs[i].TapDevice
+		if !nets[i].TapExists(taps[i]) {
+			if err := nets[i].CreateTap(taps[i]); err != nil {
+				return fmt.Errorf("failed to create TAP device: %w", err)
+			}
+		}
+		hostNet := nets[i]
+		rb.add("clean up TAP device", func() error {
+			return hostNet.DeleteTap(taps[i])
+		})
+	}
+
+	gl, err := lock.Global(paths.State, globalLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer gl.Unlock()
+	if err := m.acquireAddresses(v, defs, rb); err != nil {
+		return err
+	}
+	v.State = vm.StateStarting
+	if err := v.Save(paths.VMs); err != nil {
+		return fmt.Errorf("failed to save VM state: %w", err)
+	}
+	gl.Unlock()
+
+	var mountPaths []string
+	for _, mnt := range v.Mounts {
+		mountPaths = append(mountPaths, mnt.ImagePath)
+	}
+	m.report(v.Name, "Restoring memory from snapshot")
+	memPath, loaded, err := m.snapshots.MemoryFile(src.Name, meta.Name)
+	if err != nil {
+		return err
+	}
+	os.Remove(src.VsockPath())
+	pid, err := m.hypervisor.Restore(&firecracker.RestoreConfig{
+		SocketPath:  v.SocketPath,
+		LogPath:     fmt.Sprintf("%s/%s.log", paths.Logs, v.Name),
+		ConsolePath: v.ConsolePath(),
+		MemPath:     memPath,
+		StatePath:   filepath.Join(dir, meta.StateFile),
+		RootfsPath:  v.RootfsPath,
+		MountPaths:  mountPaths,
+		Paused:      true,
+	})
+	loaded()
+	if err != nil {
+		return fmt.Errorf("failed to restore snapshot: %w", err)
+	}
+	v.PID = pid
+	rb.add("stop Firecracker", func() error {
+		return m.hypervisor.Terminate(v)
+	})
+
+	for i, nic := range nics {
+		if err := nets[i].RenameTap(taps[i], nic.TapDevice); err != nil {
+			return fmt.Errorf("failed to rename TAP device: %w", err)
+		}
+		taps[i] = nic.TapDevice
+	}
+	if err := os.Rename(src.VsockPath(), v.VsockPath()); err != nil {
+		return fmt.Errorf("failed to move vsock socket: %w", err)
+	}
+	if err := applyFirewall(v, nets, rb); err != nil {
+		return err
+	}
+
+	m.report(v.Name, "Resuming vCPUs")
+	if err := m.hypervisor.Resume(v); err != nil {
+		return err
+	}
+	m.report(v.Name, "Moving guest to its new addresses")
+	if err := m.guests.SetNetwork(v, guestInterfaces(nics, defs)); err != nil {
+		return fmt.Errorf("failed to configure the guest's network (warm clones need the guest agent): %w", err)
+	}
+	// The guest clock resumes from when the snapshot was taken
+	if err := m.guests.SyncTime(v); err != nil {
+		fmt.Printf("Warning: failed to set guest clock: %v\n", err)
+	}
+	rb.commit()
+
+	v.State = vm.StateRunning
+	v.StartedAt = time.Now()
+	if err := v.Save(paths.VMs); err != nil {
+		return fmt.Errorf("VM started but failed to save state: %w", err)
+	}
+	return nil
+}
+
+// guestNetworkScript returns the commands that move a running guest's
+// interfaces to new MAC and IP addresses.
+func guestNetworkScript(nics []*vm.NIC, ifaces []image.NetworkInterface) string {
+	var b strings.Builder
+	b.WriteString("set -e\n")
+	for i, iface := range ifaces {
+		dev := iface.Device
+		fmt.Fprintf(&b, "ip link set dev %s down\n", dev)
+		fmt.Fprintf(&b, "ip link set dev %s address %s\n", dev, strings.ToLower(nics[i].MacAddress))
+		fmt.Fprintf(&b, "ip addr flush dev %s\n", dev)
+		fmt.Fprintf(&b, "ip link set dev %s up\n", dev)
+		if iface.Address != "" {
+			fmt.Fprintf(&b, "ip addr add %s dev %s\n", iface.Address, dev)
+		}
+		if iface.Address6 != "" {
+			fmt.Fprintf(&b, "ip -6 addr add %s dev %s nodad\n", iface.Address6, dev)
+		}
+		if iface.Gateway != "" {
+			fmt.Fprintf(&b, "ip route replace default via %s dev %s\n", iface.Gateway, dev)
+		}
+		if iface.Gateway6 != "" {
+			fmt.Fprintf(&b, "ip -6 route replace default via %s dev %s\n", iface.Gateway6, dev)
+		}
+	}
+	return b.String()
+}
+
+// discard removes a clone that failed to start, with its disks and leases.
+func (m *Manager) discard(v *vm.VM) {
+	paths := m.cfg.GetPaths()
+	if err := m.releaseLeases(v); err != nil {
+		fmt.Printf("Warning: failed to release IP leases: %v\n", err)
+	}
+	if err := m.images.DeleteVMRootfs(v.Name, paths.VMs); err != nil {
+		fmt.Printf("Warning: failed to delete VM rootfs: %v\n", err)
+	}
+	if len(v.Mounts) > 0 {
+		if err := m.mounts.DeleteAllMountImages(v.Name, v.Mounts); err != nil {
+			fmt.Printf("Warning: failed to delete mount images: %v\n", err)
+		}
+	}
+	if err := vm.Delete(paths.VMs, v.Name); err != nil {
+		fmt.Printf("Warning: failed to delete VM: %v\n", err)
+	}
+}
@@ -0,0 +1,69 @@
+package lifecycle
+
+import (
+	"fmt"
+
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+// Flatten gives a thin VM its own copy of its rootfs, detaching it from the
+// base image it was an overlay of so the image can be deleted. The VM must
+// be stopped.
+func (m *Manager) Flatten(name string) (*vm.VM, error) {
+	l, err := m.lockVM(name)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+
+	v, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if v.BaseImage == "" {
+		return nil, conflictf("VM '%s' already has its own rootfs", name)
+	}
+	if v.State.Active() {
+		return nil, conflictf("VM '%s' must be stopped to flatten its disk (state: %s)", name, v.State)
+	}
+
+	paths := m.cfg.GetPaths()
+	m.report(name, "Copying rootfs from base image")
+	if err := m.images.FlattenVMRootfs(name, paths.VMs, v.DiskSizeMB, v.BaseImage); err != nil {
+		return nil, fmt.Errorf("failed to flatten disk: %w", err)
+	}
+	v.BaseImage = ""
+	if err := v.Save(paths.VMs); err != nil {
+		return nil, fmt.Errorf("failed to save VM state: %w", err)
+	}
+	return v, nil
+}
+
+// SnapshotImage saves a stopped VM's rootfs as a new base image. A thin
+// VM's disk is attached for the copy and detached again afterwards. The VM
+// stays locked throughout, so it cannot be started mid-copy.
+func (m *Manager) SnapshotImage(name, imageName string) error {
+	l, err := m.lockVM(name)
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+
+	v, err := m.Get(name)
+	if err != nil {
+		return err
+	}
+	if v.State.Active() {
+		return conflictf("VM '%s' is %s. Stop it first before taking a snapshot", name, v.State)
+	}
+
+	paths := m.cfg.GetPaths()
+	if v.BaseImage != "" {
+		if err := m.images.AttachVMDisk(name, paths.VMs, v.DiskSizeMB, v.BaseImage); err != nil {
+			return fmt.Errorf("failed to attach disk: %w", err)
+		}
+		defer m.images.DetachVMDisk(name, paths.VMs)
+	}
+	m.report(name, fmt.Sprintf("Snapshotting rootfs as image '%s'", imageName))
+	return m.images.SnapshotVMRootfs(name, paths.VMs, imageName)
+}
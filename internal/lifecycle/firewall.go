@@ -0,0 +1,183 @@
+package lifecycle
+
+import (
+	"fmt"
+
+	"github.com/raesene/baremetalvmm/internal/network"
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+// SetFirewall replaces a VM's firewall policy. If the VM is running the new
+// policy is applied to its interfaces straight away; otherwise it takes effect
+// the next time the VM starts. A nil fw, or one that lets all traffic
+// through, removes the firewall.
+func (m *Manager) SetFirewall(name string, fw *vm.Firewall) (*vm.VM, error) {
+	if fw != nil {
+		if err := fw.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid firewall: %w", err)
+		}
+	}
+	l, err := m.lockVM(name)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+
+	v, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return m.setFirewall(v, fw)
+}
+
+// AddFirewallRule inserts a rule into a VM's firewall at position, counting
+// from 1, or appends it if position is 0. The policy is applied as
+// SetFirewall would.
+func (m *Manager) AddFirewallRule(name string, rule vm.FirewallRule, position int) (*vm.VM, error) {
+	if err := rule.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid firewall rule: %w", err)
+	}
+	l, err := m.lockVM(name)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+
+	v, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	fw := copyFirewall(v.Firewall)
+	if position < 0 || position > len(fw.Rules)+1 {
+		return nil, conflictf("invalid position %d: VM '%s' has %d rules", position, name, len(fw.Rules))
+	}
+	if position == 0 {
+		fw.Rules = append(fw.Rules, rule)
+	} else {
+		i := position - 1
+		fw.Rules = append(fw.Rules[:i], append([]vm.FirewallRule{rule}, fw.Rules[i:]...)...)
+	}
+	return m.setFirewall(v, fw)
+}
+
+// RemoveFirewallRule removes the rule at position, counting from 1, from a
+// VM's firewall. The policy is applied as SetFirewall would.
+func (m *Manager) RemoveFirewallRule(name string, position int) (*vm.VM, error) {
+	l, err := m.lockVM(name)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+
+	v, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	fw := copyFirewall(v.Firewall)
+	if position < 1 || position > len(fw.Rules) {
+		return nil, notFoundf("rule %d not found on VM '%s'", position, name)
+	}
+	fw.Rules = append(fw.Rules[:position-1], fw.Rules[position:]...)
+	return m.setFirewall(v, fw)
+}
+
+// SetFirewallDefaults changes what a VM's firewall does with the traffic in
+// each direction that no rule matches. An empty ingress or egress leaves that
+// direction's default as it is.
+func (m *Manager) SetFirewallDefaults(name, ingress, egress string) (*vm.VM, error) {
+	l, err := m.lockVM(name)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+
+	v, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	fw := copyFirewall(v.Firewall)
+	if ingress != "" {
+		fw.DefaultIngress = ingress
+	}
+	if egress != "" {
+		fw.DefaultEgress = egress
+	}
+	if err := fw.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid firewall: %w", err)
+	}
+	return m.setFirewall(v, fw)
+}
+
+// copyFirewall returns a copy of a VM's firewall policy to modify, or an
+// empty one.
+func copyFirewall(fw *vm.Firewall) *vm.Firewall {
+	out := &vm.Firewall{}
+	if fw != nil {
+		*out = *fw
+		out.Rules = append([]vm.FirewallRule(nil), fw.Rules...)
+	}
+	return out
+}
+
+// setFirewall replaces the firewall policy of v, whose lock the caller holds,
+// with fw, which has been validated.
+func (m *Manager) setFirewall(v *vm.VM, fw *vm.Firewall) (*vm.VM, error) {
+	if fw.Empty() {
+		fw = nil
+	}
+	v.Firewall = fw
+
+	if v.State.Active() {
+		compiled := compileFirewall(fw)
+		for _, nic := range v.Interfaces() {
+			d, err := m.nicNetwork(nic)
+			if err != nil {
+				return nil, err
+			}
+			if err := m.network(d).ApplyFirewall(nic.TapDevice, compiled); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := v.Save(m.cfg.GetPaths().VMs); err != nil {
+		return nil, fmt.Errorf("failed to save VM state: %w", err)
+	}
+	return v, nil
+}
+
+// compileFirewall converts a VM's firewall policy into the per-interface
+// form the network package installs. It returns nil if the policy lets all
+// traffic through.
+func compileFirewall(fw *vm.Firewall) *network.Firewall {
+	if fw.Empty() {
+		return nil
+	}
+	out := &network.Firewall{
+		IngressPolicy: firewallVerdict(fw.DefaultIngress),
+		EgressPolicy:  firewallVerdict(fw.DefaultEgress),
+	}
+	for _, r := range fw.Rules {
+		rule := network.FirewallRule{
+			Protocol: r.Protocol,
+			Port:     r.Port,
+			CIDR:     r.CIDR,
+			Verdict:  firewallVerdict(r.Action),
+		}
+		if r.Direction == vm.FirewallIngress {
+			out.Ingress = append(out.Ingress, rule)
+		} else {
+			out.Egress = append(out.Egress, rule)
+		}
+	}
+	return out
+}
+
+// firewallVerdict maps allow and deny (or an unset default, which allows) to
+// packet filter verdicts.
+func firewallVerdict(action string) network.Verdict {
+	if action == vm.FirewallDeny {
+		return network.VerdictDrop
+	}
+	return network.VerdictAccept
+}
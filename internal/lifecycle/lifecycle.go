@@ -0,0 +1,789 @@
+// Package lifecycle implements the VM start, stop, restart and delete
+// sequences. It is the single place that knows the order in which a VM's
+// rootfs, guest configuration, TAP device, IP lease, port forwards and
+// Firecracker process are created and torn down; vmmd, the CLI and the web UI
+// all go through it.
+//
+// The host-facing pieces (networking, images, mounts, Firecracker and
+// snapshots) are reached through small interfaces so the sequences can be
+// tested against fakes.
+package lifecycle
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/raesene/baremetalvmm/internal/agent"
+	"github.com/raesene/baremetalvmm/internal/config"
+	"github.com/raesene/baremetalvmm/internal/firecracker"
+	"github.com/raesene/baremetalvmm/internal/image"
+	"github.com/raesene/baremetalvmm/internal/lock"
+	"github.com/raesene/baremetalvmm/internal/mount"
+	"github.com/raesene/baremetalvmm/internal/network"
+	"github.com/raesene/baremetalvmm/internal/snapshot"
+	"github.com/raesene/baremetalvmm/internal/vm"
+	"github.com/raesene/baremetalvmm/internal/volume"
+)
+
+var (
+	// ErrNotFound is returned when the named VM does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a VM is in the wrong state for an operation.
+	ErrConflict = errors.New("conflict")
+)
+
+// opError carries a human-readable message while still matching one of the
+// sentinel errors above with errors.Is.
+type opError struct {
+	kind error
+	msg  string
+}
+
+func (e *opError) Error() string { return e.msg }
+func (e *opError) Unwrap() error { return e.kind }
+
+func notFoundf(format string, args ...interface{}) error {
+	return &opError{kind: ErrNotFound, msg: fmt.Sprintf(format, args...)}
+}
+
+func conflictf(format string, args ...interface{}) error {
+	return &opError{kind: ErrConflict, msg: fmt.Sprintf(format, args...)}
+}
+
+// Network is the host networking of one VM network: its bridge, the TAP
+// devices attached to it, their firewalls and port forwards. It is
+// implemented by network.Manager.
+type Network interface {
+	EnsureBridge() error
+	TapExists(tapName string) bool
+	CreateTap(tapName string) error
+	DeleteTap(tapName string) error
+	RenameTap(tapName, newName string) error
+	ApplyFirewall(tapName string, fw *network.Firewall) error
+	RemoveFirewall(tapName string) error
+	AddPortForward(pf network.PortForward) error
+	RemovePortForward(pf network.PortForward) error
+}
+
+// Addresses assigns VM IP addresses on one network and persists them as
+// leases. It is implemented by network.IPAM; callers hold the global lock
+// around every call.
+type Addresses interface {
+	Acquire(vmName, preferred string, inUse []string) (ip string, created bool, err error)
+	Reserve(vmName, ip string, inUse []string) error
+	Release(vmName string) (*network.Lease, error)
+}
+
+// Images prepares a VM's kernel and root filesystem, including the guest
+// configuration written into the rootfs before boot.
+type Images interface {
+	EnsureDefaultImages() error
+	CreateVMRootfs(vmName, vmDir string, diskSizeMB int, imageName string) (string, error)
+	VMRootfsPath(vmName, vmDir string) string
+	DeleteVMRootfs(vmName, vmDir string) error
+	// CreateVMOverlay, AttachVMDisk, DetachVMDisk and FlattenVMRootfs
+	// manage the rootfs of a thin VM, a copy-on-write overlay of its base
+	// image that is attached while the VM runs.
+	CreateVMOverlay(vmName, vmDir string, diskSizeMB int, basePath string) (string, error)
+	AttachVMDisk(vmName, vmDir string, diskSizeMB int, basePath string) error
+	DetachVMDisk(vmName, vmDir string) error
+	FlattenVMRootfs(vmName, vmDir string, diskSizeMB int, basePath string) error
+	SnapshotVMRootfs(vmName, vmDir, imageName string) error
+	GetKernelPath(name string) string
+	KernelExists(name string) bool
+	GetInitrdPath(name string) string
+	InitrdExists(name string) bool
+	InjectSSHKey(rootfsPath, authorizedKeys string) error
+	InjectDNSConfig(rootfsPath string, dnsServers, searchDomains []string) error
+	InjectMountFstab(rootfsPath string, mounts []image.MountEntry) error
+	InjectNetworkConfig(rootfsPath string, ifaces []image.NetworkInterface) error
+}
+
+// Mounts builds and removes the ext4 images backing a VM's host directory
+// mounts. It is implemented by mount.Manager.
+type Mounts interface {
+	CreateMountImage(m *vm.Mount, vmName string) error
+	GetMountImagePath(vmName, guestTag string) string
+	DeleteAllMountImages(vmName string, mounts []vm.Mount) error
+}
+
+// Volumes stores the persistent volumes attached to VMs. It is implemented
+// by volume.Manager.
+type Volumes interface {
+	Get(name string) (*volume.Volume, error)
+	ImagePath(name string) string
+	Resize(name string, sizeMB int) (*volume.Volume, error)
+	Delete(name string) error
+}
+
+// Hypervisor runs VM processes.
+type Hypervisor interface {
+	// Start boots a VM and returns the PID of its process.
+	Start(cfg *firecracker.VMConfig) (int, error)
+	// Restore starts a VM from a snapshot and returns the PID of its
+	// process.
+	Restore(cfg *firecracker.RestoreConfig) (int, error)
+	// Terminate stops a VM's process; see firecracker.Client.Terminate.
+	Terminate(v *vm.VM) error
+	// UpdateVMState refreshes a VM's State and PID from the process table.
+	UpdateVMState(v *vm.VM)
+	// UpdateRateLimits applies a running VM's rate limits to its devices.
+	UpdateRateLimits(v *vm.VM) error
+	// SetBalloon resizes a running VM's memory balloon.
+	SetBalloon(v *vm.VM, targetMB int) error
+	// BalloonStats returns a running VM's balloon size and guest memory
+	// statistics.
+	BalloonStats(v *vm.VM) (*vm.BalloonStats, error)
+	// Pause stops a running VM's vCPUs; Resume starts them again.
+	Pause(v *vm.VM) error
+	Resume(v *vm.VM) error
+}
+
+// Snapshots reads a VM's snapshots, restores and copies their disks and
+// removes them. It is implemented by snapshot.Manager.
+type Snapshots interface {
+	Exists(vmName, snapName string) bool
+	Get(vmName, snapName string) (*snapshot.Metadata, error)
+	Dir(vmName, snapName string) string
+	MemoryFile(vmName, snapName string) (string, func(), error)
+	RestoreDisks(v *vm.VM, snapName string) (*snapshot.Metadata, error)
+	CloneDisks(vmName, snapName, rootfsPath string, mountPath func(guestTag string) string) error
+	DeleteAllForVM(vmName string) error
+}
+
+// Guests reaches the agent inside a running VM.
+type Guests interface {
+	// SetNetwork moves the guest's interfaces to the VM's MAC addresses
+	// and the given addresses.
+	SetNetwork(v *vm.VM, ifaces []image.NetworkInterface) error
+	// SyncTime sets the guest's clock to the host's.
+	SyncTime(v *vm.VM) error
+}
+
+// ProgressFunc is called as a lifecycle operation moves through its steps.
+type ProgressFunc func(vmName, step string)
+
+// Manager runs VM lifecycle operations. Each mutating operation holds the VM's
+// file lock (see package lock), so operations on the same VM from different
+// processes fail with a "VM is busy" error instead of interleaving.
+type Manager struct {
+	cfg        *config.Config
+	network    func(d *network.Definition) Network
+	addresses  func(d *network.Definition) Addresses
+	images     Images
+	mounts     Mounts
+	volumes    Volumes
+	hypervisor Hypervisor
+	snapshots  Snapshots
+	guests     Guests
+	progress   ProgressFunc
+}
+
+// NewManager creates a Manager backed by the real host network, images,
+// mounts, Firecracker and snapshot store.
+func NewManager(cfg *config.Config) *Manager {
+	paths := cfg.GetPaths()
+	return &Manager{
+		cfg: cfg,
+		network: func(d *network.Definition) Network {
+			return d.Manager(cfg.HostInterface)
+		},
+		addresses: func(d *network.Definition) Addresses {
+			return d.IPAM(paths.State)
+		},
+		images:     hostImages{image.NewManager(paths.Kernels, paths.Rootfs)},
+		mounts:     mount.NewManager(paths.Mounts),
+		volumes:    volume.NewManager(paths.Volumes),
+		hypervisor: hostHypervisor{firecracker.NewClient()},
+		snapshots:  snapshot.NewManager(paths.Snapshots),
+		guests:     hostGuests{},
+	}
+}
+
+// SetProgress registers a callback for progress reports. A nil fn disables
+// reporting.
+func (m *Manager) SetProgress(fn ProgressFunc) {
+	m.progress = fn
+}
+
+func (m *Manager) report(vmName, step string) {
+	if m.progress != nil {
+		m.progress(vmName, step)
+	}
+}
+
+// Get returns a VM with its State and PID refreshed from the running process.
+func (m *Manager) Get(name string) (*vm.VM, error) {
+	v, err := vm.Load(m.cfg.GetPaths().VMs, name)
+	if err != nil {
+		return nil, notFoundf("VM '%s' not found", name)
+	}
+	m.hypervisor.UpdateVMState(v)
+	return v, nil
+}
+
+// List returns all VMs with their live state.
+func (m *Manager) List() ([]*vm.VM, error) {
+	vms, err := vm.List(m.cfg.GetPaths().VMs)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range vms {
+		m.hypervisor.UpdateVMState(v)
+	}
+	return vms, nil
+}
+
+// lockVM takes the VM's file lock. A lock held elsewhere is reported as
+// ErrConflict.
+func (m *Manager) lockVM(name string) (*lock.Lock, error) {
+	l, err := lock.VM(m.cfg.GetPaths().State, name)
+	if errors.Is(err, lock.ErrBusy) {
+		return nil, &opError{kind: ErrConflict, msg: err.Error()}
+	}
+	return l, err
+}
+
+// Create persists a new VM definition. It fails if a VM with the same name
+// already exists, one of its networks or its base image does not, or another
+// VM already forwards one of its host ports. Interfaces without a TAP
+// device or MAC address are given generated ones, and any interface with an
+// IP address set has that address reserved as a static lease.
+func (m *Manager) Create(v *vm.VM) (*vm.VM, error) {
+	if err := m.cfg.EnsureDirectories(); err != nil {
+		return nil, fmt.Errorf("failed to create directories: %w", err)
+	}
+	l, err := m.lockVM(v.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+	return m.create(v)
+}
+
+func (m *Manager) create(v *vm.VM) (*vm.VM, error) {
+	paths := m.cfg.GetPaths()
+	if vm.Exists(paths.VMs, v.Name) {
+		return nil, conflictf("VM '%s' already exists", v.Name)
+	}
+	var err error
+	if v.PortForwards, err = normalizePortForwards(v.PortForwards); err != nil {
+		return nil, err
+	}
+	if err := m.checkPortForwards(v.Name, v.PortForwards, false); err != nil {
+		return nil, err
+	}
+	if v.RateLimits.Empty() {
+		v.RateLimits = nil
+	} else if err := v.RateLimits.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid rate limits: %w", err)
+	}
+	if err := v.Boot().Validate(); err != nil {
+		return nil, err
+	}
+	nics := v.Interfaces()
+	defs := make([]*network.Definition, len(nics))
+	for i, nic := range nics {
+		if nic.Network == network.DefaultNetwork {
+			nic.Network = ""
+		}
+		d, err := m.nicNetwork(nic)
+		if err != nil {
+			return nil, err
+		}
+		defs[i] = d
+		if nic.TapDevice == "" {
+			nic.TapDevice = network.GenerateNICTapName(v.ID, i)
+		}
+		if nic.MacAddress == "" {
+			nic.MacAddress = v.GenerateNICMacAddress(i)
+		}
+	}
+
+	// Static reservations and base images are shared between VMs, and the
+	// global lock keeps them from being taken or deleted under this one
+	// until it is saved
+	needsGlobal := v.BaseImage != ""
+	for _, nic := range nics {
+		needsGlobal = needsGlobal || nic.IPAddress != ""
+	}
+	if needsGlobal {
+		gl, err := lock.Global(paths.State, globalLockTimeout)
+		if err != nil {
+			return nil, err
+		}
+		defer gl.Unlock()
+	}
+	if v.BaseImage != "" {
+		if _, err := os.Stat(v.BaseImage); err != nil {
+			return nil, notFoundf("base image %s not found", v.BaseImage)
+		}
+	}
+
+	// An IP address on a new VM's interface is a request for a static
+	// reservation
+	var reserved []func()
+	releaseReserved := func() {
+		for _, release := range reserved {
+			release()
+		}
+	}
+	for i, nic := range nics {
+		if nic.IPAddress == "" {
+			continue
+		}
+		addrs, key := m.addresses(defs[i]), network.LeaseKey(v.Name, vm.InterfaceName(i))
+		if err := addrs.Reserve(key, nic.IPAddress, usedIPs(paths.VMs, v, i)); err != nil {
+			releaseReserved()
+			if errors.Is(err, network.ErrAddressInUse) {
+				return nil, &opError{kind: ErrConflict, msg: fmt.Sprintf("failed to reserve IP: %v", err)}
+			}
+			return nil, fmt.Errorf("failed to reserve IP: %w", err)
+		}
+		reserved = append(reserved, func() { addrs.Release(key) })
+	}
+
+	if err := v.Save(paths.VMs); err != nil {
+		releaseReserved()
+		return nil, fmt.Errorf("failed to save VM config: %w", err)
+	}
+	return v, nil
+}
+
+// Stop terminates a running or paused VM and releases its TAP device and port
+// forwards.
+func (m *Manager) Stop(name string) (*vm.VM, error) {
+	l, err := m.lockVM(name)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+	return m.stop(name)
+}
+
+func (m *Manager) stop(name string) (*vm.VM, error) {
+	v, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if !v.State.Active() {
+		return nil, conflictf("VM '%s' is not running (state: %s)", name, v.State)
+	}
+
+	paths := m.cfg.GetPaths()
+	m.wake(v)
+	v.State = vm.StateStopping
+	if err := v.Save(paths.VMs); err != nil {
+		fmt.Printf("Warning: failed to save VM state: %v\n", err)
+	}
+
+	m.report(name, "Stopping Firecracker")
+	if err := m.terminate(v); err != nil {
+		return nil, fmt.Errorf("failed to stop VM '%s': %w", name, err)
+	}
+	m.report(name, "Releasing network")
+	m.releaseNetwork(v)
+	m.detachDisk(v)
+
+	// Terminate already cleared the PID and removed the socket
+	v.State = vm.StateStopped
+	v.LastSnapshot = ""
+	if err := v.Save(paths.VMs); err != nil {
+		return nil, fmt.Errorf("failed to save VM state: %w", err)
+	}
+	return v, nil
+}
+
+// Reap cleans up after VMs whose Firecracker process exited without vmm
+// stopping them, such as when the guest powered itself off: their network
+// is released, a thin disk detached and the VM saved as stopped. It returns
+// the names of the VMs it reaped. VMs another operation holds are left for
+// the next call.
+func (m *Manager) Reap() ([]string, error) {
+	vms, err := vm.List(m.cfg.GetPaths().VMs)
+	if err != nil {
+		return nil, err
+	}
+	var reaped []string
+	for _, v := range vms {
+		if !v.State.Active() {
+			continue
+		}
+		l, err := m.lockVM(v.Name)
+		if errors.Is(err, ErrConflict) {
+			continue
+		}
+		if err != nil {
+			return reaped, err
+		}
+		ok, err := m.reap(v.Name)
+		l.Unlock()
+		if err != nil {
+			return reaped, err
+		}
+		if ok {
+			reaped = append(reaped, v.Name)
+		}
+	}
+	return reaped, nil
+}
+
+// reap releases the host resources of a VM recorded as running whose
+// process is gone and saves it as stopped. It reports whether the VM needed
+// reaping. The caller holds the VM's lock.
+func (m *Manager) reap(name string) (bool, error) {
+	paths := m.cfg.GetPaths()
+	v, err := vm.Load(paths.VMs, name)
+	if err != nil || !v.State.Active() {
+		return false, nil
+	}
+	m.hypervisor.UpdateVMState(v)
+	if v.State.Active() {
+		return false, nil
+	}
+
+	m.report(name, "Firecracker has exited, releasing network")
+	m.releaseNetwork(v)
+	m.detachDisk(v)
+	v.State = vm.StateStopped
+	v.LastSnapshot = ""
+	if err := v.Save(paths.VMs); err != nil {
+		return false, fmt.Errorf("failed to save VM state: %w", err)
+	}
+	return true, nil
+}
+
+// Restart stops a VM if it is running and starts it again.
+func (m *Manager) Restart(name string) (*vm.VM, error) {
+	l, err := m.lockVM(name)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+
+	v, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if v.State.Active() {
+		if _, err := m.stop(name); err != nil {
+			return nil, err
+		}
+	}
+	return m.start(name)
+}
+
+// Delete removes a VM and everything that belongs to it: rootfs, mount images,
+// snapshots and its state file. A running or paused VM is only deleted when
+// force is set.
+func (m *Manager) Delete(name string, force bool) error {
+	l, err := m.lockVM(name)
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+
+	v, err := m.Get(name)
+	if err != nil {
+		return err
+	}
+	paths := m.cfg.GetPaths()
+
+	if v.State.Active() {
+		if !force {
+			return conflictf("VM '%s' is %s. Use --force to delete anyway", name, v.State)
+		}
+		// Never delete the VM's state while its Firecracker process
+		// survives, or the process is orphaned with no record of how to
+		// reach it.
+		m.wake(v)
+		m.report(name, "Stopping Firecracker")
+		if err := m.terminate(v); err != nil {
+			return fmt.Errorf("refusing to delete VM '%s': %w", name, err)
+		}
+	}
+	m.releaseNetwork(v)
+	if err := m.releaseLeases(v); err != nil {
+		fmt.Printf("Warning: failed to release IP leases: %v\n", err)
+	}
+
+	m.report(name, "Removing disks and snapshots")
+	if err := m.images.DeleteVMRootfs(name, paths.VMs); err != nil {
+		fmt.Printf("Warning: failed to delete VM rootfs: %v\n", err)
+	}
+	if len(v.Mounts) > 0 {
+		if err := m.mounts.DeleteAllMountImages(name, v.Mounts); err != nil {
+			fmt.Printf("Warning: failed to delete mount images: %v\n", err)
+		}
+	}
+	if err := m.snapshots.DeleteAllForVM(name); err != nil {
+		fmt.Printf("Warning: failed to delete snapshots: %v\n", err)
+	}
+	os.Remove(v.SocketPath)
+
+	if err := vm.Delete(paths.VMs, name); err != nil {
+		return fmt.Errorf("failed to delete VM: %w", err)
+	}
+	return nil
+}
+
+// detachDisk detaches a thin VM's rootfs once its process has exited.
+func (m *Manager) detachDisk(v *vm.VM) {
+	if v.BaseImage == "" {
+		return
+	}
+	if err := m.images.DetachVMDisk(v.Name, m.cfg.GetPaths().VMs); err != nil {
+		fmt.Printf("Warning: failed to detach rootfs: %v\n", err)
+	}
+}
+
+// wake resumes a paused VM before it is stopped, since a paused guest cannot
+// shut itself down cleanly. If that fails, terminate falls back to signals.
+func (m *Manager) wake(v *vm.VM) {
+	if v.State != vm.StatePaused {
+		return
+	}
+	m.report(v.Name, "Resuming vCPUs")
+	if err := m.hypervisor.Resume(v); err != nil {
+		fmt.Printf("Warning: failed to resume VM before stopping it: %v\n", err)
+	}
+}
+
+// terminate stops the VM's process, recording an error state if the process
+// survives.
+func (m *Manager) terminate(v *vm.VM) error {
+	if err := m.hypervisor.Terminate(v); err != nil {
+		v.State = vm.StateError
+		if saveErr := v.Save(m.cfg.GetPaths().VMs); saveErr != nil {
+			fmt.Printf("Warning: failed to save VM state: %v\n", saveErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// nicNetwork returns the definition of the network an interface is attached
+// to.
+func (m *Manager) nicNetwork(nic *vm.NIC) (*network.Definition, error) {
+	d, err := m.cfg.Networks().Get(nic.Network)
+	if errors.Is(err, network.ErrNetworkNotFound) {
+		return nil, notFoundf("network '%s' not found", nic.Network)
+	}
+	return d, err
+}
+
+// releaseNetwork deletes the VM's TAP devices and removes its port forwards.
+func (m *Manager) releaseNetwork(v *vm.VM) {
+	for i, nic := range v.Interfaces() {
+		d, err := m.nicNetwork(nic)
+		if err != nil {
+			// TAP devices and port forwards do not depend on the bridge,
+			// so the default network's manager can still remove them
+			fmt.Printf("Warning: %v\n", err)
+			d, _ = m.cfg.Networks().Get(network.DefaultNetwork)
+		}
+		hostNet := m.network(d)
+
+		if nic.TapDevice != "" && v.Firewall != nil {
+			if err := hostNet.RemoveFirewall(nic.TapDevice); err != nil {
+				fmt.Printf("Warning: failed to remove firewall: %v\n", err)
+			}
+		}
+		if nic.TapDevice != "" && hostNet.TapExists(nic.TapDevice) {
+			if err := hostNet.DeleteTap(nic.TapDevice); err != nil {
+				fmt.Printf("Warning: failed to delete TAP device: %v\n", err)
+			}
+		}
+		// Port forwards always target the primary interface
+		if i > 0 {
+			continue
+		}
+		for _, pf := range natForwards(v.PortForwards) {
+			for _, guestIP := range nic.Addresses() {
+				if err := hostNet.RemovePortForward(hostPortForward(pf, guestIP)); err != nil {
+					fmt.Printf("Warning: failed to remove port forward %s: %v\n", pf, err)
+				}
+			}
+		}
+	}
+}
+
+// releaseLeases gives up the IP leases of all the VM's interfaces under the
+// global lock.
+func (m *Manager) releaseLeases(v *vm.VM) error {
+	gl, err := lock.Global(m.cfg.GetPaths().State, globalLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer gl.Unlock()
+
+	var errs []error
+	for i, nic := range v.Interfaces() {
+		d, err := m.nicNetwork(nic)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err := m.addresses(d).Release(network.LeaseKey(v.Name, vm.InterfaceName(i))); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// releaseLease gives up the lease held under key under the global lock.
+func (m *Manager) releaseLease(addrs Addresses, key string) error {
+	gl, err := lock.Global(m.cfg.GetPaths().State, globalLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer gl.Unlock()
+	_, err = addrs.Release(key)
+	return err
+}
+
+// usedIPs returns the IPs recorded on the network of self's index'th
+// interface by every other interface: those of other VMs and self's own
+// other interfaces.
+func usedIPs(vmsDir string, self *vm.VM, index int) []string {
+	nics := self.Interfaces()
+	netName := nics[index].Network
+
+	var ips []string
+	vms, _ := vm.List(vmsDir)
+	for _, v := range vms {
+		if v.Name == self.Name {
+			continue
+		}
+		for _, nic := range v.Interfaces() {
+			if nic.Network == netName && nic.IPAddress != "" {
+				ips = append(ips, nic.IPAddress)
+			}
+		}
+	}
+	for i, nic := range nics {
+		if i != index && nic.Network == netName && nic.IPAddress != "" {
+			ips = append(ips, nic.IPAddress)
+		}
+	}
+	return ips
+}
+
+// hostImages adds the rootfs injection helpers to image.Manager.
+type hostImages struct {
+	*image.Manager
+}
+
+func (hostImages) VMRootfsPath(vmName, vmDir string) string {
+	return image.VMRootfsPath(vmName, vmDir)
+}
+
+func (hostImages) InjectSSHKey(rootfsPath, authorizedKeys string) error {
+	return image.InjectSSHKey(rootfsPath, authorizedKeys)
+}
+
+func (hostImages) InjectDNSConfig(rootfsPath string, dnsServers, searchDomains []string) error {
+	return image.InjectDNSConfig(rootfsPath, dnsServers, searchDomains)
+}
+
+func (hostImages) InjectMountFstab(rootfsPath string, mounts []image.MountEntry) error {
+	return image.InjectMountFstab(rootfsPath, mounts)
+}
+
+func (hostImages) InjectNetworkConfig(rootfsPath string, ifaces []image.NetworkInterface) error {
+	return image.InjectNetworkConfig(rootfsPath, ifaces)
+}
+
+// hostHypervisor runs VMs with Firecracker. The Firecracker process must
+// outlive the request that started it, so it is never tied to a request
+// context.
+type hostHypervisor struct {
+	fc *firecracker.Client
+}
+
+func (h hostHypervisor) Start(cfg *firecracker.VMConfig) (int, error) {
+	machine, err := h.fc.StartVM(context.Background(), cfg)
+	if err != nil {
+		return 0, err
+	}
+	return h.fc.GetVMPID(machine), nil
+}
+
+func (h hostHypervisor) Restore(cfg *firecracker.RestoreConfig) (int, error) {
+	machine, err := h.fc.RestoreVM(context.Background(), cfg)
+	if err != nil {
+		return 0, err
+	}
+	return h.fc.GetVMPID(machine), nil
+}
+
+func (h hostHypervisor) Terminate(v *vm.VM) error {
+	return h.fc.Terminate(context.Background(), v)
+}
+
+func (h hostHypervisor) UpdateVMState(v *vm.VM) {
+	h.fc.UpdateVMState(v)
+}
+
+func (h hostHypervisor) UpdateRateLimits(v *vm.VM) error {
+	return h.fc.UpdateRateLimits(context.Background(), v)
+}
+
+func (h hostHypervisor) SetBalloon(v *vm.VM, targetMB int) error {
+	return h.fc.SetBalloon(context.Background(), v.SocketPath, targetMB)
+}
+
+func (h hostHypervisor) BalloonStats(v *vm.VM) (*vm.BalloonStats, error) {
+	return h.fc.BalloonStats(context.Background(), v.SocketPath)
+}
+
+func (h hostHypervisor) Pause(v *vm.VM) error {
+	return h.fc.PauseVM(context.Background(), v.SocketPath)
+}
+
+func (h hostHypervisor) Resume(v *vm.VM) error {
+	return h.fc.ResumeVM(context.Background(), v.SocketPath)
+}
+
+// guestTimeout bounds each request to a guest agent.
+const guestTimeout = 10 * time.Second
+
+// hostGuests talks to vmm-agent over each VM's vsock device.
+type hostGuests struct{}
+
+func (hostGuests) SetNetwork(v *vm.VM, ifaces []image.NetworkInterface) error {
+	client := agent.NewClient(v.VsockPath())
+	ctx, cancel := context.WithTimeout(context.Background(), guestTimeout)
+	defer cancel()
+
+	// Rewrite the networkd configuration first, so the addresses survive a
+	// restart of networkd in the guest
+	for _, iface := range ifaces {
+		path, conf := image.NetworkdFile(iface)
+		if err := client.Push(ctx, strings.NewReader(conf), int64(len(conf)), path, 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	}
+	var stderr bytes.Buffer
+	code, err := client.Exec(ctx, agent.ExecRequest{
+		Command: []string{"sh", "-c", guestNetworkScript(v.Interfaces(), ifaces)},
+	}, nil, &stderr)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("network setup exited with code %d: %s", code, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func (hostGuests) SyncTime(v *vm.VM) error {
+	ctx, cancel := context.WithTimeout(context.Background(), guestTimeout)
+	defer cancel()
+	return agent.NewClient(v.VsockPath()).SyncTime(ctx)
+}
@@ -0,0 +1,2081 @@
+package lifecycle
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/raesene/baremetalvmm/internal/config"
+	"github.com/raesene/baremetalvmm/internal/firecracker"
+	"github.com/raesene/baremetalvmm/internal/image"
+	"github.com/raesene/baremetalvmm/internal/lock"
+	"github.com/raesene/baremetalvmm/internal/network"
+	"github.com/raesene/baremetalvmm/internal/snapshot"
+	"github.com/raesene/baremetalvmm/internal/vm"
+	"github.com/raesene/baremetalvmm/internal/volume"
+)
+
+type fakeNetwork struct {
+	taps        map[string]bool
+	forwards    map[string]bool
+	firewalls   map[string]*network.Firewall
+	failForward int // host port whose AddPortForward fails
+}
+
+func forwardKey(hostPort, guestPort int, guestIP, protocol string) string {
+	return fmt.Sprintf("%s:%d->%s:%d", protocol, hostPort, guestIP, guestPort)
+}
+
+func (n *fakeNetwork) EnsureBridge() error            { return nil }
+func (n *fakeNetwork) TapExists(tapName string) bool  { return n.taps[tapName] }
+func (n *fakeNetwork) CreateTap(tapName string) error { n.taps[tapName] = true; return nil }
+func (n *fakeNetwork) DeleteTap(tapName string) error { delete(n.taps, tapName); return nil }
+
+func (n *fakeNetwork) RenameTap(tapName, newName string) error {
+	if !n.taps[tapName] {
+		return fmt.Errorf("TAP device %s not found", tapName)
+	}
+	delete(n.taps, tapName)
+	n.taps[newName] = true
+	return nil
+}
+
+func (n *fakeNetwork) ApplyFirewall(tapName string, fw *network.Firewall) error {
+	if fw == nil {
+		delete(n.firewalls, tapName)
+		return nil
+	}
+	n.firewalls[tapName] = fw
+	return nil
+}
+
+func (n *fakeNetwork) RemoveFirewall(tapName string) error {
+	delete(n.firewalls, tapName)
+	return nil
+}
+
+func (n *fakeNetwork) AddPortForward(pf network.PortForward) error {
+	if pf.HostPort == n.failForward {
+		return errors.New("port in use")
+	}
+	n.forwards[forwardKey(pf.HostPort, pf.GuestPort, pf.GuestIP, pf.Protocol)] = true
+	return nil
+}
+
+func (n *fakeNetwork) RemovePortForward(pf network.PortForward) error {
+	delete(n.forwards, forwardKey(pf.HostPort, pf.GuestPort, pf.GuestIP, pf.Protocol))
+	return nil
+}
+
+type fakeImages struct {
+	dir           string
+	deleted       []string
+	attached      map[string]bool // thin disks by VM name
+	flattened     []string
+	snapshotted   map[string]bool // whether each snapshotted VM's thin disk was attached
+	injected      []string
+	fstab         []image.MountEntry
+	interfaces    []image.NetworkInterface
+	dnsServers    []string
+	searchDomains []string
+}
+
+func (i *fakeImages) EnsureDefaultImages() error { return nil }
+
+func (i *fakeImages) CreateVMRootfs(vmName, vmDir string, diskSizeMB int, imageName string) (string, error) {
+	return filepath.Join(i.dir, vmName+".ext4"), nil
+}
+
+func (i *fakeImages) VMRootfsPath(vmName, vmDir string) string {
+	return filepath.Join(i.dir, vmName+".ext4")
+}
+
+func (i *fakeImages) DeleteVMRootfs(vmName, vmDir string) error {
+	i.deleted = append(i.deleted, vmName)
+	return nil
+}
+
+func (i *fakeImages) CreateVMOverlay(vmName, vmDir string, diskSizeMB int, basePath string) (string, error) {
+	if err := i.AttachVMDisk(vmName, vmDir, diskSizeMB, basePath); err != nil {
+		return "", err
+	}
+	return filepath.Join(i.dir, vmName+".ext4"), nil
+}
+
+func (i *fakeImages) AttachVMDisk(vmName, vmDir string, diskSizeMB int, basePath string) error {
+	if i.attached == nil {
+		i.attached = map[string]bool{}
+	}
+	i.attached[vmName] = true
+	return nil
+}
+
+func (i *fakeImages) DetachVMDisk(vmName, vmDir string) error {
+	delete(i.attached, vmName)
+	return nil
+}
+
+func (i *fakeImages) FlattenVMRootfs(vmName, vmDir string, diskSizeMB int, basePath string) error {
+	i.flattened = append(i.flattened, vmName)
+	return nil
+}
+
+func (i *fakeImages) SnapshotVMRootfs(vmName, vmDir, imageName string) error {
+	if i.snapshotted == nil {
+		i.snapshotted = map[string]bool{}
+	}
+	i.snapshotted[vmName] = i.attached[vmName]
+	return nil
+}
+
+func (i *fakeImages) GetKernelPath(name string) string { return filepath.Join(i.dir, "vmlinux") }
+
+func (i *fakeImages) KernelExists(name string) bool { return name == "custom-kernel" }
+
+func (i *fakeImages) GetInitrdPath(name string) string {
+	if name == "" {
+		return ""
+	}
+	return filepath.Join(i.dir, name)
+}
+
+func (i *fakeImages) InitrdExists(name string) bool { return name == "debug-initrd" }
+
+func (i *fakeImages) InjectSSHKey(rootfsPath, authorizedKeys string) error {
+	i.injected = append(i.injected, "ssh")
+	return nil
+}
+
+func (i *fakeImages) InjectDNSConfig(rootfsPath string, dnsServers, searchDomains []string) error {
+	i.injected = append(i.injected, "dns")
+	i.dnsServers, i.searchDomains = dnsServers, searchDomains
+	return nil
+}
+
+func (i *fakeImages) InjectMountFstab(rootfsPath string, mounts []image.MountEntry) error {
+	i.injected = append(i.injected, "fstab")
+	i.fstab = mounts
+	return nil
+}
+
+func (i *fakeImages) InjectNetworkConfig(rootfsPath string, ifaces []image.NetworkInterface) error {
+	i.injected = append(i.injected, "network")
+	i.interfaces = ifaces
+	return nil
+}
+
+type fakeMounts struct{}
+
+func (fakeMounts) CreateMountImage(m *vm.Mount, vmName string) error {
+	m.ImagePath = "/mounts/" + vmName + "-" + m.GuestTag + ".ext4"
+	return nil
+}
+
+func (fakeMounts) GetMountImagePath(vmName, guestTag string) string {
+	return "/mounts/" + vmName + "-" + guestTag + ".ext4"
+}
+
+func (fakeMounts) DeleteAllMountImages(vmName string, mounts []vm.Mount) error { return nil }
+
+// fakeVolumes holds volumes by name.
+type fakeVolumes map[string]*volume.Volume
+
+func (f fakeVolumes) Get(name string) (*volume.Volume, error) {
+	v, ok := f[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s'", volume.ErrVolumeNotFound, name)
+	}
+	return v, nil
+}
+
+func (f fakeVolumes) ImagePath(name string) string { return "/volumes/" + name + ".ext4" }
+
+func (f fakeVolumes) Resize(name string, sizeMB int) (*volume.Volume, error) {
+	v, err := f.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	v.SizeMB = sizeMB
+	return v, nil
+}
+
+func (f fakeVolumes) Delete(name string) error {
+	if _, err := f.Get(name); err != nil {
+		return err
+	}
+	delete(f, name)
+	return nil
+}
+
+// fakeHypervisor tracks running VMs by socket path.
+type fakeHypervisor struct {
+	running      map[string]int
+	nextPID      int
+	startErr     error
+	terminateErr error
+	started      []*firecracker.VMConfig
+	restored     []*firecracker.RestoreConfig
+	onRestore    func()                    // stands in for Firecracker binding the vsock socket
+	rateLimits   map[string]*vm.RateLimits // limits applied to running VMs, by name
+	balloons     map[string]int            // balloon sizes of running VMs, by name
+	paused       map[string]bool           // paused VMs, by socket path
+}
+
+func (h *fakeHypervisor) Start(cfg *firecracker.VMConfig) (int, error) {
+	if h.startErr != nil {
+		return 0, h.startErr
+	}
+	h.nextPID++
+	h.running[cfg.SocketPath] = 1000 + h.nextPID
+	h.started = append(h.started, cfg)
+	return h.running[cfg.SocketPath], nil
+}
+
+func (h *fakeHypervisor) Restore(cfg *firecracker.RestoreConfig) (int, error) {
+	if h.startErr != nil {
+		return 0, h.startErr
+	}
+	h.nextPID++
+	h.running[cfg.SocketPath] = 1000 + h.nextPID
+	if cfg.Paused {
+		h.paused[cfg.SocketPath] = true
+	}
+	h.restored = append(h.restored, cfg)
+	if h.onRestore != nil {
+		h.onRestore()
+	}
+	return h.running[cfg.SocketPath], nil
+}
+
+func (h *fakeHypervisor) Terminate(v *vm.VM) error {
+	if h.terminateErr != nil {
+		return h.terminateErr
+	}
+	delete(h.running, v.SocketPath)
+	delete(h.paused, v.SocketPath)
+	v.PID = 0
+	return nil
+}
+
+func (h *fakeHypervisor) UpdateVMState(v *vm.VM) {
+	if pid, ok := h.running[v.SocketPath]; ok {
+		v.PID = pid
+		v.State = vm.StateRunning
+		if h.paused[v.SocketPath] {
+			v.State = vm.StatePaused
+		}
+		return
+	}
+	v.PID = 0
+	if v.State.Active() || v.State == vm.StateStarting || v.State == vm.StateStopping {
+		v.State = vm.StateStopped
+	}
+}
+
+func (h *fakeHypervisor) UpdateRateLimits(v *vm.VM) error {
+	if _, ok := h.running[v.SocketPath]; !ok {
+		return errors.New("VM is not running")
+	}
+	h.rateLimits[v.Name] = v.RateLimits
+	return nil
+}
+
+func (h *fakeHypervisor) SetBalloon(v *vm.VM, targetMB int) error {
+	if _, ok := h.running[v.SocketPath]; !ok {
+		return errors.New("VM is not running")
+	}
+	h.balloons[v.Name] = targetMB
+	return nil
+}
+
+func (h *fakeHypervisor) BalloonStats(v *vm.VM) (*vm.BalloonStats, error) {
+	if _, ok := h.running[v.SocketPath]; !ok {
+		return nil, errors.New("VM is not running")
+	}
+	target := h.balloons[v.Name]
+	return &vm.BalloonStats{TargetMB: target, ActualMB: target}, nil
+}
+
+func (h *fakeHypervisor) Pause(v *vm.VM) error {
+	if _, ok := h.running[v.SocketPath]; !ok {
+		return errors.New("VM is not running")
+	}
+	h.paused[v.SocketPath] = true
+	return nil
+}
+
+func (h *fakeHypervisor) Resume(v *vm.VM) error {
+	if _, ok := h.running[v.SocketPath]; !ok {
+		return errors.New("VM is not running")
+	}
+	delete(h.paused, v.SocketPath)
+	return nil
+}
+
+// fakeSnapshots holds snapshot metadata keyed by "vm/snapshot".
+type fakeSnapshots struct {
+	snaps    map[string]*snapshot.Metadata
+	restored []string // disks restored in place, as "vm/snapshot"
+	cloned   []string // disk copies made, as destination paths
+	deleted  []string
+}
+
+func (s *fakeSnapshots) Exists(vmName, snapName string) bool {
+	return s.snaps[vmName+"/"+snapName] != nil
+}
+
+func (s *fakeSnapshots) Get(vmName, snapName string) (*snapshot.Metadata, error) {
+	if meta := s.snaps[vmName+"/"+snapName]; meta != nil {
+		return meta, nil
+	}
+	return nil, fmt.Errorf("snapshot '%s' not found for VM '%s'", snapName, vmName)
+}
+
+func (s *fakeSnapshots) Dir(vmName, snapName string) string {
+	return "/snapshots/" + vmName + "/" + snapName
+}
+
+func (s *fakeSnapshots) MemoryFile(vmName, snapName string) (string, func(), error) {
+	meta, err := s.Get(vmName, snapName)
+	if err != nil {
+		return "", nil, err
+	}
+	return s.Dir(vmName, snapName) + "/" + meta.MemFile, func() {}, nil
+}
+
+func (s *fakeSnapshots) RestoreDisks(v *vm.VM, snapName string) (*snapshot.Metadata, error) {
+	meta, err := s.Get(v.Name, snapName)
+	if err != nil {
+		return nil, err
+	}
+	s.restored = append(s.restored, v.Name+"/"+snapName)
+	v.RootfsPath = meta.RootfsPath
+	return meta, nil
+}
+
+func (s *fakeSnapshots) CloneDisks(vmName, snapName, rootfsPath string, mountPath func(guestTag string) string) error {
+	meta, err := s.Get(vmName, snapName)
+	if err != nil {
+		return err
+	}
+	s.cloned = append(s.cloned, rootfsPath)
+	if mountPath != nil {
+		for _, mnt := range meta.Mounts {
+			s.cloned = append(s.cloned, mountPath(mnt.GuestTag))
+		}
+	}
+	return nil
+}
+
+func (s *fakeSnapshots) DeleteAllForVM(vmName string) error {
+	s.deleted = append(s.deleted, vmName)
+	return nil
+}
+
+// fakeGuests records the addresses guests were moved to, by VM name.
+type fakeGuests struct {
+	networks map[string][]image.NetworkInterface
+	err      error
+}
+
+func (g *fakeGuests) SetNetwork(v *vm.VM, ifaces []image.NetworkInterface) error {
+	if g.err != nil {
+		return g.err
+	}
+	g.networks[v.Name] = ifaces
+	return nil
+}
+
+func (g *fakeGuests) SyncTime(v *vm.VM) error { return nil }
+
+type testEnv struct {
+	mgr    *Manager
+	net    *fakeNetwork
+	img    *fakeImages
+	hv     *fakeHypervisor
+	snaps  *fakeSnapshots
+	guests *fakeGuests
+	steps  []string
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	cfg := config.DefaultConfig()
+	cfg.DataDir = t.TempDir()
+	if err := cfg.EnsureDirectories(); err != nil {
+		t.Fatalf("EnsureDirectories() error: %v", err)
+	}
+
+	env := &testEnv{
+		net:    &fakeNetwork{taps: map[string]bool{}, forwards: map[string]bool{}, firewalls: map[string]*network.Firewall{}},
+		img:    &fakeImages{dir: t.TempDir()},
+		hv:     &fakeHypervisor{running: map[string]int{}, rateLimits: map[string]*vm.RateLimits{}, balloons: map[string]int{}, paused: map[string]bool{}},
+		snaps:  &fakeSnapshots{snaps: map[string]*snapshot.Metadata{}},
+		guests: &fakeGuests{networks: map[string][]image.NetworkInterface{}},
+	}
+	env.mgr = &Manager{
+		cfg:        cfg,
+		network:    func(*network.Definition) Network { return env.net },
+		addresses:  func(d *network.Definition) Addresses { return d.IPAM(cfg.GetPaths().State) },
+		images:     env.img,
+		mounts:     fakeMounts{},
+		volumes:    fakeVolumes{"db": {Name: "db", SizeMB: 1024, UUID: "1234"}, "logs": {Name: "logs", SizeMB: 1024, UUID: "5678"}},
+		hypervisor: env.hv,
+		snapshots:  env.snaps,
+		guests:     env.guests,
+	}
+	env.mgr.SetProgress(func(vmName, step string) {
+		env.steps = append(env.steps, step)
+	})
+	return env
+}
+
+// createVM saves a VM definition with a TAP device, socket and the given port
+// forwards.
+func (e *testEnv) createVM(t *testing.T, name string, forwards ...vm.PortForward) *vm.VM {
+	t.Helper()
+	v := vm.NewVM(name)
+	v.TapDevice = "tap-" + name
+	v.SocketPath = filepath.Join(e.mgr.cfg.GetPaths().Sockets, name+".sock")
+	v.PortForwards = forwards
+	if _, err := e.mgr.Create(v); err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+	return v
+}
+
+// leaseOf returns the lease held by vmName, or nil if it has none.
+func leaseOf(t *testing.T, ipam *network.IPAM, vmName string) *network.Lease {
+	t.Helper()
+	leases, err := ipam.Leases()
+	if err != nil {
+		t.Fatalf("Leases() error: %v", err)
+	}
+	for i := range leases {
+		if leases[i].VMName == vmName {
+			return &leases[i]
+		}
+	}
+	return nil
+}
+
+func (e *testEnv) load(t *testing.T, name string) *vm.VM {
+	t.Helper()
+	v, err := vm.Load(e.mgr.cfg.GetPaths().VMs, name)
+	if err != nil {
+		t.Fatalf("vm.Load() error: %v", err)
+	}
+	return v
+}
+
+func TestStart(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web", vm.PortForward{HostPort: 8080, GuestPort: 80, Protocol: "tcp"})
+
+	v, err := env.mgr.Start("web")
+	if err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+
+	if v.State != vm.StateRunning || v.PID == 0 {
+		t.Errorf("Start() state = %s, PID = %d; want running with a PID", v.State, v.PID)
+	}
+	if v.IPAddress == "" {
+		t.Error("Start() did not assign an IP address")
+	}
+	if !env.net.taps["tap-web"] {
+		t.Error("Start() did not create the TAP device")
+	}
+	if !env.net.forwards[forwardKey(8080, 80, v.IPAddress, "tcp")] {
+		t.Error("Start() did not add the port forward")
+	}
+	if want := []string{"ssh", "dns", "network"}; !reflect.DeepEqual(env.img.injected, want) {
+		t.Errorf("injected = %v, want %v", env.img.injected, want)
+	}
+
+	saved := env.load(t, "web")
+	if saved.State != vm.StateRunning || saved.IPAddress != v.IPAddress || saved.PID != v.PID {
+		t.Errorf("saved VM = %s/%s/%d, want running/%s/%d", saved.State, saved.IPAddress, saved.PID, v.IPAddress, v.PID)
+	}
+
+	wantSteps := []string{
+		"Preparing root filesystem",
+		"Injecting SSH public key",
+		"Configuring DNS",
+		"Setting up network",
+		"Booting Firecracker",
+	}
+	if !reflect.DeepEqual(env.steps, wantSteps) {
+		t.Errorf("progress = %v, want %v", env.steps, wantSteps)
+	}
+}
+
+func TestStartWithMounts(t *testing.T) {
+	env := newTestEnv(t)
+	v := vm.NewVM("data")
+	v.TapDevice = "tap-data"
+	v.Mounts = []vm.Mount{{HostPath: "/srv/a", GuestTag: "a"}, {HostPath: "/srv/b", GuestTag: "b", ReadOnly: true}}
+	if _, err := env.mgr.Create(v); err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+
+	if _, err := env.mgr.Start("data"); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+
+	drives := env.hv.started[0].MountDrives
+	if len(drives) != 2 || drives[0].Tag != "a" || !drives[1].ReadOnly {
+		t.Errorf("MountDrives = %+v, want a (rw) and b (ro)", drives)
+	}
+	if want := []string{"ssh", "dns", "fstab", "network"}; !reflect.DeepEqual(env.img.injected, want) {
+		t.Errorf("injected = %v, want %v", env.img.injected, want)
+	}
+}
+
+func TestStartRollback(t *testing.T) {
+	tests := []struct {
+		name        string
+		startErr    error
+		failForward int
+	}{
+		{name: "firecracker fails to boot", startErr: errors.New("boot failed")},
+		{name: "second port forward fails", failForward: 8443},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.hv.startErr = tt.startErr
+			env.net.failForward = tt.failForward
+			env.createVM(t, "web",
+				vm.PortForward{HostPort: 8080, GuestPort: 80, Protocol: "tcp"},
+				vm.PortForward{HostPort: 8443, GuestPort: 443, Protocol: "tcp"},
+			)
+
+			if _, err := env.mgr.Start("web"); err == nil {
+				t.Fatal("Start() should fail")
+			}
+
+			if env.net.taps["tap-web"] {
+				t.Error("TAP device was not rolled back")
+			}
+			if len(env.net.forwards) != 0 {
+				t.Errorf("port forwards were not rolled back: %v", env.net.forwards)
+			}
+			saved := env.load(t, "web")
+			if saved.State != vm.StateError || saved.IPAddress != "" {
+				t.Errorf("saved VM = %s/%q, want error state with no IP", saved.State, saved.IPAddress)
+			}
+		})
+	}
+}
+
+func TestStartKeepsIPAcrossRestarts(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web")
+	env.createVM(t, "db")
+
+	first, err := env.mgr.Start("web")
+	if err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	if _, err := env.mgr.Stop("web"); err != nil {
+		t.Fatalf("Stop() error: %v", err)
+	}
+	// Another VM starting while web is stopped must not take its address
+	db, err := env.mgr.Start("db")
+	if err != nil {
+		t.Fatalf("Start(db) error: %v", err)
+	}
+	if db.IPAddress == first.IPAddress {
+		t.Fatalf("db was given web's leased address %s", db.IPAddress)
+	}
+
+	again, err := env.mgr.Start("web")
+	if err != nil {
+		t.Fatalf("second Start() error: %v", err)
+	}
+	if again.IPAddress != first.IPAddress {
+		t.Errorf("IP after restart = %s, want %s", again.IPAddress, first.IPAddress)
+	}
+}
+
+func TestCreateWithStaticIP(t *testing.T) {
+	env := newTestEnv(t)
+	v := vm.NewVM("web")
+	v.TapDevice = "tap-web"
+	v.IPAddress = "172.16.0.50"
+	if _, err := env.mgr.Create(v); err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+
+	clash := vm.NewVM("db")
+	clash.IPAddress = "172.16.0.50"
+	if _, err := env.mgr.Create(clash); !errors.Is(err, ErrConflict) {
+		t.Errorf("Create() with a reserved IP error = %v, want ErrConflict", err)
+	}
+	if vm.Exists(env.mgr.cfg.GetPaths().VMs, "db") {
+		t.Error("Create() saved a VM whose reservation failed")
+	}
+
+	started, err := env.mgr.Start("web")
+	if err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	if started.IPAddress != "172.16.0.50" {
+		t.Errorf("Start() IP = %s, want the reserved 172.16.0.50", started.IPAddress)
+	}
+
+	if err := env.mgr.Delete("web", true); err != nil {
+		t.Fatalf("Delete() error: %v", err)
+	}
+	clash = vm.NewVM("db")
+	clash.IPAddress = "172.16.0.50"
+	if _, err := env.mgr.Create(clash); err != nil {
+		t.Errorf("Create() after the owner was deleted error = %v, want the address to be free", err)
+	}
+}
+
+func TestStartOnNamedNetwork(t *testing.T) {
+	env := newTestEnv(t)
+	lab := &network.Definition{Name: "lab", Bridge: "vmm-lab", Subnet: "10.66.0.0/24", Gateway: "10.66.0.1", Mode: network.ModeIsolated}
+	if err := env.mgr.cfg.Networks().Create(lab); err != nil {
+		t.Fatalf("Networks().Create() error: %v", err)
+	}
+
+	v := vm.NewVM("target")
+	v.TapDevice = "tap-target"
+	v.Network = "lab"
+	if _, err := env.mgr.Create(v); err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+	env.createVM(t, "dev")
+
+	started, err := env.mgr.Start("target")
+	if err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	if started.IPAddress != "10.66.0.2" {
+		t.Errorf("Start() IP = %s, want 10.66.0.2 from the lab subnet", started.IPAddress)
+	}
+	if cfg := env.hv.started[0]; cfg.Gateway != "10.66.0.1" || cfg.Subnet != "10.66.0.0/24" {
+		t.Errorf("Firecracker gateway/subnet = %s/%s, want the lab network's", cfg.Gateway, cfg.Subnet)
+	}
+
+	// Networks allocate independently
+	dev, err := env.mgr.Start("dev")
+	if err != nil {
+		t.Fatalf("Start(dev) error: %v", err)
+	}
+	if dev.IPAddress != "172.16.0.2" {
+		t.Errorf("Start(dev) IP = %s, want 172.16.0.2 from the default subnet", dev.IPAddress)
+	}
+}
+
+func TestStartDualStack(t *testing.T) {
+	env := newTestEnv(t)
+	env.mgr.cfg.Subnet6 = "fd00:db8::/64"
+	env.createVM(t, "web", vm.PortForward{HostPort: 8080, GuestPort: 80, Protocol: "tcp"})
+
+	v, err := env.mgr.Start("web")
+	if err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	if v.IPAddress != "172.16.0.2" || v.IPv6Address != "fd00:db8::ac10:2" {
+		t.Errorf("Start() addresses = %s, %s; want 172.16.0.2, fd00:db8::ac10:2", v.IPAddress, v.IPv6Address)
+	}
+	for _, ip := range []string{v.IPAddress, v.IPv6Address} {
+		if !env.net.forwards[forwardKey(8080, 80, ip, "tcp")] {
+			t.Errorf("Start() did not add the port forward to %s", ip)
+		}
+	}
+	want := image.NetworkInterface{
+		Device:   "eth0",
+		Address:  "172.16.0.2/16",
+		Gateway:  "172.16.0.1",
+		Address6: "fd00:db8::ac10:2/64",
+		Gateway6: "fd00:db8::ac10:1",
+	}
+	if len(env.img.interfaces) != 1 || env.img.interfaces[0] != want {
+		t.Errorf("guest interfaces = %+v, want %+v", env.img.interfaces, want)
+	}
+	if saved := env.load(t, "web"); saved.IPv6Address != v.IPv6Address {
+		t.Errorf("saved IPv6 address = %q, want %q", saved.IPv6Address, v.IPv6Address)
+	}
+
+	if _, err := env.mgr.Stop("web"); err != nil {
+		t.Fatalf("Stop() error: %v", err)
+	}
+	if len(env.net.forwards) != 0 {
+		t.Errorf("port forwards left after Stop: %v", env.net.forwards)
+	}
+}
+
+func TestStartGuestDNS(t *testing.T) {
+	tests := []struct {
+		name        string
+		dnsServers  []string
+		disableDNS  bool
+		upstream    []string
+		wantServers []string
+		wantSearch  []string
+	}{
+		{
+			name:        "built-in server",
+			wantServers: []string{"172.16.0.1", "8.8.8.8", "8.8.4.4"},
+			wantSearch:  []string{"vmm.internal"},
+		},
+		{
+			name:        "configured upstream",
+			upstream:    []string{"10.0.0.53"},
+			wantServers: []string{"172.16.0.1", "10.0.0.53"},
+			wantSearch:  []string{"vmm.internal"},
+		},
+		{
+			name:        "VM's own servers",
+			dnsServers:  []string{"9.9.9.9"},
+			wantServers: []string{"9.9.9.9"},
+		},
+		{
+			name:       "disabled",
+			disableDNS: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.mgr.cfg.DisableDNS = tt.disableDNS
+			env.mgr.cfg.DNSUpstream = tt.upstream
+			v := env.createVM(t, "web")
+			v.DNSServers = tt.dnsServers
+			if err := v.Save(env.mgr.cfg.GetPaths().VMs); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := env.mgr.Start("web"); err != nil {
+				t.Fatalf("Start() error: %v", err)
+			}
+			if !reflect.DeepEqual(env.img.dnsServers, tt.wantServers) {
+				t.Errorf("nameservers = %v, want %v", env.img.dnsServers, tt.wantServers)
+			}
+			if !reflect.DeepEqual(env.img.searchDomains, tt.wantSearch) {
+				t.Errorf("search domains = %v, want %v", env.img.searchDomains, tt.wantSearch)
+			}
+		})
+	}
+}
+
+func TestCreateOnMissingNetwork(t *testing.T) {
+	env := newTestEnv(t)
+
+	v := vm.NewVM("web")
+	v.Network = "nope"
+	if _, err := env.mgr.Create(v); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Create() on a missing network error = %v, want ErrNotFound", err)
+	}
+
+	v = vm.NewVM("web")
+	v.Network = network.DefaultNetwork
+	if _, err := env.mgr.Create(v); err != nil {
+		t.Fatalf("Create() on the default network error: %v", err)
+	}
+	if saved := env.load(t, "web"); saved.Network != "" {
+		t.Errorf("saved network = %q, want the default network stored as empty", saved.Network)
+	}
+}
+
+// createRouter creates a VM on the default network with extra interfaces on
+// the lab network and on the default network again.
+func (e *testEnv) createRouter(t *testing.T) *vm.VM {
+	t.Helper()
+	lab := &network.Definition{Name: "lab", Bridge: "vmm-lab", Subnet: "10.66.0.0/24", Gateway: "10.66.0.1", Mode: network.ModeIsolated}
+	if err := e.mgr.cfg.Networks().Create(lab); err != nil {
+		t.Fatalf("Networks().Create() error: %v", err)
+	}
+	v := vm.NewVM("router")
+	v.NICs = []vm.NIC{{Network: "lab", IPAddress: "10.66.0.254"}, {Network: network.DefaultNetwork}}
+	v.SocketPath = filepath.Join(e.mgr.cfg.GetPaths().Sockets, "router.sock")
+	if _, err := e.mgr.Create(v); err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+	return v
+}
+
+func TestStartWithMultipleNICs(t *testing.T) {
+	env := newTestEnv(t)
+	created := env.createRouter(t)
+	if created.NICs[0].TapDevice != network.GenerateNICTapName(created.ID, 1) || created.NICs[1].MacAddress != created.GenerateNICMacAddress(2) {
+		t.Errorf("Create() NICs = %+v, want generated TAP devices and MACs", created.NICs)
+	}
+	if created.NICs[1].Network != "" {
+		t.Errorf("Create() NIC network = %q, want the default network stored as empty", created.NICs[1].Network)
+	}
+
+	v, err := env.mgr.Start("router")
+	if err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	if v.IPAddress != "172.16.0.2" || v.NICs[0].IPAddress != "10.66.0.254" || v.NICs[1].IPAddress != "172.16.0.3" {
+		t.Errorf("Start() addresses = %s, %s, %s; want 172.16.0.2, the reserved 10.66.0.254 and 172.16.0.3",
+			v.IPAddress, v.NICs[0].IPAddress, v.NICs[1].IPAddress)
+	}
+	for _, nic := range v.Interfaces() {
+		if !env.net.taps[nic.TapDevice] {
+			t.Errorf("Start() did not create TAP device %s", nic.TapDevice)
+		}
+	}
+
+	cfg := env.hv.started[0]
+	if len(cfg.NetworkInterfaces) != 3 || cfg.NetworkInterfaces[1].TapDevice != v.NICs[0].TapDevice {
+		t.Errorf("Firecracker interfaces = %+v, want all three in order", cfg.NetworkInterfaces)
+	}
+	wantIfaces := []image.NetworkInterface{
+		{Device: "eth0", Address: "172.16.0.2/16", Gateway: "172.16.0.1"},
+		{Device: "eth1", Address: "10.66.0.254/24"},
+		{Device: "eth2", Address: "172.16.0.3/16"},
+	}
+	if !reflect.DeepEqual(env.img.interfaces, wantIfaces) {
+		t.Errorf("guest interfaces = %+v, want %+v", env.img.interfaces, wantIfaces)
+	}
+
+	if _, err := env.mgr.Stop("router"); err != nil {
+		t.Fatalf("Stop() error: %v", err)
+	}
+	if len(env.net.taps) != 0 {
+		t.Errorf("Stop() left TAP devices: %v", env.net.taps)
+	}
+
+	// Every interface keeps its address across restarts
+	again, err := env.mgr.Start("router")
+	if err != nil {
+		t.Fatalf("second Start() error: %v", err)
+	}
+	if again.NICs[1].IPAddress != "172.16.0.3" {
+		t.Errorf("eth2 IP after restart = %s, want 172.16.0.3", again.NICs[1].IPAddress)
+	}
+
+	if err := env.mgr.Delete("router", true); err != nil {
+		t.Fatalf("Delete() error: %v", err)
+	}
+	for _, name := range []string{network.DefaultNetwork, "lab"} {
+		d, _ := env.mgr.cfg.Networks().Get(name)
+		leases, err := d.IPAM(env.mgr.cfg.GetPaths().State).Leases()
+		if err != nil || len(leases) != 0 {
+			t.Errorf("%s leases after Delete() = %+v, %v; want none", name, leases, err)
+		}
+	}
+}
+
+func TestStartWithMultipleNICsRollback(t *testing.T) {
+	env := newTestEnv(t)
+	env.hv.startErr = errors.New("boot failed")
+	env.createRouter(t)
+
+	if _, err := env.mgr.Start("router"); err == nil {
+		t.Fatal("Start() should fail")
+	}
+	if len(env.net.taps) != 0 {
+		t.Errorf("TAP devices were not rolled back: %v", env.net.taps)
+	}
+	saved := env.load(t, "router")
+	for _, nic := range saved.Interfaces() {
+		if nic.IPAddress != "" {
+			t.Errorf("saved interface %s kept address %s", nic.TapDevice, nic.IPAddress)
+		}
+	}
+
+	// The static reservation survives; the dynamic leases do not
+	lab, _ := env.mgr.cfg.Networks().Get("lab")
+	if lease := leaseOf(t, lab.IPAM(env.mgr.cfg.GetPaths().State), "router/eth1"); lease == nil || !lease.Static {
+		t.Errorf("lab lease after rollback = %+v, want the static reservation", lease)
+	}
+	def, _ := env.mgr.cfg.Networks().Get(network.DefaultNetwork)
+	if leases, _ := def.IPAM(env.mgr.cfg.GetPaths().State).Leases(); len(leases) != 0 {
+		t.Errorf("default leases after rollback = %+v, want none", leases)
+	}
+}
+
+func TestCreateStaticIPClashOnSecondNIC(t *testing.T) {
+	env := newTestEnv(t)
+	env.createRouter(t)
+
+	v := vm.NewVM("probe")
+	v.IPAddress = "172.16.0.40"
+	v.NICs = []vm.NIC{{Network: "lab", IPAddress: "10.66.0.254"}}
+	if _, err := env.mgr.Create(v); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Create() error = %v, want ErrConflict", err)
+	}
+	// The reservation made for the first interface is undone
+	def, _ := env.mgr.cfg.Networks().Get(network.DefaultNetwork)
+	if lease := leaseOf(t, def.IPAM(env.mgr.cfg.GetPaths().State), "probe"); lease != nil {
+		t.Errorf("lease for the failed VM's first interface = %+v, want none", lease)
+	}
+}
+
+func TestStartRollbackReleasesNewLease(t *testing.T) {
+	env := newTestEnv(t)
+	env.hv.startErr = errors.New("boot failed")
+	env.createVM(t, "web")
+
+	if _, err := env.mgr.Start("web"); err == nil {
+		t.Fatal("Start() should fail")
+	}
+	ipam := network.NewIPAM(env.mgr.cfg.GetPaths().State, network.DefaultNetwork, "172.16.0.0/16", "172.16.0.1", nil)
+	if lease := leaseOf(t, ipam, "web"); lease != nil {
+		t.Errorf("lease after failed first start = %+v, want none", lease)
+	}
+}
+
+func TestStartKeepsExistingTap(t *testing.T) {
+	env := newTestEnv(t)
+	env.hv.startErr = errors.New("boot failed")
+	env.net.taps["tap-web"] = true
+	env.createVM(t, "web")
+
+	if _, err := env.mgr.Start("web"); err == nil {
+		t.Fatal("Start() should fail")
+	}
+	if !env.net.taps["tap-web"] {
+		t.Error("rollback deleted a TAP device it did not create")
+	}
+}
+
+func TestStartAlreadyRunning(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web")
+	if _, err := env.mgr.Start("web"); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+
+	if _, err := env.mgr.Start("web"); !errors.Is(err, ErrConflict) {
+		t.Errorf("second Start() error = %v, want ErrConflict", err)
+	}
+}
+
+func TestStop(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web", vm.PortForward{HostPort: 8080, GuestPort: 80, Protocol: "tcp"})
+	if _, err := env.mgr.Start("web"); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+
+	v, err := env.mgr.Stop("web")
+	if err != nil {
+		t.Fatalf("Stop() error: %v", err)
+	}
+	if v.State != vm.StateStopped || v.PID != 0 {
+		t.Errorf("Stop() state = %s, PID = %d; want stopped with no PID", v.State, v.PID)
+	}
+	if env.net.taps["tap-web"] {
+		t.Error("Stop() did not delete the TAP device")
+	}
+	if len(env.net.forwards) != 0 {
+		t.Errorf("Stop() left port forwards: %v", env.net.forwards)
+	}
+
+	if _, err := env.mgr.Stop("web"); !errors.Is(err, ErrConflict) {
+		t.Errorf("Stop() of stopped VM error = %v, want ErrConflict", err)
+	}
+}
+
+func TestReap(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web", vm.PortForward{HostPort: 8080, GuestPort: 80, Protocol: "tcp"})
+	env.createVM(t, "db")
+	for _, name := range []string{"web", "db"} {
+		if _, err := env.mgr.Start(name); err != nil {
+			t.Fatalf("Start(%s) error: %v", name, err)
+		}
+	}
+
+	// The guest powers off and Firecracker exits without vmm stopping it
+	delete(env.hv.running, env.load(t, "web").SocketPath)
+
+	reaped, err := env.mgr.Reap()
+	if err != nil {
+		t.Fatalf("Reap() error: %v", err)
+	}
+	if !reflect.DeepEqual(reaped, []string{"web"}) {
+		t.Errorf("Reap() = %v, want [web]", reaped)
+	}
+	if saved := env.load(t, "web"); saved.State != vm.StateStopped || saved.PID != 0 {
+		t.Errorf("saved state = %s, PID = %d; want stopped with no PID", saved.State, saved.PID)
+	}
+	if env.net.taps["tap-web"] {
+		t.Error("Reap() did not delete the TAP device")
+	}
+	if len(env.net.forwards) != 0 {
+		t.Errorf("Reap() left port forwards: %v", env.net.forwards)
+	}
+	if !env.net.taps["tap-db"] || env.load(t, "db").State != vm.StateRunning {
+		t.Error("Reap() touched a running VM")
+	}
+	if reaped, err := env.mgr.Reap(); err != nil || len(reaped) != 0 {
+		t.Errorf("second Reap() = %v, %v; want nothing to reap", reaped, err)
+	}
+
+	// Starting a VM that exited before it was reaped releases what it held
+	// first
+	delete(env.hv.running, env.load(t, "db").SocketPath)
+	env.steps = nil
+	if _, err := env.mgr.Start("db"); err != nil {
+		t.Fatalf("Start() of exited VM error: %v", err)
+	}
+	if len(env.steps) == 0 || env.steps[0] != "Firecracker has exited, releasing network" {
+		t.Errorf("Start() of exited VM progress = %v, want it reaped first", env.steps)
+	}
+	if v := env.load(t, "db"); v.State != vm.StateRunning {
+		t.Errorf("state after restart = %s, want running", v.State)
+	}
+}
+
+func TestStopTerminateFailure(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web")
+	if _, err := env.mgr.Start("web"); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	env.hv.terminateErr = errors.New("still running after SIGKILL")
+
+	if _, err := env.mgr.Stop("web"); err == nil {
+		t.Fatal("Stop() should fail when the process survives")
+	}
+	if !env.net.taps["tap-web"] {
+		t.Error("Stop() released the TAP device of a surviving VM")
+	}
+	if saved := env.load(t, "web"); saved.State != vm.StateError {
+		t.Errorf("saved state = %s, want %s", saved.State, vm.StateError)
+	}
+}
+
+func TestThinDisk(t *testing.T) {
+	env := newTestEnv(t)
+	v := vm.NewVM("web")
+	v.TapDevice = "tap-web"
+	v.BaseImage = filepath.Join(t.TempDir(), "base.ext4")
+	if _, err := env.mgr.Create(v); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Create() with a missing base image error = %v, want ErrNotFound", err)
+	}
+	if err := os.WriteFile(v.BaseImage, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.mgr.Create(v); err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+
+	if _, err := env.mgr.Start("web"); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	if !env.img.attached["web"] {
+		t.Error("Start() did not attach the thin disk")
+	}
+	if _, err := env.mgr.Flatten("web"); !errors.Is(err, ErrConflict) {
+		t.Errorf("Flatten() of running VM error = %v, want ErrConflict", err)
+	}
+	if _, err := env.mgr.Stop("web"); err != nil {
+		t.Fatalf("Stop() error: %v", err)
+	}
+	if env.img.attached["web"] {
+		t.Error("Stop() did not detach the thin disk")
+	}
+
+	// A failed start leaves the disk detached
+	env.hv.startErr = errors.New("boot failed")
+	if _, err := env.mgr.Start("web"); err == nil {
+		t.Fatal("Start() should fail")
+	}
+	if env.img.attached["web"] {
+		t.Error("failed Start() left the thin disk attached")
+	}
+	env.hv.startErr = nil
+
+	// Snapshotting a running VM is refused, a stopped thin VM has its disk
+	// attached for the copy only
+	if _, err := env.mgr.Start("web"); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	if err := env.mgr.SnapshotImage("web", "web-image"); !errors.Is(err, ErrConflict) {
+		t.Errorf("SnapshotImage() of running VM error = %v, want ErrConflict", err)
+	}
+	if _, err := env.mgr.Stop("web"); err != nil {
+		t.Fatalf("Stop() error: %v", err)
+	}
+	if err := env.mgr.SnapshotImage("web", "web-image"); err != nil {
+		t.Fatalf("SnapshotImage() error: %v", err)
+	}
+	if attached, ok := env.img.snapshotted["web"]; !ok || !attached {
+		t.Errorf("SnapshotImage() snapshotted = %v, want web with its disk attached", env.img.snapshotted)
+	}
+	if env.img.attached["web"] {
+		t.Error("SnapshotImage() left the thin disk attached")
+	}
+
+	v, err := env.mgr.Flatten("web")
+	if err != nil {
+		t.Fatalf("Flatten() error: %v", err)
+	}
+	if v.BaseImage != "" || env.load(t, "web").BaseImage != "" {
+		t.Error("Flatten() did not detach the VM from its base image")
+	}
+	if !reflect.DeepEqual(env.img.flattened, []string{"web"}) {
+		t.Errorf("flattened = %v, want [web]", env.img.flattened)
+	}
+	if _, err := env.mgr.Flatten("web"); !errors.Is(err, ErrConflict) {
+		t.Errorf("Flatten() of flattened VM error = %v, want ErrConflict", err)
+	}
+
+	// With its own rootfs the VM starts without attaching anything
+	if _, err := env.mgr.Start("web"); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	if env.img.attached["web"] {
+		t.Error("Start() attached a disk for a flattened VM")
+	}
+}
+
+func TestVolumes(t *testing.T) {
+	env := newTestEnv(t)
+	for _, name := range []string{"web", "api"} {
+		v := vm.NewVM(name)
+		v.TapDevice = "tap-" + name
+		v.Mounts = []vm.Mount{{HostPath: "/srv/a", GuestTag: "a"}}
+		if _, err := env.mgr.Create(v); err != nil {
+			t.Fatalf("Create() error: %v", err)
+		}
+	}
+
+	if _, err := env.mgr.AttachVolume("web", vm.VolumeAttachment{Name: "db"}); err != nil {
+		t.Fatalf("AttachVolume() error: %v", err)
+	}
+	if _, err := env.mgr.AttachVolume("web", vm.VolumeAttachment{Name: "logs", MountPath: "/var/log/app", ReadOnly: true}); err != nil {
+		t.Fatalf("AttachVolume() error: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		vm   string
+		att  vm.VolumeAttachment
+		want error
+	}{
+		{"missing volume", "web", vm.VolumeAttachment{Name: "gone"}, ErrNotFound},
+		{"missing VM", "gone", vm.VolumeAttachment{Name: "db"}, ErrNotFound},
+		{"attached elsewhere", "api", vm.VolumeAttachment{Name: "db"}, ErrConflict},
+		{"mount path of a mount", "api", vm.VolumeAttachment{Name: "logs", MountPath: "/mnt/a"}, ErrConflict},
+		{"mount path taken", "web", vm.VolumeAttachment{Name: "logs", MountPath: "/mnt/db"}, ErrConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := env.mgr.AttachVolume(tt.vm, tt.att); !errors.Is(err, tt.want) {
+				t.Errorf("AttachVolume() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+	if _, err := env.mgr.AttachVolume("web", vm.VolumeAttachment{Name: "db", MountPath: "relative"}); err == nil {
+		t.Error("AttachVolume() accepted a relative mount path")
+	}
+
+	// Volume drives follow the mount drives and are mounted by UUID
+	if _, err := env.mgr.Start("web"); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	drives := env.hv.started[0].MountDrives
+	wantDrives := []firecracker.MountDrive{
+		{ImagePath: "/mounts/web-a.ext4", Tag: "a"},
+		{ImagePath: "/volumes/db.ext4", Tag: "db"},
+		{ImagePath: "/volumes/logs.ext4", Tag: "logs", ReadOnly: true},
+	}
+	if !reflect.DeepEqual(drives, wantDrives) {
+		t.Errorf("MountDrives = %+v, want %+v", drives, wantDrives)
+	}
+	wantFstab := []image.MountEntry{
+		{Device: "/dev/vdb", MountPath: "/mnt/a"},
+		{Device: "UUID=1234", MountPath: "/mnt/db"},
+		{Device: "UUID=5678", MountPath: "/var/log/app", ReadOnly: true},
+	}
+	if !reflect.DeepEqual(env.img.fstab, wantFstab) {
+		t.Errorf("fstab = %+v, want %+v", env.img.fstab, wantFstab)
+	}
+
+	if _, err := env.mgr.DetachVolume("web", "db"); !errors.Is(err, ErrConflict) {
+		t.Errorf("DetachVolume() of running VM error = %v, want ErrConflict", err)
+	}
+	if _, err := env.mgr.ResizeVolume("db", 2048); !errors.Is(err, ErrConflict) {
+		t.Errorf("ResizeVolume() of a running VM's volume error = %v, want ErrConflict", err)
+	}
+	if err := env.mgr.DeleteVolume("db"); !errors.Is(err, ErrConflict) {
+		t.Errorf("DeleteVolume() of attached volume error = %v, want ErrConflict", err)
+	}
+	if _, err := env.mgr.Stop("web"); err != nil {
+		t.Fatalf("Stop() error: %v", err)
+	}
+	if _, err := env.mgr.DetachVolume("web", "db"); err != nil {
+		t.Fatalf("DetachVolume() error: %v", err)
+	}
+	if _, err := env.mgr.DetachVolume("web", "db"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DetachVolume() of detached volume error = %v, want ErrNotFound", err)
+	}
+	if saved := env.load(t, "web"); len(saved.Volumes) != 1 || saved.Volumes[0].Name != "logs" {
+		t.Errorf("saved volumes = %+v, want [logs]", saved.Volumes)
+	}
+
+	if vol, err := env.mgr.ResizeVolume("logs", 2048); err != nil || vol.SizeMB != 2048 {
+		t.Errorf("ResizeVolume() of a stopped VM's volume = %+v, %v", vol, err)
+	}
+	if _, err := env.mgr.ResizeVolume("logs", 1024); !errors.Is(err, ErrConflict) {
+		t.Errorf("ResizeVolume() shrinking error = %v, want ErrConflict", err)
+	}
+
+	// The volume is free for another VM once detached
+	if _, err := env.mgr.AttachVolume("api", vm.VolumeAttachment{Name: "db"}); err != nil {
+		t.Errorf("AttachVolume() of detached volume error: %v", err)
+	}
+
+	// Deleting the VM keeps its volumes; once free they can be deleted
+	if err := env.mgr.Delete("api", false); err != nil {
+		t.Fatalf("Delete() error: %v", err)
+	}
+	if err := env.mgr.DeleteVolume("db"); err != nil {
+		t.Errorf("DeleteVolume() error: %v", err)
+	}
+	if err := env.mgr.DeleteVolume("db"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DeleteVolume() of deleted volume error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web")
+	first, err := env.mgr.Start("web")
+	if err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+
+	second, err := env.mgr.Restart("web")
+	if err != nil {
+		t.Fatalf("Restart() error: %v", err)
+	}
+	if second.State != vm.StateRunning || second.PID == first.PID {
+		t.Errorf("Restart() state = %s, PID = %d; want running with a new PID (was %d)", second.State, second.PID, first.PID)
+	}
+	if len(env.hv.started) != 2 {
+		t.Errorf("Firecracker started %d times, want 2", len(env.hv.started))
+	}
+}
+
+func TestRestartStoppedVM(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web")
+
+	v, err := env.mgr.Restart("web")
+	if err != nil {
+		t.Fatalf("Restart() error: %v", err)
+	}
+	if v.State != vm.StateRunning {
+		t.Errorf("Restart() state = %s, want running", v.State)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web")
+	if _, err := env.mgr.Start("web"); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+
+	if err := env.mgr.Delete("web", false); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Delete() of running VM without force error = %v, want ErrConflict", err)
+	}
+
+	if err := env.mgr.Delete("web", true); err != nil {
+		t.Fatalf("Delete(force) error: %v", err)
+	}
+	if _, err := env.mgr.Get("web"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() after Delete error = %v, want ErrNotFound", err)
+	}
+	if len(env.hv.running) != 0 {
+		t.Error("Delete(force) left the VM running")
+	}
+	if !reflect.DeepEqual(env.img.deleted, []string{"web"}) || !reflect.DeepEqual(env.snaps.deleted, []string{"web"}) {
+		t.Errorf("deleted rootfs %v and snapshots %v, want [web] for both", env.img.deleted, env.snaps.deleted)
+	}
+}
+
+func TestDeleteKeepsSurvivingVM(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web")
+	if _, err := env.mgr.Start("web"); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	env.hv.terminateErr = errors.New("still running after SIGKILL")
+
+	if err := env.mgr.Delete("web", true); err == nil {
+		t.Fatal("Delete() should fail when the process survives")
+	}
+	if saved := env.load(t, "web"); saved.State != vm.StateError {
+		t.Errorf("saved state = %s, want %s", saved.State, vm.StateError)
+	}
+	if len(env.img.deleted) != 0 {
+		t.Error("Delete() removed the rootfs of a surviving VM")
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	env := newTestEnv(t)
+
+	ops := map[string]func() error{
+		"Get":     func() error { _, err := env.mgr.Get("missing"); return err },
+		"Start":   func() error { _, err := env.mgr.Start("missing"); return err },
+		"Stop":    func() error { _, err := env.mgr.Stop("missing"); return err },
+		"Restart": func() error { _, err := env.mgr.Restart("missing"); return err },
+		"Delete":  func() error { return env.mgr.Delete("missing", true) },
+		"SetFirewall": func() error {
+			_, err := env.mgr.SetFirewall("missing", nil)
+			return err
+		},
+	}
+	for name, op := range ops {
+		if err := op(); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s() error = %v, want ErrNotFound", name, err)
+		}
+	}
+}
+
+func TestBusyVM(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web")
+
+	l, err := lock.VM(env.mgr.cfg.GetPaths().State, "web")
+	if err != nil {
+		t.Fatalf("lock.VM() error: %v", err)
+	}
+	defer l.Unlock()
+
+	_, err = env.mgr.Start("web")
+	if !errors.Is(err, ErrConflict) || !strings.Contains(err.Error(), "is busy") {
+		t.Errorf("Start() of locked VM error = %v, want a busy ErrConflict", err)
+	}
+	if len(env.hv.started) != 0 {
+		t.Error("Start() booted a VM whose lock is held elsewhere")
+	}
+}
+
+func sshOnlyFirewall() *vm.Firewall {
+	return &vm.Firewall{
+		DefaultIngress: vm.FirewallDeny,
+		Rules: []vm.FirewallRule{
+			{Direction: vm.FirewallIngress, Action: vm.FirewallAllow, Protocol: "tcp", Port: 22, CIDR: "10.0.0.0/8"},
+			{Direction: vm.FirewallEgress, Action: vm.FirewallDeny, CIDR: "172.16.0.0/16"},
+		},
+	}
+}
+
+func TestStartAppliesFirewall(t *testing.T) {
+	env := newTestEnv(t)
+	v := vm.NewVM("web")
+	v.TapDevice = "tap-web"
+	v.Firewall = sshOnlyFirewall()
+	if _, err := env.mgr.Create(v); err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+
+	if _, err := env.mgr.Start("web"); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	want := &network.Firewall{
+		Ingress:       []network.FirewallRule{{Protocol: "tcp", Port: 22, CIDR: "10.0.0.0/8", Verdict: network.VerdictAccept}},
+		Egress:        []network.FirewallRule{{CIDR: "172.16.0.0/16", Verdict: network.VerdictDrop}},
+		IngressPolicy: network.VerdictDrop,
+		EgressPolicy:  network.VerdictAccept,
+	}
+	if got := env.net.firewalls["tap-web"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("firewall = %+v, want %+v", got, want)
+	}
+
+	if _, err := env.mgr.Stop("web"); err != nil {
+		t.Fatalf("Stop() error: %v", err)
+	}
+	if fw, ok := env.net.firewalls["tap-web"]; ok {
+		t.Errorf("Stop() left the firewall in place: %+v", fw)
+	}
+}
+
+func TestStartRollbackRemovesFirewall(t *testing.T) {
+	env := newTestEnv(t)
+	env.hv.startErr = errors.New("boot failed")
+	v := vm.NewVM("web")
+	v.TapDevice = "tap-web"
+	v.Firewall = sshOnlyFirewall()
+	if _, err := env.mgr.Create(v); err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+
+	if _, err := env.mgr.Start("web"); err == nil {
+		t.Fatal("Start() should fail")
+	}
+	if len(env.net.firewalls) != 0 {
+		t.Errorf("firewall was not rolled back: %v", env.net.firewalls)
+	}
+}
+
+func TestSetFirewall(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web")
+
+	// A stopped VM only records the policy
+	if _, err := env.mgr.SetFirewall("web", sshOnlyFirewall()); err != nil {
+		t.Fatalf("SetFirewall() error: %v", err)
+	}
+	if len(env.net.firewalls) != 0 {
+		t.Errorf("SetFirewall() on a stopped VM installed a firewall: %v", env.net.firewalls)
+	}
+	if saved := env.load(t, "web"); !reflect.DeepEqual(saved.Firewall, sshOnlyFirewall()) {
+		t.Errorf("saved firewall = %+v, want %+v", saved.Firewall, sshOnlyFirewall())
+	}
+
+	if _, err := env.mgr.Start("web"); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+
+	// A running VM gets the new policy straight away
+	open := &vm.Firewall{Rules: []vm.FirewallRule{{Direction: vm.FirewallEgress, Action: vm.FirewallDeny, Protocol: "udp", Port: 53}}}
+	if _, err := env.mgr.SetFirewall("web", open); err != nil {
+		t.Fatalf("SetFirewall() error: %v", err)
+	}
+	fw := env.net.firewalls["tap-web"]
+	if fw == nil || fw.IngressPolicy != network.VerdictAccept || len(fw.Egress) != 1 || len(fw.Ingress) != 0 {
+		t.Errorf("firewall after update = %+v, want a single egress rule that accepts by default", fw)
+	}
+
+	// A policy that allows everything removes the firewall
+	if _, err := env.mgr.SetFirewall("web", &vm.Firewall{DefaultIngress: vm.FirewallAllow}); err != nil {
+		t.Fatalf("SetFirewall() error: %v", err)
+	}
+	if len(env.net.firewalls) != 0 {
+		t.Errorf("firewall left after clearing the policy: %v", env.net.firewalls)
+	}
+	if saved := env.load(t, "web"); saved.Firewall != nil {
+		t.Errorf("saved firewall = %+v, want none", saved.Firewall)
+	}
+}
+
+func TestFirewallRules(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web")
+	if _, err := env.mgr.Start("web"); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+
+	ssh := vm.FirewallRule{Direction: vm.FirewallIngress, Action: vm.FirewallAllow, Protocol: "tcp", Port: 22}
+	dns := vm.FirewallRule{Direction: vm.FirewallEgress, Action: vm.FirewallAllow, Protocol: "udp", Port: 53}
+	if _, err := env.mgr.AddFirewallRule("web", ssh, 0); err != nil {
+		t.Fatalf("AddFirewallRule() error: %v", err)
+	}
+	if _, err := env.mgr.AddFirewallRule("web", dns, 1); err != nil {
+		t.Fatalf("AddFirewallRule() at position 1 error: %v", err)
+	}
+	if _, err := env.mgr.AddFirewallRule("web", ssh, 4); !errors.Is(err, ErrConflict) {
+		t.Errorf("AddFirewallRule() past the end error = %v, want ErrConflict", err)
+	}
+	if _, err := env.mgr.SetFirewallDefaults("web", vm.FirewallDeny, ""); err != nil {
+		t.Fatalf("SetFirewallDefaults() error: %v", err)
+	}
+	want := &vm.Firewall{DefaultIngress: vm.FirewallDeny, Rules: []vm.FirewallRule{dns, ssh}}
+	if got := env.load(t, "web").Firewall; !reflect.DeepEqual(got, want) {
+		t.Errorf("saved firewall = %+v, want %+v", got, want)
+	}
+	if fw := env.net.firewalls["tap-web"]; fw == nil || fw.IngressPolicy != network.VerdictDrop || len(fw.Ingress) != 1 || len(fw.Egress) != 1 {
+		t.Errorf("applied firewall = %+v, want the saved policy", fw)
+	}
+
+	if _, err := env.mgr.RemoveFirewallRule("web", 3); !errors.Is(err, ErrNotFound) {
+		t.Errorf("RemoveFirewallRule() of a missing rule error = %v, want ErrNotFound", err)
+	}
+	if _, err := env.mgr.RemoveFirewallRule("web", 1); err != nil {
+		t.Fatalf("RemoveFirewallRule() error: %v", err)
+	}
+	want.Rules = []vm.FirewallRule{ssh}
+	if got := env.load(t, "web").Firewall; !reflect.DeepEqual(got, want) {
+		t.Errorf("saved firewall after removal = %+v, want %+v", got, want)
+	}
+}
+
+func TestSetFirewallInvalid(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web")
+
+	fw := &vm.Firewall{Rules: []vm.FirewallRule{{Direction: vm.FirewallIngress, Action: vm.FirewallAllow, Port: 22}}}
+	if _, err := env.mgr.SetFirewall("web", fw); err == nil {
+		t.Fatal("SetFirewall() with a port but no protocol should fail")
+	}
+	if saved := env.load(t, "web"); saved.Firewall != nil {
+		t.Errorf("invalid firewall was saved: %+v", saved.Firewall)
+	}
+}
+
+func TestSetRateLimits(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web")
+
+	// A stopped VM only records the limits, which are passed to Firecracker
+	// at boot
+	limits := &vm.RateLimits{Disk: vm.RateLimit{BandwidthMiB: 100}}
+	if _, err := env.mgr.SetRateLimits("web", limits); err != nil {
+		t.Fatalf("SetRateLimits() error: %v", err)
+	}
+	if len(env.hv.rateLimits) != 0 {
+		t.Errorf("SetRateLimits() on a stopped VM updated Firecracker: %v", env.hv.rateLimits)
+	}
+	if _, err := env.mgr.Start("web"); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	if got := env.hv.started[0].RateLimits; !reflect.DeepEqual(got, limits) {
+		t.Errorf("boot rate limits = %+v, want %+v", got, limits)
+	}
+
+	// A running VM gets the new limits straight away
+	limits = &vm.RateLimits{Net: vm.RateLimit{Ops: 5000}}
+	if _, err := env.mgr.SetRateLimits("web", limits); err != nil {
+		t.Fatalf("SetRateLimits() error: %v", err)
+	}
+	if got := env.hv.rateLimits["web"]; !reflect.DeepEqual(got, limits) {
+		t.Errorf("applied rate limits = %+v, want %+v", got, limits)
+	}
+
+	// Limits that leave everything unlimited are removed
+	if _, err := env.mgr.SetRateLimits("web", &vm.RateLimits{}); err != nil {
+		t.Fatalf("SetRateLimits() error: %v", err)
+	}
+	if got, ok := env.hv.rateLimits["web"]; !ok || got != nil {
+		t.Errorf("applied rate limits after clearing = %+v, want none", got)
+	}
+	if saved := env.load(t, "web"); saved.RateLimits != nil {
+		t.Errorf("saved rate limits = %+v, want none", saved.RateLimits)
+	}
+
+	if _, err := env.mgr.SetRateLimits("web", &vm.RateLimits{Net: vm.RateLimit{BandwidthMiB: -1}}); err == nil {
+		t.Error("SetRateLimits() with a negative limit should fail")
+	}
+}
+
+func TestBalloon(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web")
+
+	if _, err := env.mgr.BalloonStats("web"); !errors.Is(err, ErrConflict) {
+		t.Errorf("BalloonStats() of a stopped VM error = %v, want ErrConflict", err)
+	}
+
+	// A stopped VM's balloon is inflated at boot
+	if _, err := env.mgr.SetBalloon("web", 128); err != nil {
+		t.Fatalf("SetBalloon() error: %v", err)
+	}
+	if _, err := env.mgr.Start("web"); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	if got := env.hv.started[0].BalloonMB; got != 128 {
+		t.Errorf("boot balloon = %d MB, want 128", got)
+	}
+
+	// A running VM's balloon is resized straight away
+	if _, err := env.mgr.SetBalloon("web", 256); err != nil {
+		t.Fatalf("SetBalloon() error: %v", err)
+	}
+	if got := env.hv.balloons["web"]; got != 256 {
+		t.Errorf("applied balloon = %d MB, want 256", got)
+	}
+	if saved := env.load(t, "web"); saved.BalloonMB != 256 {
+		t.Errorf("saved balloon = %d MB, want 256", saved.BalloonMB)
+	}
+
+	// Resizing is not recorded
+	if err := env.mgr.ResizeBalloon("web", 384); err != nil {
+		t.Fatalf("ResizeBalloon() error: %v", err)
+	}
+	st, err := env.mgr.BalloonStats("web")
+	if err != nil {
+		t.Fatalf("BalloonStats() error: %v", err)
+	}
+	if st.TargetMB != 384 {
+		t.Errorf("balloon target = %d MB, want 384", st.TargetMB)
+	}
+	if saved := env.load(t, "web"); saved.BalloonMB != 256 {
+		t.Errorf("saved balloon after ResizeBalloon() = %d MB, want 256", saved.BalloonMB)
+	}
+
+	if _, err := env.mgr.SetBalloon("web", 512); err == nil {
+		t.Error("SetBalloon() of all the VM's memory should fail")
+	}
+}
+
+func TestSetBoot(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web")
+
+	boot := vm.Boot{Kernel: "custom-kernel", KernelArgs: "quiet loglevel=3", Initrd: "debug-initrd"}
+	if _, err := env.mgr.SetBoot("web", boot); err != nil {
+		t.Fatalf("SetBoot() error: %v", err)
+	}
+	if saved := env.load(t, "web"); saved.Boot() != boot {
+		t.Errorf("saved boot settings = %+v, want %+v", saved.Boot(), boot)
+	}
+	if _, err := env.mgr.Start("web"); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	started := env.hv.started[0]
+	if started.KernelArgs != boot.KernelArgs || started.InitrdPath != filepath.Join(env.img.dir, "debug-initrd") {
+		t.Errorf("booted with args %q and initrd %q", started.KernelArgs, started.InitrdPath)
+	}
+
+	if _, err := env.mgr.SetBoot("web", vm.Boot{Kernel: "custom-kernel"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("SetBoot() of a running VM error = %v, want ErrConflict", err)
+	}
+	if _, err := env.mgr.SetBoot("web", vm.Boot{Kernel: "custom-kernel", Initrd: "missing"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetBoot() with a missing initrd error = %v, want ErrNotFound", err)
+	}
+	if _, err := env.mgr.SetBoot("web", vm.Boot{Kernel: "custom-kernel", KernelArgs: "bad\nargs"}); err == nil {
+		t.Error("SetBoot() with a control character in the arguments should fail")
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web")
+
+	if _, err := env.mgr.Pause("web"); !errors.Is(err, ErrConflict) {
+		t.Errorf("Pause() of a stopped VM error = %v, want ErrConflict", err)
+	}
+	if _, err := env.mgr.Start("web"); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+
+	v, err := env.mgr.Pause("web")
+	if err != nil {
+		t.Fatalf("Pause() error: %v", err)
+	}
+	if v.State != vm.StatePaused {
+		t.Errorf("state after Pause() = %s, want paused", v.State)
+	}
+	// A paused VM keeps its TAP device and cannot be started again
+	if !env.net.taps[v.TapDevice] {
+		t.Errorf("TAP device %s released by Pause()", v.TapDevice)
+	}
+	if _, err := env.mgr.Start("web"); !errors.Is(err, ErrConflict) {
+		t.Errorf("Start() of a paused VM error = %v, want ErrConflict", err)
+	}
+	if _, err := env.mgr.Pause("web"); !errors.Is(err, ErrConflict) {
+		t.Errorf("Pause() of a paused VM error = %v, want ErrConflict", err)
+	}
+
+	if v, err = env.mgr.Resume("web"); err != nil {
+		t.Fatalf("Resume() error: %v", err)
+	}
+	if got, _ := env.mgr.Get("web"); got.State != vm.StateRunning {
+		t.Errorf("state after Resume() = %s, want running", got.State)
+	}
+	if _, err := env.mgr.Resume("web"); !errors.Is(err, ErrConflict) {
+		t.Errorf("Resume() of a running VM error = %v, want ErrConflict", err)
+	}
+
+	// A paused VM can be stopped
+	if _, err := env.mgr.Pause("web"); err != nil {
+		t.Fatalf("Pause() error: %v", err)
+	}
+	if v, err = env.mgr.Stop("web"); err != nil {
+		t.Fatalf("Stop() of a paused VM error: %v", err)
+	}
+	if v.State != vm.StateStopped || env.net.taps[v.TapDevice] {
+		t.Errorf("after Stop() state = %s, TAP kept = %v", v.State, env.net.taps[v.TapDevice])
+	}
+}
+
+func TestClone(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "golden", vm.PortForward{HostPort: 8080, GuestPort: 80, Protocol: "tcp"})
+	env.snaps.snaps["golden/warm"] = &snapshot.Metadata{
+		Name: "warm", VMName: "golden", CPUs: 2, MemoryMB: 1024,
+		MemFile: "memory", StateFile: "vmstate", RootfsFile: "rootfs.ext4",
+	}
+	if _, err := env.mgr.Start("golden"); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	src := env.load(t, "golden")
+
+	if _, err := env.mgr.Clone("golden", "missing", "web1", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Clone() of a missing snapshot error = %v, want ErrNotFound", err)
+	}
+	if _, err := env.mgr.Clone("golden", "warm", "golden", false); !errors.Is(err, ErrConflict) {
+		t.Errorf("Clone() onto an existing VM error = %v, want ErrConflict", err)
+	}
+	if _, err := env.mgr.Clone("golden", "warm", "web1", true); !errors.Is(err, ErrConflict) {
+		t.Errorf("warm Clone() of a running VM error = %v, want ErrConflict", err)
+	}
+
+	// A cold clone boots the snapshot's disk with its own identity
+	cold, err := env.mgr.Clone("golden", "warm", "web1", false)
+	if err != nil {
+		t.Fatalf("cold Clone() error: %v", err)
+	}
+	if cold.State != vm.StateRunning || cold.CPUs != 2 || cold.MemoryMB != 1024 {
+		t.Errorf("cold clone = %s with %d CPUs and %d MB, want running with the snapshot's 2 CPUs and 1024 MB", cold.State, cold.CPUs, cold.MemoryMB)
+	}
+	if cold.TapDevice == src.TapDevice || cold.MacAddress == src.MacAddress || cold.IPAddress == src.IPAddress {
+		t.Errorf("cold clone shares its identity with the source: %s/%s/%s", cold.TapDevice, cold.MacAddress, cold.IPAddress)
+	}
+	if len(cold.PortForwards) != 0 {
+		t.Errorf("cold clone copied the source's port forwards: %v", cold.PortForwards)
+	}
+	if want := []string{filepath.Join(env.img.dir, "web1.ext4")}; !reflect.DeepEqual(env.snaps.cloned, want) {
+		t.Errorf("disks copied = %v, want %v", env.snaps.cloned, want)
+	}
+
+	// A warm clone borrows the source's TAP device while the snapshot loads
+	if _, err := env.mgr.Stop("golden"); err != nil {
+		t.Fatalf("Stop() error: %v", err)
+	}
+	env.hv.onRestore = func() {
+		if !env.net.taps[src.TapDevice] {
+			t.Errorf("TAP device %s recorded in the snapshot does not exist while it loads", src.TapDevice)
+		}
+		if err := os.WriteFile(src.VsockPath(), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	warm, err := env.mgr.Clone("golden", "warm", "web2", true)
+	if err != nil {
+		t.Fatalf("warm Clone() error: %v", err)
+	}
+	cfg := env.hv.restored[len(env.hv.restored)-1]
+	if !cfg.Paused || cfg.RootfsPath != filepath.Join(env.img.dir, "web2.ext4") || cfg.MemPath != "/snapshots/golden/warm/memory" {
+		t.Errorf("restored with %+v, want the snapshot's memory, the clone's rootfs and paused", cfg)
+	}
+	if warm.State != vm.StateRunning || env.hv.paused[warm.SocketPath] {
+		t.Errorf("warm clone state = %s, paused = %v; want running", warm.State, env.hv.paused[warm.SocketPath])
+	}
+	if env.net.taps[src.TapDevice] || !env.net.taps[warm.TapDevice] {
+		t.Errorf("TAP devices after warm clone = %v, want %s renamed to %s", env.net.taps, src.TapDevice, warm.TapDevice)
+	}
+	if _, err := os.Stat(warm.VsockPath()); err != nil {
+		t.Errorf("vsock socket not moved to the clone: %v", err)
+	}
+	if got := env.guests.networks["web2"]; len(got) != 1 || !strings.HasPrefix(got[0].Address, warm.IPAddress+"/") {
+		t.Errorf("guest network = %+v, want the clone's address %s", got, warm.IPAddress)
+	}
+
+	// A clone whose guest cannot be reached is removed again
+	env.guests.err = errors.New("agent not responding")
+	if _, err := env.mgr.Clone("golden", "warm", "web3", true); err == nil {
+		t.Fatal("warm Clone() without a guest agent should fail")
+	}
+	if vm.Exists(env.mgr.cfg.GetPaths().VMs, "web3") {
+		t.Error("failed clone was not removed")
+	}
+	if _, ok := env.hv.running[filepath.Join(env.mgr.cfg.GetPaths().Sockets, "web3.sock")]; ok {
+		t.Error("failed clone's Firecracker process was not stopped")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	env := newTestEnv(t)
+	v := vm.NewVM("web")
+	v.TapDevice = "tap-web"
+	v.SocketPath = filepath.Join(env.mgr.cfg.GetPaths().Sockets, "web.sock")
+	v.Firewall = sshOnlyFirewall()
+	v.PortForwards = []vm.PortForward{{HostPort: 8080, GuestPort: 80, Protocol: "tcp"}}
+	if _, err := env.mgr.Create(v); err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+	env.snaps.snaps["web/before"] = &snapshot.Metadata{
+		Name: "before", VMName: "web", CPUs: 2, MemoryMB: 1024,
+		MemFile: "memory", StateFile: "vmstate", RootfsFile: "rootfs.ext4", RootfsPath: "/vms/web.ext4",
+	}
+	env.snaps.snaps["web/disks"] = &snapshot.Metadata{
+		Name: "disks", VMName: "web", CPUs: 1, MemoryMB: 512,
+		RootfsFile: "rootfs.ext4", RootfsPath: "/vms/web.ext4",
+	}
+	if _, err := env.mgr.Start("web"); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+
+	if _, err := env.mgr.Restore("web", "missing", true, true); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Restore() of a missing snapshot error = %v, want ErrNotFound", err)
+	}
+	if _, err := env.mgr.Restore("web", "before", false, true); !errors.Is(err, ErrConflict) {
+		t.Errorf("Restore() of a running VM without force error = %v, want ErrConflict", err)
+	}
+
+	// A forced restore stops the VM and carries on from the snapshot's
+	// memory behind its firewall, with its port forwards
+	restored, err := env.mgr.Restore("web", "before", true, true)
+	if err != nil {
+		t.Fatalf("Restore() error: %v", err)
+	}
+	if restored.State != vm.StateRunning || restored.CPUs != 2 || restored.MemoryMB != 1024 || restored.LastSnapshot != "before" {
+		t.Errorf("restored VM = %s with %d CPUs, %d MB and last snapshot %q; want running with the snapshot's 2 CPUs and 1024 MB", restored.State, restored.CPUs, restored.MemoryMB, restored.LastSnapshot)
+	}
+	cfg := env.hv.restored[len(env.hv.restored)-1]
+	if cfg.MemPath != "/snapshots/web/before/memory" || cfg.StatePath != "/snapshots/web/before/vmstate" || cfg.Paused {
+		t.Errorf("restored with %+v, want the snapshot's memory and state, resumed", cfg)
+	}
+	if !env.net.taps["tap-web"] || env.net.firewalls["tap-web"] == nil {
+		t.Errorf("TAP devices = %v, firewalls = %v; want tap-web with its firewall", env.net.taps, env.net.firewalls)
+	}
+	if want := map[string]bool{forwardKey(8080, 80, restored.IPAddress, "tcp"): true}; !reflect.DeepEqual(env.net.forwards, want) {
+		t.Errorf("port forwards = %v, want %v", env.net.forwards, want)
+	}
+	if got := env.load(t, "web"); got.RootfsPath != "/vms/web.ext4" || got.PID != restored.PID {
+		t.Errorf("saved VM has rootfs %s and PID %d, want /vms/web.ext4 and %d", got.RootfsPath, got.PID, restored.PID)
+	}
+
+	// A restore that fails to load leaves no TAP device or firewall behind
+	if _, err := env.mgr.Stop("web"); err != nil {
+		t.Fatalf("Stop() error: %v", err)
+	}
+	env.hv.startErr = errors.New("restore failed")
+	if _, err := env.mgr.Restore("web", "before", false, true); err == nil {
+		t.Fatal("Restore() should fail")
+	}
+	if len(env.net.taps) != 0 || len(env.net.firewalls) != 0 || len(env.net.forwards) != 0 {
+		t.Errorf("failed restore left TAP devices %v, firewalls %v and port forwards %v", env.net.taps, env.net.firewalls, env.net.forwards)
+	}
+	env.hv.startErr = nil
+
+	// A disk-only snapshot is booted from its disks
+	restored, err = env.mgr.Restore("web", "disks", false, true)
+	if err != nil {
+		t.Fatalf("Restore() of a disk-only snapshot error: %v", err)
+	}
+	if restored.State != vm.StateRunning || len(env.hv.started) != 2 {
+		t.Errorf("disk-only restore = %s after %d boots, want running after a second boot", restored.State, len(env.hv.started))
+	}
+
+	// Without start only the disks are restored
+	if _, err := env.mgr.Stop("web"); err != nil {
+		t.Fatalf("Stop() error: %v", err)
+	}
+	restored, err = env.mgr.Restore("web", "before", false, false)
+	if err != nil {
+		t.Fatalf("Restore() without start error: %v", err)
+	}
+	if restored.State != vm.StateStopped {
+		t.Errorf("state after restoring disks only = %s, want stopped", restored.State)
+	}
+	if want := []string{"web/before", "web/before", "web/disks", "web/before"}; !reflect.DeepEqual(env.snaps.restored, want) {
+		t.Errorf("disks restored = %v, want %v", env.snaps.restored, want)
+	}
+}
+
+func TestGuestNetworkScript(t *testing.T) {
+	nics := []*vm.NIC{{MacAddress: "AA:FC:00:61:62:63"}}
+	ifaces := []image.NetworkInterface{{Device: "eth0", Address: "172.16.0.9/24", Gateway: "172.16.0.1"}}
+	want := `set -e
+ip link set dev eth0 down
+ip link set dev eth0 address aa:fc:00:61:62:63
+ip addr flush dev eth0
+ip link set dev eth0 up
+ip addr add 172.16.0.9/24 dev eth0
+ip route replace default via 172.16.0.1 dev eth0
+`
+	if got := guestNetworkScript(nics, ifaces); got != want {
+		t.Errorf("guestNetworkScript() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCreatePortForwardConflict(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web", vm.PortForward{HostPort: 8000, HostPortEnd: 8010, GuestPort: 8000, Protocol: "tcp"})
+
+	tests := []struct {
+		name    string
+		pfs     []vm.PortForward
+		wantErr error
+	}{
+		{name: "port inside another VM's range", pfs: []vm.PortForward{{HostPort: 8005, GuestPort: 80, Protocol: "tcp"}}, wantErr: ErrConflict},
+		{name: "overlapping range", pfs: []vm.PortForward{{HostPort: 7990, HostPortEnd: 8000, GuestPort: 7990, Protocol: "tcp"}}, wantErr: ErrConflict},
+		{name: "same port twice", pfs: []vm.PortForward{{HostPort: 9000, GuestPort: 80, Protocol: "tcp"}, {HostPort: 9000, GuestPort: 81}}, wantErr: ErrConflict},
+		{name: "invalid protocol", pfs: []vm.PortForward{{HostPort: 9000, GuestPort: 80, Protocol: "sctp"}}},
+		{name: "invalid port", pfs: []vm.PortForward{{HostPort: 70000, GuestPort: 80, Protocol: "tcp"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := vm.NewVM("db")
+			v.PortForwards = tt.pfs
+			_, err := env.mgr.Create(v)
+			if err == nil {
+				t.Fatal("Create() should fail")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Create() error = %v, want %v", err, tt.wantErr)
+			}
+			if vm.Exists(env.mgr.cfg.GetPaths().VMs, "db") {
+				t.Error("Create() saved a VM with conflicting port forwards")
+			}
+		})
+	}
+
+	// The same port over another protocol is a separate forward, and an
+	// unset protocol means tcp
+	v := vm.NewVM("db")
+	v.PortForwards = []vm.PortForward{{HostPort: 8005, GuestPort: 53, Protocol: "udp"}, {HostPort: 9000, GuestPort: 80}}
+	created, err := env.mgr.Create(v)
+	if err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+	if got := created.PortForwards[1].Protocol; got != "tcp" {
+		t.Errorf("default protocol = %q, want tcp", got)
+	}
+}
+
+func TestStartPortForwardConflict(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web", vm.PortForward{HostPort: 8080, GuestPort: 80, Protocol: "tcp"})
+	env.createVM(t, "db")
+	if _, err := env.mgr.Start("web"); err != nil {
+		t.Fatalf("Start(web) error: %v", err)
+	}
+
+	// A state file edited by hand can still claim a port in use
+	db := env.load(t, "db")
+	db.PortForwards = []vm.PortForward{{HostPort: 8080, GuestPort: 8080, Protocol: "tcp"}}
+	if err := db.Save(env.mgr.cfg.GetPaths().VMs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.mgr.Start("db"); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Start(db) error = %v, want ErrConflict", err)
+	}
+	if env.net.taps["tap-db"] {
+		t.Error("TAP device was not rolled back")
+	}
+
+	// Once web stops the port is free
+	if _, err := env.mgr.Stop("web"); err != nil {
+		t.Fatalf("Stop(web) error: %v", err)
+	}
+	v, err := env.mgr.Start("db")
+	if err != nil {
+		t.Fatalf("Start(db) error: %v", err)
+	}
+	if !env.net.forwards[forwardKey(8080, 8080, v.IPAddress, "tcp")] {
+		t.Error("Start(db) did not add the port forward")
+	}
+}
+
+func TestSetPortForwards(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web", vm.PortForward{HostPort: 8080, GuestPort: 80, Protocol: "tcp"})
+	env.createVM(t, "db", vm.PortForward{HostPort: 5432, GuestPort: 5432, Protocol: "tcp"})
+
+	// A stopped VM only records the forwards
+	pfs := []vm.PortForward{{HostPort: 8443, GuestPort: 443, Protocol: "tcp"}}
+	if _, err := env.mgr.SetPortForwards("web", pfs); err != nil {
+		t.Fatalf("SetPortForwards() error: %v", err)
+	}
+	if len(env.net.forwards) != 0 {
+		t.Errorf("SetPortForwards() applied forwards to a stopped VM: %v", env.net.forwards)
+	}
+	if got := env.load(t, "web").PortForwards; !reflect.DeepEqual(got, pfs) {
+		t.Errorf("saved port forwards = %v, want %v", got, pfs)
+	}
+
+	// A running VM has the old forwards replaced straight away
+	v, err := env.mgr.Start("web")
+	if err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	pfs = []vm.PortForward{
+		{HostPort: 8080, GuestPort: 80, Protocol: "tcp"},
+		{HostPort: 5353, GuestPort: 53, Protocol: "udp"},
+	}
+	if _, err := env.mgr.SetPortForwards("web", pfs); err != nil {
+		t.Fatalf("SetPortForwards() error: %v", err)
+	}
+	want := map[string]bool{
+		forwardKey(8080, 80, v.IPAddress, "tcp"): true,
+		forwardKey(5353, 53, v.IPAddress, "udp"): true,
+	}
+	if !reflect.DeepEqual(env.net.forwards, want) {
+		t.Errorf("forwards = %v, want %v", env.net.forwards, want)
+	}
+
+	// Another VM's port is refused and nothing changes
+	if _, err := env.mgr.SetPortForwards("web", []vm.PortForward{{HostPort: 5432, GuestPort: 5432, Protocol: "tcp"}}); !errors.Is(err, ErrConflict) {
+		t.Errorf("SetPortForwards() with db's port error = %v, want ErrConflict", err)
+	}
+	if got := env.load(t, "web").PortForwards; !reflect.DeepEqual(got, pfs) {
+		t.Errorf("saved port forwards after a conflict = %v, want %v", got, pfs)
+	}
+
+	if _, err := env.mgr.SetPortForwards("nope", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetPortForwards() on a missing VM error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestAddRemovePortForward(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web", vm.PortForward{HostPort: 8080, GuestPort: 80, Protocol: "tcp"})
+	env.createVM(t, "db", vm.PortForward{HostPort: 5432, GuestPort: 5432, Protocol: "tcp"})
+	v, err := env.mgr.Start("web")
+	if err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+
+	// A forward is added alongside the existing ones, once
+	dns := vm.PortForward{HostPort: 5353, GuestPort: 53, Protocol: "udp"}
+	for i := 0; i < 2; i++ {
+		if _, err := env.mgr.AddPortForward("web", dns); err != nil {
+			t.Fatalf("AddPortForward() error: %v", err)
+		}
+	}
+	want := []vm.PortForward{{HostPort: 8080, GuestPort: 80, Protocol: "tcp"}, dns}
+	if got := env.load(t, "web").PortForwards; !reflect.DeepEqual(got, want) {
+		t.Errorf("saved port forwards = %v, want %v", got, want)
+	}
+	if !env.net.forwards[forwardKey(5353, 53, v.IPAddress, "udp")] {
+		t.Errorf("added forward not applied to the running VM: %v", env.net.forwards)
+	}
+	if _, err := env.mgr.AddPortForward("web", vm.PortForward{HostPort: 5432, GuestPort: 5432}); !errors.Is(err, ErrConflict) {
+		t.Errorf("AddPortForward() with db's port error = %v, want ErrConflict", err)
+	}
+
+	// Only the host ports and protocol pick the forward to remove
+	if _, err := env.mgr.RemovePortForward("web", vm.PortForward{HostPort: 8080, GuestPort: 1}); err != nil {
+		t.Fatalf("RemovePortForward() error: %v", err)
+	}
+	if got := env.load(t, "web").PortForwards; !reflect.DeepEqual(got, []vm.PortForward{dns}) {
+		t.Errorf("saved port forwards after removal = %v, want [%v]", got, dns)
+	}
+	if env.net.forwards[forwardKey(8080, 80, v.IPAddress, "tcp")] {
+		t.Errorf("removed forward still applied: %v", env.net.forwards)
+	}
+	if _, err := env.mgr.RemovePortForward("web", vm.PortForward{HostPort: 5353, Protocol: "tcp"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("RemovePortForward() of a forward the VM does not have error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestStartSkipsProxiedForwards(t *testing.T) {
+	env := newTestEnv(t)
+	env.createVM(t, "web",
+		vm.PortForward{HostPort: 8080, GuestPort: 80, Protocol: "tcp"},
+		vm.PortForward{HostPort: 8443, GuestPort: 443, Protocol: "tcp", Mode: vm.ForwardProxy},
+	)
+
+	v, err := env.mgr.Start("web")
+	if err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	want := map[string]bool{forwardKey(8080, 80, v.IPAddress, "tcp"): true}
+	if !reflect.DeepEqual(env.net.forwards, want) {
+		t.Errorf("forwards = %v, want only the NAT forward %v", env.net.forwards, want)
+	}
+
+	// The proxied port still conflicts with other VMs
+	other := vm.NewVM("db")
+	other.PortForwards = []vm.PortForward{{HostPort: 8443, GuestPort: 443, Protocol: "tcp"}}
+	if _, err := env.mgr.Create(other); !errors.Is(err, ErrConflict) {
+		t.Errorf("Create() with a proxied port error = %v, want ErrConflict", err)
+	}
+}
@@ -0,0 +1,63 @@
+package lifecycle
+
+import (
+	"fmt"
+
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+// Pause stops a running VM's vCPUs. Its Firecracker process, memory, TAP
+// devices, addresses and port forwards are kept, so Resume carries on where
+// the guest left off.
+func (m *Manager) Pause(name string) (*vm.VM, error) {
+	l, err := m.lockVM(name)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+
+	v, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if v.State != vm.StateRunning {
+		return nil, conflictf("VM '%s' is not running (state: %s)", name, v.State)
+	}
+
+	m.report(name, "Pausing vCPUs")
+	if err := m.hypervisor.Pause(v); err != nil {
+		return nil, err
+	}
+	v.State = vm.StatePaused
+	if err := v.Save(m.cfg.GetPaths().VMs); err != nil {
+		return nil, fmt.Errorf("failed to save VM state: %w", err)
+	}
+	return v, nil
+}
+
+// Resume starts a paused VM's vCPUs again.
+func (m *Manager) Resume(name string) (*vm.VM, error) {
+	l, err := m.lockVM(name)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+
+	v, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if v.State != vm.StatePaused {
+		return nil, conflictf("VM '%s' is not paused (state: %s)", name, v.State)
+	}
+
+	m.report(name, "Resuming vCPUs")
+	if err := m.hypervisor.Resume(v); err != nil {
+		return nil, err
+	}
+	v.State = vm.StateRunning
+	if err := v.Save(m.cfg.GetPaths().VMs); err != nil {
+		return nil, fmt.Errorf("failed to save VM state: %w", err)
+	}
+	return v, nil
+}
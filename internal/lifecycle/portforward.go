@@ -0,0 +1,207 @@
+package lifecycle
+
+import (
+	"fmt"
+
+	"github.com/raesene/baremetalvmm/internal/network"
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+// SetPortForwards replaces a VM's port forwards. If the VM is running the
+// forwards it no longer has are removed and the new ones applied straight
+// away; otherwise they take effect the next time the VM starts. A host port
+// can only be forwarded to one VM.
+func (m *Manager) SetPortForwards(name string, pfs []vm.PortForward) (*vm.VM, error) {
+	pfs, err := normalizePortForwards(pfs)
+	if err != nil {
+		return nil, err
+	}
+	l, err := m.lockVM(name)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+
+	v, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return m.setPortForwards(v, pfs)
+}
+
+// AddPortForward adds a forward to a VM's port forwards, as SetPortForwards
+// would. Adding a forward the VM already has changes nothing.
+func (m *Manager) AddPortForward(name string, pf vm.PortForward) (*vm.VM, error) {
+	l, err := m.lockVM(name)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+
+	v, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if pf.Protocol == "" {
+		pf.Protocol = "tcp"
+	}
+	for _, existing := range v.PortForwards {
+		if existing == pf {
+			return v, nil
+		}
+	}
+	pfs, err := normalizePortForwards(append(append([]vm.PortForward(nil), v.PortForwards...), pf))
+	if err != nil {
+		return nil, err
+	}
+	return m.setPortForwards(v, pfs)
+}
+
+// RemovePortForward removes the forward of target's host ports and protocol
+// from a VM, as SetPortForwards would. Its guest ports are not compared.
+func (m *Manager) RemovePortForward(name string, target vm.PortForward) (*vm.VM, error) {
+	l, err := m.lockVM(name)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+
+	v, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if target.Protocol == "" {
+		target.Protocol = "tcp"
+	}
+	var kept []vm.PortForward
+	found := false
+	for _, pf := range v.PortForwards {
+		if pf.Protocol == "" {
+			pf.Protocol = "tcp"
+		}
+		if !found && pf.HostPorts() == target.HostPorts() {
+			found = true
+			continue
+		}
+		kept = append(kept, pf)
+	}
+	if !found {
+		return nil, notFoundf("port forward %s not found on VM '%s'", target.HostPorts(), name)
+	}
+	return m.setPortForwards(v, kept)
+}
+
+// setPortForwards replaces the port forwards of v, whose lock the caller
+// holds, with pfs, which have been normalized.
+func (m *Manager) setPortForwards(v *vm.VM, pfs []vm.PortForward) (*vm.VM, error) {
+	if err := m.checkPortForwards(v.Name, pfs, false); err != nil {
+		return nil, err
+	}
+
+	if v.State.Active() {
+		d, err := m.nicNetwork(&v.NIC)
+		if err != nil {
+			return nil, err
+		}
+		hostNet := m.network(d)
+		for _, pf := range natForwards(v.PortForwards) {
+			for _, guestIP := range v.NIC.Addresses() {
+				if err := hostNet.RemovePortForward(hostPortForward(pf, guestIP)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		for _, pf := range natForwards(pfs) {
+			for _, guestIP := range v.NIC.Addresses() {
+				if err := hostNet.AddPortForward(hostPortForward(pf, guestIP)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	v.PortForwards = pfs
+	if err := v.Save(m.cfg.GetPaths().VMs); err != nil {
+		return nil, fmt.Errorf("failed to save VM state: %w", err)
+	}
+	return v, nil
+}
+
+// normalizePortForwards defaults the protocol to tcp, validates each forward
+// and rejects forwards that claim the same host port twice.
+func normalizePortForwards(pfs []vm.PortForward) ([]vm.PortForward, error) {
+	out := make([]vm.PortForward, 0, len(pfs))
+	for _, pf := range pfs {
+		if pf.Protocol == "" {
+			pf.Protocol = "tcp"
+		}
+		if err := pf.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid port forward %s: %w", pf, err)
+		}
+		for _, prev := range out {
+			if pf.Overlaps(prev) {
+				return nil, conflictf("port forwards %s and %s use the same host port", prev, pf)
+			}
+		}
+		out = append(out, pf)
+	}
+	return out, nil
+}
+
+// checkPortForwards fails if another VM already forwards one of the host
+// ports in pfs. With runningOnly set only running VMs are considered, which
+// is what matters when the forwards are about to be applied; otherwise the
+// forwards recorded on every VM are.
+func (m *Manager) checkPortForwards(name string, pfs []vm.PortForward, runningOnly bool) error {
+	if len(pfs) == 0 {
+		return nil
+	}
+	vms, err := m.List()
+	if err != nil {
+		return fmt.Errorf("failed to list VMs: %w", err)
+	}
+	for _, other := range vms {
+		if other.Name == name || (runningOnly && !other.State.Active()) {
+			continue
+		}
+		for _, theirs := range other.PortForwards {
+			if theirs.Protocol == "" {
+				theirs.Protocol = "tcp"
+			}
+			for _, pf := range pfs {
+				if pf.Overlaps(theirs) {
+					return conflictf("host port %s is already forwarded to VM '%s'", theirs.HostPorts(), other.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// natForwards returns the forwards applied as DNAT rules, leaving out those
+// the userspace proxy relays.
+func natForwards(pfs []vm.PortForward) []vm.PortForward {
+	var out []vm.PortForward
+	for _, pf := range pfs {
+		if !pf.Proxied() {
+			out = append(out, pf)
+		}
+	}
+	return out
+}
+
+// hostPortForward converts a VM's port forward into the DNAT rule for one
+// of its guest addresses.
+func hostPortForward(pf vm.PortForward, guestIP string) network.PortForward {
+	protocol := pf.Protocol
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	return network.PortForward{
+		Protocol:    protocol,
+		HostPort:    pf.HostPort,
+		HostPortEnd: pf.HostPortEnd,
+		GuestIP:     guestIP,
+		GuestPort:   pf.GuestPort,
+	}
+}
@@ -0,0 +1,44 @@
+package lifecycle
+
+import (
+	"fmt"
+
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+// SetRateLimits replaces a VM's network and disk rate limits. If the VM is
+// running the new limits are applied to its devices straight away through
+// Firecracker's API; otherwise they take effect the next time the VM starts.
+// Nil limits, or ones that leave every device unlimited, remove them.
+func (m *Manager) SetRateLimits(name string, limits *vm.RateLimits) (*vm.VM, error) {
+	if limits != nil {
+		if err := limits.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid rate limits: %w", err)
+		}
+	}
+	l, err := m.lockVM(name)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+
+	v, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if limits.Empty() {
+		limits = nil
+	}
+	v.RateLimits = limits
+
+	if v.State.Active() {
+		if err := m.hypervisor.UpdateRateLimits(v); err != nil {
+			return nil, fmt.Errorf("failed to update rate limits: %w", err)
+		}
+	}
+
+	if err := v.Save(m.cfg.GetPaths().VMs); err != nil {
+		return nil, fmt.Errorf("failed to save VM state: %w", err)
+	}
+	return v, nil
+}
@@ -0,0 +1,188 @@
+package lifecycle
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/raesene/baremetalvmm/internal/firecracker"
+	"github.com/raesene/baremetalvmm/internal/image"
+	"github.com/raesene/baremetalvmm/internal/lock"
+	"github.com/raesene/baremetalvmm/internal/snapshot"
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+// Restore rolls a VM back in place to one of its snapshots. A running or
+// paused VM is only restored when force is set, and is stopped first. The
+// snapshot's disks replace the VM's, including a thin VM's overlay, and the
+// VM takes on the snapshot's CPUs and memory.
+//
+// If start is set the VM then carries on from the snapshot's memory, with the
+// TAP devices and addresses frozen into it; a disk-only snapshot has no
+// memory, so the VM is booted from the restored disks instead. Otherwise it
+// is left stopped.
+func (m *Manager) Restore(name, snapName string, force, start bool) (*vm.VM, error) {
+	l, err := m.lockVM(name)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+
+	v, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if !m.snapshots.Exists(name, snapName) {
+		return nil, notFoundf("snapshot '%s' not found for VM '%s'", snapName, name)
+	}
+	meta, err := m.snapshots.Get(name, snapName)
+	if err != nil {
+		return nil, err
+	}
+	if start && !meta.DiskOnly() {
+		if len(v.Volumes) > 0 {
+			return nil, conflictf("VM '%s' has volumes attached, which the memory of snapshot '%s' does not know about; restore its disks without starting and boot the VM", name, snapName)
+		}
+		if meta.StateRootfs != "" && meta.StateRootfs != meta.RootfsPath {
+			return nil, conflictf("snapshot '%s' was imported from a VM whose disks were at %s; it can only be restored without starting or cloned cold", snapName, meta.StateRootfs)
+		}
+	}
+
+	// The VM must be stopped before its disks are overwritten
+	if v.State.Active() {
+		if !force {
+			return nil, conflictf("VM '%s' is %s; stop it first or use --force to stop and restore", name, v.State)
+		}
+		if v, err = m.stop(name); err != nil {
+			return nil, err
+		}
+	}
+
+	paths := m.cfg.GetPaths()
+	v.CPUs = meta.CPUs
+	v.MemoryMB = meta.MemoryMB
+
+	// The snapshot holds a full copy of the rootfs, which replaces a thin
+	// VM's overlay of its base image
+	if v.BaseImage != "" {
+		if err := m.images.DetachVMDisk(name, paths.VMs); err != nil {
+			return nil, fmt.Errorf("failed to detach disk: %w", err)
+		}
+	}
+	m.report(name, fmt.Sprintf("Restoring disks from snapshot '%s'", snapName))
+	if _, err := m.snapshots.RestoreDisks(v, snapName); err != nil {
+		v.State = vm.StateError
+		if saveErr := v.Save(paths.VMs); saveErr != nil {
+			fmt.Printf("Warning: failed to save VM state: %v\n", saveErr)
+		}
+		return nil, fmt.Errorf("failed to restore snapshot: %w", err)
+	}
+	if v.BaseImage != "" {
+		os.Remove(image.VMOverlayPath(name, paths.VMs))
+		v.BaseImage = ""
+	}
+	v.State = vm.StateStopped
+	v.LastSnapshot = ""
+	if err := v.Save(paths.VMs); err != nil {
+		return nil, fmt.Errorf("failed to save VM state: %w", err)
+	}
+
+	switch {
+	case !start:
+		return v, nil
+	case meta.DiskOnly():
+		err = m.boot(v)
+	default:
+		err = m.restoreMemory(v, meta)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// restoreMemory starts a stopped VM from the memory of one of its own
+// snapshots. Firecracker opens the TAP devices recorded in the snapshot,
+// which are the VM's own, so they are created and firewalled, and the VM's
+// port forwards applied, before it loads.
+func (m *Manager) restoreMemory(v *vm.VM, meta *snapshot.Metadata) error {
+	paths := m.cfg.GetPaths()
+
+	m.report(v.Name, "Setting up network")
+	nics := v.Interfaces()
+	_, nets, err := m.hostNetworks(nics)
+	if err != nil {
+		return err
+	}
+
+	rb := &rollback{}
+	defer rb.run()
+
+	for i, nic := range nics {
+		if nets[i].TapExists(nic.TapDevice) {
+			continue
+		}
+		if err := nets[i].CreateTap(nic.TapDevice); err != nil {
+			return fmt.Errorf("failed to create TAP device: %w", err)
+		}
+		hostNet, tap := nets[i], nic.TapDevice
+		rb.add("clean up TAP device "+tap, func() error {
+			return hostNet.DeleteTap(tap)
+		})
+	}
+	if err := applyFirewall(v, nets, rb); err != nil {
+		return err
+	}
+
+	// The guest keeps the addresses frozen into its memory, which are the
+	// VM's own, so its port forwards are applied as on any start
+	gl, err := lock.Global(paths.State, globalLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer gl.Unlock()
+	if err := m.applyPortForwards(v, nets[0], rb); err != nil {
+		return err
+	}
+	v.State = vm.StateStarting
+	if err := v.Save(paths.VMs); err != nil {
+		return fmt.Errorf("failed to save VM state: %w", err)
+	}
+	gl.Unlock()
+
+	m.report(v.Name, "Restoring memory from snapshot")
+	memPath, loaded, err := m.snapshots.MemoryFile(v.Name, meta.Name)
+	if err != nil {
+		return err
+	}
+	// Firecracker binds the vsock socket recorded in the snapshot state, and
+	// fails if a stale one is in the way
+	os.Remove(v.VsockPath())
+	pid, err := m.hypervisor.Restore(&firecracker.RestoreConfig{
+		SocketPath:  v.SocketPath,
+		LogPath:     fmt.Sprintf("%s/%s.log", paths.Logs, v.Name),
+		ConsolePath: v.ConsolePath(),
+		MemPath:     memPath,
+		StatePath:   filepath.Join(m.snapshots.Dir(v.Name, meta.Name), meta.StateFile),
+	})
+	loaded()
+	if err != nil {
+		return fmt.Errorf("failed to restore snapshot: %w", err)
+	}
+	rb.commit()
+
+	// The guest clock resumes from when the snapshot was taken. Only images
+	// with the guest agent can be brought up to date, so a failure is not
+	// reported.
+	m.guests.SyncTime(v)
+
+	v.State = vm.StateRunning
+	v.PID = pid
+	v.StartedAt = time.Now()
+	v.LastSnapshot = meta.Name
+	if err := v.Save(paths.VMs); err != nil {
+		return fmt.Errorf("VM restored but failed to save state: %w", err)
+	}
+	return nil
+}
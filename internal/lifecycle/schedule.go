@@ -0,0 +1,45 @@
+package lifecycle
+
+import (
+	"fmt"
+
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+// SetSnapshotSchedule replaces a VM's snapshot schedule, which vmmd runs
+// while the VM is running. The status of the schedule's last run is kept, so
+// changing the retention does not take a snapshot straight away. A nil or
+// empty schedule removes it; the snapshots it took are kept.
+func (m *Manager) SetSnapshotSchedule(name string, sched *vm.SnapshotSchedule) (*vm.VM, error) {
+	if !sched.Empty() {
+		if err := sched.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	l, err := m.lockVM(name)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+
+	v, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if sched.Empty() {
+		v.SnapshotSchedule = nil
+	} else {
+		if old := v.SnapshotSchedule; old != nil {
+			sched.LastRun = old.LastRun
+			sched.LastSnapshot = old.LastSnapshot
+			sched.LastError = old.LastError
+			sched.Failures = old.Failures
+		}
+		v.SnapshotSchedule = sched
+	}
+
+	if err := v.Save(m.cfg.GetPaths().VMs); err != nil {
+		return nil, fmt.Errorf("failed to save VM state: %w", err)
+	}
+	return v, nil
+}
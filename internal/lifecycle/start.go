@@ -0,0 +1,440 @@
+package lifecycle
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/raesene/baremetalvmm/internal/firecracker"
+	"github.com/raesene/baremetalvmm/internal/image"
+	"github.com/raesene/baremetalvmm/internal/lock"
+	"github.com/raesene/baremetalvmm/internal/nameserver"
+	"github.com/raesene/baremetalvmm/internal/network"
+	"github.com/raesene/baremetalvmm/internal/sshkey"
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+// globalLockTimeout bounds how long an operation waits for another process to
+// finish allocating an IP.
+const globalLockTimeout = 30 * time.Second
+
+// rollback collects undo steps for resources created during an operation and
+// runs them in reverse order if the operation does not complete.
+type rollback struct {
+	steps     []rollbackStep
+	committed bool
+}
+
+type rollbackStep struct {
+	desc string
+	undo func() error
+}
+
+// add registers an undo step. desc completes the sentence "failed to ..." in
+// the warning printed if the step fails.
+func (r *rollback) add(desc string, undo func() error) {
+	r.steps = append(r.steps, rollbackStep{desc: desc, undo: undo})
+}
+
+// commit marks the operation as complete so run does nothing.
+func (r *rollback) commit() {
+	r.committed = true
+}
+
+// run undoes every registered step, newest first, unless committed.
+func (r *rollback) run() {
+	if r.committed {
+		return
+	}
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		if err := r.steps[i].undo(); err != nil {
+			fmt.Printf("Warning: failed to %s: %v\n", r.steps[i].desc, err)
+		}
+	}
+}
+
+// Start boots a stopped VM: it prepares the rootfs, injects SSH keys, DNS and
+// mount configuration, creates a TAP device, installs the firewall and
+// acquires an IP lease for each interface, applies port forwards, writes the
+// guest network configuration and launches Firecracker. Partially created
+// resources are rolled back if any step fails.
+func (m *Manager) Start(name string) (*vm.VM, error) {
+	l, err := m.lockVM(name)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+	return m.start(name)
+}
+
+func (m *Manager) start(name string) (*vm.VM, error) {
+	// A VM whose guest powered off still holds its TAP devices until reaped
+	if _, err := m.reap(name); err != nil {
+		return nil, err
+	}
+	v, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if v.State.Active() {
+		return nil, conflictf("VM '%s' is already %s", name, v.State)
+	}
+	if err := m.boot(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (m *Manager) boot(v *vm.VM) error {
+	paths := m.cfg.GetPaths()
+
+	m.report(v.Name, "Preparing root filesystem")
+	if err := m.images.EnsureDefaultImages(); err != nil {
+		return fmt.Errorf("failed to ensure images: %w", err)
+	}
+	var vmRootfs string
+	var err error
+	if v.BaseImage != "" {
+		vmRootfs, err = m.images.CreateVMOverlay(v.Name, paths.VMs, v.DiskSizeMB, v.BaseImage)
+		// The overlay stays attached while Firecracker has it open
+		defer func() {
+			if v.State != vm.StateRunning {
+				m.detachDisk(v)
+			}
+		}()
+	} else {
+		vmRootfs, err = m.images.CreateVMRootfs(v.Name, paths.VMs, v.DiskSizeMB, v.Image)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create VM rootfs: %w", err)
+	}
+	v.RootfsPath = vmRootfs
+	v.KernelPath = m.images.GetKernelPath(v.Kernel)
+
+	m.report(v.Name, "Injecting SSH public key")
+	if err := sshkey.EnsureKeyPair(paths.SSH); err != nil {
+		return fmt.Errorf("failed to ensure vmm SSH key: %w", err)
+	}
+	authorizedKeys, err := sshkey.BuildAuthorizedKeys(paths.SSH, v.SSHPublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to build authorized keys: %w", err)
+	}
+	if err := m.images.InjectSSHKey(v.RootfsPath, authorizedKeys); err != nil {
+		return fmt.Errorf("failed to inject SSH key: %w", err)
+	}
+
+	m.report(v.Name, "Configuring DNS")
+	dnsServers, searchDomains := m.guestDNS(v)
+	if err := m.images.InjectDNSConfig(v.RootfsPath, dnsServers, searchDomains); err != nil {
+		return fmt.Errorf("failed to inject DNS config: %w", err)
+	}
+
+	mountDrives, err := m.prepareMounts(v)
+	if err != nil {
+		return err
+	}
+
+	m.report(v.Name, "Setting up network")
+	nics := v.Interfaces()
+	defs, nets, err := m.hostNetworks(nics)
+	if err != nil {
+		return err
+	}
+
+	rb := &rollback{}
+	defer rb.run()
+
+	for i, nic := range nics {
+		if nets[i].TapExists(nic.TapDevice) {
+			continue
+		}
+		if err := nets[i].CreateTap(nic.TapDevice); err != nil {
+			return fmt.Errorf("failed to create TAP device: %w", err)
+		}
+		hostNet, tap := nets[i], nic.TapDevice
+		rb.add("clean up TAP device "+tap, func() error {
+			return hostNet.DeleteTap(tap)
+		})
+	}
+
+	// Install the firewall before the VM can send or receive anything
+	if err := applyFirewall(v, nets, rb); err != nil {
+		return err
+	}
+
+	// Hold the global lock from choosing IPs until they are recorded in the
+	// VM's state file, so concurrent starts cannot pick the same address.
+	gl, err := lock.Global(paths.State, globalLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer gl.Unlock()
+
+	if err := m.acquireAddresses(v, defs, rb); err != nil {
+		return err
+	}
+
+	// Port forwards target the primary interface, over IPv4 and, on
+	// dual-stack networks, IPv6. They are applied on every start, so they
+	// follow the VM if its address changed while it was stopped. Proxied
+	// forwards are picked up by vmmd once the VM is running.
+	if err := m.applyPortForwards(v, nets[0], rb); err != nil {
+		return err
+	}
+
+	v.State = vm.StateStarting
+	if err := v.Save(paths.VMs); err != nil {
+		return fmt.Errorf("failed to save VM state: %w", err)
+	}
+	gl.Unlock()
+
+	if err := m.images.InjectNetworkConfig(v.RootfsPath, guestInterfaces(nics, defs)); err != nil {
+		return fmt.Errorf("failed to inject network config: %w", err)
+	}
+
+	rb.add("clean up socket file "+v.SocketPath, func() error {
+		if err := os.Remove(v.SocketPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+
+	var fcNICs []firecracker.NetworkInterface
+	for _, nic := range nics {
+		fcNICs = append(fcNICs, firecracker.NetworkInterface{
+			TapDevice:  nic.TapDevice,
+			MacAddress: nic.MacAddress,
+		})
+	}
+
+	m.report(v.Name, "Booting Firecracker")
+	pid, err := m.hypervisor.Start(&firecracker.VMConfig{
+		SocketPath:        v.SocketPath,
+		KernelPath:        v.KernelPath,
+		KernelArgs:        v.KernelArgs,
+		InitrdPath:        m.images.GetInitrdPath(v.Initrd),
+		RootfsPath:        v.RootfsPath,
+		CPUs:              v.CPUs,
+		MemoryMB:          v.MemoryMB,
+		NetworkInterfaces: fcNICs,
+		LogPath:           fmt.Sprintf("%s/%s.log", paths.Logs, v.Name),
+		IPAddress:         v.IPAddress,
+		Gateway:           defs[0].Gateway,
+		Subnet:            defs[0].Subnet,
+		MountDrives:       mountDrives,
+		RateLimits:        v.RateLimits,
+		BalloonMB:         v.BalloonMB,
+		VsockPath:         v.VsockPath(),
+		ConsolePath:       v.ConsolePath(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start VM: %w", err)
+	}
+	rb.commit()
+
+	v.State = vm.StateRunning
+	v.PID = pid
+	v.StartedAt = time.Now()
+	v.LastSnapshot = ""
+	if err := v.Save(paths.VMs); err != nil {
+		return fmt.Errorf("VM started but failed to save state: %w", err)
+	}
+	return nil
+}
+
+// hostNetworks returns the definition and host networking of each of the
+// given interfaces' networks, with their bridges set up.
+func (m *Manager) hostNetworks(nics []*vm.NIC) ([]*network.Definition, []Network, error) {
+	defs := make([]*network.Definition, len(nics))
+	nets := make([]Network, len(nics))
+	for i, nic := range nics {
+		d, err := m.nicNetwork(nic)
+		if err != nil {
+			return nil, nil, err
+		}
+		defs[i], nets[i] = d, m.network(d)
+		if err := nets[i].EnsureBridge(); err != nil {
+			return nil, nil, fmt.Errorf("failed to setup bridge: %w", err)
+		}
+	}
+	return defs, nets, nil
+}
+
+// applyFirewall installs the VM's firewall on each of its TAP devices. A VM
+// without one still clears any left behind.
+func applyFirewall(v *vm.VM, nets []Network, rb *rollback) error {
+	fw := compileFirewall(v.Firewall)
+	for i, nic := range v.Interfaces() {
+		if err := nets[i].ApplyFirewall(nic.TapDevice, fw); err != nil {
+			return fmt.Errorf("failed to apply firewall: %w", err)
+		}
+		if fw == nil {
+			continue
+		}
+		hostNet, tap := nets[i], nic.TapDevice
+		rb.add("remove firewall for "+tap, func() error {
+			return hostNet.RemoveFirewall(tap)
+		})
+	}
+	return nil
+}
+
+// applyPortForwards adds the DNAT rules of the VM's port forwards, which
+// target its primary interface on hostNet, after checking that no other
+// running VM forwards the same host ports. The caller holds the global lock
+// until the VM is saved as starting.
+func (m *Manager) applyPortForwards(v *vm.VM, hostNet Network, rb *rollback) error {
+	if err := m.checkPortForwards(v.Name, v.PortForwards, true); err != nil {
+		return err
+	}
+	for _, pf := range natForwards(v.PortForwards) {
+		for _, guestIP := range v.NIC.Addresses() {
+			hpf := hostPortForward(pf, guestIP)
+			if err := hostNet.AddPortForward(hpf); err != nil {
+				return fmt.Errorf("failed to add port forward %s: %w", pf, err)
+			}
+			rb.add("clean up port forward "+hpf.String(), func() error {
+				return hostNet.RemovePortForward(hpf)
+			})
+		}
+	}
+	return nil
+}
+
+// acquireAddresses gives each of the VM's interfaces the address of its
+// lease. The caller holds the global lock until the addresses are saved.
+func (m *Manager) acquireAddresses(v *vm.VM, defs []*network.Definition, rb *rollback) error {
+	paths := m.cfg.GetPaths()
+	nics := v.Interfaces()
+
+	// Each interface's lease keeps its address stable across restarts. The
+	// address it last had is preferred when a lease has to be created, so
+	// VMs from before leases existed keep their IP.
+	for i, nic := range nics {
+		addrs, key := m.addresses(defs[i]), network.LeaseKey(v.Name, vm.InterfaceName(i))
+		ip, created, err := addrs.Acquire(key, nic.IPAddress, usedIPs(paths.VMs, v, i))
+		if err != nil {
+			return fmt.Errorf("failed to allocate IP for %s: %w", vm.InterfaceName(i), err)
+		}
+		nic.IPAddress = ip
+		if created {
+			rb.add("release IP lease "+ip, func() error {
+				return m.releaseLease(addrs, key)
+			})
+		}
+		// Dual-stack networks derive the IPv6 address from the IPv4 one
+		if nic.IPv6Address, err = defs[i].IPv6Address(ip); err != nil {
+			return fmt.Errorf("failed to assign IPv6 address for %s: %w", vm.InterfaceName(i), err)
+		}
+	}
+	rb.add("save VM state during cleanup", func() error {
+		for _, nic := range nics {
+			nic.IPAddress = ""
+			nic.IPv6Address = ""
+		}
+		v.State = vm.StateError
+		return v.Save(paths.VMs)
+	})
+	return nil
+}
+
+// maxNameservers is the most nameservers the guest's resolver uses.
+const maxNameservers = 3
+
+// guestDNS returns the nameservers and search domains for a VM's resolver.
+// VMs without their own DNS servers use the server vmmd runs on their
+// primary network's gateway, which resolves VM names in the vmm.internal
+// domain. The upstream servers follow it, so names outside the domain still
+// resolve when vmmd is not running.
+func (m *Manager) guestDNS(v *vm.VM) ([]string, []string) {
+	if len(v.DNSServers) > 0 || m.cfg.DisableDNS {
+		return v.DNSServers, nil
+	}
+	d, err := m.nicNetwork(&v.NIC)
+	if err != nil {
+		return nil, nil
+	}
+	fallback := m.cfg.DNSUpstream
+	if len(fallback) == 0 {
+		fallback = image.DefaultDNSServers
+	}
+	servers := []string{d.Gateway}
+	for _, s := range fallback {
+		if len(servers) == maxNameservers {
+			break
+		}
+		servers = append(servers, s)
+	}
+	return servers, []string{nameserver.Domain}
+}
+
+// guestInterfaces describes the VM's interfaces for the guest network
+// configuration. Only the primary interface has default routes.
+func guestInterfaces(nics []*vm.NIC, defs []*network.Definition) []image.NetworkInterface {
+	var ifaces []image.NetworkInterface
+	for i, nic := range nics {
+		iface := image.NetworkInterface{Device: vm.InterfaceName(i)}
+		if _, ipnet, err := net.ParseCIDR(defs[i].Subnet); err == nil {
+			ones, _ := ipnet.Mask.Size()
+			iface.Address = fmt.Sprintf("%s/%d", nic.IPAddress, ones)
+		}
+		if _, ipnet, err := net.ParseCIDR(defs[i].Subnet6); err == nil && nic.IPv6Address != "" {
+			ones, _ := ipnet.Mask.Size()
+			iface.Address6 = fmt.Sprintf("%s/%d", nic.IPv6Address, ones)
+		}
+		if i == 0 {
+			iface.Gateway = defs[i].Gateway
+			if iface.Address6 != "" {
+				iface.Gateway6 = defs[i].Gateway6()
+			}
+		}
+		ifaces = append(ifaces, iface)
+	}
+	return ifaces
+}
+
+// prepareMounts builds the mount images for a VM and writes their fstab
+// entries, and those of its volumes, into the rootfs. Device names follow
+// the drive order: vda is the rootfs, then vdb, vdc, ... for each mount,
+// then the volumes.
+func (m *Manager) prepareMounts(v *vm.VM) ([]firecracker.MountDrive, error) {
+	if len(v.Mounts) == 0 && len(v.Volumes) == 0 {
+		return nil, nil
+	}
+
+	if len(v.Mounts) > 0 {
+		m.report(v.Name, "Creating mount images")
+	}
+	var mountDrives []firecracker.MountDrive
+	var mountEntries []image.MountEntry
+	for i := range v.Mounts {
+		mt := &v.Mounts[i]
+		if err := m.mounts.CreateMountImage(mt, v.Name); err != nil {
+			return nil, fmt.Errorf("failed to create mount image for '%s': %w", mt.GuestTag, err)
+		}
+		mountEntries = append(mountEntries, image.MountEntry{
+			Device:    fmt.Sprintf("/dev/vd%c", 'b'+i),
+			MountPath: fmt.Sprintf("/mnt/%s", mt.GuestTag),
+			ReadOnly:  mt.ReadOnly,
+		})
+		mountDrives = append(mountDrives, firecracker.MountDrive{
+			ImagePath: mt.ImagePath,
+			Tag:       mt.GuestTag,
+			ReadOnly:  mt.ReadOnly,
+		})
+	}
+
+	volumeDrives, volumeEntries, err := m.prepareVolumes(v)
+	if err != nil {
+		return nil, err
+	}
+	mountDrives = append(mountDrives, volumeDrives...)
+	mountEntries = append(mountEntries, volumeEntries...)
+
+	m.report(v.Name, "Configuring mount points in guest")
+	if err := m.images.InjectMountFstab(v.RootfsPath, mountEntries); err != nil {
+		return nil, fmt.Errorf("failed to inject mount fstab: %w", err)
+	}
+	return mountDrives, nil
+}
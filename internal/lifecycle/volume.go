@@ -0,0 +1,228 @@
+package lifecycle
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/raesene/baremetalvmm/internal/firecracker"
+	"github.com/raesene/baremetalvmm/internal/image"
+	"github.com/raesene/baremetalvmm/internal/lock"
+	"github.com/raesene/baremetalvmm/internal/validate"
+	"github.com/raesene/baremetalvmm/internal/vm"
+	"github.com/raesene/baremetalvmm/internal/volume"
+)
+
+// AttachVolume attaches a volume to a VM, to be mounted on att.MountPath
+// (/mnt/<volume> if empty) from its next start. Firecracker cannot add
+// drives to a running VM, so the VM must be stopped. A volume is attached to
+// one VM at a time.
+func (m *Manager) AttachVolume(name string, att vm.VolumeAttachment) (*vm.VM, error) {
+	if err := validate.VolumeName(att.Name); err != nil {
+		return nil, err
+	}
+	if att.MountPath == "" {
+		att.MountPath = "/mnt/" + att.Name
+	}
+	if err := validate.GuestMountPath(att.MountPath); err != nil {
+		return nil, err
+	}
+	if _, err := m.getVolume(att.Name); err != nil {
+		return nil, err
+	}
+
+	l, err := m.lockVM(name)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+
+	v, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if v.State.Active() {
+		return nil, conflictf("VM '%s' must be stopped to attach a volume (state: %s)", name, v.State)
+	}
+	for _, mt := range v.Mounts {
+		if "/mnt/"+mt.GuestTag == att.MountPath {
+			return nil, conflictf("VM '%s' already mounts '%s' on %s", name, mt.GuestTag, att.MountPath)
+		}
+	}
+	for _, other := range v.Volumes {
+		if other.MountPath == att.MountPath {
+			return nil, conflictf("VM '%s' already mounts volume '%s' on %s", name, other.Name, att.MountPath)
+		}
+	}
+
+	// Hold the global lock until the attachment is saved, so two VMs cannot
+	// take the same volume
+	paths := m.cfg.GetPaths()
+	gl, err := lock.Global(paths.State, globalLockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer gl.Unlock()
+
+	user, err := vm.VolumeUser(paths.VMs, att.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list VMs: %w", err)
+	}
+	if user != "" {
+		return nil, conflictf("volume '%s' is already attached to VM '%s'", att.Name, user)
+	}
+
+	v.Volumes = append(v.Volumes, att)
+	if err := v.Save(paths.VMs); err != nil {
+		return nil, fmt.Errorf("failed to save VM state: %w", err)
+	}
+	return v, nil
+}
+
+// DetachVolume removes a volume from a stopped VM. The volume and its data
+// are kept.
+func (m *Manager) DetachVolume(name, volumeName string) (*vm.VM, error) {
+	l, err := m.lockVM(name)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+
+	v, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if v.Volume(volumeName) == nil {
+		return nil, notFoundf("volume '%s' is not attached to VM '%s'", volumeName, name)
+	}
+	if v.State.Active() {
+		return nil, conflictf("VM '%s' must be stopped to detach a volume (state: %s)", name, v.State)
+	}
+
+	var kept []vm.VolumeAttachment
+	for _, att := range v.Volumes {
+		if att.Name != volumeName {
+			kept = append(kept, att)
+		}
+	}
+	v.Volumes = kept
+	if err := v.Save(m.cfg.GetPaths().VMs); err != nil {
+		return nil, fmt.Errorf("failed to save VM state: %w", err)
+	}
+	return v, nil
+}
+
+// ResizeVolume grows a volume and its filesystem to sizeMB. The VM it is
+// attached to, if any, must be stopped, and is kept stopped until the resize
+// is done.
+func (m *Manager) ResizeVolume(name string, sizeMB int) (*volume.Volume, error) {
+	if err := validate.VolumeName(name); err != nil {
+		return nil, err
+	}
+	if err := validate.VolumeSizeMB(sizeMB); err != nil {
+		return nil, err
+	}
+	vol, err := m.getVolume(name)
+	if err != nil {
+		return nil, err
+	}
+	if sizeMB < vol.SizeMB {
+		return nil, conflictf("volume '%s' is %d MB and cannot be shrunk to %d MB", name, vol.SizeMB, sizeMB)
+	}
+
+	// The VM's lock is taken before the global lock, as in AttachVolume
+	paths := m.cfg.GetPaths()
+	user, err := vm.VolumeUser(paths.VMs, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list VMs: %w", err)
+	}
+	if user != "" {
+		l, err := m.lockVM(user)
+		if err != nil {
+			return nil, err
+		}
+		defer l.Unlock()
+	}
+	gl, err := lock.Global(paths.State, globalLockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer gl.Unlock()
+
+	if current, err := vm.VolumeUser(paths.VMs, name); err != nil {
+		return nil, fmt.Errorf("failed to list VMs: %w", err)
+	} else if current != user {
+		return nil, conflictf("volume '%s' was attached or detached while resizing; try again", name)
+	}
+	if user != "" {
+		v, err := m.Get(user)
+		if err != nil {
+			return nil, err
+		}
+		if v.State.Active() {
+			return nil, conflictf("volume '%s' is attached to VM '%s', which must be stopped to resize it (state: %s)", name, user, v.State)
+		}
+	}
+	return m.volumes.Resize(name, sizeMB)
+}
+
+// DeleteVolume deletes a volume and its data. It must not be attached to a
+// VM.
+func (m *Manager) DeleteVolume(name string) error {
+	if err := validate.VolumeName(name); err != nil {
+		return err
+	}
+	// AttachVolume checks the volume is free under the same lock
+	paths := m.cfg.GetPaths()
+	gl, err := lock.Global(paths.State, globalLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer gl.Unlock()
+
+	if _, err := m.getVolume(name); err != nil {
+		return err
+	}
+	user, err := vm.VolumeUser(paths.VMs, name)
+	if err != nil {
+		return fmt.Errorf("failed to list VMs: %w", err)
+	}
+	if user != "" {
+		return conflictf("volume '%s' is attached to VM '%s'; detach it first", name, user)
+	}
+	return m.volumes.Delete(name)
+}
+
+// getVolume returns the named volume, reporting a missing one as
+// ErrNotFound.
+func (m *Manager) getVolume(name string) (*volume.Volume, error) {
+	vol, err := m.volumes.Get(name)
+	if errors.Is(err, volume.ErrVolumeNotFound) {
+		return nil, notFoundf("volume '%s' not found", name)
+	}
+	return vol, err
+}
+
+// prepareVolumes returns the drives of a VM's volumes and the fstab entries
+// that mount them by filesystem UUID, so their mount points do not depend on
+// the device names the guest gives them.
+func (m *Manager) prepareVolumes(v *vm.VM) ([]firecracker.MountDrive, []image.MountEntry, error) {
+	var drives []firecracker.MountDrive
+	var entries []image.MountEntry
+	for _, att := range v.Volumes {
+		vol, err := m.volumes.Get(att.Name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to find volume '%s': %w", att.Name, err)
+		}
+		drives = append(drives, firecracker.MountDrive{
+			ImagePath: m.volumes.ImagePath(att.Name),
+			Tag:       att.Name,
+			ReadOnly:  att.ReadOnly,
+		})
+		entries = append(entries, image.MountEntry{
+			Device:    "UUID=" + vol.UUID,
+			MountPath: att.MountPath,
+			ReadOnly:  att.ReadOnly,
+		})
+	}
+	return drives, entries, nil
+}
@@ -0,0 +1,101 @@
+// Package lock provides advisory file locks that serialise changes to VM state
+// across processes. vmm, vmm-web and vmmd all take the same flock(2) locks on
+// files under the state directory, so a CLI command racing a web request gets
+// a clear error instead of a duplicate IP or a lost write.
+//
+// flock locks belong to the open file, not the process, so two goroutines in
+// the same process that each take a lock also exclude each other.
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// ErrBusy is returned when a lock is held by another operation.
+var ErrBusy = errors.New("busy")
+
+// pollInterval is how often a waiting caller retries a held lock.
+const pollInterval = 50 * time.Millisecond
+
+// busyError describes which lock is held while still matching ErrBusy.
+type busyError struct {
+	msg string
+}
+
+func (e *busyError) Error() string { return e.msg }
+func (e *busyError) Unwrap() error { return ErrBusy }
+
+// Lock is a held advisory lock. Release it with Unlock.
+type Lock struct {
+	f *os.File
+}
+
+// Dir returns the directory holding lock files under stateDir.
+func Dir(stateDir string) string {
+	return filepath.Join(stateDir, "locks")
+}
+
+// VM takes the exclusive lock for a single VM. It does not wait: if another
+// operation holds the lock, the returned error matches ErrBusy.
+func VM(stateDir, name string) (*Lock, error) {
+	l, err := acquire(filepath.Join(Dir(stateDir), "vm-"+name+".lock"), 0)
+	if errors.Is(err, ErrBusy) {
+		return nil, &busyError{msg: fmt.Sprintf("VM '%s' is busy: another operation is in progress", name)}
+	}
+	return l, err
+}
+
+// Global takes the host-wide lock that guards resources shared between VMs,
+// such as IP allocation. It waits up to timeout for the lock.
+func Global(stateDir string, timeout time.Duration) (*Lock, error) {
+	l, err := acquire(filepath.Join(Dir(stateDir), "global.lock"), timeout)
+	if errors.Is(err, ErrBusy) {
+		return nil, &busyError{msg: "host is busy: timed out waiting for another operation to finish allocating resources"}
+	}
+	return l, err
+}
+
+// Unlock releases the lock. It is safe to call on a nil Lock.
+func (l *Lock) Unlock() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
+
+func acquire(path string, timeout time.Duration) (*Lock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return &Lock{f: f}, nil
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+		if !time.Now().Before(deadline) {
+			f.Close()
+			return nil, ErrBusy
+		}
+		time.Sleep(pollInterval)
+	}
+}
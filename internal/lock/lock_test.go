@@ -0,0 +1,71 @@
+package lock
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVMLockIsExclusive(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := VM(dir, "web")
+	if err != nil {
+		t.Fatalf("VM() error: %v", err)
+	}
+
+	_, err = VM(dir, "web")
+	if !errors.Is(err, ErrBusy) {
+		t.Fatalf("second VM() error = %v, want ErrBusy", err)
+	}
+	if !strings.Contains(err.Error(), "VM 'web' is busy") {
+		t.Errorf("error = %q, want it to name the busy VM", err)
+	}
+
+	// Other VMs are independent
+	other, err := VM(dir, "db")
+	if err != nil {
+		t.Fatalf("VM() for another VM error: %v", err)
+	}
+	other.Unlock()
+
+	if err := l.Unlock(); err != nil {
+		t.Fatalf("Unlock() error: %v", err)
+	}
+	again, err := VM(dir, "web")
+	if err != nil {
+		t.Fatalf("VM() after Unlock error: %v", err)
+	}
+	again.Unlock()
+}
+
+func TestGlobalLockWaits(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := Global(dir, 0)
+	if err != nil {
+		t.Fatalf("Global() error: %v", err)
+	}
+
+	if _, err := Global(dir, 100*time.Millisecond); !errors.Is(err, ErrBusy) {
+		t.Fatalf("Global() while held error = %v, want ErrBusy", err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		l.Unlock()
+	}()
+	waited, err := Global(dir, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Global() should succeed once released: %v", err)
+	}
+	waited.Unlock()
+}
+
+func TestUnlockNil(t *testing.T) {
+	var l *Lock
+	if err := l.Unlock(); err != nil {
+		t.Errorf("Unlock() on nil Lock error = %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+package nameserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sys/unix"
+)
+
+// Domain is the zone answered from VM state: each VM is <name>.vmm.internal.
+const Domain = "vmm.internal"
+
+// recordTTL is kept short so VMs see address changes after a restart quickly.
+const recordTTL = 5
+
+// forwardTimeout bounds each attempt to reach an upstream server.
+const forwardTimeout = 3 * time.Second
+
+// LookupFunc returns the addresses of a VM for a query from client, or nil if
+// there is no VM with that name. Names are matched case-insensitively.
+type LookupFunc func(name string, client net.IP) []net.IP
+
+// Server is a DNS forwarder that answers names in the vmm.internal zone, and
+// single-label VM names, from VM state and passes every other query to the
+// upstream servers.
+type Server struct {
+	lookup   LookupFunc
+	upstream []string
+
+	mu        sync.Mutex
+	listeners map[string][]*dns.Server
+}
+
+// New returns a Server that resolves VM names with lookup and forwards other
+// queries to upstream, a list of host:port addresses tried in order.
+func New(lookup LookupFunc, upstream []string) *Server {
+	return &Server{
+		lookup:    lookup,
+		upstream:  upstream,
+		listeners: make(map[string][]*dns.Server),
+	}
+}
+
+// Sync makes the server listen on exactly the given host:port addresses over
+// UDP and TCP, starting listeners for new addresses and shutting down those
+// no longer wanted. Addresses may belong to bridges that do not exist yet;
+// they start receiving queries as soon as the bridge comes up.
+func (s *Server) Sync(addrs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted := make(map[string]bool)
+	var errs []error
+	for _, addr := range addrs {
+		wanted[addr] = true
+		if _, ok := s.listeners[addr]; ok {
+			continue
+		}
+		servers, err := s.listen(addr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		s.listeners[addr] = servers
+	}
+	for addr, servers := range s.listeners {
+		if wanted[addr] {
+			continue
+		}
+		for _, srv := range servers {
+			shutdown(srv)
+		}
+		delete(s.listeners, addr)
+	}
+	return errors.Join(errs...)
+}
+
+// Addrs returns the addresses the server is listening on.
+func (s *Server) Addrs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var addrs []string
+	for addr := range s.listeners {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Close shuts down all listeners.
+func (s *Server) Close() {
+	s.Sync(nil)
+}
+
+// listen starts a UDP and a TCP server on addr.
+func (s *Server) listen(addr string) ([]*dns.Server, error) {
+	lc := net.ListenConfig{Control: freebind}
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s/udp: %w", addr, err)
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("failed to listen on %s/tcp: %w", addr, err)
+	}
+
+	servers := []*dns.Server{
+		{PacketConn: pc, Handler: s},
+		{Listener: ln, Handler: s},
+	}
+	for _, srv := range servers {
+		go func(srv *dns.Server) {
+			if err := srv.ActivateAndServe(); err != nil {
+				log.Printf("dns: server on %s stopped: %v", addr, err)
+			}
+		}(srv)
+	}
+	return servers, nil
+}
+
+// shutdown stops srv, closing its socket directly if it has not started
+// serving yet.
+func shutdown(srv *dns.Server) {
+	if err := srv.Shutdown(); err == nil {
+		return
+	}
+	if srv.PacketConn != nil {
+		srv.PacketConn.Close()
+	}
+	if srv.Listener != nil {
+		srv.Listener.Close()
+	}
+}
+
+// freebind lets a socket bind to an address that is not assigned yet, such
+// as the gateway of a network whose bridge is created when its first VM
+// starts.
+func freebind(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if strings.HasSuffix(network, "6") {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_FREEBIND, 1)
+		} else {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_FREEBIND, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// ServeDNS answers a query. It implements dns.Handler.
+func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 {
+		reply := new(dns.Msg)
+		reply.SetRcode(req, dns.RcodeFormatError)
+		w.WriteMsg(reply)
+		return
+	}
+
+	if reply := s.answer(req, clientIP(w.RemoteAddr())); reply != nil {
+		w.WriteMsg(reply)
+		return
+	}
+	w.WriteMsg(s.forward(req, w.LocalAddr().Network()))
+}
+
+// answer resolves a query for a VM name, or returns nil if it has to be
+// forwarded. Every name under the vmm.internal zone is answered here, while a
+// single-label name is only answered if a VM has that name, so that bare
+// names like <cluster>-control-plane resolve without the search domain.
+func (s *Server) answer(req *dns.Msg, client net.IP) *dns.Msg {
+	q := req.Question[0]
+	name := strings.TrimSuffix(strings.ToLower(q.Name), ".")
+	zone := name == Domain || strings.HasSuffix(name, "."+Domain)
+	if !zone && (name == "" || strings.Contains(name, ".")) {
+		return nil
+	}
+	host := strings.TrimSuffix(strings.TrimSuffix(name, Domain), ".")
+
+	var ips []net.IP
+	if host != "" {
+		ips = s.lookup(host, client)
+	}
+	if !zone && len(ips) == 0 {
+		return nil
+	}
+
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	reply.Authoritative = true
+	reply.RecursionAvailable = true
+	if host != "" && len(ips) == 0 {
+		reply.Rcode = dns.RcodeNameError
+		return reply
+	}
+	for _, ip := range ips {
+		hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: recordTTL}
+		if v4 := ip.To4(); v4 != nil {
+			if q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY {
+				hdr.Rrtype = dns.TypeA
+				reply.Answer = append(reply.Answer, &dns.A{Hdr: hdr, A: v4})
+			}
+		} else if q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY {
+			hdr.Rrtype = dns.TypeAAAA
+			reply.Answer = append(reply.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return reply
+}
+
+// forward passes a query to each upstream server in turn over the transport
+// it arrived on, and returns the first reply.
+func (s *Server) forward(req *dns.Msg, network string) *dns.Msg {
+	client := &dns.Client{Net: "udp", Timeout: forwardTimeout}
+	if strings.HasPrefix(network, "tcp") {
+		client.Net = "tcp"
+	}
+	for _, upstream := range s.upstream {
+		reply, _, err := client.Exchange(req, upstream)
+		if err != nil {
+			continue
+		}
+		return reply
+	}
+	reply := new(dns.Msg)
+	reply.SetRcode(req, dns.RcodeServerFailure)
+	return reply
+}
+
+// clientIP extracts the IP address of a query's sender.
+func clientIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package nameserver
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/raesene/baremetalvmm/internal/cluster"
+	"github.com/raesene/baremetalvmm/internal/network"
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+// recorder is a dns.ResponseWriter that keeps the reply.
+type recorder struct {
+	dns.ResponseWriter
+	network string
+	reply   *dns.Msg
+}
+
+func (r *recorder) LocalAddr() net.Addr {
+	if r.network == "tcp" {
+		return &net.TCPAddr{IP: net.ParseIP("172.16.0.1"), Port: 53}
+	}
+	return &net.UDPAddr{IP: net.ParseIP("172.16.0.1"), Port: 53}
+}
+
+func (r *recorder) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("172.16.0.9"), Port: 40000}
+}
+
+func (r *recorder) WriteMsg(m *dns.Msg) error {
+	r.reply = m
+	return nil
+}
+
+func query(t *testing.T, s *Server, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	w := &recorder{network: "udp"}
+	s.ServeDNS(w, req)
+	if w.reply == nil {
+		t.Fatalf("no reply to %s", name)
+	}
+	return w.reply
+}
+
+// startUpstream runs a DNS server on loopback that answers every A query
+// with 192.0.2.1, and returns its address.
+func startUpstream(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{
+		PacketConn:        pc,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			reply := new(dns.Msg)
+			reply.SetReply(req)
+			reply.Answer = append(reply.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("192.0.2.1"),
+			})
+			w.WriteMsg(reply)
+		}),
+	}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func staticLookup(records map[string][]string) LookupFunc {
+	return func(name string, client net.IP) []net.IP {
+		var ips []net.IP
+		for _, addr := range records[name] {
+			ips = append(ips, net.ParseIP(addr))
+		}
+		return ips
+	}
+}
+
+func answers(m *dns.Msg) []string {
+	var got []string
+	for _, rr := range m.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			got = append(got, rr.A.String())
+		case *dns.AAAA:
+			got = append(got, rr.AAAA.String())
+		}
+	}
+	return got
+}
+
+func TestServeDNS(t *testing.T) {
+	s := New(staticLookup(map[string][]string{
+		"web":                  {"172.16.0.2", "fd00:db8::ac10:2"},
+		"demo-control-plane":   {"172.16.0.3"},
+		"db.example-with-dots": {"172.16.0.4"},
+	}), []string{startUpstream(t)})
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		wantRcode int
+		want      []string
+	}{
+		{name: "VM A record", qname: "web.vmm.internal", qtype: dns.TypeA, want: []string{"172.16.0.2"}},
+		{name: "VM AAAA record", qname: "web.vmm.internal", qtype: dns.TypeAAAA, want: []string{"fd00:db8::ac10:2"}},
+		{name: "case-insensitive", qname: "WEB.VMM.Internal", qtype: dns.TypeA, want: []string{"172.16.0.2"}},
+		{name: "no record of type", qname: "demo-control-plane.vmm.internal", qtype: dns.TypeAAAA},
+		{name: "VM name with dots", qname: "db.example-with-dots.vmm.internal", qtype: dns.TypeA, want: []string{"172.16.0.4"}},
+		{name: "unknown VM", qname: "nope.vmm.internal", qtype: dns.TypeA, wantRcode: dns.RcodeNameError},
+		{name: "zone apex", qname: "vmm.internal", qtype: dns.TypeA},
+		{name: "bare VM name", qname: "demo-control-plane", qtype: dns.TypeA, want: []string{"172.16.0.3"}},
+		{name: "bare unknown name is forwarded", qname: "localhost-ish", qtype: dns.TypeA, want: []string{"192.0.2.1"}},
+		{name: "other names are forwarded", qname: "example.com", qtype: dns.TypeA, want: []string{"192.0.2.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := query(t, s, tt.qname, tt.qtype)
+			if reply.Rcode != tt.wantRcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[reply.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+			if got := answers(reply); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("answers = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardFailure(t *testing.T) {
+	// Nothing listens on the upstream, so the query fails
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := pc.LocalAddr().String()
+	pc.Close()
+
+	s := New(staticLookup(nil), []string{upstream})
+	if reply := query(t, s, "example.com", dns.TypeA); reply.Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode = %s, want SERVFAIL", dns.RcodeToString[reply.Rcode])
+	}
+}
+
+func TestStateLookup(t *testing.T) {
+	vmDir, clusterDir := t.TempDir(), t.TempDir()
+	networks := network.NewRegistry(t.TempDir(), network.Definition{
+		Bridge:  "vmm-br0",
+		Subnet:  "172.16.0.0/16",
+		Gateway: "172.16.0.1",
+		Mode:    network.ModeNAT,
+	})
+	if err := networks.Create(&network.Definition{Name: "lab", Bridge: "vmm-lab", Subnet: "10.66.0.0/24", Gateway: "10.66.0.1", Mode: network.ModeIsolated}); err != nil {
+		t.Fatal(err)
+	}
+
+	router := vm.NewVM("Router")
+	router.NIC = vm.NIC{IPAddress: "172.16.0.2", IPv6Address: "fd00:db8::ac10:2"}
+	router.NICs = []vm.NIC{{Network: "lab", IPAddress: "10.66.0.254"}}
+	if err := router.Save(vmDir); err != nil {
+		t.Fatal(err)
+	}
+	cl := cluster.NewCluster("demo", 0, "1.31.0", cluster.DistroKubeadm, "")
+	cl.ControlPlaneIP = "172.16.0.10"
+	if err := cl.Save(clusterDir); err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := StateLookup(vmDir, clusterDir, networks)
+	tests := []struct {
+		name   string
+		host   string
+		client string
+		want   []string
+	}{
+		{name: "primary interface", host: "router", client: "172.16.0.9", want: []string{"172.16.0.2", "fd00:db8::ac10:2"}},
+		{name: "client's network", host: "router", client: "10.66.0.7", want: []string{"10.66.0.254"}},
+		{name: "client on no network", host: "router", client: "192.0.2.1", want: []string{"172.16.0.2", "fd00:db8::ac10:2"}},
+		{name: "cluster control plane", host: "demo-control-plane", client: "172.16.0.9", want: []string{"172.16.0.10"}},
+		{name: "unknown", host: "nope", client: "172.16.0.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, ip := range lookup(tt.host, net.ParseIP(tt.client)) {
+				got = append(got, ip.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lookup(%q) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListenAddrs(t *testing.T) {
+	networks := network.NewRegistry(t.TempDir(), network.Definition{
+		Bridge:  "vmm-br0",
+		Subnet:  "172.16.0.0/16",
+		Gateway: "172.16.0.1",
+		Subnet6: "fd00:db8::/64",
+		Mode:    network.ModeNAT,
+	})
+	if err := networks.Create(&network.Definition{Name: "lab", Bridge: "vmm-lab", Subnet: "10.66.0.0/24", Gateway: "10.66.0.1", Mode: network.ModeIsolated}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ListenAddrs(networks)
+	if err != nil {
+		t.Fatalf("ListenAddrs() error: %v", err)
+	}
+	want := []string{"172.16.0.1:53", "[fd00:db8::ac10:1]:53", "10.66.0.1:53"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListenAddrs() = %v, want %v", got, want)
+	}
+}
+
+func TestUpstream(t *testing.T) {
+	got := Upstream([]string{"10.0.0.53", "192.0.2.53:5353", "2001:db8::53"}, nil)
+	want := []string{"10.0.0.53:53", "192.0.2.53:5353", "[2001:db8::53]:53"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Upstream() = %v, want %v", got, want)
+	}
+}
+
+func TestSync(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+
+	s := New(staticLookup(map[string][]string{"web": {"172.16.0.2"}}), nil)
+	// 192.0.2.53 is not assigned to this host, so it needs IP_FREEBIND
+	if err := s.Sync([]string{addr, "192.0.2.53:5353"}); err != nil {
+		t.Fatalf("Sync() error: %v", err)
+	}
+	defer s.Close()
+	if got := s.Addrs(); len(got) != 2 {
+		t.Errorf("Addrs() = %v, want two addresses", got)
+	}
+
+	for _, proto := range []string{"udp", "tcp"} {
+		req := new(dns.Msg)
+		req.SetQuestion("web.vmm.internal.", dns.TypeA)
+		reply, _, err := (&dns.Client{Net: proto}).Exchange(req, addr)
+		if err != nil {
+			t.Fatalf("%s query error: %v", proto, err)
+		}
+		if got := answers(reply); !reflect.DeepEqual(got, []string{"172.16.0.2"}) {
+			t.Errorf("%s answers = %v, want [172.16.0.2]", proto, got)
+		}
+	}
+
+	if err := s.Sync([]string{addr}); err != nil {
+		t.Fatalf("Sync() error: %v", err)
+	}
+	if got := s.Addrs(); !reflect.DeepEqual(got, []string{addr}) {
+		t.Errorf("Addrs() after removal = %v, want [%s]", got, addr)
+	}
+}
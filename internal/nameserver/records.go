@@ -0,0 +1,156 @@
+package nameserver
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/raesene/baremetalvmm/internal/cluster"
+	"github.com/raesene/baremetalvmm/internal/network"
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+// Port is the DNS port the server listens on at each gateway.
+const Port = "53"
+
+// hostResolvConf is read for upstream servers when none are configured.
+const hostResolvConf = "/etc/resolv.conf"
+
+// StateLookup returns a LookupFunc that resolves VM names from the state
+// files in vmDir, falling back to the control-plane address recorded for
+// clusters in clusterDir. A VM with interfaces on several networks resolves
+// to its addresses on the client's network, or to those of its primary
+// interface for clients on none of them. VMs resolve whether or not they are
+// running, since their leased addresses stay the same.
+func StateLookup(vmDir, clusterDir string, networks *network.Registry) LookupFunc {
+	return func(name string, client net.IP) []net.IP {
+		vms, _ := vm.List(vmDir)
+		for _, v := range vms {
+			if strings.EqualFold(v.Name, name) {
+				return vmAddresses(v, client, networks)
+			}
+		}
+		clusters, _ := cluster.List(clusterDir)
+		for _, c := range clusters {
+			if strings.EqualFold(c.ControlPlaneVM, name) {
+				if ip := net.ParseIP(c.ControlPlaneIP); ip != nil {
+					return []net.IP{ip}
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// vmAddresses picks the addresses of the VM interface on the client's
+// network, or of the primary interface.
+func vmAddresses(v *vm.VM, client net.IP, networks *network.Registry) []net.IP {
+	nics := v.Interfaces()
+	nic := nics[0]
+	for _, n := range nics {
+		if d, err := networks.Get(n.Network); err == nil && onNetwork(d, client) {
+			nic = n
+			break
+		}
+	}
+	var ips []net.IP
+	for _, addr := range nic.Addresses() {
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// onNetwork reports whether ip is in either of the network's subnets.
+func onNetwork(d *network.Definition, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, subnet := range []string{d.Subnet, d.Subnet6} {
+		if _, ipnet, err := net.ParseCIDR(subnet); err == nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListenAddrs returns the addresses to serve DNS on: the gateway of every
+// network, and its IPv6 gateway on dual-stack networks.
+func ListenAddrs(networks *network.Registry) ([]string, error) {
+	defs, err := networks.List()
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, d := range defs {
+		addrs = append(addrs, net.JoinHostPort(d.Gateway, Port))
+		if gw6 := d.Gateway6(); gw6 != "" {
+			addrs = append(addrs, net.JoinHostPort(gw6, Port))
+		}
+	}
+	return addrs, nil
+}
+
+// Upstream returns the host:port addresses to forward queries to. Configured
+// servers are used if there are any, otherwise the host's own resolvers from
+// /etc/resolv.conf, and failing that the public servers VMs used to be given.
+func Upstream(configured, fallback []string) []string {
+	servers := configured
+	if len(servers) == 0 {
+		if cc, err := dns.ClientConfigFromFile(hostResolvConf); err == nil {
+			servers = cc.Servers
+		}
+	}
+	if len(servers) == 0 {
+		servers = fallback
+	}
+	var upstream []string
+	for _, s := range servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, Port)
+		}
+		upstream = append(upstream, s)
+	}
+	return upstream
+}
+
+// Serve answers queries on the gateway of every network until ctx is
+// cancelled, checking every interval for networks that were created or
+// deleted.
+func (s *Server) Serve(ctx context.Context, networks *network.Registry, interval time.Duration) {
+	defer s.Close()
+
+	var lastErr string
+	refresh := func() {
+		addrs, err := ListenAddrs(networks)
+		if err == nil {
+			err = s.Sync(addrs)
+		}
+		// Report a failure once, not on every retry
+		msg := ""
+		if err != nil {
+			msg = err.Error()
+			if msg != lastErr {
+				log.Printf("dns: %v", err)
+			}
+		}
+		lastErr = msg
+	}
+
+	refresh()
+	log.Printf("dns: serving %s on %s", Domain, strings.Join(s.Addrs(), ", "))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			refresh()
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Backend performs the host changes a Manager needs: creating links and
+// addresses, and maintaining packet filter and NAT rules. NewHostBackend
+// returns the implementation that talks to the kernel over netlink and
+// nftables; FakeBackend records changes in memory for tests.
+type Backend interface {
+	// LinkExists reports whether a network interface with the name exists.
+	LinkExists(name string) bool
+	// CreateBridge creates a bridge, assigns it address (CIDR notation)
+	// and brings it up.
+	CreateBridge(name, address string) error
+	// CreateTap creates a persistent TAP device attached to bridge and
+	// brings it up.
+	CreateTap(name, bridge string) error
+	// DeleteLink removes a network interface.
+	DeleteLink(name string) error
+	// RenameLink renames a network interface, taking it down for the
+	// rename and bringing it back up.
+	RenameLink(name, newName string) error
+	// AddAddress assigns an address (CIDR notation) to a link. Adding an
+	// address the link already has does nothing.
+	AddAddress(name, address string) error
+	// EnableIPForwarding turns on IPv4 forwarding for the host.
+	EnableIPForwarding() error
+	// EnableIPv6Forwarding turns on IPv6 forwarding for the host while
+	// keeping router advertisements accepted on hostInterface, so the host
+	// does not lose an autoconfigured default route.
+	EnableIPv6Forwarding(hostInterface string) error
+	// SetRouteLocalnet sets whether connections from 127.0.0.0/8 may be
+	// routed out of the named interface once they are NATed, which port
+	// forwards reached through localhost rely on.
+	SetRouteLocalnet(name string, enabled bool) error
+
+	// SetRules atomically replaces every rule previously set for owner
+	// with rules. An empty rules removes them.
+	SetRules(owner string, rules []Rule) error
+	// AddPortForward adds the DNAT rules for pf, for connections arriving
+	// at the host and for those made from the host itself. They replace
+	// any rules for the same protocol, host ports and address family, so
+	// re-adding a forward after the guest's address changed re-targets it.
+	AddPortForward(pf PortForward) error
+	// RemovePortForward removes the DNAT rules for pf's protocol, host
+	// ports and address family. Removing rules that are not present does
+	// nothing.
+	RemovePortForward(pf PortForward) error
+	// SetFirewall atomically replaces the firewall for a TAP device. A nil
+	// fw removes it.
+	SetFirewall(tap string, fw *Firewall) error
+}
+
+// Hook is the point in packet processing at which a Rule is evaluated.
+type Hook string
+
+const (
+	HookInput       Hook = "input"
+	HookForward     Hook = "forward"
+	HookPostrouting Hook = "postrouting"
+)
+
+// Verdict is what a Rule does with a matching packet.
+type Verdict string
+
+const (
+	VerdictAccept     Verdict = "accept"
+	VerdictDrop       Verdict = "drop"
+	VerdictMasquerade Verdict = "masquerade"
+)
+
+// Rule is a packet filter or NAT rule in backend-neutral form. Empty match
+// fields match any packet.
+type Rule struct {
+	Hook        Hook
+	Source      string // source subnet (CIDR)
+	Destination string // destination subnet (CIDR)
+	InIface     string
+	NotInIface  string
+	OutIface    string
+	NotOutIface string
+	Established bool // only packets of established or related connections
+	NotDNAT     bool // only packets of connections that were not DNATed
+	Verdict     Verdict
+}
+
+// String renders the rule in nft syntax, prefixed by its hook.
+func (r Rule) String() string {
+	parts := []string{string(r.Hook)}
+	if r.Source != "" {
+		parts = append(parts, cidrFamily(r.Source)+" saddr "+r.Source)
+	}
+	if r.Destination != "" {
+		parts = append(parts, cidrFamily(r.Destination)+" daddr "+r.Destination)
+	}
+	if r.InIface != "" {
+		parts = append(parts, fmt.Sprintf("iifname %q", r.InIface))
+	}
+	if r.NotInIface != "" {
+		parts = append(parts, fmt.Sprintf("iifname != %q", r.NotInIface))
+	}
+	if r.OutIface != "" {
+		parts = append(parts, fmt.Sprintf("oifname %q", r.OutIface))
+	}
+	if r.NotOutIface != "" {
+		parts = append(parts, fmt.Sprintf("oifname != %q", r.NotOutIface))
+	}
+	if r.Established {
+		parts = append(parts, "ct state established,related")
+	}
+	if r.NotDNAT {
+		parts = append(parts, "ct status & dnat == 0")
+	}
+	parts = append(parts, string(r.Verdict))
+	return strings.Join(parts, " ")
+}
+
+// cidrFamily returns the nft family keyword, ip or ip6, of a subnet.
+func cidrFamily(cidr string) string {
+	if ip, _, err := net.ParseCIDR(cidr); err == nil && ip.To4() == nil {
+		return "ip6"
+	}
+	return "ip"
+}
+
+// PortForward is a DNAT rule sending connections to a host port, or a
+// range of host ports, on to a guest. A range is forwarded to the same
+// number of consecutive guest ports starting at GuestPort. The guest address
+// may be IPv4 or IPv6; the rule only matches connections of the same family.
+type PortForward struct {
+	Protocol    string
+	HostPort    int
+	HostPortEnd int // last port of a host port range; 0 for a single port
+	GuestIP     string
+	GuestPort   int
+}
+
+// lastHostPort returns the last host port forwarded.
+func (p PortForward) lastHostPort() int {
+	if p.HostPortEnd == 0 {
+		return p.HostPort
+	}
+	return p.HostPortEnd
+}
+
+// Validate checks the protocol, ports and guest address.
+func (p PortForward) Validate() error {
+	if p.Protocol != "tcp" && p.Protocol != "udp" {
+		return fmt.Errorf("unsupported protocol %q", p.Protocol)
+	}
+	if p.HostPort < 1 || p.HostPort > 65535 {
+		return fmt.Errorf("invalid host port %d: must be 1-65535", p.HostPort)
+	}
+	if p.HostPortEnd != 0 && (p.HostPortEnd <= p.HostPort || p.HostPortEnd > 65535) {
+		return fmt.Errorf("invalid host port range %d-%d", p.HostPort, p.HostPortEnd)
+	}
+	if p.GuestPort < 1 || p.GuestPort+p.lastHostPort()-p.HostPort > 65535 {
+		return fmt.Errorf("invalid guest port %d: must be 1-65535", p.GuestPort)
+	}
+	if net.ParseIP(p.GuestIP) == nil {
+		return fmt.Errorf("invalid guest IP %q", p.GuestIP)
+	}
+	return nil
+}
+
+// owner identifies the host ports the forward claims, independently of the
+// guest, e.g. "tcp 8000-8010 ip6".
+func (p PortForward) owner() string {
+	family := "ip"
+	if ip := net.ParseIP(p.GuestIP); ip != nil && ip.To4() == nil {
+		family = "ip6"
+	}
+	return fmt.Sprintf("%s %s %s", p.Protocol, p.hostPorts(), family)
+}
+
+// hostPorts renders the host port or range, e.g. "8080" or "8000-8010".
+func (p PortForward) hostPorts() string {
+	if p.HostPortEnd == 0 {
+		return strconv.Itoa(p.HostPort)
+	}
+	return fmt.Sprintf("%d-%d", p.HostPort, p.HostPortEnd)
+}
+
+// String renders the port forward in nft syntax.
+func (p PortForward) String() string {
+	guestPorts := strconv.Itoa(p.GuestPort)
+	if p.HostPortEnd != 0 {
+		guestPorts = fmt.Sprintf("%d-%d", p.GuestPort, p.GuestPort+p.HostPortEnd-p.HostPort)
+	}
+	return fmt.Sprintf("%s dport %s dnat to %s", p.Protocol, p.hostPorts(), net.JoinHostPort(p.GuestIP, guestPorts))
+}
@@ -0,0 +1,290 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// DefaultNetwork is the name of the network described by the bridge, subnet
+// and gateway in the main config. VMs with no network are attached to it.
+const DefaultNetwork = "default"
+
+// maxBridgeNameLen is the longest interface name the kernel accepts.
+const maxBridgeNameLen = 15
+
+// Mode controls what traffic a network may exchange beyond its own bridge.
+type Mode string
+
+const (
+	// ModeNAT masquerades outbound traffic behind the host interface.
+	ModeNAT Mode = "nat"
+	// ModeRouted forwards traffic to and from the host interface without
+	// address translation, for subnets the upstream network routes to the
+	// host.
+	ModeRouted Mode = "routed"
+	// ModeIsolated drops all forwarded traffic, so VMs can only reach each
+	// other and the host.
+	ModeIsolated Mode = "isolated"
+)
+
+// ErrNetworkNotFound is returned when a named network does not exist.
+var ErrNetworkNotFound = errors.New("network not found")
+
+// Definition describes a named network: its bridge, addressing and how its
+// traffic leaves the host.
+type Definition struct {
+	Name      string    `json:"name"`
+	Bridge    string    `json:"bridge"`
+	Subnet    string    `json:"subnet"`
+	Gateway   string    `json:"gateway"`
+	Subnet6   string    `json:"subnet6,omitempty"` // IPv6 subnet for dual-stack networks
+	Mode      Mode      `json:"mode"`
+	IPExclude []string  `json:"ip_exclude,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+}
+
+// Manager returns a network manager for the definition's bridge.
+func (d *Definition) Manager(hostInterface string) *Manager {
+	m := NewManager(d.Bridge, d.Subnet, d.Gateway, hostInterface)
+	m.Subnet6 = d.Subnet6
+	m.Mode = d.Mode
+	return m
+}
+
+// IPv6Address returns the IPv6 address that goes with a VM's IPv4 address
+// on the network, or "" if the network is IPv4-only.
+func (d *Definition) IPv6Address(ipv4 string) (string, error) {
+	if d.Subnet6 == "" {
+		return "", nil
+	}
+	return IPv6Address(d.Subnet6, ipv4)
+}
+
+// Gateway6 returns the bridge's IPv6 address, or "" if the network is
+// IPv4-only.
+func (d *Definition) Gateway6() string {
+	gw, err := d.IPv6Address(d.Gateway)
+	if err != nil {
+		return ""
+	}
+	return gw
+}
+
+// IPAM returns the address manager holding the network's leases.
+func (d *Definition) IPAM(stateDir string) *IPAM {
+	return NewIPAM(stateDir, d.Name, d.Subnet, d.Gateway, d.IPExclude)
+}
+
+// Validate checks the definition's bridge name, subnets, gateway and mode.
+func (d *Definition) Validate() error {
+	if d.Bridge == "" || len(d.Bridge) > maxBridgeNameLen {
+		return fmt.Errorf("bridge name %q is invalid: must be 1-%d characters", d.Bridge, maxBridgeNameLen)
+	}
+	sub, err := parseSubnet(d.Subnet)
+	if err != nil {
+		return err
+	}
+	gw := net.ParseIP(d.Gateway)
+	if !sub.isHost(gw) {
+		return fmt.Errorf("gateway %s is not a usable address in subnet %s", d.Gateway, d.Subnet)
+	}
+	if d.Subnet6 != "" {
+		if err := ValidateSubnet6(d.Subnet6); err != nil {
+			return err
+		}
+	}
+	switch d.Mode {
+	case ModeNAT, ModeRouted, ModeIsolated:
+	default:
+		return fmt.Errorf("invalid network mode %q: must be nat, routed or isolated", d.Mode)
+	}
+	return ValidateExclusions(d.IPExclude)
+}
+
+// overlaps reports whether the two definitions' IPv4 subnets share any
+// address.
+func (d *Definition) overlaps(other *Definition) bool {
+	a, errA := parseSubnet(d.Subnet)
+	b, errB := parseSubnet(other.Subnet)
+	if errA != nil || errB != nil {
+		return false
+	}
+	return a.network <= b.broadcast && b.network <= a.broadcast
+}
+
+// overlaps6 reports whether the two definitions' IPv6 subnets share any
+// address.
+func (d *Definition) overlaps6(other *Definition) bool {
+	if d.Subnet6 == "" || other.Subnet6 == "" {
+		return false
+	}
+	return subnets6Overlap(d.Subnet6, other.Subnet6)
+}
+
+// Registry stores named network definitions as JSON files in a directory.
+// The default network is not stored; it is always the definition passed to
+// NewRegistry.
+type Registry struct {
+	dir        string
+	defaultNet Definition
+}
+
+// NewRegistry creates a registry over dir whose default network is def.
+func NewRegistry(dir string, def Definition) *Registry {
+	def.Name = DefaultNetwork
+	return &Registry{dir: dir, defaultNet: def}
+}
+
+// Get returns the named network. An empty name means the default network.
+func (r *Registry) Get(name string) (*Definition, error) {
+	if name == "" || name == DefaultNetwork {
+		def := r.defaultNet
+		return &def, nil
+	}
+	data, err := os.ReadFile(r.path(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: '%s'", ErrNetworkNotFound, name)
+		}
+		return nil, fmt.Errorf("failed to read network config: %w", err)
+	}
+	var d Definition
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal network config: %w", err)
+	}
+	return &d, nil
+}
+
+// List returns the default network followed by the named networks sorted by
+// name.
+func (r *Registry) List() ([]*Definition, error) {
+	def := r.defaultNet
+	defs := []*Definition{&def}
+
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return defs, nil
+		}
+		return nil, err
+	}
+	var named []*Definition
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		d, err := r.Get(entry.Name()[:len(entry.Name())-5])
+		if err != nil {
+			continue // Skip invalid configs
+		}
+		named = append(named, d)
+	}
+	sort.Slice(named, func(i, j int) bool { return named[i].Name < named[j].Name })
+	return append(defs, named...), nil
+}
+
+// Create validates and stores a new network. Its name, bridge and subnet must
+// not clash with any existing network, including the default one.
+func (r *Registry) Create(d *Definition) error {
+	if d.Name == DefaultNetwork {
+		return fmt.Errorf("network name '%s' is reserved", DefaultNetwork)
+	}
+	if err := d.Validate(); err != nil {
+		return err
+	}
+	existing, err := r.List()
+	if err != nil {
+		return fmt.Errorf("failed to list networks: %w", err)
+	}
+	for _, e := range existing {
+		switch {
+		case e.Name == d.Name:
+			return fmt.Errorf("network '%s' already exists", d.Name)
+		case e.Bridge == d.Bridge:
+			return fmt.Errorf("bridge %s is already used by network '%s'", d.Bridge, e.Name)
+		case d.overlaps(e):
+			return fmt.Errorf("subnet %s overlaps network '%s' (%s)", d.Subnet, e.Name, e.Subnet)
+		case d.overlaps6(e):
+			return fmt.Errorf("IPv6 subnet %s overlaps network '%s' (%s)", d.Subnet6, e.Name, e.Subnet6)
+		}
+	}
+
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = time.Now()
+	}
+	return r.save(d)
+}
+
+// Delete removes a named network's definition. The default network cannot be
+// deleted.
+func (r *Registry) Delete(name string) error {
+	if name == "" || name == DefaultNetwork {
+		return fmt.Errorf("the default network cannot be deleted")
+	}
+	if err := os.Remove(r.path(name)); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: '%s'", ErrNetworkNotFound, name)
+		}
+		return fmt.Errorf("failed to delete network config: %w", err)
+	}
+	return nil
+}
+
+func (r *Registry) path(name string) string {
+	return filepath.Join(r.dir, name+".json")
+}
+
+func (r *Registry) save(d *Definition) error {
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal network config: %w", err)
+	}
+	if err := os.MkdirAll(r.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create networks directory: %w", err)
+	}
+
+	tmpFile, err := os.CreateTemp(r.dir, ".network-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write network config: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+	if err := os.Rename(tmpPath, r.path(d.Name)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+	return nil
+}
+
+// DefaultBridgeName returns the bridge name used for a new network when none
+// is given: "vmm-" followed by the network name, cut to the kernel's limit.
+func DefaultBridgeName(network string) string {
+	name := "vmm-" + network
+	if len(name) > maxBridgeNameLen {
+		name = name[:maxBridgeNameLen]
+	}
+	return name
+}
+
+// DefaultGateway returns the first host address of subnet.
+func DefaultGateway(subnet string) (string, error) {
+	sub, err := parseSubnet(subnet)
+	if err != nil {
+		return "", err
+	}
+	return uintToIP(sub.network + 1).String(), nil
+}
@@ -0,0 +1,118 @@
+package network
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func newTestRegistry(t *testing.T) *Registry {
+	t.Helper()
+	return NewRegistry(t.TempDir(), Definition{
+		Bridge:  "vmm-br0",
+		Subnet:  "172.16.0.0/16",
+		Gateway: "172.16.0.1",
+		Mode:    ModeNAT,
+	})
+}
+
+func TestRegistryDefaultNetwork(t *testing.T) {
+	r := newTestRegistry(t)
+
+	for _, name := range []string{"", DefaultNetwork} {
+		d, err := r.Get(name)
+		if err != nil {
+			t.Fatalf("Get(%q) error: %v", name, err)
+		}
+		if d.Name != DefaultNetwork || d.Bridge != "vmm-br0" {
+			t.Errorf("Get(%q) = %+v, want the default network", name, d)
+		}
+	}
+
+	if err := r.Delete(DefaultNetwork); err == nil {
+		t.Error("Delete() of the default network should fail")
+	}
+}
+
+func TestRegistryCreate(t *testing.T) {
+	r := newTestRegistry(t)
+
+	lab := &Definition{Name: "lab", Bridge: "vmm-lab", Subnet: "10.66.0.0/24", Gateway: "10.66.0.1", Subnet6: "fd00:66::/64", Mode: ModeIsolated}
+	if err := r.Create(lab); err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+
+	got, err := r.Get("lab")
+	if err != nil {
+		t.Fatalf("Get() error: %v", err)
+	}
+	if got.Subnet != "10.66.0.0/24" || got.Subnet6 != "fd00:66::/64" || got.Mode != ModeIsolated || got.CreatedAt.IsZero() {
+		t.Errorf("Get() = %+v, want the stored lab network", got)
+	}
+
+	defs, err := r.List()
+	if err != nil {
+		t.Fatalf("List() error: %v", err)
+	}
+	if len(defs) != 2 || defs[0].Name != DefaultNetwork || defs[1].Name != "lab" {
+		t.Errorf("List() = %v, want [default lab]", defs)
+	}
+
+	tests := []struct {
+		name    string
+		def     Definition
+		wantErr string
+	}{
+		{"reserved name", Definition{Name: DefaultNetwork, Bridge: "vmm-x", Subnet: "10.1.0.0/24", Gateway: "10.1.0.1", Mode: ModeNAT}, "reserved"},
+		{"duplicate name", Definition{Name: "lab", Bridge: "vmm-x", Subnet: "10.1.0.0/24", Gateway: "10.1.0.1", Mode: ModeNAT}, "already exists"},
+		{"duplicate bridge", Definition{Name: "dev", Bridge: "vmm-lab", Subnet: "10.1.0.0/24", Gateway: "10.1.0.1", Mode: ModeNAT}, "already used"},
+		{"overlapping subnet", Definition{Name: "dev", Bridge: "vmm-dev", Subnet: "172.16.5.0/24", Gateway: "172.16.5.1", Mode: ModeNAT}, "overlaps network 'default'"},
+		{"gateway outside subnet", Definition{Name: "dev", Bridge: "vmm-dev", Subnet: "10.1.0.0/24", Gateway: "10.2.0.1", Mode: ModeNAT}, "gateway"},
+		{"bridge name too long", Definition{Name: "dev", Bridge: "vmm-a-very-long-name", Subnet: "10.1.0.0/24", Gateway: "10.1.0.1", Mode: ModeNAT}, "bridge name"},
+		{"unknown mode", Definition{Name: "dev", Bridge: "vmm-dev", Subnet: "10.1.0.0/24", Gateway: "10.1.0.1", Mode: "bridged"}, "invalid network mode"},
+		{"IPv4 subnet6", Definition{Name: "dev", Bridge: "vmm-dev", Subnet: "10.1.0.0/24", Gateway: "10.1.0.1", Subnet6: "10.2.0.0/24", Mode: ModeNAT}, "invalid IPv6 subnet"},
+		{"subnet6 too small", Definition{Name: "dev", Bridge: "vmm-dev", Subnet: "10.1.0.0/24", Gateway: "10.1.0.1", Subnet6: "fd00:1::/112", Mode: ModeNAT}, "too small"},
+		{"overlapping subnet6", Definition{Name: "dev", Bridge: "vmm-dev", Subnet: "10.1.0.0/24", Gateway: "10.1.0.1", Subnet6: "fd00::/16", Mode: ModeNAT}, "IPv6 subnet fd00::/16 overlaps network 'lab'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := tt.def
+			err := r.Create(&d)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Create() error = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRegistryDelete(t *testing.T) {
+	r := newTestRegistry(t)
+	lab := &Definition{Name: "lab", Bridge: "vmm-lab", Subnet: "10.66.0.0/24", Gateway: "10.66.0.1", Mode: ModeNAT}
+	if err := r.Create(lab); err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+
+	if err := r.Delete("lab"); err != nil {
+		t.Fatalf("Delete() error: %v", err)
+	}
+	if _, err := r.Get("lab"); !errors.Is(err, ErrNetworkNotFound) {
+		t.Errorf("Get() after Delete error = %v, want ErrNetworkNotFound", err)
+	}
+	if err := r.Delete("lab"); !errors.Is(err, ErrNetworkNotFound) {
+		t.Errorf("second Delete() error = %v, want ErrNetworkNotFound", err)
+	}
+}
+
+func TestDefaultBridgeAndGateway(t *testing.T) {
+	if got := DefaultBridgeName("lab"); got != "vmm-lab" {
+		t.Errorf("DefaultBridgeName(lab) = %s, want vmm-lab", got)
+	}
+	if got := DefaultBridgeName("attack-lab-network"); len(got) > maxBridgeNameLen {
+		t.Errorf("DefaultBridgeName() = %s, longer than %d characters", got, maxBridgeNameLen)
+	}
+
+	gw, err := DefaultGateway("10.66.0.0/24")
+	if err != nil || gw != "10.66.0.1" {
+		t.Errorf("DefaultGateway() = %s, %v; want 10.66.0.1", gw, err)
+	}
+}
@@ -0,0 +1,287 @@
+package network
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// FakeBackend is an in-memory Backend for tests. It tracks links, rules and
+// port forwards without touching the host. Set Err to make every mutating
+// call fail.
+type FakeBackend struct {
+	Err error
+
+	mu           sync.Mutex
+	links        map[string]string // name -> bridge it is attached to ("" for bridges)
+	addresses    map[string][]string
+	forwarding   bool
+	forwarding6  bool
+	localnet     map[string]bool
+	rules        map[string][]Rule
+	portForwards map[string]PortForward // keyed by the host ports claimed
+	firewalls    map[string]*Firewall
+}
+
+// NewFakeBackend returns an empty FakeBackend.
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{
+		links:        make(map[string]string),
+		addresses:    make(map[string][]string),
+		localnet:     make(map[string]bool),
+		rules:        make(map[string][]Rule),
+		portForwards: make(map[string]PortForward),
+		firewalls:    make(map[string]*Firewall),
+	}
+}
+
+func (f *FakeBackend) LinkExists(name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.links[name]
+	return ok
+}
+
+func (f *FakeBackend) CreateBridge(name, address string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	if _, ok := f.links[name]; ok {
+		return fmt.Errorf("link %s already exists", name)
+	}
+	f.links[name] = ""
+	f.addresses[name] = []string{address}
+	return nil
+}
+
+func (f *FakeBackend) AddAddress(name, address string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	if _, ok := f.links[name]; !ok {
+		return fmt.Errorf("link %s not found", name)
+	}
+	for _, a := range f.addresses[name] {
+		if a == address {
+			return nil
+		}
+	}
+	f.addresses[name] = append(f.addresses[name], address)
+	return nil
+}
+
+func (f *FakeBackend) CreateTap(name, bridge string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	if _, ok := f.links[name]; ok {
+		return fmt.Errorf("link %s already exists", name)
+	}
+	if _, ok := f.links[bridge]; !ok {
+		return fmt.Errorf("bridge %s not found", bridge)
+	}
+	f.links[name] = bridge
+	return nil
+}
+
+func (f *FakeBackend) DeleteLink(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	if _, ok := f.links[name]; !ok {
+		return fmt.Errorf("link %s not found", name)
+	}
+	delete(f.links, name)
+	delete(f.addresses, name)
+	return nil
+}
+
+func (f *FakeBackend) RenameLink(name, newName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	master, ok := f.links[name]
+	if !ok {
+		return fmt.Errorf("link %s not found", name)
+	}
+	if _, ok := f.links[newName]; ok {
+		return fmt.Errorf("link %s already exists", newName)
+	}
+	delete(f.links, name)
+	f.links[newName] = master
+	if addrs, ok := f.addresses[name]; ok {
+		delete(f.addresses, name)
+		f.addresses[newName] = addrs
+	}
+	return nil
+}
+
+func (f *FakeBackend) EnableIPForwarding() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	f.forwarding = true
+	return nil
+}
+
+func (f *FakeBackend) EnableIPv6Forwarding(hostInterface string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	f.forwarding6 = true
+	return nil
+}
+
+func (f *FakeBackend) SetRouteLocalnet(name string, enabled bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	f.localnet[name] = enabled
+	return nil
+}
+
+func (f *FakeBackend) SetRules(owner string, rules []Rule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	if len(rules) == 0 {
+		delete(f.rules, owner)
+		return nil
+	}
+	f.rules[owner] = append([]Rule(nil), rules...)
+	return nil
+}
+
+func (f *FakeBackend) AddPortForward(pf PortForward) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	f.portForwards[pf.owner()] = pf
+	return nil
+}
+
+func (f *FakeBackend) RemovePortForward(pf PortForward) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	delete(f.portForwards, pf.owner())
+	return nil
+}
+
+func (f *FakeBackend) SetFirewall(tap string, fw *Firewall) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	if fw == nil {
+		delete(f.firewalls, tap)
+		return nil
+	}
+	f.firewalls[tap] = fw
+	return nil
+}
+
+// Master returns the bridge a link is attached to, or "" if it is not
+// attached or does not exist.
+func (f *FakeBackend) Master(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.links[name]
+}
+
+// Address returns the address a bridge was created with.
+func (f *FakeBackend) Address(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.addresses[name]) == 0 {
+		return ""
+	}
+	return f.addresses[name][0]
+}
+
+// Addresses returns every address assigned to a link, in the order they
+// were added.
+func (f *FakeBackend) Addresses(name string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.addresses[name]...)
+}
+
+// IPForwarding reports whether EnableIPForwarding has been called.
+func (f *FakeBackend) IPForwarding() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.forwarding
+}
+
+// IPv6Forwarding reports whether EnableIPv6Forwarding has been called.
+func (f *FakeBackend) IPv6Forwarding() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.forwarding6
+}
+
+// RouteLocalnet reports whether route_localnet is enabled for a link.
+func (f *FakeBackend) RouteLocalnet(name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.localnet[name]
+}
+
+// Rules returns the rules currently set for owner.
+func (f *FakeBackend) Rules(owner string) []Rule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Rule(nil), f.rules[owner]...)
+}
+
+// PortForwards returns the port forwards currently in place, sorted by
+// host port, protocol and guest address.
+func (f *FakeBackend) PortForwards() []PortForward {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var pfs []PortForward
+	for _, pf := range f.portForwards {
+		pfs = append(pfs, pf)
+	}
+	sort.Slice(pfs, func(i, j int) bool {
+		if pfs[i].HostPort != pfs[j].HostPort {
+			return pfs[i].HostPort < pfs[j].HostPort
+		}
+		if pfs[i].Protocol != pfs[j].Protocol {
+			return pfs[i].Protocol < pfs[j].Protocol
+		}
+		return pfs[i].GuestIP < pfs[j].GuestIP
+	})
+	return pfs
+}
+
+// Firewall returns the firewall set for a TAP device, or nil.
+func (f *FakeBackend) Firewall(tap string) *Firewall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.firewalls[tap]
+}
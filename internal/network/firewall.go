@@ -0,0 +1,79 @@
+package network
+
+import "fmt"
+
+// Firewall is the packet filter for one VM interface. Ingress rules see
+// traffic sent to the VM and egress rules traffic it sends. Rules are checked
+// in order and the first match decides; traffic no rule matches gets the
+// direction's policy. Replies to connections that were let through, and ARP,
+// are always allowed.
+type Firewall struct {
+	Ingress       []FirewallRule
+	Egress        []FirewallRule
+	IngressPolicy Verdict // VerdictAccept or VerdictDrop
+	EgressPolicy  Verdict
+}
+
+// FirewallRule matches traffic by protocol, destination port and remote
+// address range. Empty fields match any packet.
+type FirewallRule struct {
+	Protocol string // tcp, udp, icmp or icmpv6
+	Port     int    // destination port, tcp and udp only
+	CIDR     string // remote IPv4 or IPv6 range: the source for ingress, the destination for egress
+	Verdict  Verdict
+}
+
+// Validate checks the rule can be translated into packet filter rules.
+func (r FirewallRule) Validate() error {
+	switch r.Protocol {
+	case "", "tcp", "udp", "icmp", "icmpv6":
+	default:
+		return fmt.Errorf("invalid protocol %q: must be tcp, udp, icmp or icmpv6", r.Protocol)
+	}
+	if r.Port != 0 {
+		if r.Protocol != "tcp" && r.Protocol != "udp" {
+			return fmt.Errorf("a port requires protocol tcp or udp")
+		}
+		if r.Port < 1 || r.Port > 65535 {
+			return fmt.Errorf("invalid port %d: must be 1-65535", r.Port)
+		}
+	}
+	if r.CIDR != "" {
+		ipnet, err := parseCIDR(r.CIDR)
+		if err != nil {
+			return err
+		}
+		v4 := ipnet.IP.To4() != nil
+		if (r.Protocol == "icmp" && !v4) || (r.Protocol == "icmpv6" && v4) {
+			return fmt.Errorf("protocol %s does not match the address family of %s", r.Protocol, r.CIDR)
+		}
+	}
+	if r.Verdict != VerdictAccept && r.Verdict != VerdictDrop {
+		return fmt.Errorf("invalid verdict %q", r.Verdict)
+	}
+	return nil
+}
+
+// ApplyFirewall installs fw on a VM's TAP device, replacing any firewall it
+// had. A nil fw removes the firewall.
+func (m *Manager) ApplyFirewall(tapName string, fw *Firewall) error {
+	if fw != nil {
+		for _, rules := range [][]FirewallRule{fw.Ingress, fw.Egress} {
+			for _, r := range rules {
+				if err := r.Validate(); err != nil {
+					return fmt.Errorf("invalid firewall rule: %w", err)
+				}
+			}
+		}
+	}
+	if err := m.Backend.SetFirewall(tapName, fw); err != nil {
+		return fmt.Errorf("failed to apply firewall for %s: %w", tapName, err)
+	}
+	return nil
+}
+
+// RemoveFirewall removes a TAP device's firewall. A TAP device without one
+// is ignored.
+func (m *Manager) RemoveFirewall(tapName string) error {
+	return m.ApplyFirewall(tapName, nil)
+}
@@ -0,0 +1,115 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/google/nftables/expr"
+)
+
+func TestFirewallRuleValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    FirewallRule
+		wantErr bool
+	}{
+		{"tcp port", FirewallRule{Protocol: "tcp", Port: 22, Verdict: VerdictAccept}, false},
+		{"cidr only", FirewallRule{CIDR: "10.0.0.0/8", Verdict: VerdictDrop}, false},
+		{"match all", FirewallRule{Verdict: VerdictDrop}, false},
+		{"port without protocol", FirewallRule{Port: 22, Verdict: VerdictAccept}, true},
+		{"unknown protocol", FirewallRule{Protocol: "gre", Verdict: VerdictAccept}, true},
+		{"invalid CIDR", FirewallRule{CIDR: "10.0.0.300/8", Verdict: VerdictAccept}, true},
+		{"ipv6 CIDR", FirewallRule{Protocol: "tcp", Port: 443, CIDR: "fd00::/64", Verdict: VerdictAccept}, false},
+		{"icmpv6", FirewallRule{Protocol: "icmpv6", CIDR: "2001:db8::/32", Verdict: VerdictAccept}, false},
+		{"icmp with ipv6 CIDR", FirewallRule{Protocol: "icmp", CIDR: "fd00::/64", Verdict: VerdictAccept}, true},
+		{"icmpv6 with ipv4 CIDR", FirewallRule{Protocol: "icmpv6", CIDR: "10.0.0.0/8", Verdict: VerdictAccept}, true},
+		{"masquerade", FirewallRule{Verdict: VerdictMasquerade}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyFirewall(t *testing.T) {
+	m, fake := newFakeManager()
+	fw := &Firewall{
+		Ingress:       []FirewallRule{{Protocol: "tcp", Port: 22, Verdict: VerdictAccept}},
+		IngressPolicy: VerdictDrop,
+		EgressPolicy:  VerdictAccept,
+	}
+
+	if err := m.ApplyFirewall("vmm-abcdef", fw); err != nil {
+		t.Fatalf("ApplyFirewall() error: %v", err)
+	}
+	if fake.Firewall("vmm-abcdef") != fw {
+		t.Error("ApplyFirewall() did not install the firewall")
+	}
+
+	bad := &Firewall{Egress: []FirewallRule{{Port: 80, Verdict: VerdictAccept}}}
+	if err := m.ApplyFirewall("vmm-abcdef", bad); err == nil {
+		t.Error("ApplyFirewall() accepted an invalid rule")
+	}
+	if fake.Firewall("vmm-abcdef") != fw {
+		t.Error("an invalid firewall replaced the installed one")
+	}
+
+	if err := m.RemoveFirewall("vmm-abcdef"); err != nil {
+		t.Fatalf("RemoveFirewall() error: %v", err)
+	}
+	if fake.Firewall("vmm-abcdef") != nil {
+		t.Error("RemoveFirewall() left the firewall in place")
+	}
+}
+
+func TestFirewallExprs(t *testing.T) {
+	rules := []FirewallRule{
+		{Protocol: "tcp", Port: 22, CIDR: "10.0.0.0/8", Verdict: VerdictAccept},
+		{Verdict: VerdictDrop},
+	}
+
+	tests := []struct {
+		name      string
+		policy    Verdict
+		wantRules int
+	}{
+		// ARP, neighbour discovery and established connections come
+		// first, then the rules
+		{"accept policy", VerdictAccept, 5},
+		// A drop policy adds a final catch-all drop
+		{"drop policy", VerdictDrop, 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain, err := firewallExprs(rules, tt.policy, true)
+			if err != nil {
+				t.Fatalf("firewallExprs() error: %v", err)
+			}
+			if len(chain) != tt.wantRules {
+				t.Fatalf("got %d rules, want %d", len(chain), tt.wantRules)
+			}
+			for i, exprs := range chain {
+				v, ok := exprs[len(exprs)-1].(*expr.Verdict)
+				if !ok {
+					t.Fatalf("rule %d does not end in a verdict", i)
+				}
+				if i < 4 && v.Kind != expr.VerdictAccept {
+					t.Errorf("rule %d verdict = %v, want accept", i, v.Kind)
+				}
+			}
+			last := chain[len(chain)-1]
+			if tt.policy == VerdictDrop && len(last) != 1 {
+				t.Errorf("policy rule has matches: %v", last)
+			}
+		})
+	}
+
+	if _, err := firewallExprs([]FirewallRule{{Protocol: "tcp", Port: 99999, Verdict: VerdictAccept}}, VerdictAccept, false); err == nil {
+		t.Error("firewallExprs() accepted an invalid rule")
+	}
+}
@@ -0,0 +1,428 @@
+package network
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrAddressInUse is returned when a requested address is already leased to,
+// or used by, another VM.
+var ErrAddressInUse = errors.New("address in use")
+
+// Lease records an IP address assigned to a VM. Dynamic leases are created
+// the first time a VM starts and kept until it is deleted, so a VM gets the
+// same address on every boot. Static leases come from `vmm create --ip`.
+type Lease struct {
+	IP        string    `json:"ip"`
+	VMName    string    `json:"vm_name"`
+	Static    bool      `json:"static"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LeaseKey returns the name a VM interface's lease is held under: the VM name
+// for its primary interface (eth0) and "<vm>/<device>" for any other, so a VM
+// with several interfaces on one network holds a lease for each.
+func LeaseKey(vmName, device string) string {
+	if device == "" || device == "eth0" {
+		return vmName
+	}
+	return vmName + "/" + device
+}
+
+// Owner returns the VM holding the lease and the guest device it is for.
+func (l Lease) Owner() (vmName, device string) {
+	vmName, device, found := strings.Cut(l.VMName, "/")
+	if !found {
+		device = "eth0"
+	}
+	return vmName, device
+}
+
+// IPAM assigns addresses from a subnet and persists the assignments as leases
+// under the state directory. It does no locking of its own: callers must hold
+// the global lock (see internal/lock) around any call that changes leases.
+type IPAM struct {
+	path     string
+	subnet   string
+	gateway  string
+	excluded []string
+}
+
+// LeasesPath returns the file holding a network's IP leases under stateDir.
+func LeasesPath(stateDir, network string) string {
+	return filepath.Join(stateDir, "ipam", network+".json")
+}
+
+// NewIPAM creates an address manager for the named network's subnet. The
+// gateway and any addresses matched by excluded are never handed out
+// dynamically. Each exclusion is a single address, a range such as
+// "172.16.0.100-172.16.0.199", or a CIDR block.
+func NewIPAM(stateDir, network, subnet, gateway string, excluded []string) *IPAM {
+	return &IPAM{
+		path:     LeasesPath(stateDir, network),
+		subnet:   subnet,
+		gateway:  gateway,
+		excluded: excluded,
+	}
+}
+
+// Leases returns all leases sorted by address.
+func (p *IPAM) Leases() ([]Lease, error) {
+	leases, err := p.load()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return ipToUint(net.ParseIP(leases[i].IP)) < ipToUint(net.ParseIP(leases[j].IP))
+	})
+	return leases, nil
+}
+
+// Acquire returns the address leased to vmName, creating a dynamic lease if
+// it has none. A new lease uses preferred if that address is free, so VMs
+// that predate IPAM keep the address they last had; otherwise it takes the
+// first free address. inUse lists addresses held by other VMs without a
+// lease. created reports whether a new lease was written.
+func (p *IPAM) Acquire(vmName, preferred string, inUse []string) (ip string, created bool, err error) {
+	sub, err := parseSubnet(p.subnet)
+	if err != nil {
+		return "", false, err
+	}
+	exclusions, err := parseExclusions(p.excluded)
+	if err != nil {
+		return "", false, err
+	}
+	leases, err := p.load()
+	if err != nil {
+		return "", false, err
+	}
+
+	if i := findLease(leases, vmName); i >= 0 {
+		if sub.isHost(net.ParseIP(leases[i].IP)) {
+			return leases[i].IP, false, nil
+		}
+		// The subnet changed since the lease was written
+		leases = append(leases[:i], leases[i+1:]...)
+	}
+
+	taken := p.takenSet(leases, inUse)
+	free := func(addr string) bool {
+		parsed := net.ParseIP(addr)
+		return sub.isHost(parsed) && !taken[addr] && !exclusions.contains(parsed)
+	}
+
+	ip = preferred
+	if ip == "" || !free(ip) {
+		ip, err = firstFreeIP(p.subnet, func(addr string) bool { return !free(addr) })
+		if err != nil {
+			return "", false, err
+		}
+	}
+
+	leases = append(leases, Lease{IP: ip, VMName: vmName, CreatedAt: time.Now()})
+	if err := p.save(leases); err != nil {
+		return "", false, err
+	}
+	return ip, true, nil
+}
+
+// Reserve gives vmName a static lease on ip, replacing any lease it already
+// holds. Reservations may fall inside excluded ranges, which is how a range
+// is set aside for static addresses. The returned error matches
+// ErrAddressInUse if another VM holds ip.
+func (p *IPAM) Reserve(vmName, ip string, inUse []string) error {
+	if err := p.ValidateAddress(ip); err != nil {
+		return err
+	}
+	leases, err := p.load()
+	if err != nil {
+		return err
+	}
+	if i := findLease(leases, vmName); i >= 0 {
+		leases = append(leases[:i], leases[i+1:]...)
+	}
+
+	for _, l := range leases {
+		if l.IP == ip {
+			return fmt.Errorf("%w: %s is leased to VM '%s'", ErrAddressInUse, ip, l.VMName)
+		}
+	}
+	for _, addr := range inUse {
+		if addr == ip {
+			return fmt.Errorf("%w: %s is used by another VM", ErrAddressInUse, ip)
+		}
+	}
+
+	leases = append(leases, Lease{IP: ip, VMName: vmName, Static: true, CreatedAt: time.Now()})
+	return p.save(leases)
+}
+
+// Release removes the lease held by vmName and returns it, or nil if the VM
+// had no lease.
+func (p *IPAM) Release(vmName string) (*Lease, error) {
+	leases, err := p.load()
+	if err != nil {
+		return nil, err
+	}
+	i := findLease(leases, vmName)
+	if i < 0 {
+		return nil, nil
+	}
+	released := leases[i]
+	leases = append(leases[:i], leases[i+1:]...)
+	if err := p.save(leases); err != nil {
+		return nil, err
+	}
+	return &released, nil
+}
+
+// ReleaseVM removes every lease held by vmName's interfaces and returns them.
+func (p *IPAM) ReleaseVM(vmName string) ([]Lease, error) {
+	leases, err := p.load()
+	if err != nil {
+		return nil, err
+	}
+	var kept, released []Lease
+	for _, l := range leases {
+		if owner, _ := l.Owner(); owner == vmName {
+			released = append(released, l)
+			continue
+		}
+		kept = append(kept, l)
+	}
+	if len(released) == 0 {
+		return nil, nil
+	}
+	if err := p.save(kept); err != nil {
+		return nil, err
+	}
+	return released, nil
+}
+
+// ValidateAddress checks that ip is a usable host address in the subnet: not
+// the network or broadcast address and not the gateway.
+func (p *IPAM) ValidateAddress(ip string) error {
+	sub, err := parseSubnet(p.subnet)
+	if err != nil {
+		return err
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() == nil {
+		return fmt.Errorf("invalid IPv4 address: %s", ip)
+	}
+	if ip == p.gateway {
+		return fmt.Errorf("%s is the gateway address", ip)
+	}
+	if !sub.isHost(parsed) {
+		return fmt.Errorf("%s is not a usable address in subnet %s", ip, p.subnet)
+	}
+	return nil
+}
+
+// ValidateExclusions checks that every entry is a valid address, range or
+// CIDR block.
+func ValidateExclusions(entries []string) error {
+	_, err := parseExclusions(entries)
+	return err
+}
+
+func (p *IPAM) takenSet(leases []Lease, inUse []string) map[string]bool {
+	taken := map[string]bool{p.gateway: true}
+	for _, l := range leases {
+		taken[l.IP] = true
+	}
+	for _, addr := range inUse {
+		taken[addr] = true
+	}
+	return taken
+}
+
+func (p *IPAM) load() ([]Lease, error) {
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read IP leases: %w", err)
+	}
+	var leases []Lease
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return nil, fmt.Errorf("failed to parse IP leases: %w", err)
+	}
+	return leases, nil
+}
+
+func (p *IPAM) save(leases []Lease) error {
+	if leases == nil {
+		leases = []Lease{}
+	}
+	data, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal IP leases: %w", err)
+	}
+	dir := filepath.Dir(p.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create IPAM directory: %w", err)
+	}
+
+	tmpFile, err := os.CreateTemp(dir, ".leases-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write IP leases: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+	if err := os.Rename(tmpPath, p.path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+	return nil
+}
+
+func findLease(leases []Lease, vmName string) int {
+	for i, l := range leases {
+		if l.VMName == vmName {
+			return i
+		}
+	}
+	return -1
+}
+
+// subnetRange holds the network and broadcast addresses of an IPv4 subnet.
+type subnetRange struct {
+	network   uint32
+	broadcast uint32
+}
+
+func parseSubnet(subnet string) (subnetRange, error) {
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return subnetRange{}, fmt.Errorf("invalid subnet: %w", err)
+	}
+	base := ipnet.IP.To4()
+	if base == nil {
+		return subnetRange{}, fmt.Errorf("invalid IPv4 subnet")
+	}
+	network := ipToUint(base)
+	return subnetRange{
+		network:   network,
+		broadcast: network | ^binary.BigEndian.Uint32(ipnet.Mask),
+	}, nil
+}
+
+// isHost reports whether ip is inside the subnet and is neither its network
+// nor its broadcast address.
+func (s subnetRange) isHost(ip net.IP) bool {
+	if ip == nil || ip.To4() == nil {
+		return false
+	}
+	n := ipToUint(ip)
+	return n > s.network && n < s.broadcast
+}
+
+// firstFreeIP returns the lowest address from the subnet's .2 upwards for
+// which taken returns false. The first host address is left for the gateway.
+func firstFreeIP(subnet string, taken func(ip string) bool) (string, error) {
+	sub, err := parseSubnet(subnet)
+	if err != nil {
+		return "", err
+	}
+	for n := sub.network + 2; n < sub.broadcast; n++ {
+		addr := uintToIP(n).String()
+		if !taken(addr) {
+			return addr, nil
+		}
+	}
+	return "", fmt.Errorf("no free IP addresses in subnet %s", subnet)
+}
+
+// ipRange is an inclusive range of IPv4 addresses.
+type ipRange struct {
+	first uint32
+	last  uint32
+}
+
+type exclusionList []ipRange
+
+func (e exclusionList) contains(ip net.IP) bool {
+	if ip == nil || ip.To4() == nil {
+		return false
+	}
+	n := ipToUint(ip)
+	for _, r := range e {
+		if n >= r.first && n <= r.last {
+			return true
+		}
+	}
+	return false
+}
+
+func parseExclusions(entries []string) (exclusionList, error) {
+	var list exclusionList
+	for _, entry := range entries {
+		r, err := parseExclusion(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	return list, nil
+}
+
+func parseExclusion(entry string) (ipRange, error) {
+	if strings.Contains(entry, "/") {
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil || ipnet.IP.To4() == nil {
+			return ipRange{}, fmt.Errorf("invalid excluded range '%s': expected an IPv4 CIDR", entry)
+		}
+		first := ipToUint(ipnet.IP)
+		return ipRange{first: first, last: first | ^binary.BigEndian.Uint32(ipnet.Mask)}, nil
+	}
+
+	start, end, isRange := strings.Cut(entry, "-")
+	first := net.ParseIP(strings.TrimSpace(start))
+	if first == nil || first.To4() == nil {
+		return ipRange{}, fmt.Errorf("invalid excluded range '%s': expected an IPv4 address, range or CIDR", entry)
+	}
+	if !isRange {
+		return ipRange{first: ipToUint(first), last: ipToUint(first)}, nil
+	}
+	last := net.ParseIP(strings.TrimSpace(end))
+	if last == nil || last.To4() == nil {
+		return ipRange{}, fmt.Errorf("invalid excluded range '%s': expected an IPv4 address after '-'", entry)
+	}
+	r := ipRange{first: ipToUint(first), last: ipToUint(last)}
+	if r.first > r.last {
+		return ipRange{}, fmt.Errorf("invalid excluded range '%s': start is after end", entry)
+	}
+	return r, nil
+}
+
+func ipToUint(ip net.IP) uint32 {
+	v4 := ip.To4()
+	if v4 == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(v4)
+}
+
+func uintToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
@@ -0,0 +1,237 @@
+package network
+
+import (
+	"errors"
+	"testing"
+)
+
+func newTestIPAM(t *testing.T, excluded ...string) *IPAM {
+	t.Helper()
+	return NewIPAM(t.TempDir(), DefaultNetwork, "172.16.0.0/16", "172.16.0.1", excluded)
+}
+
+func TestIPAMAcquireIsSticky(t *testing.T) {
+	p := newTestIPAM(t)
+
+	ip, created, err := p.Acquire("web", "", nil)
+	if err != nil {
+		t.Fatalf("Acquire() error: %v", err)
+	}
+	if ip != "172.16.0.2" || !created {
+		t.Fatalf("Acquire() = %s, %v; want 172.16.0.2, true", ip, created)
+	}
+
+	other, _, err := p.Acquire("db", "", nil)
+	if err != nil {
+		t.Fatalf("Acquire() for second VM error: %v", err)
+	}
+	if other != "172.16.0.3" {
+		t.Errorf("second VM got %s, want 172.16.0.3", other)
+	}
+
+	again, created, err := p.Acquire("web", "172.16.0.99", nil)
+	if err != nil {
+		t.Fatalf("Acquire() again error: %v", err)
+	}
+	if again != ip || created {
+		t.Errorf("Acquire() again = %s, %v; want %s, false", again, created, ip)
+	}
+
+	// Leases survive a new IPAM over the same state directory
+	reopened := &IPAM{path: p.path, subnet: p.subnet, gateway: p.gateway}
+	leases, err := reopened.Leases()
+	if err != nil {
+		t.Fatalf("Leases() error: %v", err)
+	}
+	if i := findLease(leases, "db"); i < 0 || leases[i].IP != "172.16.0.3" || leases[i].Static {
+		t.Errorf("leases = %+v, want a dynamic lease for db on 172.16.0.3", leases)
+	}
+}
+
+func TestIPAMAcquireSkips(t *testing.T) {
+	tests := []struct {
+		name      string
+		excluded  []string
+		preferred string
+		inUse     []string
+		want      string
+	}{
+		{"preferred free address", nil, "172.16.0.50", nil, "172.16.0.50"},
+		{"preferred outside subnet", nil, "10.0.0.5", nil, "172.16.0.2"},
+		{"preferred is gateway", nil, "172.16.0.1", nil, "172.16.0.2"},
+		{"preferred in use", nil, "172.16.0.50", []string{"172.16.0.50"}, "172.16.0.2"},
+		{"in-use addresses", nil, "", []string{"172.16.0.2", "172.16.0.3"}, "172.16.0.4"},
+		{"single exclusion", []string{"172.16.0.2"}, "", nil, "172.16.0.3"},
+		{"range exclusion", []string{"172.16.0.2-172.16.0.9"}, "", nil, "172.16.0.10"},
+		{"CIDR exclusion", []string{"172.16.0.0/24"}, "", nil, "172.16.1.0"},
+		{"preferred excluded", []string{"172.16.0.50"}, "172.16.0.50", nil, "172.16.0.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestIPAM(t, tt.excluded...)
+			ip, _, err := p.Acquire("web", tt.preferred, tt.inUse)
+			if err != nil {
+				t.Fatalf("Acquire() error: %v", err)
+			}
+			if ip != tt.want {
+				t.Errorf("Acquire() = %s, want %s", ip, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPAMAcquireExhausted(t *testing.T) {
+	p := NewIPAM(t.TempDir(), DefaultNetwork, "10.0.0.0/29", "10.0.0.1", []string{"10.0.0.5-10.0.0.6"})
+
+	for _, name := range []string{"a", "b", "c"} {
+		if _, _, err := p.Acquire(name, "", nil); err != nil {
+			t.Fatalf("Acquire(%s) error: %v", name, err)
+		}
+	}
+	if _, _, err := p.Acquire("d", "", nil); err == nil {
+		t.Error("expected error when the subnet is exhausted")
+	}
+}
+
+func TestIPAMReserve(t *testing.T) {
+	p := newTestIPAM(t, "172.16.0.0/24")
+
+	// Reservations may use excluded addresses
+	if err := p.Reserve("web", "172.16.0.50", nil); err != nil {
+		t.Fatalf("Reserve() error: %v", err)
+	}
+	ip, created, err := p.Acquire("web", "", nil)
+	if err != nil {
+		t.Fatalf("Acquire() error: %v", err)
+	}
+	if ip != "172.16.0.50" || created {
+		t.Errorf("Acquire() = %s, %v; want the reserved address", ip, created)
+	}
+
+	if err := p.Reserve("db", "172.16.0.50", nil); !errors.Is(err, ErrAddressInUse) {
+		t.Errorf("Reserve() of a leased address error = %v, want ErrAddressInUse", err)
+	}
+	if err := p.Reserve("db", "172.16.0.60", []string{"172.16.0.60"}); !errors.Is(err, ErrAddressInUse) {
+		t.Errorf("Reserve() of an in-use address error = %v, want ErrAddressInUse", err)
+	}
+
+	for _, bad := range []string{"172.16.0.1", "172.16.0.0", "172.16.255.255", "10.0.0.5", "not-an-ip"} {
+		if err := p.Reserve("db", bad, nil); err == nil || errors.Is(err, ErrAddressInUse) {
+			t.Errorf("Reserve(%s) error = %v, want a validation error", bad, err)
+		}
+	}
+
+	// Re-reserving replaces the VM's existing lease
+	if err := p.Reserve("web", "172.16.0.51", nil); err != nil {
+		t.Fatalf("Reserve() replacement error: %v", err)
+	}
+	leases, err := p.Leases()
+	if err != nil {
+		t.Fatalf("Leases() error: %v", err)
+	}
+	if len(leases) != 1 || leases[0].IP != "172.16.0.51" || !leases[0].Static {
+		t.Errorf("Leases() = %+v, want one static lease on 172.16.0.51", leases)
+	}
+}
+
+func TestIPAMRelease(t *testing.T) {
+	p := newTestIPAM(t)
+
+	if _, _, err := p.Acquire("web", "", nil); err != nil {
+		t.Fatalf("Acquire() error: %v", err)
+	}
+	lease, err := p.Release("web")
+	if err != nil {
+		t.Fatalf("Release() error: %v", err)
+	}
+	if lease == nil || lease.IP != "172.16.0.2" {
+		t.Errorf("Release() = %+v, want the lease on 172.16.0.2", lease)
+	}
+
+	lease, err = p.Release("web")
+	if err != nil || lease != nil {
+		t.Errorf("second Release() = %+v, %v; want nil, nil", lease, err)
+	}
+
+	// The released address is handed out again
+	ip, _, err := p.Acquire("db", "", nil)
+	if err != nil {
+		t.Fatalf("Acquire() error: %v", err)
+	}
+	if ip != "172.16.0.2" {
+		t.Errorf("Acquire() after release = %s, want 172.16.0.2", ip)
+	}
+}
+
+func TestIPAMReleaseVM(t *testing.T) {
+	p := newTestIPAM(t)
+
+	for _, key := range []string{LeaseKey("web", "eth0"), LeaseKey("web", "eth1"), LeaseKey("db", "eth0")} {
+		if _, _, err := p.Acquire(key, "", nil); err != nil {
+			t.Fatalf("Acquire(%s) error: %v", key, err)
+		}
+	}
+
+	released, err := p.ReleaseVM("web")
+	if err != nil {
+		t.Fatalf("ReleaseVM() error: %v", err)
+	}
+	if len(released) != 2 {
+		t.Fatalf("ReleaseVM() released %+v, want both of web's leases", released)
+	}
+	if vmName, device := released[1].Owner(); vmName != "web" || device != "eth1" {
+		t.Errorf("Owner() = %s, %s; want web, eth1", vmName, device)
+	}
+
+	leases, err := p.Leases()
+	if err != nil {
+		t.Fatalf("Leases() error: %v", err)
+	}
+	if len(leases) != 1 || leases[0].VMName != "db" {
+		t.Errorf("Leases() = %+v, want only db's lease", leases)
+	}
+}
+
+func TestIPAMDropsLeaseOutsideSubnet(t *testing.T) {
+	dir := t.TempDir()
+	old := NewIPAM(dir, DefaultNetwork, "10.0.0.0/24", "10.0.0.1", nil)
+	if _, _, err := old.Acquire("web", "", nil); err != nil {
+		t.Fatalf("Acquire() error: %v", err)
+	}
+
+	p := NewIPAM(dir, DefaultNetwork, "172.16.0.0/16", "172.16.0.1", nil)
+	ip, created, err := p.Acquire("web", "", nil)
+	if err != nil {
+		t.Fatalf("Acquire() error: %v", err)
+	}
+	if ip != "172.16.0.2" || !created {
+		t.Errorf("Acquire() = %s, %v; want a new lease on 172.16.0.2", ip, created)
+	}
+}
+
+func TestValidateExclusions(t *testing.T) {
+	tests := []struct {
+		entry   string
+		wantErr bool
+	}{
+		{"172.16.0.5", false},
+		{"172.16.0.100-172.16.0.199", false},
+		{"172.16.0.100 - 172.16.0.199", false},
+		{"172.16.10.0/24", false},
+		{"172.16.0.199-172.16.0.100", true},
+		{"172.16.0.100-", true},
+		{"172.16.0.0/33", true},
+		{"fd00::1", true},
+		{"example", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			err := ValidateExclusions([]string{tt.entry})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateExclusions(%q) error = %v, wantErr %v", tt.entry, err, tt.wantErr)
+			}
+		})
+	}
+}
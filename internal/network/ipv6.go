@@ -0,0 +1,66 @@
+package network
+
+import (
+	"fmt"
+	"net"
+)
+
+// VMs on a dual-stack network need no IPv6 leases: each interface's IPv6
+// address is its IPv4 address embedded in the low 32 bits of the network's
+// IPv6 subnet, so 172.16.0.5 in fd00:db8::/64 becomes fd00:db8::ac10:5. The
+// address is unique and stable for exactly as long as the IPv4 lease, and
+// the bridge's IPv6 gateway is derived from the IPv4 gateway the same way.
+
+// maxSubnet6PrefixLen is the longest IPv6 prefix that leaves room for an
+// IPv4 address in the low 32 bits.
+const maxSubnet6PrefixLen = 96
+
+// ValidateSubnet6 checks that subnet6 is an IPv6 subnet in CIDR notation
+// with room for an embedded IPv4 address.
+func ValidateSubnet6(subnet6 string) error {
+	_, ipnet, err := net.ParseCIDR(subnet6)
+	if err != nil || ipnet.IP.To4() != nil {
+		return fmt.Errorf("invalid IPv6 subnet %q", subnet6)
+	}
+	if ones, _ := ipnet.Mask.Size(); ones > maxSubnet6PrefixLen {
+		return fmt.Errorf("IPv6 subnet %s is too small: the prefix must be /%d or shorter", subnet6, maxSubnet6PrefixLen)
+	}
+	return nil
+}
+
+// IPv6Address returns the address in subnet6 that corresponds to the IPv4
+// address ipv4.
+func IPv6Address(subnet6, ipv4 string) (string, error) {
+	if err := ValidateSubnet6(subnet6); err != nil {
+		return "", err
+	}
+	v4 := net.ParseIP(ipv4).To4()
+	if v4 == nil {
+		return "", fmt.Errorf("invalid IPv4 address: %s", ipv4)
+	}
+	_, ipnet, _ := net.ParseCIDR(subnet6)
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, ipnet.IP)
+	copy(ip[12:], v4)
+	return ip.String(), nil
+}
+
+// prefixLen6 returns the prefix length of an IPv6 subnet.
+func prefixLen6(subnet6 string) int {
+	_, ipnet, err := net.ParseCIDR(subnet6)
+	if err != nil {
+		return 64
+	}
+	ones, _ := ipnet.Mask.Size()
+	return ones
+}
+
+// subnets6Overlap reports whether two IPv6 subnets share any address.
+func subnets6Overlap(a, b string) bool {
+	_, na, errA := net.ParseCIDR(a)
+	_, nb, errB := net.ParseCIDR(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	return na.Contains(nb.IP) || nb.Contains(na.IP)
+}
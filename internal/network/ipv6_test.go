@@ -0,0 +1,47 @@
+package network
+
+import "testing"
+
+func TestIPv6Address(t *testing.T) {
+	tests := []struct {
+		name    string
+		subnet6 string
+		ipv4    string
+		want    string
+		wantErr bool
+	}{
+		{"/64", "fd00:db8::/64", "172.16.0.5", "fd00:db8::ac10:5", false},
+		{"host bits in subnet are ignored", "fd00:db8::1/64", "172.16.0.5", "fd00:db8::ac10:5", false},
+		{"/96", "2001:db8:1:2:3:4::/96", "10.66.0.2", "2001:db8:1:2:3:4:a42:2", false},
+		{"prefix too long", "fd00:db8::/120", "172.16.0.5", "", true},
+		{"IPv4 subnet", "172.16.0.0/16", "172.16.0.5", "", true},
+		{"invalid IPv4 address", "fd00:db8::/64", "fd00::5", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := IPv6Address(tt.subnet6, tt.ipv4)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("IPv6Address() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("IPv6Address() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefinitionGateway6(t *testing.T) {
+	d := &Definition{Subnet: "172.16.0.0/16", Gateway: "172.16.0.1"}
+	if got := d.Gateway6(); got != "" {
+		t.Errorf("Gateway6() of an IPv4-only network = %q, want empty", got)
+	}
+	if got, err := d.IPv6Address("172.16.0.2"); got != "" || err != nil {
+		t.Errorf("IPv6Address() of an IPv4-only network = %q, %v; want empty", got, err)
+	}
+
+	d.Subnet6 = "fd00:db8::/64"
+	if got := d.Gateway6(); got != "fd00:db8::ac10:1" {
+		t.Errorf("Gateway6() = %q, want fd00:db8::ac10:1", got)
+	}
+}
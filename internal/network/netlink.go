@@ -0,0 +1,159 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Sysctls controlling IPv4 and IPv6 forwarding, whether an interface
+// accepts router advertisements, and whether it may carry traffic from
+// loopback addresses.
+const (
+	ipForwardPath     = "/proc/sys/net/ipv4/ip_forward"
+	ipv6ForwardPath   = "/proc/sys/net/ipv6/conf/all/forwarding"
+	acceptRAPath      = "/proc/sys/net/ipv6/conf/%s/accept_ra"
+	routeLocalnetPath = "/proc/sys/net/ipv4/conf/%s/route_localnet"
+)
+
+// hostBackend manages links and addresses over netlink and rules with
+// nftables (see nftables.go).
+type hostBackend struct{}
+
+// NewHostBackend returns the Backend that configures the host kernel
+// directly, without shelling out to ip, sysctl or iptables.
+func NewHostBackend() Backend {
+	return hostBackend{}
+}
+
+func (hostBackend) LinkExists(name string) bool {
+	_, err := netlink.LinkByName(name)
+	return err == nil
+}
+
+func (hostBackend) CreateBridge(name, address string) error {
+	br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}}
+	if err := netlink.LinkAdd(br); err != nil {
+		return fmt.Errorf("failed to create bridge: %w", err)
+	}
+	if err := addAddress(br, address); err != nil {
+		return fmt.Errorf("failed to set bridge address: %w", err)
+	}
+	if err := netlink.LinkSetUp(br); err != nil {
+		return fmt.Errorf("failed to bring up bridge: %w", err)
+	}
+	return nil
+}
+
+func (hostBackend) AddAddress(name, address string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find link %s: %w", name, err)
+	}
+	if err := addAddress(link, address); err != nil {
+		return fmt.Errorf("failed to add address to %s: %w", name, err)
+	}
+	return nil
+}
+
+// addAddress assigns address to link unless it already has it. IPv6
+// addresses skip duplicate address detection so they are usable at once.
+func addAddress(link netlink.Link, address string) error {
+	addr, err := netlink.ParseAddr(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", address, err)
+	}
+	if addr.IP.To4() == nil {
+		addr.Flags = unix.IFA_F_NODAD
+	}
+	if err := netlink.AddrAdd(link, addr); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return err
+	}
+	return nil
+}
+
+func (b hostBackend) CreateTap(name, bridge string) error {
+	master, err := netlink.LinkByName(bridge)
+	if err != nil {
+		return fmt.Errorf("failed to find bridge %s: %w", bridge, err)
+	}
+	// Single queue without packet information, as Firecracker expects
+	tap := &netlink.Tuntap{
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+		Mode:      netlink.TUNTAP_MODE_TAP,
+		Flags:     netlink.TUNTAP_NO_PI,
+	}
+	if err := netlink.LinkAdd(tap); err != nil {
+		return fmt.Errorf("failed to create TAP device: %w", err)
+	}
+	if err := netlink.LinkSetMaster(tap, master); err != nil {
+		b.DeleteLink(name) // Cleanup on failure
+		return fmt.Errorf("failed to add TAP to bridge: %w", err)
+	}
+	if err := netlink.LinkSetUp(tap); err != nil {
+		b.DeleteLink(name)
+		return fmt.Errorf("failed to bring up TAP: %w", err)
+	}
+	return nil
+}
+
+func (hostBackend) DeleteLink(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find link %s: %w", name, err)
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("failed to delete link %s: %w", name, err)
+	}
+	return nil
+}
+
+func (hostBackend) RenameLink(name, newName string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find link %s: %w", name, err)
+	}
+	// The kernel only renames links that are down
+	if err := netlink.LinkSetDown(link); err != nil {
+		return fmt.Errorf("failed to bring down %s: %w", name, err)
+	}
+	if err := netlink.LinkSetName(link, newName); err != nil {
+		netlink.LinkSetUp(link)
+		return fmt.Errorf("failed to rename %s to %s: %w", name, newName, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to bring up %s: %w", newName, err)
+	}
+	return nil
+}
+
+func (hostBackend) EnableIPForwarding() error {
+	return os.WriteFile(ipForwardPath, []byte("1\n"), 0644)
+}
+
+func (hostBackend) EnableIPv6Forwarding(hostInterface string) error {
+	// A router ignores router advertisements unless accept_ra is 2, so
+	// raise it first on the uplink if it currently accepts them at all
+	if hostInterface != "" {
+		path := fmt.Sprintf(acceptRAPath, hostInterface)
+		if cur, err := os.ReadFile(path); err == nil && strings.TrimSpace(string(cur)) == "1" {
+			if err := os.WriteFile(path, []byte("2\n"), 0644); err != nil {
+				return fmt.Errorf("failed to keep accepting router advertisements on %s: %w", hostInterface, err)
+			}
+		}
+	}
+	return os.WriteFile(ipv6ForwardPath, []byte("1\n"), 0644)
+}
+
+func (hostBackend) SetRouteLocalnet(name string, enabled bool) error {
+	value := "0\n"
+	if enabled {
+		value = "1\n"
+	}
+	return os.WriteFile(fmt.Sprintf(routeLocalnetPath, name), []byte(value), 0644)
+}
@@ -3,25 +3,35 @@ package network
 import (
 	"fmt"
 	"net"
-	"os/exec"
-	"strings"
 )
 
+// localhostSubnet is the IPv4 loopback range.
+const localhostSubnet = "127.0.0.0/8"
+
+// localnetGuardOwner tags the rules guarding route_localnet. It holds a
+// space so it never collides with a bridge name.
+const localnetGuardOwner = "localnet guard"
+
 // Manager handles network setup for VMs
 type Manager struct {
 	BridgeName    string
 	Subnet        string
 	Gateway       string
+	Subnet6       string // IPv6 subnet; empty for IPv4-only networks
 	HostInterface string
+	Mode          Mode
+	Backend       Backend
 }
 
-// NewManager creates a new network manager
+// NewManager creates a new network manager for a NAT network
 func NewManager(bridgeName, subnet, gateway, hostInterface string) *Manager {
 	return &Manager{
 		BridgeName:    bridgeName,
 		Subnet:        subnet,
 		Gateway:       gateway,
 		HostInterface: hostInterface,
+		Mode:          ModeNAT,
+		Backend:       NewHostBackend(),
 	}
 }
 
@@ -35,198 +45,192 @@ func (m *Manager) prefixLen() string {
 	return fmt.Sprintf("%d", ones)
 }
 
-// EnsureBridge creates the network bridge if it doesn't exist and ensures NAT is configured
+// EnsureBridge creates the network bridge if it doesn't exist and ensures the
+// rules for the network's mode are configured
 func (m *Manager) EnsureBridge() error {
-	// Create bridge if it doesn't exist
-	if !m.bridgeExists() {
-		// Create bridge
-		if err := m.runCmd("ip", "link", "add", m.BridgeName, "type", "bridge"); err != nil {
-			return fmt.Errorf("failed to create bridge: %w", err)
-		}
-
-		// Set bridge IP
-		if err := m.runCmd("ip", "addr", "add", m.Gateway+"/"+m.prefixLen(), "dev", m.BridgeName); err != nil {
-			// Might already have an IP, continue
-		}
-
-		// Bring up bridge
-		if err := m.runCmd("ip", "link", "set", m.BridgeName, "up"); err != nil {
-			return fmt.Errorf("failed to bring up bridge: %w", err)
+	if !m.Backend.LinkExists(m.BridgeName) {
+		if err := m.Backend.CreateBridge(m.BridgeName, m.Gateway+"/"+m.prefixLen()); err != nil {
+			return err
 		}
 	}
 
 	// Always ensure IP forwarding is enabled
-	if err := m.runCmd("sysctl", "-w", "net.ipv4.ip_forward=1"); err != nil {
+	if err := m.Backend.EnableIPForwarding(); err != nil {
 		return fmt.Errorf("failed to enable IP forwarding: %w", err)
 	}
+	// route_localnet makes the kernel accept packets for 127.0.0.0/8 from
+	// the bridge, so guests could reach services bound to the host's
+	// loopback. The guard drops them unless a port forward NATed them,
+	// and it goes in before AddPortForward turns route_localnet on.
+	if err := m.Backend.SetRules(localnetGuardOwner, localnetGuardRules()); err != nil {
+		return fmt.Errorf("failed to setup localhost guard rules: %w", err)
+	}
+	if m.Mode == ModeIsolated {
+		if err := m.Backend.SetRouteLocalnet(m.BridgeName, false); err != nil {
+			return fmt.Errorf("failed to disable localhost port forwarding: %w", err)
+		}
+	}
+
+	// Dual-stack networks also need the bridge's IPv6 gateway address. It
+	// is added on every call so enabling IPv6 on an existing network does
+	// not require recreating the bridge.
+	if m.Subnet6 != "" {
+		gw6, err := IPv6Address(m.Subnet6, m.Gateway)
+		if err != nil {
+			return err
+		}
+		if err := m.Backend.AddAddress(m.BridgeName, fmt.Sprintf("%s/%d", gw6, prefixLen6(m.Subnet6))); err != nil {
+			return fmt.Errorf("failed to set bridge IPv6 address: %w", err)
+		}
+		if err := m.Backend.EnableIPv6Forwarding(m.HostInterface); err != nil {
+			return fmt.Errorf("failed to enable IPv6 forwarding: %w", err)
+		}
+	}
 
-	// Always ensure NAT rules are in place (setupNAT checks for duplicates)
-	if err := m.setupNAT(); err != nil {
-		return fmt.Errorf("failed to setup NAT: %w", err)
+	// Always ensure the rules for the network's mode are in place. They are
+	// replaced as a whole, so a changed mode never leaves stale rules behind.
+	if err := m.Backend.SetRules(m.BridgeName, m.rules()); err != nil {
+		return fmt.Errorf("failed to setup %s network rules: %w", m.Mode, err)
 	}
 
 	return nil
 }
 
-// CreateTap creates a TAP device for a VM
-func (m *Manager) CreateTap(tapName string) error {
-	// Create TAP device
-	if err := m.runCmd("ip", "tuntap", "add", "dev", tapName, "mode", "tap"); err != nil {
-		return fmt.Errorf("failed to create TAP device: %w", err)
+// DeleteBridge removes the bridge and the forwarding rules EnsureBridge
+// added for it. Rules that are already gone are ignored.
+func (m *Manager) DeleteBridge() error {
+	if err := m.Backend.SetRules(m.BridgeName, nil); err != nil {
+		return fmt.Errorf("failed to remove network rules: %w", err)
 	}
-
-	// Add TAP to bridge
-	if err := m.runCmd("ip", "link", "set", tapName, "master", m.BridgeName); err != nil {
-		m.DeleteTap(tapName) // Cleanup on failure
-		return fmt.Errorf("failed to add TAP to bridge: %w", err)
+	if !m.Backend.LinkExists(m.BridgeName) {
+		return nil
 	}
-
-	// Bring up TAP
-	if err := m.runCmd("ip", "link", "set", tapName, "up"); err != nil {
-		m.DeleteTap(tapName)
-		return fmt.Errorf("failed to bring up TAP: %w", err)
+	if err := m.Backend.DeleteLink(m.BridgeName); err != nil {
+		return fmt.Errorf("failed to delete bridge: %w", err)
 	}
-
 	return nil
 }
 
+// CreateTap creates a TAP device for a VM and attaches it to the bridge
+func (m *Manager) CreateTap(tapName string) error {
+	return m.Backend.CreateTap(tapName, m.BridgeName)
+}
+
 // DeleteTap removes a TAP device
 func (m *Manager) DeleteTap(tapName string) error {
-	return m.runCmd("ip", "link", "del", tapName)
+	return m.Backend.DeleteLink(tapName)
+}
+
+// RenameTap renames a TAP device. It stays attached to the bridge and to the
+// Firecracker process using it.
+func (m *Manager) RenameTap(tapName, newName string) error {
+	return m.Backend.RenameLink(tapName, newName)
 }
 
 // AllocateIP finds the next free IP in the subnet, skipping any in usedIPs.
 // The gateway (.1) is always reserved.
 func (m *Manager) AllocateIP(usedIPs []string) (string, error) {
-	_, ipnet, err := net.ParseCIDR(m.Subnet)
-	if err != nil {
-		return "", fmt.Errorf("invalid subnet: %w", err)
-	}
-
-	baseIP := ipnet.IP.To4()
-	if baseIP == nil {
-		return "", fmt.Errorf("invalid IPv4 subnet")
-	}
-
 	taken := make(map[string]bool)
 	for _, ip := range usedIPs {
 		taken[ip] = true
 	}
 	taken[m.Gateway] = true
 
-	// Start from .2 and find the first unused IP
-	for offset := 2; offset < 65534; offset++ {
-		candidate := make(net.IP, 4)
-		copy(candidate, baseIP)
-		candidate[2] = byte(offset / 256)
-		candidate[3] = byte(offset % 256)
-
-		if !ipnet.Contains(candidate) {
-			break
-		}
-
-		addr := candidate.String()
-		if !taken[addr] {
-			return addr, nil
-		}
-	}
-
-	return "", fmt.Errorf("no free IP addresses in subnet %s", m.Subnet)
+	return firstFreeIP(m.Subnet, func(ip string) bool { return taken[ip] })
 }
 
-// AddPortForward adds a DNAT rule for port forwarding.
-// It is idempotent: if the rule already exists, it returns nil.
-func (m *Manager) AddPortForward(hostPort, guestPort int, guestIP, protocol string) error {
-	if hostPort < 1 || hostPort > 65535 {
-		return fmt.Errorf("invalid host port %d: must be 1-65535", hostPort)
-	}
-	if guestPort < 1 || guestPort > 65535 {
-		return fmt.Errorf("invalid guest port %d: must be 1-65535", guestPort)
-	}
-
-	// Check if rule already exists (iptables -C returns 0 if it does)
-	if err := m.runCmd("iptables", "-t", "nat", "-C", "PREROUTING",
-		"-p", protocol, "--dport", fmt.Sprintf("%d", hostPort),
-		"-j", "DNAT", "--to-destination", fmt.Sprintf("%s:%d", guestIP, guestPort)); err == nil {
-		return nil // Rule already exists
+// AddPortForward adds the DNAT rules for a port forward. Adding a forward
+// whose host ports are already forwarded re-targets them to pf's guest.
+// IPv4 forwards are also reachable through 127.0.0.1, which needs
+// route_localnet on the bridge; isolated networks never get it, as nothing
+// is forwarded onto them.
+func (m *Manager) AddPortForward(pf PortForward) error {
+	if err := pf.Validate(); err != nil {
+		return err
+	}
+	if m.Mode != ModeIsolated && net.ParseIP(pf.GuestIP).To4() != nil {
+		if err := m.Backend.SetRouteLocalnet(m.BridgeName, true); err != nil {
+			return fmt.Errorf("failed to enable localhost port forwarding: %w", err)
+		}
 	}
-
-	// Add the rule
-	if err := m.runCmd("iptables", "-t", "nat", "-A", "PREROUTING",
-		"-p", protocol, "--dport", fmt.Sprintf("%d", hostPort),
-		"-j", "DNAT", "--to-destination", fmt.Sprintf("%s:%d", guestIP, guestPort)); err != nil {
+	if err := m.Backend.AddPortForward(pf); err != nil {
 		return fmt.Errorf("failed to add port forward: %w", err)
 	}
-
 	return nil
 }
 
-// RemovePortForward removes a DNAT rule
-func (m *Manager) RemovePortForward(hostPort, guestPort int, guestIP, protocol string) error {
-	rule := fmt.Sprintf("-t nat -D PREROUTING -p %s --dport %d -j DNAT --to-destination %s:%d",
-		protocol, hostPort, guestIP, guestPort)
-
-	return m.runCmd("iptables", strings.Split(rule, " ")...)
+// RemovePortForward removes the DNAT rules for a port forward. Rules that
+// are already gone are ignored.
+func (m *Manager) RemovePortForward(pf PortForward) error {
+	if err := m.Backend.RemovePortForward(pf); err != nil {
+		return fmt.Errorf("failed to remove port forward: %w", err)
+	}
+	return nil
 }
 
-// setupNAT configures iptables for NAT
-func (m *Manager) setupNAT() error {
-	// MASQUERADE for outbound traffic (match any interface except the bridge itself)
-	if err := m.runCmd("iptables", "-t", "nat", "-C", "POSTROUTING",
-		"-s", m.Subnet, "!", "-o", m.BridgeName, "-j", "MASQUERADE"); err != nil {
-		// Rule doesn't exist, add it
-		if err := m.runCmd("iptables", "-t", "nat", "-A", "POSTROUTING",
-			"-s", m.Subnet, "!", "-o", m.BridgeName, "-j", "MASQUERADE"); err != nil {
-			return err
+// rules returns the rules for the network's mode: masquerading for NAT, plain
+// forwarding for routed, and dropping everything that crosses the bridge for
+// isolated networks. Interface matches apply to IPv4 and IPv6 alike; NAT
+// networks masquerade each of their subnets. Outside isolated networks,
+// connections from localhost that a port forward sends onto the bridge are
+// masqueraded behind the gateway, since a guest cannot reply to 127.0.0.1.
+func (m *Manager) rules() []Rule {
+	if m.Mode == ModeIsolated {
+		return []Rule{
+			{Hook: HookForward, InIface: m.BridgeName, NotOutIface: m.BridgeName, Verdict: VerdictDrop},
+			{Hook: HookForward, OutIface: m.BridgeName, NotInIface: m.BridgeName, Verdict: VerdictDrop},
 		}
 	}
-
-	// Allow forwarding from bridge
-	if err := m.runCmd("iptables", "-C", "FORWARD",
-		"-i", m.BridgeName, "-o", m.HostInterface, "-j", "ACCEPT"); err != nil {
-		if err := m.runCmd("iptables", "-A", "FORWARD",
-			"-i", m.BridgeName, "-o", m.HostInterface, "-j", "ACCEPT"); err != nil {
-			return err
+	rules := []Rule{
+		{Hook: HookPostrouting, Source: localhostSubnet, OutIface: m.BridgeName, Verdict: VerdictMasquerade},
+	}
+	switch m.Mode {
+	case ModeRouted:
+		return append(rules, m.forwardRules(true)...)
+	default:
+		// Masquerade outbound traffic (any interface except the bridge itself)
+		rules = append(rules, Rule{Hook: HookPostrouting, Source: m.Subnet, NotOutIface: m.BridgeName, Verdict: VerdictMasquerade})
+		if m.Subnet6 != "" {
+			rules = append(rules, Rule{Hook: HookPostrouting, Source: m.Subnet6, NotOutIface: m.BridgeName, Verdict: VerdictMasquerade})
 		}
+		return append(rules, m.forwardRules(false)...)
 	}
+}
 
-	// Allow forwarding to bridge (established connections)
-	if err := m.runCmd("iptables", "-C", "FORWARD",
-		"-i", m.HostInterface, "-o", m.BridgeName,
-		"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"); err != nil {
-		if err := m.runCmd("iptables", "-A", "FORWARD",
-			"-i", m.HostInterface, "-o", m.BridgeName,
-			"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"); err != nil {
-			return err
-		}
+// localnetGuardRules drops packets for 127.0.0.0/8 arriving from anywhere
+// but the loopback interface, unless they belong to a connection a port
+// forward DNATed. They are the same for every network.
+func localnetGuardRules() []Rule {
+	return []Rule{
+		{Hook: HookInput, Destination: localhostSubnet, NotInIface: "lo", NotDNAT: true, Verdict: VerdictDrop},
 	}
-
-	return nil
 }
 
-// bridgeExists checks if the bridge interface exists
-func (m *Manager) bridgeExists() bool {
-	_, err := net.InterfaceByName(m.BridgeName)
-	return err == nil
+// forwardRules allows traffic from the bridge out of the host interface, and
+// replies back in. With inbound set, new connections from outside are let in
+// as well.
+func (m *Manager) forwardRules(inbound bool) []Rule {
+	return []Rule{
+		{Hook: HookForward, InIface: m.BridgeName, OutIface: m.HostInterface, Verdict: VerdictAccept},
+		{Hook: HookForward, InIface: m.HostInterface, OutIface: m.BridgeName, Established: !inbound, Verdict: VerdictAccept},
+	}
 }
 
 // TapExists checks if a TAP device exists
 func (m *Manager) TapExists(tapName string) bool {
-	_, err := net.InterfaceByName(tapName)
-	return err == nil
-}
-
-// runCmd executes a shell command
-func (m *Manager) runCmd(name string, args ...string) error {
-	cmd := exec.Command(name, args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("%s: %s", err, string(output))
-	}
-	return nil
+	return m.Backend.LinkExists(tapName)
 }
 
 // GenerateTapName generates a TAP device name for a VM
 func GenerateTapName(vmID string) string {
 	return fmt.Sprintf("vmm-%s", vmID[:6])
 }
+
+// GenerateNICTapName generates the TAP device name for a VM's index'th
+// interface. The primary interface (index 0) uses GenerateTapName.
+func GenerateNICTapName(vmID string, index int) string {
+	if index == 0 {
+		return GenerateTapName(vmID)
+	}
+	return fmt.Sprintf("vmm-%s-%d", vmID[:6], index)
+}
@@ -1,6 +1,8 @@
 package network
 
 import (
+	"errors"
+	"strings"
 	"testing"
 )
 
@@ -24,6 +26,27 @@ func TestGenerateTapName(t *testing.T) {
 	}
 }
 
+func TestGenerateNICTapName(t *testing.T) {
+	tests := []struct {
+		index int
+		want  string
+	}{
+		{0, "vmm-abcdef"},
+		{1, "vmm-abcdef-1"},
+		{12, "vmm-abcdef-12"},
+	}
+
+	for _, tt := range tests {
+		got := GenerateNICTapName("abcdef12", tt.index)
+		if got != tt.want {
+			t.Errorf("GenerateNICTapName(abcdef12, %d) = %q, want %q", tt.index, got, tt.want)
+		}
+		if len(got) > maxBridgeNameLen {
+			t.Errorf("GenerateNICTapName(abcdef12, %d) = %q is longer than an interface name may be", tt.index, got)
+		}
+	}
+}
+
 func TestAllocateIP(t *testing.T) {
 	m := &Manager{
 		Subnet:  "172.16.0.0/16",
@@ -106,6 +129,417 @@ func TestAllocateIP_Slash24(t *testing.T) {
 	// an error when all /24 addresses are exhausted.
 }
 
+func TestRulesByMode(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      Mode
+		subnet6   string
+		wantRules int
+		want      string
+	}{
+		{"nat", ModeNAT, "", 4, `postrouting ip saddr 172.16.0.0/16 oifname != "vmm-br0" masquerade`},
+		{"routed", ModeRouted, "", 3, `forward iifname "eth0" oifname "vmm-br0" accept`},
+		{"isolated", ModeIsolated, "", 2, `forward iifname "vmm-br0" oifname != "vmm-br0" drop`},
+		// Modes that let port forwards through masquerade localhost
+		// connections sent to a guest
+		{"routed localhost", ModeRouted, "", 3, `postrouting ip saddr 127.0.0.0/8 oifname "vmm-br0" masquerade`},
+		// Dual-stack NAT networks masquerade the IPv6 subnet as well
+		{"nat dual-stack", ModeNAT, "fd00:db8::/64", 5, `postrouting ip6 saddr fd00:db8::/64 oifname != "vmm-br0" masquerade`},
+		// Forwarding rules only match interfaces, so they cover IPv6 as is
+		{"routed dual-stack", ModeRouted, "fd00:db8::/64", 3, `forward iifname "vmm-br0" oifname "eth0" accept`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager("vmm-br0", "172.16.0.0/16", "172.16.0.1", "eth0")
+			m.Mode = tt.mode
+			m.Subnet6 = tt.subnet6
+
+			rules := m.rules()
+			if len(rules) != tt.wantRules {
+				t.Fatalf("rules() returned %d rules, want %d", len(rules), tt.wantRules)
+			}
+			found := false
+			for _, r := range rules {
+				if r.String() == tt.want {
+					found = true
+				}
+				if tt.mode != ModeNAT && r.Hook == HookPostrouting && r.Source != localhostSubnet {
+					t.Errorf("%s network has a NAT rule: %s", tt.mode, r)
+				}
+				if tt.mode == ModeIsolated && r.Verdict != VerdictDrop {
+					t.Errorf("isolated network has a rule that does not drop: %s", r)
+				}
+				if _, err := ruleExprs(r); err != nil {
+					t.Errorf("rule %s cannot be translated to nftables: %v", r, err)
+				}
+			}
+			if !found {
+				t.Errorf("rules() = %v, want a rule %q", rules, tt.want)
+			}
+		})
+	}
+}
+
+func newFakeManager() (*Manager, *FakeBackend) {
+	fake := NewFakeBackend()
+	m := NewManager("vmm-br0", "172.16.0.0/16", "172.16.0.1", "eth0")
+	m.Backend = fake
+	return m, fake
+}
+
+func TestEnsureBridge(t *testing.T) {
+	m, fake := newFakeManager()
+
+	if err := m.EnsureBridge(); err != nil {
+		t.Fatalf("EnsureBridge() error: %v", err)
+	}
+	if !fake.LinkExists("vmm-br0") {
+		t.Fatal("bridge was not created")
+	}
+	if got := fake.Address("vmm-br0"); got != "172.16.0.1/16" {
+		t.Errorf("bridge address = %q, want 172.16.0.1/16", got)
+	}
+	if !fake.IPForwarding() {
+		t.Error("IP forwarding was not enabled")
+	}
+	if fake.RouteLocalnet("vmm-br0") {
+		t.Error("route_localnet was enabled on a bridge without port forwards")
+	}
+	guard := fake.Rules(localnetGuardOwner)
+	if len(guard) != 1 || guard[0].String() != `input ip daddr 127.0.0.0/8 iifname != "lo" ct status & dnat == 0 drop` {
+		t.Errorf("localhost guard rules = %v", guard)
+	}
+	if got := len(fake.Rules("vmm-br0")); got != 4 {
+		t.Errorf("got %d rules for the bridge, want 4", got)
+	}
+
+	// A second call with a different mode replaces the rules rather than
+	// adding to them, and leaves the existing bridge alone
+	m.Mode = ModeIsolated
+	if err := m.EnsureBridge(); err != nil {
+		t.Fatalf("second EnsureBridge() error: %v", err)
+	}
+	rules := fake.Rules("vmm-br0")
+	if len(rules) != 2 {
+		t.Fatalf("got %d rules after switching to isolated, want 2: %v", len(rules), rules)
+	}
+	for _, r := range rules {
+		if r.Verdict != VerdictDrop {
+			t.Errorf("stale rule left after switching to isolated: %s", r)
+		}
+	}
+
+	if err := m.DeleteBridge(); err != nil {
+		t.Fatalf("DeleteBridge() error: %v", err)
+	}
+	if fake.LinkExists("vmm-br0") {
+		t.Error("bridge still exists after DeleteBridge")
+	}
+	if rules := fake.Rules("vmm-br0"); len(rules) != 0 {
+		t.Errorf("rules left after DeleteBridge: %v", rules)
+	}
+	if err := m.DeleteBridge(); err != nil {
+		t.Errorf("DeleteBridge() on a missing bridge error: %v", err)
+	}
+}
+
+func TestEnsureBridgeDualStack(t *testing.T) {
+	m, fake := newFakeManager()
+	m.Subnet6 = "fd00:db8::/64"
+
+	if err := m.EnsureBridge(); err != nil {
+		t.Fatalf("EnsureBridge() error: %v", err)
+	}
+	want := []string{"172.16.0.1/16", "fd00:db8::ac10:1/64"}
+	if got := fake.Addresses("vmm-br0"); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("bridge addresses = %v, want %v", got, want)
+	}
+	if !fake.IPv6Forwarding() {
+		t.Error("IPv6 forwarding was not enabled")
+	}
+
+	// Enabling IPv6 on an existing IPv4-only bridge adds the address once
+	m2, fake2 := newFakeManager()
+	if err := m2.EnsureBridge(); err != nil {
+		t.Fatalf("EnsureBridge() error: %v", err)
+	}
+	m2.Subnet6 = "fd00:db8::/64"
+	for i := 0; i < 2; i++ {
+		if err := m2.EnsureBridge(); err != nil {
+			t.Fatalf("EnsureBridge() with IPv6 error: %v", err)
+		}
+	}
+	if got := fake2.Addresses("vmm-br0"); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("bridge addresses after enabling IPv6 = %v, want %v", got, want)
+	}
+}
+
+func TestEnsureBridgeError(t *testing.T) {
+	m, fake := newFakeManager()
+	fake.Err = errors.New("netlink: operation not permitted")
+
+	if err := m.EnsureBridge(); err == nil {
+		t.Fatal("expected EnsureBridge to fail")
+	}
+}
+
+func TestCreateTap(t *testing.T) {
+	m, fake := newFakeManager()
+	if err := m.EnsureBridge(); err != nil {
+		t.Fatalf("EnsureBridge() error: %v", err)
+	}
+
+	if err := m.CreateTap("vmm-abcdef"); err != nil {
+		t.Fatalf("CreateTap() error: %v", err)
+	}
+	if !m.TapExists("vmm-abcdef") {
+		t.Fatal("TAP device was not created")
+	}
+	if got := fake.Master("vmm-abcdef"); got != "vmm-br0" {
+		t.Errorf("TAP attached to %q, want vmm-br0", got)
+	}
+
+	if err := m.RenameTap("vmm-abcdef", "vmm-123456"); err != nil {
+		t.Fatalf("RenameTap() error: %v", err)
+	}
+	if m.TapExists("vmm-abcdef") || fake.Master("vmm-123456") != "vmm-br0" {
+		t.Error("renamed TAP device should keep its bridge under the new name only")
+	}
+	if err := m.RenameTap("vmm-abcdef", "vmm-123456"); err == nil {
+		t.Error("RenameTap() of a missing TAP device should fail")
+	}
+
+	if err := m.DeleteTap("vmm-123456"); err != nil {
+		t.Fatalf("DeleteTap() error: %v", err)
+	}
+	if m.TapExists("vmm-123456") {
+		t.Error("TAP device still exists after DeleteTap")
+	}
+}
+
+func TestPortForward(t *testing.T) {
+	m, fake := newFakeManager()
+	pf := PortForward{Protocol: "tcp", HostPort: 8080, GuestIP: "172.16.0.2", GuestPort: 80}
+
+	if err := m.AddPortForward(pf); err != nil {
+		t.Fatalf("AddPortForward() error: %v", err)
+	}
+	// Adding the same forward again is a no-op
+	if err := m.AddPortForward(pf); err != nil {
+		t.Fatalf("second AddPortForward() error: %v", err)
+	}
+	pfs := fake.PortForwards()
+	if len(pfs) != 1 {
+		t.Fatalf("got %d port forwards, want 1: %v", len(pfs), pfs)
+	}
+	if got, want := pfs[0].String(), "tcp dport 8080 dnat to 172.16.0.2:80"; got != want {
+		t.Errorf("port forward = %q, want %q", got, want)
+	}
+	if _, err := dnatExprs(pfs[0]); err != nil {
+		t.Errorf("port forward cannot be translated to nftables: %v", err)
+	}
+
+	// Forwarding the same host port to a new address re-targets it
+	moved := pf
+	moved.GuestIP = "172.16.0.9"
+	if err := m.AddPortForward(moved); err != nil {
+		t.Fatalf("AddPortForward() to a new address error: %v", err)
+	}
+	if pfs := fake.PortForwards(); len(pfs) != 1 || pfs[0] != moved {
+		t.Errorf("port forwards after re-targeting = %v, want [%s]", pfs, moved)
+	}
+
+	if err := m.RemovePortForward(moved); err != nil {
+		t.Fatalf("RemovePortForward() error: %v", err)
+	}
+	if pfs := fake.PortForwards(); len(pfs) != 0 {
+		t.Errorf("port forwards left after removal: %v", pfs)
+	}
+	if err := m.RemovePortForward(moved); err != nil {
+		t.Errorf("RemovePortForward() of a missing rule error: %v", err)
+	}
+
+	// The same port over UDP is a separate forward
+	udp := pf
+	udp.Protocol = "udp"
+	for _, p := range []PortForward{pf, udp} {
+		if err := m.AddPortForward(p); err != nil {
+			t.Fatalf("AddPortForward(%s) error: %v", p, err)
+		}
+	}
+	if pfs := fake.PortForwards(); len(pfs) != 2 {
+		t.Errorf("got %d port forwards for tcp and udp, want 2: %v", len(pfs), pfs)
+	}
+
+	// IPv6 forwards are separate rules for the same host port
+	if err := m.AddPortForward(PortForward{Protocol: "tcp", HostPort: 8080, GuestIP: "fd00::ac10:2", GuestPort: 80}); err != nil {
+		t.Fatalf("AddPortForward() over IPv6 error: %v", err)
+	}
+	pfs = fake.PortForwards()
+	if len(pfs) != 3 {
+		t.Fatalf("got %d port forwards, want 3: %v", len(pfs), pfs)
+	}
+	for _, pf := range pfs {
+		if _, err := dnatExprs(pf); err != nil {
+			t.Errorf("port forward %s cannot be translated to nftables: %v", pf, err)
+		}
+	}
+	if got, want := (PortForward{Protocol: "tcp", HostPort: 8080, GuestIP: "fd00::ac10:2", GuestPort: 80}).String(), "tcp dport 8080 dnat to [fd00::ac10:2]:80"; got != want {
+		t.Errorf("IPv6 port forward = %q, want %q", got, want)
+	}
+}
+
+func TestPortForwardRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		pf        PortForward
+		want      string
+		wantRules int
+	}{
+		{
+			name:      "single port",
+			pf:        PortForward{Protocol: "udp", HostPort: 5353, GuestIP: "172.16.0.2", GuestPort: 53},
+			want:      "udp dport 5353 dnat to 172.16.0.2:53",
+			wantRules: 1,
+		},
+		{
+			// The destination port is kept, so one rule covers the range
+			name:      "same guest ports",
+			pf:        PortForward{Protocol: "udp", HostPort: 10000, HostPortEnd: 10100, GuestIP: "172.16.0.2", GuestPort: 10000},
+			want:      "udp dport 10000-10100 dnat to 172.16.0.2:10000-10100",
+			wantRules: 1,
+		},
+		{
+			name:      "shifted guest ports",
+			pf:        PortForward{Protocol: "tcp", HostPort: 8000, HostPortEnd: 8002, GuestIP: "172.16.0.2", GuestPort: 9000},
+			want:      "tcp dport 8000-8002 dnat to 172.16.0.2:9000-9002",
+			wantRules: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.pf.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+			rules, err := dnatExprs(tt.pf)
+			if err != nil {
+				t.Fatalf("dnatExprs() error: %v", err)
+			}
+			if len(rules) != tt.wantRules {
+				t.Errorf("dnatExprs() returned %d rules, want %d", len(rules), tt.wantRules)
+			}
+		})
+	}
+
+	// Overlapping ranges are told apart by their exact host ports
+	m, fake := newFakeManager()
+	for _, pf := range tests {
+		if err := m.AddPortForward(pf.pf); err != nil {
+			t.Fatalf("AddPortForward(%s) error: %v", pf.pf, err)
+		}
+	}
+	if pfs := fake.PortForwards(); len(pfs) != len(tests) {
+		t.Errorf("got %d port forwards, want %d: %v", len(pfs), len(tests), pfs)
+	}
+}
+
+func TestPortForwardRouteLocalnet(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    Mode
+		guestIP string
+		want    bool
+	}{
+		{"nat", ModeNAT, "172.16.0.2", true},
+		{"routed", ModeRouted, "172.16.0.2", true},
+		// IPv6 has no route_localnet; ::1 is never routed
+		{"ipv6", ModeNAT, "fd00::ac10:2", false},
+		// Nothing is forwarded onto an isolated network
+		{"isolated", ModeIsolated, "172.16.0.2", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, fake := newFakeManager()
+			m.Mode = tt.mode
+			if err := m.EnsureBridge(); err != nil {
+				t.Fatalf("EnsureBridge() error: %v", err)
+			}
+			if err := m.AddPortForward(PortForward{Protocol: "tcp", HostPort: 8080, GuestIP: tt.guestIP, GuestPort: 80}); err != nil {
+				t.Fatalf("AddPortForward() error: %v", err)
+			}
+			if got := fake.RouteLocalnet("vmm-br0"); got != tt.want {
+				t.Errorf("route_localnet = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Switching a network to isolated turns route_localnet back off
+	m, fake := newFakeManager()
+	if err := m.AddPortForward(PortForward{Protocol: "tcp", HostPort: 8080, GuestIP: "172.16.0.2", GuestPort: 80}); err != nil {
+		t.Fatalf("AddPortForward() error: %v", err)
+	}
+	m.Mode = ModeIsolated
+	if err := m.EnsureBridge(); err != nil {
+		t.Fatalf("EnsureBridge() error: %v", err)
+	}
+	if fake.RouteLocalnet("vmm-br0") {
+		t.Error("route_localnet still enabled after switching to isolated")
+	}
+	for _, r := range localnetGuardRules() {
+		if _, err := ruleExprs(r); err != nil {
+			t.Errorf("guard rule %s cannot be translated to nftables: %v", r, err)
+		}
+	}
+}
+
+func TestAddPortForwardValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		pf   PortForward
+	}{
+		{"host port zero", PortForward{Protocol: "tcp", HostPort: 0, GuestIP: "172.16.0.2", GuestPort: 80}},
+		{"host port too large", PortForward{Protocol: "tcp", HostPort: 65536, GuestIP: "172.16.0.2", GuestPort: 80}},
+		{"guest port zero", PortForward{Protocol: "tcp", HostPort: 8080, GuestIP: "172.16.0.2", GuestPort: 0}},
+		{"guest port too large", PortForward{Protocol: "tcp", HostPort: 8080, GuestIP: "172.16.0.2", GuestPort: 70000}},
+		{"range end before start", PortForward{Protocol: "tcp", HostPort: 8080, HostPortEnd: 8000, GuestIP: "172.16.0.2", GuestPort: 80}},
+		{"guest range past the last port", PortForward{Protocol: "tcp", HostPort: 8000, HostPortEnd: 8010, GuestIP: "172.16.0.2", GuestPort: 65530}},
+		{"unknown protocol", PortForward{Protocol: "sctp", HostPort: 80, GuestIP: "172.16.0.2", GuestPort: 80}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, fake := newFakeManager()
+			if err := m.AddPortForward(tt.pf); err == nil {
+				t.Fatal("expected an error")
+			}
+			if pfs := fake.PortForwards(); len(pfs) != 0 {
+				t.Errorf("invalid port forward was added: %v", pfs)
+			}
+		})
+	}
+}
+
+func TestDnatExprsValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		pf   PortForward
+	}{
+		{"unknown protocol", PortForward{Protocol: "sctp", HostPort: 80, GuestIP: "172.16.0.2", GuestPort: 80}},
+		{"invalid guest IP", PortForward{Protocol: "tcp", HostPort: 80, GuestIP: "not-an-ip", GuestPort: 80}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := dnatExprs(tt.pf); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
 func itoa(i int) string {
 	s := ""
 	if i == 0 {
@@ -0,0 +1,594 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+// nftTableName is the nftables table (family inet) holding all vmm rules.
+// Keeping them in a table of our own means they never interleave with rules
+// managed by other tools, and `nft list table inet vmm` shows everything vmm
+// has set up.
+const nftTableName = "vmm"
+
+// portForwardTag prefixes the owner tag of port forward rules so they never
+// collide with a bridge name.
+const portForwardTag = "dnat "
+
+// firewallTag prefixes the owner tag of the rules that send a TAP device's
+// traffic to its firewall chains.
+const firewallTag = "firewall "
+
+// ipsDstNAT is the conntrack status bit set on connections that were DNATed
+// (IPS_DST_NAT in linux/netfilter/nf_conntrack_common.h).
+const ipsDstNAT = 1 << 5
+
+var (
+	nftTable = &nftables.Table{Family: nftables.TableFamilyINet, Name: nftTableName}
+
+	nftInput = &nftables.Chain{
+		Name:     "input",
+		Table:    nftTable,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+	}
+	nftForward = &nftables.Chain{
+		Name:     "forward",
+		Table:    nftTable,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+	}
+	nftPrerouting = &nftables.Chain{
+		Name:     "prerouting",
+		Table:    nftTable,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityNATDest,
+	}
+	// Connections the host makes itself skip prerouting, so port forwards
+	// also need a rule at the output hook to work from localhost
+	nftOutput = &nftables.Chain{
+		Name:     "output",
+		Table:    nftTable,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityNATDest,
+	}
+	nftPostrouting = &nftables.Chain{
+		Name:     "postrouting",
+		Table:    nftTable,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	}
+
+	// VM firewalls live in a bridge family table, so they also see traffic
+	// between VMs on the same bridge, which is never routed. Frames between
+	// two ports pass the forward hook, frames to and from the host (and so
+	// anything routed or NATed) pass input and output.
+	nftBridgeTable = &nftables.Table{Family: nftables.TableFamilyBridge, Name: nftTableName}
+
+	nftBridgeForward = &nftables.Chain{
+		Name:     "forward",
+		Table:    nftBridgeTable,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+	}
+	nftBridgeInput = &nftables.Chain{
+		Name:     "input",
+		Table:    nftBridgeTable,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+	}
+	nftBridgeOutput = &nftables.Chain{
+		Name:     "output",
+		Table:    nftBridgeTable,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityFilter,
+	}
+)
+
+func (hostBackend) SetRules(owner string, rules []Rule) error {
+	var nftRules []*nftables.Rule
+	for _, r := range rules {
+		exprs, err := ruleExprs(r)
+		if err != nil {
+			return err
+		}
+		chain := nftForward
+		switch r.Hook {
+		case HookInput:
+			chain = nftInput
+		case HookPostrouting:
+			chain = nftPostrouting
+		}
+		nftRules = append(nftRules, &nftables.Rule{Table: nftTable, Chain: chain, Exprs: exprs})
+	}
+	return replaceRules(owner, []*nftables.Chain{nftInput, nftForward, nftPostrouting}, nftRules)
+}
+
+func (hostBackend) AddPortForward(pf PortForward) error {
+	dnat, err := dnatExprs(pf)
+	if err != nil {
+		return err
+	}
+	var rules []*nftables.Rule
+	for _, chain := range []*nftables.Chain{nftPrerouting, nftOutput} {
+		for _, exprs := range dnat {
+			rules = append(rules, &nftables.Rule{Table: nftTable, Chain: chain, Exprs: exprs})
+		}
+	}
+	return replaceRules(portForwardTag+pf.owner(), []*nftables.Chain{nftPrerouting, nftOutput}, rules)
+}
+
+func (hostBackend) RemovePortForward(pf PortForward) error {
+	return replaceRules(portForwardTag+pf.owner(), []*nftables.Chain{nftPrerouting, nftOutput}, nil)
+}
+
+// SetFirewall compiles fw into two regular chains for the TAP device,
+// <tap>-in for traffic to the VM and <tap>-out for traffic from it, and
+// jumps to them from the bridge table's base chains. Everything is replaced
+// in a single transaction.
+func (hostBackend) SetFirewall(tap string, fw *Firewall) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("failed to open nftables connection: %w", err)
+	}
+	if fw == nil {
+		// Nothing to remove if no VM has ever had a firewall
+		if _, err := conn.ListTableOfFamily(nftTableName, nftables.TableFamilyBridge); errors.Is(err, unix.ENOENT) {
+			return nil
+		}
+	}
+	if err := ensureNftTable(conn, nftBridgeTable, nftBridgeForward, nftBridgeInput, nftBridgeOutput); err != nil {
+		return err
+	}
+
+	tag := firewallTag + tap
+	for _, chain := range []*nftables.Chain{nftBridgeForward, nftBridgeInput, nftBridgeOutput} {
+		current, err := conn.GetRules(nftBridgeTable, chain)
+		if err != nil {
+			return fmt.Errorf("failed to list nftables rules: %w", err)
+		}
+		for _, r := range current {
+			if t, ok := userdata.GetString(r.UserData, userdata.TypeComment); ok && t == tag {
+				if err := conn.DelRule(r); err != nil {
+					return fmt.Errorf("failed to delete nftables rule: %w", err)
+				}
+			}
+		}
+	}
+
+	existing, err := conn.ListChainsOfTableFamily(nftables.TableFamilyBridge)
+	if err != nil {
+		return fmt.Errorf("failed to list nftables chains: %w", err)
+	}
+	in := &nftables.Chain{Name: tap + "-in", Table: nftBridgeTable}
+	out := &nftables.Chain{Name: tap + "-out", Table: nftBridgeTable}
+
+	if fw == nil {
+		for _, c := range existing {
+			if c.Table.Name == nftTableName && (c.Name == in.Name || c.Name == out.Name) {
+				conn.FlushChain(c)
+				conn.DelChain(c)
+			}
+		}
+	} else {
+		for _, c := range []struct {
+			chain  *nftables.Chain
+			rules  []FirewallRule
+			policy Verdict
+			source bool
+		}{
+			{in, fw.Ingress, fw.IngressPolicy, true},
+			{out, fw.Egress, fw.EgressPolicy, false},
+		} {
+			conn.AddChain(c.chain)
+			conn.FlushChain(c.chain)
+			rules, err := firewallExprs(c.rules, c.policy, c.source)
+			if err != nil {
+				return err
+			}
+			for _, exprs := range rules {
+				conn.AddRule(&nftables.Rule{Table: nftBridgeTable, Chain: c.chain, Exprs: exprs})
+			}
+		}
+
+		udata := userdata.AppendString(nil, userdata.TypeComment, tag)
+		jumps := []struct {
+			base   *nftables.Chain
+			key    expr.MetaKey
+			target *nftables.Chain
+		}{
+			{nftBridgeForward, expr.MetaKeyOIFNAME, in},
+			{nftBridgeForward, expr.MetaKeyIIFNAME, out},
+			{nftBridgeOutput, expr.MetaKeyOIFNAME, in},
+			{nftBridgeInput, expr.MetaKeyIIFNAME, out},
+		}
+		for _, j := range jumps {
+			exprs := append(matchIfname(j.key, expr.CmpOpEq, tap),
+				&expr.Verdict{Kind: expr.VerdictJump, Chain: j.target.Name})
+			conn.AddRule(&nftables.Rule{Table: nftBridgeTable, Chain: j.base, Exprs: exprs, UserData: udata})
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		if errors.Is(err, unix.EPROTO) {
+			// Connection tracking in the bridge family is a separate module
+			return fmt.Errorf("failed to apply nftables rules (is the nf_conntrack_bridge kernel module available?): %w", err)
+		}
+		return fmt.Errorf("failed to apply nftables rules: %w", err)
+	}
+	return nil
+}
+
+// firewallExprs translates one direction of a Firewall into the rules of
+// its chain. ARP, IPv6 neighbour discovery and replies to allowed
+// connections are accepted first, then rules are checked in order, and a
+// final rule applies the policy. source selects whether a rule's CIDR is
+// matched against the source or the destination address of the packet.
+func firewallExprs(rules []FirewallRule, policy Verdict, source bool) ([][]expr.Any, error) {
+	accept := &expr.Verdict{Kind: expr.VerdictAccept}
+	chain := [][]expr.Any{
+		append(matchEtherType(unix.ETH_P_ARP), accept),
+		append(matchNeighborDiscovery(), accept),
+		append(matchEstablished(), accept),
+	}
+	for _, r := range rules {
+		if err := r.Validate(); err != nil {
+			return nil, err
+		}
+		// Rules without a CIDR apply to IPv4 and IPv6 alike: the layer 4
+		// protocol is only set for IP packets, so nothing else matches.
+		var exprs []expr.Any
+		if r.CIDR != "" {
+			ipnet, _ := parseCIDR(r.CIDR)
+			f := familyOf(ipnet.IP)
+			offset := f.dstOffset
+			if source {
+				offset = f.srcOffset
+			}
+			exprs = append(exprs, matchEtherType(f.etherType)...)
+			exprs = append(exprs, matchNet(offset, ipnet)...)
+		}
+		if r.Protocol != "" {
+			proto := map[string]byte{
+				"tcp":    unix.IPPROTO_TCP,
+				"udp":    unix.IPPROTO_UDP,
+				"icmp":   unix.IPPROTO_ICMP,
+				"icmpv6": unix.IPPROTO_ICMPV6,
+			}[r.Protocol]
+			exprs = append(exprs,
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+			)
+		}
+		if r.Port != 0 {
+			exprs = append(exprs,
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(r.Port))},
+			)
+		}
+		chain = append(chain, append(exprs, verdictExpr(r.Verdict)))
+	}
+	if policy == VerdictDrop {
+		chain = append(chain, []expr.Any{verdictExpr(VerdictDrop)})
+	}
+	return chain, nil
+}
+
+// verdictExpr returns the expression for an accept or drop verdict.
+func verdictExpr(v Verdict) expr.Any {
+	if v == VerdictDrop {
+		return &expr.Verdict{Kind: expr.VerdictDrop}
+	}
+	return &expr.Verdict{Kind: expr.VerdictAccept}
+}
+
+// replaceRules deletes the rules tagged with owner from chains and adds
+// rules in their place, in a single transaction.
+func replaceRules(owner string, chains []*nftables.Chain, rules []*nftables.Rule) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("failed to open nftables connection: %w", err)
+	}
+	if err := ensureNftTable(conn, nftTable, nftInput, nftForward, nftPrerouting, nftOutput, nftPostrouting); err != nil {
+		return err
+	}
+
+	var existing []*nftables.Rule
+	for _, chain := range chains {
+		current, err := conn.GetRules(nftTable, chain)
+		if err != nil {
+			return fmt.Errorf("failed to list nftables rules: %w", err)
+		}
+		for _, r := range current {
+			if tag, ok := userdata.GetString(r.UserData, userdata.TypeComment); ok && tag == owner {
+				existing = append(existing, r)
+			}
+		}
+	}
+	for _, r := range existing {
+		if err := conn.DelRule(r); err != nil {
+			return fmt.Errorf("failed to delete nftables rule: %w", err)
+		}
+	}
+	for _, r := range rules {
+		r.UserData = userdata.AppendString(nil, userdata.TypeComment, owner)
+		conn.AddRule(r)
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to apply nftables rules: %w", err)
+	}
+	return nil
+}
+
+// ensureNftTable creates a table and its base chains if they are missing.
+// Base chains accept by default, so only traffic vmm's rules drop is
+// dropped.
+func ensureNftTable(conn *nftables.Conn, table *nftables.Table, chains ...*nftables.Chain) error {
+	accept := nftables.ChainPolicyAccept
+	conn.AddTable(table)
+	for _, chain := range chains {
+		c := *chain
+		c.Policy = &accept
+		conn.AddChain(&c)
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to create nftables table %s: %w", table.Name, err)
+	}
+	return nil
+}
+
+// ruleExprs translates a Rule into nftables expressions.
+func ruleExprs(r Rule) ([]expr.Any, error) {
+	var exprs []expr.Any
+	if r.Source != "" {
+		ipnet, err := parseCIDR(r.Source)
+		if err != nil {
+			return nil, err
+		}
+		f := familyOf(ipnet.IP)
+		exprs = append(exprs, matchFamily(f)...)
+		exprs = append(exprs, matchNet(f.srcOffset, ipnet)...)
+	}
+	if r.Destination != "" {
+		ipnet, err := parseCIDR(r.Destination)
+		if err != nil {
+			return nil, err
+		}
+		f := familyOf(ipnet.IP)
+		exprs = append(exprs, matchFamily(f)...)
+		exprs = append(exprs, matchNet(f.dstOffset, ipnet)...)
+	}
+	exprs = append(exprs, matchIfname(expr.MetaKeyIIFNAME, expr.CmpOpEq, r.InIface)...)
+	exprs = append(exprs, matchIfname(expr.MetaKeyIIFNAME, expr.CmpOpNeq, r.NotInIface)...)
+	exprs = append(exprs, matchIfname(expr.MetaKeyOIFNAME, expr.CmpOpEq, r.OutIface)...)
+	exprs = append(exprs, matchIfname(expr.MetaKeyOIFNAME, expr.CmpOpNeq, r.NotOutIface)...)
+	if r.Established {
+		exprs = append(exprs, matchEstablished()...)
+	}
+	if r.NotDNAT {
+		exprs = append(exprs, matchNotDNAT()...)
+	}
+
+	switch r.Verdict {
+	case VerdictAccept:
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictAccept})
+	case VerdictDrop:
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictDrop})
+	case VerdictMasquerade:
+		if r.Hook != HookPostrouting {
+			return nil, fmt.Errorf("masquerade is only valid in %s", HookPostrouting)
+		}
+		exprs = append(exprs, &expr.Masq{})
+	default:
+		return nil, fmt.Errorf("unknown verdict %q", r.Verdict)
+	}
+	return exprs, nil
+}
+
+// dnatExprs translates a PortForward into the expressions of its rules.
+// Only connections to one of the host's own addresses are forwarded, so
+// traffic passing through the host to the same port elsewhere is left
+// alone. A range forwarded to the same guest ports is a single rule that
+// keeps the destination port; a range shifted to other guest ports needs a
+// rule per port.
+func dnatExprs(pf PortForward) ([][]expr.Any, error) {
+	if err := pf.Validate(); err != nil {
+		return nil, err
+	}
+	proto := byte(unix.IPPROTO_TCP)
+	if pf.Protocol == "udp" {
+		proto = unix.IPPROTO_UDP
+	}
+	ip := net.ParseIP(pf.GuestIP)
+	f := familyOf(ip)
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	rule := func(first, last, guestPort int) []expr.Any {
+		exprs := matchFamily(f)
+		exprs = append(exprs,
+			&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		)
+		if first == last {
+			exprs = append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(first))})
+		} else {
+			exprs = append(exprs, &expr.Range{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				FromData: binaryutil.BigEndian.PutUint16(uint16(first)),
+				ToData:   binaryutil.BigEndian.PutUint16(uint16(last)),
+			})
+		}
+		nat := &expr.NAT{Type: expr.NATTypeDestNAT, Family: uint32(f.nfproto), RegAddrMin: 1, Specified: true}
+		exprs = append(exprs, &expr.Immediate{Register: 1, Data: ip})
+		if guestPort != 0 {
+			exprs = append(exprs, &expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(uint16(guestPort))})
+			nat.RegProtoMin = 2
+		}
+		return append(exprs, nat)
+	}
+
+	last := pf.lastHostPort()
+	switch {
+	case last == pf.HostPort:
+		return [][]expr.Any{rule(pf.HostPort, pf.HostPort, pf.GuestPort)}, nil
+	case pf.GuestPort == pf.HostPort:
+		return [][]expr.Any{rule(pf.HostPort, last, 0)}, nil
+	}
+	var rules [][]expr.Any
+	for port := pf.HostPort; port <= last; port++ {
+		rules = append(rules, rule(port, port, pf.GuestPort+port-pf.HostPort))
+	}
+	return rules, nil
+}
+
+// ipFamily describes how rules recognise packets of one IP version and
+// where their addresses are.
+type ipFamily struct {
+	nfproto   byte
+	etherType uint16
+	srcOffset uint32 // offset of the source address in the network header
+	dstOffset uint32 // offset of the destination address
+}
+
+var (
+	familyIPv4 = ipFamily{nfproto: unix.NFPROTO_IPV4, etherType: unix.ETH_P_IP, srcOffset: 12, dstOffset: 16}
+	familyIPv6 = ipFamily{nfproto: unix.NFPROTO_IPV6, etherType: unix.ETH_P_IPV6, srcOffset: 8, dstOffset: 24}
+)
+
+// familyOf returns the family of an address.
+func familyOf(ip net.IP) ipFamily {
+	if ip.To4() != nil {
+		return familyIPv4
+	}
+	return familyIPv6
+}
+
+// parseCIDR parses an IPv4 or IPv6 subnet in CIDR notation.
+func parseCIDR(cidr string) (*net.IPNet, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %q", cidr)
+	}
+	return ipnet, nil
+}
+
+// matchNet compares the address at offset in the network header against
+// ipnet. The packet must already be known to be of ipnet's family.
+func matchNet(offset uint32, ipnet *net.IPNet) []expr.Any {
+	ip := ipnet.IP
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	n := uint32(len(ip))
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: n},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: n, Mask: ipnet.Mask, Xor: make([]byte, n)},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip},
+	}
+}
+
+// matchEstablished matches packets of established or related connections.
+func matchEstablished() []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED),
+			Xor:            make([]byte, 4),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: make([]byte, 4)},
+	}
+}
+
+// matchNotDNAT matches packets of connections that were not DNATed.
+func matchNotDNAT() []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATUS},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(ipsDstNAT),
+			Xor:            make([]byte, 4),
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: make([]byte, 4)},
+	}
+}
+
+// matchFamily restricts a rule in the inet table to packets of one IP
+// version.
+func matchFamily(f ipFamily) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{f.nfproto}},
+	}
+}
+
+// matchIfname compares the input or output interface name against name.
+// It matches everything if name is empty.
+func matchIfname(key expr.MetaKey, op expr.CmpOp, name string) []expr.Any {
+	if name == "" {
+		return nil
+	}
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: op, Register: 1, Data: ifname(name)},
+	}
+}
+
+// ifname pads an interface name to the kernel's IFNAMSIZ, as nftables
+// compares the full buffer.
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
+
+// matchEtherType restricts a rule in the bridge table to frames carrying
+// the given protocol.
+func matchEtherType(etherType uint16) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyPROTOCOL, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(etherType)},
+	}
+}
+
+// matchNeighborDiscovery matches the ICMPv6 router and neighbour
+// solicitations, advertisements and redirects IPv6 needs in place of ARP.
+func matchNeighborDiscovery() []expr.Any {
+	return append(matchEtherType(unix.ETH_P_IPV6),
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_ICMPV6}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 1},
+		&expr.Range{Op: expr.CmpOpEq, Register: 1, FromData: []byte{ndpRouterSolicit}, ToData: []byte{ndpRedirect}},
+	)
+}
+
+// The range of ICMPv6 types used by neighbour discovery (RFC 4861).
+const (
+	ndpRouterSolicit = 133
+	ndpRedirect      = 137
+)
@@ -0,0 +1,470 @@
+// Package portproxy relays host ports to VMs in userspace. It is the
+// alternative to the DNAT rules of package network for hosts where another
+// tool, such as firewalld or Docker, owns the packet filter and flushes or
+// overrides rules it did not write. vmmd runs the proxy for every forward in
+// proxy mode.
+package portproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+// dialTimeout bounds how long a TCP connection waits for the guest to accept.
+const dialTimeout = 10 * time.Second
+
+// udpIdleTimeout is how long a UDP session lasts without traffic in either
+// direction.
+const udpIdleTimeout = 2 * time.Minute
+
+// udpBufferSize fits the largest UDP datagram.
+const udpBufferSize = 65535
+
+// Forward is one host port the proxy listens on and the guest address it
+// relays to.
+type Forward struct {
+	VM        string
+	Protocol  string // tcp or udp
+	HostPort  int
+	GuestIP   string
+	GuestPort int
+}
+
+// key identifies the host port the forward listens on.
+func (f Forward) key() string {
+	return fmt.Sprintf("%s/%d", f.Protocol, f.HostPort)
+}
+
+// target is the guest's host:port.
+func (f Forward) target() string {
+	return net.JoinHostPort(f.GuestIP, strconv.Itoa(f.GuestPort))
+}
+
+// Stats are the counters of one proxied host port. For UDP, a connection is
+// a session: the datagrams exchanged with one client address.
+type Stats struct {
+	VM          string `json:"vm"`
+	Protocol    string `json:"protocol"`
+	HostPort    int    `json:"host_port"`
+	Target      string `json:"target"`
+	Active      int64  `json:"active"`
+	Connections int64  `json:"connections"`
+	BytesIn     int64  `json:"bytes_in"`  // from clients to the guest
+	BytesOut    int64  `json:"bytes_out"` // from the guest to clients
+}
+
+// VMForwards returns the proxy forwards of the running and paused VMs in vms,
+// one per host port, targeting each VM's primary IPv4 address. A paused VM
+// keeps its listeners; connections wait for it to resume.
+func VMForwards(vms []*vm.VM) []Forward {
+	var fwds []Forward
+	for _, v := range vms {
+		if !v.State.Active() || v.IPAddress == "" {
+			continue
+		}
+		for _, pf := range v.PortForwards {
+			if !pf.Proxied() {
+				continue
+			}
+			for port := pf.HostPort; port <= pf.LastHostPort(); port++ {
+				fwds = append(fwds, Forward{
+					VM:        v.Name,
+					Protocol:  pf.Protocol,
+					HostPort:  port,
+					GuestIP:   v.IPAddress,
+					GuestPort: pf.GuestPort + port - pf.HostPort,
+				})
+			}
+		}
+	}
+	return fwds
+}
+
+// Proxy listens on host ports and relays connections and datagrams to VMs.
+type Proxy struct {
+	mu        sync.Mutex
+	listeners map[string]*listener
+	refresh   chan struct{}
+}
+
+// New returns a Proxy with no listeners.
+func New() *Proxy {
+	return &Proxy{
+		listeners: make(map[string]*listener),
+		refresh:   make(chan struct{}, 1),
+	}
+}
+
+// Sync makes the proxy listen on exactly the host ports of fwds, starting
+// listeners for new ports and closing those no longer wanted. A port whose
+// guest changed is re-targeted without closing its listener; connections
+// already open keep their old guest.
+func (p *Proxy) Sync(fwds []Forward) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	wanted := make(map[string]bool)
+	var errs []error
+	for _, f := range fwds {
+		key := f.key()
+		wanted[key] = true
+		if l, ok := p.listeners[key]; ok {
+			l.setForward(f)
+			continue
+		}
+		l, err := listen(f)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		p.listeners[key] = l
+	}
+	for key, l := range p.listeners {
+		if wanted[key] {
+			continue
+		}
+		l.close()
+		delete(p.listeners, key)
+	}
+	return errors.Join(errs...)
+}
+
+// Stats returns the counters of every host port, sorted by port and
+// protocol.
+func (p *Proxy) Stats() []Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := make([]Stats, 0, len(p.listeners))
+	for _, l := range p.listeners {
+		stats = append(stats, l.stats())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].HostPort != stats[j].HostPort {
+			return stats[i].HostPort < stats[j].HostPort
+		}
+		return stats[i].Protocol < stats[j].Protocol
+	})
+	return stats
+}
+
+// Close stops all listeners and closes their connections.
+func (p *Proxy) Close() {
+	p.Sync(nil)
+}
+
+// Refresh asks Serve to re-read the forwards now rather than at the next
+// interval. It does not block.
+func (p *Proxy) Refresh() {
+	select {
+	case p.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// Serve keeps the listeners in line with the forwards returned by desired
+// until ctx is cancelled, checking every interval and whenever Refresh is
+// called. If desired fails the listeners are left as they are.
+func (p *Proxy) Serve(ctx context.Context, desired func() ([]Forward, error), interval time.Duration) {
+	defer p.Close()
+
+	var lastErr string
+	refresh := func() {
+		fwds, err := desired()
+		if err == nil {
+			err = p.Sync(fwds)
+		}
+		// Report a failure once, not on every retry
+		msg := ""
+		if err != nil {
+			msg = err.Error()
+			if msg != lastErr {
+				log.Printf("port proxy: %v", err)
+			}
+		}
+		lastErr = msg
+	}
+
+	refresh()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			refresh()
+		case <-p.refresh:
+			refresh()
+		}
+	}
+}
+
+// listener relays one host port.
+type listener struct {
+	mu    sync.Mutex
+	fwd   Forward
+	conns map[io.Closer]bool // open TCP connections and UDP sessions
+	ln    net.Listener       // TCP
+	pc    net.PacketConn     // UDP
+
+	active      atomic.Int64
+	connections atomic.Int64
+	bytesIn     atomic.Int64
+	bytesOut    atomic.Int64
+}
+
+// listen starts relaying f's host port on every host address.
+func listen(f Forward) (*listener, error) {
+	l := &listener{fwd: f, conns: make(map[io.Closer]bool)}
+	addr := net.JoinHostPort("", strconv.Itoa(f.HostPort))
+	switch f.Protocol {
+	case "tcp":
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s/tcp: %w", addr, err)
+		}
+		l.ln = ln
+		go l.serveTCP()
+	case "udp":
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s/udp: %w", addr, err)
+		}
+		l.pc = pc
+		go l.serveUDP()
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q", f.Protocol)
+	}
+	return l, nil
+}
+
+func (l *listener) forward() Forward {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.fwd
+}
+
+// setForward re-targets the listener. UDP sessions to the old guest are
+// closed, since a session has no end the client would notice.
+func (l *listener) setForward(f Forward) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fwd == f {
+		return
+	}
+	l.fwd = f
+	if l.pc != nil {
+		for c := range l.conns {
+			c.Close()
+		}
+	}
+}
+
+// track records an open connection or session so close can end it. It
+// returns false once the listener is closed.
+func (l *listener) track(c io.Closer) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns == nil {
+		return false
+	}
+	l.conns[c] = true
+	return true
+}
+
+func (l *listener) untrack(c io.Closer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.conns, c)
+}
+
+// close stops listening and ends every open connection.
+func (l *listener) close() {
+	if l.ln != nil {
+		l.ln.Close()
+	}
+	if l.pc != nil {
+		l.pc.Close()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for c := range l.conns {
+		c.Close()
+	}
+	l.conns = nil
+}
+
+func (l *listener) stats() Stats {
+	f := l.forward()
+	return Stats{
+		VM:          f.VM,
+		Protocol:    f.Protocol,
+		HostPort:    f.HostPort,
+		Target:      f.target(),
+		Active:      l.active.Load(),
+		Connections: l.connections.Load(),
+		BytesIn:     l.bytesIn.Load(),
+		BytesOut:    l.bytesOut.Load(),
+	}
+}
+
+func (l *listener) serveTCP() {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("port proxy: accept on %s failed: %v", l.ln.Addr(), err)
+			}
+			return
+		}
+		go l.relayTCP(conn)
+	}
+}
+
+// relayTCP copies a client connection to and from the guest until both
+// sides have finished sending.
+func (l *listener) relayTCP(client net.Conn) {
+	defer client.Close()
+	if !l.track(client) {
+		return
+	}
+	defer l.untrack(client)
+	l.active.Add(1)
+	l.connections.Add(1)
+	defer l.active.Add(-1)
+
+	guest, err := net.DialTimeout("tcp", l.forward().target(), dialTimeout)
+	if err != nil {
+		return
+	}
+	defer guest.Close()
+	if !l.track(guest) {
+		return
+	}
+	defer l.untrack(guest)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		copyHalf(guest, client, &l.bytesIn)
+	}()
+	go func() {
+		defer wg.Done()
+		copyHalf(client, guest, &l.bytesOut)
+	}()
+	wg.Wait()
+}
+
+// copyHalf copies one direction of a TCP connection, counting the bytes as
+// they go, then passes the end of the stream on.
+func copyHalf(dst, src net.Conn, counter *atomic.Int64) {
+	io.Copy(countingWriter{w: dst, counter: counter}, src)
+	if tc, ok := dst.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+// countingWriter adds the bytes written through it to counter as it goes,
+// so the counters of a long-lived connection stay current.
+type countingWriter struct {
+	w       io.Writer
+	counter *atomic.Int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.counter.Add(int64(n))
+	return n, err
+}
+
+// udpSession relays the datagrams of one client address over a socket
+// connected to the guest.
+type udpSession struct {
+	client net.Addr
+	guest  net.Conn
+}
+
+func (s *udpSession) Close() error {
+	return s.guest.Close()
+}
+
+func (l *listener) serveUDP() {
+	sessions := make(map[string]*udpSession)
+	var mu sync.Mutex
+
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, client, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("port proxy: read on %s failed: %v", l.pc.LocalAddr(), err)
+			}
+			return
+		}
+
+		mu.Lock()
+		s, ok := sessions[client.String()]
+		mu.Unlock()
+		if !ok {
+			guest, err := net.Dial("udp", l.forward().target())
+			if err != nil {
+				continue
+			}
+			s = &udpSession{client: client, guest: guest}
+			if !l.track(s) {
+				guest.Close()
+				return
+			}
+			l.active.Add(1)
+			l.connections.Add(1)
+			mu.Lock()
+			sessions[client.String()] = s
+			mu.Unlock()
+			go func() {
+				l.relayUDPReplies(s)
+				mu.Lock()
+				delete(sessions, s.client.String())
+				mu.Unlock()
+			}()
+		}
+
+		s.guest.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		if _, err := s.guest.Write(buf[:n]); err == nil {
+			l.bytesIn.Add(int64(n))
+		}
+	}
+}
+
+// relayUDPReplies sends the guest's replies back to the client until the
+// session is idle for udpIdleTimeout or closed.
+func (l *listener) relayUDPReplies(s *udpSession) {
+	defer l.active.Add(-1)
+	defer l.untrack(s)
+	defer s.guest.Close()
+
+	buf := make([]byte, udpBufferSize)
+	for {
+		s.guest.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := s.guest.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := l.pc.WriteTo(buf[:n], s.client); err == nil {
+			l.bytesOut.Add(int64(n))
+		}
+	}
+}
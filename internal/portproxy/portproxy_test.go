@@ -0,0 +1,259 @@
+package portproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+// freePort returns a port nothing is listening on for the protocol.
+func freePort(t *testing.T, protocol string) int {
+	t.Helper()
+	var addr net.Addr
+	if protocol == "udp" {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = pc.LocalAddr()
+		pc.Close()
+	} else {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = ln.Addr()
+		ln.Close()
+	}
+	_, port, _ := net.SplitHostPort(addr.String())
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// tcpEcho runs a TCP server on loopback that prefixes each line it echoes
+// with prefix, and returns its port.
+func tcpEcho(t *testing.T, prefix string) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					io.WriteString(conn, prefix+line)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// udpEcho runs a UDP server on loopback that echoes each datagram, and
+// returns its port.
+func udpEcho(t *testing.T) int {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().(*net.UDPAddr).Port
+}
+
+// roundTrip sends a line through a new TCP connection to port and returns
+// the reply.
+func roundTrip(t *testing.T, port int, msg string) string {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, msg+"\n")
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return reply
+}
+
+func TestVMForwards(t *testing.T) {
+	web := vm.NewVM("web")
+	web.State = vm.StateRunning
+	web.IPAddress = "172.16.0.2"
+	web.PortForwards = []vm.PortForward{
+		{HostPort: 8080, GuestPort: 80, Protocol: "tcp"},
+		{HostPort: 9000, HostPortEnd: 9001, GuestPort: 7000, Protocol: "udp", Mode: vm.ForwardProxy},
+	}
+	stopped := vm.NewVM("stopped")
+	stopped.State = vm.StateStopped
+	stopped.IPAddress = "172.16.0.3"
+	stopped.PortForwards = []vm.PortForward{{HostPort: 8443, GuestPort: 443, Protocol: "tcp", Mode: vm.ForwardProxy}}
+
+	got := VMForwards([]*vm.VM{web, stopped})
+	want := []Forward{
+		{VM: "web", Protocol: "udp", HostPort: 9000, GuestIP: "172.16.0.2", GuestPort: 7000},
+		{VM: "web", Protocol: "udp", HostPort: 9001, GuestIP: "172.16.0.2", GuestPort: 7001},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("VMForwards() = %+v, want %+v", got, want)
+	}
+}
+
+func TestProxyTCP(t *testing.T) {
+	guestA, guestB := tcpEcho(t, "a:"), tcpEcho(t, "b:")
+	hostPort := freePort(t, "tcp")
+
+	p := New()
+	defer p.Close()
+	fwd := Forward{VM: "web", Protocol: "tcp", HostPort: hostPort, GuestIP: "127.0.0.1", GuestPort: guestA}
+	if err := p.Sync([]Forward{fwd}); err != nil {
+		t.Fatalf("Sync() error: %v", err)
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(hostPort)), time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "hello\n")
+	if got, err := bufio.NewReader(conn).ReadString('\n'); err != nil || got != "a:hello\n" {
+		t.Errorf("reply = %q (error %v), want %q", got, err, "a:hello\n")
+	}
+
+	// Byte counters are updated while the connection is open
+	deadline := time.Now().Add(5 * time.Second)
+	var stats []Stats
+	for time.Now().Before(deadline) {
+		stats = p.Stats()
+		if len(stats) == 1 && stats[0].BytesOut == 8 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(stats) != 1 || stats[0].Active != 1 || stats[0].BytesIn != 6 || stats[0].BytesOut != 8 {
+		t.Errorf("Stats() of an open connection = %+v, want 1 active with 6 bytes in and 8 out", stats)
+	}
+	conn.Close()
+
+	deadline = time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		stats = p.Stats()
+		if len(stats) == 1 && stats[0].Active == 0 && stats[0].BytesOut > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	want := Stats{VM: "web", Protocol: "tcp", HostPort: hostPort, Target: fwd.target(), Connections: 1, BytesIn: 6, BytesOut: 8}
+	if len(stats) != 1 || stats[0] != want {
+		t.Errorf("Stats() = %+v, want [%+v]", stats, want)
+	}
+
+	// Re-targeting keeps the listener and its counters
+	fwd.GuestPort = guestB
+	if err := p.Sync([]Forward{fwd}); err != nil {
+		t.Fatalf("Sync() re-target error: %v", err)
+	}
+	if got := roundTrip(t, hostPort, "hello"); got != "b:hello\n" {
+		t.Errorf("reply after re-target = %q, want %q", got, "b:hello\n")
+	}
+	if got := p.Stats()[0].Connections; got != 2 {
+		t.Errorf("connections after re-target = %d, want 2", got)
+	}
+
+	if err := p.Sync(nil); err != nil {
+		t.Fatalf("Sync(nil) error: %v", err)
+	}
+	if _, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(hostPort)), time.Second); err == nil {
+		t.Error("host port still accepts connections after removal")
+	}
+	if stats := p.Stats(); len(stats) != 0 {
+		t.Errorf("Stats() after removal = %+v, want none", stats)
+	}
+}
+
+func TestProxyUDP(t *testing.T) {
+	guest := udpEcho(t)
+	hostPort := freePort(t, "udp")
+
+	p := New()
+	defer p.Close()
+	if err := p.Sync([]Forward{{VM: "dns", Protocol: "udp", HostPort: hostPort, GuestIP: "127.0.0.1", GuestPort: guest}}); err != nil {
+		t.Fatalf("Sync() error: %v", err)
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(hostPort)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 64)
+	for _, msg := range []string{"ping", "again"} {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if got := string(buf[:n]); got != msg {
+			t.Errorf("reply = %q, want %q", got, msg)
+		}
+	}
+
+	stats := p.Stats()
+	if len(stats) != 1 || stats[0].Active != 1 || stats[0].Connections != 1 || stats[0].BytesIn != 9 || stats[0].BytesOut != 9 {
+		t.Errorf("Stats() = %+v, want one session with 9 bytes each way", stats)
+	}
+}
+
+func TestSyncPortInUse(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	p := New()
+	defer p.Close()
+	taken := Forward{VM: "web", Protocol: "tcp", HostPort: ln.Addr().(*net.TCPAddr).Port, GuestIP: "127.0.0.1", GuestPort: 80}
+	free := Forward{VM: "web", Protocol: "tcp", HostPort: freePort(t, "tcp"), GuestIP: "127.0.0.1", GuestPort: 80}
+	if err := p.Sync([]Forward{taken, free}); err == nil {
+		t.Error("Sync() with a port in use should fail")
+	}
+	// The other forward is still served
+	if stats := p.Stats(); len(stats) != 1 || stats[0].HostPort != free.HostPort {
+		t.Errorf("Stats() = %+v, want only port %d", stats, free.HostPort)
+	}
+}
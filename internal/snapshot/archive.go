@@ -0,0 +1,485 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/raesene/baremetalvmm/internal/diskfile"
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+// A snapshot archive moves a snapshot to another host. It is a tar stream
+// compressed with zstd. The first entry is the manifest, describing the
+// snapshot and the VM it was taken of; then come the snapshot's files and the
+// kernel and initrd the VM boots; the last entry lists a SHA-256 checksum of
+// every entry before it. A diff snapshot is exported with its chain folded
+// in, so an archive always holds a full snapshot.
+
+const (
+	archiveVersion  = 1
+	manifestEntry   = "manifest.json"
+	checksumsEntry  = "SHA256SUMS"
+	kernelEntry     = "kernel"
+	initrdEntry     = "initrd"
+	maxManifestSize = 1 << 20
+)
+
+// Manifest describes the contents of a snapshot archive.
+type Manifest struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+	Snapshot   *Metadata `json:"snapshot"`
+	VM         *vm.VM    `json:"vm"`    // the VM's settings when it was exported
+	Files      []string  `json:"files"` // entries after the manifest, in order
+}
+
+// HasKernel reports whether the archive includes the VM's kernel.
+func (man *Manifest) HasKernel() bool {
+	return man.has(kernelEntry)
+}
+
+// HasInitrd reports whether the archive includes the VM's initrd.
+func (man *Manifest) HasInitrd() bool {
+	return man.has(initrdEntry)
+}
+
+func (man *Manifest) has(entry string) bool {
+	for _, f := range man.Files {
+		if f == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks that a manifest read from an archive describes files
+// that can safely be written into a snapshot directory.
+func (man *Manifest) validate() error {
+	if man.Version < 1 || man.Version > archiveVersion {
+		return fmt.Errorf("unsupported snapshot archive version %d", man.Version)
+	}
+	if man.Snapshot == nil || man.VM == nil {
+		return fmt.Errorf("snapshot archive manifest is incomplete")
+	}
+	for _, f := range man.Files {
+		if f == manifestEntry || f == checksumsEntry || filepath.Base(f) != f || strings.HasPrefix(f, ".") {
+			return fmt.Errorf("snapshot archive has an invalid entry name %q", f)
+		}
+	}
+	needed := []string{man.Snapshot.RootfsFile}
+	if !man.Snapshot.DiskOnly() {
+		needed = append(needed, man.Snapshot.MemFile, man.Snapshot.StateFile)
+	}
+	for _, mnt := range man.Snapshot.Mounts {
+		needed = append(needed, mnt.File)
+	}
+	for _, f := range needed {
+		if f == kernelEntry || f == initrdEntry || !man.has(f) {
+			return fmt.Errorf("snapshot archive does not include %q", f)
+		}
+	}
+	return nil
+}
+
+// archiveWriter writes the entries of an archive, recording their checksums.
+type archiveWriter struct {
+	tw    *tar.Writer
+	names []string
+	sums  []string
+}
+
+func (aw *archiveWriter) add(name string, size int64, r io.Reader) error {
+	hdr := &tar.Header{
+		Name:     name,
+		Mode:     0600,
+		Size:     size,
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+	if err := aw.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(aw.tw, h), r); err != nil {
+		return err
+	}
+	aw.names = append(aw.names, name)
+	aw.sums = append(aw.sums, hex.EncodeToString(h.Sum(nil)))
+	return nil
+}
+
+func (aw *archiveWriter) addFile(name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return aw.add(name, info.Size(), bufio.NewReaderSize(f, 1<<20))
+}
+
+// finish writes the checksums entry.
+func (aw *archiveWriter) finish() error {
+	var b strings.Builder
+	for i, name := range aw.names {
+		fmt.Fprintf(&b, "%s  %s\n", aw.sums[i], name)
+	}
+	return aw.add(checksumsEntry, int64(b.Len()), strings.NewReader(b.String()))
+}
+
+// ExportOptions names the boot files to include in an archive.
+type ExportOptions struct {
+	KernelPath string
+	InitrdPath string // empty for none
+}
+
+// Export writes one of v's snapshots to w as an archive, along with v's
+// settings and its boot files.
+func (m *Manager) Export(v *vm.VM, snapName string, w io.Writer, opts ExportOptions) error {
+	chain, err := m.Chain(v.Name, snapName)
+	if err != nil {
+		return err
+	}
+	meta := *chain[len(chain)-1]
+	meta.Parent = ""
+	if meta.CPU == nil {
+		// Taken before CPUs were recorded, so most likely on this host
+		meta.CPU, _ = HostCPU()
+	}
+	dir := m.Dir(v.Name, snapName)
+
+	settings := *v
+	settings.State = vm.StateStopped
+	settings.PID = 0
+	settings.StartedAt = time.Time{}
+	settings.LastSnapshot = ""
+
+	type file struct {
+		name   string
+		layers []string
+	}
+	var files []file
+	if !meta.DiskOnly() {
+		files = append(files,
+			file{meta.MemFile, m.layers(chain, meta.MemFile)},
+			file{meta.StateFile, []string{filepath.Join(dir, meta.StateFile)}},
+		)
+	}
+	files = append(files, file{meta.RootfsFile, m.layers(chain, meta.RootfsFile)})
+	for _, mnt := range meta.Mounts {
+		files = append(files, file{mnt.File, m.layers(chain, mnt.File)})
+	}
+	if opts.KernelPath != "" {
+		files = append(files, file{kernelEntry, []string{opts.KernelPath}})
+	}
+	if opts.InitrdPath != "" {
+		files = append(files, file{initrdEntry, []string{opts.InitrdPath}})
+	}
+
+	man := &Manifest{
+		Version:    archiveVersion,
+		ExportedAt: time.Now(),
+		Snapshot:   &meta,
+		VM:         &settings,
+	}
+	for _, f := range files {
+		man.Files = append(man.Files, f.name)
+	}
+	data, err := json.MarshalIndent(man, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+
+	enc, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	aw := &archiveWriter{tw: tar.NewWriter(enc)}
+	if err := aw.add(manifestEntry, int64(len(data)), strings.NewReader(string(data))); err != nil {
+		enc.Close()
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	for _, f := range files {
+		if err := m.exportFile(aw, f.name, f.layers); err != nil {
+			enc.Close()
+			return fmt.Errorf("failed to write %s: %w", f.name, err)
+		}
+	}
+	if err := aw.finish(); err != nil {
+		enc.Close()
+		return fmt.Errorf("failed to write checksums: %w", err)
+	}
+	if err := aw.tw.Close(); err != nil {
+		enc.Close()
+		return err
+	}
+	return enc.Close()
+}
+
+// exportFile adds the file described by layers to an archive, rebuilding it
+// in a temporary file first if it is spread over a chain.
+func (m *Manager) exportFile(aw *archiveWriter, name string, layers []string) error {
+	if len(layers) == 1 {
+		return aw.addFile(name, layers[0])
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(layers[len(layers)-1]), ".export-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := rebuild(layers, tmp.Name()); err != nil {
+		return err
+	}
+	return aw.addFile(name, tmp.Name())
+}
+
+// Archive is a snapshot archive being read.
+type Archive struct {
+	Manifest *Manifest
+	dec      *zstd.Decoder
+	tr       *tar.Reader
+	sums     map[string]string // checksums of the entries read so far
+}
+
+// OpenArchive reads the manifest at the start of a snapshot archive.
+func OpenArchive(r io.Reader) (*Archive, error) {
+	dec, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	a := &Archive{dec: dec, tr: tar.NewReader(dec), sums: make(map[string]string)}
+	hdr, err := a.tr.Next()
+	if err != nil || hdr.Name != manifestEntry {
+		dec.Close()
+		return nil, fmt.Errorf("not a snapshot archive")
+	}
+	h := sha256.New()
+	data, err := io.ReadAll(io.TeeReader(io.LimitReader(a.tr, maxManifestSize), h))
+	if err != nil {
+		dec.Close()
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	a.sums[manifestEntry] = hex.EncodeToString(h.Sum(nil))
+	var man Manifest
+	if err := json.Unmarshal(data, &man); err != nil {
+		dec.Close()
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if err := man.validate(); err != nil {
+		dec.Close()
+		return nil, err
+	}
+	a.Manifest = &man
+	return a, nil
+}
+
+// Close releases the archive's decompressor.
+func (a *Archive) Close() {
+	a.dec.Close()
+}
+
+// ImportOptions says where the contents of an archive go on this host.
+type ImportOptions struct {
+	VMName     string
+	SnapName   string
+	RootfsPath string                       // where a restore puts the rootfs
+	MountPath  func(guestTag string) string // where a restore puts each mount image
+	KernelPath string                       // where to install the kernel; empty to leave it out
+	InitrdPath string                       // where to install the initrd; empty to leave it out
+}
+
+// Import stores the snapshot in an archive under the names in opts, with the
+// paths the snapshot restores disks to moved to those in opts. Nothing is
+// kept unless every entry matches its checksum. An existing kernel or initrd
+// is not replaced.
+func (m *Manager) Import(a *Archive, opts ImportOptions) (*Metadata, error) {
+	if m.Exists(opts.VMName, opts.SnapName) {
+		return nil, fmt.Errorf("snapshot '%s' already exists for VM '%s'", opts.SnapName, opts.VMName)
+	}
+	dir := m.Dir(opts.VMName, opts.SnapName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	// Boot files are written next to their destination and moved into
+	// place once verified
+	installs := map[string]string{}
+	if opts.KernelPath != "" {
+		installs[kernelEntry] = opts.KernelPath
+	}
+	if opts.InitrdPath != "" {
+		installs[initrdEntry] = opts.InitrdPath
+	}
+	success := false
+	defer func() {
+		if !success {
+			os.RemoveAll(dir)
+			os.Remove(m.VMDir(opts.VMName))
+			for _, dst := range installs {
+				os.Remove(dst + ".import")
+			}
+		}
+	}()
+
+	expected := make(map[string]bool)
+	for _, f := range a.Manifest.Files {
+		expected[f] = true
+	}
+	var sums map[string]string
+	for {
+		hdr, err := a.tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read snapshot archive: %w", err)
+		}
+		if hdr.Name == checksumsEntry {
+			if sums, err = parseChecksums(io.LimitReader(a.tr, maxManifestSize)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !expected[hdr.Name] || a.sums[hdr.Name] != "" {
+			return nil, fmt.Errorf("snapshot archive has an unexpected entry %q", hdr.Name)
+		}
+
+		dst := filepath.Join(dir, hdr.Name)
+		if installs[hdr.Name] != "" {
+			dst = installs[hdr.Name] + ".import"
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return nil, err
+			}
+		} else if hdr.Name == kernelEntry || hdr.Name == initrdEntry {
+			dst = ""
+		}
+		h := sha256.New()
+		if err := writeEntry(dst, io.TeeReader(a.tr, h)); err != nil {
+			return nil, fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+		}
+		a.sums[hdr.Name] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	if sums == nil {
+		return nil, fmt.Errorf("snapshot archive is truncated: it has no checksums")
+	}
+	for _, name := range append([]string{manifestEntry}, a.Manifest.Files...) {
+		if a.sums[name] == "" {
+			return nil, fmt.Errorf("snapshot archive is truncated: %s is missing", name)
+		}
+		if sums[name] != a.sums[name] {
+			return nil, fmt.Errorf("snapshot archive is corrupt: checksum mismatch for %s", name)
+		}
+	}
+
+	for entry, dst := range installs {
+		if !a.Manifest.has(entry) {
+			continue
+		}
+		if _, err := os.Stat(dst); err == nil {
+			os.Remove(dst + ".import")
+			continue
+		}
+		if err := os.Rename(dst+".import", dst); err != nil {
+			return nil, fmt.Errorf("failed to install %s: %w", entry, err)
+		}
+	}
+
+	meta := *a.Manifest.Snapshot
+	meta.Name = opts.SnapName
+	meta.VMName = opts.VMName
+	meta.Parent = ""
+	if meta.StateRootfs == "" {
+		meta.StateRootfs = meta.RootfsPath
+	}
+	meta.RootfsPath = opts.RootfsPath
+	meta.Mounts = append([]MountSnapshot(nil), meta.Mounts...)
+	for i := range meta.Mounts {
+		if opts.MountPath != nil {
+			meta.Mounts[i].ImagePath = opts.MountPath(meta.Mounts[i].GuestTag)
+		}
+	}
+	if opts.KernelPath != "" {
+		meta.KernelPath = opts.KernelPath
+	}
+	meta.ApparentBytes, meta.SizeBytes = dirUsage(dir)
+	if err := m.saveMetadata(dir, &meta); err != nil {
+		return nil, err
+	}
+	success = true
+	return &meta, nil
+}
+
+// parseChecksums reads a checksums entry into a map from entry name to
+// checksum.
+func parseChecksums(r io.Reader) (map[string]string, error) {
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		sum, name, ok := strings.Cut(scanner.Text(), "  ")
+		if !ok {
+			return nil, fmt.Errorf("snapshot archive has malformed checksums")
+		}
+		sums[name] = sum
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read checksums: %w", err)
+	}
+	return sums, nil
+}
+
+// writeEntry writes an archive entry to path, leaving blocks of zeros as
+// holes, since memory and disk images are mostly empty. An empty path
+// discards the entry.
+func writeEntry(path string, r io.Reader) error {
+	if path == "" {
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, deltaBlockSize)
+	var off int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 && !diskfile.AllZero(buf[:n]) {
+			if _, werr := out.WriteAt(buf[:n], off); werr != nil {
+				out.Close()
+				return werr
+			}
+		}
+		off += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := out.Truncate(off); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
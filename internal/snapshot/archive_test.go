@@ -0,0 +1,158 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+func TestExportImport(t *testing.T) {
+	src := NewManager(t.TempDir())
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeSnapshot(t, src, "vm1", "full", base)
+	for _, file := range []string{memFile, rootfsFile} {
+		writeBlocks(t, filepath.Join(src.Dir("vm1", "full"), file), []byte{1, 0, 0, 1})
+	}
+	writeDiffSnapshot(t, src, "vm1", "d1", "full", base.Add(time.Minute), 2, 3)
+	kernel := filepath.Join(t.TempDir(), "vmlinux")
+	if err := os.WriteFile(kernel, []byte("kernel image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	v := vm.NewVM("vm1")
+	v.State = vm.StateRunning
+	v.PID = 1234
+	v.LastSnapshot = "d1"
+	var buf bytes.Buffer
+	if err := src.Export(v, "d1", &buf, ExportOptions{KernelPath: kernel}); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(src.Dir("vm1", "d1"), ".export-*")); len(leftovers) > 0 {
+		t.Errorf("Export left temporary files behind: %v", leftovers)
+	}
+
+	a, err := OpenArchive(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("OpenArchive: %v", err)
+	}
+	defer a.Close()
+	man := a.Manifest
+	if man.Snapshot.Diff() || !man.HasKernel() || man.HasInitrd() {
+		t.Errorf("manifest = %+v, want a full snapshot with a kernel and no initrd", man)
+	}
+	if man.VM.State != vm.StateStopped || man.VM.PID != 0 || man.VM.LastSnapshot != "" {
+		t.Errorf("manifest VM = %+v, want its runtime state cleared", man.VM)
+	}
+
+	dst := NewManager(t.TempDir())
+	installed := filepath.Join(t.TempDir(), "kernels", "imported")
+	meta, err := dst.Import(a, ImportOptions{
+		VMName:     "vm2",
+		SnapName:   "moved",
+		RootfsPath: "/new/home/vm2.ext4",
+		KernelPath: installed,
+	})
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if meta.Name != "moved" || meta.VMName != "vm2" || meta.Parent != "" || meta.RootfsPath != "/new/home/vm2.ext4" || meta.KernelPath != installed {
+		t.Errorf("imported metadata = %+v, want it re-homed", meta)
+	}
+	if got, _ := os.ReadFile(installed); string(got) != "kernel image" {
+		t.Errorf("installed kernel = %q", got)
+	}
+
+	want := filepath.Join(t.TempDir(), "want")
+	writeBlocks(t, want, []byte{1, 0, 3, 1})
+	wantData, _ := os.ReadFile(want)
+	for _, file := range []string{memFile, rootfsFile} {
+		if got, _ := os.ReadFile(filepath.Join(dst.Dir("vm2", "moved"), file)); !bytes.Equal(got, wantData) {
+			t.Errorf("imported %s does not match the flattened chain", file)
+		}
+	}
+	if !dst.Exists("vm2", "moved") {
+		t.Error("imported snapshot does not exist")
+	}
+}
+
+// writeArchive writes an archive by hand, so tests can build broken ones.
+func writeArchive(t *testing.T, man *Manifest, files map[string]string, sums func(*archiveWriter)) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	enc, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aw := &archiveWriter{tw: tar.NewWriter(enc)}
+	data, _ := json.Marshal(man)
+	if err := aw.add(manifestEntry, int64(len(data)), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range man.Files {
+		if err := aw.add(name, int64(len(files[name])), strings.NewReader(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sums(aw)
+	if err := aw.finish(); err != nil {
+		t.Fatal(err)
+	}
+	aw.tw.Close()
+	enc.Close()
+	return buf.Bytes()
+}
+
+func TestImportRejectsBadArchives(t *testing.T) {
+	man := func(files ...string) *Manifest {
+		return &Manifest{
+			Version:  archiveVersion,
+			Snapshot: &Metadata{MemFile: memFile, StateFile: stateFile, RootfsFile: rootfsFile},
+			VM:       vm.NewVM("vm1"),
+			Files:    files,
+		}
+	}
+	files := map[string]string{memFile: "memory", stateFile: "state", rootfsFile: "rootfs"}
+	good := func(*archiveWriter) {}
+
+	tests := []struct {
+		name        string
+		archive     []byte
+		wantOpenErr bool
+	}{
+		{"not an archive", []byte("plain text"), true},
+		{"missing file", writeArchive(t, man(memFile, stateFile), files, good), true},
+		{"path in entry name", writeArchive(t, man(memFile, stateFile, rootfsFile, "../escape"), files, good), true},
+		{"newer version", writeArchive(t, &Manifest{Version: archiveVersion + 1}, files, good), true},
+		{"checksum mismatch", writeArchive(t, man(memFile, stateFile, rootfsFile), files, func(aw *archiveWriter) {
+			aw.sums[1] = strings.Repeat("0", 64)
+		}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := OpenArchive(bytes.NewReader(tt.archive))
+			if (err != nil) != tt.wantOpenErr {
+				t.Fatalf("OpenArchive() error = %v, wantErr %v", err, tt.wantOpenErr)
+			}
+			if err != nil {
+				return
+			}
+			defer a.Close()
+			m := NewManager(t.TempDir())
+			if _, err := m.Import(a, ImportOptions{VMName: "vm1", SnapName: "snap"}); err == nil {
+				t.Fatal("Import() of a corrupt archive should fail")
+			}
+			if _, err := os.Stat(m.Dir("vm1", "snap")); !os.IsNotExist(err) {
+				t.Errorf("failed import left the snapshot directory behind: %v", err)
+			}
+		})
+	}
+}
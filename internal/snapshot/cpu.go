@@ -0,0 +1,95 @@
+package snapshot
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// CPUInfo identifies the host CPU a snapshot was taken on. The guest state
+// in a snapshot assumes the CPU features it was started with, so it can only
+// be restored on a CPU from the same vendor, and may fail on one that lacks
+// some of those features.
+type CPUInfo struct {
+	Vendor string   `json:"vendor"`
+	Model  string   `json:"model"`
+	Flags  []string `json:"flags,omitempty"`
+}
+
+// HostCPU describes the CPU of this host, from /proc/cpuinfo.
+func HostCPU() (*CPUInfo, error) {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseCPUInfo(f)
+}
+
+// parseCPUInfo reads the first processor in /proc/cpuinfo format. x86 hosts
+// report a vendor, model name and flags; arm64 hosts an implementer, part
+// number and features.
+func parseCPUInfo(r io.Reader) (*CPUInfo, error) {
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			if len(fields) > 0 {
+				break // end of the first processor
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read CPU information: %w", err)
+	}
+
+	cpu := &CPUInfo{Vendor: fields["vendor_id"], Model: fields["model name"]}
+	flags := fields["flags"]
+	if cpu.Vendor == "" {
+		cpu.Vendor = fields["CPU implementer"]
+		cpu.Model = fields["CPU part"]
+		flags = fields["Features"]
+	}
+	if cpu.Vendor == "" {
+		return nil, fmt.Errorf("no CPU vendor in CPU information")
+	}
+	cpu.Flags = strings.Fields(flags)
+	return cpu, nil
+}
+
+// Compare checks whether a snapshot taken on cpu can be restored on host. It
+// returns an error for a different vendor, and warnings for a different
+// model or missing CPU features.
+func (cpu *CPUInfo) Compare(host *CPUInfo) ([]string, error) {
+	if cpu.Vendor != host.Vendor {
+		return nil, fmt.Errorf("snapshot was taken on a %s CPU, but this host has a %s CPU", cpu.Vendor, host.Vendor)
+	}
+	var warnings []string
+	if cpu.Model != host.Model {
+		warnings = append(warnings, fmt.Sprintf("snapshot was taken on a %q CPU, but this host has a %q CPU", cpu.Model, host.Model))
+	}
+	have := make(map[string]bool, len(host.Flags))
+	for _, f := range host.Flags {
+		have[f] = true
+	}
+	var missing []string
+	for _, f := range cpu.Flags {
+		if !have[f] {
+			missing = append(missing, f)
+		}
+	}
+	if len(missing) > 0 {
+		warnings = append(warnings, fmt.Sprintf("this host's CPU lacks features the guest may use: %s", strings.Join(missing, " ")))
+	}
+	return warnings, nil
+}
@@ -0,0 +1,77 @@
+package snapshot
+
+import (
+	"strings"
+	"testing"
+)
+
+const x86CPUInfo = `processor	: 0
+vendor_id	: GenuineIntel
+model name	: Intel(R) Xeon(R) CPU E5-2686 v4 @ 2.30GHz
+flags		: fpu vme sse sse2 avx avx2
+
+processor	: 1
+vendor_id	: AuthenticAMD
+model name	: second processor
+flags		: fpu
+`
+
+const arm64CPUInfo = `processor	: 0
+BogoMIPS	: 243.75
+Features	: fp asimd evtstrm aes
+CPU implementer	: 0x41
+CPU part	: 0xd0c
+`
+
+func TestParseCPUInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    CPUInfo
+		wantErr bool
+	}{
+		{"x86", x86CPUInfo, CPUInfo{"GenuineIntel", "Intel(R) Xeon(R) CPU E5-2686 v4 @ 2.30GHz", []string{"fpu", "vme", "sse", "sse2", "avx", "avx2"}}, false},
+		{"arm64", arm64CPUInfo, CPUInfo{"0x41", "0xd0c", []string{"fp", "asimd", "evtstrm", "aes"}}, false},
+		{"empty", "", CPUInfo{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCPUInfo(strings.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCPUInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.Vendor != tt.want.Vendor || got.Model != tt.want.Model || strings.Join(got.Flags, " ") != strings.Join(tt.want.Flags, " ") {
+				t.Errorf("parseCPUInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCPUCompare(t *testing.T) {
+	snap := &CPUInfo{Vendor: "GenuineIntel", Model: "Xeon", Flags: []string{"sse", "avx2"}}
+	tests := []struct {
+		name         string
+		host         *CPUInfo
+		wantWarnings int
+		wantErr      bool
+	}{
+		{"same CPU", &CPUInfo{Vendor: "GenuineIntel", Model: "Xeon", Flags: []string{"avx2", "sse", "avx512f"}}, 0, false},
+		{"other model", &CPUInfo{Vendor: "GenuineIntel", Model: "Core", Flags: []string{"sse", "avx2"}}, 1, false},
+		{"missing flags", &CPUInfo{Vendor: "GenuineIntel", Model: "Core", Flags: []string{"sse"}}, 2, false},
+		{"other vendor", &CPUInfo{Vendor: "AuthenticAMD", Model: "EPYC", Flags: []string{"sse", "avx2"}}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			warnings, err := snap.Compare(tt.host)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compare() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(warnings) != tt.wantWarnings {
+				t.Errorf("Compare() warnings = %q, want %d", warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package snapshot
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/raesene/baremetalvmm/internal/diskfile"
+)
+
+// A diff snapshot stores each file as a sparse layer over the same file in its
+// parent: the regions that hold data replace the parent's bytes, and holes
+// fall through to it. Firecracker writes diff memory files this way itself;
+// disk layers are written by writeDelta in blocks of deltaBlockSize. A chain
+// of layers ends in a full snapshot, whose files are complete.
+
+// deltaBlockSize is the granularity at which disk images are compared with
+// their parent, the guest page size.
+const deltaBlockSize = 4096
+
+// contains reports whether off falls within one of extents.
+func contains(extents []diskfile.Extent, off int64) bool {
+	i := sort.Search(len(extents), func(i int) bool { return extents[i].End > off })
+	return i < len(extents) && extents[i].Start <= off
+}
+
+// rebuild writes the file described by layers to dst, where each layer after
+// the first is a diff over those before it. If layers[0] is the file in a full
+// snapshot the result is complete; otherwise the holes no layer fills are
+// left as holes, so the result is itself a layer. It has the size of the last
+// layer, since a disk may have been resized between snapshots.
+func rebuild(layers []string, dst string) error {
+	if err := copyFile(layers[0], dst); err != nil {
+		return err
+	}
+	if len(layers) == 1 {
+		return nil
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	for _, layer := range layers[1:] {
+		if err := diskfile.Overlay(out, layer); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	info, err := os.Stat(layers[len(layers)-1])
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Truncate(info.Size()); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// layerReader reads the complete file described by a chain of layers without
+// rebuilding it.
+type layerReader struct {
+	files   []*os.File
+	extents [][]diskfile.Extent // data regions of each diff layer; unused for the first
+	size    int64               // size of the last layer
+}
+
+func openLayers(layers []string) (*layerReader, error) {
+	r := &layerReader{}
+	for i, path := range layers {
+		f, err := os.Open(path)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.files = append(r.files, f)
+		var extents []diskfile.Extent
+		if i > 0 {
+			if extents, err = diskfile.DataExtents(f); err != nil {
+				r.Close()
+				return nil, err
+			}
+		}
+		r.extents = append(r.extents, extents)
+		if i == len(layers)-1 {
+			info, err := f.Stat()
+			if err != nil {
+				r.Close()
+				return nil, err
+			}
+			r.size = info.Size()
+		}
+	}
+	return r, nil
+}
+
+// readBlock fills p, a block starting at off, from the topmost layer that
+// holds data there. Bytes past the end of that layer read as zeros.
+func (r *layerReader) readBlock(p []byte, off int64) error {
+	clear(p)
+	if off >= r.size {
+		return nil
+	}
+	i := len(r.files) - 1
+	for i > 0 && !contains(r.extents[i], off) {
+		i--
+	}
+	if _, err := r.files[i].ReadAt(p, off); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func (r *layerReader) Close() {
+	for _, f := range r.files {
+		f.Close()
+	}
+}
+
+// writeDelta writes the blocks of the disk image at cur that differ from the
+// complete file described by parent to dst, as a sparse layer the size of
+// cur.
+func writeDelta(cur string, parent []string, dst string) error {
+	in, err := os.Open(cur)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	size, err := diskfile.Size(in) // a thin VM disk is a block device
+	if err != nil {
+		return err
+	}
+	base, err := openLayers(parent)
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := out.Truncate(size); err != nil {
+		out.Close()
+		return err
+	}
+	block := make([]byte, deltaBlockSize)
+	old := make([]byte, deltaBlockSize)
+	for off := int64(0); off < size; off += deltaBlockSize {
+		n, err := in.ReadAt(block, off)
+		if err != nil && err != io.EOF {
+			out.Close()
+			return err
+		}
+		if err := base.readBlock(old, off); err != nil {
+			out.Close()
+			return err
+		}
+		if bytes.Equal(block[:n], old[:n]) {
+			continue
+		}
+		if _, err := out.WriteAt(block[:n], off); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
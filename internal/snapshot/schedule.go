@@ -0,0 +1,191 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/raesene/baremetalvmm/internal/firecracker"
+	"github.com/raesene/baremetalvmm/internal/lock"
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+// scheduledPrefix starts the names of snapshots taken by a schedule, which
+// are followed by the time they were taken.
+const scheduledPrefix = "auto-"
+
+// Scheduler takes the snapshots set by VMs' snapshot schedules and prunes
+// the ones the schedules no longer keep.
+type Scheduler struct {
+	snapshots *Manager
+	fc        *firecracker.Client
+	vmsDir    string
+	stateDir  string
+}
+
+// NewScheduler returns a Scheduler for the VMs in vmsDir, locking them in
+// stateDir as the CLI does.
+func NewScheduler(snapshotsDir, vmsDir, stateDir string) *Scheduler {
+	return &Scheduler{
+		snapshots: NewManager(snapshotsDir),
+		fc:        firecracker.NewClient(),
+		vmsDir:    vmsDir,
+		stateDir:  stateDir,
+	}
+}
+
+// Run checks the schedules every interval until ctx is cancelled.
+func (s *Scheduler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			vms, err := vm.List(s.vmsDir)
+			if err != nil {
+				log.Printf("snapshot schedule: failed to list VMs: %v", err)
+				continue
+			}
+			for _, v := range vms {
+				if !v.SnapshotSchedule.Empty() && due(v, time.Now()) {
+					s.run(ctx, v.Name)
+				}
+			}
+		}
+	}
+}
+
+// due reports whether a VM's schedule should take a snapshot at now: the VM
+// must be running, and an interval must have passed since the last run, or
+// since the VM started if the schedule has not run yet.
+func due(v *vm.VM, now time.Time) bool {
+	sched := v.SnapshotSchedule
+	if sched.Empty() || v.State != vm.StateRunning {
+		return false
+	}
+	interval := sched.Interval()
+	if interval <= 0 {
+		return false
+	}
+	last := sched.LastRun
+	if last.IsZero() {
+		last = v.StartedAt
+	}
+	return !now.Before(last.Add(interval))
+}
+
+// run takes a scheduled snapshot of the named VM and prunes its old ones,
+// recording the outcome in the VM's schedule.
+func (s *Scheduler) run(ctx context.Context, name string) {
+	l, err := lock.VM(s.stateDir, name)
+	if err != nil {
+		// Busy with another operation; the next check tries again
+		log.Printf("snapshot schedule: skipping VM %s: %v", name, err)
+		return
+	}
+	defer l.Unlock()
+
+	v, err := vm.Load(s.vmsDir, name)
+	if err != nil {
+		return
+	}
+	s.fc.UpdateVMState(v)
+	now := time.Now()
+	if !due(v, now) {
+		return
+	}
+	sched := v.SnapshotSchedule
+
+	snapName := scheduledPrefix + now.Format("20060102-150405")
+	err = s.take(ctx, v, snapName)
+	sched.LastRun = now
+	if err != nil {
+		sched.LastError = err.Error()
+		sched.Failures++
+		log.Printf("snapshot schedule: VM %s: %v", name, err)
+	} else {
+		sched.LastSnapshot = snapName
+		sched.LastError = ""
+		sched.Failures = 0
+		log.Printf("snapshot schedule: took snapshot %s of VM %s", snapName, name)
+	}
+	if err := v.Save(s.vmsDir); err != nil {
+		log.Printf("snapshot schedule: failed to save VM %s: %v", name, err)
+	}
+}
+
+// take creates a scheduled snapshot and prunes the ones the schedule no
+// longer keeps.
+func (s *Scheduler) take(ctx context.Context, v *vm.VM, snapName string) error {
+	opts := CreateOptions{DiskOnly: v.SnapshotSchedule.DiskOnly, Scheduled: true}
+	if _, err := s.snapshots.Create(ctx, s.fc, v, snapName, opts); err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	snaps, err := s.snapshots.List(v.Name)
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	for _, old := range Expired(snaps, v.SnapshotSchedule) {
+		if err := s.snapshots.Delete(v.Name, old.Name); err != nil {
+			return fmt.Errorf("failed to prune snapshot '%s': %w", old.Name, err)
+		}
+		log.Printf("snapshot schedule: pruned snapshot %s of VM %s", old.Name, v.Name)
+	}
+	return nil
+}
+
+// Expired returns the scheduled snapshots among snaps that sched no longer
+// keeps. Each retention count keeps the newest snapshot of each of the last
+// n hours, days or ISO weeks that have one, and the newest snapshot is
+// always kept. Snapshots taken by hand are never expired.
+func Expired(snaps []*Metadata, sched *vm.SnapshotSchedule) []*Metadata {
+	var scheduled []*Metadata
+	for _, s := range snaps {
+		if s.Scheduled {
+			scheduled = append(scheduled, s)
+		}
+	}
+	if len(scheduled) == 0 {
+		return nil
+	}
+	sort.Slice(scheduled, func(i, j int) bool {
+		return scheduled[i].CreatedAt.After(scheduled[j].CreatedAt)
+	})
+
+	keep := map[*Metadata]bool{scheduled[0]: true}
+	for _, rule := range []struct {
+		n      int
+		period func(t time.Time) string
+	}{
+		{sched.KeepHourly, func(t time.Time) string { return t.Format("2006-01-02 15") }},
+		{sched.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{sched.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%d", year, week)
+		}},
+	} {
+		last, n := "", rule.n
+		for _, s := range scheduled {
+			if n == 0 {
+				break
+			}
+			if p := rule.period(s.CreatedAt); p != last {
+				keep[s] = true
+				last = p
+				n--
+			}
+		}
+	}
+
+	var expired []*Metadata
+	for _, s := range scheduled {
+		if !keep[s] {
+			expired = append(expired, s)
+		}
+	}
+	return expired
+}
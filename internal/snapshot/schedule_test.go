@@ -0,0 +1,96 @@
+package snapshot
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raesene/baremetalvmm/internal/vm"
+)
+
+func TestDue(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		state vm.State
+		sched *vm.SnapshotSchedule
+		start time.Time
+		want  bool
+	}{
+		{"no schedule", vm.StateRunning, nil, now.Add(-24 * time.Hour), false},
+		{"stopped", vm.StateStopped, &vm.SnapshotSchedule{Every: "1h"}, now.Add(-24 * time.Hour), false},
+		{"paused", vm.StatePaused, &vm.SnapshotSchedule{Every: "1h"}, now.Add(-24 * time.Hour), false},
+		{"first run after an interval", vm.StateRunning, &vm.SnapshotSchedule{Every: "1h"}, now.Add(-time.Hour), true},
+		{"first run too soon", vm.StateRunning, &vm.SnapshotSchedule{Every: "1h"}, now.Add(-time.Minute), false},
+		{"interval since last run", vm.StateRunning, &vm.SnapshotSchedule{Every: "6h", LastRun: now.Add(-6 * time.Hour)}, now.Add(-48 * time.Hour), true},
+		{"ran recently", vm.StateRunning, &vm.SnapshotSchedule{Every: "6h", LastRun: now.Add(-5 * time.Hour)}, now.Add(-48 * time.Hour), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &vm.VM{Name: "vm1", State: tt.state, StartedAt: tt.start, SnapshotSchedule: tt.sched}
+			if got := due(v, now); got != tt.want {
+				t.Errorf("due() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpired(t *testing.T) {
+	// Scheduled snapshots every 6 hours over 10 days, newest first
+	newest := time.Date(2026, 3, 10, 18, 0, 0, 0, time.UTC)
+	var snaps []*Metadata
+	for i := 0; i < 40; i++ {
+		created := newest.Add(-time.Duration(i) * 6 * time.Hour)
+		snaps = append(snaps, &Metadata{Name: created.Format("0102-15"), CreatedAt: created, Scheduled: true})
+	}
+	manual := &Metadata{Name: "manual", CreatedAt: newest.Add(-30 * 24 * time.Hour)}
+	snaps = append(snaps, manual)
+
+	names := func(snaps []*Metadata) map[string]bool {
+		m := make(map[string]bool)
+		for _, s := range snaps {
+			m[s.Name] = true
+		}
+		return m
+	}
+	kept := func(expired []*Metadata) []string {
+		gone := names(expired)
+		var keep []string
+		for _, s := range snaps {
+			if !gone[s.Name] {
+				keep = append(keep, s.Name)
+			}
+		}
+		return keep
+	}
+
+	tests := []struct {
+		name  string
+		sched *vm.SnapshotSchedule
+		want  []string
+	}{
+		{
+			"4 hourly",
+			&vm.SnapshotSchedule{Every: "6h", KeepHourly: 4},
+			[]string{"0310-18", "0310-12", "0310-06", "0310-00", "manual"},
+		},
+		{
+			"2 hourly, 3 daily",
+			&vm.SnapshotSchedule{Every: "6h", KeepHourly: 2, KeepDaily: 3},
+			[]string{"0310-18", "0310-12", "0309-18", "0308-18", "manual"},
+		},
+		{
+			"1 weekly keeps the newest",
+			&vm.SnapshotSchedule{Every: "6h", KeepWeekly: 1},
+			[]string{"0310-18", "manual"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := kept(Expired(snaps, tt.sched))
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -7,27 +7,36 @@
 // snapshot is taken (while the VM is paused) or the restored guest would see an
 // inconsistent filesystem.
 //
+// A diff snapshot stores only what changed since its parent, the snapshot the
+// VM was last saved to or restored from: the guest pages dirtied since then,
+// which Firecracker tracks, and the changed blocks of each disk. Restoring a
+// diff rebuilds the full files from the chain of snapshots back to a full one.
+// The snapshot directory must be on a filesystem that supports sparse files,
+// as ext4, xfs and btrfs do.
+//
 // Restore is in-place: it rolls a VM back to one of its own snapshots, reusing
 // the VM's original IP/MAC/TAP identity (which is frozen into the guest memory).
+// Restores and clones are run by package lifecycle, using RestoreDisks and
+// CloneDisks for the disks.
 package snapshot
 
 import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"sort"
 	"time"
 
+	"github.com/raesene/baremetalvmm/internal/diskfile"
 	"github.com/raesene/baremetalvmm/internal/firecracker"
-	"github.com/raesene/baremetalvmm/internal/network"
 	"github.com/raesene/baremetalvmm/internal/vm"
 )
 
 const (
 	metadataFile = "snapshot.json"
+	maxChain     = 1000 // guards against a cycle of parents
 	memFile      = "memory"
 	stateFile    = "vmstate"
 	rootfsFile   = "rootfs.ext4"
@@ -44,35 +53,63 @@ type MountSnapshot struct {
 // Metadata describes a stored VM snapshot. It records everything needed to
 // restore the exact environment the frozen guest expects.
 type Metadata struct {
-	Name       string          `json:"name"`
-	VMName     string          `json:"vm_name"`
-	VMID       string          `json:"vm_id"`
-	CreatedAt  time.Time       `json:"created_at"`
-	FCVersion  string          `json:"fc_version,omitempty"`
-	CPUs       int             `json:"cpus"`
-	MemoryMB   int             `json:"memory_mb"`
-	Kernel     string          `json:"kernel,omitempty"`
-	KernelPath string          `json:"kernel_path"`
-	IPAddress  string          `json:"ip_address"`
-	MacAddress string          `json:"mac_address"`
-	TapDevice  string          `json:"tap_device"`
-	RootfsPath string          `json:"rootfs_path"` // original host path to restore the rootfs to
-	MemFile    string          `json:"mem_file"`
-	StateFile  string          `json:"state_file"`
-	RootfsFile string          `json:"rootfs_file"`
-	Mounts     []MountSnapshot `json:"mounts,omitempty"`
-	SizeBytes  int64           `json:"size_bytes"`
+	Name          string          `json:"name"`
+	VMName        string          `json:"vm_name"`
+	VMID          string          `json:"vm_id"`
+	CreatedAt     time.Time       `json:"created_at"`
+	FCVersion     string          `json:"fc_version,omitempty"`
+	CPU           *CPUInfo        `json:"cpu,omitempty"` // host CPU the snapshot was taken on
+	CPUs          int             `json:"cpus"`
+	MemoryMB      int             `json:"memory_mb"`
+	Kernel        string          `json:"kernel,omitempty"`
+	KernelPath    string          `json:"kernel_path"`
+	IPAddress     string          `json:"ip_address"`
+	MacAddress    string          `json:"mac_address"`
+	TapDevice     string          `json:"tap_device"`
+	RootfsPath    string          `json:"rootfs_path"`            // original host path to restore the rootfs to
+	StateRootfs   string          `json:"state_rootfs,omitempty"` // rootfs path in the VM state, when an import moved RootfsPath
+	MemFile       string          `json:"mem_file"`
+	StateFile     string          `json:"state_file"`
+	RootfsFile    string          `json:"rootfs_file"`
+	Mounts        []MountSnapshot `json:"mounts,omitempty"`
+	Parent        string          `json:"parent,omitempty"`         // snapshot of the same VM a diff builds on; empty for a full snapshot
+	SizeBytes     int64           `json:"size_bytes"`               // disk space the snapshot takes up
+	ApparentBytes int64           `json:"apparent_bytes,omitempty"` // size of the snapshot's files, counting their holes
+	Scheduled     bool            `json:"scheduled,omitempty"`      // taken by the VM's snapshot schedule
+}
+
+// DiskOnly reports whether the snapshot holds disks without memory, so it
+// can only be restored by booting them.
+func (meta *Metadata) DiskOnly() bool {
+	return meta.MemFile == ""
+}
+
+// Kind describes the snapshot for listings: "full", "diff" or "disk-only".
+func (meta *Metadata) Kind() string {
+	switch {
+	case meta.DiskOnly():
+		return "disk-only"
+	case meta.Diff():
+		return "diff"
+	}
+	return "full"
+}
+
+// Diff reports whether the snapshot only holds changes since its parent.
+func (meta *Metadata) Diff() bool {
+	return meta.Parent != ""
 }
 
 // Manager handles snapshot storage under a base directory (one subdirectory per
 // VM, one subdirectory per snapshot).
 type Manager struct {
-	baseDir string
+	baseDir      string
+	reportsHoles func(dir string) (bool, error) // diskfile.ReportsHoles, replaced in tests
 }
 
 // NewManager creates a snapshot Manager rooted at snapshotsDir.
 func NewManager(snapshotsDir string) *Manager {
-	return &Manager{baseDir: snapshotsDir}
+	return &Manager{baseDir: snapshotsDir, reportsHoles: diskfile.ReportsHoles}
 }
 
 // VMDir returns the directory holding all snapshots for a VM.
@@ -91,15 +128,52 @@ func (m *Manager) Exists(vmName, snapName string) bool {
 	return err == nil
 }
 
-// Create takes a full snapshot of a running VM. The VM is paused, its memory
-// and device state are written, its rootfs and mount images are copied, and
-// then it is resumed (unless resume is false, in which case it is left paused
-// for the caller to stop).
-func (m *Manager) Create(ctx context.Context, fc *firecracker.Client, v *vm.VM, snapName string, resume bool) (*Metadata, error) {
+// CreateOptions selects the kind of snapshot Create takes.
+type CreateOptions struct {
+	// Diff writes only the memory pages and disk blocks that changed since
+	// the VM's last snapshot, which becomes the new one's parent.
+	Diff bool
+	// DiskOnly copies the disks without the memory, so the guest is paused
+	// for less time. The snapshot can be restored by booting its disks.
+	DiskOnly bool
+	// Scheduled marks the snapshot as taken by the VM's snapshot schedule,
+	// which may prune it later.
+	Scheduled bool
+	// LeavePaused leaves the VM paused afterwards, for a caller that stops
+	// it.
+	LeavePaused bool
+}
+
+// Create takes a snapshot of a running VM. The VM is paused, its memory and
+// device state are written, its rootfs and mount images are copied, and then
+// it is resumed unless opts.LeavePaused is set.
+//
+// A diff snapshot is taken against v.LastSnapshot. Create sets
+// v.LastSnapshot for snapshots that include memory; the caller is
+// responsible for persisting the VM.
+func (m *Manager) Create(ctx context.Context, fc *firecracker.Client, v *vm.VM, snapName string, opts CreateOptions) (*Metadata, error) {
 	if m.Exists(v.Name, snapName) {
 		return nil, fmt.Errorf("snapshot '%s' already exists for VM '%s'", snapName, v.Name)
 	}
 
+	diff := opts.Diff
+	if diff && opts.DiskOnly {
+		return nil, fmt.Errorf("disk-only snapshots cannot be diffs")
+	}
+	// Volumes are not part of snapshots, so the guest's memory would not
+	// match them when resumed
+	if len(v.Volumes) > 0 && !opts.DiskOnly {
+		return nil, fmt.Errorf("VM '%s' has volumes attached, which snapshots do not include; take a disk-only snapshot instead", v.Name)
+	}
+	var parent []*Metadata
+	if diff {
+		chain, err := m.diffParent(v)
+		if err != nil {
+			return nil, err
+		}
+		parent, diff = chain, chain != nil
+	}
+
 	dir := m.Dir(v.Name, snapName)
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, fmt.Errorf("failed to create snapshot directory: %w", err)
@@ -129,12 +203,20 @@ func (m *Manager) Create(ctx context.Context, fc *firecracker.Client, v *vm.VM,
 		}
 	}()
 
-	if err := fc.CreateSnapshotFiles(ctx, v.SocketPath, memPath, statePath); err != nil {
-		return nil, err
+	if !opts.DiskOnly {
+		if err := fc.CreateSnapshotFiles(ctx, v.SocketPath, memPath, statePath, diff); err != nil {
+			return nil, err
+		}
 	}
 
-	// Copy the rootfs while still paused so it matches the memory snapshot.
-	if err := copyFile(v.RootfsPath, filepath.Join(dir, rootfsFile)); err != nil {
+	// Copy the disks while still paused so they match the memory snapshot.
+	copyDisk := func(src, file string) error {
+		if !diff {
+			return copyFile(src, filepath.Join(dir, file))
+		}
+		return writeDelta(src, m.layers(parent, file), filepath.Join(dir, file))
+	}
+	if err := copyDisk(v.RootfsPath, rootfsFile); err != nil {
 		return nil, fmt.Errorf("failed to copy rootfs: %w", err)
 	}
 
@@ -144,7 +226,7 @@ func (m *Manager) Create(ctx context.Context, fc *firecracker.Client, v *vm.VM,
 			continue
 		}
 		fname := "mount-" + mnt.GuestTag + ".ext4"
-		if err := copyFile(mnt.ImagePath, filepath.Join(dir, fname)); err != nil {
+		if err := copyDisk(mnt.ImagePath, fname); err != nil {
 			return nil, fmt.Errorf("failed to copy mount image '%s': %w", mnt.GuestTag, err)
 		}
 		mounts = append(mounts, MountSnapshot{
@@ -156,7 +238,7 @@ func (m *Manager) Create(ctx context.Context, fc *firecracker.Client, v *vm.VM,
 	}
 
 	// Resume (or intentionally leave paused for a --stop caller).
-	if resume {
+	if !opts.LeavePaused {
 		if err := fc.ResumeVM(ctx, v.SocketPath); err != nil {
 			return nil, err
 		}
@@ -181,77 +263,250 @@ func (m *Manager) Create(ctx context.Context, fc *firecracker.Client, v *vm.VM,
 		StateFile:  stateFile,
 		RootfsFile: rootfsFile,
 		Mounts:     mounts,
+		Scheduled:  opts.Scheduled,
 	}
-	meta.SizeBytes = dirSize(dir)
+	if diff {
+		meta.Parent = v.LastSnapshot
+	}
+	if opts.DiskOnly {
+		meta.MemFile, meta.StateFile = "", ""
+	}
+	if cpu, err := HostCPU(); err == nil {
+		meta.CPU = cpu
+	}
+	meta.ApparentBytes, meta.SizeBytes = dirUsage(dir)
 
 	if err := m.saveMetadata(dir, meta); err != nil {
 		return nil, err
 	}
 
 	success = true
+	if !opts.DiskOnly {
+		v.LastSnapshot = snapName
+	}
 	return meta, nil
 }
 
-// Restore rolls a VM back to a snapshot in place. The VM must already be
-// stopped. The snapshot's rootfs and mount images are copied back to their
-// original host paths; then, if start is true, the network is re-established
-// (same TAP/IP as when the snapshot was taken) and Firecracker is started from
-// the snapshot with the guest resumed.
-//
-// On a successful start the VM's State, PID and StartedAt fields are updated;
-// the caller is responsible for persisting the VM.
-func (m *Manager) Restore(ctx context.Context, fc *firecracker.Client, netMgr *network.Manager, v *vm.VM, snapName, logPath string, start bool) (*Metadata, error) {
-	meta, err := m.Get(v.Name, snapName)
+// diffParent returns the chain of snapshots a diff snapshot of v builds on,
+// ending in v.LastSnapshot. It returns nil if the snapshots directory is on a
+// filesystem that does not report holes: a diff layer marks what did not
+// change with holes, so there it would read as entirely changed and
+// overwrite its parent when rebuilt. The snapshot is then taken in full.
+func (m *Manager) diffParent(v *vm.VM) ([]*Metadata, error) {
+	if v.LastSnapshot == "" {
+		return nil, fmt.Errorf("VM '%s' has not been snapshotted or restored since it started, so there is nothing to diff against; take a full snapshot first", v.Name)
+	}
+	chain, err := m.Chain(v.Name, v.LastSnapshot)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("cannot diff against snapshot '%s': %w; take a full snapshot instead", v.LastSnapshot, err)
 	}
+	if !sameMounts(v.Mounts, chain[len(chain)-1].Mounts) {
+		return nil, fmt.Errorf("the mounts of VM '%s' differ from snapshot '%s'; take a full snapshot instead", v.Name, v.LastSnapshot)
+	}
+	holes, err := m.reportsHoles(m.baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for sparse file support in %s: %w", m.baseDir, err)
+	}
+	if !holes {
+		fmt.Printf("Note: %s does not report holes in sparse files, so a full snapshot is taken instead of a diff\n", m.baseDir)
+		return nil, nil
+	}
+	return chain, nil
+}
 
-	dir := m.Dir(v.Name, snapName)
+// RestoreDisks rolls a stopped VM's disks back to a snapshot in place: the
+// snapshot's rootfs and mount images are rebuilt at their original host
+// paths and the VM's RootfsPath is updated to match. Loading the snapshot's
+// memory is left to the caller; the caller is responsible for persisting the
+// VM.
+func (m *Manager) RestoreDisks(v *vm.VM, snapName string) (*Metadata, error) {
+	chain, err := m.Chain(v.Name, snapName)
+	if err != nil {
+		return nil, err
+	}
+	meta := chain[len(chain)-1]
 
 	// Restore the rootfs to the exact path recorded in the snapshot state.
-	if err := copyFile(filepath.Join(dir, meta.RootfsFile), meta.RootfsPath); err != nil {
+	if err := rebuild(m.layers(chain, meta.RootfsFile), meta.RootfsPath); err != nil {
 		return nil, fmt.Errorf("failed to restore rootfs: %w", err)
 	}
 	v.RootfsPath = meta.RootfsPath
 
 	for _, mnt := range meta.Mounts {
-		if err := copyFile(filepath.Join(dir, mnt.File), mnt.ImagePath); err != nil {
+		if err := rebuild(m.layers(chain, mnt.File), mnt.ImagePath); err != nil {
 			return nil, fmt.Errorf("failed to restore mount image '%s': %w", mnt.GuestTag, err)
 		}
 	}
+	return meta, nil
+}
 
-	if !start {
-		return meta, nil
+// MemoryFile returns the path of a snapshot's complete memory file for
+// Firecracker to load, and a function to call once it is loaded. For a diff
+// snapshot the file is rebuilt from the chain into a temporary file, which
+// the function removes; Firecracker keeps its mapping of the file.
+func (m *Manager) MemoryFile(vmName, snapName string) (string, func(), error) {
+	chain, err := m.Chain(vmName, snapName)
+	if err != nil {
+		return "", nil, err
 	}
-
-	// Re-establish networking with the same identity frozen into guest memory.
-	if err := netMgr.EnsureBridge(); err != nil {
-		return nil, fmt.Errorf("failed to setup bridge: %w", err)
+	meta := chain[len(chain)-1]
+	if meta.DiskOnly() {
+		return "", nil, fmt.Errorf("snapshot '%s' has no memory", snapName)
 	}
-	if v.TapDevice != "" && !netMgr.TapExists(v.TapDevice) {
-		if err := netMgr.CreateTap(v.TapDevice); err != nil {
-			return nil, fmt.Errorf("failed to create TAP device: %w", err)
-		}
+	dir := m.Dir(vmName, snapName)
+	if !meta.Diff() {
+		return filepath.Join(dir, meta.MemFile), func() {}, nil
 	}
 
-	memPath := filepath.Join(dir, meta.MemFile)
-	statePath := filepath.Join(dir, meta.StateFile)
+	tmp, err := os.CreateTemp(dir, ".memory-*.tmp")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create memory file: %w", err)
+	}
+	tmp.Close()
+	path := tmp.Name()
+	if err := rebuild(m.layers(chain, meta.MemFile), path); err != nil {
+		os.Remove(path)
+		return "", nil, fmt.Errorf("failed to rebuild memory from snapshot chain: %w", err)
+	}
+	return path, func() { os.Remove(path) }, nil
+}
 
-	machine, err := fc.RestoreVM(ctx, v.SocketPath, logPath, memPath, statePath)
+// CloneDisks copies a snapshot's rootfs to rootfsPath and, if mountPath is not
+// nil, each of its mount images to the path mountPath returns for the mount's
+// guest tag. Copies that were made are removed again if one fails.
+func (m *Manager) CloneDisks(vmName, snapName, rootfsPath string, mountPath func(guestTag string) string) error {
+	chain, err := m.Chain(vmName, snapName)
 	if err != nil {
-		if v.TapDevice != "" && netMgr.TapExists(v.TapDevice) {
-			if derr := netMgr.DeleteTap(v.TapDevice); derr != nil {
-				fmt.Printf("Warning: failed to clean up TAP device %s: %v\n", v.TapDevice, derr)
+		return err
+	}
+	meta := chain[len(chain)-1]
+
+	var copied []string
+	success := false
+	defer func() {
+		if !success {
+			for _, path := range copied {
+				os.Remove(path)
+			}
+		}
+	}()
+
+	if err := rebuild(m.layers(chain, meta.RootfsFile), rootfsPath); err != nil {
+		return fmt.Errorf("failed to copy rootfs: %w", err)
+	}
+	copied = append(copied, rootfsPath)
+	if mountPath != nil {
+		for _, mnt := range meta.Mounts {
+			dst := mountPath(mnt.GuestTag)
+			if err := rebuild(m.layers(chain, mnt.File), dst); err != nil {
+				return fmt.Errorf("failed to copy mount image '%s': %w", mnt.GuestTag, err)
 			}
+			copied = append(copied, dst)
 		}
+	}
+	success = true
+	return nil
+}
+
+// Chain returns the snapshots a snapshot is built from, starting with the full
+// one and ending with the snapshot itself.
+func (m *Manager) Chain(vmName, snapName string) ([]*Metadata, error) {
+	var chain []*Metadata
+	for name := snapName; ; {
+		meta, err := m.Get(vmName, name)
+		if err != nil {
+			return nil, err
+		}
+		chain = append([]*Metadata{meta}, chain...)
+		if !meta.Diff() {
+			return chain, nil
+		}
+		if len(chain) > maxChain {
+			return nil, fmt.Errorf("snapshot '%s' of VM '%s' has more than %d ancestors", snapName, vmName, maxChain)
+		}
+		name = meta.Parent
+	}
+}
+
+// Children returns the diff snapshots whose parent is snapName.
+func (m *Manager) Children(vmName, snapName string) ([]*Metadata, error) {
+	snaps, err := m.List(vmName)
+	if err != nil {
 		return nil, err
 	}
+	var children []*Metadata
+	for _, s := range snaps {
+		if s.Parent == snapName {
+			children = append(children, s)
+		}
+	}
+	return children, nil
+}
 
-	v.State = vm.StateRunning
-	v.PID = fc.GetVMPID(machine)
-	v.StartedAt = time.Now()
+// Tree orders snapshots so that each diff snapshot follows its parent, and
+// returns the depth of each one: 0 for a snapshot whose parent is not in the
+// list, 1 for its children and so on. Siblings keep their order in snaps.
+func Tree(snaps []*Metadata) ([]*Metadata, []int) {
+	key := func(vmName, snapName string) string { return vmName + "/" + snapName }
+	present := make(map[string]bool)
+	for _, s := range snaps {
+		present[key(s.VMName, s.Name)] = true
+	}
+	children := make(map[string][]*Metadata)
+	var roots []*Metadata
+	for _, s := range snaps {
+		if s.Diff() && present[key(s.VMName, s.Parent)] {
+			parent := key(s.VMName, s.Parent)
+			children[parent] = append(children[parent], s)
+		} else {
+			roots = append(roots, s)
+		}
+	}
 
-	return meta, nil
+	ordered := make([]*Metadata, 0, len(snaps))
+	depths := make([]int, 0, len(snaps))
+	var walk func(s *Metadata, depth int)
+	walk = func(s *Metadata, depth int) {
+		ordered = append(ordered, s)
+		depths = append(depths, depth)
+		for _, child := range children[key(s.VMName, s.Name)] {
+			walk(child, depth+1)
+		}
+	}
+	for _, s := range roots {
+		walk(s, 0)
+	}
+	return ordered, depths
+}
+
+// layers returns the paths of a file in each snapshot of a chain. Mount
+// images are matched by name, which is derived from the guest tag.
+func (m *Manager) layers(chain []*Metadata, file string) []string {
+	paths := make([]string, len(chain))
+	for i, meta := range chain {
+		paths[i] = filepath.Join(m.Dir(meta.VMName, meta.Name), file)
+	}
+	return paths
+}
+
+// sameMounts reports whether a VM's mounts are the mount images recorded in a
+// snapshot.
+func sameMounts(mounts []vm.Mount, recorded []MountSnapshot) bool {
+	var tags []string
+	for _, mnt := range mounts {
+		if mnt.ImagePath != "" {
+			tags = append(tags, mnt.GuestTag)
+		}
+	}
+	if len(tags) != len(recorded) {
+		return false
+	}
+	for i := range tags {
+		if tags[i] != recorded[i].GuestTag {
+			return false
+		}
+	}
+	return true
 }
 
 // Get loads the metadata for a single snapshot.
@@ -268,6 +523,10 @@ func (m *Manager) Get(vmName, snapName string) (*Metadata, error) {
 	if err := json.Unmarshal(data, &meta); err != nil {
 		return nil, fmt.Errorf("failed to parse snapshot metadata: %w", err)
 	}
+	if meta.ApparentBytes == 0 && meta.SizeBytes > 0 {
+		// Taken before apparent sizes were recorded
+		meta.ApparentBytes, _ = dirUsage(filepath.Dir(path))
+	}
 	return &meta, nil
 }
 
@@ -316,11 +575,22 @@ func (m *Manager) List(vmName string) ([]*Metadata, error) {
 	return snapshots, nil
 }
 
-// Delete removes a single snapshot. The per-VM directory is removed too if it
-// becomes empty.
+// Delete removes a single snapshot. Diff snapshots built on it are merged
+// with it first, so they keep their contents and take over its parent. The
+// per-VM directory is removed too if it becomes empty.
 func (m *Manager) Delete(vmName, snapName string) error {
-	if !m.Exists(vmName, snapName) {
-		return fmt.Errorf("snapshot '%s' not found for VM '%s'", snapName, vmName)
+	meta, err := m.Get(vmName, snapName)
+	if err != nil {
+		return err
+	}
+	children, err := m.Children(vmName, snapName)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := m.merge(meta, child); err != nil {
+			return fmt.Errorf("failed to merge snapshot '%s' into '%s': %w", snapName, child.Name, err)
+		}
 	}
 	if err := os.RemoveAll(m.Dir(vmName, snapName)); err != nil {
 		return fmt.Errorf("failed to delete snapshot: %w", err)
@@ -330,6 +600,34 @@ func (m *Manager) Delete(vmName, snapName string) error {
 	return nil
 }
 
+// merge folds the snapshot parent into its diff snapshot child, so that child
+// no longer needs it. Each of child's layers is laid over parent's and
+// replaces it, then child's parent becomes parent's. A merge cut short can
+// simply be run again: a merged layer laid over parent's is unchanged.
+func (m *Manager) merge(parent, child *Metadata) error {
+	dir := m.Dir(child.VMName, child.Name)
+	files := []string{child.MemFile, child.RootfsFile}
+	for _, mnt := range child.Mounts {
+		files = append(files, mnt.File)
+	}
+	for _, file := range files {
+		layer := filepath.Join(dir, file)
+		tmp := filepath.Join(dir, ".merge-"+file)
+		bottom := filepath.Join(m.Dir(parent.VMName, parent.Name), file)
+		if err := rebuild([]string{bottom, layer}, tmp); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		if err := os.Rename(tmp, layer); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	child.Parent = parent.Parent
+	child.ApparentBytes, child.SizeBytes = dirUsage(dir)
+	return m.saveMetadata(dir, child)
+}
+
 // DeleteAllForVM removes every snapshot belonging to a VM. It is a no-op if the
 // VM has no snapshots.
 func (m *Manager) DeleteAllForVM(vmName string) error {
@@ -381,43 +679,25 @@ func (m *Manager) saveMetadata(dir string, meta *Metadata) error {
 }
 
 // copyFile copies src to dst, creating dst with 0600 permissions and syncing it
-// to disk. Any existing dst is overwritten.
+// to disk. Any existing dst is overwritten. Holes in src stay holes in dst.
 func copyFile(src, dst string) error {
-	in, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer in.Close()
-
-	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
-	if err != nil {
-		return err
-	}
-
-	if _, err := io.Copy(out, in); err != nil {
-		out.Close()
-		return err
-	}
-	if err := out.Sync(); err != nil {
-		out.Close()
-		return err
-	}
-	return out.Close()
+	return diskfile.Copy(src, dst, 0600)
 }
 
-// dirSize returns the total size in bytes of all regular files in dir.
-func dirSize(dir string) int64 {
-	var total int64
+// dirUsage returns the apparent size of the regular files in dir and the
+// disk space they take up, which is less for sparse files.
+func dirUsage(dir string) (apparent, allocated int64) {
 	entries, err := os.ReadDir(dir)
 	if err != nil {
-		return 0
+		return 0, 0
 	}
 	for _, e := range entries {
 		info, err := e.Info()
 		if err != nil || e.IsDir() {
 			continue
 		}
-		total += info.Size()
+		apparent += info.Size()
+		allocated += diskfile.AllocatedSize(info)
 	}
-	return total
+	return apparent, allocated
 }
@@ -1,10 +1,17 @@
 package snapshot
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/raesene/baremetalvmm/internal/diskfile"
+	"github.com/raesene/baremetalvmm/internal/vm"
 )
 
 // writeSnapshot creates a snapshot directory with metadata and dummy data files
@@ -15,7 +22,7 @@ func writeSnapshot(t *testing.T, m *Manager, vmName, snapName string, created ti
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		t.Fatalf("mkdir: %v", err)
 	}
-	// Dummy payload files so dirSize has something to measure.
+	// Dummy payload files so dirUsage has something to measure.
 	for _, f := range []string{memFile, stateFile, rootfsFile} {
 		if err := os.WriteFile(filepath.Join(dir, f), []byte("data-"+f), 0600); err != nil {
 			t.Fatalf("write %s: %v", f, err)
@@ -156,6 +163,50 @@ func TestDeleteAllForVM(t *testing.T) {
 	}
 }
 
+func TestCloneDisks(t *testing.T) {
+	m := NewManager(t.TempDir())
+	writeSnapshot(t, m, "vm1", "snap1", time.Now())
+	dir := m.Dir("vm1", "snap1")
+	meta, err := m.Get("vm1", "snap1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	meta.Mounts = []MountSnapshot{{GuestTag: "data", File: "mount-data.ext4"}}
+	if err := m.saveMetadata(dir, meta); err != nil {
+		t.Fatalf("saveMetadata: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "mount-data.ext4"), []byte("data-mount"), 0600); err != nil {
+		t.Fatalf("write mount: %v", err)
+	}
+
+	out := t.TempDir()
+	rootfs := filepath.Join(out, "clone.ext4")
+	mountPath := func(tag string) string { return filepath.Join(out, "clone-"+tag+".ext4") }
+	if err := m.CloneDisks("vm1", "snap1", rootfs, mountPath); err != nil {
+		t.Fatalf("CloneDisks: %v", err)
+	}
+	for path, want := range map[string]string{rootfs: "data-" + rootfsFile, mountPath("data"): "data-mount"} {
+		got, err := os.ReadFile(path)
+		if err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v; want %q", filepath.Base(path), got, err, want)
+		}
+	}
+
+	// A missing mount image fails the clone and leaves no copies behind
+	os.Remove(filepath.Join(dir, "mount-data.ext4"))
+	rootfs2 := filepath.Join(out, "clone2.ext4")
+	if err := m.CloneDisks("vm1", "snap1", rootfs2, mountPath); err == nil {
+		t.Fatal("CloneDisks should fail when a mount image is missing")
+	}
+	if _, err := os.Stat(rootfs2); !os.IsNotExist(err) {
+		t.Errorf("rootfs copy left behind after a failed clone: %v", err)
+	}
+
+	if err := m.CloneDisks("vm1", "missing", rootfs2, nil); err == nil {
+		t.Fatal("CloneDisks should fail for a missing snapshot")
+	}
+}
+
 func TestCopyFile(t *testing.T) {
 	dir := t.TempDir()
 	src := filepath.Join(dir, "src")
@@ -183,3 +234,225 @@ func TestCopyFile(t *testing.T) {
 		t.Fatalf("expected dst perms 0600, got %v", info.Mode().Perm())
 	}
 }
+
+// writeBlocks writes a file of n blocks where block i is filled with the
+// byte fill[i].
+func writeBlocks(t *testing.T, path string, fill []byte) {
+	t.Helper()
+	data := make([]byte, 0, len(fill)*deltaBlockSize)
+	for _, b := range fill {
+		data = append(data, bytes.Repeat([]byte{b}, deltaBlockSize)...)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("write %s: %v", filepath.Base(path), err)
+	}
+}
+
+func TestWriteDeltaAndRebuild(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	writeBlocks(t, base, []byte{1, 2, 3, 4})
+
+	// The disk changes block 1, then grows by a block
+	disk := filepath.Join(dir, "disk")
+	writeBlocks(t, disk, []byte{1, 9, 3, 4, 5})
+	delta := filepath.Join(dir, "delta")
+	if err := writeDelta(disk, []string{base}, delta); err != nil {
+		t.Fatalf("writeDelta: %v", err)
+	}
+
+	// Then changes block 3, and block 1 back to what the base had
+	writeBlocks(t, disk, []byte{1, 2, 3, 7, 5})
+	delta2 := filepath.Join(dir, "delta2")
+	if err := writeDelta(disk, []string{base, delta}, delta2); err != nil {
+		t.Fatalf("writeDelta: %v", err)
+	}
+	f, err := os.Open(delta2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extents, err := diskfile.DataExtents(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("DataExtents: %v", err)
+	}
+	for i, changed := range []bool{false, true, false, true, false} {
+		if got := contains(extents, int64(i)*deltaBlockSize); got != changed {
+			t.Errorf("block %d in delta = %v, want %v", i, got, changed)
+		}
+	}
+
+	out := filepath.Join(dir, "out")
+	if err := rebuild([]string{base, delta, delta2}, out); err != nil {
+		t.Fatalf("rebuild: %v", err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := os.ReadFile(disk)
+	if !bytes.Equal(got, want) {
+		t.Error("rebuilt disk does not match the original")
+	}
+}
+
+// writeDiffSnapshot creates a diff snapshot whose memory and rootfs layers
+// hold a single changed block.
+func writeDiffSnapshot(t *testing.T, m *Manager, vmName, snapName, parent string, created time.Time, block int, fill byte) {
+	t.Helper()
+	writeSnapshot(t, m, vmName, snapName, created)
+	dir := m.Dir(vmName, snapName)
+	for _, file := range []string{memFile, rootfsFile} {
+		f, err := os.OpenFile(filepath.Join(dir, file), os.O_WRONLY|os.O_TRUNC, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Truncate(4 * deltaBlockSize)
+		f.WriteAt(bytes.Repeat([]byte{fill}, deltaBlockSize), int64(block)*deltaBlockSize)
+		f.Close()
+	}
+	meta, err := m.Get(vmName, snapName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.Parent = parent
+	if err := m.saveMetadata(dir, meta); err != nil {
+		t.Fatalf("saveMetadata: %v", err)
+	}
+}
+
+func TestDiffChain(t *testing.T) {
+	m := NewManager(t.TempDir())
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeSnapshot(t, m, "vm1", "full", base)
+	for _, file := range []string{memFile, rootfsFile} {
+		writeBlocks(t, filepath.Join(m.Dir("vm1", "full"), file), []byte{1, 1, 1, 1})
+	}
+	writeDiffSnapshot(t, m, "vm1", "d1", "full", base.Add(time.Minute), 1, 2)
+	writeDiffSnapshot(t, m, "vm1", "d2", "d1", base.Add(2*time.Minute), 2, 3)
+
+	chain, err := m.Chain("vm1", "d2")
+	if err != nil {
+		t.Fatalf("Chain: %v", err)
+	}
+	if len(chain) != 3 || chain[0].Name != "full" || chain[2].Name != "d2" {
+		t.Fatalf("Chain(d2) = %d snapshots, want full, d1, d2", len(chain))
+	}
+
+	want := filepath.Join(t.TempDir(), "want")
+	writeBlocks(t, want, []byte{1, 2, 3, 1})
+	wantData, _ := os.ReadFile(want)
+	check := func(label string) {
+		t.Helper()
+		out := filepath.Join(t.TempDir(), "rootfs")
+		if err := m.CloneDisks("vm1", "d2", out, nil); err != nil {
+			t.Fatalf("%s: CloneDisks: %v", label, err)
+		}
+		if got, _ := os.ReadFile(out); !bytes.Equal(got, wantData) {
+			t.Errorf("%s: rootfs rebuilt from the chain is wrong", label)
+		}
+		mem, done, err := m.MemoryFile("vm1", "d2")
+		if err != nil {
+			t.Fatalf("%s: MemoryFile: %v", label, err)
+		}
+		if got, _ := os.ReadFile(mem); !bytes.Equal(got, wantData) {
+			t.Errorf("%s: memory rebuilt from the chain is wrong", label)
+		}
+		done()
+		rebuilt := mem != filepath.Join(m.Dir("vm1", "d2"), memFile)
+		if _, err := os.Stat(mem); rebuilt && !os.IsNotExist(err) {
+			t.Errorf("%s: rebuilt memory file left behind: %v", label, err)
+		}
+	}
+	check("chain")
+
+	// Deleting a snapshot in the middle merges it into its child
+	if err := m.Delete("vm1", "d1"); err != nil {
+		t.Fatalf("Delete(d1): %v", err)
+	}
+	if meta, _ := m.Get("vm1", "d2"); meta == nil || meta.Parent != "full" {
+		t.Fatalf("d2 after deleting d1 = %+v, want parent full", meta)
+	}
+	check("after deleting d1")
+
+	// Deleting the full snapshot makes its child full
+	if err := m.Delete("vm1", "full"); err != nil {
+		t.Fatalf("Delete(full): %v", err)
+	}
+	if meta, _ := m.Get("vm1", "d2"); meta == nil || meta.Diff() {
+		t.Fatalf("d2 after deleting its full parent = %+v, want a full snapshot", meta)
+	}
+	check("after deleting full")
+}
+
+func TestDiffParent(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		last      string
+		holes     bool
+		wantChain int
+		wantErr   bool
+	}{
+		{"diff", "d1", true, 2, false},
+		// Layers could not be told apart from full files, so the snapshot
+		// falls back to a full one
+		{"no holes", "d1", false, 0, false},
+		{"never snapshotted", "", true, 0, true},
+		{"missing parent", "gone", true, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(t.TempDir())
+			m.reportsHoles = func(string) (bool, error) { return tt.holes, nil }
+			writeSnapshot(t, m, "vm1", "full", base)
+			writeDiffSnapshot(t, m, "vm1", "d1", "full", base.Add(time.Minute), 1, 2)
+			v := vm.NewVM("vm1")
+			v.LastSnapshot = tt.last
+
+			chain, err := m.diffParent(v)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("diffParent() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(chain) != tt.wantChain {
+				t.Errorf("diffParent() returned %d snapshots, want %d", len(chain), tt.wantChain)
+			}
+		})
+	}
+}
+
+func TestTree(t *testing.T) {
+	snaps := []*Metadata{
+		{VMName: "vm1", Name: "d2", Parent: "d1"},
+		{VMName: "vm1", Name: "other"},
+		{VMName: "vm1", Name: "d1", Parent: "full"},
+		{VMName: "vm1", Name: "full"},
+		{VMName: "vm2", Name: "orphan", Parent: "deleted"},
+	}
+	ordered, depths := Tree(snaps)
+	var got []string
+	for i, s := range ordered {
+		got = append(got, fmt.Sprintf("%s/%s:%d", s.VMName, s.Name, depths[i]))
+	}
+	want := []string{"vm1/other:0", "vm1/full:0", "vm1/d1:1", "vm1/d2:2", "vm2/orphan:0"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Tree() = %v, want %v", got, want)
+	}
+}
+
+func TestCreateWithVolumes(t *testing.T) {
+	m := NewManager(t.TempDir())
+	v := vm.NewVM("vm1")
+	v.Volumes = []vm.VolumeAttachment{{Name: "data", MountPath: "/mnt/data"}}
+
+	// Refused before the VM is touched, so no Firecracker client is needed
+	for _, opts := range []CreateOptions{{}, {Diff: true}} {
+		if _, err := m.Create(context.Background(), nil, v, "snap1", opts); err == nil || !strings.Contains(err.Error(), "volumes") {
+			t.Errorf("Create(%+v) error = %v, want a volumes error", opts, err)
+		}
+	}
+	if m.Exists("vm1", "snap1") {
+		t.Error("refused Create left a snapshot behind")
+	}
+}
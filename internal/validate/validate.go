@@ -3,7 +3,9 @@ package validate
 import (
 	"fmt"
 	"net"
+	"path/filepath"
 	"regexp"
+	"strings"
 )
 
 var identifierRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
@@ -37,6 +39,10 @@ func KernelName(name string) error {
 	return Name("kernel", name)
 }
 
+func InitrdName(name string) error {
+	return Name("initrd", name)
+}
+
 func MountTag(tag string) error {
 	return Name("mount tag", tag)
 }
@@ -45,6 +51,14 @@ func SnapshotName(name string) error {
 	return Name("snapshot", name)
 }
 
+func NetworkName(name string) error {
+	return Name("network", name)
+}
+
+func VolumeName(name string) error {
+	return Name("volume", name)
+}
+
 func CPUs(n int) error {
 	if n < 1 || n > 32 {
 		return fmt.Errorf("CPUs must be between 1 and 32 (got %d)", n)
@@ -66,6 +80,33 @@ func DiskSizeMB(n int) error {
 	return nil
 }
 
+func VolumeSizeMB(n int) error {
+	if n < 64 || n > 1048576 {
+		return fmt.Errorf("volume size must be between 64 and 1048576 MB (got %d)", n)
+	}
+	return nil
+}
+
+// GuestMountPath validates the directory a volume is mounted on in the guest.
+// It is written to the guest's fstab, so it may not contain whitespace.
+func GuestMountPath(path string) error {
+	if !strings.HasPrefix(path, "/") || path == "/" {
+		return fmt.Errorf("mount path %q must be an absolute path other than /", path)
+	}
+	if filepath.Clean(path) != path {
+		return fmt.Errorf("mount path %q is not clean (use %s)", path, filepath.Clean(path))
+	}
+	if len(path) > 256 {
+		return fmt.Errorf("mount path must be at most 256 characters (got %d)", len(path))
+	}
+	for _, c := range path {
+		if c <= ' ' || c > '~' {
+			return fmt.Errorf("mount path may only contain printable ASCII characters other than spaces: %q", path)
+		}
+	}
+	return nil
+}
+
 func DNSServer(addr string) error {
 	if net.ParseIP(addr) == nil {
 		return fmt.Errorf("invalid DNS server address: %q", addr)
@@ -73,6 +114,23 @@ func DNSServer(addr string) error {
 	return nil
 }
 
+// maxKernelArgs leaves room within Firecracker's 2048-byte command line for
+// the default arguments and the ip= configuration vmm adds.
+const maxKernelArgs = 1024
+
+// KernelArgs validates extra arguments for a VM's kernel command line.
+func KernelArgs(args string) error {
+	if len(args) > maxKernelArgs {
+		return fmt.Errorf("kernel arguments must be at most %d characters (got %d)", maxKernelArgs, len(args))
+	}
+	for _, c := range args {
+		if c < ' ' || c > '~' {
+			return fmt.Errorf("kernel arguments may only contain printable ASCII characters: %q", args)
+		}
+	}
+	return nil
+}
+
 var k8sVersionRe = regexp.MustCompile(`^[0-9]+\.[0-9]{1,2}\.[0-9]{1,3}$`)
 
 func K8sVersion(version string) error {
@@ -1,6 +1,7 @@
 package validate
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -110,12 +111,33 @@ func TestTypedValidators(t *testing.T) {
 		t.Errorf("KernelName(%q) expected error", invalid)
 	}
 
+	if err := InitrdName(valid); err != nil {
+		t.Errorf("InitrdName(%q) unexpected error: %v", valid, err)
+	}
+	if err := InitrdName(invalid); err == nil {
+		t.Errorf("InitrdName(%q) expected error", invalid)
+	}
+
 	if err := MountTag(valid); err != nil {
 		t.Errorf("MountTag(%q) unexpected error: %v", valid, err)
 	}
 	if err := MountTag(invalid); err == nil {
 		t.Errorf("MountTag(%q) expected error", invalid)
 	}
+
+	if err := NetworkName(valid); err != nil {
+		t.Errorf("NetworkName(%q) unexpected error: %v", valid, err)
+	}
+	if err := NetworkName(invalid); err == nil {
+		t.Errorf("NetworkName(%q) expected error", invalid)
+	}
+
+	if err := VolumeName(valid); err != nil {
+		t.Errorf("VolumeName(%q) unexpected error: %v", valid, err)
+	}
+	if err := VolumeName(invalid); err == nil {
+		t.Errorf("VolumeName(%q) expected error", invalid)
+	}
 }
 
 func TestNameErrorMessages(t *testing.T) {
@@ -135,3 +157,55 @@ func TestNameErrorMessages(t *testing.T) {
 		t.Errorf("unexpected error message: %s", got)
 	}
 }
+
+func TestKernelArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    string
+		wantErr bool
+	}{
+		{"empty", "", false},
+		{"single", "quiet", false},
+		{"several", "loglevel=7 systemd.unit=rescue.target init=/bin/sh", false},
+		{"quoted", `dyndbg="file drivers/* +p"`, false},
+		{"newline", "quiet\ninit=/bin/sh", true},
+		{"tab", "quiet\tsplash", true},
+		{"non-ascii", "quiet \u00e9", true},
+		{"too long", strings.Repeat("a", 1025), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := KernelArgs(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("KernelArgs(%q) error = %v, wantErr %v", tt.args, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGuestMountPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{"simple", "/data", false},
+		{"nested", "/var/lib/postgresql", false},
+		{"root", "/", true},
+		{"relative", "data", true},
+		{"empty", "", true},
+		{"trailing slash", "/data/", true},
+		{"dot dot", "/data/../etc", true},
+		{"space", "/my data", true},
+		{"tab", "/data\tx", true},
+		{"too long", "/" + strings.Repeat("a", 256), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := GuestMountPath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GuestMountPath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -3,11 +3,16 @@ package vm
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+
+	"github.com/raesene/baremetalvmm/internal/validate"
 )
 
 // State represents the current state of a VM
@@ -17,43 +22,228 @@ const (
 	StateCreated  State = "created"
 	StateStarting State = "starting"
 	StateRunning  State = "running"
+	StatePaused   State = "paused"
 	StateStopping State = "stopping"
 	StateStopped  State = "stopped"
 	StateError    State = "error"
 )
 
+// Active reports whether a VM in this state has a Firecracker process, and
+// so holds its TAP devices, addresses and port forwards. A paused VM is
+// active but uses no vCPU time.
+func (s State) Active() bool {
+	return s == StateRunning || s == StatePaused
+}
+
 // VM represents a microVM instance
 type VM struct {
-	ID           string        `json:"id"`
-	Name         string        `json:"name"`
-	State        State         `json:"state"`
-	CPUs         int           `json:"cpus"`
-	MemoryMB     int           `json:"memory_mb"`
-	DiskSizeMB   int           `json:"disk_size_mb"`
-	Image        string        `json:"image,omitempty"`
-	Kernel       string        `json:"kernel,omitempty"` // Custom kernel name (empty = default)
-	KernelPath   string        `json:"kernel_path"`
-	RootfsPath   string        `json:"rootfs_path"`
-	IPAddress    string        `json:"ip_address"`
-	TapDevice    string        `json:"tap_device"`
-	MacAddress   string        `json:"mac_address"`
-	SSHPort      int           `json:"ssh_port"`
-	SSHPublicKey string        `json:"ssh_public_key,omitempty"`
-	DNSServers   []string      `json:"dns_servers,omitempty"`
-	SocketPath   string        `json:"socket_path"`
-	PID          int           `json:"pid"`
-	AutoStart    bool          `json:"auto_start"`
-	CreatedAt    time.Time     `json:"created_at"`
-	StartedAt    time.Time     `json:"started_at,omitempty"`
-	PortForwards []PortForward `json:"port_forwards,omitempty"`
-	Mounts       []Mount       `json:"mounts,omitempty"`
-}
-
-// PortForward represents a port forwarding rule
+	ID               string             `json:"id"`
+	Name             string             `json:"name"`
+	State            State              `json:"state"`
+	CPUs             int                `json:"cpus"`
+	MemoryMB         int                `json:"memory_mb"`
+	DiskSizeMB       int                `json:"disk_size_mb"`
+	Image            string             `json:"image,omitempty"`
+	Kernel           string             `json:"kernel,omitempty"`      // Custom kernel name (empty = default)
+	KernelArgs       string             `json:"kernel_args,omitempty"` // Appended to the default kernel command line
+	Initrd           string             `json:"initrd,omitempty"`      // Initrd image name (empty = none)
+	KernelPath       string             `json:"kernel_path"`
+	RootfsPath       string             `json:"rootfs_path"`
+	BaseImage        string             `json:"base_image,omitempty"` // Image the rootfs is a copy-on-write overlay of (empty = own copy)
+	NIC                                 // Primary interface (eth0)
+	NICs             []NIC              `json:"nics,omitempty"` // Additional interfaces (eth1, eth2, ...)
+	SSHPort          int                `json:"ssh_port"`
+	SSHPublicKey     string             `json:"ssh_public_key,omitempty"`
+	DNSServers       []string           `json:"dns_servers,omitempty"`
+	SocketPath       string             `json:"socket_path"`
+	PID              int                `json:"pid"`
+	AutoStart        bool               `json:"auto_start"`
+	CreatedAt        time.Time          `json:"created_at"`
+	StartedAt        time.Time          `json:"started_at,omitempty"`
+	LastSnapshot     string             `json:"last_snapshot,omitempty"` // Snapshot the running guest was last saved to or restored from
+	PortForwards     []PortForward      `json:"port_forwards,omitempty"`
+	Mounts           []Mount            `json:"mounts,omitempty"`
+	Volumes          []VolumeAttachment `json:"volumes,omitempty"` // Drives after the mounts, in attach order
+	Firewall         *Firewall          `json:"firewall,omitempty"`
+	RateLimits       *RateLimits        `json:"rate_limits,omitempty"`
+	BalloonMB        int                `json:"balloon_mb,omitempty"` // Guest memory held by the balloon device
+	SnapshotSchedule *SnapshotSchedule  `json:"snapshot_schedule,omitempty"`
+}
+
+// Boot describes how a VM's kernel is booted. Empty fields mean the default
+// kernel, no extra command line arguments and no initrd.
+type Boot struct {
+	Kernel     string `json:"kernel"`
+	KernelArgs string `json:"kernel_args"`
+	Initrd     string `json:"initrd"`
+}
+
+// Validate checks the names and command line. It does not check that the
+// kernel and initrd exist.
+func (b Boot) Validate() error {
+	if b.Kernel != "" {
+		if err := validate.KernelName(b.Kernel); err != nil {
+			return err
+		}
+	}
+	if b.Initrd != "" {
+		if err := validate.InitrdName(b.Initrd); err != nil {
+			return err
+		}
+	}
+	return validate.KernelArgs(b.KernelArgs)
+}
+
+// Boot returns the VM's boot settings.
+func (v *VM) Boot() Boot {
+	return Boot{Kernel: v.Kernel, KernelArgs: v.KernelArgs, Initrd: v.Initrd}
+}
+
+// NIC is a network interface attached to a VM. The primary interface is
+// embedded in VM so its fields keep their original place in the state file.
+type NIC struct {
+	Network     string `json:"network,omitempty"` // Named network (empty = default)
+	IPAddress   string `json:"ip_address"`
+	IPv6Address string `json:"ipv6_address,omitempty"` // Set on dual-stack networks
+	TapDevice   string `json:"tap_device"`
+	MacAddress  string `json:"mac_address"`
+}
+
+// Addresses returns the interface's IPv4 address followed by its IPv6
+// address, leaving out any that are not assigned.
+func (n *NIC) Addresses() []string {
+	var addrs []string
+	for _, a := range []string{n.IPAddress, n.IPv6Address} {
+		if a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// Port forward modes. NAT forwards are DNAT rules in the host's packet
+// filter; proxy forwards are relayed by vmmd in userspace, for hosts where
+// another tool owns the packet filter.
+const (
+	ForwardNAT   = "nat"
+	ForwardProxy = "proxy"
+)
+
+// PortForward represents a port forwarding rule. A range of ports is
+// forwarded to the same number of consecutive guest ports starting at
+// GuestPort.
 type PortForward struct {
-	HostPort  int    `json:"host_port"`
-	GuestPort int    `json:"guest_port"`
-	Protocol  string `json:"protocol"` // tcp or udp
+	HostPort    int    `json:"host_port"`
+	HostPortEnd int    `json:"host_port_end,omitempty"` // Last host port of a range; 0 for a single port
+	GuestPort   int    `json:"guest_port"`
+	Protocol    string `json:"protocol"`       // tcp or udp
+	Mode        string `json:"mode,omitempty"` // nat (default) or proxy
+}
+
+// ParsePortForward parses a port forward spec of the form
+// <host-port>:<guest-port>[/<protocol>], where either side may be a range
+// such as 8000-8010. A guest range must be as long as the host range; a
+// single guest port is the start of the guest range. The protocol defaults
+// to tcp.
+func ParsePortForward(spec string) (PortForward, error) {
+	pf := PortForward{Protocol: "tcp"}
+	ports := spec
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		ports, pf.Protocol = spec[:i], spec[i+1:]
+	}
+	host, guest, ok := strings.Cut(ports, ":")
+	if !ok {
+		return pf, fmt.Errorf("invalid port spec '%s', expected format: host-port:guest-port[/tcp|udp]", spec)
+	}
+	var err error
+	if pf.HostPort, pf.HostPortEnd, err = parsePortRange(host); err != nil {
+		return pf, fmt.Errorf("invalid host port '%s' in '%s'", host, spec)
+	}
+	guestPort, guestEnd, err := parsePortRange(guest)
+	if err != nil {
+		return pf, fmt.Errorf("invalid guest port '%s' in '%s'", guest, spec)
+	}
+	pf.GuestPort = guestPort
+	if guestEnd != 0 && guestEnd-guestPort != pf.HostPortEnd-pf.HostPort {
+		return pf, fmt.Errorf("guest port range %s is not the same size as host port range %s", guest, host)
+	}
+	return pf, pf.Validate()
+}
+
+// parsePortRange parses "80" or "8000-8010". end is 0 for a single port.
+func parsePortRange(s string) (start, end int, err error) {
+	first, last, isRange := strings.Cut(s, "-")
+	if start, err = strconv.Atoi(first); err != nil {
+		return 0, 0, err
+	}
+	if isRange {
+		if end, err = strconv.Atoi(last); err != nil {
+			return 0, 0, err
+		}
+	}
+	return start, end, nil
+}
+
+// LastHostPort returns the last host port forwarded.
+func (p PortForward) LastHostPort() int {
+	if p.HostPortEnd == 0 {
+		return p.HostPort
+	}
+	return p.HostPortEnd
+}
+
+// LastGuestPort returns the guest port the last host port is forwarded to.
+func (p PortForward) LastGuestPort() int {
+	return p.GuestPort + p.LastHostPort() - p.HostPort
+}
+
+// Validate checks the protocol and mode, and that every port is in range.
+func (p PortForward) Validate() error {
+	if p.Protocol != "tcp" && p.Protocol != "udp" {
+		return fmt.Errorf("invalid protocol %q: must be tcp or udp", p.Protocol)
+	}
+	if p.HostPort < 1 || p.HostPort > 65535 {
+		return fmt.Errorf("invalid host port %d: must be 1-65535", p.HostPort)
+	}
+	if p.HostPortEnd != 0 && (p.HostPortEnd <= p.HostPort || p.HostPortEnd > 65535) {
+		return fmt.Errorf("invalid host port range %d-%d", p.HostPort, p.HostPortEnd)
+	}
+	if p.GuestPort < 1 || p.LastGuestPort() > 65535 {
+		return fmt.Errorf("invalid guest port %d: must be 1-65535", p.GuestPort)
+	}
+	if p.Mode != "" && p.Mode != ForwardNAT && p.Mode != ForwardProxy {
+		return fmt.Errorf("invalid mode %q: must be nat or proxy", p.Mode)
+	}
+	return nil
+}
+
+// Proxied reports whether the forward is relayed by the userspace proxy
+// rather than DNAT rules.
+func (p PortForward) Proxied() bool {
+	return p.Mode == ForwardProxy
+}
+
+// Overlaps reports whether two port forwards claim a common host port.
+func (p PortForward) Overlaps(o PortForward) bool {
+	return p.Protocol == o.Protocol && p.HostPort <= o.LastHostPort() && o.HostPort <= p.LastHostPort()
+}
+
+// HostPorts describes the host ports, e.g. "8080/tcp" or "8000-8010/udp".
+func (p PortForward) HostPorts() string {
+	return portRange(p.HostPort, p.LastHostPort()) + "/" + p.Protocol
+}
+
+// String renders the port forward as a spec ParsePortForward accepts, e.g.
+// "8080:80/tcp" or "8000-8010:9000-9010/udp".
+func (p PortForward) String() string {
+	return portRange(p.HostPort, p.LastHostPort()) + ":" + portRange(p.GuestPort, p.LastGuestPort()) + "/" + p.Protocol
+}
+
+func portRange(first, last int) string {
+	if first == last {
+		return strconv.Itoa(first)
+	}
+	return fmt.Sprintf("%d-%d", first, last)
 }
 
 // Mount represents a host directory mount configuration
@@ -64,6 +254,314 @@ type Mount struct {
 	ImagePath string `json:"image_path"` // Path to the ext4 image created from host dir
 }
 
+// VolumeAttachment is a persistent volume attached to a VM. The volume
+// itself lives outside the VM's directory and outlasts it.
+type VolumeAttachment struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mount_path"` // Directory the guest mounts it on
+	ReadOnly  bool   `json:"read_only"`
+}
+
+// Firewall directions and actions
+const (
+	FirewallIngress = "ingress" // traffic to the VM
+	FirewallEgress  = "egress"  // traffic from the VM
+	FirewallAllow   = "allow"
+	FirewallDeny    = "deny"
+)
+
+// Firewall is a VM's packet filter policy, applied to each of its interfaces
+// while it runs. Rules are checked in order and the first match decides;
+// traffic no rule matches gets the direction's default.
+type Firewall struct {
+	DefaultIngress string         `json:"default_ingress,omitempty"` // allow or deny (empty = allow)
+	DefaultEgress  string         `json:"default_egress,omitempty"`  // allow or deny (empty = allow)
+	Rules          []FirewallRule `json:"rules,omitempty"`
+}
+
+// FirewallRule allows or denies traffic in one direction
+type FirewallRule struct {
+	Direction string `json:"direction"`          // ingress or egress
+	Action    string `json:"action"`             // allow or deny
+	Protocol  string `json:"protocol,omitempty"` // tcp, udp, icmp or icmpv6 (empty = any)
+	Port      int    `json:"port,omitempty"`     // Destination port, tcp and udp only (0 = any)
+	CIDR      string `json:"cidr,omitempty"`     // Remote IPv4 or IPv6 range (empty = any)
+}
+
+// Validate checks that the rule is complete and consistent.
+func (r FirewallRule) Validate() error {
+	if r.Direction != FirewallIngress && r.Direction != FirewallEgress {
+		return fmt.Errorf("invalid direction %q: must be %s or %s", r.Direction, FirewallIngress, FirewallEgress)
+	}
+	if r.Action != FirewallAllow && r.Action != FirewallDeny {
+		return fmt.Errorf("invalid action %q: must be %s or %s", r.Action, FirewallAllow, FirewallDeny)
+	}
+	switch r.Protocol {
+	case "", "tcp", "udp", "icmp", "icmpv6":
+	default:
+		return fmt.Errorf("invalid protocol %q: must be tcp, udp, icmp or icmpv6", r.Protocol)
+	}
+	if r.Port != 0 {
+		if r.Protocol != "tcp" && r.Protocol != "udp" {
+			return fmt.Errorf("a port requires protocol tcp or udp")
+		}
+		if r.Port < 1 || r.Port > 65535 {
+			return fmt.Errorf("invalid port %d: must be 1-65535", r.Port)
+		}
+	}
+	if r.CIDR != "" {
+		_, ipnet, err := net.ParseCIDR(r.CIDR)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR %q: must be a range such as 10.0.0.0/8 or fd00::/64", r.CIDR)
+		}
+		v4 := ipnet.IP.To4() != nil
+		if (r.Protocol == "icmp" && !v4) || (r.Protocol == "icmpv6" && v4) {
+			return fmt.Errorf("protocol %s cannot be used with %s", r.Protocol, r.CIDR)
+		}
+	}
+	return nil
+}
+
+// String describes the rule, e.g. "ingress allow tcp/22 from 10.0.0.0/8".
+func (r FirewallRule) String() string {
+	s := r.Direction + " " + r.Action
+	switch {
+	case r.Port != 0:
+		s += fmt.Sprintf(" %s/%d", r.Protocol, r.Port)
+	case r.Protocol != "":
+		s += " " + r.Protocol
+	default:
+		s += " all"
+	}
+	if r.CIDR != "" {
+		if r.Direction == FirewallIngress {
+			s += " from " + r.CIDR
+		} else {
+			s += " to " + r.CIDR
+		}
+	}
+	return s
+}
+
+// Validate checks the defaults and every rule.
+func (f *Firewall) Validate() error {
+	for _, d := range []string{f.DefaultIngress, f.DefaultEgress} {
+		if d != "" && d != FirewallAllow && d != FirewallDeny {
+			return fmt.Errorf("invalid default %q: must be %s or %s", d, FirewallAllow, FirewallDeny)
+		}
+	}
+	for i, r := range f.Rules {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Empty reports whether the firewall lets all traffic through, so there is
+// nothing to install.
+func (f *Firewall) Empty() bool {
+	return f == nil || (len(f.Rules) == 0 && f.DefaultIngress != FirewallDeny && f.DefaultEgress != FirewallDeny)
+}
+
+// Summary describes the policy in a few words for listings, e.g.
+// "in:deny out:allow (3 rules)". A VM without a firewall is "-".
+func (f *Firewall) Summary() string {
+	if f.Empty() {
+		return "-"
+	}
+	def := func(d string) string {
+		if d == "" {
+			return FirewallAllow
+		}
+		return d
+	}
+	noun := "rules"
+	if len(f.Rules) == 1 {
+		noun = "rule"
+	}
+	return fmt.Sprintf("in:%s out:%s (%d %s)", def(f.DefaultIngress), def(f.DefaultEgress), len(f.Rules), noun)
+}
+
+// RateLimit caps the throughput of a device. A zero field leaves that
+// dimension unlimited.
+type RateLimit struct {
+	BandwidthMiB int `json:"bandwidth_mib,omitempty"` // MiB per second
+	Ops          int `json:"ops,omitempty"`           // Disk requests or network packets per second
+}
+
+// Empty reports whether the limit leaves the device unlimited.
+func (r RateLimit) Empty() bool {
+	return r.BandwidthMiB == 0 && r.Ops == 0
+}
+
+// String describes the limit, e.g. "50 MiB/s, 1000 ops/s".
+func (r RateLimit) String() string {
+	var parts []string
+	if r.BandwidthMiB > 0 {
+		parts = append(parts, fmt.Sprintf("%d MiB/s", r.BandwidthMiB))
+	}
+	if r.Ops > 0 {
+		parts = append(parts, fmt.Sprintf("%d ops/s", r.Ops))
+	}
+	if len(parts) == 0 {
+		return "unlimited"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// RateLimits are a VM's I/O limits, enforced by Firecracker. The network
+// limit applies to each interface in each direction, and the disk limit to
+// the rootfs and each mount drive separately.
+type RateLimits struct {
+	Net  RateLimit `json:"net"`
+	Disk RateLimit `json:"disk"`
+}
+
+// Validate checks that no limit is negative.
+func (l *RateLimits) Validate() error {
+	for _, d := range []struct {
+		name  string
+		limit RateLimit
+	}{{"network", l.Net}, {"disk", l.Disk}} {
+		if d.limit.BandwidthMiB < 0 {
+			return fmt.Errorf("invalid %s bandwidth %d: must not be negative", d.name, d.limit.BandwidthMiB)
+		}
+		if d.limit.Ops < 0 {
+			return fmt.Errorf("invalid %s ops %d: must not be negative", d.name, d.limit.Ops)
+		}
+	}
+	return nil
+}
+
+// Empty reports whether the limits leave every device unlimited.
+func (l *RateLimits) Empty() bool {
+	return l == nil || (l.Net.Empty() && l.Disk.Empty())
+}
+
+// Summary describes the limits in a few words for listings, e.g.
+// "net 50 MiB/s; disk 1000 ops/s". A VM without limits is "-".
+func (l *RateLimits) Summary() string {
+	if l.Empty() {
+		return "-"
+	}
+	var parts []string
+	if !l.Net.Empty() {
+		parts = append(parts, "net "+l.Net.String())
+	}
+	if !l.Disk.Empty() {
+		parts = append(parts, "disk "+l.Disk.String())
+	}
+	return strings.Join(parts, "; ")
+}
+
+// minSnapshotInterval is the shortest interval between scheduled snapshots.
+const minSnapshotInterval = time.Minute
+
+// SnapshotSchedule has vmmd snapshot a running VM at a fixed interval and
+// prune the scheduled snapshots it no longer needs. KeepHourly keeps the
+// newest scheduled snapshot in each of the last n hours that have one, and
+// KeepDaily and KeepWeekly do the same for days and weeks; the newest is
+// always kept. Snapshots taken by hand are never pruned.
+type SnapshotSchedule struct {
+	Every      string `json:"every"` // interval as a Go duration, e.g. "6h"
+	KeepHourly int    `json:"keep_hourly,omitempty"`
+	KeepDaily  int    `json:"keep_daily,omitempty"`
+	KeepWeekly int    `json:"keep_weekly,omitempty"`
+	DiskOnly   bool   `json:"disk_only,omitempty"` // skip memory, so the guest is only paused while its disks are copied
+
+	// Status of the last run, kept when the schedule is changed
+	LastRun      time.Time `json:"last_run,omitempty"`
+	LastSnapshot string    `json:"last_snapshot,omitempty"` // newest snapshot taken by the schedule
+	LastError    string    `json:"last_error,omitempty"`
+	Failures     int       `json:"failures,omitempty"` // consecutive failed runs
+}
+
+// Validate checks the interval and that something is kept.
+func (s *SnapshotSchedule) Validate() error {
+	d, err := time.ParseDuration(s.Every)
+	if err != nil {
+		return fmt.Errorf("invalid snapshot interval %q: %w", s.Every, err)
+	}
+	if d < minSnapshotInterval {
+		return fmt.Errorf("invalid snapshot interval %q: must be at least %s", s.Every, minSnapshotInterval)
+	}
+	if s.KeepHourly < 0 || s.KeepDaily < 0 || s.KeepWeekly < 0 {
+		return fmt.Errorf("invalid snapshot retention: counts must not be negative")
+	}
+	if s.KeepHourly+s.KeepDaily+s.KeepWeekly == 0 {
+		return fmt.Errorf("invalid snapshot retention: keep at least one hourly, daily or weekly snapshot")
+	}
+	return nil
+}
+
+// Empty reports whether there is no schedule.
+func (s *SnapshotSchedule) Empty() bool {
+	return s == nil || s.Every == ""
+}
+
+// Interval returns the time between snapshots, or zero for an invalid
+// schedule.
+func (s *SnapshotSchedule) Interval() time.Duration {
+	d, err := time.ParseDuration(s.Every)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// Summary describes the schedule in a few words for listings, e.g.
+// "every 6h, keep 4 hourly, 7 daily". A VM without a schedule is "-".
+func (s *SnapshotSchedule) Summary() string {
+	if s.Empty() {
+		return "-"
+	}
+	parts := []string{"every " + s.Every}
+	var keep []string
+	for _, k := range []struct {
+		n    int
+		unit string
+	}{{s.KeepHourly, "hourly"}, {s.KeepDaily, "daily"}, {s.KeepWeekly, "weekly"}} {
+		if k.n > 0 {
+			keep = append(keep, fmt.Sprintf("%d %s", k.n, k.unit))
+		}
+	}
+	if len(keep) > 0 {
+		parts = append(parts, "keep "+strings.Join(keep, ", "))
+	}
+	if s.DiskOnly {
+		parts = append(parts, "disk only")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ValidateBalloon checks that a balloon target leaves the guest some memory.
+func (v *VM) ValidateBalloon(targetMB int) error {
+	if targetMB < 0 {
+		return fmt.Errorf("invalid balloon size %d MB: must not be negative", targetMB)
+	}
+	if targetMB >= v.MemoryMB {
+		return fmt.Errorf("invalid balloon size %d MB: must be less than the VM's %d MB of memory", targetMB, v.MemoryMB)
+	}
+	return nil
+}
+
+// BalloonStats are a running VM's balloon size and the guest memory
+// statistics its balloon driver reports. The memory fields are in bytes and
+// are zero until the guest has reported once.
+type BalloonStats struct {
+	TargetMB        int   `json:"target_mb"`
+	ActualMB        int   `json:"actual_mb"`
+	TotalMemory     int64 `json:"total_memory,omitempty"`
+	FreeMemory      int64 `json:"free_memory,omitempty"`
+	AvailableMemory int64 `json:"available_memory,omitempty"`
+	DiskCaches      int64 `json:"disk_caches,omitempty"`
+	MajorFaults     int64 `json:"major_faults,omitempty"`
+	MinorFaults     int64 `json:"minor_faults,omitempty"`
+	SwapIn          int64 `json:"swap_in,omitempty"`
+	SwapOut         int64 `json:"swap_out,omitempty"`
+}
+
 // NewVM creates a new VM with default settings
 func NewVM(name string) *VM {
 	id := uuid.New().String()[:8]
@@ -79,11 +577,46 @@ func NewVM(name string) *VM {
 	}
 }
 
+// VsockPath returns the unix socket backing the VM's vsock device, through
+// which the host reaches the guest agent. It sits next to the API socket.
+func (v *VM) VsockPath() string {
+	return strings.TrimSuffix(v.SocketPath, ".sock") + ".vsock"
+}
+
+// ConsolePath returns the named pipe the VM's serial console reads its input
+// from. It sits next to the API socket.
+func (v *VM) ConsolePath() string {
+	return strings.TrimSuffix(v.SocketPath, ".sock") + ".console"
+}
+
 // GenerateMacAddress generates a MAC address based on the VM ID
 func (v *VM) GenerateMacAddress() string {
-	// Use AA:FC prefix (Firecracker convention) + parts of UUID
-	return fmt.Sprintf("AA:FC:00:%02X:%02X:%02X",
-		v.ID[0], v.ID[1], v.ID[2])
+	return v.GenerateNICMacAddress(0)
+}
+
+// GenerateNICMacAddress generates the MAC address of the VM's index'th
+// interface. The primary interface (index 0) gets the same address as
+// GenerateMacAddress.
+func (v *VM) GenerateNICMacAddress(index int) string {
+	// Use AA:FC prefix (Firecracker convention) + interface index + parts of UUID
+	return fmt.Sprintf("AA:FC:%02X:%02X:%02X:%02X",
+		index, v.ID[0], v.ID[1], v.ID[2])
+}
+
+// Interfaces returns the VM's network interfaces in guest order: the primary
+// interface first, then NICs. The returned pointers refer to the VM itself,
+// so changes made through them are saved with the VM.
+func (v *VM) Interfaces() []*NIC {
+	nics := []*NIC{&v.NIC}
+	for i := range v.NICs {
+		nics = append(nics, &v.NICs[i])
+	}
+	return nics
+}
+
+// InterfaceName returns the guest device name of the index'th interface.
+func InterfaceName(index int) string {
+	return fmt.Sprintf("eth%d", index)
 }
 
 // Save persists the VM configuration to disk
@@ -172,6 +705,62 @@ func List(vmDir string) ([]*VM, error) {
 	return vms, nil
 }
 
+// BaseImageUsers returns the names of the VMs in vmDir whose rootfs is an
+// overlay of the image at path, which must be kept until their disks are
+// flattened.
+func BaseImageUsers(vmDir, path string) ([]string, error) {
+	vms, err := List(vmDir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, v := range vms {
+		if v.BaseImage != "" && filepath.Clean(v.BaseImage) == filepath.Clean(path) {
+			names = append(names, v.Name)
+		}
+	}
+	return names, nil
+}
+
+// VolumeUser returns the name of the VM in vmDir the named volume is
+// attached to, or "" if it is not attached.
+func VolumeUser(vmDir, volume string) (string, error) {
+	vms, err := List(vmDir)
+	if err != nil {
+		return "", err
+	}
+	for _, v := range vms {
+		if v.Volume(volume) != nil {
+			return v.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// Volume returns the VM's attachment of the named volume, or nil.
+func (v *VM) Volume(name string) *VolumeAttachment {
+	for i := range v.Volumes {
+		if v.Volumes[i].Name == name {
+			return &v.Volumes[i]
+		}
+	}
+	return nil
+}
+
+// CheckBaseImageUnused returns an error naming the VMs in vmDir whose rootfs
+// is an overlay of the image at path, so it is not deleted or replaced
+// under them.
+func CheckBaseImageUnused(vmDir, path string) error {
+	users, err := BaseImageUsers(vmDir, path)
+	if err != nil {
+		return fmt.Errorf("failed to list VMs: %w", err)
+	}
+	if len(users) > 0 {
+		return fmt.Errorf("image is the base image of VM(s) %s; flatten their disks first", strings.Join(users, ", "))
+	}
+	return nil
+}
+
 // Exists checks if a VM with the given name exists
 func Exists(vmDir, name string) bool {
 	path := filepath.Join(vmDir, name+".json")
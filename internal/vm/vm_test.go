@@ -1,6 +1,8 @@
 package vm
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
 )
 
@@ -58,6 +60,74 @@ func TestGenerateMacAddress_Deterministic(t *testing.T) {
 	}
 }
 
+func TestGenerateNICMacAddress(t *testing.T) {
+	v := &VM{ID: "abcdef12"}
+
+	if got := v.GenerateNICMacAddress(0); got != v.GenerateMacAddress() {
+		t.Errorf("GenerateNICMacAddress(0) = %q, want the primary MAC %q", got, v.GenerateMacAddress())
+	}
+	if got := v.GenerateNICMacAddress(2); got != "AA:FC:02:61:62:63" {
+		t.Errorf("GenerateNICMacAddress(2) = %q, want AA:FC:02:61:62:63", got)
+	}
+}
+
+func TestInterfaces(t *testing.T) {
+	v := NewVM("router")
+	v.TapDevice = "vmm-abc"
+	v.NICs = []NIC{{Network: "lab", TapDevice: "vmm-abc-1"}}
+
+	nics := v.Interfaces()
+	if len(nics) != 2 || nics[0].TapDevice != "vmm-abc" || nics[1].Network != "lab" {
+		t.Fatalf("Interfaces() = %+v, want the primary interface then lab", nics)
+	}
+
+	// Changes through the returned pointers land on the VM
+	nics[0].IPAddress = "172.16.0.2"
+	nics[1].IPAddress = "10.66.0.2"
+	if v.IPAddress != "172.16.0.2" || v.NICs[0].IPAddress != "10.66.0.2" {
+		t.Errorf("addresses not set on the VM: %q, %q", v.IPAddress, v.NICs[0].IPAddress)
+	}
+	if InterfaceName(1) != "eth1" {
+		t.Errorf("InterfaceName(1) = %q, want eth1", InterfaceName(1))
+	}
+}
+
+func TestNICAddresses(t *testing.T) {
+	tests := []struct {
+		name string
+		nic  NIC
+		want []string
+	}{
+		{"none", NIC{}, nil},
+		{"IPv4 only", NIC{IPAddress: "172.16.0.2"}, []string{"172.16.0.2"}},
+		{"dual-stack", NIC{IPAddress: "172.16.0.2", IPv6Address: "fd00::ac10:2"}, []string{"172.16.0.2", "fd00::ac10:2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.nic.Addresses()
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Addresses() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrimaryInterfaceJSON(t *testing.T) {
+	// State files written before NICs existed keep loading unchanged
+	data := []byte(`{"name":"web","network":"lab","ip_address":"10.66.0.5","tap_device":"vmm-abc","mac_address":"AA:FC:00:01:02:03"}`)
+	var v VM
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("Unmarshal error: %v", err)
+	}
+	if v.Network != "lab" || v.IPAddress != "10.66.0.5" || v.TapDevice != "vmm-abc" || v.MacAddress != "AA:FC:00:01:02:03" {
+		t.Errorf("primary interface = %+v", v.NIC)
+	}
+	if len(v.NICs) != 0 {
+		t.Errorf("NICs = %+v, want none", v.NICs)
+	}
+}
+
 func TestNewVM_UniqueIDs(t *testing.T) {
 	ids := make(map[string]bool)
 	for i := 0; i < 100; i++ {
@@ -135,3 +205,348 @@ func TestList(t *testing.T) {
 		t.Errorf("expected 2 VMs, got %d", len(vms))
 	}
 }
+
+func TestBaseImageUsers(t *testing.T) {
+	dir := t.TempDir()
+	for name, base := range map[string]string{
+		"thin-a": "/var/lib/vmm/rootfs/web.ext4",
+		"thin-b": "/var/lib/vmm/rootfs/./web.ext4",
+		"other":  "/var/lib/vmm/rootfs/db.ext4",
+		"thick":  "",
+	} {
+		v := NewVM(name)
+		v.BaseImage = base
+		if err := v.Save(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	users, err := BaseImageUsers(dir, "/var/lib/vmm/rootfs/web.ext4")
+	if err != nil {
+		t.Fatalf("BaseImageUsers: %v", err)
+	}
+	if len(users) != 2 || users[0] != "thin-a" || users[1] != "thin-b" {
+		t.Errorf("users = %v, want [thin-a thin-b]", users)
+	}
+	if users, _ := BaseImageUsers(dir, "/var/lib/vmm/rootfs/unused.ext4"); len(users) != 0 {
+		t.Errorf("users of an unused image = %v", users)
+	}
+
+	if err := CheckBaseImageUnused(dir, "/var/lib/vmm/rootfs/web.ext4"); err == nil || !strings.Contains(err.Error(), "thin-a, thin-b") {
+		t.Errorf("CheckBaseImageUnused = %v, want an error naming thin-a and thin-b", err)
+	}
+	if err := CheckBaseImageUnused(dir, "/var/lib/vmm/rootfs/db.ext4.old"); err != nil {
+		t.Errorf("CheckBaseImageUnused of an unused image: %v", err)
+	}
+}
+
+func TestVolumeUser(t *testing.T) {
+	dir := t.TempDir()
+	v := NewVM("web")
+	v.Volumes = []VolumeAttachment{{Name: "db", MountPath: "/mnt/db"}, {Name: "logs", MountPath: "/var/log"}}
+	if err := v.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewVM("api").Save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for volume, want := range map[string]string{"db": "web", "logs": "web", "free": ""} {
+		if got, err := VolumeUser(dir, volume); err != nil || got != want {
+			t.Errorf("VolumeUser(%s) = %q, %v, want %q", volume, got, err, want)
+		}
+	}
+	if att := v.Volume("logs"); att == nil || att.MountPath != "/var/log" {
+		t.Errorf("Volume(logs) = %+v", att)
+	}
+	if att := v.Volume("free"); att != nil {
+		t.Errorf("Volume(free) = %+v, want nil", att)
+	}
+}
+
+func TestFirewallRuleValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    FirewallRule
+		wantErr bool
+	}{
+		{"allow ssh", FirewallRule{Direction: FirewallIngress, Action: FirewallAllow, Protocol: "tcp", Port: 22}, false},
+		{"deny range", FirewallRule{Direction: FirewallEgress, Action: FirewallDeny, CIDR: "10.0.0.0/8"}, false},
+		{"icmp", FirewallRule{Direction: FirewallIngress, Action: FirewallAllow, Protocol: "icmp"}, false},
+		{"bad direction", FirewallRule{Direction: "inbound", Action: FirewallAllow}, true},
+		{"bad action", FirewallRule{Direction: FirewallIngress, Action: "reject"}, true},
+		{"bad protocol", FirewallRule{Direction: FirewallIngress, Action: FirewallAllow, Protocol: "sctp"}, true},
+		{"port without protocol", FirewallRule{Direction: FirewallIngress, Action: FirewallAllow, Port: 22}, true},
+		{"port on icmp", FirewallRule{Direction: FirewallIngress, Action: FirewallAllow, Protocol: "icmp", Port: 1}, true},
+		{"port out of range", FirewallRule{Direction: FirewallIngress, Action: FirewallAllow, Protocol: "udp", Port: 70000}, true},
+		{"bad CIDR", FirewallRule{Direction: FirewallIngress, Action: FirewallAllow, CIDR: "10.0.0.0"}, true},
+		{"IPv6 CIDR", FirewallRule{Direction: FirewallIngress, Action: FirewallAllow, CIDR: "fd00::/8"}, false},
+		{"icmpv6", FirewallRule{Direction: FirewallIngress, Action: FirewallAllow, Protocol: "icmpv6", CIDR: "fd00::/8"}, false},
+		{"icmp with IPv6 CIDR", FirewallRule{Direction: FirewallIngress, Action: FirewallAllow, Protocol: "icmp", CIDR: "fd00::/8"}, true},
+		{"icmpv6 with IPv4 CIDR", FirewallRule{Direction: FirewallEgress, Action: FirewallDeny, Protocol: "icmpv6", CIDR: "10.0.0.0/8"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFirewallRuleString(t *testing.T) {
+	tests := []struct {
+		rule FirewallRule
+		want string
+	}{
+		{FirewallRule{Direction: FirewallIngress, Action: FirewallAllow, Protocol: "tcp", Port: 22, CIDR: "10.0.0.0/8"}, "ingress allow tcp/22 from 10.0.0.0/8"},
+		{FirewallRule{Direction: FirewallEgress, Action: FirewallDeny, CIDR: "172.16.0.0/16"}, "egress deny all to 172.16.0.0/16"},
+		{FirewallRule{Direction: FirewallIngress, Action: FirewallAllow, Protocol: "icmp"}, "ingress allow icmp"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.rule.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestFirewallSummary(t *testing.T) {
+	tests := []struct {
+		name string
+		fw   *Firewall
+		want string
+	}{
+		{"none", nil, "-"},
+		{"allow everything", &Firewall{DefaultEgress: FirewallAllow}, "-"},
+		{"default deny", &Firewall{DefaultIngress: FirewallDeny}, "in:deny out:allow (0 rules)"},
+		{"one rule", &Firewall{Rules: []FirewallRule{{Direction: FirewallEgress, Action: FirewallDeny}}}, "in:allow out:allow (1 rule)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.fw.Summary(); got != tt.want {
+				t.Errorf("Summary() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirewallValidate(t *testing.T) {
+	if err := (&Firewall{DefaultIngress: "block"}).Validate(); err == nil {
+		t.Error("Validate() accepted an invalid default")
+	}
+	fw := &Firewall{Rules: []FirewallRule{
+		{Direction: FirewallIngress, Action: FirewallAllow},
+		{Direction: FirewallIngress, Action: "maybe"},
+	}}
+	err := fw.Validate()
+	if err == nil || !strings.Contains(err.Error(), "rule 2") {
+		t.Errorf("Validate() error = %v, want it to name rule 2", err)
+	}
+}
+
+func TestRateLimitsSummary(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits *RateLimits
+		want   string
+	}{
+		{"none", nil, "-"},
+		{"unlimited", &RateLimits{}, "-"},
+		{"network bandwidth", &RateLimits{Net: RateLimit{BandwidthMiB: 50}}, "net 50 MiB/s"},
+		{"both", &RateLimits{Net: RateLimit{Ops: 2000}, Disk: RateLimit{BandwidthMiB: 100, Ops: 500}}, "net 2000 ops/s; disk 100 MiB/s, 500 ops/s"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.limits.Summary(); got != tt.want {
+				t.Errorf("Summary() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitsValidate(t *testing.T) {
+	if err := (&RateLimits{Net: RateLimit{BandwidthMiB: 10}, Disk: RateLimit{Ops: 100}}).Validate(); err != nil {
+		t.Errorf("Validate() error: %v", err)
+	}
+	err := (&RateLimits{Disk: RateLimit{Ops: -1}}).Validate()
+	if err == nil || !strings.Contains(err.Error(), "disk ops") {
+		t.Errorf("Validate() error = %v, want a disk ops error", err)
+	}
+}
+
+func TestSnapshotSchedule(t *testing.T) {
+	tests := []struct {
+		name        string
+		sched       *SnapshotSchedule
+		wantSummary string
+		wantErr     string
+	}{
+		{"none", nil, "-", ""},
+		{"hourly and daily", &SnapshotSchedule{Every: "6h", KeepHourly: 4, KeepDaily: 7}, "every 6h, keep 4 hourly, 7 daily", ""},
+		{"disk only", &SnapshotSchedule{Every: "30m", KeepWeekly: 2, DiskOnly: true}, "every 30m, keep 2 weekly, disk only", ""},
+		{"bad interval", &SnapshotSchedule{Every: "often", KeepDaily: 1}, "", "invalid snapshot interval"},
+		{"too frequent", &SnapshotSchedule{Every: "30s", KeepDaily: 1}, "", "at least 1m0s"},
+		{"keeps nothing", &SnapshotSchedule{Every: "1h"}, "", "keep at least one"},
+		{"negative count", &SnapshotSchedule{Every: "1h", KeepDaily: -1}, "", "must not be negative"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantErr != "" {
+				err := tt.sched.Validate()
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Validate() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if !tt.sched.Empty() {
+				if err := tt.sched.Validate(); err != nil {
+					t.Errorf("Validate() error: %v", err)
+				}
+			}
+			if got := tt.sched.Summary(); got != tt.wantSummary {
+				t.Errorf("Summary() = %q, want %q", got, tt.wantSummary)
+			}
+		})
+	}
+}
+
+func TestParsePortForward(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    PortForward
+		wantErr string
+	}{
+		{spec: "8080:80", want: PortForward{HostPort: 8080, GuestPort: 80, Protocol: "tcp"}},
+		{spec: "5353:53/udp", want: PortForward{HostPort: 5353, GuestPort: 53, Protocol: "udp"}},
+		{spec: "8000-8010:8000-8010", want: PortForward{HostPort: 8000, HostPortEnd: 8010, GuestPort: 8000, Protocol: "tcp"}},
+		{spec: "8000-8010:9000/udp", want: PortForward{HostPort: 8000, HostPortEnd: 8010, GuestPort: 9000, Protocol: "udp"}},
+		{spec: "8080", wantErr: "expected format"},
+		{spec: "http:80", wantErr: "invalid host port"},
+		{spec: "8080:80/sctp", wantErr: "invalid protocol"},
+		{spec: "0:80", wantErr: "invalid host port 0"},
+		{spec: "8010-8000:80", wantErr: "invalid host port range"},
+		{spec: "8000-8010:9000-9005", wantErr: "not the same size"},
+		{spec: "8000-8010:65530", wantErr: "invalid guest port"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParsePortForward(tt.spec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("ParsePortForward(%q) error = %v, want %q", tt.spec, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePortForward(%q) error: %v", tt.spec, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParsePortForward(%q) = %+v, want %+v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPortForwardString(t *testing.T) {
+	for spec, want := range map[string]string{
+		"8080:80":             "8080:80/tcp",
+		"8000-8010:9000/udp":  "8000-8010:9000-9010/udp",
+		"8000-8010:8000-8010": "8000-8010:8000-8010/tcp",
+	} {
+		pf, err := ParsePortForward(spec)
+		if err != nil {
+			t.Fatalf("ParsePortForward(%q) error: %v", spec, err)
+		}
+		if got := pf.String(); got != want {
+			t.Errorf("String() of %q = %q, want %q", spec, got, want)
+		}
+	}
+}
+
+func TestPortForwardOverlaps(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"8080:80", "8080:8080", true},
+		{"8080:80", "8080:80/udp", false},
+		{"8000-8010:80", "8010:80", true},
+		{"8000-8010:80", "8011-8020:80", false},
+		{"8005:80", "8000-8010:80", true},
+	}
+	for _, tt := range tests {
+		a, _ := ParsePortForward(tt.a)
+		b, _ := ParsePortForward(tt.b)
+		if got := a.Overlaps(b); got != tt.want {
+			t.Errorf("%s Overlaps %s = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestPortForwardMode(t *testing.T) {
+	tests := []struct {
+		mode        string
+		wantProxied bool
+		wantErr     bool
+	}{
+		{mode: ""},
+		{mode: ForwardNAT},
+		{mode: ForwardProxy, wantProxied: true},
+		{mode: "socks", wantErr: true},
+	}
+	for _, tt := range tests {
+		pf := PortForward{HostPort: 8080, GuestPort: 80, Protocol: "tcp", Mode: tt.mode}
+		if err := pf.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Validate() with mode %q error = %v, want error: %v", tt.mode, err, tt.wantErr)
+		}
+		if got := pf.Proxied(); got != tt.wantProxied {
+			t.Errorf("Proxied() with mode %q = %v, want %v", tt.mode, got, tt.wantProxied)
+		}
+	}
+}
+
+func TestValidateBalloon(t *testing.T) {
+	v := NewVM("web")
+	v.MemoryMB = 1024
+	tests := []struct {
+		targetMB int
+		wantErr  bool
+	}{
+		{0, false},
+		{512, false},
+		{1023, false},
+		{1024, true},
+		{-1, true},
+	}
+	for _, tt := range tests {
+		if err := v.ValidateBalloon(tt.targetMB); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateBalloon(%d) error = %v, want error: %v", tt.targetMB, err, tt.wantErr)
+		}
+	}
+}
+
+func TestStateActive(t *testing.T) {
+	tests := []struct {
+		state State
+		want  bool
+	}{
+		{StateRunning, true},
+		{StatePaused, true},
+		{StateStarting, false},
+		{StateStopping, false},
+		{StateStopped, false},
+		{StateCreated, false},
+		{StateError, false},
+	}
+	for _, tt := range tests {
+		if got := tt.state.Active(); got != tt.want {
+			t.Errorf("%s.Active() = %v, want %v", tt.state, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package volume
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrVolumeNotFound is returned when a named volume does not exist.
+var ErrVolumeNotFound = errors.New("volume not found")
+
+// Volume is a persistent ext4 disk that can be attached to one VM at a time.
+// It is stored apart from the VMs, so it keeps its data when the VM using it
+// is deleted.
+type Volume struct {
+	Name      string    `json:"name"`
+	SizeMB    int       `json:"size_mb"`
+	UUID      string    `json:"uuid"` // Filesystem UUID, which guests mount it by
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Manager stores volumes in a directory: an image and a JSON description
+// for each.
+type Manager struct {
+	Dir string
+}
+
+// NewManager creates a new volume manager
+func NewManager(dir string) *Manager {
+	return &Manager{Dir: dir}
+}
+
+// ImagePath returns the path of a volume's disk image.
+func (m *Manager) ImagePath(name string) string {
+	return filepath.Join(m.Dir, name+".ext4")
+}
+
+func (m *Manager) path(name string) string {
+	return filepath.Join(m.Dir, name+".json")
+}
+
+// Exists checks if a volume with the given name exists
+func (m *Manager) Exists(name string) bool {
+	_, err := os.Stat(m.path(name))
+	return err == nil
+}
+
+// Create makes a new volume of sizeMB with an empty ext4 filesystem. The
+// image is sparse, so it only takes up the space the guest writes.
+func (m *Manager) Create(name string, sizeMB int) (*Volume, error) {
+	if m.Exists(name) {
+		return nil, fmt.Errorf("volume '%s' already exists", name)
+	}
+	if err := os.MkdirAll(m.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create volumes directory: %w", err)
+	}
+
+	v := &Volume{
+		Name:      name,
+		SizeMB:    sizeMB,
+		UUID:      uuid.New().String(),
+		CreatedAt: time.Now(),
+	}
+	imagePath := m.ImagePath(name)
+	f, err := os.OpenFile(imagePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create volume image: %w", err)
+	}
+	err = f.Truncate(int64(sizeMB) * 1024 * 1024)
+	f.Close()
+	if err != nil {
+		os.Remove(imagePath)
+		return nil, fmt.Errorf("failed to create volume image: %w", err)
+	}
+	if output, err := exec.Command("mkfs.ext4", "-F", "-q", "-U", v.UUID, imagePath).CombinedOutput(); err != nil {
+		os.Remove(imagePath)
+		return nil, fmt.Errorf("failed to create ext4 filesystem: %w: %s", err, string(output))
+	}
+	if err := m.save(v); err != nil {
+		os.Remove(imagePath)
+		return nil, err
+	}
+	return v, nil
+}
+
+// Get returns the named volume.
+func (m *Manager) Get(name string) (*Volume, error) {
+	data, err := os.ReadFile(m.path(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: '%s'", ErrVolumeNotFound, name)
+		}
+		return nil, fmt.Errorf("failed to read volume config: %w", err)
+	}
+	var v Volume
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal volume config: %w", err)
+	}
+	return &v, nil
+}
+
+// List returns all volumes sorted by name.
+func (m *Manager) List() ([]*Volume, error) {
+	entries, err := os.ReadDir(m.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*Volume{}, nil
+		}
+		return nil, err
+	}
+	volumes := []*Volume{}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		v, err := m.Get(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			continue // Skip invalid configs
+		}
+		volumes = append(volumes, v)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Name < volumes[j].Name })
+	return volumes, nil
+}
+
+// Delete removes a volume and its data. The caller must check it is not
+// attached to a VM.
+func (m *Manager) Delete(name string) error {
+	if !m.Exists(name) {
+		return fmt.Errorf("%w: '%s'", ErrVolumeNotFound, name)
+	}
+	if err := os.Remove(m.ImagePath(name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete volume image: %w", err)
+	}
+	if err := os.Remove(m.path(name)); err != nil {
+		return fmt.Errorf("failed to delete volume config: %w", err)
+	}
+	return nil
+}
+
+// Resize grows a volume and its filesystem to sizeMB. Volumes cannot shrink.
+// The VM it is attached to, if any, must be stopped.
+func (m *Manager) Resize(name string, sizeMB int) (*Volume, error) {
+	v, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if sizeMB < v.SizeMB {
+		return nil, fmt.Errorf("volume '%s' is %d MB and cannot be shrunk to %d MB", name, v.SizeMB, sizeMB)
+	}
+	if sizeMB == v.SizeMB {
+		return v, nil
+	}
+
+	imagePath := m.ImagePath(name)
+	if err := os.Truncate(imagePath, int64(sizeMB)*1024*1024); err != nil {
+		return nil, fmt.Errorf("failed to resize volume image: %w", err)
+	}
+	fsckCmd := exec.Command("e2fsck", "-f", "-y", imagePath)
+	if output, err := fsckCmd.CombinedOutput(); err != nil {
+		// e2fsck returns 1 if it fixed errors, which is fine
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() > 1 {
+			return nil, fmt.Errorf("filesystem check failed: %w: %s", err, string(output))
+		}
+	}
+	if output, err := exec.Command("resize2fs", imagePath).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to resize filesystem: %w: %s", err, string(output))
+	}
+
+	v.SizeMB = sizeMB
+	if err := m.save(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (m *Manager) save(v *Volume) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal volume config: %w", err)
+	}
+
+	tmpFile, err := os.CreateTemp(m.Dir, ".volume-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write volume config: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+	if err := os.Rename(tmpPath, m.path(v.Name)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+	return nil
+}
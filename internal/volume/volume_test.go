@@ -0,0 +1,81 @@
+package volume
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestCreateResizeDelete(t *testing.T) {
+	for _, tool := range []string{"mkfs.ext4", "e2fsck", "resize2fs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+	m := NewManager(t.TempDir())
+
+	v, err := m.Create("data", 64)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if v.UUID == "" || v.SizeMB != 64 {
+		t.Errorf("Create = %+v", v)
+	}
+	if _, err := m.Create("data", 64); err == nil {
+		t.Error("Create should refuse an existing volume")
+	}
+	info, err := os.Stat(m.ImagePath("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 64*1024*1024 {
+		t.Errorf("image size = %d, want 64 MB", info.Size())
+	}
+
+	if _, err := m.Resize("data", 32); err == nil {
+		t.Error("Resize should refuse to shrink a volume")
+	}
+	if v, err = m.Resize("data", 128); err != nil {
+		t.Fatalf("Resize: %v", err)
+	}
+	if got, _ := m.Get("data"); got.SizeMB != 128 || got.UUID != v.UUID {
+		t.Errorf("after Resize Get = %+v, want 128 MB with UUID %s", got, v.UUID)
+	}
+	if info, _ := os.Stat(m.ImagePath("data")); info.Size() != 128*1024*1024 {
+		t.Errorf("image size after Resize = %d, want 128 MB", info.Size())
+	}
+
+	if err := m.Delete("data"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := os.Stat(m.ImagePath("data")); !os.IsNotExist(err) {
+		t.Errorf("image left behind: %v", err)
+	}
+	if _, err := m.Get("data"); !errors.Is(err, ErrVolumeNotFound) {
+		t.Errorf("Get after Delete = %v, want ErrVolumeNotFound", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	m := NewManager(t.TempDir())
+	if volumes, err := m.List(); err != nil || len(volumes) != 0 {
+		t.Fatalf("List of an empty directory = %v, %v", volumes, err)
+	}
+	for _, name := range []string{"cache", "db"} {
+		if err := m.save(&Volume{Name: name, SizeMB: 64}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Stray files are skipped
+	if err := os.WriteFile(m.path("broken"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	volumes, err := m.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(volumes) != 2 || volumes[0].Name != "cache" || volumes[1].Name != "db" {
+		t.Errorf("List = %v, want cache and db", volumes)
+	}
+}
@@ -1,8 +1,8 @@
 package web
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -13,7 +13,7 @@ import (
 	"github.com/go-chi/chi/v5"
 
 	"github.com/raesene/baremetalvmm/internal/cluster"
-	"github.com/raesene/baremetalvmm/internal/firecracker"
+	"github.com/raesene/baremetalvmm/internal/daemon"
 	"github.com/raesene/baremetalvmm/internal/image"
 	"github.com/raesene/baremetalvmm/internal/network"
 	"github.com/raesene/baremetalvmm/internal/sshkey"
@@ -277,7 +277,7 @@ func (s *Server) handleClusterCreate(w http.ResponseWriter, r *http.Request) {
 		newVM.SSHPublicKey = sshKey
 		newVM.SocketPath = fmt.Sprintf("%s/%s.sock", paths.Sockets, vmName)
 
-		if err := newVM.Save(paths.VMs); err != nil {
+		if _, err := s.backend().Create(newVM); err != nil {
 			cl.State = cluster.StateError
 			cl.Save(paths.Clusters)
 			s.renderPage(w, r, "cluster_create.html", "clusters", map[string]interface{}{
@@ -306,10 +306,11 @@ func (s *Server) provisionClusterInBackground(clusterName string) {
 
 	// Start all VMs sequentially
 	log.Printf("cluster %s: starting VMs...", clusterName)
+	backend := s.backend()
 	var nodeInfos []cluster.NodeInfo
 	var adminIP string
 	for _, vmName := range cl.AllVMs() {
-		existingVM, err := vm.Load(paths.VMs, vmName)
+		existingVM, err := backend.Get(vmName)
 		if err != nil {
 			log.Printf("cluster %s: failed to load VM %s: %v", clusterName, vmName, err)
 			cl.SetError(fmt.Sprintf("failed to load VM %s: %v", vmName, err))
@@ -317,8 +318,6 @@ func (s *Server) provisionClusterInBackground(clusterName string) {
 			return
 		}
 
-		fcClient := firecracker.NewClient()
-		fcClient.UpdateVMState(existingVM)
 		if existingVM.State == vm.StateRunning {
 			if vmName == cl.AdminVM {
 				adminIP = existingVM.IPAddress
@@ -328,7 +327,8 @@ func (s *Server) provisionClusterInBackground(clusterName string) {
 			continue
 		}
 
-		if err := s.startVM(existingVM); err != nil {
+		existingVM, err = backend.Start(vmName)
+		if err != nil {
 			log.Printf("cluster %s: failed to start VM %s: %v", clusterName, vmName, err)
 			cl.SetError(fmt.Sprintf("failed to start VM %s: %v", vmName, err))
 			cl.Save(paths.Clusters)
@@ -420,38 +420,14 @@ func (s *Server) deleteCluster(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fcClient := firecracker.NewClient()
-	netMgr := network.NewManager(s.cfg.BridgeName, s.cfg.Subnet, s.cfg.Gateway, s.cfg.HostInterface)
-	imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
-
-	// Delete all VMs in the cluster
+	backend := s.backend()
 	var stopFailures []string
 	for _, vmName := range cl.AllVMs() {
-		existingVM, err := vm.Load(paths.VMs, vmName)
-		if err != nil {
-			continue
-		}
-
-		fcClient.UpdateVMState(existingVM)
-		if existingVM.State == vm.StateRunning {
-			ctx := context.Background()
-			// Keep the VM record if the process survives, so it is not orphaned
-			if err := fcClient.Terminate(ctx, existingVM); err != nil {
-				existingVM.State = vm.StateError
-				if saveErr := existingVM.Save(paths.VMs); saveErr != nil {
-					log.Printf("failed to save state for VM %s: %v", vmName, saveErr)
-				}
-				stopFailures = append(stopFailures, vmName)
-				continue
-			}
-		}
-
-		if existingVM.TapDevice != "" && netMgr.TapExists(existingVM.TapDevice) {
-			netMgr.DeleteTap(existingVM.TapDevice)
+		// Keep the VM record if the process survives, so it is not orphaned
+		if err := backend.Delete(vmName, true); err != nil && !errors.Is(err, daemon.ErrNotFound) {
+			log.Printf("failed to delete VM %s: %v", vmName, err)
+			stopFailures = append(stopFailures, vmName)
 		}
-		imgMgr.DeleteVMRootfs(vmName, paths.VMs)
-		os.Remove(existingVM.SocketPath)
-		vm.Delete(paths.VMs, vmName)
 	}
 
 	if len(stopFailures) > 0 {
@@ -669,7 +645,7 @@ func (s *Server) handleAPIClusterCreate(w http.ResponseWriter, r *http.Request)
 		newVM.SSHPublicKey = req.SSHKey
 		newVM.SocketPath = fmt.Sprintf("%s/%s.sock", paths.Sockets, vmName)
 
-		if err := newVM.Save(paths.VMs); err != nil {
+		if _, err := s.backend().Create(newVM); err != nil {
 			cl.State = cluster.StateError
 			cl.Save(paths.Clusters)
 			jsonError(w, fmt.Sprintf("Failed to create VM '%s': %s", vmName, err.Error()), http.StatusInternalServerError)
@@ -697,37 +673,14 @@ func (s *Server) handleAPIClusterDelete(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	fcClient := firecracker.NewClient()
-	netMgr := network.NewManager(s.cfg.BridgeName, s.cfg.Subnet, s.cfg.Gateway, s.cfg.HostInterface)
-	imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
-
+	backend := s.backend()
 	var stopFailures []string
 	for _, vmName := range cl.AllVMs() {
-		existingVM, err := vm.Load(paths.VMs, vmName)
-		if err != nil {
-			continue
-		}
-
-		fcClient.UpdateVMState(existingVM)
-		if existingVM.State == vm.StateRunning {
-			ctx := context.Background()
-			// Keep the VM record if the process survives, so it is not orphaned
-			if err := fcClient.Terminate(ctx, existingVM); err != nil {
-				existingVM.State = vm.StateError
-				if saveErr := existingVM.Save(paths.VMs); saveErr != nil {
-					log.Printf("failed to save state for VM %s: %v", vmName, saveErr)
-				}
-				stopFailures = append(stopFailures, vmName)
-				continue
-			}
-		}
-
-		if existingVM.TapDevice != "" && netMgr.TapExists(existingVM.TapDevice) {
-			netMgr.DeleteTap(existingVM.TapDevice)
+		// Keep the VM record if the process survives, so it is not orphaned
+		if err := backend.Delete(vmName, true); err != nil && !errors.Is(err, daemon.ErrNotFound) {
+			log.Printf("failed to delete VM %s: %v", vmName, err)
+			stopFailures = append(stopFailures, vmName)
 		}
-		imgMgr.DeleteVMRootfs(vmName, paths.VMs)
-		os.Remove(existingVM.SocketPath)
-		vm.Delete(paths.VMs, vmName)
 	}
 
 	if len(stopFailures) > 0 {
@@ -11,6 +11,8 @@ import (
 
 	"github.com/raesene/baremetalvmm/internal/config"
 	"github.com/raesene/baremetalvmm/internal/image"
+	"github.com/raesene/baremetalvmm/internal/network"
+	"github.com/raesene/baremetalvmm/internal/vm"
 )
 
 func (s *Server) getVMMVersion() VersionInfo {
@@ -29,11 +31,19 @@ func (s *Server) configPageData() map[string]interface{} {
 	paths := s.cfg.GetPaths()
 	imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
 	kernels, _ := imgMgr.ListKernelsWithInfo()
+	initrds, _ := imgMgr.ListInitrds()
 	images, _ := imgMgr.ListRootfsWithInfo()
 
+	var limits vm.RateLimits
+	if l := s.cfg.GetVMDefaults().RateLimits; l != nil {
+		limits = *l
+	}
+
 	return map[string]interface{}{
 		"Config":     s.cfg,
+		"RateLimits": limits,
 		"Kernels":    kernels,
+		"Initrds":    initrds,
 		"Images":     images,
 		"VMMVersion": s.getVMMVersion(),
 		"WebVersion": s.version,
@@ -81,6 +91,12 @@ func (s *Server) handleConfigUpdate(w http.ResponseWriter, r *http.Request) {
 
 	defaults.Image = strings.TrimSpace(r.FormValue("default_image"))
 	defaults.Kernel = strings.TrimSpace(r.FormValue("default_kernel"))
+	defaults.KernelArgs = strings.TrimSpace(r.FormValue("default_kernel_args"))
+	defaults.Initrd = strings.TrimSpace(r.FormValue("default_initrd"))
+	if err := (vm.Boot{Kernel: defaults.Kernel, KernelArgs: defaults.KernelArgs, Initrd: defaults.Initrd}).Validate(); err != nil {
+		s.renderConfigFlash(w, r, err.Error(), "error")
+		return
+	}
 	defaults.SSHKeyPath = strings.TrimSpace(r.FormValue("default_ssh_key"))
 
 	if dns := strings.TrimSpace(r.FormValue("default_dns")); dns != "" {
@@ -91,16 +107,63 @@ func (s *Server) handleConfigUpdate(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	var limits vm.RateLimits
+	for _, f := range []struct {
+		name  string
+		field *int
+	}{
+		{"default_net_bandwidth", &limits.Net.BandwidthMiB},
+		{"default_net_ops", &limits.Net.Ops},
+		{"default_disk_bandwidth", &limits.Disk.BandwidthMiB},
+		{"default_disk_ops", &limits.Disk.Ops},
+	} {
+		v := strings.TrimSpace(r.FormValue(f.name))
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			s.renderConfigFlash(w, r, "Invalid rate limit value (must be 0 or more)", "error")
+			return
+		}
+		*f.field = n
+	}
+	if !limits.Empty() {
+		defaults.RateLimits = &limits
+	}
+
+	var ipExclude []string
+	for _, e := range strings.Split(r.FormValue("ip_exclude"), ",") {
+		if trimmed := strings.TrimSpace(e); trimmed != "" {
+			ipExclude = append(ipExclude, trimmed)
+		}
+	}
+	if err := network.ValidateExclusions(ipExclude); err != nil {
+		s.renderConfigFlash(w, r, err.Error(), "error")
+		return
+	}
+
+	subnet6 := strings.TrimSpace(r.FormValue("subnet6"))
+	if subnet6 != "" {
+		if err := network.ValidateSubnet6(subnet6); err != nil {
+			s.renderConfigFlash(w, r, err.Error(), "error")
+			return
+		}
+	}
+
 	s.cfg.DataDir = strings.TrimSpace(r.FormValue("data_dir"))
 	s.cfg.BridgeName = strings.TrimSpace(r.FormValue("bridge_name"))
 	s.cfg.Subnet = strings.TrimSpace(r.FormValue("subnet"))
 	s.cfg.Gateway = strings.TrimSpace(r.FormValue("gateway"))
+	s.cfg.Subnet6 = subnet6
+	s.cfg.IPExclude = ipExclude
 	s.cfg.HostInterface = strings.TrimSpace(r.FormValue("host_interface"))
 	s.cfg.KernelPath = strings.TrimSpace(r.FormValue("kernel_path"))
 	s.cfg.RootfsPath = strings.TrimSpace(r.FormValue("rootfs_path"))
 
 	hasDefaults := defaults.CPUs != 0 || defaults.MemoryMB != 0 || defaults.DiskSizeMB != 0 ||
-		defaults.Image != "" || defaults.Kernel != "" || defaults.SSHKeyPath != "" || len(defaults.DNSServers) > 0
+		defaults.Image != "" || defaults.Kernel != "" || defaults.KernelArgs != "" || defaults.Initrd != "" ||
+		defaults.SSHKeyPath != "" || len(defaults.DNSServers) > 0 || defaults.RateLimits != nil
 	if hasDefaults {
 		s.cfg.VMDefaults = defaults
 	} else {
@@ -15,6 +15,7 @@ import (
 type DashboardStats struct {
 	TotalVMs      int
 	RunningVMs    int
+	PausedVMs     int
 	StoppedVMs    int
 	TotalClusters int
 	TotalCPUs     int
@@ -41,6 +42,8 @@ func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
 		switch v.State {
 		case vm.StateRunning:
 			stats.RunningVMs++
+		case vm.StatePaused:
+			stats.PausedVMs++
 		case vm.StateStopped, vm.StateCreated:
 			stats.StoppedVMs++
 		}
@@ -86,7 +89,14 @@ type SSEBroker struct {
 	subscribers map[chan string]struct{}
 	subscribe   chan chan string
 	unsubscribe chan chan string
-	broadcast   chan string
+	broadcast   chan stateChange
+}
+
+// stateChange is a VM state transition reported by a handler rather than
+// found by polling.
+type stateChange struct {
+	name  string
+	state string
 }
 
 func NewSSEBroker() *SSEBroker {
@@ -94,7 +104,27 @@ func NewSSEBroker() *SSEBroker {
 		subscribers: make(map[chan string]struct{}),
 		subscribe:   make(chan chan string),
 		unsubscribe: make(chan chan string),
-		broadcast:   make(chan string, 16),
+		broadcast:   make(chan stateChange, 16),
+	}
+}
+
+// Publish sends a VM's new state to subscribers straight away instead of at
+// the next poll. It never blocks; if the queue is full the poll reports the
+// change instead.
+func (b *SSEBroker) Publish(name string, state vm.State) {
+	select {
+	case b.broadcast <- stateChange{name: name, state: string(state)}:
+	default:
+	}
+}
+
+func (b *SSEBroker) send(name, state string) {
+	msg := fmt.Sprintf(`{"name":"%s","state":"%s"}`, name, state)
+	for ch := range b.subscribers {
+		select {
+		case ch <- msg:
+		default:
+		}
 	}
 }
 
@@ -121,36 +151,23 @@ func (b *SSEBroker) Start(cfg *config.Config) {
 		case ch := <-b.unsubscribe:
 			delete(b.subscribers, ch)
 			close(ch)
-		case msg := <-b.broadcast:
-			for ch := range b.subscribers {
-				select {
-				case ch <- msg:
-				default:
-				}
+		case c := <-b.broadcast:
+			// Record the change so the next poll does not report it again
+			if lastStates != nil {
+				lastStates[c.name] = c.state
 			}
+			b.send(c.name, c.state)
 		case <-ticker.C:
 			currentStates := pollVMStates(cfg)
 			if lastStates != nil {
 				for name, state := range currentStates {
 					if lastStates[name] != state {
-						msg := fmt.Sprintf(`{"name":"%s","state":"%s"}`, name, state)
-						for ch := range b.subscribers {
-							select {
-							case ch <- msg:
-							default:
-							}
-						}
+						b.send(name, state)
 					}
 				}
 				for name := range lastStates {
 					if _, ok := currentStates[name]; !ok {
-						msg := fmt.Sprintf(`{"name":"%s","state":"deleted"}`, name)
-						for ch := range b.subscribers {
-							select {
-							case ch <- msg:
-							default:
-							}
-						}
+						b.send(name, "deleted")
 					}
 				}
 			}
@@ -3,9 +3,12 @@ package web
 import (
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/raesene/baremetalvmm/internal/image"
+	"github.com/raesene/baremetalvmm/internal/lock"
 	"github.com/raesene/baremetalvmm/internal/validate"
+	"github.com/raesene/baremetalvmm/internal/vm"
 )
 
 func (s *Server) handleImages(w http.ResponseWriter, r *http.Request) {
@@ -17,6 +20,11 @@ func (s *Server) handleImages(w http.ResponseWriter, r *http.Request) {
 		kernels = []image.KernelInfo{}
 	}
 
+	initrds, err := imgMgr.ListInitrds()
+	if err != nil {
+		initrds = []image.InitrdInfo{}
+	}
+
 	rootfs, err := imgMgr.ListRootfsWithInfo()
 	if err != nil {
 		rootfs = []image.RootfsInfo{}
@@ -39,6 +47,7 @@ func (s *Server) handleImages(w http.ResponseWriter, r *http.Request) {
 
 	s.renderPage(w, r, "images.html", "images", map[string]interface{}{
 		"Kernels":          kernels,
+		"Initrds":          initrds,
 		"Rootfs":           rootfs,
 		"AvailableKernels": availableKernels,
 		"AvailableRootfs":  availableRootfs,
@@ -68,6 +77,28 @@ func (s *Server) handleKernelDelete(w http.ResponseWriter, r *http.Request) {
 	s.renderImagesFlash(w, r, "Kernel '"+name+"' deleted", "success")
 }
 
+func (s *Server) handleInitrdDelete(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "missing initrd name", http.StatusBadRequest)
+		return
+	}
+	if err := validate.InitrdName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	paths := s.cfg.GetPaths()
+	imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
+
+	if err := imgMgr.DeleteInitrd(name); err != nil {
+		s.renderImagesFlash(w, r, "Failed to delete initrd: "+err.Error(), "error")
+		return
+	}
+
+	s.renderImagesFlash(w, r, "Initrd '"+name+"' deleted", "success")
+}
+
 func (s *Server) handleRootfsDelete(w http.ResponseWriter, r *http.Request) {
 	name := r.FormValue("name")
 	if name == "" {
@@ -82,6 +113,16 @@ func (s *Server) handleRootfsDelete(w http.ResponseWriter, r *http.Request) {
 	paths := s.cfg.GetPaths()
 	imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
 
+	gl, err := s.lockImages()
+	if err != nil {
+		s.renderImagesFlash(w, r, "Failed to delete rootfs: "+err.Error(), "error")
+		return
+	}
+	defer gl.Unlock()
+	if err := vm.CheckBaseImageUnused(paths.VMs, imgMgr.GetImagePath(name)); err != nil {
+		s.renderImagesFlash(w, r, "Cannot delete rootfs: "+err.Error(), "error")
+		return
+	}
 	if err := imgMgr.DeleteImage(name); err != nil {
 		s.renderImagesFlash(w, r, "Failed to delete rootfs: "+err.Error(), "error")
 		return
@@ -140,6 +181,12 @@ func (s *Server) handleRootfsDownload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if imgMgr.ImageExists(localName) {
+		if err := s.deleteUnusedRootfs(imgMgr, localName); err != nil {
+			s.renderImagesFlash(w, r, "Cannot replace rootfs: "+err.Error(), "error")
+			return
+		}
+	}
 	if err := imgMgr.DownloadRootfsFromRelease(url, localName); err != nil {
 		s.renderImagesFlash(w, r, "Failed to download rootfs: "+err.Error(), "error")
 		return
@@ -153,6 +200,7 @@ func (s *Server) renderImagesFlash(w http.ResponseWriter, r *http.Request, msg,
 	imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
 
 	kernels, _ := imgMgr.ListKernelsWithInfo()
+	initrds, _ := imgMgr.ListInitrds()
 	rootfs, _ := imgMgr.ListRootfsWithInfo()
 
 	available, err := imgMgr.ListAvailableReleases()
@@ -167,6 +215,7 @@ func (s *Server) renderImagesFlash(w http.ResponseWriter, r *http.Request, msg,
 
 	s.renderPage(w, r, "images.html", "images", map[string]interface{}{
 		"Kernels":          kernels,
+		"Initrds":          initrds,
 		"Rootfs":           rootfs,
 		"AvailableKernels": availableKernels,
 		"AvailableRootfs":  availableRootfs,
@@ -183,11 +232,13 @@ func (s *Server) handleAPIImageList(w http.ResponseWriter, r *http.Request) {
 	imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
 
 	kernels, _ := imgMgr.ListKernelsWithInfo()
+	initrds, _ := imgMgr.ListInitrds()
 	rootfs, _ := imgMgr.ListRootfsWithInfo()
 	available, _ := imgMgr.ListAvailableReleases()
 
 	jsonResponse(w, map[string]interface{}{
 		"kernels":   kernels,
+		"initrds":   initrds,
 		"rootfs":    rootfs,
 		"available": available,
 	})
@@ -215,6 +266,28 @@ func (s *Server) handleAPIKernelDelete(w http.ResponseWriter, r *http.Request) {
 	jsonResponse(w, map[string]string{"status": "deleted"})
 }
 
+func (s *Server) handleAPIInitrdDelete(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		jsonError(w, "missing initrd name", http.StatusBadRequest)
+		return
+	}
+	if err := validate.InitrdName(name); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	paths := s.cfg.GetPaths()
+	imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
+
+	if err := imgMgr.DeleteInitrd(name); err != nil {
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, map[string]string{"status": "deleted"})
+}
+
 func (s *Server) handleAPIRootfsDelete(w http.ResponseWriter, r *http.Request) {
 	name := r.URL.Query().Get("name")
 	if name == "" {
@@ -229,6 +302,16 @@ func (s *Server) handleAPIRootfsDelete(w http.ResponseWriter, r *http.Request) {
 	paths := s.cfg.GetPaths()
 	imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
 
+	gl, err := s.lockImages()
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer gl.Unlock()
+	if err := vm.CheckBaseImageUnused(paths.VMs, imgMgr.GetImagePath(name)); err != nil {
+		jsonError(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err := imgMgr.DeleteImage(name); err != nil {
 		jsonError(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -236,3 +319,26 @@ func (s *Server) handleAPIRootfsDelete(w http.ResponseWriter, r *http.Request) {
 
 	jsonResponse(w, map[string]string{"status": "deleted"})
 }
+
+// imageLockTimeout matches the wait used by the lifecycle operations.
+const imageLockTimeout = 30 * time.Second
+
+// lockImages takes the global lock, which lifecycle holds to create a thin
+// VM, so a base image found unused stays so until it is deleted.
+func (s *Server) lockImages() (*lock.Lock, error) {
+	return lock.Global(s.cfg.GetPaths().State, imageLockTimeout)
+}
+
+// deleteUnusedRootfs deletes a rootfs image that no thin VM is an overlay of,
+// so a replacement can be written without a thin VM created on the old one.
+func (s *Server) deleteUnusedRootfs(imgMgr *image.Manager, name string) error {
+	gl, err := s.lockImages()
+	if err != nil {
+		return err
+	}
+	defer gl.Unlock()
+	if err := vm.CheckBaseImageUnused(s.cfg.GetPaths().VMs, imgMgr.GetImagePath(name)); err != nil {
+		return err
+	}
+	return imgMgr.DeleteImage(name)
+}
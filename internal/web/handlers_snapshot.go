@@ -2,20 +2,23 @@ package web
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
 
 	"github.com/raesene/baremetalvmm/internal/firecracker"
-	"github.com/raesene/baremetalvmm/internal/network"
+	"github.com/raesene/baremetalvmm/internal/lock"
 	"github.com/raesene/baremetalvmm/internal/snapshot"
 	"github.com/raesene/baremetalvmm/internal/validate"
 	"github.com/raesene/baremetalvmm/internal/vm"
 )
 
-// handleSnapshotCreate takes a full snapshot of a running VM. The VM is paused
-// briefly and then resumed, so it keeps running afterwards.
+// handleSnapshotCreate takes a snapshot of a running VM, a diff against its
+// last one if the diff field is set, or of its disks alone if disk_only is.
+// The VM is paused briefly and then resumed, so it keeps running afterwards.
 func (s *Server) handleSnapshotCreate(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "name")
 	if err := validate.VMName(name); err != nil {
@@ -27,8 +30,19 @@ func (s *Server) handleSnapshotCreate(w http.ResponseWriter, r *http.Request) {
 		httpError(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
+	opts := snapshot.CreateOptions{
+		Diff:     r.FormValue("diff") == "on",
+		DiskOnly: r.FormValue("disk_only") == "on",
+	}
 	paths := s.cfg.GetPaths()
 
+	vmLock, err := lock.VM(paths.State, name)
+	if err != nil {
+		httpError(w, r, err.Error(), lockErrorCode(err))
+		return
+	}
+	defer vmLock.Unlock()
+
 	v, err := vm.Load(paths.VMs, name)
 	if err != nil {
 		httpError(w, r, "VM not found", http.StatusNotFound)
@@ -48,16 +62,21 @@ func (s *Server) handleSnapshotCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, err := snapMgr.Create(context.Background(), fcClient, v, snapName, true); err != nil {
+	if _, err := snapMgr.Create(context.Background(), fcClient, v, snapName, opts); err != nil {
 		httpError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err := v.Save(paths.VMs); err != nil {
+		httpError(w, r, "snapshot created, but failed to save VM state: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	http.Redirect(w, r, "/vms/"+name, http.StatusSeeOther)
 }
 
 // handleSnapshotRestore rolls a VM back to one of its snapshots in place. If the
-// VM is running it is stopped first, then restored and resumed from the snapshot.
+// VM is running it is stopped first, then restored and resumed from the snapshot,
+// or booted from its disks if the snapshot has no memory.
 func (s *Server) handleSnapshotRestore(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "name")
 	if err := validate.VMName(name); err != nil {
@@ -69,55 +88,10 @@ func (s *Server) handleSnapshotRestore(w http.ResponseWriter, r *http.Request) {
 		httpError(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
-	paths := s.cfg.GetPaths()
-
-	v, err := vm.Load(paths.VMs, name)
-	if err != nil {
-		httpError(w, r, "VM not found", http.StatusNotFound)
-		return
-	}
-
-	snapMgr := snapshot.NewManager(paths.Snapshots)
-	meta, err := snapMgr.Get(name, snapName)
-	if err != nil {
-		httpError(w, r, err.Error(), http.StatusNotFound)
-		return
-	}
-
-	fcClient := firecracker.NewClient()
-	fcClient.UpdateVMState(v)
-	ctx := context.Background()
-	netMgr := network.NewManager(s.cfg.BridgeName, s.cfg.Subnet, s.cfg.Gateway, s.cfg.HostInterface)
-
-	// The VM must be stopped before its disks are overwritten.
-	if v.State == vm.StateRunning {
-		v.State = vm.StateStopping
-		v.Save(paths.VMs)
-		if err := fcClient.Terminate(ctx, v); err != nil {
-			v.State = vm.StateError
-			v.Save(paths.VMs)
-			httpError(w, r, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if v.TapDevice != "" && netMgr.TapExists(v.TapDevice) {
-			netMgr.DeleteTap(v.TapDevice)
-		}
-		v.State = vm.StateStopped
-		v.Save(paths.VMs)
-	}
-
-	// Restore uses the snapshot's resource configuration (memory size is fixed).
-	v.CPUs = meta.CPUs
-	v.MemoryMB = meta.MemoryMB
-
-	logPath := fmt.Sprintf("%s/%s.log", paths.Logs, name)
-	if _, err := snapMgr.Restore(ctx, fcClient, netMgr, v, snapName, logPath, true); err != nil {
-		v.State = vm.StateError
-		v.Save(paths.VMs)
-		httpError(w, r, err.Error(), http.StatusInternalServerError)
+	if _, err := s.backend().Restore(name, snapName, true, true); err != nil {
+		httpError(w, r, err.Error(), backendErrorCode(err))
 		return
 	}
-	v.Save(paths.VMs)
 
 	http.Redirect(w, r, "/vms/"+name, http.StatusSeeOther)
 }
@@ -136,6 +110,13 @@ func (s *Server) handleSnapshotDelete(w http.ResponseWriter, r *http.Request) {
 	}
 	paths := s.cfg.GetPaths()
 
+	vmLock, err := lock.VM(paths.State, name)
+	if err != nil {
+		httpError(w, r, err.Error(), lockErrorCode(err))
+		return
+	}
+	defer vmLock.Unlock()
+
 	snapMgr := snapshot.NewManager(paths.Snapshots)
 	if err := snapMgr.Delete(name, snapName); err != nil {
 		httpError(w, r, err.Error(), http.StatusInternalServerError)
@@ -183,6 +164,12 @@ func (s *Server) handleAPISnapshotDelete(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	paths := s.cfg.GetPaths()
+	vmLock, err := lock.VM(paths.State, name)
+	if err != nil {
+		jsonError(w, err.Error(), lockErrorCode(err))
+		return
+	}
+	defer vmLock.Unlock()
 	snapMgr := snapshot.NewManager(paths.Snapshots)
 	if err := snapMgr.Delete(name, snapName); err != nil {
 		jsonError(w, err.Error(), http.StatusInternalServerError)
@@ -190,3 +177,47 @@ func (s *Server) handleAPISnapshotDelete(w http.ResponseWriter, r *http.Request)
 	}
 	jsonResponse(w, map[string]string{"status": "deleted"})
 }
+
+// handleAPISnapshotClone creates and starts a new VM from a snapshot. The
+// body names the new VM and whether to restore the snapshot's memory (warm)
+// or boot its disk afresh (cold).
+func (s *Server) handleAPISnapshotClone(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := validate.VMName(name); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	snapName := chi.URLParam(r, "snapshot")
+	if err := validate.SnapshotName(snapName); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+		Warm bool   `json:"warm"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validate.VMName(req.Name); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	v, err := s.backend().Clone(name, snapName, req.Name, req.Warm)
+	if err != nil {
+		jsonError(w, err.Error(), backendErrorCode(err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	jsonResponse(w, v)
+}
+
+// lockErrorCode maps an error from taking a VM lock to an HTTP status code.
+func lockErrorCode(err error) int {
+	if errors.Is(err, lock.ErrBusy) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
@@ -3,6 +3,7 @@ package web
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -17,6 +18,7 @@ import (
 	"golang.org/x/crypto/ssh/agent"
 	"nhooyr.io/websocket"
 
+	"github.com/raesene/baremetalvmm/internal/console"
 	"github.com/raesene/baremetalvmm/internal/firecracker"
 	"github.com/raesene/baremetalvmm/internal/sshkey"
 	"github.com/raesene/baremetalvmm/internal/validate"
@@ -30,6 +32,16 @@ type terminalResize struct {
 }
 
 func (s *Server) handleTerminalPage(w http.ResponseWriter, r *http.Request) {
+	s.renderTerminalPage(w, r, "ssh")
+}
+
+// handleConsolePage shows the serial console in the terminal page, as a tab
+// next to the SSH terminal.
+func (s *Server) handleConsolePage(w http.ResponseWriter, r *http.Request) {
+	s.renderTerminalPage(w, r, "console")
+}
+
+func (s *Server) renderTerminalPage(w http.ResponseWriter, r *http.Request, mode string) {
 	name := chi.URLParam(r, "name")
 	if err := validate.VMName(name); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -52,7 +64,8 @@ func (s *Server) handleTerminalPage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	data := map[string]interface{}{
-		"VM": v,
+		"VM":   v,
+		"Mode": mode,
 	}
 
 	if cookie, err := r.Cookie("vmm_session"); err == nil {
@@ -224,6 +237,96 @@ func (s *Server) handleTerminalWS(w http.ResponseWriter, r *http.Request) {
 	wg.Wait()
 }
 
+// handleConsoleWS connects a browser terminal to a VM's serial console. The
+// console allows one writer, so a second tab gets a read-only view.
+func (s *Server) handleConsoleWS(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := validate.VMName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	paths := s.cfg.GetPaths()
+
+	v, err := vm.Load(paths.VMs, name)
+	if err != nil {
+		http.Error(w, "VM not found", http.StatusNotFound)
+		return
+	}
+
+	fcClient := firecracker.NewClient()
+	fcClient.UpdateVMState(v)
+
+	if v.State != vm.StateRunning {
+		http.Error(w, "VM is not running", http.StatusBadRequest)
+		return
+	}
+
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		log.Printf("websocket accept error: %v", err)
+		return
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	input, err := console.OpenInput(v.ConsolePath())
+	switch {
+	case errors.Is(err, console.ErrBusy):
+		conn.Write(ctx, websocket.MessageBinary, []byte("\r\nAnother session is attached to the console; this view is read-only.\r\n"))
+	case err != nil:
+		writeWSError(conn, ctx, fmt.Sprintf("Console unavailable: %v", err))
+		return
+	default:
+		defer input.Close()
+		conn.Write(ctx, websocket.MessageBinary, []byte("\r\nConnected to serial console. Press Enter if no login prompt appears.\r\n"))
+	}
+
+	go func() {
+		if console.WaitStopped(ctx, v.ConsolePath()) {
+			conn.Write(ctx, websocket.MessageBinary, []byte("\r\nVM stopped.\r\n"))
+			cancel()
+		}
+	}()
+
+	// WebSocket -> console input. Resize messages are dropped: a serial
+	// line has no window size.
+	go func() {
+		defer cancel()
+		for {
+			msgType, data, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			if msgType == websocket.MessageText || input == nil {
+				continue
+			}
+			if _, err := input.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+
+	logPath := firecracker.ConsoleLogPath(fmt.Sprintf("%s/%s.log", paths.Logs, v.Name))
+	if err := console.Follow(ctx, logPath, -1, wsWriter{conn, ctx}); err != nil && ctx.Err() == nil {
+		writeWSError(conn, ctx, err.Error())
+	}
+}
+
+// wsWriter sends each write as a binary WebSocket message.
+type wsWriter struct {
+	conn *websocket.Conn
+	ctx  context.Context
+}
+
+func (w wsWriter) Write(p []byte) (int, error) {
+	if err := w.conn.Write(w.ctx, websocket.MessageBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
 func writeWSError(conn *websocket.Conn, ctx context.Context, msg string) {
 	log.Printf("terminal error: %s", msg)
 	conn.Write(ctx, websocket.MessageBinary, []byte("\r\n"+msg+"\r\n"))
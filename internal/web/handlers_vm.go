@@ -1,29 +1,26 @@
 package web
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strings"
-	"time"
 
 	"github.com/go-chi/chi/v5"
 
-	"github.com/raesene/baremetalvmm/internal/firecracker"
+	"github.com/raesene/baremetalvmm/internal/daemon"
 	"github.com/raesene/baremetalvmm/internal/image"
 	"github.com/raesene/baremetalvmm/internal/network"
 	"github.com/raesene/baremetalvmm/internal/snapshot"
-	"github.com/raesene/baremetalvmm/internal/sshkey"
 	"github.com/raesene/baremetalvmm/internal/validate"
 	"github.com/raesene/baremetalvmm/internal/vm"
 )
 
 func (s *Server) handleVMList(w http.ResponseWriter, r *http.Request) {
-	paths := s.cfg.GetPaths()
-	vms, err := vm.List(paths.VMs)
+	vms, err := s.backend().List()
 	if err != nil {
 		s.renderPage(w, r, "vms.html", "vms", map[string]interface{}{
 			"Flash":     "Failed to list VMs: " + err.Error(),
@@ -32,11 +29,6 @@ func (s *Server) handleVMList(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fcClient := firecracker.NewClient()
-	for _, v := range vms {
-		fcClient.UpdateVMState(v)
-	}
-
 	s.renderPage(w, r, "vms.html", "vms", map[string]interface{}{
 		"VMs": vms,
 	})
@@ -47,6 +39,7 @@ func (s *Server) handleVMCreateForm(w http.ResponseWriter, r *http.Request) {
 	imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
 
 	kernels, _ := imgMgr.ListKernelsWithInfo()
+	initrds, _ := imgMgr.ListInitrds()
 	images, _ := imgMgr.ListRootfsWithInfo()
 	defaults := s.cfg.GetVMDefaults()
 
@@ -71,16 +64,32 @@ func (s *Server) handleVMCreateForm(w http.ResponseWriter, r *http.Request) {
 		diskMB = 1024
 	}
 
+	var limits vm.RateLimits
+	if defaults.RateLimits != nil {
+		limits = *defaults.RateLimits
+	}
+
+	networks, _ := s.cfg.Networks().List()
+
 	s.renderPage(w, r, "vm_create.html", "vms", map[string]interface{}{
-		"Kernels": kernels,
-		"Images":  images,
+		"Kernels":  kernels,
+		"Initrds":  initrds,
+		"Images":   images,
+		"Networks": networks,
 		"Defaults": map[string]interface{}{
 			"CPUs":       cpus,
 			"MemoryMB":   memoryMB,
 			"DiskSizeMB": diskMB,
 			"SSHKey":     sshKey,
 			"Kernel":     defaults.Kernel,
+			"KernelArgs": defaults.KernelArgs,
+			"Initrd":     defaults.Initrd,
 			"Image":      defaults.Image,
+
+			"NetBandwidth":  limits.Net.BandwidthMiB,
+			"NetOps":        limits.Net.Ops,
+			"DiskBandwidth": limits.Disk.BandwidthMiB,
+			"DiskOps":       limits.Disk.Ops,
 		},
 	})
 }
@@ -124,8 +133,11 @@ func (s *Server) handleVMCreate(w http.ResponseWriter, r *http.Request) {
 	disk := formInt(r, "disk", 1024)
 	sshKey := strings.TrimSpace(r.FormValue("ssh_key"))
 	kernelName := r.FormValue("kernel")
+	kernelArgs := strings.TrimSpace(r.FormValue("kernel_args"))
+	initrdName := r.FormValue("initrd")
 	imageName := r.FormValue("image")
 	dnsStr := strings.TrimSpace(r.FormValue("dns"))
+	networkName := r.FormValue("network")
 
 	if err := validate.CPUs(cpus); err != nil {
 		s.renderPage(w, r, "vm_create.html", "vms", map[string]interface{}{
@@ -145,6 +157,13 @@ func (s *Server) handleVMCreate(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+	boot := vm.Boot{Kernel: kernelName, KernelArgs: kernelArgs, Initrd: initrdName}
+	if err := boot.Validate(); err != nil {
+		s.renderPage(w, r, "vm_create.html", "vms", map[string]interface{}{
+			"Flash": err.Error(), "FlashType": "error",
+		})
+		return
+	}
 
 	var dnsServers []string
 	if dnsStr != "" {
@@ -168,6 +187,7 @@ func (s *Server) handleVMCreate(w http.ResponseWriter, r *http.Request) {
 	hostPorts := r.Form["host_port"]
 	guestPorts := r.Form["guest_port"]
 	protocols := r.Form["protocol"]
+	modes := r.Form["forward_mode"]
 	for i := range hostPorts {
 		if hostPorts[i] == "" || guestPorts[i] == "" {
 			continue
@@ -181,13 +201,25 @@ func (s *Server) handleVMCreate(w http.ResponseWriter, r *http.Request) {
 		if i < len(protocols) && protocols[i] == "udp" {
 			proto = "udp"
 		}
+		mode := ""
+		if i < len(modes) && modes[i] == vm.ForwardProxy {
+			mode = vm.ForwardProxy
+		}
 		portForwards = append(portForwards, vm.PortForward{
 			HostPort:  hp,
 			GuestPort: gp,
 			Protocol:  proto,
+			Mode:      mode,
 		})
 	}
 
+	if _, err := s.cfg.Networks().Get(networkName); err != nil {
+		s.renderPage(w, r, "vm_create.html", "vms", map[string]interface{}{
+			"Flash": err.Error(), "FlashType": "error",
+		})
+		return
+	}
+
 	imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
 	if imageName != "" && !imgMgr.ImageExists(imageName) {
 		s.renderPage(w, r, "vm_create.html", "vms", map[string]interface{}{
@@ -203,6 +235,13 @@ func (s *Server) handleVMCreate(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+	if initrdName != "" && !imgMgr.InitrdExists(initrdName) {
+		s.renderPage(w, r, "vm_create.html", "vms", map[string]interface{}{
+			"Flash":     fmt.Sprintf("Initrd '%s' not found", initrdName),
+			"FlashType": "error",
+		})
+		return
+	}
 
 	newVM := vm.NewVM(name)
 	newVM.CPUs = cpus
@@ -210,14 +249,30 @@ func (s *Server) handleVMCreate(w http.ResponseWriter, r *http.Request) {
 	newVM.DiskSizeMB = disk
 	newVM.Image = imageName
 	newVM.Kernel = kernelName
+	newVM.KernelArgs = kernelArgs
+	newVM.Initrd = initrdName
+	if r.FormValue("thin") != "" {
+		newVM.BaseImage = imgMgr.GetDefaultRootfsPath()
+		if imageName != "" {
+			newVM.BaseImage = imgMgr.GetImagePath(imageName)
+		}
+	}
 	newVM.MacAddress = newVM.GenerateMacAddress()
 	newVM.TapDevice = network.GenerateTapName(newVM.ID)
 	newVM.DNSServers = dnsServers
 	newVM.SSHPublicKey = sshKey
 	newVM.PortForwards = portForwards
+	newVM.Network = networkName
+	limits := vm.RateLimits{
+		Net:  vm.RateLimit{BandwidthMiB: formInt(r, "net_bandwidth", 0), Ops: formInt(r, "net_ops", 0)},
+		Disk: vm.RateLimit{BandwidthMiB: formInt(r, "disk_bandwidth", 0), Ops: formInt(r, "disk_ops", 0)},
+	}
+	if !limits.Empty() {
+		newVM.RateLimits = &limits
+	}
 	newVM.SocketPath = fmt.Sprintf("%s/%s.sock", paths.Sockets, name)
 
-	if err := newVM.Save(paths.VMs); err != nil {
+	if _, err := s.backend().Create(newVM); err != nil {
 		s.renderPage(w, r, "vm_create.html", "vms", map[string]interface{}{
 			"Flash":     "Failed to create VM: " + err.Error(),
 			"FlashType": "error",
@@ -236,149 +291,41 @@ func (s *Server) handleVMDetail(w http.ResponseWriter, r *http.Request) {
 	}
 	paths := s.cfg.GetPaths()
 
-	v, err := vm.Load(paths.VMs, name)
+	v, err := s.backend().Get(name)
 	if err != nil {
-		http.Error(w, "VM not found", http.StatusNotFound)
+		http.Error(w, err.Error(), backendErrorCode(err))
 		return
 	}
 
-	fcClient := firecracker.NewClient()
-	fcClient.UpdateVMState(v)
-
 	snapMgr := snapshot.NewManager(paths.Snapshots)
 	snaps, err := snapMgr.List(name)
 	if err != nil {
 		log.Printf("failed to list snapshots for VM %s: %v", name, err)
 	}
 
-	s.renderPage(w, r, "vm_detail.html", "vms", map[string]interface{}{
-		"VM":        v,
-		"Snapshots": snaps,
-	})
-}
-
-func (s *Server) startVM(existingVM *vm.VM) error {
-	paths := s.cfg.GetPaths()
-
-	imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
-	if err := imgMgr.EnsureDefaultImages(); err != nil {
-		return fmt.Errorf("failed to ensure images: %w", err)
-	}
-
-	vmRootfs, err := imgMgr.CreateVMRootfs(existingVM.Name, paths.VMs, existingVM.DiskSizeMB, existingVM.Image)
-	if err != nil {
-		return fmt.Errorf("failed to create VM rootfs: %w", err)
-	}
-	existingVM.RootfsPath = vmRootfs
-	existingVM.KernelPath = imgMgr.GetKernelPath(existingVM.Kernel)
-
-	if err := sshkey.EnsureKeyPair(paths.SSH); err != nil {
-		return fmt.Errorf("failed to ensure vmm SSH key: %w", err)
-	}
-	authorizedKeys, err := sshkey.BuildAuthorizedKeys(paths.SSH, existingVM.SSHPublicKey)
-	if err != nil {
-		return fmt.Errorf("failed to build authorized keys: %w", err)
-	}
-	if err := image.InjectSSHKey(existingVM.RootfsPath, authorizedKeys); err != nil {
-		return fmt.Errorf("failed to inject SSH key: %w", err)
+	// Guests without a balloon driver, or VMs restored from snapshots taken
+	// without a balloon, have no statistics to show
+	var balloon *vm.BalloonStats
+	if v.State == vm.StateRunning {
+		balloon, _ = s.backend().BalloonStats(name)
 	}
 
-	if err := image.InjectDNSConfig(existingVM.RootfsPath, existingVM.DNSServers); err != nil {
-		return fmt.Errorf("failed to inject DNS config: %w", err)
-	}
-
-	netMgr := network.NewManager(s.cfg.BridgeName, s.cfg.Subnet, s.cfg.Gateway, s.cfg.HostInterface)
-	if err := netMgr.EnsureBridge(); err != nil {
-		return fmt.Errorf("failed to setup bridge: %w", err)
-	}
-
-	// Track resources for cleanup on failure
-	var cleanupFuncs []func()
-	startSuccess := false
-	defer func() {
-		if !startSuccess {
-			for i := len(cleanupFuncs) - 1; i >= 0; i-- {
-				cleanupFuncs[i]()
-			}
-		}
-	}()
-
-	if !netMgr.TapExists(existingVM.TapDevice) {
-		if err := netMgr.CreateTap(existingVM.TapDevice); err != nil {
-			return fmt.Errorf("failed to create TAP device: %w", err)
-		}
-		cleanupFuncs = append(cleanupFuncs, func() {
-			if err := netMgr.DeleteTap(existingVM.TapDevice); err != nil {
-				fmt.Printf("Warning: failed to clean up TAP device %s: %v\n", existingVM.TapDevice, err)
+	// Volumes not attached to any VM can be attached to this one
+	var freeVolumes []string
+	if volumes, err := s.listVolumes(); err == nil {
+		for _, vol := range volumes {
+			if vol.AttachedTo == "" {
+				freeVolumes = append(freeVolumes, vol.Name)
 			}
-		})
-	}
-
-	ip, err := netMgr.AllocateIP(usedVMIPs(paths.VMs))
-	if err != nil {
-		return fmt.Errorf("failed to allocate IP: %w", err)
-	}
-	existingVM.IPAddress = ip
-	cleanupFuncs = append(cleanupFuncs, func() {
-		existingVM.IPAddress = ""
-		existingVM.State = vm.StateError
-		if err := existingVM.Save(paths.VMs); err != nil {
-			fmt.Printf("Warning: failed to save VM state during cleanup: %v\n", err)
 		}
-	})
-
-	for _, pf := range existingVM.PortForwards {
-		if err := netMgr.AddPortForward(pf.HostPort, pf.GuestPort, existingVM.IPAddress, pf.Protocol); err != nil {
-			return fmt.Errorf("failed to add port forward %d:%d: %w", pf.HostPort, pf.GuestPort, err)
-		}
-		// Capture pf values for cleanup closure
-		pfCopy := pf
-		cleanupFuncs = append(cleanupFuncs, func() {
-			if err := netMgr.RemovePortForward(pfCopy.HostPort, pfCopy.GuestPort, existingVM.IPAddress, pfCopy.Protocol); err != nil {
-				fmt.Printf("Warning: failed to clean up port forward %d:%d: %v\n", pfCopy.HostPort, pfCopy.GuestPort, err)
-			}
-		})
 	}
 
-	existingVM.State = vm.StateStarting
-	existingVM.Save(paths.VMs)
-
-	// Clean up socket file on failure
-	cleanupFuncs = append(cleanupFuncs, func() {
-		if err := os.Remove(existingVM.SocketPath); err != nil && !os.IsNotExist(err) {
-			fmt.Printf("Warning: failed to clean up socket file %s: %v\n", existingVM.SocketPath, err)
-		}
+	s.renderPage(w, r, "vm_detail.html", "vms", map[string]interface{}{
+		"VM":          v,
+		"Snapshots":   snaps,
+		"Balloon":     balloon,
+		"FreeVolumes": freeVolumes,
 	})
-
-	ctx := context.Background()
-	fcClient := firecracker.NewClient()
-	vmCfg := &firecracker.VMConfig{
-		SocketPath: existingVM.SocketPath,
-		KernelPath: existingVM.KernelPath,
-		RootfsPath: existingVM.RootfsPath,
-		CPUs:       existingVM.CPUs,
-		MemoryMB:   existingVM.MemoryMB,
-		TapDevice:  existingVM.TapDevice,
-		MacAddress: existingVM.MacAddress,
-		LogPath:    fmt.Sprintf("%s/%s.log", paths.Logs, existingVM.Name),
-		IPAddress:  existingVM.IPAddress,
-		Gateway:    s.cfg.Gateway,
-		Subnet:     s.cfg.Subnet,
-	}
-
-	machine, err := fcClient.StartVM(ctx, vmCfg)
-	if err != nil {
-		return fmt.Errorf("failed to start VM: %w", err)
-	}
-
-	// Mark success to prevent cleanup
-	startSuccess = true
-
-	existingVM.State = vm.StateRunning
-	existingVM.PID = fcClient.GetVMPID(machine)
-	existingVM.StartedAt = time.Now()
-	existingVM.Save(paths.VMs)
-	return nil
 }
 
 func (s *Server) handleVMStart(w http.ResponseWriter, r *http.Request) {
@@ -387,24 +334,30 @@ func (s *Server) handleVMStart(w http.ResponseWriter, r *http.Request) {
 		httpError(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
-	paths := s.cfg.GetPaths()
 
-	existingVM, err := vm.Load(paths.VMs, name)
+	existingVM, err := s.backend().Start(name)
 	if err != nil {
-		httpError(w, r, "VM not found", http.StatusNotFound)
+		httpError(w, r, err.Error(), backendErrorCode(err))
 		return
 	}
 
-	fcClient := firecracker.NewClient()
-	fcClient.UpdateVMState(existingVM)
+	if isHTMXRequest(r) {
+		s.renderVMRow(w, existingVM)
+	} else {
+		http.Redirect(w, r, "/vms", http.StatusSeeOther)
+	}
+}
 
-	if existingVM.State == vm.StateRunning {
-		httpError(w, r, "VM is already running", http.StatusConflict)
+func (s *Server) handleVMStop(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := validate.VMName(name); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if err := s.startVM(existingVM); err != nil {
-		httpError(w, r, err.Error(), http.StatusInternalServerError)
+	existingVM, err := s.backend().Stop(name)
+	if err != nil {
+		httpError(w, r, err.Error(), backendErrorCode(err))
 		return
 	}
 
@@ -415,61 +368,61 @@ func (s *Server) handleVMStart(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) handleVMStop(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleVMPause(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "name")
 	if err := validate.VMName(name); err != nil {
 		httpError(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
-	paths := s.cfg.GetPaths()
 
-	existingVM, err := vm.Load(paths.VMs, name)
+	existingVM, err := s.backend().Pause(name)
 	if err != nil {
-		httpError(w, r, "VM not found", http.StatusNotFound)
+		httpError(w, r, err.Error(), backendErrorCode(err))
 		return
 	}
+	s.sseBroker.Publish(existingVM.Name, existingVM.State)
 
-	fcClient := firecracker.NewClient()
-	fcClient.UpdateVMState(existingVM)
+	if isHTMXRequest(r) {
+		s.renderVMRow(w, existingVM)
+	} else {
+		http.Redirect(w, r, "/vms/"+name, http.StatusSeeOther)
+	}
+}
 
-	if existingVM.State != vm.StateRunning {
-		httpError(w, r, "VM is not running", http.StatusConflict)
+func (s *Server) handleVMResume(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := validate.VMName(name); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	existingVM.State = vm.StateStopping
-	existingVM.Save(paths.VMs)
-
-	ctx := context.Background()
-	if err := fcClient.Terminate(ctx, existingVM); err != nil {
-		existingVM.State = vm.StateError
-		if saveErr := existingVM.Save(paths.VMs); saveErr != nil {
-			log.Printf("failed to save state for VM %s: %v", name, saveErr)
-		}
-		httpError(w, r, err.Error(), http.StatusInternalServerError)
+	existingVM, err := s.backend().Resume(name)
+	if err != nil {
+		httpError(w, r, err.Error(), backendErrorCode(err))
 		return
 	}
+	s.sseBroker.Publish(existingVM.Name, existingVM.State)
 
-	netMgr := network.NewManager(s.cfg.BridgeName, s.cfg.Subnet, s.cfg.Gateway, s.cfg.HostInterface)
-	if existingVM.TapDevice != "" && netMgr.TapExists(existingVM.TapDevice) {
-		netMgr.DeleteTap(existingVM.TapDevice)
+	if isHTMXRequest(r) {
+		s.renderVMRow(w, existingVM)
+	} else {
+		http.Redirect(w, r, "/vms/"+name, http.StatusSeeOther)
 	}
+}
 
-	for _, pf := range existingVM.PortForwards {
-		if existingVM.IPAddress != "" {
-			netMgr.RemovePortForward(pf.HostPort, pf.GuestPort, existingVM.IPAddress, pf.Protocol)
-		}
+func (s *Server) handleVMFlatten(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := validate.VMName(name); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// Terminate already cleared the PID and removed the socket
-	existingVM.State = vm.StateStopped
-	existingVM.Save(paths.VMs)
-
-	if isHTMXRequest(r) {
-		s.renderVMRow(w, existingVM)
-	} else {
-		http.Redirect(w, r, "/vms", http.StatusSeeOther)
+	if _, err := s.backend().Flatten(name); err != nil {
+		httpError(w, r, err.Error(), backendErrorCode(err))
+		return
 	}
+
+	http.Redirect(w, r, "/vms/"+name, http.StatusSeeOther)
 }
 
 func (s *Server) handleVMDelete(w http.ResponseWriter, r *http.Request) {
@@ -486,47 +439,12 @@ func (s *Server) deleteVM(w http.ResponseWriter, r *http.Request) {
 		httpError(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
-	paths := s.cfg.GetPaths()
 
-	existingVM, err := vm.Load(paths.VMs, name)
-	if err != nil {
-		httpError(w, r, "VM not found", http.StatusNotFound)
+	if err := s.backend().Delete(name, true); err != nil {
+		httpError(w, r, err.Error(), backendErrorCode(err))
 		return
 	}
 
-	fcClient := firecracker.NewClient()
-	fcClient.UpdateVMState(existingVM)
-
-	if existingVM.State == vm.StateRunning {
-		ctx := context.Background()
-		// Never remove the VM record while its process survives
-		if err := fcClient.Terminate(ctx, existingVM); err != nil {
-			existingVM.State = vm.StateError
-			if saveErr := existingVM.Save(paths.VMs); saveErr != nil {
-				log.Printf("failed to save state for VM %s: %v", name, saveErr)
-			}
-			httpError(w, r, err.Error(), http.StatusInternalServerError)
-			return
-		}
-	}
-
-	netMgr := network.NewManager(s.cfg.BridgeName, s.cfg.Subnet, s.cfg.Gateway, s.cfg.HostInterface)
-	if existingVM.TapDevice != "" && netMgr.TapExists(existingVM.TapDevice) {
-		netMgr.DeleteTap(existingVM.TapDevice)
-	}
-
-	for _, pf := range existingVM.PortForwards {
-		if existingVM.IPAddress != "" {
-			netMgr.RemovePortForward(pf.HostPort, pf.GuestPort, existingVM.IPAddress, pf.Protocol)
-		}
-	}
-
-	imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
-	imgMgr.DeleteVMRootfs(name, paths.VMs)
-	snapshot.NewManager(paths.Snapshots).DeleteAllForVM(name)
-	os.Remove(existingVM.SocketPath)
-	vm.Delete(paths.VMs, name)
-
 	if isHTMXRequest(r) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(""))
@@ -544,18 +462,12 @@ func (s *Server) renderVMRow(w http.ResponseWriter, v *vm.VM) {
 // JSON API handlers
 
 func (s *Server) handleAPIVMList(w http.ResponseWriter, r *http.Request) {
-	paths := s.cfg.GetPaths()
-	vms, err := vm.List(paths.VMs)
+	vms, err := s.backend().List()
 	if err != nil {
 		jsonError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	fcClient := firecracker.NewClient()
-	for _, v := range vms {
-		fcClient.UpdateVMState(v)
-	}
-
 	jsonResponse(w, vms)
 }
 
@@ -565,17 +477,12 @@ func (s *Server) handleAPIVMDetail(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	paths := s.cfg.GetPaths()
-
-	v, err := vm.Load(paths.VMs, name)
+	v, err := s.backend().Get(name)
 	if err != nil {
-		jsonError(w, "VM not found", http.StatusNotFound)
+		jsonError(w, err.Error(), backendErrorCode(err))
 		return
 	}
 
-	fcClient := firecracker.NewClient()
-	fcClient.UpdateVMState(v)
-
 	jsonResponse(w, v)
 }
 
@@ -587,9 +494,19 @@ func (s *Server) handleAPIVMCreate(w http.ResponseWriter, r *http.Request) {
 		DiskSizeMB   int              `json:"disk_size_mb"`
 		SSHKey       string           `json:"ssh_key"`
 		Kernel       string           `json:"kernel"`
+		KernelArgs   string           `json:"kernel_args"`
+		Initrd       string           `json:"initrd"`
 		Image        string           `json:"image"`
+		Thin         bool             `json:"thin"`
 		DNSServers   []string         `json:"dns_servers"`
 		PortForwards []vm.PortForward `json:"port_forwards"`
+		RateLimits   *vm.RateLimits   `json:"rate_limits"`
+		IP           string           `json:"ip"`
+		Network      string           `json:"network"`
+		NICs         []struct {
+			Network string `json:"network"`
+			IP      string `json:"ip"`
+		} `json:"nics"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		jsonError(w, "Invalid request body", http.StatusBadRequest)
@@ -632,10 +549,57 @@ func (s *Server) handleAPIVMCreate(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	if err := (vm.Boot{Kernel: req.Kernel, KernelArgs: req.KernelArgs, Initrd: req.Initrd}).Validate(); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Thin && req.Image != "" {
+		if err := validate.ImageName(req.Image); err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	// Without rate limits of its own a VM gets the configured defaults
+	if req.RateLimits == nil {
+		req.RateLimits = s.cfg.GetVMDefaults().RateLimits
+	}
+	if req.RateLimits != nil {
+		if err := req.RateLimits.Validate(); err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
 	paths := s.cfg.GetPaths()
 	s.cfg.EnsureDirectories()
 
+	// network and ip describe a single interface; nics describes each
+	// interface in guest order
+	nics := []vm.NIC{{Network: req.Network, IPAddress: req.IP}}
+	if len(req.NICs) > 0 {
+		if req.Network != "" || req.IP != "" {
+			jsonError(w, "nics cannot be combined with network or ip", http.StatusBadRequest)
+			return
+		}
+		nics = nil
+		for _, n := range req.NICs {
+			nics = append(nics, vm.NIC{Network: n.Network, IPAddress: n.IP})
+		}
+	}
+	for _, nic := range nics {
+		netDef, err := s.cfg.Networks().Get(nic.Network)
+		if err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if nic.IPAddress != "" {
+			if err := netDef.IPAM(paths.State).ValidateAddress(nic.IPAddress); err != nil {
+				jsonError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
 	if vm.Exists(paths.VMs, req.Name) {
 		jsonError(w, fmt.Sprintf("VM '%s' already exists", req.Name), http.StatusConflict)
 		return
@@ -647,20 +611,34 @@ func (s *Server) handleAPIVMCreate(w http.ResponseWriter, r *http.Request) {
 	newVM.DiskSizeMB = req.DiskSizeMB
 	newVM.Image = req.Image
 	newVM.Kernel = req.Kernel
-	newVM.MacAddress = newVM.GenerateMacAddress()
-	newVM.TapDevice = network.GenerateTapName(newVM.ID)
+	newVM.KernelArgs = req.KernelArgs
+	newVM.Initrd = req.Initrd
+	if req.Thin {
+		imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
+		newVM.BaseImage = imgMgr.GetDefaultRootfsPath()
+		if req.Image != "" {
+			newVM.BaseImage = imgMgr.GetImagePath(req.Image)
+		}
+	}
+	for i := range nics {
+		nics[i].TapDevice = network.GenerateNICTapName(newVM.ID, i)
+		nics[i].MacAddress = newVM.GenerateNICMacAddress(i)
+	}
+	newVM.NIC, newVM.NICs = nics[0], nics[1:]
 	newVM.DNSServers = req.DNSServers
 	newVM.SSHPublicKey = req.SSHKey
 	newVM.PortForwards = req.PortForwards
+	newVM.RateLimits = req.RateLimits
 	newVM.SocketPath = fmt.Sprintf("%s/%s.sock", paths.Sockets, req.Name)
 
-	if err := newVM.Save(paths.VMs); err != nil {
-		jsonError(w, "Failed to create VM: "+err.Error(), http.StatusInternalServerError)
+	created, err := s.backend().Create(newVM)
+	if err != nil {
+		jsonError(w, "Failed to create VM: "+err.Error(), backendErrorCode(err))
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
-	jsonResponse(w, newVM)
+	jsonResponse(w, created)
 }
 
 func (s *Server) handleAPIVMStart(w http.ResponseWriter, r *http.Request) {
@@ -671,52 +649,163 @@ func (s *Server) handleAPIVMStop(w http.ResponseWriter, r *http.Request) {
 	s.handleVMStop(w, r)
 }
 
-func (s *Server) handleAPIVMDelete(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleAPIVMPause(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "name")
 	if err := validate.VMName(name); err != nil {
 		jsonError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	paths := s.cfg.GetPaths()
 
-	existingVM, err := vm.Load(paths.VMs, name)
+	v, err := s.backend().Pause(name)
 	if err != nil {
-		jsonError(w, "VM not found", http.StatusNotFound)
+		jsonError(w, err.Error(), backendErrorCode(err))
 		return
 	}
+	s.sseBroker.Publish(v.Name, v.State)
 
-	fcClient := firecracker.NewClient()
-	fcClient.UpdateVMState(existingVM)
+	jsonResponse(w, v)
+}
 
-	if existingVM.State == vm.StateRunning {
-		ctx := context.Background()
-		// Never remove the VM record while its process survives
-		if err := fcClient.Terminate(ctx, existingVM); err != nil {
-			existingVM.State = vm.StateError
-			if saveErr := existingVM.Save(paths.VMs); saveErr != nil {
-				log.Printf("failed to save state for VM %s: %v", name, saveErr)
-			}
-			jsonError(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+func (s *Server) handleAPIVMResume(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := validate.VMName(name); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	netMgr := network.NewManager(s.cfg.BridgeName, s.cfg.Subnet, s.cfg.Gateway, s.cfg.HostInterface)
-	if existingVM.TapDevice != "" && netMgr.TapExists(existingVM.TapDevice) {
-		netMgr.DeleteTap(existingVM.TapDevice)
+	v, err := s.backend().Resume(name)
+	if err != nil {
+		jsonError(w, err.Error(), backendErrorCode(err))
+		return
 	}
+	s.sseBroker.Publish(v.Name, v.State)
 
-	for _, pf := range existingVM.PortForwards {
-		if existingVM.IPAddress != "" {
-			netMgr.RemovePortForward(pf.HostPort, pf.GuestPort, existingVM.IPAddress, pf.Protocol)
-		}
+	jsonResponse(w, v)
+}
+
+func (s *Server) handleAPIVMRateLimits(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := validate.VMName(name); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var limits vm.RateLimits
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := limits.Validate(); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	imgMgr := image.NewManager(paths.Kernels, paths.Rootfs)
-	imgMgr.DeleteVMRootfs(name, paths.VMs)
-	snapshot.NewManager(paths.Snapshots).DeleteAllForVM(name)
-	os.Remove(existingVM.SocketPath)
-	vm.Delete(paths.VMs, name)
+	v, err := s.backend().SetRateLimits(name, &limits)
+	if err != nil {
+		jsonError(w, err.Error(), backendErrorCode(err))
+		return
+	}
+
+	jsonResponse(w, v)
+}
+
+func (s *Server) handleAPIVMBalloon(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := validate.VMName(name); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		TargetMB int `json:"target_mb"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	existing, err := s.backend().Get(name)
+	if err != nil {
+		jsonError(w, err.Error(), backendErrorCode(err))
+		return
+	}
+	if err := existing.ValidateBalloon(req.TargetMB); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	v, err := s.backend().SetBalloon(name, req.TargetMB)
+	if err != nil {
+		jsonError(w, err.Error(), backendErrorCode(err))
+		return
+	}
+
+	jsonResponse(w, v)
+}
+
+func (s *Server) handleAPIVMBoot(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := validate.VMName(name); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var boot vm.Boot
+	if err := json.NewDecoder(r.Body).Decode(&boot); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := boot.Validate(); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	v, err := s.backend().SetBoot(name, boot)
+	if err != nil {
+		jsonError(w, err.Error(), backendErrorCode(err))
+		return
+	}
+
+	jsonResponse(w, v)
+}
+
+func (s *Server) handleAPIVMFlatten(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := validate.VMName(name); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	v, err := s.backend().Flatten(name)
+	if err != nil {
+		jsonError(w, err.Error(), backendErrorCode(err))
+		return
+	}
+
+	jsonResponse(w, v)
+}
+
+func (s *Server) handleAPIVMBalloonStats(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := validate.VMName(name); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	st, err := s.backend().BalloonStats(name)
+	if err != nil {
+		jsonError(w, err.Error(), backendErrorCode(err))
+		return
+	}
+	jsonResponse(w, st)
+}
+
+func (s *Server) handleAPIVMDelete(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := validate.VMName(name); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.backend().Delete(name, true); err != nil {
+		jsonError(w, err.Error(), backendErrorCode(err))
+		return
+	}
 
 	jsonResponse(w, map[string]string{"status": "deleted"})
 }
@@ -727,15 +816,22 @@ func (s *Server) handleAPIHealth(w http.ResponseWriter, r *http.Request) {
 
 // helpers
 
-func usedVMIPs(vmsDir string) []string {
-	vms, _ := vm.List(vmsDir)
-	var ips []string
-	for _, v := range vms {
-		if v.IPAddress != "" {
-			ips = append(ips, v.IPAddress)
-		}
+// backend returns the VM lifecycle backend: the vmmd daemon when it is
+// running, otherwise an in-process service.
+func (s *Server) backend() daemon.Backend {
+	return daemon.Open(s.cfg)
+}
+
+// backendErrorCode maps a backend error to an HTTP status code.
+func backendErrorCode(err error) int {
+	switch {
+	case errors.Is(err, daemon.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, daemon.ErrConflict):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
 	}
-	return ips
 }
 
 func expandHomePath(path string) string {
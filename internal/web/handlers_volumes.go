@@ -0,0 +1,320 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/raesene/baremetalvmm/internal/diskfile"
+	"github.com/raesene/baremetalvmm/internal/validate"
+	"github.com/raesene/baremetalvmm/internal/vm"
+	"github.com/raesene/baremetalvmm/internal/volume"
+)
+
+// volumeInfo is a volume with its disk usage and the VM it is attached to.
+type volumeInfo struct {
+	*volume.Volume
+	AllocatedBytes int64  `json:"allocated_bytes"`
+	AttachedTo     string `json:"attached_to,omitempty"`
+	MountPath      string `json:"mount_path,omitempty"`
+	ReadOnly       bool   `json:"read_only,omitempty"`
+}
+
+// listVolumes returns all volumes with the VMs they are attached to.
+func (s *Server) listVolumes() ([]volumeInfo, error) {
+	paths := s.cfg.GetPaths()
+	volMgr := volume.NewManager(paths.Volumes)
+	volumes, err := volMgr.List()
+	if err != nil {
+		return nil, err
+	}
+	vms, _ := vm.List(paths.VMs)
+
+	infos := make([]volumeInfo, 0, len(volumes))
+	for _, v := range volumes {
+		info := volumeInfo{Volume: v}
+		if st, err := os.Stat(volMgr.ImagePath(v.Name)); err == nil {
+			info.AllocatedBytes = diskfile.AllocatedSize(st)
+		}
+		for _, existing := range vms {
+			if att := existing.Volume(v.Name); att != nil {
+				info.AttachedTo, info.MountPath, info.ReadOnly = existing.Name, att.MountPath, att.ReadOnly
+				break
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (s *Server) handleVolumes(w http.ResponseWriter, r *http.Request) {
+	s.renderVolumesFlash(w, r, "", "")
+}
+
+func (s *Server) handleVolumeCreate(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if err := validate.VolumeName(name); err != nil {
+		s.renderVolumesFlash(w, r, err.Error(), "error")
+		return
+	}
+	sizeMB, err := strconv.Atoi(r.FormValue("size_mb"))
+	if err != nil {
+		s.renderVolumesFlash(w, r, "Invalid size", "error")
+		return
+	}
+	if err := validate.VolumeSizeMB(sizeMB); err != nil {
+		s.renderVolumesFlash(w, r, err.Error(), "error")
+		return
+	}
+
+	if _, err := volume.NewManager(s.cfg.GetPaths().Volumes).Create(name, sizeMB); err != nil {
+		s.renderVolumesFlash(w, r, "Failed to create volume: "+err.Error(), "error")
+		return
+	}
+
+	s.renderVolumesFlash(w, r, "Volume '"+name+"' created", "success")
+}
+
+func (s *Server) handleVolumeResize(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := validate.VolumeName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sizeMB, err := strconv.Atoi(r.FormValue("size_mb"))
+	if err != nil {
+		s.renderVolumesFlash(w, r, "Invalid size", "error")
+		return
+	}
+
+	vol, err := s.backend().ResizeVolume(name, sizeMB)
+	if err != nil {
+		s.renderVolumesFlash(w, r, "Failed to resize volume: "+err.Error(), "error")
+		return
+	}
+
+	s.renderVolumesFlash(w, r, fmt.Sprintf("Volume '%s' is now %d MB", vol.Name, vol.SizeMB), "success")
+}
+
+func (s *Server) handleVolumeDelete(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := validate.VolumeName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.backend().DeleteVolume(name); err != nil {
+		s.renderVolumesFlash(w, r, "Failed to delete volume: "+err.Error(), "error")
+		return
+	}
+
+	s.renderVolumesFlash(w, r, "Volume '"+name+"' deleted", "success")
+}
+
+func (s *Server) renderVolumesFlash(w http.ResponseWriter, r *http.Request, msg, flashType string) {
+	volumes, err := s.listVolumes()
+	if err != nil {
+		http.Error(w, "Failed to list volumes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.renderPage(w, r, "volumes.html", "volumes", map[string]interface{}{
+		"Volumes":   volumes,
+		"Flash":     msg,
+		"FlashType": flashType,
+	})
+}
+
+func (s *Server) handleVMVolumeAttach(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := validate.VMName(name); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	att := vm.VolumeAttachment{
+		Name:      r.FormValue("volume"),
+		MountPath: r.FormValue("mount_path"),
+		ReadOnly:  r.FormValue("read_only") == "on",
+	}
+	if err := validate.VolumeName(att.Name); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if att.MountPath != "" {
+		if err := validate.GuestMountPath(att.MountPath); err != nil {
+			httpError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if _, err := s.backend().AttachVolume(name, att); err != nil {
+		httpError(w, r, err.Error(), backendErrorCode(err))
+		return
+	}
+
+	http.Redirect(w, r, "/vms/"+name, http.StatusSeeOther)
+}
+
+func (s *Server) handleVMVolumeDetach(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := validate.VMName(name); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	volumeName := chi.URLParam(r, "volume")
+	if err := validate.VolumeName(volumeName); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := s.backend().DetachVolume(name, volumeName); err != nil {
+		httpError(w, r, err.Error(), backendErrorCode(err))
+		return
+	}
+
+	http.Redirect(w, r, "/vms/"+name, http.StatusSeeOther)
+}
+
+// JSON API handlers
+
+func (s *Server) handleAPIVolumeList(w http.ResponseWriter, r *http.Request) {
+	volumes, err := s.listVolumes()
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, volumes)
+}
+
+func (s *Server) handleAPIVolumeCreate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name   string `json:"name"`
+		SizeMB int    `json:"size_mb"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.SizeMB == 0 {
+		req.SizeMB = 1024
+	}
+	if err := validate.VolumeName(req.Name); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validate.VolumeSizeMB(req.SizeMB); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	volMgr := volume.NewManager(s.cfg.GetPaths().Volumes)
+	if volMgr.Exists(req.Name) {
+		jsonError(w, "volume '"+req.Name+"' already exists", http.StatusConflict)
+		return
+	}
+	vol, err := volMgr.Create(req.Name, req.SizeMB)
+	if err != nil {
+		jsonError(w, "Failed to create volume: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	jsonResponse(w, vol)
+}
+
+func (s *Server) handleAPIVolumeResize(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := validate.VolumeName(name); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		SizeMB int `json:"size_mb"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validate.VolumeSizeMB(req.SizeMB); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vol, err := s.backend().ResizeVolume(name, req.SizeMB)
+	if err != nil {
+		jsonError(w, err.Error(), backendErrorCode(err))
+		return
+	}
+
+	jsonResponse(w, vol)
+}
+
+func (s *Server) handleAPIVolumeDelete(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := validate.VolumeName(name); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.backend().DeleteVolume(name); err != nil {
+		jsonError(w, err.Error(), backendErrorCode(err))
+		return
+	}
+
+	jsonResponse(w, map[string]string{"status": "deleted"})
+}
+
+func (s *Server) handleAPIVMVolumeAttach(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := validate.VMName(name); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var att vm.VolumeAttachment
+	if err := json.NewDecoder(r.Body).Decode(&att); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validate.VolumeName(att.Name); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if att.MountPath != "" {
+		if err := validate.GuestMountPath(att.MountPath); err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	v, err := s.backend().AttachVolume(name, att)
+	if err != nil {
+		jsonError(w, err.Error(), backendErrorCode(err))
+		return
+	}
+
+	jsonResponse(w, v)
+}
+
+func (s *Server) handleAPIVMVolumeDetach(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := validate.VMName(name); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	volumeName := chi.URLParam(r, "volume")
+	if err := validate.VolumeName(volumeName); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	v, err := s.backend().DetachVolume(name, volumeName)
+	if err != nil {
+		jsonError(w, err.Error(), backendErrorCode(err))
+		return
+	}
+
+	jsonResponse(w, v)
+}
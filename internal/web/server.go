@@ -78,6 +78,9 @@ func (s *Server) loadTemplates() error {
 		"divFloat": func(a int64, b int64) float64 {
 			return float64(a) / float64(b)
 		},
+		"add": func(a, b int) int {
+			return a + b
+		},
 	}
 
 	s.templates = make(map[string]*template.Template)
@@ -90,6 +93,7 @@ func (s *Server) loadTemplates() error {
 		"clusters.html",
 		"cluster_create.html",
 		"images.html",
+		"volumes.html",
 		"api_key.html",
 		"config.html",
 	}
@@ -151,6 +155,7 @@ func (s *Server) setupRouter() {
 
 		// WebSocket terminal
 		r.Get("/ws/vms/{name}/terminal", s.handleTerminalWS)
+		r.Get("/ws/vms/{name}/console", s.handleConsoleWS)
 
 		// API key page
 		r.Get("/api-key", s.handleAPIKeyPage)
@@ -162,7 +167,13 @@ func (s *Server) setupRouter() {
 		r.Get("/vms/{name}", s.handleVMDetail)
 		r.Post("/vms/{name}/start", s.handleVMStart)
 		r.Post("/vms/{name}/stop", s.handleVMStop)
+		r.Post("/vms/{name}/pause", s.handleVMPause)
+		r.Post("/vms/{name}/resume", s.handleVMResume)
+		r.Post("/vms/{name}/flatten", s.handleVMFlatten)
+		r.Post("/vms/{name}/volumes", s.handleVMVolumeAttach)
+		r.Post("/vms/{name}/volumes/{volume}/detach", s.handleVMVolumeDetach)
 		r.Get("/vms/{name}/terminal", s.handleTerminalPage)
+		r.Get("/vms/{name}/console", s.handleConsolePage)
 		r.Delete("/vms/{name}", s.handleVMDelete)
 		r.Post("/vms/{name}/delete", s.handleVMDeletePost)
 		r.Post("/vms/{name}/snapshots", s.handleSnapshotCreate)
@@ -172,10 +183,17 @@ func (s *Server) setupRouter() {
 		// Image management HTML routes
 		r.Get("/images", s.handleImages)
 		r.Post("/images/kernels/delete", s.handleKernelDelete)
+		r.Post("/images/initrds/delete", s.handleInitrdDelete)
 		r.Post("/images/rootfs/delete", s.handleRootfsDelete)
 		r.Post("/images/kernels/download", s.handleKernelDownload)
 		r.Post("/images/rootfs/download", s.handleRootfsDownload)
 
+		// Volume HTML routes
+		r.Get("/volumes", s.handleVolumes)
+		r.Post("/volumes", s.handleVolumeCreate)
+		r.Post("/volumes/{name}/resize", s.handleVolumeResize)
+		r.Post("/volumes/{name}/delete", s.handleVolumeDelete)
+
 		// Config HTML routes
 		r.Get("/config", s.handleConfigPage)
 		r.Post("/config", s.handleConfigUpdate)
@@ -195,10 +213,20 @@ func (s *Server) setupRouter() {
 			r.Get("/vms/{name}", s.handleAPIVMDetail)
 			r.Post("/vms/{name}/start", s.handleAPIVMStart)
 			r.Post("/vms/{name}/stop", s.handleAPIVMStop)
+			r.Post("/vms/{name}/pause", s.handleAPIVMPause)
+			r.Post("/vms/{name}/resume", s.handleAPIVMResume)
+			r.Put("/vms/{name}/rate-limits", s.handleAPIVMRateLimits)
+			r.Get("/vms/{name}/balloon", s.handleAPIVMBalloonStats)
+			r.Put("/vms/{name}/balloon", s.handleAPIVMBalloon)
+			r.Put("/vms/{name}/boot", s.handleAPIVMBoot)
+			r.Post("/vms/{name}/flatten", s.handleAPIVMFlatten)
+			r.Post("/vms/{name}/volumes", s.handleAPIVMVolumeAttach)
+			r.Delete("/vms/{name}/volumes/{volume}", s.handleAPIVMVolumeDetach)
 			r.Delete("/vms/{name}", s.handleAPIVMDelete)
 			r.Get("/vms/{name}/snapshots", s.handleAPISnapshotList)
 			r.Post("/vms/{name}/snapshots", s.handleAPISnapshotCreate)
 			r.Post("/vms/{name}/snapshots/{snapshot}/restore", s.handleAPISnapshotRestore)
+			r.Post("/vms/{name}/snapshots/{snapshot}/clone", s.handleAPISnapshotClone)
 			r.Delete("/vms/{name}/snapshots/{snapshot}", s.handleAPISnapshotDelete)
 
 			r.Get("/clusters", s.handleAPIClusterList)
@@ -207,7 +235,13 @@ func (s *Server) setupRouter() {
 
 			r.Get("/images", s.handleAPIImageList)
 			r.Delete("/images/kernels", s.handleAPIKernelDelete)
+			r.Delete("/images/initrds", s.handleAPIInitrdDelete)
 			r.Delete("/images/rootfs", s.handleAPIRootfsDelete)
+
+			r.Get("/volumes", s.handleAPIVolumeList)
+			r.Post("/volumes", s.handleAPIVolumeCreate)
+			r.Post("/volumes/{name}/resize", s.handleAPIVolumeResize)
+			r.Delete("/volumes/{name}", s.handleAPIVolumeDelete)
 		})
 	})
 
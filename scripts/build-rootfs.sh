@@ -5,7 +5,7 @@
 # This script creates an ext4 rootfs image from a Docker base image,
 # configured for Firecracker microVMs with systemd, SSH, and networking.
 #
-# Usage: build-rootfs.sh --name <name> [--output <dir>] [--size <MB>] [--base-image <image>]
+# Usage: build-rootfs.sh --name <name> [--output <dir>] [--size <MB>] [--base-image <image>] [--agent <path>]
 #
 # Requires: Docker, root, mkfs.ext4, tar, mount, chroot
 #
@@ -19,6 +19,7 @@ SIZE_MB=512
 BASE_IMAGE="ubuntu:24.04"
 CLEANUP=true
 TMP_DIR=""
+AGENT_BIN=""
 
 # Colors for output
 RED='\033[0;31m'
@@ -28,7 +29,7 @@ NC='\033[0m' # No Color
 
 usage() {
     cat <<EOF
-Usage: $0 --name <name> [--output <dir>] [--size <MB>] [--base-image <image>]
+Usage: $0 --name <name> [--output <dir>] [--size <MB>] [--base-image <image>] [--agent <path>]
 
 Build a Firecracker-compatible rootfs image from a Docker base image.
 
@@ -37,12 +38,14 @@ Options:
   --output DIR          Output directory (default: /var/lib/vmm/images/rootfs)
   --size MB             Image size in MB (default: 512)
   --base-image IMAGE    Docker base image (default: ubuntu:24.04)
+  --agent PATH          Install this vmm-agent binary as the guest agent
   --no-cleanup          Keep temporary directory after completion
   --help                Show this help message
 
 Examples:
   $0 --name rootfs.ext4 --size 512
   $0 --name rootfs.ext4 --base-image ubuntu:24.04 --output /tmp
+  $0 --name rootfs.ext4 --agent ./vmm-agent
 EOF
     exit 1
 }
@@ -260,6 +263,40 @@ NET_EOF
     ln -sf /lib/systemd/system/systemd-networkd.service \
         "$wants_dir/systemd-networkd.service"
 
+    # Firecracker has no power-off device, so a guest that halts leaves its
+    # process running. Reboot instead once systemd has stopped everything:
+    # Firecracker exits and vmm marks the VM stopped.
+    mkdir -p "$rootfs_dir/usr/lib/systemd/system-shutdown"
+    cat > "$rootfs_dir/usr/lib/systemd/system-shutdown/vmm-poweroff" <<'SHUTDOWN_EOF'
+#!/bin/sh
+case "$1" in
+    poweroff|halt) exec systemctl --force --force reboot ;;
+esac
+SHUTDOWN_EOF
+    chmod 0755 "$rootfs_dir/usr/lib/systemd/system-shutdown/vmm-poweroff"
+
+    # Install the guest agent, used by vmm exec/cp and for clean shutdown
+    if [ -n "$AGENT_BIN" ]; then
+        log_info "Installing guest agent..."
+        install -m 0755 "$AGENT_BIN" "$rootfs_dir/usr/local/bin/vmm-agent"
+        cat > "$rootfs_dir/etc/systemd/system/vmm-agent.service" <<'AGENT_EOF'
+[Unit]
+Description=VMM guest agent
+DefaultDependencies=no
+After=local-fs.target
+
+[Service]
+ExecStart=/usr/local/bin/vmm-agent
+Restart=always
+RestartSec=1
+
+[Install]
+WantedBy=multi-user.target
+AGENT_EOF
+        ln -sf /etc/systemd/system/vmm-agent.service \
+            "$wants_dir/vmm-agent.service"
+    fi
+
     # Lock root password (SSH key login only)
     if [ -f "$rootfs_dir/etc/shadow" ]; then
         sed -i 's|^root:[^:]*:|root:*:|' "$rootfs_dir/etc/shadow"
@@ -315,6 +352,10 @@ while [[ $# -gt 0 ]]; do
             BASE_IMAGE="$2"
             shift 2
             ;;
+        --agent)
+            AGENT_BIN="$2"
+            shift 2
+            ;;
         --no-cleanup)
             CLEANUP=false
             shift
@@ -335,6 +376,11 @@ if [ -z "$NAME" ]; then
     usage
 fi
 
+if [ -n "$AGENT_BIN" ] && [ ! -f "$AGENT_BIN" ]; then
+    log_error "Agent binary not found: $AGENT_BIN"
+    exit 1
+fi
+
 # Check if running as root
 if [ "$(id -u)" -ne 0 ]; then
     log_error "This script must be run as root"
@@ -26,6 +26,12 @@ fi
 echo "Installing vmm systemd service..."
 cp "$SCRIPT_DIR/vmm.service" "$SERVICE_DIR/vmm.service"
 
+# Install vmmd systemd service if binary exists
+if command -v vmmd &> /dev/null; then
+    echo "Installing vmmd systemd service..."
+    cp "$SCRIPT_DIR/vmmd.service" "$SERVICE_DIR/vmmd.service"
+fi
+
 # Install vmm-web systemd service if binary exists
 if command -v vmm-web &> /dev/null; then
     echo "Installing vmm-web systemd service..."
@@ -52,6 +58,14 @@ echo "  sudo systemctl enable vmm"
 echo "  sudo systemctl start vmm"
 echo "  sudo systemctl status vmm"
 
+if command -v vmmd &> /dev/null; then
+    echo ""
+    echo "VMM daemon (owns VM lifecycle; vmm and vmm-web use it when running):"
+    echo "  sudo systemctl enable vmmd"
+    echo "  sudo systemctl start vmmd"
+    echo "  sudo systemctl status vmmd"
+fi
+
 if command -v vmm-web &> /dev/null; then
     echo ""
     echo "VMM Web UI:"
@@ -85,7 +85,7 @@ if [ "$SKIP_CONFIRM" = false ]; then
     echo "  - Remove all VM data (/var/lib/vmm)"
     echo "  - Remove user configuration (~/.config/vmm)"
     echo "  - Remove network bridge and TAP devices"
-    echo "  - Remove iptables rules"
+    echo "  - Remove nftables and legacy iptables rules"
     echo "  - Remove systemd service"
     echo ""
     read -p "Are you sure you want to continue? [y/N] " -n 1 -r
@@ -162,10 +162,24 @@ else
     echo "  Bridge $BRIDGE_NAME not found"
 fi
 
-# 5. Remove iptables rules
-echo "Removing iptables rules..."
+# 5. Remove nftables and legacy iptables rules
+echo "Removing firewall rules..."
 RULES_REMOVED=0
 
+if command -v nft &>/dev/null && nft list table inet vmm &>/dev/null; then
+    nft delete table inet vmm 2>/dev/null || true
+    echo -e "  ${GREEN}Removed nftables table inet vmm${NC}"
+    RULES_REMOVED=$((RULES_REMOVED + 1))
+fi
+
+if command -v nft &>/dev/null && nft list table bridge vmm &>/dev/null; then
+    nft delete table bridge vmm 2>/dev/null || true
+    echo -e "  ${GREEN}Removed nftables table bridge vmm${NC}"
+    RULES_REMOVED=$((RULES_REMOVED + 1))
+fi
+
+# Rules added by versions of vmm that used iptables
+
 # Remove NAT MASQUERADE rule (matches Go code: ! -o bridge, not -o host_iface)
 if iptables -t nat -C POSTROUTING -s "$SUBNET" ! -o "$BRIDGE_NAME" -j MASQUERADE 2>/dev/null; then
     iptables -t nat -D POSTROUTING -s "$SUBNET" ! -o "$BRIDGE_NAME" -j MASQUERADE 2>/dev/null || true
@@ -199,7 +213,7 @@ while iptables -t nat -L PREROUTING -n --line-numbers 2>/dev/null | grep -q "172
 done
 
 if [ "$RULES_REMOVED" -eq 0 ]; then
-    echo "  No iptables rules found"
+    echo "  No firewall rules found"
 fi
 
 # 6. Remove data directory
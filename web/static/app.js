@@ -23,6 +23,7 @@ document.body.addEventListener('htmx:configRequest', function(event) {
             '<span class="text-gray-400">:</span>' +
             '<input type="number" name="guest_port" min="1" max="65535" placeholder="Guest port" class="w-1/3 px-3 py-2 border border-gray-300 rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500 text-sm">' +
             '<select name="protocol" class="px-3 py-2 border border-gray-300 rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500 text-sm"><option value="tcp">TCP</option><option value="udp">UDP</option></select>' +
+            '<select name="forward_mode" class="px-3 py-2 border border-gray-300 rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500 text-sm" title="NAT uses nftables; proxy is relayed by vmmd"><option value="nat">NAT</option><option value="proxy">Proxy</option></select>' +
             '<button type="button" class="remove-port-forward text-red-500 hover:text-red-700 text-sm px-2" title="Remove">\u2715</button>';
         container.appendChild(row);
     });
@@ -1,11 +1,11 @@
 document.addEventListener("DOMContentLoaded", function () {
     var container = document.getElementById("terminal-container");
     if (container && container.dataset.vmName) {
-        initTerminal(container.dataset.vmName);
+        initTerminal(container.dataset.vmName, container.dataset.endpoint || "terminal");
     }
 });
 
-function initTerminal(vmName) {
+function initTerminal(vmName, endpoint) {
     var statusEl = document.getElementById("terminal-status");
     var statusText = document.getElementById("terminal-status-text");
 
@@ -32,7 +32,7 @@ function initTerminal(vmName) {
     fitAddon.fit();
 
     var protocol = location.protocol === "https:" ? "wss:" : "ws:";
-    var wsUrl = protocol + "//" + location.host + "/ws/vms/" + vmName + "/terminal";
+    var wsUrl = protocol + "//" + location.host + "/ws/vms/" + vmName + "/" + endpoint;
 
     var ws = new WebSocket(wsUrl);
     ws.binaryType = "arraybuffer";